@@ -0,0 +1,79 @@
+package plugin
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// When an endpoint configuration key gets renamed, the old name can be
+// declared as an alias of the new (canonical) one, so that endpoints that
+// were configured before the rename keep working.  The ShieldEndpoint
+// accessors look the canonical key up first, and then each of its aliases,
+// in the order they were declared; using an alias prints a deprecation
+// warning.
+//
+// Aliases are usually declared through the `Aliases` attribute of the
+// plugin Fields, but can also be declared with Alias().
+
+var (
+	aliasLock sync.Mutex
+	aliases   = map[string][]string{}
+	warned    = map[string]bool{}
+
+	// Where deprecation warnings go.
+	deprecationOutput io.Writer = os.Stderr
+)
+
+// Alias declares old names that are still accepted for a canonical key.
+func Alias(canonical string, old ...string) {
+	aliasLock.Lock()
+	defer aliasLock.Unlock()
+	aliases[canonical] = append(aliases[canonical], old...)
+}
+
+func registerAliases(fields []Field) {
+	for _, f := range fields {
+		if len(f.Aliases) > 0 {
+			Alias(f.Name, f.Aliases...)
+		}
+	}
+}
+
+// deprecated prints a warning about the use of an alias, only once per
+// alias.
+func deprecated(format string, alias, canonical string) {
+	aliasLock.Lock()
+	defer aliasLock.Unlock()
+	if warned[alias] {
+		return
+	}
+	warned[alias] = true
+	Fprintf(deprecationOutput, format, alias, canonical)
+}
+
+// lookup retrieves the value of a key, falling back to its aliases if
+// the canonical key is not set.
+func (endpoint ShieldEndpoint) lookup(key string) (interface{}, bool) {
+	aliasLock.Lock()
+	old := aliases[key]
+	aliasLock.Unlock()
+
+	v, ok := endpoint[key]
+	if ok {
+		for _, alias := range old {
+			if _, set := endpoint[alias]; set {
+				deprecated("@Y{DEPRECATED: both '%[2]s' and its old name '%[1]s' are set; ignoring '%[1]s'}\n", alias, key)
+			}
+		}
+		return v, true
+	}
+
+	for _, alias := range old {
+		if v, ok := endpoint[alias]; ok {
+			deprecated("@Y{DEPRECATED: endpoint key '%s' has been renamed '%s'; please update your configuration}\n", alias, key)
+			return v, true
+		}
+	}
+	return nil, false
+}
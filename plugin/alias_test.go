@@ -0,0 +1,78 @@
+package plugin
+
+import (
+	"bytes"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Endpoint Key Aliases", func() {
+	var out bytes.Buffer
+
+	BeforeEach(func() {
+		out.Reset()
+		deprecationOutput = &out
+		aliases = map[string][]string{}
+		warned = map[string]bool{}
+
+		registerAliases([]Field{
+			{Name: "datadirs", Aliases: []string{"datadir", "data_dir"}},
+			{Name: "exclude_keyspaces", Aliases: []string{"exclude_keyspace"}},
+			{Name: "port"},
+		})
+	})
+
+	AfterEach(func() {
+		deprecationOutput = os.Stderr
+		aliases = map[string][]string{}
+		warned = map[string]bool{}
+	})
+
+	It("resolves old names to their canonical key", func() {
+		e := ShieldEndpoint{"exclude_keyspace": []interface{}{"system"}}
+		Ω(e.ArrayValueDefault("exclude_keyspaces", nil)).Should(Equal([]string{"system"}))
+		Ω(out.String()).Should(ContainSubstring("'exclude_keyspace' has been renamed 'exclude_keyspaces'"))
+	})
+
+	It("prefers the canonical key over its aliases", func() {
+		e := ShieldEndpoint{"datadirs": "/new", "datadir": "/old"}
+		Ω(e.StringValue("datadirs")).Should(Equal("/new"))
+		Ω(out.String()).Should(ContainSubstring("ignoring 'datadir'"))
+	})
+
+	It("tries the aliases in the order they were declared", func() {
+		e := ShieldEndpoint{"datadir": "/first", "data_dir": "/second"}
+		Ω(e.StringValue("datadirs")).Should(Equal("/first"))
+
+		e = ShieldEndpoint{"data_dir": "/second"}
+		Ω(e.StringValue("datadirs")).Should(Equal("/second"))
+	})
+
+	It("only warns once per alias", func() {
+		e := ShieldEndpoint{"datadir": "/old"}
+		e.StringValue("datadirs")
+		e.StringValueDefault("datadirs", "")
+		Ω(bytes.Count(out.Bytes(), []byte("DEPRECATED"))).Should(Equal(1))
+	})
+
+	It("does not warn when only the canonical key is used", func() {
+		e := ShieldEndpoint{"datadirs": "/new", "port": "9042"}
+		Ω(e.StringValue("datadirs")).Should(Equal("/new"))
+		Ω(e.StringValue("port")).Should(Equal("9042"))
+		Ω(out.String()).Should(BeEmpty())
+	})
+
+	It("reports type mismatches against the canonical key", func() {
+		e := ShieldEndpoint{"datadir": 42.0}
+		_, err := e.StringValue("datadirs")
+		Ω(err).Should(Equal(EndpointDataTypeMismatchError{Key: "datadirs", DesiredType: "string"}))
+	})
+
+	It("reports missing keys, when neither the key nor its aliases are set", func() {
+		_, err := ShieldEndpoint{}.StringValue("datadirs")
+		Ω(err).Should(Equal(EndpointMissingRequiredDataError{Key: "datadirs"}))
+		Ω(ShieldEndpoint{}.StringValueDefault("datadirs", "/default")).Should(Equal("/default"))
+	})
+})
@@ -150,7 +150,7 @@ func (p AzurePlugin) Validate(endpoint plugin.ShieldEndpoint) error {
 	}
 
 	if fail {
-		return fmt.Errorf("azure: invalid configuration")
+		return plugin.ValidationError{Plugin: "azure"}
 	}
 	return nil
 }
@@ -0,0 +1,64 @@
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// MissingBinariesError is returned by RequireBinaries() when some of the
+// external commands a plugin relies upon cannot be found, or cannot be
+// executed.  Missing holds one "name (reason)" entry per offending command.
+type MissingBinariesError struct {
+	Missing []string
+}
+
+func (e MissingBinariesError) Error() string {
+	return fmt.Sprintf("missing required binaries: %s", strings.Join(e.Missing, ", "))
+}
+
+// RequireBinaries checks that each of the named commands is available.
+// Absolute paths must point to an executable file; other names are looked
+// up in $PATH.  All the commands are checked, and all the missing ones are
+// reported in a single MissingBinariesError.
+func RequireBinaries(names ...string) error {
+	missing := []string{}
+	for _, name := range names {
+		if err := findBinary(name); err != nil {
+			missing = append(missing, fmt.Sprintf("%s (%s)", name, err))
+		}
+	}
+	if len(missing) > 0 {
+		return MissingBinariesError{Missing: missing}
+	}
+	return nil
+}
+
+func findBinary(name string) error {
+	if name == "" {
+		return fmt.Errorf("no command specified")
+	}
+	if !filepath.IsAbs(name) {
+		if _, err := exec.LookPath(name); err != nil {
+			return fmt.Errorf("not found in $PATH")
+		}
+		return nil
+	}
+
+	fi, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no such file")
+	}
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("is a directory")
+	}
+	if fi.Mode()&0111 == 0 {
+		return fmt.Errorf("not executable")
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Required Binaries", func() {
+	var tmp string
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-binaries-")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "runme"), []byte("#!/bin/sh\n"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "readme"), []byte("nope\n"), 0644)).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	It("finds commands in $PATH and by absolute path", func() {
+		Ω(RequireBinaries("sh", filepath.Join(tmp, "runme"))).Should(Succeed())
+		Ω(RequireBinaries()).Should(Succeed())
+	})
+
+	It("reports all the missing commands at once", func() {
+		err := RequireBinaries(
+			"sh",
+			"shield-no-such-command",
+			filepath.Join(tmp, "missing"),
+			filepath.Join(tmp, "readme"),
+			tmp,
+			"",
+		)
+		Ω(err).Should(HaveOccurred())
+
+		missing, ok := err.(MissingBinariesError)
+		Ω(ok).Should(BeTrue())
+		Ω(missing.Missing).Should(Equal([]string{
+			"shield-no-such-command (not found in $PATH)",
+			filepath.Join(tmp, "missing") + " (no such file)",
+			filepath.Join(tmp, "readme") + " (not executable)",
+			tmp + " (is a directory)",
+			" (no command specified)",
+		}))
+		Ω(err.Error()).Should(HavePrefix("missing required binaries: shield-no-such-command (not found in $PATH), "))
+	})
+})
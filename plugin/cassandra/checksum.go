@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Checksummed archives
+//
+// When `cassandra_checksum` is set, the archive is framed with its SHA-256
+// checksum on its way out, past the backup filter (see plugin/checksum.go).
+// Restores check archives that come with a checksum whatever the option
+// says: the checksum is taken off before the restore filter, and the archive
+// is checked once tar has extracted it, before anything is loaded.  Chunked
+// and deduplicated backups are not framed: what they stream is a manifest,
+// and their chunks are stored with checksums of their own.
+
+// checksumOutput wraps `run`, which writes the archive to the file it is
+// given, so that it is followed by its checksum.
+func checksumOutput(run func(out *os.File) error) func(out *os.File) error {
+	return func(out *os.File) error {
+		w, wait, err := plugin.ChecksumOutput(out)
+		if err != nil {
+			return err
+		}
+		err = run(w)
+		w.Close()
+		if werr := wait(); err == nil {
+			err = werr
+		}
+		return err
+	}
+}
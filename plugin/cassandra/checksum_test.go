@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("Checksummed Archives", func() {
+	var (
+		tmp       string
+		cassandra *CassandraInfo
+		sstable   = bytes.Repeat([]byte("sstable data "), 10000)
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-cassandra-checksum-")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(os.MkdirAll(filepath.Join(tmp, "backup", "ks1", "t1"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "backup", "ks1", "t1", "mc-1-big-Data.db"), sstable, 0644)).Should(Succeed())
+		Ω(os.MkdirAll(filepath.Join(tmp, "restore"), 0755)).Should(Succeed())
+		cassandra = &CassandraInfo{Tar: "tar"}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	backup := func(archive func(out *os.File) error) []byte {
+		out, err := os.Create(filepath.Join(tmp, "archive"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(checksumOutput(archive)(out)).Should(Succeed())
+		out.Close()
+
+		b, err := ioutil.ReadFile(filepath.Join(tmp, "archive"))
+		Ω(err).ShouldNot(HaveOccurred())
+		return b
+	}
+
+	restore := func(archive []byte) error {
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "archive"), archive, 0644)).Should(Succeed())
+		stdin := os.Stdin
+		defer func() { os.Stdin = stdin }()
+		var err error
+		os.Stdin, err = os.Open(filepath.Join(tmp, "archive"))
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.Stdin.Close()
+		return extractArchive(cassandra, filepath.Join(tmp, "restore"))
+	}
+
+	tar := func(out *os.File) error {
+		return plugin.ExecWithOptions(plugin.ExecOptions{Cmd: "tar -c -C " + filepath.Join(tmp, "backup") + " -f - .", Stdout: out})
+	}
+
+	It("restores checksummed archives, through the filters", func() {
+		cassandra.RestoreFilter = "gzip -dc"
+		archive := backup(filterOutput("gzip -c", tar))
+		Ω(archive).Should(HavePrefix(plugin.ChecksumFormat + " sha256\n"))
+
+		Ω(restore(archive)).Should(Succeed())
+		Ω(ioutil.ReadFile(filepath.Join(tmp, "restore", "ks1", "t1", "mc-1-big-Data.db"))).Should(Equal(sstable))
+	})
+
+	It("fails the restore of archives corrupted in ways tar does not notice", func() {
+		archive := backup(tar)
+		i := bytes.Index(archive, sstable)
+		Ω(i).Should(BeNumerically(">", 0))
+		archive[i+len(sstable)/2] ^= 0x01
+
+		err := restore(archive)
+		Ω(err).Should(BeAssignableToTypeOf(plugin.ChecksumError{}))
+		Ω(err.Error()).Should(ContainSubstring("sha256"))
+	})
+
+	It("fails the restore of truncated archives", func() {
+		archive := backup(tar)
+		err := restore(archive[:len(archive)-plugin.ChecksumTrailerSize-512])
+		Ω(err).Should(BeAssignableToTypeOf(plugin.ChecksumError{}))
+	})
+
+	It("restores archives without a checksum as they come", func() {
+		archive := backup(tar)
+		Ω(restore(archive[len(plugin.ChecksumFormat+" sha256\n") : len(archive)-plugin.ChecksumTrailerSize])).Should(Succeed())
+		Ω(ioutil.ReadFile(filepath.Join(tmp, "restore", "ks1", "t1", "mc-1-big-Data.db"))).Should(Equal(sstable))
+	})
+})
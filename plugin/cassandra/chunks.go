@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Chunked backups
+//
+// When `cassandra_chunk_size` is set, the tar archive is not streamed to
+// SHIELD: it is cut into chunks of (at most) that size, that are stored one
+// by one, in order, with the storage plugin configured in
+// `cassandra_chunk_store`.  What SHIELD gets (and stores with the storage
+// of the job) is a small JSON manifest, that lists the chunks:
+//
+//    {
+//      "format"     : "shield-cassandra-chunks/1",
+//      "chunk_size" : 1073741824,
+//      "count"      : 2,
+//      "size"       : 1610612736,
+//      "chunks"     : [
+//        { "index": 1, "key": "...", "size": 1073741824, "sha256": "..." },
+//        { "index": 2, "key": "...", "size": 536870912,  "sha256": "..." }
+//      ]
+//    }
+//
+// Chunks are numbered from 1, in archive order; their names are the keys
+// the chunk store returned for them.  On restore, if the archive read from
+// standard input turns out to be such a manifest, the chunks are retrieved
+// in index order, checked against their size and SHA-256, and concatenated
+// back into the original archive.
+
+const ChunkManifestFormat = "shield-cassandra-chunks/1"
+
+// ChunkStore is the storage plugin (and its endpoint) that holds chunks.
+type ChunkStore struct {
+	Plugin   string                 `json:"plugin"`
+	Endpoint map[string]interface{} `json:"endpoint"`
+}
+
+type Chunk struct {
+	Index  int    `json:"index"`
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type ChunkManifest struct {
+	Format    string  `json:"format"`
+	ChunkSize int64   `json:"chunk_size"`
+	Count     int     `json:"count"`
+	Size      int64   `json:"size"`
+	Chunks    []Chunk `json:"chunks"`
+}
+
+// chunkDigest hashes and counts what goes through it.
+type chunkDigest struct {
+	sha  hash.Hash
+	size int64
+}
+
+func newChunkDigest() *chunkDigest {
+	return &chunkDigest{sha: sha256.New()}
+}
+
+func (d *chunkDigest) Write(b []byte) (int, error) {
+	d.size += int64(len(b))
+	return d.sha.Write(b)
+}
+
+func (d *chunkDigest) sum() string {
+	return hex.EncodeToString(d.sha.Sum(nil))
+}
+
+// storeChunk stores what it reads from `in` as a single chunk.
+func storeChunk(store ChunkStore, in io.Reader) (string, error) {
+	cmd, err := plugin.SubPluginCommand(store.Plugin, store.Endpoint, "store")
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	cmd.Stdin = in
+	cmd.Stdout = &out
+	if err = cmd.Run(); err != nil {
+		return "", err
+	}
+
+	var result struct {
+		Key string `json:"key"`
+	}
+	if err = json.Unmarshal(out.Bytes(), &result); err != nil {
+		return "", fmt.Errorf("unable to parse the output of the chunk store: %s", err)
+	}
+	if result.Key == "" {
+		return "", fmt.Errorf("the chunk store returned no key")
+	}
+	return result.Key, nil
+}
+
+// storeChunks cuts the archive read from `in` into chunks of `size` bytes,
+// and stores them.  The manifest lists the chunks that were stored, even
+// when it fails, so that they can be purged.
+func storeChunks(in io.Reader, size int64, store ChunkStore) (*ChunkManifest, error) {
+	manifest := &ChunkManifest{
+		Format:    ChunkManifestFormat,
+		ChunkSize: size,
+		Chunks:    []Chunk{},
+	}
+
+	r := bufio.NewReader(in)
+	for {
+		/* don't store an empty chunk at the end of the archive */
+		if _, err := r.Peek(1); err == io.EOF && manifest.Count > 0 {
+			return manifest, nil
+		} else if err != nil && err != io.EOF {
+			return manifest, err
+		}
+
+		index := manifest.Count + 1
+		digest := newChunkDigest()
+		key, err := storeChunk(store, io.TeeReader(io.LimitReader(r, size), digest))
+		if err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Store chunk #%d}  %s\n", index, err)
+			return manifest, err
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Store chunk #%d}  @C{%s} (%d bytes)\n", index, key, digest.size)
+
+		manifest.Chunks = append(manifest.Chunks, Chunk{
+			Index:  index,
+			Key:    key,
+			Size:   digest.size,
+			SHA256: digest.sum(),
+		})
+		manifest.Count++
+		manifest.Size += digest.size
+		if digest.size < size {
+			if _, err := r.Peek(1); err != io.EOF {
+				return manifest, fmt.Errorf("the chunk store stopped reading chunk #%d after %d bytes", index, digest.size)
+			}
+			return manifest, nil
+		}
+	}
+}
+
+// purgeChunk removes a single chunk from the chunk store.
+func purgeChunk(store ChunkStore, key string) error {
+	cmd, err := plugin.SubPluginCommand(store.Plugin, store.Endpoint, "purge", "-k", key)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = os.Stderr
+	return cmd.Run()
+}
+
+// retrieveChunk writes a single chunk to `out`.
+func retrieveChunk(store ChunkStore, key string, out io.Writer) error {
+	cmd, err := plugin.SubPluginCommand(store.Plugin, store.Endpoint, "retrieve", "-k", key)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = out
+	return cmd.Run()
+}
+
+// purge removes the chunks of the manifest from the chunk store.
+func (m *ChunkManifest) purge(store ChunkStore) {
+	for _, chunk := range m.Chunks {
+		if err := purgeChunk(store, chunk.Key); err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Purge chunk #%d}  %s: %s\n", chunk.Index, chunk.Key, err)
+			continue
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Purge chunk #%d}  @C{%s}\n", chunk.Index, chunk.Key)
+	}
+}
+
+// check makes sure the manifest describes a whole archive.
+func (m *ChunkManifest) check() error {
+	if m.Format != ChunkManifestFormat {
+		return fmt.Errorf("unsupported chunk manifest format '%s'", m.Format)
+	}
+	if len(m.Chunks) != m.Count {
+		return fmt.Errorf("chunk manifest lists %d chunks, instead of %d", len(m.Chunks), m.Count)
+	}
+	var size int64
+	for i, chunk := range m.Chunks {
+		if chunk.Index != i+1 {
+			return fmt.Errorf("chunk manifest lists chunk #%d at position %d", chunk.Index, i+1)
+		}
+		size += chunk.Size
+	}
+	if size != m.Size {
+		return fmt.Errorf("chunks of the manifest add up to %d bytes, instead of %d", size, m.Size)
+	}
+	return nil
+}
+
+// retrieveChunks writes the archive the manifest describes to `out`,
+// checking each chunk on the way.
+func retrieveChunks(m *ChunkManifest, store ChunkStore, out io.Writer) error {
+	if err := m.check(); err != nil {
+		return err
+	}
+
+	for _, chunk := range m.Chunks {
+		digest := newChunkDigest()
+		if err := retrieveChunk(store, chunk.Key, io.MultiWriter(out, digest)); err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Retrieve chunk #%d of %d}  %s\n", chunk.Index, m.Count, err)
+			return err
+		}
+		if digest.size != chunk.Size || digest.sum() != chunk.SHA256 {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Retrieve chunk #%d of %d}  corrupted\n", chunk.Index, m.Count)
+			return fmt.Errorf("chunk #%d (%s) is corrupted: got %d bytes with SHA-256 %s, expected %d bytes with SHA-256 %s",
+				chunk.Index, chunk.Key, digest.size, digest.sum(), chunk.Size, chunk.SHA256)
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Retrieve chunk #%d of %d}\n", chunk.Index, m.Count)
+	}
+	return nil
+}
+
+// chunkedArchive streams the tar archive into chunks, instead of standard
+// output, while tar runs, and then prints the manifest on standard output.
+func chunkedArchive(cassandra *CassandraInfo, run func(out *os.File) error) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	var (
+		manifest *ChunkManifest
+		serr     error
+		done     = make(chan struct{})
+	)
+	go func() {
+		manifest, serr = storeChunks(r, cassandra.ChunkSize, *cassandra.ChunkStore)
+		/* a failing chunk store must not leave tar hanging */
+		r.Close()
+		close(done)
+	}()
+	err = run(w)
+	w.Close()
+	<-done
+
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		manifest.purge(*cassandra.ChunkStore)
+		return err
+	}
+
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		manifest.purge(*cassandra.ChunkStore)
+		return err
+	}
+	fmt.Printf("%s\n", b)
+	return nil
+}
+
+// archiveInput returns where to read the tar archive to restore from.  That
+// is standard input, unless a chunk store is configured: the archive may
+// then be a chunk manifest, in which case it is reassembled from its chunks,
+// a dedup manifest, in which case it is rebuilt from the files it lists, or
+// a split manifest, in which case the archives of the keyspaces to restore
+// are multiplexed into it.  The returned function waits for that to be done.
+func archiveInput(cassandra *CassandraInfo) (*os.File, func() error, error) {
+	if cassandra.ChunkStore == nil {
+		return os.Stdin, func() error { return nil }, nil
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	chunked := fmt.Sprintf(`{"format":"%s"`, ChunkManifestFormat)
+	dedup := fmt.Sprintf(`{"format":"%s"`, DedupManifestFormat)
+	split := fmt.Sprintf(`{"format":"%s"`, SplitManifestFormat)
+	b, _ := in.Peek(len(chunked))
+	head := string(b)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	errs := make(chan error, 1)
+	switch {
+	case strings.HasPrefix(head, dedup):
+		var manifest DedupManifest
+		if err = json.NewDecoder(in).Decode(&manifest); err != nil {
+			r.Close()
+			w.Close()
+			return nil, nil, fmt.Errorf("invalid dedup manifest: %s", err)
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Read dedup manifest}  %d files, %d bytes\n", len(manifest.Files), manifest.Size)
+		go func() {
+			err := retrieveDedup(&manifest, *cassandra.ChunkStore, w)
+			w.Close()
+			errs <- err
+		}()
+
+	case strings.HasPrefix(head, split):
+		var manifest SplitManifest
+		if err = json.NewDecoder(in).Decode(&manifest); err != nil {
+			r.Close()
+			w.Close()
+			return nil, nil, fmt.Errorf("invalid split manifest: %s", err)
+		}
+		if cassandra.RestoreFilter != "" {
+			r.Close()
+			w.Close()
+			return nil, nil, plugin.ConfigError{Key: "cassandra_restore_filter", Err: fmt.Errorf("per-keyspace archives are not filtered; unset cassandra_restore_filter to restore them")}
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Read split manifest}  %d archives, %d bytes\n", len(manifest.Archives), manifest.Size)
+		go func() {
+			err := retrieveSplit(cassandra, &manifest, w)
+			w.Close()
+			errs <- err
+		}()
+
+	case strings.HasPrefix(head, chunked):
+		var manifest ChunkManifest
+		if err = json.NewDecoder(in).Decode(&manifest); err != nil {
+			r.Close()
+			w.Close()
+			return nil, nil, fmt.Errorf("invalid chunk manifest: %s", err)
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Read chunk manifest}  %d chunks, %d bytes\n", manifest.Count, manifest.Size)
+		go func() {
+			err := retrieveChunks(&manifest, *cassandra.ChunkStore, w)
+			w.Close()
+			errs <- err
+		}()
+
+	default:
+		plugin.DEBUG("not a chunk, dedup or split manifest; restoring the archive as is")
+		go func() {
+			_, err := io.Copy(w, in)
+			w.Close()
+			errs <- err
+		}()
+	}
+
+	return r, func() error {
+		r.Close()
+		return <-errs
+	}, nil
+}
+
+// getChunkStore reads `cassandra_chunk_store`, which is either a JSON
+// object, or a string holding one (as the web UI hands it over).
+func getChunkStore(endpoint plugin.ShieldEndpoint) (*ChunkStore, error) {
+	raw, ok := endpoint["cassandra_chunk_store"]
+	if !ok || raw == nil || raw == "" {
+		return nil, nil
+	}
+	if s, ok := raw.(string); ok {
+		if err := json.Unmarshal([]byte(s), &raw); err != nil {
+			return nil, plugin.ConfigError{Key: "cassandra_chunk_store", Err: fmt.Errorf("invalid JSON: %s", err)}
+		}
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return nil, plugin.ConfigError{Key: "cassandra_chunk_store", Err: err}
+	}
+	var store ChunkStore
+	if err = json.Unmarshal(b, &store); err != nil {
+		return nil, plugin.ConfigError{Key: "cassandra_chunk_store", Err: fmt.Errorf("must be an object with 'plugin' and 'endpoint' keys")}
+	}
+	if store.Plugin == "" {
+		return nil, plugin.ConfigError{Key: "cassandra_chunk_store", Err: fmt.Errorf("no plugin specified")}
+	}
+	return &store, nil
+}
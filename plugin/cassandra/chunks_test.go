@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// chunkStore is a storage plugin that keeps chunks as numbered files, and
+// that fails to store chunk N when a `fail-N` file exists.
+const chunkStore = `#!/bin/sh
+set -e
+dir=$(dirname $0)/chunks
+case $1 in
+store)
+	n=$(( $(ls $dir | wc -l) + 1 ))
+	test ! -f $dir/../fail-$n
+	cat > $dir/chunk-$n
+	echo '{"key":"chunk-'$n'"}'
+	;;
+retrieve)
+	cat $dir/$5
+	;;
+purge)
+	rm $dir/$5
+	;;
+esac
+`
+
+var _ = Describe("Chunked Backups", func() {
+	var (
+		tmp   string
+		store ChunkStore
+		data  []byte
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-cassandra-chunks-")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(os.Mkdir(filepath.Join(tmp, "chunks"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "store"), []byte(chunkStore), 0755)).Should(Succeed())
+		store = ChunkStore{Plugin: filepath.Join(tmp, "store")}
+		data = bytes.Repeat([]byte("0123456789"), 35)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	chunk := func(key string) []byte {
+		b, err := ioutil.ReadFile(filepath.Join(tmp, "chunks", key))
+		Ω(err).ShouldNot(HaveOccurred())
+		return b
+	}
+
+	It("cuts the archive into ordered chunks, and reassembles them", func() {
+		manifest, err := storeChunks(bytes.NewReader(data), 100, store)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(manifest.Count).Should(Equal(4))
+		Ω(manifest.Size).Should(Equal(int64(350)))
+		for i, c := range manifest.Chunks {
+			Ω(c.Index).Should(Equal(i + 1))
+			Ω(c.Key).Should(Equal(fmt.Sprintf("chunk-%d", i+1)))
+			Ω(chunk(c.Key)).Should(Equal(data[i*100 : i*100+int(c.Size)]))
+		}
+		Ω(manifest.Chunks[3].Size).Should(Equal(int64(50)))
+
+		var out bytes.Buffer
+		Ω(retrieveChunks(manifest, store, &out)).Should(Succeed())
+		Ω(out.Bytes()).Should(Equal(data))
+	})
+
+	It("does not store an empty chunk when the archive size is a multiple of the chunk size", func() {
+		manifest, err := storeChunks(bytes.NewReader(data), 35, store)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(manifest.Count).Should(Equal(10))
+		Ω(listDir(filepath.Join(tmp, "chunks"))).Should(HaveLen(10))
+	})
+
+	It("detects corrupted and missing chunks", func() {
+		manifest, err := storeChunks(bytes.NewReader(data), 100, store)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "chunks", "chunk-2"), bytes.Repeat([]byte("x"), 100), 0644)).Should(Succeed())
+		err = retrieveChunks(manifest, store, ioutil.Discard)
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(HavePrefix("chunk #2 (chunk-2) is corrupted"))
+
+		manifest.Chunks = manifest.Chunks[1:]
+		Ω(retrieveChunks(manifest, store, ioutil.Discard)).Should(MatchError("chunk manifest lists 3 chunks, instead of 4"))
+	})
+
+	It("purges the stored chunks when the backup fails", func() {
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "fail-3"), nil, 0644)).Should(Succeed())
+
+		stdout := os.Stdout
+		defer func() { os.Stdout = stdout }()
+		os.Stdout, _ = os.Open(os.DevNull)
+
+		cassandra := &CassandraInfo{ChunkSize: 100, ChunkStore: &store}
+		err := chunkedArchive(cassandra, func(out *os.File) error {
+			_, err := out.Write(data)
+			return err
+		})
+		Ω(err).Should(HaveOccurred())
+		Ω(listDir(filepath.Join(tmp, "chunks"))).Should(BeEmpty())
+	})
+
+	It("restores regular archives and chunk manifests alike", func() {
+		manifest, err := storeChunks(bytes.NewReader(data), 100, store)
+		Ω(err).ShouldNot(HaveOccurred())
+		b, err := json.Marshal(manifest)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		stdin := os.Stdin
+		defer func() { os.Stdin = stdin }()
+		cassandra := &CassandraInfo{ChunkStore: &store}
+		for _, archive := range [][]byte{b, data} {
+			Ω(ioutil.WriteFile(filepath.Join(tmp, "archive"), archive, 0644)).Should(Succeed())
+			os.Stdin, err = os.Open(filepath.Join(tmp, "archive"))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			in, wait, err := archiveInput(cassandra)
+			Ω(err).ShouldNot(HaveOccurred())
+			restored, err := ioutil.ReadAll(in)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(wait()).Should(Succeed())
+			Ω(restored).Should(Equal(data))
+		}
+	})
+
+	It("reads the chunk store from JSON objects and strings", func() {
+		s, err := getChunkStore(map[string]interface{}{})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(s).Should(BeNil())
+
+		s, err = getChunkStore(map[string]interface{}{"cassandra_chunk_store": `{"plugin":"s3","endpoint":{"bucket":"b"}}`})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(s.Plugin).Should(Equal("s3"))
+		Ω(s.Endpoint).Should(Equal(map[string]interface{}{"bucket": "b"}))
+
+		_, err = getChunkStore(map[string]interface{}{"cassandra_chunk_store": map[string]interface{}{"endpoint": "x"}})
+		Ω(err).Should(HaveOccurred())
+	})
+})
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Cleaning up the cluster
+//
+// Backups are per node: backing up a cluster takes one job per node, and
+// aborting such a cluster-wide backup can leave the `shield-backup` snapshot
+// on some of the nodes, holding on to disk space until the next backup of
+// each node clears it.  The `cleanup-cluster` command clears it right away,
+// on this node and on each of `cassandra_peers`, with nodetool: over JMX
+// (`nodetool -h <peer> -p <cassandra_jmx_port>`), or over SSH, with the
+// nodetool of `cassandra_bindir` on the peer, as set by
+// `cassandra_peer_access`.  It goes on past the nodes it fails to reach, and
+// fails once it has tried them all.  It is only ever run by an operator: a
+// failed backup of one node never touches the others.
+//
+// Only the `shield-backup` snapshot is cleared, not the generations that
+// `cassandra_snapshot_generations` keeps on purpose.  Clearing it throws the
+// checkpoints of failed backups (see `cassandra_resume`) away too, as they
+// can't be resumed without their snapshot.
+
+const (
+	DefaultPeerAccess = "jmx"
+	DefaultJMXPort    = 7199
+)
+
+func validPeerAccess(access string) bool {
+	return access == "jmx" || access == "ssh"
+}
+
+// peerClearCommand returns the command line that clears the snapshot on a
+// peer node.
+func peerClearCommand(cassandra *CassandraInfo, peer string) string {
+	clear := fmt.Sprintf("%s/nodetool clearsnapshot -t %s", cassandra.BinDir, SnapshotName)
+	if cassandra.PeerAccess == "ssh" {
+		key := ""
+		if cassandra.SSHKey != "" {
+			key = fmt.Sprintf(" -i \"%s\"", cassandra.SSHKey)
+		}
+		return fmt.Sprintf("ssh -o BatchMode=yes%s \"%s\" \"%s\"", key, peer, clear)
+	}
+
+	auth := ""
+	if cassandra.JMXUser != "" {
+		auth = fmt.Sprintf(" -u \"%s\" -pw \"%s\"", cassandra.JMXUser, cassandra.JMXPassword)
+	}
+	return fmt.Sprintf("%s/nodetool -h \"%s\" -p %d%s clearsnapshot -t %s", cassandra.BinDir, peer, cassandra.JMXPort, auth, SnapshotName)
+}
+
+// CleanupCluster clears the `shield-backup` snapshot on this node and on its
+// peers.
+func (p CassandraPlugin) CleanupCluster(endpoint plugin.ShieldEndpoint, dryRun bool) error {
+	cassandra, err := cassandraInfo(endpoint)
+	if err != nil {
+		return err
+	}
+	if len(cassandra.Peers) == 0 {
+		plugin.Fprintf(os.Stderr, "@Y{cassandra_peers lists no peer node: only the snapshot of this node is cleared}\n")
+	}
+
+	nodes := []string{"this node"}
+	cmds := []string{fmt.Sprintf("%s/nodetool clearsnapshot -t %s", cassandra.BinDir, SnapshotName)}
+	for _, peer := range cassandra.Peers {
+		nodes = append(nodes, peer)
+		cmds = append(cmds, peerClearCommand(cassandra, peer))
+	}
+
+	failed := []string{}
+	for i, node := range nodes {
+		if dryRun {
+			plugin.Fprintf(os.Stderr, "would clear the '%s' snapshot on %s, with `%s`\n", SnapshotName, node, plugin.Redact(cmds[i]))
+			continue
+		}
+		if err := nodetool(cassandra, cmds[i]); err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Clear the '%s' snapshot on %s}  %s\n", SnapshotName, node, err)
+			failed = append(failed, node)
+			continue
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Clear the '%s' snapshot on %s}\n", SnapshotName, node)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to clear the '%s' snapshot on %d of %d nodes: %s", SnapshotName, len(failed), len(nodes), strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("Cluster Cleanup", func() {
+	var (
+		bindir   string
+		endpoint plugin.ShieldEndpoint
+	)
+
+	BeforeEach(func() {
+		var err error
+		bindir, err = ioutil.TempDir("", "nodetool")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		/* a nodetool that logs what it is asked, and can't reach 10.0.0.3 */
+		Ω(ioutil.WriteFile(filepath.Join(bindir, "nodetool"), []byte("#!/bin/sh\n"+
+			"echo \"$@\" >> "+filepath.Join(bindir, "calls")+"\n"+
+			"if [ \"$2\" = 10.0.0.3 ]; then\n"+
+			"  echo \"nodetool: Failed to connect to '10.0.0.3:7199'\" >&2\n"+
+			"  exit 1\n"+
+			"fi\n"), 0755)).Should(Succeed())
+
+		endpoint = plugin.ShieldEndpoint{
+			"cassandra_password": "secret",
+			"cassandra_bindir":   bindir,
+			"cassandra_peers":    []interface{}{"10.0.0.2", "10.0.0.3", "10.0.0.4"},
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(bindir)
+	})
+
+	calls := func() string {
+		b, err := ioutil.ReadFile(filepath.Join(bindir, "calls"))
+		if os.IsNotExist(err) {
+			return ""
+		}
+		Ω(err).ShouldNot(HaveOccurred())
+		return string(b)
+	}
+
+	It("clears the snapshot over JMX on each peer, whatever happened to the others", func() {
+		err := CassandraPlugin{}.CleanupCluster(endpoint, false)
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(Equal("unable to clear the 'shield-backup' snapshot on 1 of 4 nodes: 10.0.0.3"))
+		Ω(calls()).Should(Equal(
+			"clearsnapshot -t shield-backup\n" +
+				"-h 10.0.0.2 -p 7199 clearsnapshot -t shield-backup\n" +
+				"-h 10.0.0.3 -p 7199 clearsnapshot -t shield-backup\n" +
+				"-h 10.0.0.4 -p 7199 clearsnapshot -t shield-backup\n"))
+	})
+
+	It("only clears this node without peers", func() {
+		delete(endpoint, "cassandra_peers")
+		Ω(CassandraPlugin{}.CleanupCluster(endpoint, false)).Should(Succeed())
+		Ω(calls()).Should(Equal("clearsnapshot -t shield-backup\n"))
+	})
+
+	It("runs nothing on a dry run", func() {
+		Ω(CassandraPlugin{}.CleanupCluster(endpoint, true)).Should(Succeed())
+		Ω(calls()).Should(BeEmpty())
+	})
+
+	It("authenticates over JMX, or goes through ssh, as configured", func() {
+		cassandra := &CassandraInfo{BinDir: "/bin", PeerAccess: "jmx", JMXPort: 7299, JMXUser: "admin", JMXPassword: "s3cr3t"}
+		Ω(peerClearCommand(cassandra, "10.0.0.2")).Should(Equal(`/bin/nodetool -h "10.0.0.2" -p 7299 -u "admin" -pw "s3cr3t" clearsnapshot -t shield-backup`))
+
+		cassandra = &CassandraInfo{BinDir: "/bin", PeerAccess: "ssh"}
+		Ω(peerClearCommand(cassandra, "vcap@10.0.0.2")).Should(Equal(`ssh -o BatchMode=yes "vcap@10.0.0.2" "/bin/nodetool clearsnapshot -t shield-backup"`))
+		cassandra.SSHKey = "/etc/peers.key"
+		Ω(peerClearCommand(cassandra, "10.0.0.2")).Should(Equal(`ssh -o BatchMode=yes -i "/etc/peers.key" "10.0.0.2" "/bin/nodetool clearsnapshot -t shield-backup"`))
+	})
+
+	It("refuses unknown ways to reach the peers", func() {
+		endpoint["cassandra_peer_access"] = "rsh"
+		_, err := cassandraInfo(endpoint)
+		Ω(err).Should(BeAssignableToTypeOf(plugin.ConfigError{}))
+		Ω(err.(plugin.ConfigError).Key).Should(Equal("cassandra_peer_access"))
+	})
+})
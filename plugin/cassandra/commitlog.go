@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Commit log archiving
+//
+// Snapshots only restore the data of a node as of the time they were taken.
+// For point-in-time recovery, Cassandra can archive the segments of its
+// commit log as they are closed, with the `archive_command` of its
+// `commitlog_archiving.properties` file (next to `cassandra_config`), and
+// replay archived segments, up to `restore_point_in_time`, when it starts.
+//
+// When `cassandra_commitlog_archiving` is true, backups also collect the
+// segments archived since the snapshot was taken (i.e. those whose files
+// were modified since) into a `shield-commitlogs` directory at the root of
+// the archive, and list them in `shield-manifest.yml`.  The segments are
+// looked for in `cassandra_commitlog_archive_dir`, or else in the directory
+// that the `%name` argument of `archive_command` points into.
+//
+// On restore, when `cassandra_restore_point_in_time` is set and the archive
+// holds segments, they are copied to CommitlogRestoreDir once the SSTables
+// are loaded, and `restore_directories` and `restore_point_in_time` are set
+// in `commitlog_archiving.properties` (along with a `restore_command`, if it
+// has none), for the node to replay them on its next start.
+
+// CommitlogDir is the directory, at the root of the archive, that holds the
+// archived commit log segments.
+const CommitlogDir = "shield-commitlogs"
+
+// CommitlogProperties is the file, next to `cassandra_config`, that sets how
+// Cassandra archives and restores its commit log segments.
+const CommitlogProperties = "commitlog_archiving.properties"
+
+// PointInTimeFormat is how Cassandra expects `restore_point_in_time` (in
+// UTC) to be written.
+const PointInTimeFormat = "2006:01:02 15:04:05"
+
+// CommitlogRestoreDir is where restores leave the segments of the archive,
+// for Cassandra to replay them.  Unlike the staging directory, it outlives
+// the restore.
+var CommitlogRestoreDir = "/var/vcap/store/shield/cassandra-commitlogs"
+
+// CommitlogArchive records the commit log segments of a backup.
+type CommitlogArchive struct {
+	SnapshotAt time.Time `yaml:"snapshot_at"`
+	Segments   []string  `yaml:"segments"`
+}
+
+// commitlogProperties returns the path of the commit log archiving settings
+// of the node.
+func (cassandra *CassandraInfo) commitlogProperties() string {
+	return filepath.Join(filepath.Dir(cassandra.Config), CommitlogProperties)
+}
+
+// readProperties reads the settings of a Java properties file, written as
+// `key=value` or `key: value` lines.
+func readProperties(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	props := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if key, value, ok := parseProperty(scanner.Text()); ok {
+			props[key] = value
+		}
+	}
+	return props, scanner.Err()
+}
+
+// parseProperty splits a line of a properties file into its key and value,
+// unless it is blank or a comment.
+func parseProperty(line string) (string, string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || line[0] == '!' {
+		return "", "", false
+	}
+	i := strings.IndexAny(line, "=:")
+	if i < 0 {
+		return line, "", true
+	}
+	return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]), true
+}
+
+// setProperties updates the given settings of a properties file, in place,
+// and appends those it does not have yet.  Other lines are left alone.
+func setProperties(path string, settings map[string]string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	lines := []string{}
+	if len(b) > 0 {
+		lines = strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+	}
+	done := map[string]bool{}
+	for i, line := range lines {
+		key, _, ok := parseProperty(line)
+		if value, set := settings[key]; ok && set {
+			lines[i] = key + "=" + value
+			done[key] = true
+		}
+	}
+	keys := []string{}
+	for key := range settings {
+		if !done[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lines = append(lines, key+"="+settings[key])
+	}
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// commitlogArchiveDir returns the directory that commit log segments are
+// archived into: `cassandra_commitlog_archive_dir`, or the directory of the
+// `%name` argument of `archive_command`.
+func commitlogArchiveDir(cassandra *CassandraInfo) (string, error) {
+	if cassandra.CommitlogArchiveDir != "" {
+		return cassandra.CommitlogArchiveDir, nil
+	}
+
+	path := cassandra.commitlogProperties()
+	props, err := readProperties(path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read the commit log archiving settings: %s", err)
+	}
+	command := props["archive_command"]
+	if command == "" {
+		return "", fmt.Errorf("commit log archiving is not configured: %s sets no archive_command", path)
+	}
+	for _, arg := range strings.Fields(command) {
+		if strings.Contains(arg, "%name") {
+			if dir := filepath.Dir(arg); filepath.IsAbs(dir) && !strings.Contains(dir, "%") {
+				return dir, nil
+			}
+		}
+	}
+	return "", plugin.ConfigError{
+		Key: "cassandra_commitlog_archive_dir",
+		Err: fmt.Errorf("unable to tell where `%s` archives commit log segments; set cassandra_commitlog_archive_dir", command),
+	}
+}
+
+// archivedSegments returns the names of the commit log segments of dir that
+// were archived at or after since, in the order they were written.
+func archivedSegments(dir string, since time.Time) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := []string{}
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || !strings.HasPrefix(entry.Name(), "CommitLog-") {
+			continue
+		}
+		if entry.ModTime().Before(since) {
+			plugin.DEBUG("Leaving out commit log segment '%s', archived before the snapshot", entry.Name())
+			continue
+		}
+		segments = append(segments, entry.Name())
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segmentID(segments[i]) < segmentID(segments[j])
+	})
+	return segments, nil
+}
+
+// segmentID returns the ID that orders a commit log segment, from its name
+// (CommitLog-<version>-<id>.log), or "" if it has none.  IDs are compared
+// as numbers, by length first.
+func segmentID(name string) string {
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return ""
+	}
+	return fmt.Sprintf("%020s", name[i+1:])
+}
+
+// linkOrCopy hard-links src to dst, or copies it when they are not on the
+// same file system.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// stageCommitlogs stages the commit log segments archived since the
+// snapshot into the CommitlogDir of baseDir, and lists them in the manifest.
+// It returns the names of the segments.
+func stageCommitlogs(cassandra *CassandraInfo, baseDir string, snapshotAt time.Time) ([]string, error) {
+	archiveDir, err := commitlogArchiveDir(cassandra)
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("Collecting the commit log segments archived in '%s' since %s", archiveDir, snapshotAt.Format(time.RFC3339))
+	segments, err := archivedSegments(archiveDir, snapshotAt)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(baseDir, CommitlogDir)
+	if err = os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err = plugin.MkdirStaging(dir, 0755); err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		if err = linkOrCopy(filepath.Join(archiveDir, segment), filepath.Join(dir, segment)); err != nil {
+			return nil, err
+		}
+	}
+
+	manifest, err := readManifest(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		manifest = &Manifest{}
+	}
+	manifest.Commitlogs = &CommitlogArchive{SnapshotAt: snapshotAt.UTC(), Segments: segments}
+	b, err := yaml.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(baseDir, ManifestFile)
+	plugin.DEBUG("Writing manifest file '%s'", path)
+	return segments, plugin.WriteStagingFile(path, b, 0644)
+}
+
+// prepareReplay copies the commit log segments of the archive, unpacked in
+// baseDir, to CommitlogRestoreDir, and has Cassandra replay them up to
+// `cassandra_restore_point_in_time` on its next start.  It returns how many
+// segments are to be replayed.
+func prepareReplay(cassandra *CassandraInfo, baseDir string) (int, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(baseDir, CommitlogDir))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	if err = os.RemoveAll(CommitlogRestoreDir); err != nil {
+		return 0, err
+	}
+	if err = os.MkdirAll(CommitlogRestoreDir, 0755); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		if err = linkOrCopy(filepath.Join(baseDir, CommitlogDir, entry.Name()), filepath.Join(CommitlogRestoreDir, entry.Name())); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	path := cassandra.commitlogProperties()
+	props, err := readProperties(path)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	settings := map[string]string{
+		"restore_directories":   CommitlogRestoreDir,
+		"restore_point_in_time": cassandra.RestorePointInTime,
+	}
+	if props["restore_command"] == "" {
+		settings["restore_command"] = "cp -f %from %to"
+	}
+	plugin.DEBUG("Setting up the replay of %d commit log segments in '%s'", n, path)
+	return n, setProperties(path, settings)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Commit Log Archiving", func() {
+	var (
+		tmp, confDir, archiveDir, baseDir string
+		restoreDir                        string
+		cassandra                         *CassandraInfo
+		snapshotAt                        time.Time
+	)
+
+	segment := func(name string, archivedAt time.Time) {
+		path := filepath.Join(archiveDir, name)
+		Ω(ioutil.WriteFile(path, []byte(name), 0644)).Should(Succeed())
+		Ω(os.Chtimes(path, archivedAt, archivedAt)).Should(Succeed())
+	}
+
+	properties := func(content string) {
+		Ω(ioutil.WriteFile(filepath.Join(confDir, CommitlogProperties), []byte(content), 0644)).Should(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-cassandra-commitlog-")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		confDir = filepath.Join(tmp, "conf")
+		archiveDir = filepath.Join(tmp, "commitlog-archive")
+		baseDir = filepath.Join(tmp, "backup")
+		for _, dir := range []string{confDir, archiveDir, baseDir} {
+			Ω(os.MkdirAll(dir, 0755)).Should(Succeed())
+		}
+		restoreDir = CommitlogRestoreDir
+		CommitlogRestoreDir = filepath.Join(tmp, "restore")
+
+		cassandra = &CassandraInfo{Config: filepath.Join(confDir, "cassandra.yaml")}
+		snapshotAt = time.Date(2024, 1, 31, 2, 0, 0, 0, time.UTC)
+		segment("CommitLog-7-1706664000001.log", snapshotAt.Add(-time.Hour))
+		segment("CommitLog-7-1706664000002.log", snapshotAt.Add(-time.Minute))
+		segment("CommitLog-7-1706664000003.log", snapshotAt.Add(time.Minute))
+		segment("CommitLog-7-999999999999.log", snapshotAt.Add(time.Hour))
+		segment("CommitLog-7-1706664000004.log", snapshotAt.Add(2*time.Minute))
+		segment("archive.lock", snapshotAt.Add(time.Hour))
+	})
+
+	AfterEach(func() {
+		CommitlogRestoreDir = restoreDir
+		os.RemoveAll(tmp)
+	})
+
+	It("reads properties files", func() {
+		properties("# archiving\n! also a comment\n\narchive_command=/bin/ln %path /backup/%name\nrestore_command: cp -f %from %to\nprecision = MICROSECONDS\n")
+		Ω(readProperties(cassandra.commitlogProperties())).Should(Equal(map[string]string{
+			"archive_command": "/bin/ln %path /backup/%name",
+			"restore_command": "cp -f %from %to",
+			"precision":       "MICROSECONDS",
+		}))
+	})
+
+	It("finds the archive directory in archive_command", func() {
+		properties("archive_command=/bin/ln %path " + archiveDir + "/%name\n")
+		Ω(commitlogArchiveDir(cassandra)).Should(Equal(archiveDir))
+
+		cassandra.CommitlogArchiveDir = "/elsewhere"
+		Ω(commitlogArchiveDir(cassandra)).Should(Equal("/elsewhere"))
+	})
+
+	It("fails when commit log archiving is not configured", func() {
+		_, err := commitlogArchiveDir(cassandra)
+		Ω(err).Should(HaveOccurred())
+
+		properties("archive_command=\n")
+		_, err = commitlogArchiveDir(cassandra)
+		Ω(err).Should(MatchError(ContainSubstring("sets no archive_command")))
+
+		properties("archive_command=/usr/local/bin/archive-segment %path\n")
+		_, err = commitlogArchiveDir(cassandra)
+		Ω(err).Should(MatchError(ContainSubstring("set cassandra_commitlog_archive_dir")))
+	})
+
+	It("collects the segments archived since the snapshot, in order", func() {
+		Ω(archivedSegments(archiveDir, snapshotAt)).Should(Equal([]string{
+			"CommitLog-7-999999999999.log",
+			"CommitLog-7-1706664000003.log",
+			"CommitLog-7-1706664000004.log",
+		}))
+	})
+
+	It("stages the segments and lists them in the manifest", func() {
+		properties("archive_command=/bin/ln %path " + archiveDir + "/%name\n")
+		segments, err := stageCommitlogs(cassandra, baseDir, snapshotAt)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(segments).Should(HaveLen(3))
+		Ω(listDir(filepath.Join(baseDir, CommitlogDir))).Should(ConsistOf(segments))
+
+		manifest, err := readManifest(baseDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(manifest.Commitlogs.Segments).Should(Equal(segments))
+		Ω(manifest.Commitlogs.SnapshotAt.Equal(snapshotAt)).Should(BeTrue())
+	})
+
+	It("does not take the segments for a keyspace on restore", func() {
+		Ω(os.MkdirAll(filepath.Join(baseDir, "ks1"), 0755)).Should(Succeed())
+		Ω(os.MkdirAll(filepath.Join(baseDir, CommitlogDir), 0755)).Should(Succeed())
+		Ω(restoredKeyspaces(cassandra, nil, baseDir)).Should(Equal([]string{"ks1"}))
+	})
+
+	It("sets the node up to replay the segments of the archive", func() {
+		properties("archive_command=/bin/ln %path /backup/%name\nrestore_directories=/old\n")
+		cassandra.CommitlogArchiveDir = archiveDir
+		_, err := stageCommitlogs(cassandra, baseDir, snapshotAt)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		cassandra.RestorePointInTime = "2024:01:31 02:30:00"
+		Ω(prepareReplay(cassandra, baseDir)).Should(Equal(3))
+		Ω(listDir(CommitlogRestoreDir)).Should(HaveLen(3))
+
+		b, err := ioutil.ReadFile(cassandra.commitlogProperties())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(b)).Should(Equal("archive_command=/bin/ln %path /backup/%name\n" +
+			"restore_directories=" + CommitlogRestoreDir + "\n" +
+			"restore_command=cp -f %from %to\n" +
+			"restore_point_in_time=2024:01:31 02:30:00\n"))
+	})
+
+	It("leaves archives without segments alone", func() {
+		cassandra.RestorePointInTime = "2024:01:31 02:30:00"
+		Ω(prepareReplay(cassandra, baseDir)).Should(Equal(0))
+		_, err := os.Stat(cassandra.commitlogProperties())
+		Ω(os.IsNotExist(err)).Should(BeTrue())
+	})
+})
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Schema export
+//
+// Keyspaces without any SSTable (newly created, or whose data all expired)
+// have nothing to snapshot, and so leave no trace in archives: a restore
+// does not bring them back.  When `cassandra_export_schema` is true, the
+// schema of each keyspace selected for backup is exported with `cqlsh -e
+// "DESCRIBE KEYSPACE ..."`, whether it holds data or not, to a
+// `shield-schema-<keyspace>.cql` file at the root of the archive.  The list
+// of keyspaces is asked to the cluster, since empty keyspaces may have no
+// data directory either.
+//
+// On restore, the schema files of the keyspaces to restore are run through
+// `cqlsh -f`, before any data is loaded, with IF NOT EXISTS added to the
+// CREATE statements: missing keyspaces, tables, types and so on are created,
+// and existing ones are left as they are.
+
+// SchemaFilePrefix and SchemaFileSuffix make the name of the schema files.
+const (
+	SchemaFilePrefix = "shield-schema-"
+	SchemaFileSuffix = ".cql"
+)
+
+func schemaFile(baseDir, keyspace string) string {
+	return filepath.Join(baseDir, SchemaFilePrefix+keyspace+SchemaFileSuffix)
+}
+
+// exportSchema writes the schema of the keyspaces selected for backup to the
+// base directory, and returns those keyspaces.
+func exportSchema(cassandra *CassandraInfo, savedKeyspaces []string, baseDir string) ([]string, error) {
+	keyspaces, err := cqlKeyspaces(cassandra)
+	if err != nil {
+		return nil, err
+	}
+	exported := []string{}
+	for _, keyspace := range keyspaces {
+		if !keyspaceSaved(cassandra, savedKeyspaces, keyspace) {
+			continue
+		}
+		if cassandra.IncludeTables != nil && len(cassandra.IncludeTables[keyspace]) == 0 {
+			continue
+		}
+		out, err := cqlsh(cassandra, fmt.Sprintf("DESCRIBE KEYSPACE \"%s\";", keyspace))
+		if err != nil {
+			return nil, fmt.Errorf("unable to describe keyspace '%s': %s", keyspace, err)
+		}
+		if err = plugin.WriteStagingFile(schemaFile(baseDir, keyspace), out, 0644); err != nil {
+			return nil, err
+		}
+		plugin.DEBUG("Exported the schema of keyspace '%s'", keyspace)
+		exported = append(exported, keyspace)
+	}
+	return exported, nil
+}
+
+// archivedSchemas lists the keyspaces that have a schema file in an
+// extracted archive.
+func archivedSchemas(baseDir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(baseDir, SchemaFilePrefix+"*"+SchemaFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	keyspaces := []string{}
+	for _, file := range files {
+		name := filepath.Base(file)
+		keyspaces = append(keyspaces, name[len(SchemaFilePrefix):len(name)-len(SchemaFileSuffix)])
+	}
+	sort.Strings(keyspaces)
+	return keyspaces, nil
+}
+
+var createRegexp = regexp.MustCompile(`(?im)^(\s*CREATE\s+(?:KEYSPACE|TABLE|TYPE|CUSTOM\s+INDEX|INDEX|MATERIALIZED\s+VIEW|FUNCTION|AGGREGATE))\s+(?:IF\s+NOT\s+EXISTS\s+)?`)
+
+// createIfNotExists makes the CREATE statements of an exported schema leave
+// what already exists alone.
+func createIfNotExists(schema string) string {
+	return createRegexp.ReplaceAllString(schema, "$1 IF NOT EXISTS ")
+}
+
+// cqlshFile runs the CQL statements of a file.
+var cqlshFile = func(cassandra *CassandraInfo, path string) error {
+	cmd := fmt.Sprintf("%s/cqlsh -u \"%s\" -p \"%s\" -f \"%s\" \"%s\"",
+		cassandra.BinDir, cassandra.User, cassandra.Password, path, cassandra.Host)
+	plugin.DEBUG("Executing `%s/cqlsh -f \"%s\" %s`", cassandra.BinDir, path, cassandra.Host)
+	return plugin.ExecWithOptions(plugin.ExecOptions{Cmd: cmd, Stderr: os.Stderr, ExpectRC: []int{0}})
+}
+
+// restoreSchema creates what is missing from the schema of the keyspaces to
+// restore, and returns the keyspaces whose schema was applied.
+func restoreSchema(cassandra *CassandraInfo, savedKeyspaces []string, baseDir string) ([]string, error) {
+	keyspaces, err := archivedSchemas(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	applied := []string{}
+	for _, keyspace := range keyspaces {
+		if !keyspaceSaved(cassandra, savedKeyspaces, keyspace) {
+			plugin.DEBUG("Not recreating the schema of excluded keyspace '%s'", keyspace)
+			continue
+		}
+		b, err := ioutil.ReadFile(schemaFile(baseDir, keyspace))
+		if err != nil {
+			return nil, err
+		}
+		path := filepath.Join(baseDir, "restore-"+SchemaFilePrefix+keyspace+SchemaFileSuffix)
+		if err = plugin.WriteStagingFile(path, []byte(createIfNotExists(string(b))), 0644); err != nil {
+			return nil, err
+		}
+		if err = cqlshFile(cassandra, path); err != nil {
+			return nil, fmt.Errorf("unable to recreate the schema of keyspace '%s': %s", keyspace, err)
+		}
+		applied = append(applied, keyspace)
+	}
+	return applied, nil
+}
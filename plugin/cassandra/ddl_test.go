@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Schema Export", func() {
+	var (
+		baseDir   string
+		cassandra *CassandraInfo
+		saved     func(*CassandraInfo, string) ([]byte, error)
+		savedFile func(*CassandraInfo, string) error
+		applied   map[string]string
+	)
+
+	keyspaces := []byte(`
+ keyspace_name
+---------------
+           ks1
+      empty_ks
+ system_schema
+
+(3 rows)
+`)
+
+	BeforeEach(func() {
+		var err error
+		baseDir, err = ioutil.TempDir("", "shield-cassandra-ddl-")
+		Ω(err).ShouldNot(HaveOccurred())
+		cassandra = &CassandraInfo{ExcludeKeyspaces: append([]string{}, DefaultExcludeKeyspaces...)}
+		sort.Strings(cassandra.ExcludeKeyspaces)
+
+		saved = cqlsh
+		cqlsh = func(cassandra *CassandraInfo, query string) ([]byte, error) {
+			switch query {
+			case KeyspacesQuery:
+				return keyspaces, nil
+			case `DESCRIBE KEYSPACE "ks1";`:
+				return []byte("CREATE KEYSPACE ks1 WITH replication = {'class': 'SimpleStrategy', 'replication_factor': '1'};\n\n" +
+					"CREATE TABLE ks1.orders (\n    id uuid PRIMARY KEY\n);\n"), nil
+			case `DESCRIBE KEYSPACE "empty_ks";`:
+				/* a keyspace with tables, but no SSTable at all */
+				return []byte("CREATE KEYSPACE empty_ks WITH replication = {'class': 'SimpleStrategy', 'replication_factor': '1'};\n\n" +
+					"CREATE TYPE empty_ks.address (\n    city text\n);\n\n" +
+					"CREATE TABLE empty_ks.sessions (\n    id uuid PRIMARY KEY\n);\n\n" +
+					"CREATE INDEX sessions_idx ON empty_ks.sessions (id);\n"), nil
+			}
+			return nil, fmt.Errorf("unexpected query %s", query)
+		}
+
+		applied = map[string]string{}
+		savedFile = cqlshFile
+		cqlshFile = func(cassandra *CassandraInfo, path string) error {
+			b, err := ioutil.ReadFile(path)
+			Ω(err).ShouldNot(HaveOccurred())
+			applied[filepath.Base(path)] = string(b)
+			return nil
+		}
+	})
+
+	AfterEach(func() {
+		cqlsh = saved
+		cqlshFile = savedFile
+		os.RemoveAll(baseDir)
+	})
+
+	It("exports the schema of the selected keyspaces, even without data", func() {
+		exported, err := exportSchema(cassandra, nil, baseDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(exported).Should(Equal([]string{"empty_ks", "ks1"}))
+		Ω(archivedSchemas(baseDir)).Should(Equal([]string{"empty_ks", "ks1"}))
+
+		b, err := ioutil.ReadFile(filepath.Join(baseDir, "shield-schema-empty_ks.cql"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(b)).Should(ContainSubstring("CREATE TABLE empty_ks.sessions"))
+
+		exported, err = exportSchema(cassandra, []string{"ks1"}, baseDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(exported).Should(Equal([]string{"ks1"}))
+	})
+
+	It("recreates empty keyspaces on restore, leaving existing objects alone", func() {
+		_, err := exportSchema(cassandra, nil, baseDir)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		restored, err := restoreSchema(cassandra, []string{"empty_ks"}, baseDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(restored).Should(Equal([]string{"empty_ks"}))
+		Ω(applied).Should(HaveLen(1))
+		Ω(applied["restore-shield-schema-empty_ks.cql"]).Should(Equal(
+			"CREATE KEYSPACE IF NOT EXISTS empty_ks WITH replication = {'class': 'SimpleStrategy', 'replication_factor': '1'};\n\n" +
+				"CREATE TYPE IF NOT EXISTS empty_ks.address (\n    city text\n);\n\n" +
+				"CREATE TABLE IF NOT EXISTS empty_ks.sessions (\n    id uuid PRIMARY KEY\n);\n\n" +
+				"CREATE INDEX IF NOT EXISTS sessions_idx ON empty_ks.sessions (id);\n"))
+	})
+
+	It("does not add IF NOT EXISTS twice", func() {
+		Ω(createIfNotExists("CREATE TABLE IF NOT EXISTS ks.t (id int PRIMARY KEY);\n")).Should(
+			Equal("CREATE TABLE IF NOT EXISTS ks.t (id int PRIMARY KEY);\n"))
+		Ω(createIfNotExists("CREATE CUSTOM INDEX i ON ks.t (v) USING 'SAI';\n")).Should(
+			Equal("CREATE CUSTOM INDEX IF NOT EXISTS i ON ks.t (v) USING 'SAI';\n"))
+	})
+})
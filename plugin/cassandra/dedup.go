@@ -0,0 +1,301 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Deduplicated backups
+//
+// SSTables are immutable: successive backups of a node mostly hold the same
+// files.  When `cassandra_dedup` is true, the plugin does not stream a tar
+// archive; it stores each file of the backup on its own, in the chunk store,
+// unless a file with the same content (SHA-256) was already stored by a
+// recent backup of this node, and prints a manifest that lists the files and
+// where their content is:
+//
+//    {
+//      "format"   : "shield-cassandra-dedup/1",
+//      "size"     : 1610612736,
+//      "uploaded" : 1048576,
+//      "files"    : [
+//        { "path": "ks1/orders/nb-1-big-Data.db", "size": 1073741824,
+//          "mode": 420, "mtime": 1700000000, "sha256": "...", "key": "..." },
+//        ...
+//      ]
+//    }
+//
+// The content already stored is tracked in a local index (a JSON file, in
+// `cassandra_dedup_index`), by SHA-256, with the key the chunk store gave
+// and the time it was stored.  Losing the index only means that the next
+// backup stores everything again.  Content is only reused for
+// `cassandra_dedup_max_age` days after it was stored, so that a backup
+// never references content older than that, and the chunk store can expire
+// what is older than that plus the retention of the backups.
+//
+// On restore, when the archive read from standard input is such a manifest,
+// the files are retrieved, checked against their size and SHA-256, and
+// handed to tar as the archive they were backed up from.
+
+const DedupManifestFormat = "shield-cassandra-dedup/1"
+
+type DedupFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Mode   int64  `json:"mode"`
+	MTime  int64  `json:"mtime"`
+	SHA256 string `json:"sha256"`
+	Key    string `json:"key"`
+}
+
+type DedupManifest struct {
+	Format   string      `json:"format"`
+	Size     int64       `json:"size"`
+	Uploaded int64       `json:"uploaded"`
+	Files    []DedupFile `json:"files"`
+}
+
+// DedupBlob is content stored in the chunk store, as recorded in the index.
+type DedupBlob struct {
+	Key    string    `json:"key"`
+	Size   int64     `json:"size"`
+	Stored time.Time `json:"stored"`
+}
+
+// DedupIndex records the content stored by previous backups, by SHA-256.
+type DedupIndex map[string]DedupBlob
+
+// readDedupIndex reads the index; a missing or unreadable index is empty,
+// since it only costs storing everything again.
+func readDedupIndex(path string) DedupIndex {
+	index := DedupIndex{}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return index
+	}
+	if err == nil {
+		err = json.Unmarshal(b, &index)
+	}
+	if err != nil {
+		plugin.Fprintf(os.Stderr, "@Y{Unable to read the dedup index %s (%s); storing all files again}\n", path, err)
+		return DedupIndex{}
+	}
+	return index
+}
+
+// lookup returns the stored content with that hash and size, unless it is
+// too old to be referenced.
+func (index DedupIndex) lookup(sum string, size int64, since time.Time) (DedupBlob, bool) {
+	blob, ok := index[sum]
+	if !ok || blob.Size != size || blob.Stored.Before(since) {
+		return DedupBlob{}, false
+	}
+	return blob, true
+}
+
+// save writes the index, without the content that is too old to be
+// referenced anymore.
+func (index DedupIndex) save(path string, since time.Time) error {
+	for sum, blob := range index {
+		if blob.Stored.Before(since) {
+			delete(index, sum)
+		}
+	}
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// hashFile returns the SHA-256 of a file.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sha := sha256.New()
+	if _, err = io.Copy(sha, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sha.Sum(nil)), nil
+}
+
+// storeFile stores the content of a file in the chunk store.
+func storeFile(store ChunkStore, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return storeChunk(store, f)
+}
+
+// storeDedup stores the files under baseDir that the index does not know
+// about (or only as too old), and returns the manifest of the backup, along
+// with the keys of what it stored, so that they can be purged if the
+// backup fails.
+func storeDedup(baseDir string, store ChunkStore, index DedupIndex, now, since time.Time) (*DedupManifest, []string, error) {
+	manifest := &DedupManifest{Format: DedupManifestFormat, Files: []DedupFile{}}
+	stored := []string{}
+
+	err := filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(baseDir, path)
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+
+		blob, ok := index.lookup(sum, info.Size(), since)
+		if !ok {
+			key, err := storeFile(store, path)
+			if err != nil {
+				plugin.Fprintf(os.Stderr, "@R{\u2717 Store %s}  %s\n", rel, err)
+				return err
+			}
+			plugin.DEBUG("Stored '%s' (%d bytes) as '%s'", rel, info.Size(), key)
+			blob = DedupBlob{Key: key, Size: info.Size(), Stored: now}
+			index[sum] = blob
+			stored = append(stored, key)
+			manifest.Uploaded += info.Size()
+		}
+
+		manifest.Files = append(manifest.Files, DedupFile{
+			Path:   filepath.ToSlash(rel),
+			Size:   info.Size(),
+			Mode:   int64(info.Mode().Perm()),
+			MTime:  info.ModTime().Unix(),
+			SHA256: sum,
+			Key:    blob.Key,
+		})
+		manifest.Size += info.Size()
+		return nil
+	})
+	return manifest, stored, err
+}
+
+// dedupArchive stores the files of the backup, deduplicated, and prints the
+// manifest on standard output.
+func dedupArchive(cassandra *CassandraInfo, baseDir string) error {
+	now := time.Now()
+	since := now.Add(-time.Duration(cassandra.DedupMaxAge) * 24 * time.Hour)
+	index := readDedupIndex(cassandra.DedupIndex)
+
+	manifest, stored, err := storeDedup(baseDir, *cassandra.ChunkStore, index, now, since)
+	if err == nil {
+		var b []byte
+		if b, err = json.Marshal(manifest); err == nil {
+			/* only remember what this backup stored once it can be referenced */
+			if err = index.save(cassandra.DedupIndex, since); err == nil {
+				fmt.Printf("%s\n", b)
+			}
+		}
+	}
+	if err != nil {
+		for _, key := range stored {
+			if perr := purgeChunk(*cassandra.ChunkStore, key); perr != nil {
+				plugin.Fprintf(os.Stderr, "@R{\u2717 Purge %s}  %s\n", key, perr)
+			}
+		}
+		return err
+	}
+
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Deduplicate backup files}  %d files, %d bytes, %d bytes stored\n",
+		len(manifest.Files), manifest.Size, manifest.Uploaded)
+	return nil
+}
+
+// check makes sure the manifest is one this plugin knows how to restore.
+func (m *DedupManifest) check() error {
+	if m.Format != DedupManifestFormat {
+		return fmt.Errorf("unsupported dedup manifest format '%s'", m.Format)
+	}
+	var size int64
+	for _, f := range m.Files {
+		size += f.Size
+	}
+	if size != m.Size {
+		return fmt.Errorf("files of the dedup manifest add up to %d bytes, instead of %d", size, m.Size)
+	}
+	return nil
+}
+
+// retrieveDedup writes the files the manifest lists to `out`, as a tar
+// archive, checking each one on the way.
+func retrieveDedup(m *DedupManifest, store ChunkStore, out io.Writer) error {
+	if err := m.check(); err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(out)
+	dirs := map[string]bool{".": true}
+	var mkdir func(dir string) error
+	mkdir = func(dir string) error {
+		if dirs[dir] {
+			return nil
+		}
+		if err := mkdir(filepath.Dir(dir)); err != nil {
+			return err
+		}
+		dirs[dir] = true
+		return tw.WriteHeader(&tar.Header{Name: dir + "/", Mode: 0755, Typeflag: tar.TypeDir, ModTime: time.Now()})
+	}
+
+	for i, f := range m.Files {
+		if err := mkdir(filepath.Dir(f.Path)); err != nil {
+			return err
+		}
+		err := tw.WriteHeader(&tar.Header{
+			Name:     f.Path,
+			Mode:     f.Mode,
+			Size:     f.Size,
+			ModTime:  time.Unix(f.MTime, 0),
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			return err
+		}
+
+		digest := newChunkDigest()
+		err = retrieveChunk(store, f.Key, io.MultiWriter(tw, digest))
+		if err == nil && (digest.size != f.Size || digest.sum() != f.SHA256) {
+			err = fmt.Errorf("%s (%s) is corrupted: got %d bytes with SHA-256 %s, expected %d bytes with SHA-256 %s",
+				f.Path, f.Key, digest.size, digest.sum(), f.Size, f.SHA256)
+		}
+		if err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Retrieve file #%d of %d}  %s\n", i+1, len(m.Files), f.Path)
+			return err
+		}
+		plugin.DEBUG("Retrieved '%s' (%d bytes) from '%s'", f.Path, f.Size, f.Key)
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Retrieve deduplicated files}  %d files, %d bytes\n", len(m.Files), m.Size)
+	return nil
+}
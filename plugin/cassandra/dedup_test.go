@@ -0,0 +1,154 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Deduplicated Backups", func() {
+	var (
+		tmp, baseDir string
+		store        ChunkStore
+		now          time.Time
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-cassandra-dedup-")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(os.Mkdir(filepath.Join(tmp, "chunks"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "store"), []byte(chunkStore), 0755)).Should(Succeed())
+		store = ChunkStore{Plugin: filepath.Join(tmp, "store")}
+		now = time.Now()
+
+		baseDir = filepath.Join(tmp, "backup")
+		Ω(os.MkdirAll(filepath.Join(baseDir, "ks1", "orders"), 0755)).Should(Succeed())
+		Ω(os.MkdirAll(filepath.Join(baseDir, "ks1", "users"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(baseDir, "ks1", "orders", "nb-1-big-Data.db"), []byte("orders data"), 0644)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(baseDir, "ks1", "users", "nb-1-big-Data.db"), []byte("users data"), 0644)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(baseDir, "ks1", "users", "nb-1-big-Digest.crc32"), []byte("users data"), 0644)).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	It("only stores content that no recent backup stored", func() {
+		index := DedupIndex{}
+		manifest, stored, err := storeDedup(baseDir, store, index, now, now.Add(-time.Hour))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(manifest.Files).Should(HaveLen(3))
+		Ω(manifest.Size).Should(Equal(int64(31)))
+		Ω(stored).Should(HaveLen(2))
+		Ω(manifest.Uploaded).Should(Equal(int64(21)))
+		Ω(manifest.Files[0].Path).Should(Equal("ks1/orders/nb-1-big-Data.db"))
+		Ω(manifest.Files[1].Key).Should(Equal(manifest.Files[2].Key))
+
+		Ω(ioutil.WriteFile(filepath.Join(baseDir, "ks1", "orders", "nb-2-big-Data.db"), []byte("new orders"), 0644)).Should(Succeed())
+		manifest, stored, err = storeDedup(baseDir, store, index, now, now.Add(-time.Hour))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(manifest.Files).Should(HaveLen(4))
+		Ω(stored).Should(HaveLen(1))
+		Ω(manifest.Uploaded).Should(Equal(int64(10)))
+
+		/* content stored before the max age is stored again */
+		later := now.Add(48 * time.Hour)
+		_, stored, err = storeDedup(baseDir, store, index, later, later.Add(-24*time.Hour))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(stored).Should(HaveLen(3))
+	})
+
+	It("persists the index, without the content that is too old", func() {
+		path := filepath.Join(tmp, "index", "dedup.json")
+		Ω(readDedupIndex(path)).Should(BeEmpty())
+
+		index := DedupIndex{
+			"aaa": {Key: "old", Size: 1, Stored: now.Add(-10 * 24 * time.Hour)},
+			"bbb": {Key: "new", Size: 1, Stored: now.Add(-time.Hour)},
+		}
+		Ω(index.save(path, now.Add(-7*24*time.Hour))).Should(Succeed())
+		saved := readDedupIndex(path)
+		Ω(saved).Should(HaveLen(1))
+		Ω(saved["bbb"].Key).Should(Equal("new"))
+
+		Ω(ioutil.WriteFile(path, []byte("{garbage"), 0644)).Should(Succeed())
+		Ω(readDedupIndex(path)).Should(BeEmpty())
+	})
+
+	It("rebuilds the archive from the stored files", func() {
+		manifest, _, err := storeDedup(baseDir, store, DedupIndex{}, now, now)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		var out bytes.Buffer
+		Ω(retrieveDedup(manifest, store, &out)).Should(Succeed())
+
+		files := map[string]string{}
+		tr := tar.NewReader(&out)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			Ω(err).ShouldNot(HaveOccurred())
+			if h.Typeflag == tar.TypeDir {
+				files[h.Name] = ""
+				continue
+			}
+			b, err := ioutil.ReadAll(tr)
+			Ω(err).ShouldNot(HaveOccurred())
+			files[h.Name] = string(b)
+		}
+		Ω(files).Should(Equal(map[string]string{
+			"ks1/":                            "",
+			"ks1/orders/":                     "",
+			"ks1/orders/nb-1-big-Data.db":     "orders data",
+			"ks1/users/":                      "",
+			"ks1/users/nb-1-big-Data.db":      "users data",
+			"ks1/users/nb-1-big-Digest.crc32": "users data",
+		}))
+	})
+
+	It("detects corrupted files", func() {
+		manifest, _, err := storeDedup(baseDir, store, DedupIndex{}, now, now)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "chunks", manifest.Files[0].Key), []byte("ORDERS DATA"), 0644)).Should(Succeed())
+
+		err = retrieveDedup(manifest, store, ioutil.Discard)
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(HavePrefix("ks1/orders/nb-1-big-Data.db (chunk-1) is corrupted"))
+
+		manifest.Format = "shield-cassandra-dedup/2"
+		Ω(retrieveDedup(manifest, store, ioutil.Discard)).Should(MatchError("unsupported dedup manifest format 'shield-cassandra-dedup/2'"))
+	})
+
+	It("restores dedup manifests", func() {
+		manifest, _, err := storeDedup(baseDir, store, DedupIndex{}, now, now)
+		Ω(err).ShouldNot(HaveOccurred())
+		b, err := json.Marshal(manifest)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "archive"), b, 0644)).Should(Succeed())
+
+		stdin := os.Stdin
+		defer func() { os.Stdin = stdin }()
+		os.Stdin, err = os.Open(filepath.Join(tmp, "archive"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		in, wait, err := archiveInput(&CassandraInfo{ChunkStore: &store})
+		Ω(err).ShouldNot(HaveOccurred())
+		tr := tar.NewReader(in)
+		h, err := tr.Next()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(h.Name).Should(Equal("ks1/"))
+		io.Copy(ioutil.Discard, in)
+		Ω(wait()).Should(Succeed())
+	})
+})
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// KeyspacesQuery lists all the keyspaces of the cluster.
+const KeyspacesQuery = "SELECT keyspace_name FROM system_schema.keyspaces;"
+
+// cqlsh runs a CQL query, and returns what cqlsh printed.
+var cqlsh = func(cassandra *CassandraInfo, query string) ([]byte, error) {
+	var out bytes.Buffer
+	cmd := fmt.Sprintf("%s/cqlsh -u \"%s\" -p \"%s\" -e \"%s\" \"%s\"",
+		cassandra.BinDir, cassandra.User, cassandra.Password, escapeQuotes(query), cassandra.Host)
+	plugin.DEBUG("Executing `%s/cqlsh -e \"%s\" %s`", cassandra.BinDir, query, cassandra.Host)
+	err := plugin.ExecWithOptions(plugin.ExecOptions{Cmd: cmd, Stdout: &out, Stderr: os.Stderr, ExpectRC: []int{0}})
+	return out.Bytes(), err
+}
+
+// escapeQuotes escapes what would end (or escape out of) a double-quoted
+// argument of a command line, e.g. the quoted names of a CQL query.
+func escapeQuotes(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+// parseCQLColumn extracts the values of a single-column cqlsh result, i.e.
+//
+//	 keyspace_name
+//	--------------------
+//	        system_auth
+//	      system_schema
+//
+//	(2 rows)
+func parseCQLColumn(out []byte) []string {
+	values := []string{}
+	header := true
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if header {
+			header = !strings.HasPrefix(line, "---")
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "(") {
+			break
+		}
+		values = append(values, line)
+	}
+	return values
+}
+
+// cqlKeyspaces asks the cluster for the authoritative list of keyspaces.
+func cqlKeyspaces(cassandra *CassandraInfo) ([]string, error) {
+	out, err := cqlsh(cassandra, KeyspacesQuery)
+	if err != nil {
+		return nil, err
+	}
+	keyspaces := parseCQLColumn(out)
+	if len(keyspaces) == 0 {
+		return nil, fmt.Errorf("no keyspace found in system_schema.keyspaces")
+	}
+	sort.Strings(keyspaces)
+	return keyspaces, nil
+}
+
+// discoverKeyspaces lists the keyspaces known to the cluster (instead of
+// the directories found in the data directory), after checking the include
+// and exclude lists against them.  Keyspaces that have no data directory yet
+// have nothing to back up, and are left out.
+func discoverKeyspaces(cassandra *CassandraInfo) ([]string, error) {
+	keyspaces, err := cqlKeyspaces(cassandra)
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("Keyspaces found with CQL: %v", keyspaces)
+
+	known := map[string]bool{}
+	for _, keyspace := range keyspaces {
+		known[keyspace] = true
+	}
+	if err = checkIncludedKeyspaces(cassandra, keyspaces); err != nil {
+		return nil, err
+	}
+	for _, keyspace := range cassandra.ExcludeKeyspaces {
+		if !known[keyspace] {
+			plugin.Fprintf(os.Stderr, "@Y{cassandra_exclude_keyspaces lists '%s', which is not a keyspace of this cluster}\n", keyspace)
+		}
+	}
+
+	withData := []string{}
+	for _, keyspace := range keyspaces {
+		info, err := os.Stat(filepath.Join(cassandra.DataDir, keyspace))
+		if os.IsNotExist(err) {
+			plugin.DEBUG("Keyspace '%s' has no data directory yet", keyspace)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", filepath.Join(cassandra.DataDir, keyspace))
+		}
+		withData = append(withData, keyspace)
+	}
+	return withData, nil
+}
+
+// checkIncludedKeyspaces warns about the keyspaces listed in
+// `cassandra_include_keyspaces` that do not exist, since they would
+// otherwise be skipped silently; with `cassandra_fail_on_missing_keyspace`,
+// it fails instead.
+func checkIncludedKeyspaces(cassandra *CassandraInfo, existing []string) error {
+	known := map[string]bool{}
+	for _, keyspace := range existing {
+		known[keyspace] = true
+	}
+	missing := []string{}
+	for _, keyspace := range cassandra.IncludeKeyspaces {
+		if !known[keyspace] {
+			missing = append(missing, keyspace)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	if cassandra.FailOnMissingKeyspace {
+		return plugin.ConfigError{
+			Key: "cassandra_include_keyspaces",
+			Err: fmt.Errorf("keyspaces listed in cassandra_include_keyspaces do not exist: %s", strings.Join(missing, ", ")),
+		}
+	}
+	for _, keyspace := range missing {
+		plugin.Fprintf(os.Stderr, "@Y{WARNING: keyspace '%s' is listed in cassandra_include_keyspaces, but does not exist; it is NOT backed up}\n", keyspace)
+	}
+	return nil
+}
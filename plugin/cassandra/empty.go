@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Empty backups
+//
+// A node that is fresh, or still bootstrapping (joining the ring, and
+// streaming its data from the other nodes), has no keyspace to back up, or
+// only part of its data.  Backing it up still succeeds, with an archive that
+// holds next to nothing, which is a trap: it replaces good backups in the
+// retention window, and restores an empty node.  Before the snapshot is
+// taken, the plugin asks `nodetool netstats` for the mode of the node, and
+// once the keyspaces are staged, it checks that at least one of them has
+// data, telling a node without keyspaces apart from keyspaces that
+// `cassandra_include_keyspaces` and `cassandra_exclude_keyspaces` all leave
+// out.  Both only get a loud warning, unless `cassandra_fail_on_empty_backup`
+// is true, which fails the backup instead.
+
+// BootstrappingMode is the mode `nodetool netstats` reports for a node that
+// is joining the ring.
+const BootstrappingMode = "JOINING"
+
+// nodetoolNetstats runs `nodetool netstats`, and returns what it printed.
+var nodetoolNetstats = func(cassandra *CassandraInfo) ([]byte, error) {
+	cmd := exec.Command(filepath.Join(cassandra.BinDir, "nodetool"), "netstats")
+	cmd.Stderr = os.Stderr
+	plugin.DEBUG("Executing `%s/nodetool netstats`", cassandra.BinDir)
+	return cmd.Output()
+}
+
+// parseNodeMode reads the mode of the node out of the "Mode: NORMAL" line
+// that `nodetool netstats` prints first.
+func parseNodeMode(out []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ":", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "Mode" {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+	return ""
+}
+
+// keyspaceNameRegexp matches the names Cassandra allows for keyspaces, and
+// not the other directories of a data directory (i.e. `lost+found`).
+var keyspaceNameRegexp = regexp.MustCompile(`^\w+$`)
+
+// userKeyspaces returns the keyspaces that are not system ones, sorted.
+func userKeyspaces(keyspaces []string) []string {
+	system := map[string]bool{}
+	for _, keyspace := range DefaultExcludeKeyspaces {
+		system[keyspace] = true
+	}
+	user := []string{}
+	for _, keyspace := range keyspaces {
+		if !system[keyspace] && keyspaceNameRegexp.MatchString(keyspace) {
+			user = append(user, keyspace)
+		}
+	}
+	sort.Strings(user)
+	return user
+}
+
+// emptyBackupReason tells why a backup that stages none of the keyspaces
+// of the node is empty; it returns "" when some keyspace was staged.
+func emptyBackupReason(cassandra *CassandraInfo, savedKeyspaces, keyspaces, backedUp []string) string {
+	if len(backedUp) > 0 {
+		return ""
+	}
+	user := userKeyspaces(keyspaces)
+	selected := []string{}
+	for _, keyspace := range keyspaces {
+		if !keyspaceNameRegexp.MatchString(keyspace) || !keyspaceSaved(cassandra, savedKeyspaces, keyspace) {
+			continue
+		}
+		if cassandra.IncludeTables != nil && len(cassandra.IncludeTables[keyspace]) == 0 {
+			continue
+		}
+		selected = append(selected, keyspace)
+	}
+	sort.Strings(selected)
+
+	switch {
+	case len(user) == 0 && len(selected) == 0:
+		return "this node has no keyspace yet; it may be a fresh node, or one that is still bootstrapping"
+	case len(selected) == 0:
+		return fmt.Sprintf("all the keyspaces of this node (%s) are left out by cassandra_include_keyspaces, cassandra_exclude_keyspaces or cassandra_include_tables",
+			strings.Join(user, ", "))
+	default:
+		return fmt.Sprintf("none of the keyspaces selected for backup (%s) has any data in the snapshot; this node may be fresh, or still bootstrapping",
+			strings.Join(selected, ", "))
+	}
+}
+
+// emptyBackup reports a backup that is, or is about to be, good for
+// nothing: it fails with `cassandra_fail_on_empty_backup`, and only warns
+// otherwise.
+func emptyBackup(cassandra *CassandraInfo, reason string) error {
+	if cassandra.FailOnEmptyBackup {
+		return fmt.Errorf("refusing to back up this node: %s", reason)
+	}
+	plugin.Fprintf(os.Stderr, "@Y{WARNING: %s.}\n", reason)
+	plugin.Fprintf(os.Stderr, "@Y{WARNING: backing it up anyway; set cassandra_fail_on_empty_backup to fail such backups instead.}\n")
+	return nil
+}
+
+// checkBootstrapping checks that the node is not joining the ring, since
+// it has only part of its data then.  Failing to find out only gets the
+// backup going.
+func checkBootstrapping(cassandra *CassandraInfo) error {
+	out, err := nodetoolNetstats(cassandra)
+	if err != nil {
+		plugin.DEBUG("Unable to run `nodetool netstats`, not checking whether the node is bootstrapping: %s", err)
+		return nil
+	}
+	mode := parseNodeMode(out)
+	plugin.DEBUG("Node mode: '%s'", mode)
+	if mode != BootstrappingMode {
+		return nil
+	}
+	return emptyBackup(cassandra, fmt.Sprintf("this node is bootstrapping (nodetool reports it as %s), and only holds part of its data", mode))
+}
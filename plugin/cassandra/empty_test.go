@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Empty Backups", func() {
+	var (
+		tmp, dataDir, baseDir string
+		cassandra             *CassandraInfo
+		netstats              string
+		netstatsErr           error
+		saved                 func(*CassandraInfo) ([]byte, error)
+	)
+
+	/* stage returns why the backup is empty, if it is */
+	stage := func() string {
+		sort.Strings(cassandra.ExcludeKeyspaces)
+		savedKeyspaces := computeSavedKeyspaces(cassandra.IncludeKeyspaces, cassandra.ExcludeKeyspaces)
+		keyspaces, err := listKeyspaces(cassandra)
+		Ω(err).ShouldNot(HaveOccurred())
+		backedUp, _, err := stageKeyspaces(cassandra, savedKeyspaces, keyspaces, baseDir, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		return emptyBackupReason(cassandra, savedKeyspaces, keyspaces, backedUp)
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-cassandra-")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		dataDir = filepath.Join(tmp, "data")
+		baseDir = filepath.Join(tmp, "backup")
+		Ω(os.MkdirAll(dataDir, 0755)).Should(Succeed())
+		Ω(os.MkdirAll(baseDir, 0755)).Should(Succeed())
+		cassandra = &CassandraInfo{
+			DataDir:          dataDir,
+			ExcludeKeyspaces: append([]string{}, DefaultExcludeKeyspaces...),
+			SkipComponents:   DefaultSkipComponents,
+		}
+
+		netstats, netstatsErr = "Mode: NORMAL\nNot sending any streams.\n", nil
+		saved = nodetoolNetstats
+		nodetoolNetstats = func(cassandra *CassandraInfo) ([]byte, error) {
+			return []byte(netstats), netstatsErr
+		}
+	})
+
+	AfterEach(func() {
+		nodetoolNetstats = saved
+		os.RemoveAll(tmp)
+	})
+
+	It("tells that a node with an empty data directory has no keyspace yet", func() {
+		Ω(stage()).Should(ContainSubstring("this node has no keyspace yet"))
+	})
+
+	It("tells that a node with only system keyspaces has no keyspace yet", func() {
+		for _, keyspace := range []string{"system", "system_schema", "lost+found"} {
+			Ω(os.MkdirAll(filepath.Join(dataDir, keyspace), 0755)).Should(Succeed())
+		}
+		Ω(stage()).Should(ContainSubstring("this node has no keyspace yet"))
+	})
+
+	It("tells excluded keyspaces apart from missing ones", func() {
+		Ω(copyTree("test/fixtures", dataDir)).Should(Succeed())
+		cassandra.ExcludeKeyspaces = append(cassandra.ExcludeKeyspaces, "ks1", "ks2")
+		Ω(stage()).Should(Equal("all the keyspaces of this node (ks1, ks2) are left out by cassandra_include_keyspaces, cassandra_exclude_keyspaces or cassandra_include_tables"))
+	})
+
+	It("tells when the selected keyspaces have no data in the snapshot", func() {
+		Ω(os.MkdirAll(filepath.Join(dataDir, "ks3", "events-0d1e2f30de2711e6a6b5d13f3c2b2a1a"), 0755)).Should(Succeed())
+		Ω(stage()).Should(ContainSubstring("none of the keyspaces selected for backup (ks3) has any data"))
+	})
+
+	It("has nothing to say about backups with data", func() {
+		Ω(copyTree("test/fixtures", dataDir)).Should(Succeed())
+		Ω(stage()).Should(Equal(""))
+	})
+
+	It("only warns about empty backups, unless asked to fail", func() {
+		Ω(emptyBackup(cassandra, "this node has no keyspace yet")).Should(Succeed())
+		cassandra.FailOnEmptyBackup = true
+		Ω(emptyBackup(cassandra, "this node has no keyspace yet")).Should(MatchError("refusing to back up this node: this node has no keyspace yet"))
+	})
+
+	It("notices bootstrapping nodes", func() {
+		cassandra.FailOnEmptyBackup = true
+		Ω(checkBootstrapping(cassandra)).Should(Succeed())
+
+		netstats = "Mode: JOINING\nBootstrap 6b8ac1a0-...\n"
+		Ω(parseNodeMode([]byte(netstats))).Should(Equal("JOINING"))
+		Ω(checkBootstrapping(cassandra)).ShouldNot(Succeed())
+		cassandra.FailOnEmptyBackup = false
+		Ω(checkBootstrapping(cassandra)).Should(Succeed())
+
+		netstats, netstatsErr = "", fmt.Errorf("nodetool: connection refused")
+		cassandra.FailOnEmptyBackup = true
+		Ω(checkBootstrapping(cassandra)).Should(Succeed())
+	})
+})
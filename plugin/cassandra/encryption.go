@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Clusters running with transparent data encryption (TDE) write SSTables
+// that can be hard-linked and archived just fine, but that `sstableloader`
+// can't read back without the very same encryption configuration and key
+// material.  Those keys are NOT part of the backup archive, so we detect
+// encrypted tables at backup time, warn about it, and record what we know
+// into a manifest file at the root of the archive.
+
+const (
+	// Name of the manifest file, at the root of the backup archive
+	ManifestFile = "shield-manifest.yml"
+)
+
+var (
+	// The compressor class, recorded in the *-CompressionInfo.db component
+	// of each SSTable, is `Encryptor` or `Encrypting*Compressor` for tables
+	// that are encrypted at rest.
+	EncryptionMarker = []byte("Encrypt")
+
+	// The `cassandra.yaml` settings that relate to data encryption, and
+	// that must be replicated on the node where encrypted SSTables are to
+	// be restored.
+	EncryptionConfigKeys = []string{
+		"transparent_data_encryption_options",
+		"system_key_directory",
+		"system_info_encryption",
+		"config_encryption_active",
+		"config_encryption_key_name",
+		"kmip_hosts",
+	}
+)
+
+// Manifest describes the encryption-related facts about a backup archive,
+// the IDs of its tables (see schema.go), the node it comes from (see
+// identity.go), the format versions of its SSTables (see sstables.go), and
+// the keyspaces left out of it for their size (see size.go).
+type Manifest struct {
+	EncryptedTables  []string               `yaml:"encrypted_tables,omitempty"`
+	CassandraConfig  string                 `yaml:"cassandra_config,omitempty"`
+	EncryptionConfig map[string]interface{} `yaml:"encryption_config,omitempty"`
+	TableIDs         map[string]string      `yaml:"table_ids,omitempty"`
+	Node             NodeIdentity           `yaml:"node,omitempty"`
+	SSTableFormats   map[string][]string    `yaml:"sstable_formats,omitempty"`
+	SkippedKeyspaces map[string]int64       `yaml:"skipped_keyspaces,omitempty"`
+	Commitlogs       *CommitlogArchive      `yaml:"commitlogs,omitempty"`
+}
+
+// Tell whether the SSTables of a table directory are encrypted
+func tableEncrypted(tableDir string) (bool, error) {
+	files, err := filepath.Glob(filepath.Join(tableDir, "*-CompressionInfo.db"))
+	if err != nil {
+		return false, err
+	}
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return false, err
+		}
+		if bytes.Contains(b, EncryptionMarker) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// List the encrypted tables, as "keyspace.table", found in a backup base
+// directory laid out as {keyspace}/{tablename}/*
+func encryptedTables(baseDir string) ([]string, error) {
+	tableDirs, err := filepath.Glob(filepath.Join(baseDir, "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	tables := []string{}
+	for _, tableDir := range tableDirs {
+		info, err := os.Stat(tableDir)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			continue
+		}
+		encrypted, err := tableEncrypted(tableDir)
+		if err != nil {
+			return nil, err
+		}
+		if encrypted {
+			keyspace := filepath.Base(filepath.Dir(tableDir))
+			tables = append(tables, keyspace+"."+filepath.Base(tableDir))
+		}
+	}
+	sort.Strings(tables)
+	return tables, nil
+}
+
+// Extract the encryption stanzas from a `cassandra.yaml` file
+func encryptionConfig(path string) (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config map[string]interface{}
+	if err = yaml.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %s", path, err)
+	}
+
+	stanzas := map[string]interface{}{}
+	for _, key := range EncryptionConfigKeys {
+		if v, ok := config[key]; ok {
+			stanzas[key] = v
+		}
+	}
+	return stanzas, nil
+}
+
+// Tell whether commitlog and hints encryption is turned on, in the
+// encryption stanzas of `cassandra.yaml`
+func commitLogEncrypted(stanzas map[string]interface{}) bool {
+	tde, ok := stanzas["transparent_data_encryption_options"].(map[interface{}]interface{})
+	if !ok {
+		return false
+	}
+	enabled, _ := tde["enabled"].(bool)
+	return enabled
+}
+
+// Look for encrypted tables in the backup base directory, and when any is
+// found (or when commitlog encryption is on), warn that the key material
+// must be managed separately and write the manifest file.
+func checkEncryption(cassandra *CassandraInfo, baseDir string) error {
+	tables, err := encryptedTables(baseDir)
+	if err != nil {
+		return err
+	}
+
+	stanzas, err := encryptionConfig(cassandra.Config)
+	if err != nil {
+		plugin.DEBUG("Unable to read encryption settings from '%s': %s", cassandra.Config, err)
+		if len(tables) > 0 {
+			plugin.Fprintf(os.Stderr, "@Y{Unable to read encryption settings from %s: %s}\n", cassandra.Config, err)
+		}
+		stanzas = nil
+	}
+
+	if len(tables) == 0 && !commitLogEncrypted(stanzas) {
+		plugin.DEBUG("No encrypted SSTables found")
+		return nil
+	}
+
+	if len(tables) > 0 {
+		plugin.Fprintf(os.Stderr, "@Y{Found encrypted SSTables for %d table(s): %s}\n", len(tables), strings.Join(tables, ", "))
+	} else {
+		plugin.Fprintf(os.Stderr, "@Y{Commitlog encryption is enabled on this node.}\n")
+	}
+	plugin.Fprintf(os.Stderr, "@Y{Encryption keys are NOT part of this backup; they must be managed separately,}\n")
+	plugin.Fprintf(os.Stderr, "@Y{and be in place on the target node for the archive to be restorable.}\n")
+
+	manifest := Manifest{
+		EncryptedTables:  tables,
+		EncryptionConfig: stanzas,
+	}
+	if stanzas != nil {
+		manifest.CassandraConfig = cassandra.Config
+	}
+	b, err := yaml.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(baseDir, ManifestFile)
+	plugin.DEBUG("Writing manifest file '%s'", path)
+	return plugin.WriteStagingFile(path, b, 0644)
+}
+
+// Read the manifest file from an extracted archive, if any
+func readManifest(baseDir string) (*Manifest, error) {
+	b, err := ioutil.ReadFile(filepath.Join(baseDir, ManifestFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var manifest Manifest
+	if err = yaml.Unmarshal(b, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("Extract-Only Restores", func() {
+	var (
+		tmp      string
+		endpoint plugin.ShieldEndpoint
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-cassandra-extract-")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(os.MkdirAll(filepath.Join(tmp, "backup", "ks1", "t1"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "backup", "ks1", "t1", "mc-1-big-Data.db"), []byte("backed up"), 0644)).Should(Succeed())
+		Ω(exec.Command("tar", "-cf", filepath.Join(tmp, "archive"), "-C", filepath.Join(tmp, "backup"), ".").Run()).Should(Succeed())
+
+		Ω(os.MkdirAll(filepath.Join(tmp, "data", "ks1", "t1-0123"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "data", "ks1", "t1-0123", "mc-1-big-Data.db"), []byte("live"), 0644)).Should(Succeed())
+
+		endpoint = plugin.ShieldEndpoint{
+			"cassandra_password":     "secret",
+			"cassandra_datadir":      filepath.Join(tmp, "data"),
+			"cassandra_tempdir":      filepath.Join(tmp, "staging"),
+			"cassandra_extract_only": true,
+			"cassandra_extract_dir":  filepath.Join(tmp, "extract"),
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	restore := func() error {
+		stdin := os.Stdin
+		defer func() { os.Stdin = stdin }()
+		var err error
+		os.Stdin, err = os.Open(filepath.Join(tmp, "archive"))
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.Stdin.Close()
+		return CassandraPlugin{}.Restore(endpoint)
+	}
+
+	live := func() string {
+		entries, err := ioutil.ReadDir(filepath.Join(tmp, "data", "ks1", "t1-0123"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(entries).Should(HaveLen(1))
+		b, err := ioutil.ReadFile(filepath.Join(tmp, "data", "ks1", "t1-0123", "mc-1-big-Data.db"))
+		Ω(err).ShouldNot(HaveOccurred())
+		return string(b)
+	}
+
+	It("unpacks the archive into the extract directory, leaving the data directory alone", func() {
+		Ω(restore()).Should(Succeed())
+		Ω(ioutil.ReadFile(filepath.Join(tmp, "extract", "ks1", "t1", "mc-1-big-Data.db"))).Should(Equal([]byte("backed up")))
+		Ω(live()).Should(Equal("live"))
+		Ω(filepath.Join(tmp, "staging")).ShouldNot(BeADirectory())
+	})
+
+	It("unpacks into an existing, empty extract directory", func() {
+		Ω(os.Mkdir(filepath.Join(tmp, "extract"), 0755)).Should(Succeed())
+		Ω(restore()).Should(Succeed())
+		Ω(ioutil.ReadFile(filepath.Join(tmp, "extract", "ks1", "t1", "mc-1-big-Data.db"))).Should(Equal([]byte("backed up")))
+	})
+
+	It("refuses extract directories that are not empty", func() {
+		Ω(os.Mkdir(filepath.Join(tmp, "extract"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "extract", "previous"), []byte("left over"), 0644)).Should(Succeed())
+
+		err := restore()
+		Ω(err).Should(MatchError(ContainSubstring("is not empty")))
+		Ω(filepath.Join(tmp, "extract", "ks1")).ShouldNot(BeADirectory())
+		Ω(live()).Should(Equal("live"))
+	})
+
+	It("requires an extract directory", func() {
+		delete(endpoint, "cassandra_extract_dir")
+		err := restore()
+		Ω(err).Should(BeAssignableToTypeOf(plugin.ConfigError{}))
+		Ω(live()).Should(Equal("live"))
+	})
+})
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mattn/go-shellwords"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Archive filters
+//
+// `cassandra_backup_filter` and `cassandra_restore_filter` are commands that
+// the tar stream goes through, on its way out (before it is chunked, if it
+// is) and on its way in (after it is reassembled), i.e. to compress or
+// encrypt it with tools that SHIELD knows nothing about.  Filters read the
+// stream on their standard input and write the result to their standard
+// output.  They are split into words like any other command, but not run
+// through a shell.
+
+// filterCommand returns the executable of a filter command.
+func filterCommand(filter string) (string, error) {
+	args, err := shellwords.Parse(filter)
+	if err != nil {
+		return "", err
+	}
+	if len(args) == 0 {
+		return "", fmt.Errorf("empty command")
+	}
+	return args[0], nil
+}
+
+// filterError reports the failure of a filter command, which is what failed
+// first when it breaks the pipeline.
+func filterError(key, filter string, err error) error {
+	return fmt.Errorf("%s `%s` failed: %s", key, filter, err)
+}
+
+// filterOutput wraps `run`, which writes the archive to the file it is
+// given, so that it goes through the `filter` command instead.
+func filterOutput(filter string, run func(out *os.File) error) func(out *os.File) error {
+	return func(out *os.File) error {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+
+		errs := make(chan error, 1)
+		go func() {
+			plugin.DEBUG("Executing backup filter `%s`", filter)
+			err := plugin.ExecWithOptions(plugin.ExecOptions{Cmd: filter, Stdin: r, Stdout: out, Stderr: os.Stderr, ExpectRC: []int{0}})
+			/* a failing filter must not leave the archiver hanging */
+			r.Close()
+			errs <- err
+		}()
+		err = run(w)
+		w.Close()
+
+		if ferr := <-errs; ferr != nil {
+			return filterError("cassandra_backup_filter", filter, ferr)
+		}
+		return err
+	}
+}
+
+// filterInput returns the archive read from `in`, once it went through the
+// `filter` command.  The returned function waits for the filter to exit.
+func filterInput(filter string, in *os.File) (*os.File, func() error, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		plugin.DEBUG("Executing restore filter `%s`", filter)
+		err := plugin.ExecWithOptions(plugin.ExecOptions{Cmd: filter, Stdin: in, Stdout: w, Stderr: os.Stderr, ExpectRC: []int{0}})
+		w.Close()
+		errs <- err
+	}()
+
+	return r, func() error {
+		/* a failing archiver must not leave the filter hanging */
+		r.Close()
+		if err := <-errs; err != nil {
+			return filterError("cassandra_restore_filter", filter, err)
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Archive Filters", func() {
+	var tmp string
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-cassandra-filters-")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	archive := func(out *os.File) error {
+		_, err := out.Write([]byte("some archive"))
+		return err
+	}
+
+	It("pipes archives through the backup filter", func() {
+		out, err := os.Create(filepath.Join(tmp, "out"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(filterOutput("tr a-z A-Z", archive)(out)).Should(Succeed())
+		out.Close()
+
+		b, err := ioutil.ReadFile(filepath.Join(tmp, "out"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(b)).Should(Equal("SOME ARCHIVE"))
+	})
+
+	It("fails the backup when the backup filter fails", func() {
+		out, err := os.Create(filepath.Join(tmp, "out"))
+		Ω(err).ShouldNot(HaveOccurred())
+		defer out.Close()
+
+		err = filterOutput("sh -c 'cat >/dev/null; exit 3'", archive)(out)
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(HavePrefix("cassandra_backup_filter `sh -c 'cat >/dev/null; exit 3'` failed"))
+	})
+
+	It("pipes archives through the restore filter", func() {
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "in"), []byte("SOME ARCHIVE"), 0644)).Should(Succeed())
+		in, err := os.Open(filepath.Join(tmp, "in"))
+		Ω(err).ShouldNot(HaveOccurred())
+		defer in.Close()
+
+		r, wait, err := filterInput("tr A-Z a-z", in)
+		Ω(err).ShouldNot(HaveOccurred())
+		b, err := ioutil.ReadAll(r)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(wait()).Should(Succeed())
+		Ω(string(b)).Should(Equal("some archive"))
+	})
+
+	It("fails the restore when the restore filter fails", func() {
+		in, err := os.Open(os.DevNull)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer in.Close()
+
+		r, wait, err := filterInput("false", in)
+		Ω(err).ShouldNot(HaveOccurred())
+		ioutil.ReadAll(r)
+		err = wait()
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(HavePrefix("cassandra_restore_filter `false` failed"))
+	})
+
+	It("tells which executable a filter runs", func() {
+		bin, err := filterCommand("  gpg --encrypt -r 'SHIELD Backups'")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(bin).Should(Equal("gpg"))
+
+		_, err = filterCommand("gpg 'unterminated")
+		Ω(err).Should(HaveOccurred())
+	})
+})
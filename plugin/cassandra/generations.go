@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Snapshot generations
+//
+// By default, each backup takes the `shield-backup` snapshot, and clears it
+// once the archive has been streamed.  When `cassandra_snapshot_generations`
+// is set, each backup names its snapshot after its generation, the UTC time
+// it started at (i.e. `shield-backup-20240131T020000Z`), and keeps it on the
+// node once the backup succeeded.  Only that many generations are kept: the
+// oldest ones are cleared after each successful backup.  The snapshot of a
+// failed backup is cleared right away.  Since snapshots are hard links,
+// generations hold on to the disk space of the SSTables that compaction
+// replaced since.
+//
+// The `list-snapshots` command lists the `shield-backup` snapshots found on
+// the node, generations or not, with the time they were taken (the oldest
+// modification time of their table directories) and the size of their
+// files, as JSON.  That size is mostly shared with the live data, and with
+// the other generations.
+//
+// When `cassandra_restore_generation` is set, restores load that generation
+// of the snapshot, from the node, instead of the archive, which is not read.
+// Snapshots hold the SSTables only: there is no schema, users or manifest to
+// restore or check them against, as there is in archives.
+
+// generationFormat is the layout of the generations of the snapshot.
+const generationFormat = "20060102T150405Z"
+
+// generationRegexp matches the generations that backups name their
+// snapshots after, and that they clear once they are too old.
+var generationRegexp = regexp.MustCompile(`^[0-9]{8}T[0-9]{6}Z$`)
+
+// newGeneration returns the generation of a backup that starts at t.
+func newGeneration(t time.Time) string {
+	return t.UTC().Format(generationFormat)
+}
+
+// snapshotName returns the name of the snapshot that the backup takes, or
+// that the restore reads.
+func (cassandra *CassandraInfo) snapshotName() string {
+	if cassandra.Generation == "" {
+		return SnapshotName
+	}
+	return SnapshotName + "-" + cassandra.Generation
+}
+
+// generationOf returns the generation of a snapshot, and whether it is a
+// `shield-backup` snapshot at all.
+func generationOf(name string) (string, bool) {
+	if name == SnapshotName {
+		return "", true
+	}
+	if !strings.HasPrefix(name, SnapshotName+"-") {
+		return "", false
+	}
+	return strings.TrimPrefix(name, SnapshotName+"-"), true
+}
+
+// snapshotDirs returns the directories of the snapshots whose name matches
+// a pattern, in the table directories of a data directory.
+func snapshotDirs(dataDir, pattern string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dataDir, "*", "*", "snapshots", pattern))
+	if err != nil {
+		return nil, err
+	}
+	dirs := []string{}
+	for _, dir := range matches {
+		table := filepath.Base(filepath.Dir(filepath.Dir(dir)))
+		if !reservedTableDirs[table] && !strings.HasPrefix(table, ".") {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, nil
+}
+
+// listSnapshots returns the `shield-backup` snapshots of a data directory,
+// i.e. those found in {dataDir}/{keyspace}/{table}/snapshots.
+func listSnapshots(dataDir string) ([]plugin.Snapshot, error) {
+	dirs, err := snapshotDirs(dataDir, SnapshotName+"*")
+	if err != nil {
+		return nil, err
+	}
+	snapshots := map[string]*plugin.Snapshot{}
+	for _, dir := range dirs {
+		generation, ok := generationOf(filepath.Base(dir))
+		if !ok {
+			continue
+		}
+		info, err := os.Stat(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			continue
+		}
+		s, ok := snapshots[info.Name()]
+		if !ok {
+			s = &plugin.Snapshot{Name: info.Name(), Generation: generation, CreatedAt: info.ModTime().UTC()}
+			snapshots[info.Name()] = s
+		}
+		if info.ModTime().Before(s.CreatedAt) {
+			s.CreatedAt = info.ModTime().UTC()
+		}
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if file.Mode().IsRegular() {
+				s.Bytes += file.Size()
+			}
+		}
+	}
+
+	l := []plugin.Snapshot{}
+	for _, s := range snapshots {
+		l = append(l, *s)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Name < l[j].Name })
+	return l, nil
+}
+
+// Snapshots lists the `shield-backup` snapshots of the node.
+func (p CassandraPlugin) Snapshots(endpoint plugin.ShieldEndpoint) ([]plugin.Snapshot, error) {
+	cassandra, err := cassandraInfo(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return listSnapshots(cassandra.DataDir)
+}
+
+// expiredGenerations returns the generations of the snapshot, among those
+// of the data directory, that are past the newest keep ones.  Snapshots
+// whose name does not end with a generation are left alone.
+func expiredGenerations(snapshots []plugin.Snapshot, keep int) []string {
+	generations := []string{}
+	for _, s := range snapshots {
+		if generationRegexp.MatchString(s.Generation) {
+			generations = append(generations, s.Generation)
+		}
+	}
+	/* generations sort by time, newest first */
+	sort.Sort(sort.Reverse(sort.StringSlice(generations)))
+	if len(generations) <= keep {
+		return []string{}
+	}
+	return generations[keep:]
+}
+
+// keepGeneration keeps the snapshot of a successful backup, and clears the
+// generations that are past cassandra_snapshot_generations.
+func keepGeneration(cassandra *CassandraInfo) error {
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Keep snapshot '%s'}\n", cassandra.snapshotName())
+
+	snapshots, err := listSnapshots(cassandra.DataDir)
+	if err != nil {
+		return err
+	}
+	for _, generation := range expiredGenerations(snapshots, cassandra.SnapshotGenerations) {
+		name := SnapshotName + "-" + generation
+		plugin.DEBUG("Clearing snapshot '%s', past the last %d generations", name, cassandra.SnapshotGenerations)
+		if err := nodetool(cassandra, fmt.Sprintf("%s/nodetool clearsnapshot -t %s", cassandra.BinDir, name)); err != nil {
+			return err
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Clear expired snapshot '%s'}\n", name)
+	}
+	return nil
+}
+
+// stageGeneration hard-links the files of the generation of the snapshot
+// to restore into baseDir/{keyspace}/{tablename}, the way backups stage
+// them before they are archived.
+func stageGeneration(cassandra *CassandraInfo, baseDir string) error {
+	dirs, err := snapshotDirs(cassandra.DataDir, cassandra.snapshotName())
+	if err != nil {
+		return err
+	}
+	if len(dirs) == 0 {
+		return plugin.ConfigError{Key: "cassandra_restore_generation", Err: fmt.Errorf("there is no '%s' snapshot on this node", cassandra.snapshotName())}
+	}
+
+	keyspaces := map[string]bool{}
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(cassandra.DataDir, dir)
+		if err != nil {
+			return err
+		}
+		keyspaces[strings.Split(rel, string(filepath.Separator))[0]] = true
+	}
+	for keyspace := range keyspaces {
+		if err := hardLinkKeyspace(cassandra.DataDir, baseDir, keyspace, cassandra.snapshotName(), cassandra.SkipComponents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("Snapshot Generations", func() {
+	var tmp, dataDir, baseDir string
+
+	orders := "ks1/orders-5bc52802de2511e6a6b5d13f3c2b2a1a"
+	secrets := "ks2/secrets-7a1f3c40de2611e6a6b5d13f3c2b2a1a"
+
+	snapshot := func(table, name string, files map[string]string) {
+		dir := filepath.Join(dataDir, table, "snapshots", name)
+		Ω(os.MkdirAll(dir, 0755)).Should(Succeed())
+		for file, content := range files {
+			Ω(ioutil.WriteFile(filepath.Join(dir, file), []byte(content), 0644)).Should(Succeed())
+		}
+	}
+
+	size := func(dir string) int64 {
+		var n int64
+		files, err := ioutil.ReadDir(filepath.Join(dataDir, dir))
+		Ω(err).ShouldNot(HaveOccurred())
+		for _, f := range files {
+			n += f.Size()
+		}
+		return n
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-cassandra-")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		dataDir = filepath.Join(tmp, "data")
+		baseDir = filepath.Join(tmp, "backup")
+		Ω(copyTree("test/fixtures", dataDir)).Should(Succeed())
+		Ω(os.MkdirAll(baseDir, 0755)).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	It("names generations after the UTC time of the backup", func() {
+		t := time.Date(2024, 1, 31, 3, 0, 0, 0, time.FixedZone("CET", 3600))
+		Ω(newGeneration(t)).Should(Equal("20240131T020000Z"))
+		Ω((&CassandraInfo{}).snapshotName()).Should(Equal("shield-backup"))
+		Ω((&CassandraInfo{Generation: "20240131T020000Z"}).snapshotName()).Should(Equal("shield-backup-20240131T020000Z"))
+	})
+
+	It("lists the shield-backup snapshots of the table directories, with their size", func() {
+		snapshot(orders, "shield-backup-20240131T020000Z", map[string]string{"mc-4-big-Data.db": "0123456789"})
+		snapshot(secrets, "shield-backup-20240131T020000Z", map[string]string{"mc-2-big-Data.db": "01234"})
+		snapshot(orders, "other", map[string]string{"mc-4-big-Data.db": "0123456789"})
+
+		snapshots, err := listSnapshots(dataDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(snapshots).Should(HaveLen(2))
+
+		Ω(snapshots[0].Name).Should(Equal("shield-backup"))
+		Ω(snapshots[0].Generation).Should(Equal(""))
+		/* not the stray ks1/snapshots directory, which is no table */
+		Ω(snapshots[0].Bytes).Should(Equal(size(orders+"/snapshots/shield-backup") + size(secrets+"/snapshots/shield-backup")))
+
+		Ω(snapshots[1].Name).Should(Equal("shield-backup-20240131T020000Z"))
+		Ω(snapshots[1].Generation).Should(Equal("20240131T020000Z"))
+		Ω(snapshots[1].Bytes).Should(Equal(int64(15)))
+		Ω(snapshots[1].CreatedAt.IsZero()).Should(BeFalse())
+	})
+
+	It("expires the oldest generations, and leaves other snapshots alone", func() {
+		snapshots := []plugin.Snapshot{
+			{Name: "shield-backup"},
+			{Name: "shield-backup-20240129T020000Z", Generation: "20240129T020000Z"},
+			{Name: "shield-backup-manual", Generation: "manual"},
+			{Name: "shield-backup-20240131T020000Z", Generation: "20240131T020000Z"},
+			{Name: "shield-backup-20240130T020000Z", Generation: "20240130T020000Z"},
+		}
+		Ω(expiredGenerations(snapshots, 2)).Should(Equal([]string{"20240129T020000Z"}))
+		Ω(expiredGenerations(snapshots, 1)).Should(Equal([]string{"20240130T020000Z", "20240129T020000Z"}))
+		Ω(expiredGenerations(snapshots, 3)).Should(BeEmpty())
+	})
+
+	It("stages a generation the way backups stage their snapshot", func() {
+		snapshot(orders, "shield-backup-20240131T020000Z", map[string]string{"mc-4-big-Data.db": "0123456789", "mc-4-big-Data.db.tmp": "x"})
+
+		cassandra := &CassandraInfo{DataDir: dataDir, Generation: "20240131T020000Z", SkipComponents: DefaultSkipComponents}
+		Ω(stageGeneration(cassandra, baseDir)).Should(Succeed())
+		Ω(listDir(baseDir)).Should(Equal([]string{"ks1"}))
+		Ω(listDir(filepath.Join(baseDir, "ks1"))).Should(Equal([]string{"orders"}))
+		Ω(listDir(filepath.Join(baseDir, "ks1", "orders"))).Should(Equal([]string{"mc-4-big-Data.db"}))
+	})
+
+	It("fails to stage a generation that is not on the node", func() {
+		cassandra := &CassandraInfo{DataDir: dataDir, Generation: "20240131T020000Z"}
+		err := stageGeneration(cassandra, baseDir)
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("no 'shield-backup-20240131T020000Z' snapshot"))
+	})
+})
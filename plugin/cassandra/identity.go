@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Node identity
+//
+// Archives hold the SSTables of one node, which only make sense on the node
+// that owns the same token ranges.  The hostname of the node, and its host
+// ID, data center and rack (as `nodetool info` tells them) are recorded into
+// the manifest at backup time.  On restore, they are checked against the
+// node being restored, and the restore fails on a mismatch, unless
+// `cassandra_force_restore` is true, which turns the failure into a warning.
+// That is needed when restoring onto a replacement node, or another cluster.
+
+// hostname returns the hostname of the node the plugin runs on.
+var hostname = os.Hostname
+
+// nodetoolInfo runs `nodetool info`, and returns what it printed.
+var nodetoolInfo = func(cassandra *CassandraInfo) ([]byte, error) {
+	cmd := exec.Command(filepath.Join(cassandra.BinDir, "nodetool"), "info")
+	cmd.Stderr = os.Stderr
+	plugin.DEBUG("Executing `%s/nodetool info`", cassandra.BinDir)
+	return cmd.Output()
+}
+
+// NodeIdentity tells which node an archive comes from.
+type NodeIdentity struct {
+	Hostname   string `yaml:"hostname,omitempty"`
+	HostID     string `yaml:"host_id,omitempty"`
+	DataCenter string `yaml:"data_center,omitempty"`
+	Rack       string `yaml:"rack,omitempty"`
+}
+
+// parseNodetoolInfo reads the host ID, data center and rack out of the
+// "Key : value" lines that `nodetool info` prints.
+func parseNodetoolInfo(out []byte, id *NodeIdentity) {
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "ID":
+			id.HostID = value
+		case "Data Center":
+			id.DataCenter = value
+		case "Rack":
+			id.Rack = value
+		}
+	}
+}
+
+// nodeIdentity returns the identity of the node.  Whatever can't be found
+// out is left empty, with the errors that prevented it.
+func nodeIdentity(cassandra *CassandraInfo) (NodeIdentity, []error) {
+	var (
+		id   NodeIdentity
+		errs []error
+	)
+
+	name, err := hostname()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("unable to get the hostname: %s", err))
+	}
+	id.Hostname = name
+
+	out, err := nodetoolInfo(cassandra)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("unable to run `nodetool info`: %s", err))
+	} else {
+		parseNodetoolInfo(out, &id)
+	}
+	return id, errs
+}
+
+// recordIdentity records the identity of the node into the manifest of the
+// backup.  Failing to find it out only gets a warning: the archive is just
+// as good, it won't be checked on restore.
+func recordIdentity(cassandra *CassandraInfo, baseDir string) error {
+	id, errs := nodeIdentity(cassandra)
+	for _, err := range errs {
+		plugin.Fprintf(os.Stderr, "@Y{%s; the archive won't record it}\n", err)
+	}
+
+	manifest, err := readManifest(baseDir)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		manifest = &Manifest{}
+	}
+	manifest.Node = id
+
+	b, err := yaml.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(baseDir, ManifestFile)
+	plugin.DEBUG("Writing manifest file '%s'", path)
+	return plugin.WriteStagingFile(path, b, 0644)
+}
+
+// identityMismatches lists how the node an archive comes from differs from
+// the given one.  What either side doesn't know isn't compared.
+func identityMismatches(archived, node NodeIdentity) []string {
+	mismatches := []string{}
+	for _, field := range []struct{ name, archived, node string }{
+		{"hostname", archived.Hostname, node.Hostname},
+		{"host ID", archived.HostID, node.HostID},
+		{"data center", archived.DataCenter, node.DataCenter},
+		{"rack", archived.Rack, node.Rack},
+	} {
+		if field.archived != "" && field.node != "" && field.archived != field.node {
+			mismatches = append(mismatches, fmt.Sprintf("%s %s (this node: %s)", field.name, field.archived, field.node))
+		}
+	}
+	return mismatches
+}
+
+// checkIdentity checks that the archive comes from the node being restored.
+// Archives made before the identity was recorded are not checked.
+func checkIdentity(cassandra *CassandraInfo, manifest *Manifest) error {
+	if manifest == nil || manifest.Node == (NodeIdentity{}) {
+		plugin.Fprintf(os.Stderr, "@Y{The archive does not record which node it comes from; not checking it}\n")
+		return nil
+	}
+
+	node, errs := nodeIdentity(cassandra)
+	for _, err := range errs {
+		plugin.Fprintf(os.Stderr, "@Y{%s; not checking it against the archive}\n", err)
+	}
+
+	mismatches := identityMismatches(manifest.Node, node)
+	if len(mismatches) == 0 {
+		return nil
+	}
+	if cassandra.ForceRestore {
+		plugin.Fprintf(os.Stderr, "@Y{The archive comes from another node: %s; restoring anyway, as cassandra_force_restore is set}\n", strings.Join(mismatches, ", "))
+		return nil
+	}
+	return fmt.Errorf("the archive comes from another node: %s; set cassandra_force_restore to restore it on this node anyway (i.e. onto a replacement node)", strings.Join(mismatches, ", "))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Node Identity", func() {
+	var (
+		baseDir   string
+		name      string
+		info      string
+		infoErr   error
+		savedHost func() (string, error)
+		savedInfo func(*CassandraInfo) ([]byte, error)
+	)
+
+	BeforeEach(func() {
+		var err error
+		baseDir, err = ioutil.TempDir("", "shield-cassandra-")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		name = "cassandra-0"
+		info = "ID                     : 2a1f9c3e-4b7d-4e2a-9f1c-6d8e0b3a5c7f\n" +
+			"Gossip active          : true\n" +
+			"Load                   : 1.2 GiB\n" +
+			"Data Center            : dc1\n" +
+			"Rack                   : rack1\n"
+		infoErr = nil
+
+		savedHost, savedInfo = hostname, nodetoolInfo
+		hostname = func() (string, error) { return name, nil }
+		nodetoolInfo = func(cassandra *CassandraInfo) ([]byte, error) {
+			return []byte(info), infoErr
+		}
+	})
+
+	AfterEach(func() {
+		hostname, nodetoolInfo = savedHost, savedInfo
+		os.RemoveAll(baseDir)
+	})
+
+	It("records the node identity in the manifest, along with the table IDs", func() {
+		Ω(recordTableIDs(baseDir, map[string]string{"ks1.orders": "5bc5"})).Should(Succeed())
+		Ω(recordIdentity(&CassandraInfo{}, baseDir)).Should(Succeed())
+
+		manifest, err := readManifest(baseDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(manifest.TableIDs).Should(HaveKey("ks1.orders"))
+		Ω(manifest.Node).Should(Equal(NodeIdentity{
+			Hostname:   "cassandra-0",
+			HostID:     "2a1f9c3e-4b7d-4e2a-9f1c-6d8e0b3a5c7f",
+			DataCenter: "dc1",
+			Rack:       "rack1",
+		}))
+	})
+
+	It("records what it can when nodetool is unavailable", func() {
+		infoErr = fmt.Errorf("exit status 1")
+		Ω(recordIdentity(&CassandraInfo{}, baseDir)).Should(Succeed())
+
+		manifest, err := readManifest(baseDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(manifest.Node).Should(Equal(NodeIdentity{Hostname: "cassandra-0"}))
+	})
+
+	It("restores archives of the same node", func() {
+		Ω(recordIdentity(&CassandraInfo{}, baseDir)).Should(Succeed())
+		manifest, err := readManifest(baseDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(checkIdentity(&CassandraInfo{}, manifest)).Should(Succeed())
+	})
+
+	It("refuses archives of another node, unless forced", func() {
+		Ω(recordIdentity(&CassandraInfo{}, baseDir)).Should(Succeed())
+		manifest, err := readManifest(baseDir)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		name = "cassandra-1"
+		info = "ID : 0f0e0d0c-0b0a-4908-8706-050403020100\nData Center : dc1\nRack : rack1\n"
+		err = checkIdentity(&CassandraInfo{}, manifest)
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("hostname cassandra-0 (this node: cassandra-1)"))
+		Ω(err.Error()).Should(ContainSubstring("host ID 2a1f9c3e-4b7d-4e2a-9f1c-6d8e0b3a5c7f"))
+		Ω(err.Error()).ShouldNot(ContainSubstring("rack"))
+
+		Ω(checkIdentity(&CassandraInfo{ForceRestore: true}, manifest)).Should(Succeed())
+	})
+
+	It("does not check archives that do not record their node", func() {
+		name = "elsewhere"
+		Ω(checkIdentity(&CassandraInfo{}, nil)).Should(Succeed())
+		Ω(checkIdentity(&CassandraInfo{}, &Manifest{TableIDs: map[string]string{"ks1.orders": "5bc5"}})).Should(Succeed())
+	})
+})
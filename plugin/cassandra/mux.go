@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Parallel archiving
+//
+// A single `tar -c .` reads the files of the backup one after the other,
+// which leaves most disks idle on nodes whose data directories span several
+// of them.  When `cassandra_tar_jobs` is more than 1, each keyspace directory
+// is archived by its own `tar` (along with one more for the files at the
+// root of the backup), up to that many at a time, and their outputs are
+// multiplexed into the archive:
+//
+//    {"format":"shield-cassandra-mux/1","streams":[".","ks1","ks2"]}\n
+//    <frame> <frame> ...
+//
+// The first line is the index of the streams; each frame is a 4-byte stream
+// number (its position in the index), a 4-byte length, and that many bytes
+// of the tar stream, in network byte order.  A frame of length 0 ends its
+// stream.  Restores detect the format from the first line, and extract each
+// stream with its own `tar -x`, into the same directory; the result is the
+// same as for a single tar archive.
+
+const MuxArchiveFormat = "shield-cassandra-mux/1"
+
+// MuxFrameSize is the largest amount of data carried by a single frame.
+var MuxFrameSize = 1024 * 1024
+
+/* frame buffers are recycled, rather than allocated for every frame */
+var muxBuffers sync.Pool
+
+func muxBuffer() []byte {
+	if b, ok := muxBuffers.Get().([]byte); ok && len(b) == MuxFrameSize {
+		return b
+	}
+	return make([]byte, MuxFrameSize)
+}
+
+type MuxIndex struct {
+	Format  string   `json:"format"`
+	Streams []string `json:"streams"`
+}
+
+type muxFrame struct {
+	stream int
+	data   []byte
+}
+
+// muxStreams returns what each stream archives: the files at the root of
+// the backup go in the first one (".", if there are any), and each directory
+// (i.e. keyspace) in its own.  The backup is staged in baseDir, or in its
+// `archiveRoot` subdirectory when set (see root.go), and the entries are
+// relative to baseDir.
+func muxStreams(baseDir, archiveRoot string) ([]string, [][]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(baseDir, archiveRoot))
+	if err != nil {
+		return nil, nil, err
+	}
+	prefix := "./"
+	if archiveRoot != "" {
+		prefix = archiveRoot + "/"
+	}
+	names, contents := []string{}, [][]string{}
+	root := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+			contents = append(contents, []string{prefix + entry.Name()})
+		} else {
+			root = append(root, prefix+entry.Name())
+		}
+	}
+	if len(root) > 0 {
+		names = append([]string{"."}, names...)
+		contents = append([][]string{root}, contents...)
+	}
+	return names, contents, nil
+}
+
+// tarStream runs `tar -c` for the given entries of baseDir, and sends its
+// output as frames of the given stream, ending with an empty one.
+func tarStream(cassandra *CassandraInfo, baseDir string, stream int, entries []string, frames chan<- muxFrame) error {
+	cmd := fmt.Sprintf("%s -c -C %s -f -", cassandra.Tar, baseDir)
+	for _, entry := range entries {
+		cmd = fmt.Sprintf("%s \"%s\"", cmd, entry)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		frames <- muxFrame{stream: stream}
+		return err
+	}
+	errs := make(chan error, 1)
+	go func() {
+		plugin.DEBUG("Executing `%s`", cmd)
+		err := plugin.ExecWithOptions(plugin.ExecOptions{Cmd: cmd, Stdout: w, ExpectRC: []int{0}})
+		w.Close()
+		errs <- err
+	}()
+
+	for {
+		buf := muxBuffer()
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			frames <- muxFrame{stream: stream, data: buf[:n]}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			err = rerr
+			break
+		}
+	}
+	/* a failing read must not leave tar hanging */
+	r.Close()
+	frames <- muxFrame{stream: stream}
+
+	if terr := <-errs; terr != nil {
+		return terr
+	}
+	return err
+}
+
+// muxArchive writes the multiplexed archive of baseDir to `out`, running
+// up to `cassandra_tar_jobs` tar commands at a time.
+func muxArchive(cassandra *CassandraInfo, baseDir string, out *os.File) error {
+	names, contents, err := muxStreams(baseDir, cassandra.ArchiveRoot)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(MuxIndex{Format: MuxArchiveFormat, Streams: names})
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	if _, err = w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	frames := make(chan muxFrame, cassandra.TarJobs)
+	errs := make(chan error, len(names))
+	jobs := make(chan struct{}, cassandra.TarJobs)
+	go func() {
+		for i := range names {
+			jobs <- struct{}{}
+			go func(i int) {
+				err := tarStream(cassandra, baseDir, i, contents[i], frames)
+				if err != nil {
+					err = fmt.Errorf("archiving '%s' failed: %s", names[i], err)
+				}
+				errs <- err
+				<-jobs
+			}(i)
+		}
+	}()
+
+	/* keep reading frames after a failure, so that every tar runs to its end */
+	ended := 0
+	for ended < len(names) {
+		f := <-frames
+		if len(f.data) == 0 {
+			ended++
+			plugin.DEBUG("Archived '%s'", names[f.stream])
+		}
+		if err != nil {
+			continue
+		}
+		err = writeMuxFrame(w, f.stream, f.data)
+		if len(f.data) > 0 {
+			muxBuffers.Put(f.data[:cap(f.data)])
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+
+	for range names {
+		if terr := <-errs; terr != nil && err == nil {
+			err = terr
+		}
+	}
+	return err
+}
+
+// writeMuxFrame writes a frame of the given stream; a frame without data
+// ends the stream.
+func writeMuxFrame(w io.Writer, stream int, data []byte) error {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:4], uint32(stream))
+	binary.BigEndian.PutUint32(header[4:8], uint32(len(data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// muxed tells whether the archive read from `in` is a multiplexed one.
+func muxed(in *bufio.Reader) bool {
+	head := fmt.Sprintf(`{"format":"%s"`, MuxArchiveFormat)
+	b, _ := in.Peek(len(head))
+	return string(b) == head
+}
+
+// untarStream is the `tar -x` of one stream of a multiplexed archive.
+type untarStream struct {
+	in   *os.File
+	errs chan error
+}
+
+func startUntar(cassandra *CassandraInfo, dir string) (*untarStream, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	s := &untarStream{in: w, errs: make(chan error, 1)}
+	go func() {
+		cmd := fmt.Sprintf("%s -x -C %s -f -", cassandra.Tar, dir)
+		plugin.DEBUG("Executing `%s`", cmd)
+		err := plugin.ExecWithOptions(plugin.ExecOptions{Cmd: cmd, Stdin: r, ExpectRC: []int{0}})
+		/* a failing tar must not leave the demultiplexer hanging */
+		r.Close()
+		s.errs <- err
+	}()
+	return s, nil
+}
+
+func (s *untarStream) wait() error {
+	s.in.Close()
+	return <-s.errs
+}
+
+// demuxArchive extracts a multiplexed archive into dir, with one `tar -x`
+// per stream, started at its first frame, and waited for at its last.
+func demuxArchive(cassandra *CassandraInfo, in *bufio.Reader, dir string) error {
+	line, err := in.ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("invalid multiplexed archive: %s", err)
+	}
+	var index MuxIndex
+	if err = json.Unmarshal(line, &index); err != nil {
+		return fmt.Errorf("invalid multiplexed archive index: %s", err)
+	}
+	if index.Format != MuxArchiveFormat {
+		return fmt.Errorf("unsupported multiplexed archive format '%s'", index.Format)
+	}
+	plugin.DEBUG("Extracting multiplexed archive of %s", strings.Join(index.Streams, ", "))
+
+	untars := make([]*untarStream, len(index.Streams))
+	ended := make([]bool, len(index.Streams))
+	defer func() {
+		for _, s := range untars {
+			if s != nil {
+				s.wait()
+			}
+		}
+	}()
+
+	header := make([]byte, 8)
+	left := len(index.Streams)
+	for left > 0 {
+		if _, err = io.ReadFull(in, header); err != nil {
+			return fmt.Errorf("multiplexed archive is truncated: %s", err)
+		}
+		stream := int(binary.BigEndian.Uint32(header[0:4]))
+		size := int64(binary.BigEndian.Uint32(header[4:8]))
+		if stream >= len(index.Streams) || ended[stream] {
+			return fmt.Errorf("multiplexed archive is corrupted: unexpected frame for stream #%d", stream)
+		}
+
+		if untars[stream] == nil {
+			if untars[stream], err = startUntar(cassandra, dir); err != nil {
+				return err
+			}
+		}
+		if size > 0 {
+			if _, err = io.CopyN(untars[stream].in, in, size); err == io.EOF {
+				return fmt.Errorf("multiplexed archive is truncated: %s", err)
+			} else if err != nil {
+				return fmt.Errorf("extracting '%s' failed: %s", index.Streams[stream], err)
+			}
+			continue
+		}
+
+		ended[stream] = true
+		left--
+		err = untars[stream].wait()
+		untars[stream] = nil
+		if err != nil {
+			return fmt.Errorf("extracting '%s' failed: %s", index.Streams[stream], err)
+		}
+		plugin.DEBUG("Extracted '%s'", index.Streams[stream])
+	}
+	return nil
+}
+
+// untar extracts the archive read from `in` into dir, whether it is a
+// multiplexed archive or a plain tar one.
+func untar(cassandra *CassandraInfo, in *bufio.Reader, dir string) error {
+	if muxed(in) {
+		return demuxArchive(cassandra, in, dir)
+	}
+	s, err := startUntar(cassandra, dir)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(s.in, in)
+	/* tar failing is what breaks the copy, so it is reported first */
+	if werr := s.wait(); werr != nil {
+		return werr
+	}
+	return err
+}
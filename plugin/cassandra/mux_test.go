@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// backupTree writes a backup directory with a file at its root, and
+// `keyspaces` keyspaces of `files` files of `size` bytes each.
+func backupTree(dir string, keyspaces, files, size int) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, ManifestFile), []byte("table_ids: {}\n"), 0644); err != nil {
+		return err
+	}
+	for k := 1; k <= keyspaces; k++ {
+		table := filepath.Join(dir, fmt.Sprintf("ks%d", k), "orders")
+		if err := os.MkdirAll(table, 0755); err != nil {
+			return err
+		}
+		for f := 1; f <= files; f++ {
+			data := bytes.Repeat([]byte(fmt.Sprintf("ks%d-%d ", k, f)), size/8)
+			if err := ioutil.WriteFile(filepath.Join(table, fmt.Sprintf("nb-%d-big-Data.db", f)), data, 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// treeContents maps the relative paths of the files below dir to their
+// contents.
+func treeContents(dir string) map[string]string {
+	contents := map[string]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		b, err := ioutil.ReadFile(path)
+		contents[rel] = string(b)
+		return err
+	})
+	Ω(err).ShouldNot(HaveOccurred())
+	return contents
+}
+
+var _ = Describe("Parallel Archiving", func() {
+	var (
+		tmp       string
+		src, dst  string
+		cassandra *CassandraInfo
+		frameSize int
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-cassandra-mux-")
+		Ω(err).ShouldNot(HaveOccurred())
+		src = filepath.Join(tmp, "src")
+		dst = filepath.Join(tmp, "dst")
+		Ω(os.Mkdir(src, 0755)).Should(Succeed())
+		Ω(os.Mkdir(dst, 0755)).Should(Succeed())
+		Ω(backupTree(src, 3, 2, 20000)).Should(Succeed())
+
+		cassandra = &CassandraInfo{Tar: "tar", TarJobs: 2}
+		frameSize = MuxFrameSize
+		/* small frames, so that the streams get interleaved */
+		MuxFrameSize = 4096
+	})
+
+	AfterEach(func() {
+		MuxFrameSize = frameSize
+		os.RemoveAll(tmp)
+	})
+
+	archive := func() *os.File {
+		f, err := os.Create(filepath.Join(tmp, "archive"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(muxArchive(cassandra, src, f)).Should(Succeed())
+		_, err = f.Seek(0, 0)
+		Ω(err).ShouldNot(HaveOccurred())
+		return f
+	}
+
+	It("indexes one stream per keyspace, and one for the root files", func() {
+		names, contents, err := muxStreams(src, "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(names).Should(Equal([]string{".", "ks1", "ks2", "ks3"}))
+		Ω(contents[0]).Should(Equal([]string{"./" + ManifestFile}))
+		Ω(contents[2]).Should(Equal([]string{"./ks2"}))
+	})
+
+	It("extracts multiplexed archives into the same tree as the backup", func() {
+		f := archive()
+		defer f.Close()
+
+		in := bufio.NewReader(f)
+		Ω(muxed(in)).Should(BeTrue())
+		Ω(untar(cassandra, in, dst)).Should(Succeed())
+		Ω(treeContents(dst)).Should(Equal(treeContents(src)))
+	})
+
+	It("still extracts plain tar archives", func() {
+		r, w, err := os.Pipe()
+		Ω(err).ShouldNot(HaveOccurred())
+		go func() {
+			plugin.ExecWithOptions(plugin.ExecOptions{Cmd: fmt.Sprintf("tar -c -C %s -f - .", src), Stdout: w, ExpectRC: []int{0}})
+			w.Close()
+		}()
+
+		in := bufio.NewReader(r)
+		Ω(muxed(in)).Should(BeFalse())
+		Ω(untar(cassandra, in, dst)).Should(Succeed())
+		Ω(treeContents(dst)).Should(Equal(treeContents(src)))
+	})
+
+	It("fails on truncated archives", func() {
+		f := archive()
+		defer f.Close()
+		b, err := ioutil.ReadAll(f)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		in := bufio.NewReader(bytes.NewReader(b[:len(b)/2]))
+		err = untar(cassandra, in, dst)
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("multiplexed archive is truncated"))
+	})
+
+	It("fails when one of the tar commands fails", func() {
+		cassandra.Tar = "false"
+		f, err := os.Create(filepath.Join(tmp, "archive"))
+		Ω(err).ShouldNot(HaveOccurred())
+		defer f.Close()
+
+		err = muxArchive(cassandra, src, f)
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("archiving '"))
+	})
+})
+
+// benchmarkArchive archives a backup of 8 keyspaces of 32 MiB each, with
+// a single tar, or with `jobs` concurrent ones.
+func benchmarkArchive(b *testing.B, jobs int) {
+	tmp, err := ioutil.TempDir("", "shield-cassandra-bench-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err = backupTree(tmp, 8, 4, 8*1024*1024); err != nil {
+		b.Fatal(err)
+	}
+	cassandra := &CassandraInfo{Tar: "tar", TarJobs: jobs}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		/* a pipe, since tar skips reading the files when writing to /dev/null */
+		r, w, err := os.Pipe()
+		if err != nil {
+			b.Fatal(err)
+		}
+		done := make(chan int64)
+		go func() {
+			n, _ := io.Copy(ioutil.Discard, r)
+			done <- n
+		}()
+		if jobs > 1 {
+			err = muxArchive(cassandra, tmp, w)
+		} else {
+			err = plugin.ExecWithOptions(plugin.ExecOptions{Cmd: fmt.Sprintf("tar -c -C %s -f - .", tmp), Stdout: w, ExpectRC: []int{0}})
+		}
+		w.Close()
+		b.SetBytes(<-done)
+		r.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSerialArchive(b *testing.B) { benchmarkArchive(b, 1) }
+func BenchmarkMuxArchive4(b *testing.B)   { benchmarkArchive(b, 4) }
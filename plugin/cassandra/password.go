@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Password Sources
+//
+// The password may be kept out of the endpoint: `cassandra_password_file`
+// names a file to read it from, and `cassandra_password_env` an environment
+// variable of the plugin process to take it from. They are looked up at run
+// time, in that order, and take precedence over `cassandra_password`. A
+// trailing newline in the file is not part of the password.
+
+// passwordSource tells where the password comes from, without revealing it,
+// for the `validate` action and debug logs.
+func passwordSource(endpoint plugin.ShieldEndpoint) (string, error) {
+	file, err := endpoint.StringValueDefault("cassandra_password_file", "")
+	if err != nil {
+		return "", err
+	}
+	if file != "" {
+		return fmt.Sprintf("file %s", file), nil
+	}
+
+	env, err := endpoint.StringValueDefault("cassandra_password_env", "")
+	if err != nil {
+		return "", err
+	}
+	if env != "" {
+		return fmt.Sprintf("environment variable $%s", env), nil
+	}
+	return "", nil
+}
+
+// cassandraPassword returns the password to authenticate with, reading it
+// from `cassandra_password_file` or `cassandra_password_env` when set, and
+// falling back on `cassandra_password` otherwise.
+func cassandraPassword(endpoint plugin.ShieldEndpoint) (string, error) {
+	file, err := endpoint.StringValueDefault("cassandra_password_file", "")
+	if err != nil {
+		return "", err
+	}
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", plugin.ConfigError{Key: "cassandra_password_file",
+				Err: fmt.Errorf("unable to read the password file: %s", err)}
+		}
+		password := strings.TrimRight(string(b), "\r\n")
+		if password == "" {
+			return "", plugin.ConfigError{Key: "cassandra_password_file",
+				Err: fmt.Errorf("password file %s is empty", file)}
+		}
+		return password, nil
+	}
+
+	env, err := endpoint.StringValueDefault("cassandra_password_env", "")
+	if err != nil {
+		return "", err
+	}
+	if env != "" {
+		password, ok := os.LookupEnv(env)
+		if !ok || password == "" {
+			return "", plugin.ConfigError{Key: "cassandra_password_env",
+				Err: fmt.Errorf("environment variable $%s is not set", env)}
+		}
+		return password, nil
+	}
+
+	return endpoint.StringValueDefault("cassandra_password", DefaultPassword)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("Password Sources", func() {
+	var (
+		dir    string
+		secret string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "shield-cassandra-")
+		Ω(err).ShouldNot(HaveOccurred())
+		secret = filepath.Join(dir, "secret")
+		Ω(ioutil.WriteFile(secret, []byte("s3cr3t\n"), 0600)).Should(Succeed())
+		os.Setenv("SHIELD_TEST_CASSANDRA_PWD", "fr0m-env")
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("SHIELD_TEST_CASSANDRA_PWD")
+		os.RemoveAll(dir)
+	})
+
+	It("falls back on the inline password, then on the default one", func() {
+		Ω(cassandraPassword(plugin.ShieldEndpoint{"cassandra_password": "inline"})).Should(Equal("inline"))
+		Ω(cassandraPassword(plugin.ShieldEndpoint{})).Should(Equal(DefaultPassword))
+		Ω(passwordSource(plugin.ShieldEndpoint{"cassandra_password": "inline"})).Should(Equal(""))
+	})
+
+	It("reads the password file first, without its trailing newline", func() {
+		endpoint := plugin.ShieldEndpoint{
+			"cassandra_password":      "inline",
+			"cassandra_password_file": secret,
+			"cassandra_password_env":  "SHIELD_TEST_CASSANDRA_PWD",
+		}
+		Ω(cassandraPassword(endpoint)).Should(Equal("s3cr3t"))
+		Ω(passwordSource(endpoint)).Should(Equal("file " + secret))
+	})
+
+	It("takes the password from the environment over the inline one", func() {
+		endpoint := plugin.ShieldEndpoint{
+			"cassandra_password":     "inline",
+			"cassandra_password_env": "SHIELD_TEST_CASSANDRA_PWD",
+		}
+		Ω(cassandraPassword(endpoint)).Should(Equal("fr0m-env"))
+	})
+
+	It("fails on missing or empty sources, rather than using the inline password", func() {
+		for _, endpoint := range []plugin.ShieldEndpoint{
+			{"cassandra_password": "inline", "cassandra_password_file": filepath.Join(dir, "nope")},
+			{"cassandra_password": "inline", "cassandra_password_env": "SHIELD_TEST_CASSANDRA_UNSET"},
+		} {
+			_, err := cassandraPassword(endpoint)
+			Ω(err).Should(BeAssignableToTypeOf(plugin.ConfigError{}))
+		}
+
+		Ω(ioutil.WriteFile(secret, []byte("\n"), 0600)).Should(Succeed())
+		_, err := cassandraPassword(plugin.ShieldEndpoint{"cassandra_password_file": secret})
+		Ω(err).Should(MatchError(ContainSubstring("is empty")))
+	})
+})
@@ -20,12 +20,55 @@
 //        "cassandra_port"              : "9042",             # native transport port
 //        "cassandra_user"              : "username",
 //        "cassandra_password"          : "password",
+//        "cassandra_password_file"     : "/path/to/secret",  # optional
+//        "cassandra_password_env"      : "CASSANDRA_PWD",    # optional
 //        "cassandra_include_keyspaces" : [ "ksXXXX" ],       # optional
 //        "cassandra_exclude_keyspaces" : [ "ksXXXX" ],       # optional
+//        "cassandra_include_tables"    : [ "ksXXXX.tbl" ],   # optional
+//        "cassandra_discover_via_cql"  : false,              # optional
+//        "cassandra_fail_on_missing_keyspace" : false,       # optional
+//        "cassandra_fail_on_empty_backup" : false,           # optional
 //        "cassandra_save_users"        : true,               # optional
+//        "cassandra_export_schema"     : false,              # optional
+//        "cassandra_keep_snapshot"     : false,              # optional
+//        "cassandra_snapshot_skip_flush" : false,            # optional
+//        "cassandra_nodetool_timeout"  : 0,                  # optional, in seconds
+//        "cassandra_peers"             : [ "10.0.0.2" ],     # optional, for cleanup-cluster
+//        "cassandra_peer_access"       : "jmx",              # optional, jmx or ssh
+//        "cassandra_jmx_port"          : 7199,               # optional
+//        "cassandra_jmx_user"          : "username",         # optional
+//        "cassandra_jmx_password"      : "password",         # optional
+//        "cassandra_ssh_key"           : "/path/to/key",     # optional
+//        "cassandra_resume"            : false,              # optional
+//        "cassandra_resume_max_age"    : 12,                 # optional, in hours
+//        "cassandra_snapshot_generations" : 0,               # optional
+//        "cassandra_max_keyspace_bytes" : 0,                 # optional
+//        "cassandra_commitlog_archiving" : false,            # optional
+//        "cassandra_commitlog_archive_dir" : "/path/to/archive",  # optional
+//        "cassandra_skip_components"   : [ "*-tmp-*" ],      # optional
 //        "cassandra_bindir"            : "/path/to/bindir",
 //        "cassandra_datadir"           : "/var/vcap/store/cassandra/<cluster-name>/data",
-//        "cassandra_tar"               : "/path/to/tar"      # where is the tar utility?
+//        "cassandra_tempdir"           : "/var/vcap/store/shield/cassandra",  # optional
+//        "cassandra_config"            : "/path/to/cassandra.yaml",
+//        "cassandra_tar"               : "/path/to/tar",     # where is the tar utility?
+//        "cassandra_tar_jobs"          : 1,                  # optional
+//        "cassandra_archive_root"      : "cassandra-backup", # optional
+//        "cassandra_extract_only"      : false,              # optional
+//        "cassandra_extract_dir"       : "/path/to/scratch", # required with extract_only
+//        "cassandra_restore_generation" : "20240131T020000Z", # optional
+//        "cassandra_restore_point_in_time" : "2024:01:31 02:30:00", # optional, in UTC
+//        "cassandra_force_restore"     : false,              # optional
+//        "cassandra_resume_restore"    : false,              # optional
+//        "cassandra_upgrade_sstables"  : false,              # optional
+//        "cassandra_chunk_size"        : 102400,             # optional, in MiB
+//        "cassandra_chunk_store"       : { "plugin": "s3", "endpoint": { ... } }  # required with chunk_size
+//        "cassandra_backup_filter"     : "age -r age1...",   # optional
+//        "cassandra_restore_filter"    : "age -d -i /path/to/key",  # optional
+//        "cassandra_checksum"          : false,              # optional
+//        "cassandra_dedup"             : false,              # optional, requires chunk_store
+//        "cassandra_dedup_index"       : "/path/to/index.json",  # optional
+//        "cassandra_dedup_max_age"     : 7,                  # optional, in days
+//        "cassandra_split_keyspaces"   : false,              # optional, requires chunk_store
 //    }
 //
 // The plugin provides devault values for those configuration properties, as
@@ -37,14 +80,53 @@
 //        "cassandra_port"              : "9042",
 //        "cassandra_user"              : "cassandra",
 //        "cassandra_password"          : "cassandra",
-//        "cassandra_include_keyspaces" : null,               # Backup all keyspaces
+//        "cassandra_include_keyspaces" : null,               # Backup all keyspaces ([] is none)
 //        "cassandra_exclude_keyspaces" : [ "system_schema", "system_distributed", "system_auth", "system", "system_traces" ],
+//        "cassandra_include_tables"    : null,               # Backup all tables
+//        "cassandra_discover_via_cql"  : false,
+//        "cassandra_fail_on_missing_keyspace" : false,
+//        "cassandra_fail_on_empty_backup" : false,
 //        "cassandra_save_users"        : true,
+//        "cassandra_export_schema"     : false,
+//        "cassandra_keep_snapshot"     : false,
+//        "cassandra_snapshot_skip_flush" : false,            # Flush memtables first
+//        "cassandra_nodetool_timeout"  : 0,
+//        "cassandra_peers"             : [],                 # This node only
+//        "cassandra_peer_access"       : "jmx",
+//        "cassandra_jmx_port"          : 7199,
+//        "cassandra_resume"            : false,
+//        "cassandra_resume_max_age"    : 12,
+//        "cassandra_snapshot_generations" : 0,               # Clear snapshots after backup
+//        "cassandra_max_keyspace_bytes" : 0,                 # Back up keyspaces of any size
+//        "cassandra_commitlog_archiving" : false,            # No commit log segments
+//        "cassandra_skip_components"   : [ "*-tmp-*", "*.tmp*" ],
 //        "cassandra_bindir"            : "/var/vcap/packages/cassandra/bin",
 //        "cassandra_datadir"           : "/var/vcap/store/cassandra/data",
-//        "cassandra_tar"               : "tar"
+//        "cassandra_tempdir"           : "/var/vcap/store/shield/cassandra",
+//        "cassandra_config"            : "/var/vcap/jobs/cassandra/conf/cassandra.yaml",
+//        "cassandra_tar"               : "tar",
+//        "cassandra_tar_jobs"          : 1,                  # A single tar
+//        "cassandra_archive_root"      : "",                 # Entries rooted at ./
+//        "cassandra_extract_only"      : false,
+//        "cassandra_force_restore"     : false,
+//        "cassandra_resume_restore"    : false,
+//        "cassandra_upgrade_sstables"  : false,
+//        "cassandra_chunk_size"        : 0,                  # No chunks
+//        "cassandra_checksum"          : false,
+//        "cassandra_dedup"             : false,
+//        "cassandra_dedup_index"       : "/var/vcap/store/shield/cassandra-dedup-index.json",
+//        "cassandra_dedup_max_age"     : 7,
+//        "cassandra_split_keyspaces"   : false               # One archive for all keyspaces
 //    }
 //
+// The password can be kept out of the endpoint (and out of the SHIELD
+// database) with `cassandra_password_file`, the path of a file on the node to
+// read it from, or `cassandra_password_env`, the name of an environment
+// variable of the plugin to take it from. Either takes precedence over
+// `cassandra_password`, and the file over the variable. The password is read
+// at run time, and `validate` only checks that it can be read, without
+// printing it.
+//
 // BACKUP DETAILS
 //
 // To completely backup the Cassandra cluster, the backup operation needs to
@@ -52,9 +134,10 @@
 // archive. For consistency of the backup archives, backup should ideally
 // happen at the same time on all nodes.
 //
-// When no `cassandra_include_keyspaces` list is specified, then all keyspaces
-// are backuped on a specific node. Be careful that when the
-// `cassandra_include_keyspaces` list is empty, then no keyspace is backed up.
+// When no `cassandra_include_keyspaces` list is specified (it is unset, or
+// null), then all keyspaces are backuped on a specific node. Be careful that
+// when the `cassandra_include_keyspaces` list is empty (`[]`), then no
+// keyspace is backed up.
 //
 // After determining the include list, then the `cassandra_exclude_keyspaces`
 // list is taken into consideration for black-listing keyspaces that must not
@@ -63,6 +146,44 @@
 // excludes these standard system keyspaces: "system", "system_auth",
 // "system_distributed", "system_schema" and "system_traces".
 //
+// When `cassandra_include_tables` is set, only the listed tables (as
+// "keyspace.table" names) are backed up, within the keyspaces that pass the
+// include and exclude lists. The snapshot itself is scoped to them, with one
+// `nodetool snapshot -cf <table> <keyspace>` per table, instead of
+// snapshotting whole keyspaces, which saves disk space and time on nodes with
+// large tables that are left out. Listing a table that does not exist makes
+// `nodetool`, and thus the backup, fail. When the list is not defined, whole
+// keyspaces are snapshotted, and when it is empty, no table is backed up.
+//
+// Keyspaces are found by listing the directories of `cassandra_datadir`. When
+// `cassandra_discover_via_cql` is true, the authoritative list of keyspaces is
+// queried from `system_schema.keyspaces` with `cqlsh` instead, and mapped to
+// the `cassandra_datadir/<keyspace>` directories. This ignores stray
+// directories that are not keyspaces, skips keyspaces that have no data yet,
+// and warns about excluded keyspaces that do not exist.
+//
+// Keyspaces that have no SSTable at all (newly created ones, or ones whose
+// data all expired) leave nothing to back up, and are absent from archives.
+// When `cassandra_export_schema` is true, the schema of every keyspace
+// selected for backup is exported (with `cqlsh -e "DESCRIBE KEYSPACE ..."`),
+// whether it holds data or not, to `shield-schema-<keyspace>.cql` files at the
+// root of the archive, so that a restore recreates empty keyspaces and tables.
+// The keyspaces are then listed with `cqlsh`, even without
+// `cassandra_discover_via_cql`.
+//
+// Keyspaces listed in `cassandra_include_keyspaces` that do not exist (i.e.
+// typos) are reported with a loud warning, since nothing gets backed up for
+// them. When `cassandra_fail_on_missing_keyspace` is true, the backup fails
+// instead.
+//
+// A backup that ends up with no keyspace data at all gets a loud warning too,
+// telling whether the node has no keyspace yet (i.e. it is fresh, or still
+// bootstrapping) or all its keyspaces are left out by the include and exclude
+// lists; so does a backup of a node that `nodetool netstats` reports as
+// JOINING, i.e. bootstrapping, which only holds part of its data. When
+// `cassandra_fail_on_empty_backup` is true, such backups fail instead, before
+// an archive good for nothing replaces good ones.
+//
 // When 'cassandra_save_users' is true (its default value) then the content
 // the 'system_auth' keyspace tables are backuped. Four CSV files are backuped
 // for these tables: "roles", "role_permissions", "role_members",
@@ -73,6 +194,88 @@
 // This is useful not to alter the password of this user, and keep being able
 // to access the cluster for administrative tasks.
 //
+// SSTable component files whose name matches any of the shell patterns listed
+// in `cassandra_skip_components` are left out of the archive. By default,
+// temporary and incomplete components (with `-tmp-` or `.tmp` in their names)
+// are skipped, because `sstableloader` chokes on them at restore time. Add
+// patterns like "*-Digest.crc32" or "*-TOC.txt" to skip more components, or
+// set an empty list to archive everything.
+//
+// The `shield-backup` snapshot is cleared once the archive has been streamed.
+// When `cassandra_keep_snapshot` is true, it is left in place instead, so
+// that the snapshot files can be inspected when a backup looks suspicious.
+// The disk space used by the snapshot is then NOT reclaimed, until an
+// operator runs `nodetool clearsnapshot -t shield-backup`. (The next backup
+// also clears any stale snapshot before taking a new one.) Should `nodetool
+// snapshot` still find a `shield-backup` snapshot in place, because that
+// clear did not fully complete, the snapshot is cleared again and taken
+// anew, once, instead of failing the backup.
+//
+// `nodetool snapshot` flushes the memtables of the tables it snapshots first,
+// so that the snapshot holds every write the node acknowledged until then.
+// Flushing is heavy on I/O, and can slow writes down on busy nodes. When
+// `cassandra_snapshot_skip_flush` is true, snapshots are taken with
+// `--skip-flush`: they only hold what was flushed to SSTables already, and
+// the writes still in memtables (i.e. the last minutes of writes, or more on
+// tables that are seldom flushed) are NOT in the backup. The commit log is
+// not backed up either. This is only safe when the other replicas, or the
+// next backup, are trusted to make up for those writes. It is false by
+// default.
+//
+// When `cassandra_nodetool_timeout` is set, the `nodetool` commands that take
+// and clear the snapshot are killed after running for that many seconds, and
+// the backup fails, with a distinct "timed out" message. The partial
+// snapshot is cleared then, even when `cassandra_keep_snapshot` is true. It
+// is 0 by default, which means no timeout.
+//
+// When `cassandra_resume` is true, a failed backup leaves the `shield-backup`
+// snapshot and the keyspaces it already staged in place, along with a
+// checkpoint (/var/vcap/store/shield/cassandra.checkpoint) that lists them.
+// The next backup resumes from there, without taking the snapshot again,
+// and only stages the remaining keyspaces. Beware that the archive it
+// produces then holds the data as of the first attempt: a checkpoint is only
+// resumed from for `cassandra_resume_max_age` hours (12 by default) after
+// its snapshot was taken. Past that, or when the keyspaces or tables to back
+// up changed, or when the snapshot was cleared in the meantime, the backup
+// starts over. Meanwhile, the snapshot holds on to its disk space.
+//
+// When `cassandra_snapshot_generations` is set, backups keep their snapshot
+// on the node, as `shield-backup-<generation>`, where the generation is the
+// UTC time the backup started at (i.e. `20240131T020000Z`). Only that many
+// generations are kept: the oldest ones are cleared once a backup succeeded,
+// and the snapshot of a failed backup is cleared right away. The snapshots
+// present on the node are listed, as JSON, by the `list-snapshots` command,
+// with their generation, the time they were taken and the size of their
+// files (mostly shared, through hard links, with the live data and the other
+// generations). Generations can't be combined with `cassandra_resume`, and
+// make `cassandra_keep_snapshot` moot.
+//
+// When `cassandra_max_keyspace_bytes` is set, keyspaces whose snapshot holds
+// more than that many bytes (not counting the components left out by
+// `cassandra_skip_components`) are left out of the backup, with a warning,
+// for them to be dumped some other way. The keyspaces left out are listed,
+// with their size, under `skipped_keyspaces` in `shield-manifest.yml`.
+//
+// When `cassandra_commitlog_archiving` is true, the commit log segments that
+// Cassandra archived since the snapshot was taken are added to the archive
+// too, for point-in-time recovery. See POINT-IN-TIME RECOVERY.
+//
+// Tables that are encrypted at rest (transparent data encryption) are
+// detected by looking at the compressor class of their SSTables. Their
+// encryption keys are NOT backed up: a warning is issued, and a
+// `shield-manifest.yml` file is added at the root of the archive, listing the
+// encrypted tables along with the encryption settings found in the
+// `cassandra_config` file. Those keys must be managed separately, and be in
+// place on the node where the archive is to be restored.
+//
+// The `shield-manifest.yml` file also records the ID (CFID) that each table
+// had at backup time. Table directories are named after their tables only in
+// the archive, without their ID.
+//
+// The node the archive comes from is recorded there too: its hostname, and
+// the host ID, data center and rack that `nodetool info` reports. So are the
+// format versions of the SSTables of each table (see SSTABLE FORMATS).
+//
 // RESTORE DETAILS
 //
 // Keyspaces are restored on a specific node. To completely restore the
@@ -80,8 +283,28 @@
 // cluster nodes. This is because in the general case, keyspaces might have a
 // replication factor that is smaler than the number of nodes.
 //
+// The snapshot files are hard-linked into `cassandra_tempdir`
+// (`/var/vcap/store/shield/cassandra` by default) before being archived. It
+// must be on the same filesystem as `cassandra_datadir`, for hard links to
+// work: `validate` checks that it is, and so do backups, before they take the
+// snapshot. It must also be dedicated to the plugin, since it is removed
+// wholesale. The directories created there (and the manifest and
+// schema files) get mode 0755 (0700 for keyspaces, 0644 for files), unless
+// `staging_mode` is set, in which case they all get that mode. The hard links
+// keep the mode of the SSTables they share with Cassandra.
+//
+// That directory is removed at the end of each backup and restore, unless the run
+// fails and `keep_staging_on_failure` is true: it is then left behind, for
+// inspection, and its path printed. The next run removes it (except for backups to
+// be resumed with `cassandra_resume`, which keep their staged keyspaces anyway).
+//
 // Restored keyspaces are subject to the same inclusion/exclusion rules as at
 // backup time, to decide which keyspaces from the archive are considered.
+// This is how a single keyspace gets restored out of an archive that holds
+// them all: set `cassandra_include_keyspaces` to just that one. The whole
+// archive is still extracted, but only the selected keyspaces have their
+// schema applied and their tables loaded. Included keyspaces that the
+// archive does not hold are reported with a warning.
 //
 // The `cassandra_include_keyspaces` list is first taken into consideration.
 // Then, the `cassandra_exclude_keyspaces` list applies, for black-listing
@@ -99,13 +322,40 @@
 // "system", "system_auth", "system_distributed", "system_schema" and
 // "system_traces".
 //
+// When the archive holds schema files (see `cassandra_export_schema`), the
+// schema of the keyspaces to restore is applied first, with `cqlsh -f`, and
+// IF NOT EXISTS added to its CREATE statements: keyspaces, tables and types
+// that are missing from the cluster are created, and existing ones are left
+// alone. Keyspaces that were empty at backup time are restored that way.
+//
+// Before anything is loaded, the tables of the archive are checked against
+// the live schema (`system_schema.tables`, queried with `cqlsh`). Tables that
+// were dropped and created again since the backup (and thus got a new ID) are
+// reported, and their data is loaded into the live table, by name. Tables that
+// do not exist in the cluster make the restore fail right away, since
+// `sstableloader` would fail on them after loading the others; create them
+// first, with the schema they had at backup time.
+//
 // Keyspaces are restored with their original names, as written into the
 // archive. This plugin doesn't support restoring any keyspace to another one
 // with a different name.
 //
 // Restore should happen on the same node where the data has been backuped.
 // This plugin doesn't support restoring keyspaces from one node to another
-// node.
+// node. The hostname, host ID, data center and rack recorded in the archive
+// are checked against the node being restored, and the restore fails when
+// they differ. For disaster recovery, when restoring onto a replacement node
+// (which gets a new host ID) or into another cluster, set
+// `cassandra_force_restore` to true: mismatches are then only warned about.
+// Archives that don't record their node are not checked.
+//
+// When `cassandra_resume_restore` is true, the tables that `sstableloader`
+// loaded are recorded into a checkpoint
+// (/var/vcap/store/shield/cassandra-restore.checkpoint), which a failed
+// restore leaves in place. Restoring the same archive again then skips the
+// tables it lists, instead of streaming them all over again. The checkpoint
+// is only resumed from for `cassandra_resume_max_age` hours (12 by default)
+// after the failed restore started, and is removed once a restore succeeds.
 //
 // When 'cassandra_save_users' is true (its default value) then the four CSV
 // files ("system_auth.roles.csv", "system_auth.role_permissions.csv",
@@ -119,38 +369,306 @@
 // password of this user, and keep being able to access the cluster for
 // administrative tasks.
 //
+// When the archive holds encrypted tables, a reminder is issued that the
+// matching encryption settings and keys must be in place on the node, for
+// `sstableloader` to be able to read them.
+//
+// When `cassandra_extract_only` is true, the restore operation is not
+// destructive: the archive is just unpacked into `cassandra_extract_dir`, and
+// the plugin stops there, without running `sstableloader` nor touching any
+// user or permission. This is meant for operators who want to inspect the
+// contents of a backup, or verify its integrity. The extract directory must
+// not exist yet (or be empty), and needs enough scratch space for the whole
+// uncompressed archive. It is left in place for inspection, and must be
+// cleaned up manually afterwards.
+//
+// When `cassandra_restore_generation` is set, the restore loads that
+// generation of the snapshot (see `cassandra_snapshot_generations`), from
+// the node itself, instead of the archive: its files are hard-linked into
+// the temporary directory, and loaded with `sstableloader` like those of an
+// archive, subject to the same keyspace inclusion and exclusion rules. The
+// archive is not read, so the restore can be run by hand with an empty
+// standard input. Snapshots only hold SSTables: no schema is applied, no
+// user is restored, and the node and table IDs are not checked. It can't be
+// combined with `cassandra_extract_only`.
+//
+// POINT-IN-TIME RECOVERY
+//
+// Snapshots restore the data of a node as of the time of the backup. To
+// restore it as of a later point in time, the writes made since must be
+// replayed from the commit log. This takes some setup on the node first:
+// Cassandra must archive the segments of its commit log as it closes them,
+// with an `archive_command` in the `commitlog_archiving.properties` file
+// that sits next to `cassandra_config`, e.g.:
+//
+//    archive_command=/bin/ln %path /var/vcap/store/cassandra/commitlog-archive/%name
+//
+// The archive directory must exist, and be on the same file system as the
+// commit log for `ln` to work (use `cp` otherwise). Cassandra does not clean
+// it up: archived segments must be expired by some other means, once no
+// backup needs them anymore.
+//
+// When `cassandra_commitlog_archiving` is true, backups then collect the
+// segments archived since their snapshot was taken into a `shield-commitlogs`
+// directory of the archive, and list them under `commitlogs` in
+// `shield-manifest.yml`. They are looked for in
+// `cassandra_commitlog_archive_dir`, or else in the directory that the `%name`
+// argument of `archive_command` points into. The segment that is being
+// written when the backup runs is not archived yet: writes are only
+// recoverable up to the last archived segment, i.e. up to the previous
+// backup at worst. With `cassandra_snapshot_skip_flush`, the writes that were
+// in memtables at snapshot time may be in earlier segments, which are not
+// collected.
+//
+// On restore, when `cassandra_restore_point_in_time` is set (as
+// "yyyy:MM:dd HH:mm:ss", in UTC, the way Cassandra expects it), the segments
+// of the archive are copied to `/var/vcap/store/shield/cassandra-commitlogs`
+// once the SSTables are loaded, and `restore_directories` and
+// `restore_point_in_time` are set in `commitlog_archiving.properties` (so is
+// `restore_command`, to `cp -f %from %to`, if it is not set). Cassandra has
+// no command to replay segments on a running node: it replays them, up to
+// that point in time, the next time it starts. Restart the node to complete
+// the restore, then remove those settings, so that later restarts do not
+// replay the segments again. Without `cassandra_restore_point_in_time`, the
+// segments of the archive are ignored.
+//
+// SSTABLE FORMATS
+//
+// SSTables are written in the format of the Cassandra version that wrote
+// them, which shows at the start of their file names: `ka` (2.1), `la` (2.2),
+// `ma` to `me` (3.0 and 3.11), `na` and `nb` (4.0 and 4.1), `oa` (5.0). The
+// formats of each table of the archive are recorded in `shield-manifest.yml`.
+//
+// Archives can be restored into a cluster that was upgraded since, within
+// the limits of what its `sstableloader` can read: a Cassandra version reads
+// the SSTables of its own major version, and those of the previous one, but
+// no older (4.x reads `ma` and later, not `ka` nor `la`). Older archives must
+// go through an intermediate version first. Archives can NOT be restored into
+// a cluster that runs an older version than the one they were made with.
+//
+// Loaded SSTables keep their older format, until they are compacted. On
+// restore, when the archive holds SSTables older than the newest format found
+// in `cassandra_datadir`, a warning says so. When `cassandra_upgrade_sstables`
+// is true, `nodetool upgradesstables` is run for the keyspaces that hold them,
+// once everything is loaded, which rewrites the outdated SSTables of the node
+// (and only those). That is a lot of I/O on large keyspaces, and like the
+// restore itself, it only concerns the node being restored.
+//
+// CHUNKED BACKUPS
+//
+// Some object stores (and transfer layers) can't cope with multi-TB objects.
+// When `cassandra_chunk_size` is set (in MiB), the archive is not streamed to
+// SHIELD as a whole: it is cut into chunks of that size, that are stored one
+// after the other, in order, by the storage plugin (and endpoint) configured
+// in `cassandra_chunk_store`. SHIELD then stores a small JSON manifest, that
+// records the order, size, SHA-256 and storage key of each chunk, instead of
+// the archive.
+//
+// On restore, when `cassandra_chunk_store` is set and SHIELD hands over such
+// a manifest, the chunks are retrieved in order, checked, and reassembled
+// into the original archive. Regular archives are restored as usual.
+//
+// The chunks are not known to SHIELD: purging the manifest (when the backup
+// expires) leaves them in the chunk store. Have them expire on their own
+// (i.e. with a bucket lifecycle policy), with a delay that matches the
+// retention policy of the backup job.
+//
+// DEDUPLICATED BACKUPS
+//
+// SSTables are immutable, so successive backups of a node hold mostly the
+// same files. When `cassandra_dedup` is true, no tar archive is made: each
+// file of the backup is stored on its own, by the storage plugin configured
+// in `cassandra_chunk_store`, unless a file with the same content (SHA-256)
+// was stored by a recent backup of the node, in which case it is referenced
+// instead of being transferred again. SHIELD then stores a small JSON
+// manifest (format `shield-cassandra-dedup/1`) that lists the path, size,
+// SHA-256 and storage key of each file. On restore, the files of such a
+// manifest are retrieved, checked, and extracted as if they came from an
+// archive.
+//
+// What was stored is recorded in a local index, `cassandra_dedup_index`, on
+// the node. Losing it only makes the next backup store everything again.
+// Content is only referenced for `cassandra_dedup_max_age` days (7 by
+// default) after it was stored: after that, it is stored again. Like chunks,
+// the stored files are not known to SHIELD, and are left in the store when
+// backups expire. Have them expire on their own, after at least
+// `cassandra_dedup_max_age` days plus the retention of the backup job, or
+// backups would reference content that is gone. Deduplication can't be
+// combined with `cassandra_chunk_size` or archive filters.
+//
+// PER-KEYSPACE ARCHIVES
+//
+// Restoring a single keyspace of a large cluster out of a monolithic archive
+// means retrieving (and reading through) the archive of all of them. When
+// `cassandra_split_keyspaces` is true, each keyspace is archived on its own,
+// along with one archive of the files at the root of the backup (schema,
+// users, identity of the node), and each archive is stored as a separate
+// object, by the storage plugin configured in `cassandra_chunk_store`.
+// SHIELD then stores a small JSON manifest (format
+// `shield-cassandra-split/1`) that maps each keyspace to the storage key,
+// size and SHA-256 of its archive.
+//
+// On restore, only the archives of the keyspaces that pass
+// `cassandra_include_keyspaces` and `cassandra_exclude_keyspaces` are
+// retrieved (along with the root one, always), checked, and extracted: a
+// restore of one keyspace only fetches its own archive. It applies to
+// `cassandra_extract_only` too. Up to `cassandra_tar_jobs` keyspaces are
+// archived and stored at a time. Like chunks, the archives are not known to
+// SHIELD, and are left in the store when backups expire: have them expire on
+// their own, with the retention of the backup job. Each archive comes with
+// its checksum in the manifest, so `cassandra_checksum` does not apply.
+// Per-keyspace archives can't be combined with `cassandra_chunk_size`,
+// `cassandra_dedup` or archive filters.
+//
+// PARALLEL ARCHIVING
+//
+// A single `tar` reads the backup files one after the other. On nodes whose
+// data directories span several disks, `cassandra_tar_jobs` can be set to
+// archive up to that many keyspaces at once, each with its own `tar`. Their
+// outputs are then multiplexed into the archive, which is no longer a plain
+// tar archive: it starts with a JSON line (format `shield-cassandra-mux/1`)
+// that indexes the streams, followed by frames of the tar stream of each
+// keyspace (and one for the files at the root of the backup). Restores
+// recognize such archives, and extract each stream with its own `tar`, so
+// they are restored like any other; but they can't be extracted with `tar`
+// by hand. Multiplexed archives go through chunks and filters just like tar
+// archives do. It makes no difference to deduplicated backups, which are not
+// archived, and can't be combined with them.
+//
+// Multiplexing costs one more copy of the archive stream, through the plugin:
+// it only pays off when reading the files is what limits the backup (i.e. on
+// several disks, or on network storage), rather than the CPU or the store.
+//
+// ARCHIVE ROOT
+//
+// Archives are rooted at `./` by default. When `cassandra_archive_root` is
+// set to a directory name (i.e. "cassandra-backup"), everything in the
+// archive is put under that directory instead, so that an operator listing
+// it with `tar tvf` can tell what it is. Restores strip that directory, as
+// long as it is the only thing at the top of the archive; archives without
+// it (i.e. taken before it was set) are restored as they are. It applies to
+// multiplexed archives too, but can't be combined with `cassandra_dedup`.
+//
+// ARCHIVE FILTERS
+//
+// For compression or encryption tools that this plugin does not support
+// natively, `cassandra_backup_filter` is a command that the tar stream is
+// piped through, before it goes out (and before it is cut into chunks), and
+// `cassandra_restore_filter` is the command that undoes it, on the way in
+// (after the chunks are reassembled). Filters read the stream on their
+// standard input and write the result on their standard output. They are
+// split into words, but NOT run through a shell: wrap them in `sh -c '...'`
+// for pipelines.
+//
+// The operator owns the correctness of these commands: the plugin has no way
+// to tell whether what comes out of a filter is right, only whether it exited
+// successfully. A filter that exits non-zero fails the backup (or restore).
+// Archives produced with a backup filter can only be restored with the
+// matching restore filter, so test restores whenever a filter changes.
+//
+// CHECKSUMS
+//
+// Archives can be truncated or corrupted on their way to storage and back,
+// in ways that tar does not always notice. When `cassandra_checksum` is true,
+// the archive is followed by its SHA-256 checksum (format
+// `shield-checksum/1`), past the backup filter. Restores check archives that
+// come with a checksum whatever the option says, once extracted, and fail
+// before anything is loaded into Cassandra when they do not match; archives
+// without one are restored as they always were. Checksummed archives are not
+// plain tar streams anymore: `tar tvf` cannot read them as is. Chunked and
+// deduplicated backups are not framed, as their chunks are stored with
+// checksums of their own.
+//
+// CLUSTER CLEANUP
+//
+// Backups are per node, so an aborted cluster-wide backup can leave the
+// `shield-backup` snapshot behind on some nodes. The `cleanup-cluster`
+// command, run by an operator on one node, clears it there and on each node
+// of `cassandra_peers` (host names or addresses), and reports those it could
+// not clear. With `--dry-run`, it only lists the commands it would run. It is
+// never run on its own. The snapshot generations that
+// `cassandra_snapshot_generations` keeps are left alone.
+//
+// With `cassandra_peer_access` set to `jmx` (the default), the nodetool of
+// this node connects to the JMX port of each peer (`cassandra_jmx_port`, 7199
+// by default). Cassandra only listens for JMX on localhost by default: the
+// peers must have remote JMX enabled (LOCAL_JMX=no in cassandra-env.sh), and
+// their JMX port must be reachable from this node. When JMX authentication is
+// enabled, `cassandra_jmx_user` and `cassandra_jmx_password` are passed on.
+//
+// With `cassandra_peer_access` set to `ssh`, the plugin runs `ssh -o
+// BatchMode=yes <peer> <cassandra_bindir>/nodetool clearsnapshot`, with the
+// private key of `cassandra_ssh_key` if set. The peers must accept that key
+// (or the keys of the user the plugin runs as) without any prompt, for a user
+// allowed to run nodetool, and their host keys must already be known, as
+// BatchMode refuses to ask. Write peers as `user@host` to log in as another
+// user. `cassandra_bindir` must be the same on all nodes.
+//
 // DEPENDENCIES
 //
 // This plugin relies on the `nodetool`, `sstableloader` and 'cqlsh'
 // utilities. Please ensure that they are present on the cassandra node that
 // will be backed up or restored. The `cassandra_bindir` configuration
 // indicates in which directory those three required utilities are to be
-// found.
+// found. The `validate` command checks that they can be found there, along
+// with `tar`. Chunked, deduplicated and per-keyspace backups also rely on
+// the storage plugin configured in `cassandra_chunk_store`, and filters on
+// the commands they run.
 
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
-
-	"github.com/starkandwayne/goutils/ansi"
+	"time"
 
 	"github.com/starkandwayne/shield/plugin"
 )
 
 // Default configuration values for the plugin
 const (
-	DefaultHost      = "127.0.0.1"
-	DefaultPort      = "9042"
-	DefaultUser      = "cassandra"
-	DefaultPassword  = "cassandra"
-	DefaultSaveUsers = true
-	DefaultBinDir    = "/var/vcap/jobs/cassandra/bin"
-	DefaultDataDir   = "/var/vcap/store/cassandra/data"
-	DefaultTar       = "tar"
+	DefaultHost         = "127.0.0.1"
+	DefaultPort         = "9042"
+	DefaultUser         = "cassandra"
+	DefaultPassword     = "cassandra"
+	DefaultSaveUsers    = true
+	DefaultKeepSnapshot = false
+	DefaultSkipFlush    = false
+	DefaultBinDir       = "/var/vcap/jobs/cassandra/bin"
+	DefaultDataDir      = "/var/vcap/store/cassandra/data"
+	DefaultTempDir      = "/var/vcap/store/shield/cassandra"
+	DefaultConfig       = "/var/vcap/jobs/cassandra/conf/cassandra.yaml"
+	DefaultTar          = "tar"
+
+	DefaultDiscoverViaCQL        = false
+	DefaultFailOnMissingKeyspace = false
+	DefaultFailOnEmptyBackup     = false
+	DefaultExtractOnly           = false
+	DefaultForceRestore          = false
+	DefaultResumeRestore         = false
+	DefaultUpgradeSSTables       = false
+	DefaultChunkSize             = 0
+	DefaultChecksum              = false
+	DefaultDedup                 = false
+	DefaultDedupIndex            = "/var/vcap/store/shield/cassandra-dedup-index.json"
+	DefaultDedupMaxAge           = 7
+	DefaultSplitKeyspaces        = false
+	DefaultNodetoolTimeout       = 0
+	DefaultJMXUser               = ""
+	DefaultSSHKey                = ""
+	DefaultExportSchema          = false
+	DefaultTarJobs               = 1
+	DefaultArchiveRoot           = ""
+	DefaultResume                = false
+	DefaultResumeMaxAge          = 12
+	DefaultSnapshotGenerations   = 0
+	DefaultMaxKeyspaceBytes      = 0
+	DefaultCommitlogArchiving    = false
 
 	VcapOwnership = "vcap:vcap"
 	SnapshotName  = "shield-backup"
@@ -159,6 +677,7 @@ const (
 // Array or slices aren't immutable by nature; you can't make them constant
 var (
 	DefaultExcludeKeyspaces = []string{"system_schema", "system_distributed", "system_auth", "system", "system_traces"}
+	DefaultSkipComponents   = []string{"*-tmp-*", "*.tmp*"}
 	SystemAuthTables        = []string{"roles", "role_permissions", "role_members", "resource_role_permissons_index"}
 )
 
@@ -177,12 +696,51 @@ func main() {
   "cassandra_port"              : "9042",           # optional
   "cassandra_user"              : "username",
   "cassandra_password"          : "password",
+  "cassandra_password_file"     : "/path/to/secret", # read the password from this file instead
   "cassandra_include_keyspaces" : "db",
   "cassandra_exclude_keyspaces" : "system",
+  "cassandra_include_tables"    : [ "db.orders", "db.users" ],  # only snapshot these tables
+  "cassandra_discover_via_cql"  : false,            # list keyspaces with CQL, not from the data directory
+  "cassandra_fail_on_missing_keyspace" : false,     # fail when an included keyspace does not exist
+  "cassandra_fail_on_empty_backup" : true,          # fail backups of empty or bootstrapping nodes
   "cassandra_save_users"        : true,
+  "cassandra_export_schema"     : true,             # back up the schema of keyspaces, even empty ones
+  "cassandra_keep_snapshot"     : false,            # keep the snapshot after backup, for debugging
+  "cassandra_snapshot_skip_flush" : false,          # don't flush memtables; their writes are not backed up
+  "cassandra_nodetool_timeout"  : 600,              # seconds before snapshots are given up on
+  "cassandra_peers"             : [ "10.0.0.2", "10.0.0.3" ], # nodes that cleanup-cluster clears too
+  "cassandra_peer_access"       : "ssh",            # reach them over jmx or ssh
+  "cassandra_ssh_key"           : "/var/vcap/jobs/shield-agent/config/peers.key",
+  "cassandra_resume"            : true,             # resume failed backups from their snapshot
+  "cassandra_resume_max_age"    : 6,                # hours during which a failed backup can be resumed
+  "cassandra_snapshot_generations" : 3,             # keep the snapshots of the last 3 backups on the node
+  "cassandra_max_keyspace_bytes" : 1099511627776,   # leave keyspaces over 1 TiB out of backups
+  "cassandra_commitlog_archiving" : true,           # also back up the commit log segments archived since the snapshot
+  "cassandra_commitlog_archive_dir" : "/path/to/archive",  # where archive_command puts them
+  "cassandra_skip_components"   : [ "*-tmp-*", "*.tmp*", "*-Digest.crc32" ],  # SSTable files to leave out
   "cassandra_bindir"            : "/path/to/bin",   # optional
   "cassandra_datadir"           : "/path/to/data",  # optional
-  "cassandra_tar"               : "/bin/tar"        # Tar-compatible archival tool to use
+  "cassandra_tempdir"           : "/path/to/data/../shield-tmp",  # where to stage backups, on the filesystem of the data
+  "cassandra_config"            : "/path/to/cassandra.yaml",  # where to look for encryption settings
+  "cassandra_tar"               : "/bin/tar",       # Tar-compatible archival tool to use
+  "cassandra_tar_jobs"          : 4,                # keyspaces archived at once
+  "cassandra_archive_root"      : "cassandra-backup", # top-level directory inside the archive
+  "cassandra_extract_only"      : false,            # only unpack archives, on restore
+  "cassandra_extract_dir"       : "/path/to/dir",   # where to unpack them
+  "cassandra_restore_generation" : "20240131T020000Z", # restore a snapshot kept on the node instead
+  "cassandra_restore_point_in_time" : "2024:01:31 02:30:00", # replay commit logs up to then (UTC), on restart
+  "cassandra_force_restore"     : false,            # restore archives of other nodes
+  "cassandra_resume_restore"    : true,             # skip the tables that failed restores loaded
+  "cassandra_upgrade_sstables"  : true,             # rewrite older SSTables, once restored
+  "cassandra_chunk_size"        : 102400,           # cut archives in chunks of that many MiB
+  "cassandra_chunk_store"       : { "plugin": "s3", "endpoint": { "bucket": "chunks", ... } },
+  "cassandra_backup_filter"     : "age -r age1...", # command to pipe archives through, on backup
+  "cassandra_restore_filter"    : "age -d -i /path/to/key", # command that undoes it, on restore
+  "cassandra_checksum"          : true,             # catch archives corrupted on the way
+  "cassandra_dedup"             : true,             # store each file once, in the chunk store
+  "cassandra_dedup_index"       : "/path/to/index.json",  # what was stored, on this node
+  "cassandra_dedup_max_age"     : 7,                # days to reference stored files for
+  "cassandra_split_keyspaces"   : true              # one archive per keyspace, in the chunk store
 }
 `,
 		Defaults: `
@@ -192,12 +750,420 @@ func main() {
   "cassandra_user"              : "cassandra",
   "cassandra_password"          : "cassandra",
   "cassandra_exclude_keyspaces" : [ "system_schema", "system_distributed", "system_auth", "system", "system_traces" ],
+  "cassandra_discover_via_cql"  : false,
+  "cassandra_fail_on_missing_keyspace" : false,
+  "cassandra_fail_on_empty_backup" : false,
   "cassandra_save_users"        : true,
+  "cassandra_export_schema"     : false,
+  "cassandra_keep_snapshot"     : false,
+  "cassandra_snapshot_skip_flush" : false,
+  "cassandra_nodetool_timeout"  : 0,
+  "cassandra_peers"             : [],
+  "cassandra_peer_access"       : "jmx",
+  "cassandra_jmx_port"          : 7199,
+  "cassandra_resume"            : false,
+  "cassandra_resume_max_age"    : 12,
+  "cassandra_snapshot_generations" : 0,
+  "cassandra_max_keyspace_bytes" : 0,
+  "cassandra_commitlog_archiving" : false,
+  "cassandra_skip_components"   : [ "*-tmp-*", "*.tmp*" ],
   "cassandra_bindir"            : "/var/vcap/jobs/cassandra/bin",
   "cassandra_datadir"           : "/var/vcap/store/cassandra/data",
-  "cassandra_tar"               : "tar"
+  "cassandra_tempdir"           : "/var/vcap/store/shield/cassandra",
+  "cassandra_config"            : "/var/vcap/jobs/cassandra/conf/cassandra.yaml",
+  "cassandra_tar"               : "tar",
+  "cassandra_tar_jobs"          : 1,
+  "cassandra_archive_root"      : "",
+  "cassandra_extract_only"      : false,
+  "cassandra_force_restore"     : false,
+  "cassandra_resume_restore"    : false,
+  "cassandra_upgrade_sstables"  : false,
+  "cassandra_chunk_size"        : 0,
+  "cassandra_checksum"          : false,
+  "cassandra_dedup"             : false,
+  "cassandra_dedup_index"       : "/var/vcap/store/shield/cassandra-dedup-index.json",
+  "cassandra_dedup_max_age"     : 7,
+  "cassandra_split_keyspaces"   : false
 }
 `,
+		Fields: []plugin.Field{
+			{
+				Name:    "cassandra_host",
+				Label:   "Cassandra Host",
+				Type:    plugin.TextField,
+				Default: DefaultHost,
+				Help:    "The hostname or IP address of the Cassandra node to back up.",
+			},
+			{
+				Name:    "cassandra_port",
+				Label:   "Cassandra Port",
+				Type:    plugin.TextField,
+				Default: DefaultPort,
+				Format:  `^\d+$`,
+				Invalid: "The Cassandra port must be numeric",
+				Help:    "The native transport port of the Cassandra node.",
+			},
+			{
+				Name:    "cassandra_user",
+				Label:   "Cassandra Username",
+				Type:    plugin.TextField,
+				Default: DefaultUser,
+				Help:    "Username to authenticate to Cassandra as.",
+			},
+			{
+				Name:    "cassandra_password",
+				Label:   "Cassandra Password",
+				Type:    plugin.PasswordField,
+				Default: DefaultPassword,
+				Help:    "Password to authenticate to Cassandra with.",
+			},
+			{
+				Name:  "cassandra_password_file",
+				Label: "Cassandra Password File",
+				Type:  plugin.TextField,
+				Help:  "A file on the node to read the Cassandra password from, instead of storing it in the endpoint.",
+			},
+			{
+				Name:  "cassandra_password_env",
+				Label: "Cassandra Password Variable",
+				Type:  plugin.TextField,
+				Help:  "An environment variable to take the Cassandra password from, instead of storing it in the endpoint.",
+			},
+			{
+				Name:        "cassandra_include_keyspaces",
+				Label:       "Keyspaces to Include",
+				Type:        plugin.ListField,
+				Placeholder: "(unset: all keyspaces)",
+				Help:        "The keyspaces to back up and restore. Unset (null), all keyspaces are; an empty list ([]) means no keyspace at all.",
+			},
+			{
+				Name:    "cassandra_exclude_keyspaces",
+				Label:   "Keyspaces to Exclude",
+				Type:    plugin.ListField,
+				Default: DefaultExcludeKeyspaces,
+				Help:    "The keyspaces that must not be backed up or restored.",
+				Aliases: []string{"cassandra_exclude_keyspace"},
+			},
+			{
+				Name:        "cassandra_include_tables",
+				Label:       "Tables to Include",
+				Type:        plugin.ListField,
+				Placeholder: "(all tables)",
+				Help:        "The tables to back up, as keyspace.table names. Only those tables are snapshotted. An empty list means no table at all.",
+				Examples:    []string{"db.orders"},
+			},
+			{
+				Name:    "cassandra_discover_via_cql",
+				Label:   "Discover Keyspaces via CQL",
+				Type:    plugin.BooleanField,
+				Default: DefaultDiscoverViaCQL,
+				Help:    "Ask the cluster for its keyspaces (in system_schema.keyspaces), instead of listing the data directory. Also checks the include and exclude lists against them.",
+			},
+			{
+				Name:    "cassandra_fail_on_missing_keyspace",
+				Label:   "Fail on Missing Keyspaces",
+				Type:    plugin.BooleanField,
+				Default: DefaultFailOnMissingKeyspace,
+				Help:    "Fail the backup when a keyspace to include does not exist, instead of only warning about it.",
+			},
+			{
+				Name:    "cassandra_fail_on_empty_backup",
+				Label:   "Fail on Empty Backups",
+				Type:    plugin.BooleanField,
+				Default: DefaultFailOnEmptyBackup,
+				Help:    "Fail the backup when the node is bootstrapping, or when no keyspace of the node has data to back up, instead of only warning about it.",
+			},
+			{
+				Name:    "cassandra_save_users",
+				Label:   "Save Users",
+				Type:    plugin.BooleanField,
+				Default: DefaultSaveUsers,
+				Help:    "Whether or not to back up and restore users and permissions, from the 'system_auth' keyspace.",
+			},
+			{
+				Name:    "cassandra_export_schema",
+				Label:   "Export Schema",
+				Type:    plugin.BooleanField,
+				Default: DefaultExportSchema,
+				Help:    "Back up the schema of the keyspaces (with DESCRIBE KEYSPACE), even those without any data, so that restores recreate them.",
+			},
+			{
+				Name:    "cassandra_keep_snapshot",
+				Label:   "Keep Snapshot",
+				Type:    plugin.BooleanField,
+				Default: DefaultKeepSnapshot,
+				Help:    "Leave the backup snapshot in place after backup, for forensic analysis. Its disk space is not reclaimed until it is cleared by hand.",
+			},
+			{
+				Name:    "cassandra_snapshot_skip_flush",
+				Label:   "Skip Memtable Flush",
+				Type:    plugin.BooleanField,
+				Default: DefaultSkipFlush,
+				Help:    "Take snapshots without flushing memtables first (--skip-flush), for less impact on writes. The writes that are still in memtables are NOT backed up.",
+			},
+			{
+				Name:    "cassandra_nodetool_timeout",
+				Label:   "Nodetool Timeout (seconds)",
+				Type:    plugin.NumberField,
+				Default: DefaultNodetoolTimeout,
+				Help:    "How long `nodetool` may take to snapshot the keyspaces (or clear the snapshot) before it is killed and the backup fails. 0 means no timeout.",
+			},
+			{
+				Name:     "cassandra_peers",
+				Label:    "Peer Nodes",
+				Type:     plugin.ListField,
+				Help:     "The other nodes of the cluster, whose 'shield-backup' snapshot the `cleanup-cluster` command clears too, after an aborted cluster-wide backup.",
+				Examples: []string{"10.0.0.2", "cassandra-1.example.com", "vcap@10.0.0.3"},
+			},
+			{
+				Name:     "cassandra_peer_access",
+				Label:    "Peer Access",
+				Type:     plugin.TextField,
+				Default:  DefaultPeerAccess,
+				Format:   `^(jmx|ssh)$`,
+				Invalid:  "Peers are reached either over 'jmx' or 'ssh'",
+				Help:     "How `cleanup-cluster` reaches the peer nodes: with nodetool, over their JMX port ('jmx'), or with ssh, to run nodetool there ('ssh').",
+				Examples: []string{"jmx", "ssh"},
+			},
+			{
+				Name:    "cassandra_jmx_port",
+				Label:   "Peer JMX Port",
+				Type:    plugin.NumberField,
+				Default: DefaultJMXPort,
+				Help:    "The JMX port of the peer nodes, which must accept remote connections.",
+			},
+			{
+				Name:    "cassandra_jmx_user",
+				Label:   "Peer JMX User",
+				Type:    plugin.TextField,
+				Default: DefaultJMXUser,
+				Help:    "The user to authenticate over JMX with, on the peer nodes. Leave empty when JMX authentication is disabled.",
+			},
+			{
+				Name:  "cassandra_jmx_password",
+				Label: "Peer JMX Password",
+				Type:  plugin.PasswordField,
+				Help:  "The password of the JMX user, on the peer nodes.",
+			},
+			{
+				Name:    "cassandra_ssh_key",
+				Label:   "Peer SSH Key",
+				Type:    plugin.TextField,
+				Default: DefaultSSHKey,
+				Help:    "Absolute path of the private key to ssh into the peer nodes with. The peers must accept it without any prompt.",
+			},
+			{
+				Name:    "cassandra_resume",
+				Label:   "Resume Failed Backups",
+				Type:    plugin.BooleanField,
+				Default: DefaultResume,
+				Help:    "Keep the snapshot and the staged keyspaces of failed backups, for the next backup to resume from them instead of starting over.",
+			},
+			{
+				Name:    "cassandra_resume_max_age",
+				Label:   "Resume Window (hours)",
+				Type:    plugin.NumberField,
+				Default: DefaultResumeMaxAge,
+				Help:    "How old the snapshot of a failed backup may be for the next backup to resume from it. Resumed backups hold the data as of that snapshot.",
+			},
+			{
+				Name:    "cassandra_snapshot_generations",
+				Label:   "Snapshot Generations",
+				Type:    plugin.NumberField,
+				Default: DefaultSnapshotGenerations,
+				Help:    "How many backup snapshots to keep on the node, named after the time they were taken, to restore from with 'cassandra_restore_generation'. 0 clears each snapshot after its backup.",
+			},
+			{
+				Name:    "cassandra_max_keyspace_bytes",
+				Label:   "Max Keyspace Size (bytes)",
+				Type:    plugin.NumberField,
+				Default: DefaultMaxKeyspaceBytes,
+				Help:    "Leave the keyspaces whose snapshot is larger than that many bytes out of backups, with a warning. They are listed in the manifest of the archive. 0 backs up keyspaces of any size.",
+			},
+			{
+				Name:    "cassandra_commitlog_archiving",
+				Label:   "Back Up Archived Commit Logs",
+				Type:    plugin.BooleanField,
+				Default: DefaultCommitlogArchiving,
+				Help:    "Also back up the commit log segments that Cassandra archived (see commitlog_archiving.properties) since the snapshot, for point-in-time recovery.",
+			},
+			{
+				Name:        "cassandra_commitlog_archive_dir",
+				Label:       "Commit Log Archive Directory",
+				Type:        plugin.TextField,
+				Placeholder: "(from archive_command)",
+				Help:        "Where Cassandra archives its commit log segments. By default, the directory that archive_command puts them in.",
+			},
+			{
+				Name:     "cassandra_skip_components",
+				Label:    "SSTable Components to Skip",
+				Type:     plugin.ListField,
+				Default:  DefaultSkipComponents,
+				Help:     "Shell patterns of SSTable component file names to leave out of backups. Temporary files are skipped by default.",
+				Examples: []string{"*-tmp-*", "*.tmp*", "*-Digest.crc32", "*-TOC.txt"},
+			},
+			{
+				Name:    "cassandra_bindir",
+				Label:   "Cassandra Binary Directory",
+				Type:    plugin.TextField,
+				Default: DefaultBinDir,
+				Help:    "Where to find the `nodetool`, `sstableloader` and `cqlsh` utilities.",
+			},
+			{
+				Name:    "cassandra_datadir",
+				Label:   "Cassandra Data Directory",
+				Type:    plugin.TextField,
+				Default: DefaultDataDir,
+				Help:    "Absolute path to the Cassandra data directory.",
+			},
+			{
+				Name:    "cassandra_tempdir",
+				Label:   "Temporary Directory",
+				Type:    plugin.TextField,
+				Default: DefaultTempDir,
+				Help:    "Where the snapshot files are hard-linked to be archived. It must be on the same filesystem as the data directory, and is removed after each run.",
+			},
+			{
+				Name:    "cassandra_config",
+				Label:   "Cassandra Configuration File",
+				Type:    plugin.TextField,
+				Default: DefaultConfig,
+				Help:    "Absolute path to the `cassandra.yaml` file, whose encryption settings are recorded when backing up encrypted tables.",
+			},
+			{
+				Name:    "cassandra_tar",
+				Label:   "Path to tar",
+				Type:    plugin.TextField,
+				Default: DefaultTar,
+				Help:    "Tar-compatible archival tool to use.",
+			},
+			{
+				Name:    "cassandra_tar_jobs",
+				Label:   "Concurrent Tar Jobs",
+				Type:    plugin.NumberField,
+				Default: DefaultTarJobs,
+				Help:    "How many keyspaces to archive at once, each with its own `tar`. More than 1 produces a multiplexed archive, that only this plugin can restore.",
+			},
+			{
+				Name:        "cassandra_archive_root",
+				Label:       "Archive Root Directory",
+				Type:        plugin.TextField,
+				Placeholder: "(none)",
+				Format:      `^[A-Za-z0-9][A-Za-z0-9._-]*$`,
+				Invalid:     "The archive root must be a single directory name",
+				Help:        "A directory to put everything in, inside the archive (i.e. 'cassandra-backup'), so that it tells what it is when listed by hand. Restores strip it.",
+			},
+			{
+				Name:    "cassandra_extract_only",
+				Label:   "Extract Only",
+				Type:    plugin.BooleanField,
+				Default: DefaultExtractOnly,
+				Help:    "Only unpack the archive into the extract directory on restore, without loading anything into Cassandra.",
+			},
+			{
+				Name:  "cassandra_extract_dir",
+				Label: "Extract Directory",
+				Type:  plugin.TextField,
+				Help:  "Where to unpack the archive, in extract-only mode. Needs enough scratch space for the whole backup.",
+			},
+			{
+				Name:        "cassandra_restore_generation",
+				Label:       "Restore Generation",
+				Type:        plugin.TextField,
+				Placeholder: "(the archive)",
+				Help:        "The generation of a snapshot kept on the node (see 'list-snapshots') to restore, instead of the archive.",
+			},
+			{
+				Name:        "cassandra_restore_point_in_time",
+				Label:       "Restore Point in Time",
+				Type:        plugin.TextField,
+				Placeholder: "yyyy:MM:dd HH:mm:ss",
+				Help:        "Have the node replay the commit log segments of the archive up to that time (UTC) on its next start, for point-in-time recovery. The node must be restarted after the restore.",
+			},
+			{
+				Name:    "cassandra_force_restore",
+				Label:   "Force Restore",
+				Type:    plugin.BooleanField,
+				Default: DefaultForceRestore,
+				Help:    "Restore archives that come from another node (another hostname or host ID), i.e. onto a replacement node. Mismatches are only warned about then.",
+			},
+			{
+				Name:    "cassandra_resume_restore",
+				Label:   "Resume Failed Restores",
+				Type:    plugin.BooleanField,
+				Default: DefaultResumeRestore,
+				Help:    "Record the tables that restores load, for a failed restore of the same archive to skip them when it is retried.",
+			},
+			{
+				Name:    "cassandra_upgrade_sstables",
+				Label:   "Upgrade SSTables",
+				Type:    plugin.BooleanField,
+				Default: DefaultUpgradeSSTables,
+				Help:    "Run `nodetool upgradesstables` on restore, for the keyspaces of the archive that hold SSTables older than the format of the node.",
+			},
+			{
+				Name:    "cassandra_chunk_size",
+				Label:   "Chunk Size (MiB)",
+				Type:    plugin.NumberField,
+				Default: DefaultChunkSize,
+				Help:    "Cut archives into chunks of that many MiB, stored in the chunk store, for storage that can't handle huge objects. 0 disables chunking.",
+			},
+			{
+				Name:  "cassandra_chunk_store",
+				Label: "Chunk Store",
+				Type:  plugin.MultilineField,
+				Help:  "The storage plugin that holds the chunks, as a JSON object with its `plugin` name and `endpoint` configuration. Required to back up or restore chunked archives.",
+			},
+			{
+				Name:     "cassandra_backup_filter",
+				Label:    "Backup Filter",
+				Type:     plugin.TextField,
+				Help:     "A command that archives are piped through on backup, i.e. to compress or encrypt them. It is not run through a shell. You own its correctness.",
+				Examples: []string{"xz -T0", "age -r age1..."},
+			},
+			{
+				Name:     "cassandra_restore_filter",
+				Label:    "Restore Filter",
+				Type:     plugin.TextField,
+				Help:     "The command that undoes the backup filter, that archives are piped through on restore.",
+				Examples: []string{"xz -d", "age -d -i /path/to/key"},
+			},
+			{
+				Name:    "cassandra_checksum",
+				Label:   "Checksum Archives",
+				Type:    plugin.BooleanField,
+				Default: DefaultChecksum,
+				Help:    "Follow the archive with its SHA-256 checksum, for restores to catch archives that were truncated or corrupted on their way to storage and back.",
+			},
+			{
+				Name:    "cassandra_dedup",
+				Label:   "Deduplicate Backups",
+				Type:    plugin.BooleanField,
+				Default: DefaultDedup,
+				Help:    "Store each file of the backup on its own in the chunk store, and only if no recent backup stored the same content already.",
+			},
+			{
+				Name:    "cassandra_dedup_index",
+				Label:   "Deduplication Index",
+				Type:    plugin.TextField,
+				Default: DefaultDedupIndex,
+				Help:    "Where to record what deduplicated backups stored, on this node.",
+			},
+			{
+				Name:    "cassandra_dedup_max_age",
+				Label:   "Deduplication Max Age (days)",
+				Type:    plugin.NumberField,
+				Default: DefaultDedupMaxAge,
+				Help:    "How many days stored files are referenced by later backups, before they are stored again. The chunk store must keep them for at least that long, plus the retention of the backups.",
+			},
+			{
+				Name:    "cassandra_split_keyspaces",
+				Label:   "Per-Keyspace Archives",
+				Type:    plugin.BooleanField,
+				Default: DefaultSplitKeyspaces,
+				Help:    "Store the archive of each keyspace as a separate object in the chunk store, so that restoring a keyspace only retrieves its own archive.",
+			},
+		},
 	}
 
 	plugin.Run(p)
@@ -208,16 +1174,58 @@ type CassandraPlugin plugin.PluginInfo
 
 // CassandraInfo defines the custom type for plugin config
 type CassandraInfo struct {
-	Host             string
-	Port             string
-	User             string
-	Password         string
-	IncludeKeyspaces []string
-	ExcludeKeyspaces []string
-	SaveUsers        bool
-	BinDir           string
-	DataDir          string
-	Tar              string
+	Host                  string
+	Port                  string
+	User                  string
+	Password              string
+	IncludeKeyspaces      []string
+	ExcludeKeyspaces      []string
+	IncludeTables         map[string][]string
+	DiscoverViaCQL        bool
+	FailOnMissingKeyspace bool
+	FailOnEmptyBackup     bool
+	SaveUsers             bool
+	ExportSchema          bool
+	KeepSnapshot          bool
+	SkipFlush             bool
+	Resume                bool
+	ResumeMaxAge          int
+	SnapshotGenerations   int
+	Generation            string
+	MaxKeyspaceBytes      int64
+	CommitlogArchiving    bool
+	CommitlogArchiveDir   string
+	NodetoolTimeout       int
+	Peers                 []string
+	PeerAccess            string
+	JMXPort               int
+	JMXUser               string
+	JMXPassword           string
+	SSHKey                string
+	SkipComponents        []string
+	BinDir                string
+	DataDir               string
+	TempDir               string
+	Config                string
+	Tar                   string
+	TarJobs               int
+	ArchiveRoot           string
+	ExtractOnly           bool
+	ExtractDir            string
+	RestoreGeneration     string
+	RestorePointInTime    string
+	ForceRestore          bool
+	ResumeRestore         bool
+	UpgradeSSTables       bool
+	ChunkSize             int64
+	ChunkStore            *ChunkStore
+	BackupFilter          string
+	RestoreFilter         string
+	Checksum              bool
+	Dedup                 bool
+	DedupIndex            string
+	DedupMaxAge           int
+	SplitKeyspaces        bool
 }
 
 // Meta returns the plugin's PluginInfo, however you decide to implement it
@@ -237,311 +1245,966 @@ func (p CassandraPlugin) Validate(endpoint plugin.ShieldEndpoint) error {
 
 	s, err = endpoint.StringValueDefault("cassandra_host", "")
 	if err != nil {
-		ansi.Printf("@R{\u2717 cassandra_host          %s}\n", err)
+		plugin.Printf("@R{\u2717 cassandra_host          %s}\n", err)
 		fail = true
 	} else if s == "" {
-		ansi.Printf("@G{\u2713 cassandra_host}          using default node @C{%s}\n", DefaultHost)
+		plugin.Printf("@G{\u2713 cassandra_host}          using default node @C{%s}\n", DefaultHost)
 	} else {
-		ansi.Printf("@G{\u2713 cassandra_host}          @C{%s}\n", s)
+		plugin.Printf("@G{\u2713 cassandra_host}          @C{%s}\n", s)
 	}
 
 	s, err = endpoint.StringValueDefault("cassandra_port", "")
 	if err != nil {
-		ansi.Printf("@R{\u2717 cassandra_port          %s}\n", err)
+		plugin.Printf("@R{\u2717 cassandra_port          %s}\n", err)
 		fail = true
 	} else if s == "" {
-		ansi.Printf("@G{\u2713 cassandra_port}          using default port @C{%s}\n", DefaultPort)
+		plugin.Printf("@G{\u2713 cassandra_port}          using default port @C{%s}\n", DefaultPort)
 	} else {
-		ansi.Printf("@G{\u2713 cassandra_port}          @C{%s}\n", s)
+		plugin.Printf("@G{\u2713 cassandra_port}          @C{%s}\n", s)
 	}
 
 	s, err = endpoint.StringValueDefault("cassandra_user", "")
 	if err != nil {
-		ansi.Printf("@R{\u2717 cassandra_user          %s}\n", err)
+		plugin.Printf("@R{\u2717 cassandra_user          %s}\n", err)
 		fail = true
 	} else if s == "" {
-		ansi.Printf("@G{\u2713 cassandra_user}          using default user @C{%s}\n", DefaultUser)
+		plugin.Printf("@G{\u2713 cassandra_user}          using default user @C{%s}\n", DefaultUser)
 	} else {
-		ansi.Printf("@G{\u2713 cassandra_user}          @C{%s}\n", s)
+		plugin.Printf("@G{\u2713 cassandra_user}          @C{%s}\n", s)
 	}
 
-	s, err = endpoint.StringValueDefault("cassandra_password", "")
+	s, err = passwordSource(endpoint)
 	if err != nil {
-		ansi.Printf("@R{\u2717 cassandra_password      %s}\n", err)
+		plugin.Printf("@R{\u2717 cassandra_password      %s}\n", err)
+		fail = true
+	} else if s != "" {
+		/* never print a password that is kept out of the endpoint */
+		if _, err = cassandraPassword(endpoint); err != nil {
+			plugin.Printf("@R{\u2717 cassandra_password      %s}\n", err)
+			fail = true
+		} else {
+			plugin.Printf("@G{\u2713 cassandra_password}      read from @C{%s}\n", s)
+		}
+	} else if s, err = endpoint.StringValueDefault("cassandra_password", ""); err != nil {
+		plugin.Printf("@R{\u2717 cassandra_password      %s}\n", err)
 		fail = true
 	} else if s == "" {
-		ansi.Printf("@G{\u2713 cassandra_password}      using default password @C{%s}\n", DefaultPassword)
+		plugin.Printf("@G{\u2713 cassandra_password}      using default password @C{%s}\n", DefaultPassword)
 	} else {
-		ansi.Printf("@G{\u2713 cassandra_password}      @C{%s}\n", s)
+		plugin.Printf("@G{\u2713 cassandra_password}      @C{%s}\n", s)
 	}
 
 	a, err = endpoint.ArrayValueDefault("cassandra_include_keyspaces", nil)
 	if err != nil {
-		ansi.Printf("@R{\u2717 cassandra_include_keyspaces      %s}\n", err)
+		plugin.Printf("@R{\u2717 cassandra_include_keyspaces      %s}\n", err)
 		fail = true
 	} else if a == nil {
-		ansi.Printf("@G{\u2713 cassandra_include_keyspaces}      backing up *all* keyspaces\n")
+		plugin.Printf("@G{\u2713 cassandra_include_keyspaces}      backing up *all* keyspaces\n")
 	} else {
-		ansi.Printf("@G{\u2713 cassandra_include_keyspaces}      @C{%v}\n", a)
+		plugin.Printf("@G{\u2713 cassandra_include_keyspaces}      @C{%v}\n", a)
 	}
 
-	a, err = endpoint.ArrayValueDefault("cassandra_exclude_keyspace", DefaultExcludeKeyspaces)
+	a, err = endpoint.ArrayValueDefault("cassandra_exclude_keyspaces", DefaultExcludeKeyspaces)
 	if err != nil {
-		ansi.Printf("@R{\u2717 cassandra_exclude_keyspaces      %s}\n", err)
+		plugin.Printf("@R{\u2717 cassandra_exclude_keyspaces      %s}\n", err)
 		fail = true
 	} else if len(a) == 0 {
-		ansi.Printf("@G{\u2713 cassandra_exclude_keyspaces}      including *all* keyspaces\n")
+		plugin.Printf("@G{\u2713 cassandra_exclude_keyspaces}      including *all* keyspaces\n")
 	} else {
-		ansi.Printf("@G{\u2713 cassandra_exclude_keyspaces}      @C{%v}\n", a)
+		plugin.Printf("@G{\u2713 cassandra_exclude_keyspaces}      @C{%v}\n", a)
 	}
 
-	b, err = endpoint.BooleanValueDefault("cassandra_save_users", DefaultSaveUsers)
+	a, err = endpoint.ArrayValueDefault("cassandra_include_tables", nil)
 	if err != nil {
-		ansi.Printf("@R{\u2717 cassandra_save_users      %s}\n", err)
+		plugin.Printf("@R{\u2717 cassandra_include_tables      %s}\n", err)
+		fail = true
+	} else if _, err = parseIncludeTables(a); err != nil {
+		plugin.Printf("@R{\u2717 cassandra_include_tables      %s}\n", err)
 		fail = true
+	} else if a == nil {
+		plugin.Printf("@G{\u2713 cassandra_include_tables}      backing up *all* tables\n")
 	} else {
-		ansi.Printf("@G{\u2713 cassandra_save_users}      @C{%t}\n", b)
+		plugin.Printf("@G{\u2713 cassandra_include_tables}      @C{%v}\n", a)
 	}
 
-	s, err = endpoint.StringValueDefault("cassandra_bindir", "")
+	b, err = endpoint.BooleanValueDefault("cassandra_discover_via_cql", DefaultDiscoverViaCQL)
 	if err != nil {
-		ansi.Printf("@R{\u2717 cassandra_bindir          %s}\n", err)
+		plugin.Printf("@R{\u2717 cassandra_discover_via_cql      %s}\n", err)
 		fail = true
-	} else if s == "" {
-		ansi.Printf("@G{\u2713 cassandra_bindir}          using default @C{%s}\n", DefaultBinDir)
+	} else if b {
+		plugin.Printf("@G{\u2713 cassandra_discover_via_cql}      @C{yes}, keyspaces are listed from system_schema.keyspaces\n")
 	} else {
-		ansi.Printf("@G{\u2713 cassandra_bindir}          @C{%s}\n", s)
+		plugin.Printf("@G{\u2713 cassandra_discover_via_cql}      @C{no}, keyspaces are listed from the data directory\n")
 	}
 
-	s, err = endpoint.StringValueDefault("cassandra_datadir", "")
+	b, err = endpoint.BooleanValueDefault("cassandra_fail_on_missing_keyspace", DefaultFailOnMissingKeyspace)
 	if err != nil {
-		ansi.Printf("@R{\u2717 cassandra_datadir         %s}\n", err)
+		plugin.Printf("@R{\u2717 cassandra_fail_on_missing_keyspace      %s}\n", err)
 		fail = true
-	} else if s == "" {
-		ansi.Printf("@G{\u2713 cassandra_datadir}         using default @C{%s}\n", DefaultDataDir)
+	} else if b {
+		plugin.Printf("@G{\u2713 cassandra_fail_on_missing_keyspace}      @C{yes}, backups fail when an included keyspace does not exist\n")
 	} else {
-		ansi.Printf("@G{\u2713 cassandra_datadir}         @C{%s}\n", s)
+		plugin.Printf("@G{\u2713 cassandra_fail_on_missing_keyspace}      @C{no}, missing included keyspaces are only reported\n")
 	}
 
-	s, err = endpoint.StringValueDefault("cassandra_tar", "")
+	b, err = endpoint.BooleanValueDefault("cassandra_fail_on_empty_backup", DefaultFailOnEmptyBackup)
 	if err != nil {
-		ansi.Printf("@R{\u2717 cassandra_tar           %s}\n", err)
+		plugin.Printf("@R{\u2717 cassandra_fail_on_empty_backup          %s}\n", err)
 		fail = true
-	} else if s == "" {
-		ansi.Printf("@G{\u2713 cassandra_tar}           using default @C{%s}\n", DefaultTar)
+	} else if b {
+		plugin.Printf("@G{\u2713 cassandra_fail_on_empty_backup}          @C{yes}, backups of empty or bootstrapping nodes fail\n")
 	} else {
-		ansi.Printf("@G{\u2713 cassandra_tar}           @C{%s}\n", s)
+		plugin.Printf("@G{\u2713 cassandra_fail_on_empty_backup}          @C{no}, empty or bootstrapping nodes are only reported\n")
 	}
 
-	if fail {
-		return fmt.Errorf("cassandra: invalid configuration")
+	b, err = endpoint.BooleanValueDefault("cassandra_save_users", DefaultSaveUsers)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_save_users      %s}\n", err)
+		fail = true
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_save_users}      @C{%t}\n", b)
 	}
-	return nil
-}
 
-func computeSavedKeyspaces(includeKeyspaces, excludeKeyspaces []string) []string {
-	if includeKeyspaces == nil {
-		return nil
+	b, err = endpoint.BooleanValueDefault("cassandra_export_schema", DefaultExportSchema)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_export_schema   %s}\n", err)
+		fail = true
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_export_schema}   @C{%t}\n", b)
 	}
 
-	savedKeyspaces := []string{}
-
-	sort.Strings(excludeKeyspaces)
-	for _, keyspace := range includeKeyspaces {
-		idx := sort.SearchStrings(excludeKeyspaces, keyspace)
-		if idx < len(excludeKeyspaces) && excludeKeyspaces[idx] == keyspace {
-			continue
-		}
-		savedKeyspaces = append(savedKeyspaces, keyspace)
+	b, err = endpoint.BooleanValueDefault("cassandra_keep_snapshot", DefaultKeepSnapshot)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_keep_snapshot   %s}\n", err)
+		fail = true
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_keep_snapshot}   @C{%t}\n", b)
 	}
-	sort.Strings(savedKeyspaces)
-
-	return savedKeyspaces
-}
 
-// Backup one cassandra keyspace
-func (p CassandraPlugin) Backup(endpoint plugin.ShieldEndpoint) error {
-	cassandra, err := cassandraInfo(endpoint)
+	b, err = endpoint.BooleanValueDefault("cassandra_snapshot_skip_flush", DefaultSkipFlush)
 	if err != nil {
-		return err
+		plugin.Printf("@R{\u2717 cassandra_snapshot_skip_flush %s}\n", err)
+		fail = true
+	} else if b {
+		plugin.Printf("@G{\u2713 cassandra_snapshot_skip_flush} @C{true}, @Y{writes still in memtables are not backed up}\n")
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_snapshot_skip_flush} @C{false}\n")
 	}
 
-	plugin.DEBUG("Cleaning any stale '%s' snapshot", SnapshotName)
-	cmd := fmt.Sprintf("%s/nodetool clearsnapshot -t %s", cassandra.BinDir, SnapshotName)
-	plugin.DEBUG("Executing: `%s`", cmd)
-	err = plugin.Exec(cmd, plugin.STDIN)
+	f, err := endpoint.FloatValueDefault("cassandra_nodetool_timeout", DefaultNodetoolTimeout)
 	if err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 Clean up any stale snapshot}\n")
-		return err
+		plugin.Printf("@R{\u2717 cassandra_nodetool_timeout %s}\n", err)
+		fail = true
+	} else if f < 0 || f != float64(int(f)) {
+		plugin.Printf("@R{\u2717 cassandra_nodetool_timeout must be a whole number of seconds}\n")
+		fail = true
+	} else if f == 0 {
+		plugin.Printf("@G{\u2713 cassandra_nodetool_timeout} @C{none}\n")
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_nodetool_timeout} @C{%ds}\n", int(f))
 	}
-	ansi.Fprintf(os.Stderr, "@G{\u2713 Clean up any stale snapshot}\n")
 
-	defer func() {
-		plugin.DEBUG("Clearing snapshot '%s'", SnapshotName)
-		cmd := fmt.Sprintf("%s/nodetool clearsnapshot -t %s", cassandra.BinDir, SnapshotName)
-		plugin.DEBUG("Executing: `%s`", cmd)
-		err := plugin.Exec(cmd, plugin.STDIN)
-		if err != nil {
-			ansi.Fprintf(os.Stderr, "@R{\u2717 Clear snapshot}\n")
-			return
-		}
-		ansi.Fprintf(os.Stderr, "@G{\u2713 Clear snapshot}\n")
-	}()
+	a, err = endpoint.ArrayValueDefault("cassandra_peers", nil)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_peers        %s}\n", err)
+		fail = true
+	} else if len(a) == 0 {
+		plugin.Printf("@G{\u2713 cassandra_peers}        @C{none}, cleanup-cluster only clears this node\n")
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_peers}        @C{%v}\n", a)
+	}
 
-	sort.Strings(cassandra.ExcludeKeyspaces)
-	savedKeyspaces := computeSavedKeyspaces(cassandra.IncludeKeyspaces, cassandra.ExcludeKeyspaces)
+	s, err = endpoint.StringValueDefault("cassandra_peer_access", DefaultPeerAccess)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_peer_access  %s}\n", err)
+		fail = true
+	} else if !validPeerAccess(s) {
+		plugin.Printf("@R{\u2717 cassandra_peer_access  must be 'jmx' or 'ssh', not '%s'}\n", s)
+		fail = true
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_peer_access}  @C{%s}\n", s)
+	}
 
-	plugin.DEBUG("Creating a new '%s' snapshot", SnapshotName)
-	cmd = fmt.Sprintf("%s/nodetool snapshot -t %s", cassandra.BinDir, SnapshotName)
-	if savedKeyspaces != nil {
-		for _, keyspace := range savedKeyspaces {
-			cmd = fmt.Sprintf("%s \"%s\"", cmd, keyspace)
-		}
+	f, err = endpoint.FloatValueDefault("cassandra_jmx_port", DefaultJMXPort)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_jmx_port     %s}\n", err)
+		fail = true
+	} else if f < 1 || f > 65535 || f != float64(int(f)) {
+		plugin.Printf("@R{\u2717 cassandra_jmx_port     must be a port number}\n")
+		fail = true
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_jmx_port}     @C{%d}\n", int(f))
 	}
-	plugin.DEBUG("Executing: `%s`", cmd)
-	err = plugin.Exec(cmd, plugin.STDIN)
+
+	s, err = endpoint.StringValueDefault("cassandra_jmx_user", DefaultJMXUser)
 	if err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 Create new snapshot}\n")
-		return err
+		plugin.Printf("@R{\u2717 cassandra_jmx_user     %s}\n", err)
+		fail = true
+	} else if s == "" {
+		plugin.Printf("@G{\u2713 cassandra_jmx_user}     @C{none}, without JMX authentication\n")
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_jmx_user}     @C{%s}\n", s)
 	}
-	ansi.Fprintf(os.Stderr, "@G{\u2713 Create new snapshot}\n")
 
-	// Here we need to copy the snapshots/shield-backup directories into a
-	// {keyspace}/{tablename} structure that we'll temporarily put in
-	// /var/vcap/store/shield/cassandra. Then we can tar it all and stream
-	// that to stdout.
+	s, err = endpoint.StringValueDefault("cassandra_ssh_key", DefaultSSHKey)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_ssh_key      %s}\n", err)
+		fail = true
+	} else if s != "" && !filepath.IsAbs(s) {
+		plugin.Printf("@R{\u2717 cassandra_ssh_key      must be an absolute path}\n")
+		fail = true
+	} else if s == "" {
+		plugin.Printf("@G{\u2713 cassandra_ssh_key}      @C{none}, the default keys of ssh\n")
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_ssh_key}      @C{%s}\n", s)
+	}
 
-	baseDir := "/var/vcap/store/shield/cassandra"
+	b, err = endpoint.BooleanValueDefault("cassandra_resume", DefaultResume)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_resume        %s}\n", err)
+		fail = true
+	} else if b {
+		plugin.Printf("@G{\u2713 cassandra_resume}        @C{yes}, failed backups are resumed from their snapshot\n")
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_resume}        @C{no}, failed backups start over\n")
+	}
+	resume := err == nil && b
 
-	// Recursively remove /var/vcap/store/shield/cassandra, if any
-	plugin.DEBUG("Removing any stale '%s' directory", baseDir)
-	cmd = fmt.Sprintf("rm -rf \"%s\"", baseDir)
-	plugin.DEBUG("Executing `%s`", cmd)
-	err = plugin.Exec(cmd, plugin.STDOUT)
+	f, err = endpoint.FloatValueDefault("cassandra_resume_max_age", DefaultResumeMaxAge)
 	if err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 Clean up any stale base temporary directory}\n")
-		return err
+		plugin.Printf("@R{\u2717 cassandra_resume_max_age %s}\n", err)
+		fail = true
+	} else if f < 1 || f != float64(int(f)) {
+		plugin.Printf("@R{\u2717 cassandra_resume_max_age must be a whole, positive number of hours}\n")
+		fail = true
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_resume_max_age} @C{%d hours}\n", int(f))
 	}
-	ansi.Fprintf(os.Stderr, "@G{\u2713 Clean up any stale base temporary directory}\n")
 
-	plugin.DEBUG("Creating base directories for '%s', with 0755 permissions", baseDir)
-	err = os.MkdirAll(baseDir, 0755)
+	f, err = endpoint.FloatValueDefault("cassandra_snapshot_generations", DefaultSnapshotGenerations)
 	if err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 Create base temporary directory}\n")
-		return err
+		plugin.Printf("@R{\u2717 cassandra_snapshot_generations %s}\n", err)
+		fail = true
+	} else if f < 0 || f != float64(int(f)) {
+		plugin.Printf("@R{\u2717 cassandra_snapshot_generations must be a whole number}\n")
+		fail = true
+	} else if f > 0 && resume {
+		plugin.Printf("@R{\u2717 cassandra_snapshot_generations can't be combined with cassandra_resume}\n")
+		fail = true
+	} else if f == 0 {
+		plugin.Printf("@G{\u2713 cassandra_snapshot_generations} @C{none}, snapshots are cleared after backup\n")
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_snapshot_generations} @C{%d}, kept on the node\n", int(f))
 	}
-	ansi.Fprintf(os.Stderr, "@G{\u2713 Create base temporary directory}\n")
 
-	defer func() {
-		// Recursively remove /var/vcap/store/shield/cassandra directory
-		plugin.DEBUG("Cleaning the '%s' directory up", baseDir)
-		cmd := fmt.Sprintf("rm -rf \"%s\"", baseDir)
-		plugin.DEBUG("Executing `%s`", cmd)
-		err := plugin.Exec(cmd, plugin.STDOUT)
-		if err != nil {
-			ansi.Fprintf(os.Stderr, "@R{\u2717 Clear base temporary directory}\n")
-			return
-		}
-		ansi.Fprintf(os.Stderr, "@G{\u2713 Clear base temporary directory}\n")
-	}()
+	f, err = endpoint.FloatValueDefault("cassandra_max_keyspace_bytes", DefaultMaxKeyspaceBytes)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_max_keyspace_bytes %s}\n", err)
+		fail = true
+	} else if f < 0 || f != float64(int64(f)) {
+		plugin.Printf("@R{\u2717 cassandra_max_keyspace_bytes must be a whole number of bytes}\n")
+		fail = true
+	} else if f == 0 {
+		plugin.Printf("@G{\u2713 cassandra_max_keyspace_bytes} keyspaces of @C{any size} are backed up\n")
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_max_keyspace_bytes} @C{%d bytes}\n", int64(f))
+	}
 
-	// Iterate through {dataDir}/{keyspace}/{tablename}/snapshots/shield-backup/*
-	// and for all the immutable files we find here, we hard-link them
-	// to /var/vcap/store/shield/cassandra/{keyspace}/{tablename}
-	//
-	// We chose to hard-link because copying those immutable files is
-	// unnecessary anyway. It could lead to performance issues and would
-	// consume twice the disk space it should.
+	b, err = endpoint.BooleanValueDefault("cassandra_commitlog_archiving", DefaultCommitlogArchiving)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_commitlog_archiving %s}\n", err)
+		fail = true
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_commitlog_archiving} @C{%t}\n", b)
+	}
 
-	info, err := os.Lstat(cassandra.DataDir)
+	s, err = endpoint.StringValueDefault("cassandra_commitlog_archive_dir", "")
 	if err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 Recursive hard-link snapshot files in temp dir}\n")
-		return err
+		plugin.Printf("@R{\u2717 cassandra_commitlog_archive_dir %s}\n", err)
+		fail = true
+	} else if s != "" && !filepath.IsAbs(s) {
+		plugin.Printf("@R{\u2717 cassandra_commitlog_archive_dir must be an absolute path}\n")
+		fail = true
+	} else if s == "" {
+		plugin.Printf("@G{\u2713 cassandra_commitlog_archive_dir} taken from archive_command\n")
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_commitlog_archive_dir} @C{%s}\n", s)
 	}
-	if !info.IsDir() {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 Recursive hard-link snapshot files in temp dir}\n")
-		return fmt.Errorf("cassandra DataDir is not a directory")
+
+	a, err = endpoint.ArrayValueDefault("cassandra_skip_components", DefaultSkipComponents)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_skip_components   %s}\n", err)
+		fail = true
+	} else if err = checkPatterns(a); err != nil {
+		plugin.Printf("@R{\u2717 cassandra_skip_components   %s}\n", err)
+		fail = true
+	} else if len(a) == 0 {
+		plugin.Printf("@G{\u2713 cassandra_skip_components}   archiving *all* SSTable components\n")
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_skip_components}   @C{%v}\n", a)
 	}
 
-	dir, err := os.Open(cassandra.DataDir)
+	s, err = endpoint.StringValueDefault("cassandra_bindir", "")
 	if err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 Recursive hard-link snapshot files in temp dir}\n")
-		return err
+		plugin.Printf("@R{\u2717 cassandra_bindir          %s}\n", err)
+		fail = true
+	} else if s == "" {
+		plugin.Printf("@G{\u2713 cassandra_bindir}          using default @C{%s}\n", DefaultBinDir)
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_bindir}          @C{%s}\n", s)
 	}
-	defer dir.Close()
 
-	entries, err := dir.Readdir(-1)
+	s, err = endpoint.StringValueDefault("cassandra_datadir", "")
 	if err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 Recursive hard-link snapshot files in temp dir}\n")
-		return err
+		plugin.Printf("@R{\u2717 cassandra_datadir         %s}\n", err)
+		fail = true
+	} else if s == "" {
+		plugin.Printf("@G{\u2713 cassandra_datadir}         using default @C{%s}\n", DefaultDataDir)
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_datadir}         @C{%s}\n", s)
 	}
-	for _, keyspaceDirInfo := range entries {
-		if !keyspaceDirInfo.IsDir() {
-			continue
-		}
-		keyspace := keyspaceDirInfo.Name()
-		if savedKeyspaces == nil {
-			idx := sort.SearchStrings(cassandra.ExcludeKeyspaces, keyspace)
-			if idx < len(cassandra.ExcludeKeyspaces) && cassandra.ExcludeKeyspaces[idx] == keyspace {
-				plugin.DEBUG("Excluding keyspace '%s'", keyspace)
-				continue
-			}
-		} else {
-			idx := sort.SearchStrings(savedKeyspaces, keyspace)
-			if idx >= len(savedKeyspaces) || savedKeyspaces[idx] != keyspace {
-				plugin.DEBUG("Excluding keyspace '%s'", keyspace)
-				continue
-			}
-		}
-		err = hardLinkKeyspace(cassandra.DataDir, baseDir, keyspace)
-		if err != nil {
-			ansi.Fprintf(os.Stderr, "@R{\u2717 Recursive hard-link snapshot files in temp dir}\n")
-			return err
-		}
+	dataDir := s
+	if dataDir == "" {
+		dataDir = DefaultDataDir
 	}
-	ansi.Fprintf(os.Stderr, "@G{\u2713 Recursive hard-link snapshot files in temp dir}\n")
 
-	if cassandra.SaveUsers {
-		err = backupUsers(cassandra, baseDir)
-		if err != nil {
-			ansi.Fprintf(os.Stderr, "@R{\u2717 Backup users}\n")
-			return err
+	s, err = endpoint.StringValueDefault("cassandra_tempdir", DefaultTempDir)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_tempdir         %s}\n", err)
+		fail = true
+	} else if !filepath.IsAbs(s) {
+		plugin.Printf("@R{\u2717 cassandra_tempdir         must be an absolute path}\n")
+		fail = true
+	} else if err = checkSameFilesystem(dataDir, s); err != nil {
+		if _, ok := err.(plugin.ConfigError); ok {
+			plugin.Printf("@R{\u2717 cassandra_tempdir         %s}\n", err)
+			fail = true
+		} else {
+			plugin.Printf("@G{\u2713 cassandra_tempdir}         @C{%s}, @Y{not checked against cassandra_datadir: %s}\n", s, err)
 		}
-		ansi.Fprintf(os.Stderr, "@G{\u2713 Backup users}\n")
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_tempdir}         @C{%s}, on the filesystem of cassandra_datadir\n", s)
 	}
 
-	plugin.DEBUG("Setting ownership of all backup files to '%s'", VcapOwnership)
-	cmd = fmt.Sprintf("chown -R vcap:vcap \"%s\"", baseDir)
-	plugin.DEBUG("Executing `%s`", cmd)
-	err = plugin.Exec(cmd, plugin.STDOUT)
+	s, err = endpoint.StringValueDefault("cassandra_config", "")
 	if err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 Set ownership of snapshot hard-links}\n")
-		return err
+		plugin.Printf("@R{\u2717 cassandra_config          %s}\n", err)
+		fail = true
+	} else if s == "" {
+		plugin.Printf("@G{\u2713 cassandra_config}          using default @C{%s}\n", DefaultConfig)
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_config}          @C{%s}\n", s)
 	}
-	ansi.Fprintf(os.Stderr, "@G{\u2713 Set ownership of snapshot hard-links}\n")
 
-	plugin.DEBUG("Streaming output tar file")
-	cmd = fmt.Sprintf("%s -c -C %s -f - .", cassandra.Tar, baseDir)
-	plugin.DEBUG("Executing `%s`", cmd)
-	err = plugin.Exec(cmd, plugin.STDOUT)
+	s, err = endpoint.StringValueDefault("cassandra_tar", "")
 	if err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 Stream tar of snapshots files}\n")
-		return err
+		plugin.Printf("@R{\u2717 cassandra_tar           %s}\n", err)
+		fail = true
+	} else if s == "" {
+		plugin.Printf("@G{\u2713 cassandra_tar}           using default @C{%s}\n", DefaultTar)
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_tar}           @C{%s}\n", s)
 	}
-	ansi.Fprintf(os.Stderr, "@G{\u2713 Stream tar of snapshots files}\n")
 
-	return nil
-}
-
-func hardLinkKeyspace(srcDataDir string, dstBaseDir string, keyspace string) error {
-	tmpKeyspaceDir := filepath.Join(dstBaseDir, keyspace)
-	plugin.DEBUG("Creating destination keyspace directory '%s' with 0700 permissions", tmpKeyspaceDir)
-	err := os.Mkdir(tmpKeyspaceDir, 0700)
+	b, err = endpoint.BooleanValueDefault("cassandra_extract_only", DefaultExtractOnly)
 	if err != nil {
-		return err
+		plugin.Printf("@R{\u2717 cassandra_extract_only  %s}\n", err)
+		fail = true
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_extract_only}  @C{%t}\n", b)
 	}
 
-	srcKeyspaceDir := filepath.Join(srcDataDir, keyspace)
+	s, err = endpoint.StringValueDefault("cassandra_extract_dir", "")
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_extract_dir   %s}\n", err)
+		fail = true
+	} else if s == "" && b {
+		plugin.Printf("@R{\u2717 cassandra_extract_dir   required when cassandra_extract_only is set}\n")
+		fail = true
+	} else if s == "" {
+		plugin.Printf("@G{\u2713 cassandra_extract_dir}   not set\n")
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_extract_dir}   @C{%s}\n", s)
+	}
+
+	s, err = endpoint.StringValueDefault("cassandra_restore_generation", "")
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_restore_generation %s}\n", err)
+		fail = true
+	} else if s != "" && b {
+		plugin.Printf("@R{\u2717 cassandra_restore_generation can't be combined with cassandra_extract_only}\n")
+		fail = true
+	} else if s == "" {
+		plugin.Printf("@G{\u2713 cassandra_restore_generation} not set, restoring the archive\n")
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_restore_generation} @C{%s}\n", s)
+	}
+
+	s, err = endpoint.StringValueDefault("cassandra_restore_point_in_time", "")
+	if err == nil && s != "" {
+		_, err = time.Parse(PointInTimeFormat, s)
+	}
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_restore_point_in_time %s}\n", err)
+		fail = true
+	} else if s == "" {
+		plugin.Printf("@G{\u2713 cassandra_restore_point_in_time} not set, commit logs are not replayed\n")
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_restore_point_in_time} @C{%s} (UTC)\n", s)
+	}
+
+	b, err = endpoint.BooleanValueDefault("cassandra_force_restore", DefaultForceRestore)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_force_restore %s}\n", err)
+		fail = true
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_force_restore} @C{%t}\n", b)
+	}
+
+	b, err = endpoint.BooleanValueDefault("cassandra_resume_restore", DefaultResumeRestore)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_resume_restore %s}\n", err)
+		fail = true
+	} else if b {
+		plugin.Printf("@G{\u2713 cassandra_resume_restore} @C{yes}, failed restores skip the tables they loaded when retried\n")
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_resume_restore} @C{no}, failed restores start over\n")
+	}
+
+	b, err = endpoint.BooleanValueDefault("cassandra_upgrade_sstables", DefaultUpgradeSSTables)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_upgrade_sstables %s}\n", err)
+		fail = true
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_upgrade_sstables} @C{%t}\n", b)
+	}
+
+	f, err = endpoint.FloatValueDefault("cassandra_chunk_size", DefaultChunkSize)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_chunk_size    %s}\n", err)
+		fail = true
+	} else if f < 0 || f != float64(int64(f)) {
+		plugin.Printf("@R{\u2717 cassandra_chunk_size    must be a whole number of MiB}\n")
+		fail = true
+	} else if f == 0 {
+		plugin.Printf("@G{\u2713 cassandra_chunk_size}    archives are @C{not} chunked\n")
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_chunk_size}    @C{%d MiB}\n", int64(f))
+	}
+
+	store, err := getChunkStore(endpoint)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_chunk_store   %s}\n", err)
+		fail = true
+	} else if store == nil && f > 0 {
+		plugin.Printf("@R{\u2717 cassandra_chunk_store   required when cassandra_chunk_size is set}\n")
+		fail = true
+	} else if store == nil {
+		plugin.Printf("@G{\u2713 cassandra_chunk_store}   not set\n")
+	} else if _, err = plugin.SubPluginPath(store.Plugin); err != nil {
+		plugin.Printf("@R{\u2717 cassandra_chunk_store   plugin '%s' not found: %s}\n", store.Plugin, err)
+		fail = true
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_chunk_store}   @C{%s}\n", store.Plugin)
+	}
+
+	for _, key := range []string{"cassandra_backup_filter", "cassandra_restore_filter"} {
+		s, err = endpoint.StringValueDefault(key, "")
+		if err != nil {
+			plugin.Printf("@R{\u2717 %-23s %s}\n", key, err)
+			fail = true
+		} else if s == "" {
+			plugin.Printf("@G{\u2713 %s}%*s not set\n", key, 23-len(key), "")
+		} else if _, err = filterCommand(s); err != nil {
+			plugin.Printf("@R{\u2717 %-23s invalid command: %s}\n", key, err)
+			fail = true
+		} else {
+			plugin.Printf("@G{\u2713 %s}%*s @C{%s}\n", key, 23-len(key), "", s)
+		}
+	}
+
+	b, err = endpoint.BooleanValueDefault("cassandra_checksum", DefaultChecksum)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_checksum      %s}\n", err)
+		fail = true
+	} else if b {
+		plugin.Printf("@G{\u2713 cassandra_checksum}      @C{yes}, archives will be followed by their checksum\n")
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_checksum}      @C{no}\n")
+	}
+
+	b, err = endpoint.BooleanValueDefault("cassandra_dedup", DefaultDedup)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_dedup         %s}\n", err)
+		fail = true
+	} else if !b {
+		plugin.Printf("@G{\u2713 cassandra_dedup}         @C{no}, backups are archived as a whole\n")
+	} else if store == nil {
+		plugin.Printf("@R{\u2717 cassandra_dedup         requires cassandra_chunk_store}\n")
+		fail = true
+	} else if f > 0 {
+		plugin.Printf("@R{\u2717 cassandra_dedup         can't be combined with cassandra_chunk_size}\n")
+		fail = true
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_dedup}         @C{yes}, files are stored once, in the chunk store\n")
+	}
+	dedup := err == nil && b
+
+	b, err = endpoint.BooleanValueDefault("cassandra_split_keyspaces", DefaultSplitKeyspaces)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_split_keyspaces %s}\n", err)
+		fail = true
+	} else if !b {
+		plugin.Printf("@G{\u2713 cassandra_split_keyspaces} @C{no}, keyspaces are archived together\n")
+	} else if store == nil {
+		plugin.Printf("@R{\u2717 cassandra_split_keyspaces requires cassandra_chunk_store}\n")
+		fail = true
+	} else if f > 0 || dedup {
+		plugin.Printf("@R{\u2717 cassandra_split_keyspaces can't be combined with cassandra_chunk_size or cassandra_dedup}\n")
+		fail = true
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_split_keyspaces} @C{yes}, each keyspace is stored on its own, in the chunk store\n")
+	}
+
+	s, err = endpoint.StringValueDefault("cassandra_dedup_index", DefaultDedupIndex)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_dedup_index   %s}\n", err)
+		fail = true
+	} else if !filepath.IsAbs(s) {
+		plugin.Printf("@R{\u2717 cassandra_dedup_index   must be an absolute path}\n")
+		fail = true
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_dedup_index}   @C{%s}\n", s)
+	}
+
+	f, err = endpoint.FloatValueDefault("cassandra_dedup_max_age", DefaultDedupMaxAge)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_dedup_max_age %s}\n", err)
+		fail = true
+	} else if f < 1 || f != float64(int(f)) {
+		plugin.Printf("@R{\u2717 cassandra_dedup_max_age must be a whole, positive number of days}\n")
+		fail = true
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_dedup_max_age} @C{%d days}\n", int(f))
+	}
+
+	n, err := endpoint.FloatValueDefault("cassandra_tar_jobs", DefaultTarJobs)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_tar_jobs      %s}\n", err)
+		fail = true
+	} else if n < 1 || n != float64(int(n)) {
+		plugin.Printf("@R{\u2717 cassandra_tar_jobs      must be a whole, positive number}\n")
+		fail = true
+	} else if n > 1 && b {
+		plugin.Printf("@R{\u2717 cassandra_tar_jobs      can't be combined with cassandra_dedup}\n")
+		fail = true
+	} else if n == 1 {
+		plugin.Printf("@G{\u2713 cassandra_tar_jobs}      @C{1}, keyspaces are archived one after the other\n")
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_tar_jobs}      @C{%d}, keyspaces are archived concurrently, in a multiplexed archive\n", int(n))
+	}
+
+	s, err = archiveRootFor(endpoint)
+	if err != nil {
+		plugin.Printf("@R{\u2717 cassandra_archive_root  %s}\n", err)
+		fail = true
+	} else if s != "" && b {
+		plugin.Printf("@R{\u2717 cassandra_archive_root  can't be combined with cassandra_dedup}\n")
+		fail = true
+	} else if s == "" {
+		plugin.Printf("@G{\u2713 cassandra_archive_root}  none, archive entries are rooted at @C{./}\n")
+	} else {
+		plugin.Printf("@G{\u2713 cassandra_archive_root}  @C{%s/}\n", s)
+	}
+
+	if !fail {
+		cassandra, err := cassandraInfo(endpoint)
+		if err != nil {
+			plugin.Printf("@R{\u2717 binaries                %s}\n", err)
+			fail = true
+		} else {
+			bins := []string{cassandra.Tar}
+			if !cassandra.ExtractOnly {
+				bins = append(bins,
+					filepath.Join(cassandra.BinDir, "nodetool"),
+					filepath.Join(cassandra.BinDir, "cqlsh"),
+					filepath.Join(cassandra.BinDir, "sstableloader"))
+			}
+			for _, filter := range []string{cassandra.BackupFilter, cassandra.RestoreFilter} {
+				if filter != "" {
+					bin, _ := filterCommand(filter)
+					bins = append(bins, bin)
+				}
+			}
+			if err = plugin.RequireBinaries(bins...); err != nil {
+				plugin.Printf("@R{\u2717 binaries                %s}\n", err)
+				fail = true
+			} else {
+				plugin.Printf("@G{\u2713 binaries}                @C{%s}\n", strings.Join(bins, ", "))
+			}
+		}
+	}
+
+	if fail {
+		return plugin.ValidationError{Plugin: "cassandra"}
+	}
+	return nil
+}
+
+func computeSavedKeyspaces(includeKeyspaces, excludeKeyspaces []string) []string {
+	if includeKeyspaces == nil {
+		return nil
+	}
+
+	savedKeyspaces := []string{}
+
+	sort.Strings(excludeKeyspaces)
+	for _, keyspace := range includeKeyspaces {
+		idx := sort.SearchStrings(excludeKeyspaces, keyspace)
+		if idx < len(excludeKeyspaces) && excludeKeyspaces[idx] == keyspace {
+			continue
+		}
+		savedKeyspaces = append(savedKeyspaces, keyspace)
+	}
+	sort.Strings(savedKeyspaces)
+
+	return savedKeyspaces
+}
+
+// Backup one cassandra keyspace
+func (p CassandraPlugin) Backup(endpoint plugin.ShieldEndpoint) (err error) {
+	cassandra, err := cassandraInfo(endpoint)
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(cassandra.ExcludeKeyspaces)
+	savedKeyspaces := computeSavedKeyspaces(cassandra.IncludeKeyspaces, cassandra.ExcludeKeyspaces)
+	if cassandra.SnapshotGenerations > 0 {
+		cassandra.Generation = newGeneration(time.Now())
+	}
+
+	if err = checkSameFilesystem(cassandra.DataDir, cassandra.TempDir); err != nil {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Check that the temporary directory is on the filesystem of the data}\n")
+		return err
+	}
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Check that the temporary directory is on the filesystem of the data}\n")
+
+	if err = checkBootstrapping(cassandra); err != nil {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Check that the node is not bootstrapping}\n")
+		return err
+	}
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Check that the node is not bootstrapping}\n")
+
+	var checkpoint *Checkpoint
+	if cassandra.Resume {
+		checkpoint, err = resumeCheckpoint(cassandra, savedKeyspaces, time.Now())
+		if err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Read the checkpoint of the previous backup}\n")
+			return err
+		}
+	}
+	resumed := checkpoint != nil
+	if resumed {
+		plugin.Fprintf(os.Stderr, "@Y{Resuming the previous backup, from the '%s' snapshot taken at %s (%d keyspaces staged already)}\n",
+			cassandra.snapshotName(), checkpoint.SnapshotAt.Format(time.RFC3339), len(checkpoint.Keyspaces))
+	} else {
+		plugin.DEBUG("Cleaning any stale '%s' snapshot", cassandra.snapshotName())
+		err = clearSnapshot(cassandra)
+		if err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Clean up any stale snapshot}\n")
+			return err
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Clean up any stale snapshot}\n")
+	}
+
+	snapshotted := resumed
+	defer func() {
+		releaseSnapshot(cassandra, snapshotted, err)
+	}()
+
+	snapshotAt := time.Now()
+	if resumed {
+		snapshotAt = checkpoint.SnapshotAt
+	}
+	if !resumed {
+		if err = takeSnapshot(cassandra, savedKeyspaces); err != nil {
+			return err
+		}
+		snapshotted = true
+	}
+
+	// Here we need to copy the snapshots/shield-backup directories into a
+	// {keyspace}/{tablename} structure that we'll temporarily put in
+	// cassandra_tempdir. Then we can tar it all and stream that to stdout.
+
+	archiveDir := cassandra.TempDir
+	baseDir, tarRoot := archiveDir, "."
+	if cassandra.ArchiveRoot != "" {
+		baseDir, tarRoot = filepath.Join(archiveDir, cassandra.ArchiveRoot), cassandra.ArchiveRoot
+	}
+
+	var cmd string
+	if !resumed {
+		// Recursively remove the temporary directory, if any, along with the checkpoint of what it held
+		plugin.DEBUG("Removing any stale '%s' directory", archiveDir)
+		cmd = fmt.Sprintf("rm -rf \"%s\"", archiveDir)
+		plugin.DEBUG("Executing `%s`", cmd)
+		err = plugin.Exec(cmd, plugin.STDOUT)
+		if err == nil {
+			err = clearCheckpoint()
+		}
+		if err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Clean up any stale base temporary directory}\n")
+			return err
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Clean up any stale base temporary directory}\n")
+
+		if cassandra.Resume {
+			checkpoint = newCheckpoint(cassandra, savedKeyspaces, time.Now())
+			if err = checkpoint.save(); err != nil {
+				plugin.Fprintf(os.Stderr, "@R{\u2717 Save the checkpoint of the backup}\n")
+				return err
+			}
+		}
+	}
+
+	plugin.DEBUG("Creating base directories for '%s'", baseDir)
+	err = plugin.MkdirStaging(baseDir, 0755)
+	if err != nil {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Create base temporary directory}\n")
+		return err
+	}
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Create base temporary directory}\n")
+
+	defer func() {
+		if cassandra.Resume && err != nil {
+			return
+		}
+		if cerr := clearCheckpoint(); cerr != nil {
+			plugin.DEBUG("Unable to remove the checkpoint file: %s", cerr)
+		}
+
+		if plugin.KeepStaging(archiveDir, err) {
+			return
+		}
+
+		// Recursively remove the temporary directory
+		plugin.DEBUG("Cleaning the '%s' directory up", archiveDir)
+		cmd := fmt.Sprintf("rm -rf \"%s\"", archiveDir)
+		plugin.DEBUG("Executing `%s`", cmd)
+		err := plugin.Exec(cmd, plugin.STDOUT)
+		if err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Clear base temporary directory}\n")
+			return
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Clear base temporary directory}\n")
+	}()
+
+	// Iterate through {dataDir}/{keyspace}/{tablename}/snapshots/shield-backup/*
+	// and for all the immutable files we find here, we hard-link them
+	// to {tempDir}/{keyspace}/{tablename}
+	//
+	// We chose to hard-link because copying those immutable files is
+	// unnecessary anyway. It could lead to performance issues and would
+	// consume twice the disk space it should.
+
+	info, err := os.Lstat(cassandra.DataDir)
+	if err != nil {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Recursive hard-link snapshot files in temp dir}\n")
+		return err
+	}
+	if !info.IsDir() {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Recursive hard-link snapshot files in temp dir}\n")
+		return plugin.ConfigError{Key: "cassandra_datadir", Err: fmt.Errorf("cassandra DataDir is not a directory")}
+	}
+
+	keyspaces, err := listKeyspaces(cassandra)
+	if err != nil {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Recursive hard-link snapshot files in temp dir}\n")
+		return err
+	}
+	backedUp, skipped, err := stageKeyspaces(cassandra, savedKeyspaces, keyspaces, baseDir, checkpoint)
+	if err != nil {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Recursive hard-link snapshot files in temp dir}\n")
+		return err
+	}
+	if reason := emptyBackupReason(cassandra, savedKeyspaces, keyspaces, backedUp); reason != "" {
+		if len(skipped) > 0 {
+			reason = fmt.Sprintf("the keyspaces selected for backup (%s) are all larger than cassandra_max_keyspace_bytes, or have no data in the snapshot",
+				strings.Join(skippedNames(skipped), ", "))
+		}
+		if err = emptyBackup(cassandra, reason); err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Recursive hard-link snapshot files in temp dir}\n")
+			return err
+		}
+	}
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Recursive hard-link snapshot files in temp dir}\n")
+
+	if cassandra.ExportSchema {
+		exported, err := exportSchema(cassandra, savedKeyspaces, baseDir)
+		if err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Export keyspaces schema}\n")
+			return err
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Export keyspaces schema}  %d keyspaces\n", len(exported))
+	}
+
+	if cassandra.SaveUsers {
+		err = backupUsers(cassandra, baseDir)
+		if err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Backup users}\n")
+			return err
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Backup users}\n")
+	}
+
+	err = checkEncryption(cassandra, baseDir)
+	if err != nil {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Check for encrypted SSTables}\n")
+		return err
+	}
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Check for encrypted SSTables}\n")
+
+	tableIDs, err := snapshotTableIDs(cassandra.DataDir, cassandra.snapshotName(), backedUp)
+	if err == nil {
+		err = recordTableIDs(baseDir, tableIDs)
+	}
+	if err != nil {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Record table IDs}\n")
+		return err
+	}
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Record table IDs}\n")
+
+	err = recordIdentity(cassandra, baseDir)
+	if err != nil {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Record node identity}\n")
+		return err
+	}
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Record node identity}\n")
+
+	err = recordSSTableFormats(baseDir, backedUp)
+	if err != nil {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Record SSTable formats}\n")
+		return err
+	}
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Record SSTable formats}\n")
+
+	if len(skipped) > 0 {
+		err = recordSkippedKeyspaces(baseDir, skipped)
+		if err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Record skipped keyspaces}\n")
+			return err
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Record skipped keyspaces}  %s\n", strings.Join(skippedNames(skipped), ", "))
+	}
+
+	if cassandra.CommitlogArchiving {
+		segments, err := stageCommitlogs(cassandra, baseDir, snapshotAt)
+		if err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Collect archived commit log segments}\n")
+			return err
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Collect archived commit log segments}  %d segments\n", len(segments))
+	}
+
+	plugin.DEBUG("Setting ownership of all backup files to '%s'", VcapOwnership)
+	cmd = fmt.Sprintf("chown -R vcap:vcap \"%s\"", archiveDir)
+	plugin.DEBUG("Executing `%s`", cmd)
+	err = plugin.Exec(cmd, plugin.STDOUT)
+	if err != nil {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Set ownership of snapshot hard-links}\n")
+		return err
+	}
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Set ownership of snapshot hard-links}\n")
+
+	plugin.DEBUG("Streaming output tar file")
+	cmd = fmt.Sprintf("%s -c -C %s -f - %s", cassandra.Tar, archiveDir, tarRoot)
+	plugin.DEBUG("Executing `%s`", cmd)
+	archive := func(out *os.File) error {
+		return plugin.ExecWithOptions(plugin.ExecOptions{Cmd: cmd, Stdout: out, ExpectRC: []int{0}})
+	}
+	if cassandra.TarJobs > 1 {
+		plugin.DEBUG("Archiving keyspaces with up to %d concurrent tar commands", cassandra.TarJobs)
+		archive = func(out *os.File) error {
+			return muxArchive(cassandra, archiveDir, out)
+		}
+	}
+	if cassandra.BackupFilter != "" {
+		archive = filterOutput(cassandra.BackupFilter, archive)
+	}
+	if cassandra.Dedup {
+		err = dedupArchive(cassandra, baseDir)
+	} else if cassandra.SplitKeyspaces {
+		err = splitArchive(cassandra, archiveDir)
+	} else if cassandra.ChunkSize > 0 {
+		err = chunkedArchive(cassandra, archive)
+	} else if cassandra.Checksum {
+		err = checksumOutput(archive)(os.Stdout)
+	} else if cassandra.BackupFilter != "" || cassandra.TarJobs > 1 {
+		err = archive(os.Stdout)
+	} else {
+		err = plugin.Exec(cmd, plugin.STDOUT)
+	}
+	if err != nil {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Stream tar of snapshots files}\n")
+		return err
+	}
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Stream tar of snapshots files}\n")
+
+	return nil
+}
+
+// listKeyspaces returns the keyspaces that have data on this node, either
+// by listing the data directory, or by asking the cluster (see
+// discoverKeyspaces).
+func listKeyspaces(cassandra *CassandraInfo) ([]string, error) {
+	if cassandra.DiscoverViaCQL {
+		return discoverKeyspaces(cassandra)
+	}
+
+	dir, err := os.Open(cassandra.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	entries, err := dir.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	keyspaces := []string{}
+	for _, keyspaceDirInfo := range entries {
+		if keyspaceDirInfo.IsDir() {
+			keyspaces = append(keyspaces, keyspaceDirInfo.Name())
+		}
+	}
+	return keyspaces, checkIncludedKeyspaces(cassandra, keyspaces)
+}
+
+// Names of the subdirectories that Cassandra keeps within table directories.
+// They are never tables themselves, even when found one level too high, in a
+// keyspace directory (i.e. left there by hand).
+var reservedTableDirs = map[string]bool{
+	"snapshots": true,
+	"backups":   true,
+}
+
+// isTableDir tells whether an entry of a keyspace data directory can be the
+// directory of a table.  Hidden directories (i.e. those of secondary
+// indexes) are not.
+func isTableDir(info os.FileInfo) bool {
+	return info.IsDir() && !reservedTableDirs[info.Name()] && !strings.HasPrefix(info.Name(), ".")
+}
+
+// hardLinkKeyspace hard-links the files of the given snapshot of the tables
+// of a keyspace into dstBaseDir/{keyspace}/{tablename}.  The keyspace
+// directory is only created for the first table that has snapshot data, so
+// that keyspaces without any are left out of the archive.
+func hardLinkKeyspace(srcDataDir string, dstBaseDir string, keyspace string, snapshot string, skip []string) error {
+	tmpKeyspaceDir := filepath.Join(dstBaseDir, keyspace)
+
+	srcKeyspaceDir := filepath.Join(srcDataDir, keyspace)
 	dir, err := os.Open(srcKeyspaceDir)
 	if err != nil {
 		return err
@@ -553,11 +2216,14 @@ func hardLinkKeyspace(srcDataDir string, dstBaseDir string, keyspace string) err
 		return err
 	}
 	for _, tableDirInfo := range entries {
-		if !tableDirInfo.IsDir() {
+		if !isTableDir(tableDirInfo) {
+			if tableDirInfo.IsDir() {
+				plugin.DEBUG("Skipping '%s', which is not a table directory", filepath.Join(srcKeyspaceDir, tableDirInfo.Name()))
+			}
 			continue
 		}
 
-		srcDir := filepath.Join(srcKeyspaceDir, tableDirInfo.Name(), "snapshots", SnapshotName)
+		srcDir := filepath.Join(srcKeyspaceDir, tableDirInfo.Name(), "snapshots", snapshot)
 		_, err = os.Lstat(srcDir)
 		if os.IsNotExist(err) {
 			continue
@@ -570,15 +2236,23 @@ func hardLinkKeyspace(srcDataDir string, dstBaseDir string, keyspace string) err
 			tableName = tableName[:idx]
 		}
 
+		if _, err = os.Lstat(tmpKeyspaceDir); os.IsNotExist(err) {
+			plugin.DEBUG("Creating destination keyspace directory '%s'", tmpKeyspaceDir)
+			err = plugin.MkdirStaging(tmpKeyspaceDir, 0700)
+		}
+		if err != nil {
+			return err
+		}
+
 		dstDir := filepath.Join(tmpKeyspaceDir, tableName)
 		plugin.DEBUG("Creating destination table directory '%s'", dstDir)
-		err = os.MkdirAll(dstDir, 0755)
+		err = plugin.MkdirStaging(dstDir, 0755)
 		if err != nil {
 			return err
 		}
 
 		plugin.DEBUG("Hard-linking all '%s/*' files to '%s/'", srcDir, dstDir)
-		err = hardLinkAll(srcDir, dstDir)
+		err = hardLinkAll(srcDir, dstDir, skip)
 		if err != nil {
 			return err
 		}
@@ -586,8 +2260,29 @@ func hardLinkKeyspace(srcDataDir string, dstBaseDir string, keyspace string) err
 	return nil
 }
 
-// Hard-link all files from 'srcDir' to the 'dstDir'
-func hardLinkAll(srcDir string, dstDir string) (err error) {
+// Check that all the given shell patterns are well-formed
+func checkPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad pattern '%s': %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Tell whether an SSTable component file must be left out of the backup
+func skipComponent(name string, skip []string) bool {
+	for _, pattern := range skip {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Hard-link all files from 'srcDir' to the 'dstDir', except those matching
+// any of the 'skip' patterns
+func hardLinkAll(srcDir string, dstDir string, skip []string) (err error) {
 
 	dir, err := os.Open(srcDir)
 	if err != nil {
@@ -606,6 +2301,10 @@ func hardLinkAll(srcDir string, dstDir string) (err error) {
 		if tableDirInfo.IsDir() {
 			continue
 		}
+		if skipComponent(tableDirInfo.Name(), skip) {
+			plugin.DEBUG("Skipping SSTable component '%s'", filepath.Join(srcDir, tableDirInfo.Name()))
+			continue
+		}
 		src := filepath.Join(srcDir, tableDirInfo.Name())
 		dst := filepath.Join(dstDir, tableDirInfo.Name())
 
@@ -625,120 +2324,277 @@ func backupUsers(cassandra *CassandraInfo, baseDir string) error {
 		plugin.DEBUG("Executing `%s`", cmd)
 		err := plugin.Exec(cmd, plugin.NOPIPE)
 		if err != nil {
-			ansi.Fprintf(os.Stderr, "@R{\u2717 Saving cassandra %s}\n", table)
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Saving cassandra %s}\n", table)
+			return err
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Saving cassandra %s}\n", table)
+	}
+	return nil
+}
+
+// Restore one cassandra keyspace
+func (p CassandraPlugin) Restore(endpoint plugin.ShieldEndpoint) (err error) {
+	cassandra, err := cassandraInfo(endpoint)
+	if err != nil {
+		return err
+	}
+
+	if cassandra.ExtractOnly {
+		return extractOnly(cassandra)
+	}
+
+	baseDir := cassandra.TempDir
+
+	// Recursively remove the temporary directory, if any
+	cmd := fmt.Sprintf("rm -rf \"%s\"", baseDir)
+	plugin.DEBUG("Executing `%s`", cmd)
+	err = plugin.Exec(cmd, plugin.STDOUT)
+	if err != nil {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Clean up any stale base temporary directory}\n")
+		return err
+	}
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Clean up any stale base temporary directory}\n")
+
+	plugin.DEBUG("Creating directory '%s'", baseDir)
+	err = plugin.MkdirStaging(baseDir, 0755)
+	if err != nil {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Create base temporary directory}\n")
+		return err
+	}
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Create base temporary directory}\n")
+
+	defer func() {
+		if plugin.KeepStaging(baseDir, err) {
+			return
+		}
+
+		// Recursively remove the temporary directory, if any
+		cmd := fmt.Sprintf("rm -rf \"%s\"", baseDir)
+		plugin.DEBUG("Executing `%s`", cmd)
+		err := plugin.Exec(cmd, plugin.STDOUT)
+		if err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Clear base temporary directory}\n")
+			return
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Clear base temporary directory}\n")
+	}()
+
+	sort.Strings(cassandra.ExcludeKeyspaces)
+	savedKeyspaces := computeSavedKeyspaces(cassandra.IncludeKeyspaces, cassandra.ExcludeKeyspaces)
+
+	if cassandra.RestoreGeneration != "" {
+		cassandra.Generation = cassandra.RestoreGeneration
+		if err = checkSameFilesystem(cassandra.DataDir, baseDir); err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Check that the temporary directory is on the filesystem of the data}\n")
+			return err
+		}
+		if err = stageGeneration(cassandra, baseDir); err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Hard-link snapshot '%s' files in temp dir}\n", cassandra.snapshotName())
+			return err
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Hard-link snapshot '%s' files in temp dir}\n", cassandra.snapshotName())
+	} else {
+		err = extractArchive(cassandra, baseDir)
+		if err == nil {
+			err = stripArchiveRoot(baseDir, cassandra.ArchiveRoot)
+		}
+		if err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Extract tar to temporary directory}\n")
+			return err
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Extract tar to temporary directory}\n")
+	}
+
+	manifest, err := readManifest(baseDir)
+	if err != nil {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Read archive manifest}\n")
+		return err
+	}
+	if manifest != nil && len(manifest.EncryptedTables) > 0 {
+		plugin.Fprintf(os.Stderr, "@Y{The archive holds encrypted SSTables for: %s}\n", strings.Join(manifest.EncryptedTables, ", "))
+		plugin.Fprintf(os.Stderr, "@Y{The encryption settings and keys they were written with must be in place on this node,}\n")
+		plugin.Fprintf(os.Stderr, "@Y{or sstableloader will fail to read them. (See %s in the archive.)}\n", ManifestFile)
+	}
+
+	err = checkIdentity(cassandra, manifest)
+	if err != nil {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Check the node the archive comes from}\n")
+		return err
+	}
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Check the node the archive comes from}\n")
+
+	keyspaces, err := restoredKeyspaces(cassandra, savedKeyspaces, baseDir)
+	if err != nil {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Load tables data}\n")
+		return err
+	}
+
+	applied, err := restoreSchema(cassandra, savedKeyspaces, baseDir)
+	if err != nil {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Recreate keyspaces schema}\n")
+		return err
+	}
+	if len(applied) > 0 {
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Recreate keyspaces schema}  %s\n", strings.Join(applied, ", "))
+	}
+
+	err = checkLiveTables(cassandra, baseDir, keyspaces, manifest)
+	if err != nil {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Check tables against the live schema}\n")
+		return err
+	}
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Check tables against the live schema}\n")
+
+	var checkpoint *RestoreCheckpoint
+	if cassandra.ResumeRestore {
+		archive, err := archiveFingerprint(baseDir, keyspaces)
+		if err == nil {
+			checkpoint, err = resumeRestoreCheckpoint(cassandra, archive, time.Now())
+		}
+		if err == nil {
+			err = checkpoint.save()
+		}
+		if err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Save the checkpoint of the restore}\n")
+			return err
+		}
+	}
+
+	for _, keyspace := range keyspaces {
+		keyspaceDirPath := filepath.Join(baseDir, keyspace)
+		err = restoreKeyspace(cassandra, keyspaceDirPath, checkpoint)
+		if err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Load tables data for keyspace '%s'}\n", keyspace)
+			if checkpoint != nil {
+				plugin.Fprintf(os.Stderr, "@Y{The %d tables loaded so far are recorded in %s; restoring the same archive again}\n", len(checkpoint.Tables), RestoreCheckpointFile)
+				plugin.Fprintf(os.Stderr, "@Y{within %d hours skips them.}\n", cassandra.ResumeMaxAge)
+			}
+			return err
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Load tables data for keyspace '%s'}\n", keyspace)
+	}
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Load tables data}\n")
+
+	upgraded, err := upgradeSSTables(cassandra, baseDir, keyspaces, manifest)
+	if err != nil {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Upgrade SSTables}\n")
+		return err
+	}
+	if len(upgraded) > 0 {
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Upgrade SSTables}  %s\n", strings.Join(upgraded, ", "))
+	}
+
+	if cassandra.SaveUsers && cassandra.RestoreGeneration == "" {
+		err = restoreUsers(cassandra, baseDir)
+		if err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Restore users}\n")
+			return err
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Restore users}\n")
+	}
+
+	if cassandra.RestorePointInTime != "" && cassandra.RestoreGeneration == "" {
+		n, err := prepareReplay(cassandra, baseDir)
+		if err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Set up the replay of commit log segments}\n")
 			return err
 		}
-		ansi.Fprintf(os.Stderr, "@G{\u2713 Saving cassandra %s}\n", table)
+		if n == 0 {
+			plugin.Fprintf(os.Stderr, "@Y{The archive holds no commit log segment; the data is restored as of the backup, not as of %s}\n", cassandra.RestorePointInTime)
+		} else {
+			plugin.Fprintf(os.Stderr, "@G{\u2713 Set up the replay of commit log segments}  %d segments, up to %s\n", n, cassandra.RestorePointInTime)
+			plugin.Fprintf(os.Stderr, "@Y{Restart Cassandra on this node for it to replay them, then remove restore_directories and}\n")
+			plugin.Fprintf(os.Stderr, "@Y{restore_point_in_time from %s.}\n", cassandra.commitlogProperties())
+		}
+	}
+
+	if checkpoint != nil {
+		if err := clearRestoreCheckpoint(); err != nil {
+			plugin.DEBUG("Unable to remove the checkpoint file: %s", err)
+		}
 	}
 	return nil
 }
 
-// Restore one cassandra keyspace
-func (p CassandraPlugin) Restore(endpoint plugin.ShieldEndpoint) error {
-	cassandra, err := cassandraInfo(endpoint)
-	if err != nil {
-		return err
+// Unpack the archive into the extract directory, and stop there
+func extractOnly(cassandra *CassandraInfo) error {
+	dir := cassandra.ExtractDir
+	if dir == "" {
+		return plugin.ConfigError{Key: "cassandra_extract_dir", Err: fmt.Errorf("cassandra_extract_dir is required when cassandra_extract_only is set")}
 	}
 
-	baseDir := "/var/vcap/store/shield/cassandra"
-
-	// Recursively remove /var/vcap/store/shield/cassandra, if any
-	cmd := fmt.Sprintf("rm -rf \"%s\"", baseDir)
-	plugin.DEBUG("Executing `%s`", cmd)
-	err = plugin.Exec(cmd, plugin.STDOUT)
-	if err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 Clean up any stale base temporary directory}\n")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Check extract directory} %s\n", dir)
 		return err
 	}
-	ansi.Fprintf(os.Stderr, "@G{\u2713 Clean up any stale base temporary directory}\n")
-
-	plugin.DEBUG("Creating directory '%s' with 0755 permissions", baseDir)
-	err = os.MkdirAll(baseDir, 0755)
-	if err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 Create base temporary directory}\n")
+	if len(entries) > 0 {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Check extract directory} %s\n", dir)
+		return fmt.Errorf("extract directory '%s' is not empty", dir)
+	}
+	plugin.DEBUG("Creating directory '%s'", dir)
+	if err = plugin.MkdirStaging(dir, 0755); err != nil {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Check extract directory} %s\n", dir)
 		return err
 	}
-	ansi.Fprintf(os.Stderr, "@G{\u2713 Create base temporary directory}\n")
-
-	defer func() {
-		// Recursively remove /var/vcap/store/shield/cassandra, if any
-		cmd := fmt.Sprintf("rm -rf \"%s\"", baseDir)
-		plugin.DEBUG("Executing `%s`", cmd)
-		err := plugin.Exec(cmd, plugin.STDOUT)
-		if err != nil {
-			ansi.Fprintf(os.Stderr, "@R{\u2717 Clear base temporary directory}\n")
-			return
-		}
-		ansi.Fprintf(os.Stderr, "@G{\u2713 Clear base temporary directory}\n")
-	}()
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Check extract directory} %s\n", dir)
 
-	sort.Strings(cassandra.ExcludeKeyspaces)
-	savedKeyspaces := computeSavedKeyspaces(cassandra.IncludeKeyspaces, cassandra.ExcludeKeyspaces)
-
-	// TODO: here we should extract only the necessary keyspaces
-	cmd = fmt.Sprintf("%s -x -C %s -f -", cassandra.Tar, baseDir)
-	plugin.DEBUG("Executing `%s`", cmd)
-	err = plugin.Exec(cmd, plugin.STDIN)
+	err = extractArchive(cassandra, dir)
+	if err == nil {
+		err = stripArchiveRoot(dir, cassandra.ArchiveRoot)
+	}
 	if err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 Extract tar to temporary directory}\n")
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Extract tar to extract directory}\n")
 		return err
 	}
-	ansi.Fprintf(os.Stderr, "@G{\u2713 Extract tar to temporary directory}\n")
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Extract tar to extract directory}\n")
+
+	plugin.Fprintf(os.Stderr, "@Y{Extract-only mode: no data was loaded into Cassandra.}\n")
+	plugin.Fprintf(os.Stderr, "@Y{The backup contents are left in %s, for inspection.}\n", dir)
+	return nil
+}
 
-	dir, err := os.Open(baseDir)
+// extractArchive runs the tar command(s) that extract the archive into dir,
+// feeding them with the archive, or with its chunks, through the restore
+// filter if any, once its checksum (if any) is taken off.
+func extractArchive(cassandra *CassandraInfo, dir string) error {
+	in, wait, err := archiveInput(cassandra)
 	if err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 Load tables data}\n")
 		return err
 	}
-	defer dir.Close()
-
-	entries, err := dir.Readdir(-1)
+	in, verify, err := plugin.ChecksumInput(in)
 	if err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 Load tables data}\n")
+		wait()
 		return err
 	}
-	for _, keyspaceDirInfo := range entries {
-		if !keyspaceDirInfo.IsDir() {
-			continue
-		}
-		keyspace := keyspaceDirInfo.Name()
-		if savedKeyspaces == nil {
-			idx := sort.SearchStrings(cassandra.ExcludeKeyspaces, keyspace)
-			if idx < len(cassandra.ExcludeKeyspaces) && cassandra.ExcludeKeyspaces[idx] == keyspace {
-				plugin.DEBUG("Excluding keyspace '%s'", keyspace)
-				continue
-			}
-		} else {
-			idx := sort.SearchStrings(savedKeyspaces, keyspace)
-			if idx >= len(savedKeyspaces) || savedKeyspaces[idx] != keyspace {
-				plugin.DEBUG("Excluding keyspace '%s'", keyspace)
-				continue
-			}
-		}
-		keyspaceDirPath := filepath.Join(baseDir, keyspace)
-		err = restoreKeyspace(cassandra, keyspaceDirPath)
-		if err != nil {
-			ansi.Fprintf(os.Stderr, "@R{\u2717 Load tables data for keyspace '%s'}\n", keyspace)
+	unfilter := func() error { return nil }
+	if cassandra.RestoreFilter != "" {
+		if in, unfilter, err = filterInput(cassandra.RestoreFilter, in); err != nil {
+			verify()
+			wait()
 			return err
 		}
-		ansi.Fprintf(os.Stderr, "@G{\u2713 Load tables data for keyspace '%s'}\n", keyspace)
 	}
-	ansi.Fprintf(os.Stderr, "@G{\u2713 Load tables data}\n")
-
-	if cassandra.SaveUsers {
-		err = restoreUsers(cassandra, baseDir)
-		if err != nil {
-			ansi.Fprintf(os.Stderr, "@R{\u2717 Restore users}\n")
-			return err
-		}
-		ansi.Fprintf(os.Stderr, "@G{\u2713 Restore users}\n")
+	err = untar(cassandra, bufio.NewReader(in), dir)
+	/* a broken filter is what makes tar fail, so it is reported first,
+	   unless the archive itself is broken */
+	if ferr := unfilter(); ferr != nil {
+		err = ferr
 	}
-
-	return nil
+	if verr := verify(); verr != nil {
+		err = verr
+	}
+	if werr := wait(); err == nil {
+		err = werr
+	}
+	return err
 }
 
-func restoreKeyspace(cassandra *CassandraInfo, keyspaceDirPath string) error {
-	// Iterate through all table directories /var/vcap/store/shield/cassandra/{cassandra.IncludeKeyspaces}/{tablename}
+// restoreKeyspace runs sstableloader on each table of the keyspace.  When
+// checkpoint is set, the tables it lists are skipped, and the others are
+// recorded into it once loaded.
+func restoreKeyspace(cassandra *CassandraInfo, keyspaceDirPath string, checkpoint *RestoreCheckpoint) error {
+	// Iterate through all table directories {tempDir}/{cassandra.IncludeKeyspaces}/{tablename}
 	dir, err := os.Open(keyspaceDirPath)
 	if err != nil {
 		return err
@@ -753,6 +2609,12 @@ func restoreKeyspace(cassandra *CassandraInfo, keyspaceDirPath string) error {
 		if !tableDirInfo.IsDir() {
 			continue
 		}
+		table := filepath.Base(keyspaceDirPath) + "." + tableDirInfo.Name()
+		if checkpoint.loaded(table) {
+			plugin.DEBUG("Table '%s' was loaded by a previous run", table)
+			continue
+		}
+
 		// Run sstableloader on each sub-directory found, assuming it is a table backup
 		tableDirPath := filepath.Join(keyspaceDirPath, tableDirInfo.Name())
 		cmd := fmt.Sprintf("%s/sstableloader -u \"%s\" -pw \"%s\" -d \"%s\" \"%s\"", cassandra.BinDir, cassandra.User, cassandra.Password, cassandra.Host, tableDirPath)
@@ -761,6 +2623,9 @@ func restoreKeyspace(cassandra *CassandraInfo, keyspaceDirPath string) error {
 		if err != nil {
 			return err
 		}
+		if err = checkpoint.record(table); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -771,10 +2636,10 @@ func restoreUsers(cassandra *CassandraInfo, baseDir string) error {
 	plugin.DEBUG("Executing: `%s`", cmd)
 	err := plugin.Exec(cmd, plugin.STDIN)
 	if err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 Exclude cassandra user from 'system_auth.roles' table content}\n")
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Exclude cassandra user from 'system_auth.roles' table content}\n")
 		return err
 	}
-	ansi.Fprintf(os.Stderr, "@G{\u2713 Exclude cassandra user from 'system_auth.roles' table content}\n")
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Exclude cassandra user from 'system_auth.roles' table content}\n")
 
 	for _, table := range SystemAuthTables {
 		plugin.DEBUG("Restoring 'system_auth.%s' table content", table)
@@ -783,10 +2648,10 @@ func restoreUsers(cassandra *CassandraInfo, baseDir string) error {
 		plugin.DEBUG("Executing: `%s`", cmd)
 		err := plugin.Exec(cmd, plugin.STDIN)
 		if err != nil {
-			ansi.Fprintf(os.Stderr, "@R{\u2717 Restore 'system_auth.%s' table content}\n", table)
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Restore 'system_auth.%s' table content}\n", table)
 			return err
 		}
-		ansi.Fprintf(os.Stderr, "@G{\u2713 Restore 'system_auth.%s' table content}\n", table)
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Restore 'system_auth.%s' table content}\n", table)
 	}
 	return nil
 }
@@ -825,11 +2690,16 @@ func cassandraInfo(endpoint plugin.ShieldEndpoint) (*CassandraInfo, error) {
 	}
 	plugin.DEBUG("CASSANDRA_USER: '%s'", user)
 
-	password, err := endpoint.StringValueDefault("cassandra_password", DefaultPassword)
+	password, err := cassandraPassword(endpoint)
 	if err != nil {
 		return nil, err
 	}
-	plugin.DEBUG("CASSANDRA_PWD: '%s'", password)
+	plugin.RegisterSecret(password)
+	if source, _ := passwordSource(endpoint); source != "" {
+		plugin.DEBUG("CASSANDRA_PWD: (read from %s)", source)
+	} else {
+		plugin.DEBUG("CASSANDRA_PWD: '%s'", password)
+	}
 
 	includeKeyspace, err := endpoint.ArrayValueDefault("cassandra_include_keyspaces", nil)
 	if err != nil {
@@ -843,12 +2713,172 @@ func cassandraInfo(endpoint plugin.ShieldEndpoint) (*CassandraInfo, error) {
 	}
 	plugin.DEBUG("CASSANDRA_EXCLUDE_KEYSPACES: [%v]", excludeKeyspace)
 
+	a, err := endpoint.ArrayValueDefault("cassandra_include_tables", nil)
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("CASSANDRA_INCLUDE_TABLES: [%v]", a)
+	includeTables, err := parseIncludeTables(a)
+	if err != nil {
+		return nil, plugin.ConfigError{Key: "cassandra_include_tables", Err: err}
+	}
+
+	discover, err := endpoint.BooleanValueDefault("cassandra_discover_via_cql", DefaultDiscoverViaCQL)
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("CASSANDRA_DISCOVER_VIA_CQL: %t", discover)
+
+	failOnMissing, err := endpoint.BooleanValueDefault("cassandra_fail_on_missing_keyspace", DefaultFailOnMissingKeyspace)
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("CASSANDRA_FAIL_ON_MISSING_KEYSPACE: %t", failOnMissing)
+
+	failOnEmpty, err := endpoint.BooleanValueDefault("cassandra_fail_on_empty_backup", DefaultFailOnEmptyBackup)
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("CASSANDRA_FAIL_ON_EMPTY_BACKUP: %t", failOnEmpty)
+
 	saveUsers, err := endpoint.BooleanValueDefault("cassandra_save_users", DefaultSaveUsers)
 	if err != nil {
 		return nil, err
 	}
 	plugin.DEBUG("CASSANDRA_SAVE_USERS: %t", saveUsers)
 
+	exportSchema, err := endpoint.BooleanValueDefault("cassandra_export_schema", DefaultExportSchema)
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("CASSANDRA_EXPORT_SCHEMA: %t", exportSchema)
+
+	keepSnapshot, err := endpoint.BooleanValueDefault("cassandra_keep_snapshot", DefaultKeepSnapshot)
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("CASSANDRA_KEEP_SNAPSHOT: %t", keepSnapshot)
+
+	skipFlush, err := endpoint.BooleanValueDefault("cassandra_snapshot_skip_flush", DefaultSkipFlush)
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("CASSANDRA_SNAPSHOT_SKIP_FLUSH: %t", skipFlush)
+
+	nodetoolTimeout, err := endpoint.FloatValueDefault("cassandra_nodetool_timeout", DefaultNodetoolTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if nodetoolTimeout < 0 || nodetoolTimeout != float64(int(nodetoolTimeout)) {
+		return nil, plugin.ConfigError{Key: "cassandra_nodetool_timeout", Err: fmt.Errorf("cassandra_nodetool_timeout must be a whole number of seconds")}
+	}
+	plugin.DEBUG("CASSANDRA_NODETOOL_TIMEOUT: %ds", int(nodetoolTimeout))
+
+	peers, err := endpoint.ArrayValueDefault("cassandra_peers", nil)
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("CASSANDRA_PEERS: %v", peers)
+
+	peerAccess, err := endpoint.StringValueDefault("cassandra_peer_access", DefaultPeerAccess)
+	if err != nil {
+		return nil, err
+	}
+	if !validPeerAccess(peerAccess) {
+		return nil, plugin.ConfigError{Key: "cassandra_peer_access", Err: fmt.Errorf("cassandra_peer_access must be 'jmx' or 'ssh', not '%s'", peerAccess)}
+	}
+	plugin.DEBUG("CASSANDRA_PEER_ACCESS: '%s'", peerAccess)
+
+	jmxPort, err := endpoint.FloatValueDefault("cassandra_jmx_port", DefaultJMXPort)
+	if err != nil {
+		return nil, err
+	}
+	if jmxPort < 1 || jmxPort > 65535 || jmxPort != float64(int(jmxPort)) {
+		return nil, plugin.ConfigError{Key: "cassandra_jmx_port", Err: fmt.Errorf("cassandra_jmx_port must be a port number")}
+	}
+	plugin.DEBUG("CASSANDRA_JMX_PORT: %d", int(jmxPort))
+
+	jmxUser, err := endpoint.StringValueDefault("cassandra_jmx_user", DefaultJMXUser)
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("CASSANDRA_JMX_USER: '%s'", jmxUser)
+
+	jmxPassword, err := endpoint.StringValueDefault("cassandra_jmx_password", "")
+	if err != nil {
+		return nil, err
+	}
+	plugin.RegisterSecret(jmxPassword)
+
+	sshKey, err := endpoint.StringValueDefault("cassandra_ssh_key", DefaultSSHKey)
+	if err != nil {
+		return nil, err
+	}
+	if sshKey != "" && !filepath.IsAbs(sshKey) {
+		return nil, plugin.ConfigError{Key: "cassandra_ssh_key", Err: fmt.Errorf("cassandra_ssh_key must be an absolute path")}
+	}
+	plugin.DEBUG("CASSANDRA_SSH_KEY: '%s'", sshKey)
+
+	resume, err := endpoint.BooleanValueDefault("cassandra_resume", DefaultResume)
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("CASSANDRA_RESUME: %t", resume)
+
+	resumeMaxAge, err := endpoint.FloatValueDefault("cassandra_resume_max_age", DefaultResumeMaxAge)
+	if err != nil {
+		return nil, err
+	}
+	if resumeMaxAge < 1 || resumeMaxAge != float64(int(resumeMaxAge)) {
+		return nil, plugin.ConfigError{Key: "cassandra_resume_max_age", Err: fmt.Errorf("cassandra_resume_max_age must be a whole, positive number of hours")}
+	}
+	plugin.DEBUG("CASSANDRA_RESUME_MAX_AGE: %d hours", int(resumeMaxAge))
+
+	generations, err := endpoint.FloatValueDefault("cassandra_snapshot_generations", DefaultSnapshotGenerations)
+	if err != nil {
+		return nil, err
+	}
+	if generations < 0 || generations != float64(int(generations)) {
+		return nil, plugin.ConfigError{Key: "cassandra_snapshot_generations", Err: fmt.Errorf("cassandra_snapshot_generations must be a whole number")}
+	}
+	if generations > 0 && resume {
+		return nil, plugin.ConfigError{Key: "cassandra_snapshot_generations", Err: fmt.Errorf("cassandra_snapshot_generations can't be combined with cassandra_resume")}
+	}
+	plugin.DEBUG("CASSANDRA_SNAPSHOT_GENERATIONS: %d", int(generations))
+
+	maxKeyspaceBytes, err := endpoint.FloatValueDefault("cassandra_max_keyspace_bytes", DefaultMaxKeyspaceBytes)
+	if err != nil {
+		return nil, err
+	}
+	if maxKeyspaceBytes < 0 || maxKeyspaceBytes != float64(int64(maxKeyspaceBytes)) {
+		return nil, plugin.ConfigError{Key: "cassandra_max_keyspace_bytes", Err: fmt.Errorf("cassandra_max_keyspace_bytes must be a whole number of bytes")}
+	}
+	plugin.DEBUG("CASSANDRA_MAX_KEYSPACE_BYTES: %d", int64(maxKeyspaceBytes))
+
+	commitlogArchiving, err := endpoint.BooleanValueDefault("cassandra_commitlog_archiving", DefaultCommitlogArchiving)
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("CASSANDRA_COMMITLOG_ARCHIVING: %t", commitlogArchiving)
+
+	commitlogArchiveDir, err := endpoint.StringValueDefault("cassandra_commitlog_archive_dir", "")
+	if err != nil {
+		return nil, err
+	}
+	if commitlogArchiveDir != "" && !filepath.IsAbs(commitlogArchiveDir) {
+		return nil, plugin.ConfigError{Key: "cassandra_commitlog_archive_dir", Err: fmt.Errorf("cassandra_commitlog_archive_dir must be an absolute path")}
+	}
+	plugin.DEBUG("CASSANDRA_COMMITLOG_ARCHIVE_DIR: '%s'", commitlogArchiveDir)
+
+	skipComponents, err := endpoint.ArrayValueDefault("cassandra_skip_components", DefaultSkipComponents)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkPatterns(skipComponents); err != nil {
+		return nil, plugin.ConfigError{Key: "cassandra_skip_components", Err: err}
+	}
+	plugin.DEBUG("CASSANDRA_SKIP_COMPONENTS: [%v]", skipComponents)
+
 	bindir, err := endpoint.StringValueDefault("cassandra_bindir", DefaultBinDir)
 	if err != nil {
 		return nil, err
@@ -861,22 +2891,226 @@ func cassandraInfo(endpoint plugin.ShieldEndpoint) (*CassandraInfo, error) {
 	}
 	plugin.DEBUG("CASSANDRA_DATADIR: '%s'", datadir)
 
+	tempdir, err := endpoint.StringValueDefault("cassandra_tempdir", DefaultTempDir)
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(tempdir) {
+		return nil, plugin.ConfigError{Key: "cassandra_tempdir", Err: fmt.Errorf("cassandra_tempdir must be an absolute path")}
+	}
+	plugin.DEBUG("CASSANDRA_TEMPDIR: '%s'", tempdir)
+
+	config, err := endpoint.StringValueDefault("cassandra_config", DefaultConfig)
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("CASSANDRA_CONFIG: '%s'", config)
+
 	tar, err := endpoint.StringValueDefault("cassandra_tar", DefaultTar)
 	if err != nil {
 		return nil, err
 	}
 	plugin.DEBUG("CASSANDRA_TAR: '%s'", tar)
 
+	extract, err := endpoint.BooleanValueDefault("cassandra_extract_only", DefaultExtractOnly)
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("CASSANDRA_EXTRACT_ONLY: %t", extract)
+
+	extractDir, err := endpoint.StringValueDefault("cassandra_extract_dir", "")
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("CASSANDRA_EXTRACT_DIR: '%s'", extractDir)
+
+	restoreGeneration, err := endpoint.StringValueDefault("cassandra_restore_generation", "")
+	if err != nil {
+		return nil, err
+	}
+	if restoreGeneration != "" && extract {
+		return nil, plugin.ConfigError{Key: "cassandra_restore_generation", Err: fmt.Errorf("cassandra_restore_generation can't be combined with cassandra_extract_only")}
+	}
+	plugin.DEBUG("CASSANDRA_RESTORE_GENERATION: '%s'", restoreGeneration)
+
+	pointInTime, err := endpoint.StringValueDefault("cassandra_restore_point_in_time", "")
+	if err != nil {
+		return nil, err
+	}
+	if pointInTime != "" {
+		if _, err = time.Parse(PointInTimeFormat, pointInTime); err != nil {
+			return nil, plugin.ConfigError{Key: "cassandra_restore_point_in_time", Err: fmt.Errorf("cassandra_restore_point_in_time must be written as yyyy:MM:dd HH:mm:ss")}
+		}
+	}
+	plugin.DEBUG("CASSANDRA_RESTORE_POINT_IN_TIME: '%s'", pointInTime)
+
+	forceRestore, err := endpoint.BooleanValueDefault("cassandra_force_restore", DefaultForceRestore)
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("CASSANDRA_FORCE_RESTORE: %t", forceRestore)
+
+	resumeRestore, err := endpoint.BooleanValueDefault("cassandra_resume_restore", DefaultResumeRestore)
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("CASSANDRA_RESUME_RESTORE: %t", resumeRestore)
+
+	upgradeSSTables, err := endpoint.BooleanValueDefault("cassandra_upgrade_sstables", DefaultUpgradeSSTables)
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("CASSANDRA_UPGRADE_SSTABLES: %t", upgradeSSTables)
+
+	chunkSize, err := endpoint.FloatValueDefault("cassandra_chunk_size", DefaultChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	if chunkSize < 0 {
+		return nil, plugin.ConfigError{Key: "cassandra_chunk_size", Err: fmt.Errorf("cassandra_chunk_size must not be negative")}
+	}
+	plugin.DEBUG("CASSANDRA_CHUNK_SIZE: %d MiB", int64(chunkSize))
+
+	chunkStore, err := getChunkStore(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if chunkStore == nil && chunkSize > 0 {
+		return nil, plugin.ConfigError{Key: "cassandra_chunk_store", Err: fmt.Errorf("cassandra_chunk_store is required when cassandra_chunk_size is set")}
+	}
+	if chunkStore != nil {
+		plugin.DEBUG("CASSANDRA_CHUNK_STORE: '%s'", chunkStore.Plugin)
+	}
+
+	backupFilter, err := endpoint.StringValueDefault("cassandra_backup_filter", "")
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("CASSANDRA_BACKUP_FILTER: '%s'", backupFilter)
+
+	restoreFilter, err := endpoint.StringValueDefault("cassandra_restore_filter", "")
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("CASSANDRA_RESTORE_FILTER: '%s'", restoreFilter)
+
+	checksum, err := endpoint.BooleanValueDefault("cassandra_checksum", DefaultChecksum)
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("CASSANDRA_CHECKSUM: %t", checksum)
+
+	dedup, err := endpoint.BooleanValueDefault("cassandra_dedup", DefaultDedup)
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("CASSANDRA_DEDUP: %t", dedup)
+	if dedup && chunkStore == nil {
+		return nil, plugin.ConfigError{Key: "cassandra_chunk_store", Err: fmt.Errorf("cassandra_chunk_store is required when cassandra_dedup is set")}
+	}
+	if dedup && (chunkSize > 0 || backupFilter != "") {
+		return nil, plugin.ConfigError{Key: "cassandra_dedup", Err: fmt.Errorf("cassandra_dedup can't be combined with cassandra_chunk_size or cassandra_backup_filter")}
+	}
+
+	dedupIndex, err := endpoint.StringValueDefault("cassandra_dedup_index", DefaultDedupIndex)
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("CASSANDRA_DEDUP_INDEX: '%s'", dedupIndex)
+
+	dedupMaxAge, err := endpoint.FloatValueDefault("cassandra_dedup_max_age", DefaultDedupMaxAge)
+	if err != nil {
+		return nil, err
+	}
+	if dedupMaxAge < 1 || dedupMaxAge != float64(int(dedupMaxAge)) {
+		return nil, plugin.ConfigError{Key: "cassandra_dedup_max_age", Err: fmt.Errorf("cassandra_dedup_max_age must be a whole, positive number of days")}
+	}
+	plugin.DEBUG("CASSANDRA_DEDUP_MAX_AGE: %d days", int(dedupMaxAge))
+
+	split, err := endpoint.BooleanValueDefault("cassandra_split_keyspaces", DefaultSplitKeyspaces)
+	if err != nil {
+		return nil, err
+	}
+	plugin.DEBUG("CASSANDRA_SPLIT_KEYSPACES: %t", split)
+	if split && chunkStore == nil {
+		return nil, plugin.ConfigError{Key: "cassandra_chunk_store", Err: fmt.Errorf("cassandra_chunk_store is required when cassandra_split_keyspaces is set")}
+	}
+	if split && (chunkSize > 0 || dedup || backupFilter != "") {
+		return nil, plugin.ConfigError{Key: "cassandra_split_keyspaces", Err: fmt.Errorf("cassandra_split_keyspaces can't be combined with cassandra_chunk_size, cassandra_dedup or cassandra_backup_filter")}
+	}
+
+	tarJobs, err := endpoint.FloatValueDefault("cassandra_tar_jobs", DefaultTarJobs)
+	if err != nil {
+		return nil, err
+	}
+	if tarJobs < 1 || tarJobs != float64(int(tarJobs)) {
+		return nil, plugin.ConfigError{Key: "cassandra_tar_jobs", Err: fmt.Errorf("cassandra_tar_jobs must be a whole, positive number")}
+	}
+	if tarJobs > 1 && dedup {
+		return nil, plugin.ConfigError{Key: "cassandra_tar_jobs", Err: fmt.Errorf("cassandra_tar_jobs can't be combined with cassandra_dedup")}
+	}
+	plugin.DEBUG("CASSANDRA_TAR_JOBS: %d", int(tarJobs))
+
+	archiveRoot, err := archiveRootFor(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if archiveRoot != "" && dedup {
+		return nil, plugin.ConfigError{Key: "cassandra_archive_root", Err: fmt.Errorf("cassandra_archive_root can't be combined with cassandra_dedup")}
+	}
+	plugin.DEBUG("CASSANDRA_ARCHIVE_ROOT: '%s'", archiveRoot)
+
 	return &CassandraInfo{
-		Host:             host,
-		Port:             port,
-		User:             user,
-		Password:         password,
-		IncludeKeyspaces: includeKeyspace,
-		ExcludeKeyspaces: excludeKeyspace,
-		SaveUsers:        saveUsers,
-		BinDir:           bindir,
-		DataDir:          datadir,
-		Tar:              tar,
+		Host:                  host,
+		Port:                  port,
+		User:                  user,
+		Password:              password,
+		IncludeKeyspaces:      includeKeyspace,
+		ExcludeKeyspaces:      excludeKeyspace,
+		IncludeTables:         includeTables,
+		DiscoverViaCQL:        discover,
+		FailOnMissingKeyspace: failOnMissing,
+		FailOnEmptyBackup:     failOnEmpty,
+		SaveUsers:             saveUsers,
+		ExportSchema:          exportSchema,
+		KeepSnapshot:          keepSnapshot,
+		SkipFlush:             skipFlush,
+		Resume:                resume,
+		ResumeMaxAge:          int(resumeMaxAge),
+		SnapshotGenerations:   int(generations),
+		MaxKeyspaceBytes:      int64(maxKeyspaceBytes),
+		CommitlogArchiving:    commitlogArchiving,
+		CommitlogArchiveDir:   commitlogArchiveDir,
+		NodetoolTimeout:       int(nodetoolTimeout),
+		Peers:                 peers,
+		PeerAccess:            peerAccess,
+		JMXPort:               int(jmxPort),
+		JMXUser:               jmxUser,
+		JMXPassword:           jmxPassword,
+		SSHKey:                sshKey,
+		SkipComponents:        skipComponents,
+		BinDir:                bindir,
+		DataDir:               datadir,
+		TempDir:               tempdir,
+		Config:                config,
+		Tar:                   tar,
+		TarJobs:               int(tarJobs),
+		ArchiveRoot:           archiveRoot,
+		ExtractOnly:           extract,
+		ExtractDir:            extractDir,
+		RestoreGeneration:     restoreGeneration,
+		RestorePointInTime:    pointInTime,
+		ForceRestore:          forceRestore,
+		ResumeRestore:         resumeRestore,
+		UpgradeSSTables:       upgradeSSTables,
+		ChunkSize:             int64(chunkSize) * 1024 * 1024,
+		ChunkStore:            chunkStore,
+		BackupFilter:          backupFilter,
+		RestoreFilter:         restoreFilter,
+		Checksum:              checksum,
+		Dedup:                 dedup,
+		DedupIndex:            dedupIndex,
+		DedupMaxAge:           int(dedupMaxAge),
+		SplitKeyspaces:        split,
 	}, nil
 }
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/mattn/go-shellwords"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// copyTree copies the fixture data directory to dst, so that the files
+// can be hard-linked without crossing file systems.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, b, 0644)
+	})
+}
+
+func listDir(dir string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	Ω(err).ShouldNot(HaveOccurred())
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+var _ = Describe("SSTable Components", func() {
+	var tmp, dataDir, baseDir string
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-cassandra-")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		dataDir = filepath.Join(tmp, "data")
+		baseDir = filepath.Join(tmp, "backup")
+		Ω(copyTree("test/fixtures", dataDir)).Should(Succeed())
+		Ω(os.MkdirAll(baseDir, 0755)).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	It("skips temporary components by default", func() {
+		Ω(hardLinkKeyspace(dataDir, baseDir, "ks1", SnapshotName, DefaultSkipComponents)).Should(Succeed())
+		Ω(listDir(filepath.Join(baseDir, "ks1", "orders"))).Should(Equal([]string{
+			"mc-1-big-Data.db",
+			"mc-1-big-Digest.crc32",
+			"mc-1-big-Index.db",
+			"mc-1-big-Statistics.db",
+			"mc-1-big-TOC.txt",
+		}))
+	})
+
+	It("skips the configured components", func() {
+		skip := append(DefaultSkipComponents, "*-Digest.crc32", "*-TOC.txt")
+		Ω(hardLinkKeyspace(dataDir, baseDir, "ks1", SnapshotName, skip)).Should(Succeed())
+		Ω(listDir(filepath.Join(baseDir, "ks1", "orders"))).Should(Equal([]string{
+			"mc-1-big-Data.db",
+			"mc-1-big-Index.db",
+			"mc-1-big-Statistics.db",
+		}))
+	})
+
+	It("keeps everything when the skip list is empty", func() {
+		Ω(hardLinkKeyspace(dataDir, baseDir, "ks1", SnapshotName, []string{})).Should(Succeed())
+		Ω(listDir(filepath.Join(baseDir, "ks1", "orders"))).Should(HaveLen(7))
+	})
+
+	It("leaves out keyspaces whose tables have no snapshot", func() {
+		/* a table that was never snapshotted, and one with another snapshot */
+		Ω(os.MkdirAll(filepath.Join(dataDir, "ks3", "events-0d1e2f30de2711e6a6b5d13f3c2b2a1a"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(dataDir, "ks3", "events-0d1e2f30de2711e6a6b5d13f3c2b2a1a", "mc-1-big-Data.db"), []byte("data"), 0644)).Should(Succeed())
+		Ω(os.MkdirAll(filepath.Join(dataDir, "ks3", "users-1e2f3041de2711e6a6b5d13f3c2b2a1a", "snapshots", "nightly"), 0755)).Should(Succeed())
+
+		Ω(hardLinkKeyspace(dataDir, baseDir, "ks3", SnapshotName, DefaultSkipComponents)).Should(Succeed())
+		Ω(hardLinkKeyspace(dataDir, baseDir, "ks1", SnapshotName, DefaultSkipComponents)).Should(Succeed())
+		Ω(listDir(baseDir)).Should(Equal([]string{"ks1"}))
+	})
+
+	It("does not take reserved subdirectories of keyspaces for tables", func() {
+		/* the fixtures hold a stray ks1/snapshots directory, with a snapshot in it */
+		Ω(os.MkdirAll(filepath.Join(dataDir, "ks1", ".orders_idx", "snapshots", SnapshotName), 0755)).Should(Succeed())
+		Ω(hardLinkKeyspace(dataDir, baseDir, "ks1", SnapshotName, DefaultSkipComponents)).Should(Succeed())
+		Ω(listDir(filepath.Join(baseDir, "ks1"))).Should(Equal([]string{"orders"}))
+	})
+
+	It("rejects malformed patterns", func() {
+		Ω(checkPatterns([]string{"*.tmp", "[-"})).ShouldNot(Succeed())
+		Ω(checkPatterns(DefaultSkipComponents)).Should(Succeed())
+	})
+})
+
+var _ = Describe("Encrypted SSTables", func() {
+	var tmp, dataDir, baseDir string
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-cassandra-")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		dataDir = filepath.Join(tmp, "data")
+		baseDir = filepath.Join(tmp, "backup")
+		Ω(copyTree("test/fixtures", dataDir)).Should(Succeed())
+		Ω(os.MkdirAll(baseDir, 0755)).Should(Succeed())
+		Ω(hardLinkKeyspace(dataDir, baseDir, "ks1", SnapshotName, DefaultSkipComponents)).Should(Succeed())
+		Ω(hardLinkKeyspace(dataDir, baseDir, "ks2", SnapshotName, DefaultSkipComponents)).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	It("detects encrypted tables from their compressor class", func() {
+		Ω(encryptedTables(baseDir)).Should(Equal([]string{"ks2.secrets"}))
+	})
+
+	It("extracts the encryption stanzas from cassandra.yaml", func() {
+		stanzas, err := encryptionConfig("test/cassandra.yaml")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(stanzas).Should(HaveKey("transparent_data_encryption_options"))
+		Ω(stanzas).Should(HaveKeyWithValue("system_key_directory", "/etc/dse/conf"))
+		Ω(stanzas).ShouldNot(HaveKey("cluster_name"))
+		Ω(commitLogEncrypted(stanzas)).Should(BeFalse())
+	})
+
+	It("records encrypted tables and settings into the manifest", func() {
+		cassandra := &CassandraInfo{Config: "test/cassandra.yaml"}
+		Ω(checkEncryption(cassandra, baseDir)).Should(Succeed())
+
+		manifest, err := readManifest(baseDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(manifest).ShouldNot(BeNil())
+		Ω(manifest.EncryptedTables).Should(Equal([]string{"ks2.secrets"}))
+		Ω(manifest.CassandraConfig).Should(Equal("test/cassandra.yaml"))
+		Ω(manifest.EncryptionConfig).Should(HaveKey("system_key_directory"))
+	})
+
+	It("still writes the manifest when cassandra.yaml can't be read", func() {
+		cassandra := &CassandraInfo{Config: filepath.Join(tmp, "nonexistent.yaml")}
+		Ω(checkEncryption(cassandra, baseDir)).Should(Succeed())
+
+		manifest, err := readManifest(baseDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(manifest.EncryptedTables).Should(Equal([]string{"ks2.secrets"}))
+		Ω(manifest.EncryptionConfig).Should(BeEmpty())
+	})
+
+	It("writes no manifest when nothing is encrypted", func() {
+		Ω(os.RemoveAll(filepath.Join(baseDir, "ks2"))).Should(Succeed())
+		cassandra := &CassandraInfo{Config: "test/cassandra.yaml"}
+		Ω(checkEncryption(cassandra, baseDir)).Should(Succeed())
+		Ω(readManifest(baseDir)).Should(BeNil())
+	})
+})
+
+var _ = Describe("Keyspace Discovery", func() {
+	var (
+		tmp, dataDir string
+		output       string
+		saved        func(*CassandraInfo, string) ([]byte, error)
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-cassandra-")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		dataDir = filepath.Join(tmp, "data")
+		Ω(copyTree("test/fixtures", dataDir)).Should(Succeed())
+		Ω(os.MkdirAll(filepath.Join(dataDir, "lost+found"), 0755)).Should(Succeed())
+
+		output = `
+ keyspace_name
+--------------------
+        system_auth
+                ks1
+                ks2
+              empty
+
+(4 rows)
+`
+		saved = cqlsh
+		cqlsh = func(cassandra *CassandraInfo, query string) ([]byte, error) {
+			Ω(query).Should(Equal(KeyspacesQuery))
+			return []byte(output), nil
+		}
+	})
+
+	AfterEach(func() {
+		cqlsh = saved
+		os.RemoveAll(tmp)
+	})
+
+	It("parses cqlsh output", func() {
+		Ω(parseCQLColumn([]byte(output))).Should(Equal([]string{"system_auth", "ks1", "ks2", "empty"}))
+		Ω(parseCQLColumn([]byte("\n keyspace_name\n---------\n\n(0 rows)\n"))).Should(BeEmpty())
+	})
+
+	It("lists the data directory by default", func() {
+		keyspaces, err := listKeyspaces(&CassandraInfo{DataDir: dataDir})
+		Ω(err).ShouldNot(HaveOccurred())
+		sort.Strings(keyspaces)
+		Ω(keyspaces).Should(Equal([]string{"ks1", "ks2", "lost+found"}))
+	})
+
+	It("only keeps real keyspaces that have data, when discovering via CQL", func() {
+		keyspaces, err := listKeyspaces(&CassandraInfo{DataDir: dataDir, DiscoverViaCQL: true})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(keyspaces).Should(Equal([]string{"ks1", "ks2"}))
+	})
+
+	It("only warns about included keyspaces that do not exist, by default", func() {
+		keyspaces, err := listKeyspaces(&CassandraInfo{
+			DataDir:          dataDir,
+			IncludeKeyspaces: []string{"ks1", "nope"},
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+		sort.Strings(keyspaces)
+		Ω(keyspaces).Should(Equal([]string{"ks1", "ks2", "lost+found"}))
+
+		_, err = discoverKeyspaces(&CassandraInfo{
+			DataDir:          dataDir,
+			IncludeKeyspaces: []string{"ks1", "nope", "empty"},
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	It("fails on included keyspaces that do not exist, when asked to", func() {
+		_, err := listKeyspaces(&CassandraInfo{
+			DataDir:               dataDir,
+			IncludeKeyspaces:      []string{"ks1", "nope", "typo"},
+			FailOnMissingKeyspace: true,
+		})
+		Ω(err).Should(MatchError("keyspaces listed in cassandra_include_keyspaces do not exist: nope, typo"))
+
+		_, err = discoverKeyspaces(&CassandraInfo{
+			DataDir:               dataDir,
+			IncludeKeyspaces:      []string{"ks1", "nope", "empty"},
+			FailOnMissingKeyspace: true,
+		})
+		Ω(err).Should(MatchError("keyspaces listed in cassandra_include_keyspaces do not exist: nope"))
+	})
+
+	It("fails when cqlsh finds no keyspace", func() {
+		output = ""
+		_, err := discoverKeyspaces(&CassandraInfo{DataDir: dataDir})
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("runs cqlsh like any other command, and captures what it prints", func() {
+		fake := plugin.NewFakeExec()
+		defer fake.Restore()
+		fake.On(`/cqlsh .* -e "SELECT `, plugin.FakeOutput(output))
+		fake.On(`/cqlsh .* -e "DESCRIBE `, plugin.FakeFailure(2, "Keyspace 'nope' not found."))
+
+		cassandra := &CassandraInfo{BinDir: "/opt/cassandra/bin", User: "cassandra", Password: "s3cr3t", Host: "10.0.0.1"}
+		out, err := saved(cassandra, KeyspacesQuery)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(out)).Should(Equal(output))
+
+		_, err = saved(cassandra, `DESCRIBE KEYSPACE "nope";`)
+		Ω(err).Should(HaveOccurred())
+		Ω(fake.Commands()).Should(Equal([]string{
+			`/opt/cassandra/bin/cqlsh -u "cassandra" -p "s3cr3t" -e "SELECT keyspace_name FROM system_schema.keyspaces;" "10.0.0.1"`,
+			`/opt/cassandra/bin/cqlsh -u "cassandra" -p "s3cr3t" -e "DESCRIBE KEYSPACE \"nope\";" "10.0.0.1"`,
+		}))
+
+		args, err := shellwords.Parse(fake.Commands()[1])
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(args).Should(Equal([]string{
+			"/opt/cassandra/bin/cqlsh", "-u", "cassandra", "-p", "s3cr3t", "-e", `DESCRIBE KEYSPACE "nope";`, "10.0.0.1",
+		}))
+	})
+})
+
+var _ = Describe("Keyspace Filtering", func() {
+	var fake *plugin.FakeExec
+
+	BeforeEach(func() {
+		fake = plugin.NewFakeExec()
+	})
+
+	AfterEach(func() {
+		fake.Restore()
+	})
+
+	snapshot := func(cassandra *CassandraInfo, include []string) []string {
+		sort.Strings(cassandra.ExcludeKeyspaces)
+		Ω(takeSnapshot(cassandra, computeSavedKeyspaces(include, cassandra.ExcludeKeyspaces))).Should(Succeed())
+		return fake.Commands()
+	}
+
+	It("only snapshots the included keyspaces that are not excluded", func() {
+		cassandra := &CassandraInfo{BinDir: "/bin", ExcludeKeyspaces: append([]string{}, DefaultExcludeKeyspaces...)}
+		Ω(snapshot(cassandra, []string{"ks2", "system_auth", "ks1"})).Should(Equal([]string{
+			`/bin/nodetool snapshot -t shield-backup "ks1" "ks2"`,
+		}))
+	})
+
+	It("snapshots all the keyspaces when none is included", func() {
+		cassandra := &CassandraInfo{BinDir: "/bin", ExcludeKeyspaces: []string{"ks1"}, SkipFlush: true}
+		Ω(snapshot(cassandra, nil)).Should(Equal([]string{
+			`/bin/nodetool snapshot -t shield-backup --skip-flush`,
+		}))
+	})
+
+	It("only snapshots the included tables of the keyspaces that are not excluded", func() {
+		cassandra := &CassandraInfo{
+			BinDir:           "/bin",
+			ExcludeKeyspaces: []string{"system_auth"},
+			IncludeTables:    map[string][]string{"ks1": {"t1", "t2"}, "ks2": {"t3"}, "system_auth": {"roles"}},
+		}
+		Ω(snapshot(cassandra, nil)).Should(Equal([]string{
+			`/bin/nodetool snapshot -t shield-backup -cf "t1" "ks1"`,
+			`/bin/nodetool snapshot -t shield-backup -cf "t2" "ks1"`,
+			`/bin/nodetool snapshot -t shield-backup -cf "t3" "ks2"`,
+		}))
+		fake.Restore()
+		fake = plugin.NewFakeExec()
+		Ω(snapshot(cassandra, []string{"ks2", "system_auth"})).Should(Equal([]string{
+			`/bin/nodetool snapshot -t shield-backup -cf "t3" "ks2"`,
+		}))
+	})
+
+	It("clears the snapshot left behind by a previous run, and takes it again", func() {
+		fake.On(`nodetool snapshot `, plugin.FakeFailure(2, "error: Snapshot shield-backup already exists.\n-- StackTrace --\n"))
+		cassandra := &CassandraInfo{BinDir: "/bin"}
+		err := takeSnapshot(cassandra, []string{"ks1"})
+		Ω(err).Should(HaveOccurred())
+		Ω(snapshotExists(err)).Should(BeTrue())
+		Ω(fake.Commands()).Should(Equal([]string{
+			`/bin/nodetool snapshot -t shield-backup "ks1"`,
+			`/bin/nodetool clearsnapshot -t shield-backup`,
+			`/bin/nodetool snapshot -t shield-backup "ks1"`,
+		}))
+	})
+})
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Resuming restores
+//
+// When `cassandra_resume_restore` is true, every table that `sstableloader`
+// loads is recorded into a checkpoint file, and a restore that fails leaves
+// it in place.  When the same archive is restored again, the tables it
+// lists are not streamed again.  Loading data that is already present is
+// mostly harmless (the cells are the same, and compaction merges them), so
+// this only saves time, which is hours for large keyspaces.
+//
+// The archive is told by a fingerprint of the files of its keyspaces (their
+// paths and sizes), so that the checkpoint of one archive is never used for
+// another.  A checkpoint is only resumed from for `cassandra_resume_max_age`
+// hours after the failed restore started.
+
+// RestoreCheckpointFile is where the checkpoint of a failed restore is kept.
+var RestoreCheckpointFile = "/var/vcap/store/shield/cassandra-restore.checkpoint"
+
+// RestoreCheckpoint records the tables that a restore loaded, for it to be
+// resumed.
+type RestoreCheckpoint struct {
+	// When the first attempt started.
+	StartedAt time.Time `json:"started_at"`
+	// What the archive is (see archiveFingerprint).
+	Archive string `json:"archive"`
+	// The tables that are fully loaded, as `keyspace.table`.
+	Tables []string `json:"tables"`
+}
+
+// archiveFingerprint identifies the extracted archive in baseDir, by the
+// paths and sizes of the files of the given keyspaces.
+func archiveFingerprint(baseDir string, keyspaces []string) (string, error) {
+	keyspaces = append([]string{}, keyspaces...)
+	sort.Strings(keyspaces)
+
+	h := sha256.New()
+	for _, keyspace := range keyspaces {
+		err := filepath.Walk(filepath.Join(baseDir, keyspace), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(baseDir, path)
+			if err != nil {
+				return err
+			}
+			io.WriteString(h, fmt.Sprintf("%s %d\n", rel, info.Size()))
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// resumeRestoreCheckpoint returns the checkpoint to resume the restore of
+// the archive from, or a new one when it must start over.
+func resumeRestoreCheckpoint(cassandra *CassandraInfo, archive string, now time.Time) (*RestoreCheckpoint, error) {
+	fresh := &RestoreCheckpoint{StartedAt: now.UTC(), Archive: archive, Tables: []string{}}
+
+	b, err := ioutil.ReadFile(RestoreCheckpointFile)
+	if os.IsNotExist(err) {
+		return fresh, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var checkpoint RestoreCheckpoint
+	if err = json.Unmarshal(b, &checkpoint); err != nil {
+		plugin.Fprintf(os.Stderr, "@Y{Ignoring the corrupted checkpoint file %s: %s}\n", RestoreCheckpointFile, err)
+		return fresh, nil
+	}
+	if checkpoint.Archive != archive {
+		plugin.Fprintf(os.Stderr, "@Y{Not resuming the previous restore: it was of another archive}\n")
+		return fresh, nil
+	}
+	if age := now.Sub(checkpoint.StartedAt); age > time.Duration(cassandra.ResumeMaxAge)*time.Hour {
+		plugin.Fprintf(os.Stderr, "@Y{Not resuming the previous restore: it started %s ago, more than %d hours}\n", age.Round(time.Minute), cassandra.ResumeMaxAge)
+		return fresh, nil
+	}
+	plugin.Fprintf(os.Stderr, "@Y{Resuming the previous restore: %d tables were loaded already, and are skipped}\n", len(checkpoint.Tables))
+	return &checkpoint, nil
+}
+
+// loaded tells whether the table was fully loaded already.
+func (c *RestoreCheckpoint) loaded(table string) bool {
+	if c == nil {
+		return false
+	}
+	for _, t := range c.Tables {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
+
+// record adds the table to the checkpoint, and saves it.
+func (c *RestoreCheckpoint) record(table string) error {
+	if c == nil {
+		return nil
+	}
+	c.Tables = append(c.Tables, table)
+	if err := c.save(); err != nil {
+		return fmt.Errorf("unable to save the checkpoint of the restore: %s", err)
+	}
+	return nil
+}
+
+// save writes the checkpoint out, atomically.
+func (c *RestoreCheckpoint) save() error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := RestoreCheckpointFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, RestoreCheckpointFile)
+}
+
+// clearRestoreCheckpoint removes the checkpoint file, if any.
+func clearRestoreCheckpoint() error {
+	err := os.Remove(RestoreCheckpointFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Resuming Restores", func() {
+	var (
+		tmp        string
+		baseDir    string
+		bindir     string
+		cassandra  *CassandraInfo
+		checkpoint string
+	)
+
+	now := time.Date(2024, 1, 31, 2, 0, 0, 0, time.UTC)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-cassandra-restore-")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		/* an extracted archive, with three tables */
+		baseDir = filepath.Join(tmp, "backup")
+		for _, table := range []string{"ks1/orders", "ks1/users", "ks2/secrets"} {
+			Ω(os.MkdirAll(filepath.Join(baseDir, table), 0755)).Should(Succeed())
+			Ω(ioutil.WriteFile(filepath.Join(baseDir, table, "mc-1-big-Data.db"), []byte(table), 0644)).Should(Succeed())
+		}
+
+		/* an sstableloader that logs what it is asked, and fails on the tables listed in `fail` */
+		bindir = filepath.Join(tmp, "bin")
+		Ω(os.MkdirAll(bindir, 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(bindir, "sstableloader"), []byte("#!/bin/sh\n"+
+			"for a; do table=$(basename \"$a\"); done\n"+
+			"echo $table >> "+filepath.Join(bindir, "calls")+"\n"+
+			"! grep -qx $table "+filepath.Join(bindir, "fail")+" 2>/dev/null\n"), 0755)).Should(Succeed())
+
+		checkpoint = RestoreCheckpointFile
+		RestoreCheckpointFile = filepath.Join(tmp, "cassandra-restore.checkpoint")
+		cassandra = &CassandraInfo{BinDir: bindir, ResumeRestore: true, ResumeMaxAge: DefaultResumeMaxAge}
+	})
+
+	AfterEach(func() {
+		RestoreCheckpointFile = checkpoint
+		os.RemoveAll(tmp)
+	})
+
+	failOn := func(tables ...string) {
+		Ω(ioutil.WriteFile(filepath.Join(bindir, "fail"), []byte(strings.Join(tables, "\n")+"\n"), 0644)).Should(Succeed())
+	}
+
+	calls := func() []string {
+		b, _ := ioutil.ReadFile(filepath.Join(bindir, "calls"))
+		os.Remove(filepath.Join(bindir, "calls"))
+		l := strings.Fields(string(b))
+		sort.Strings(l)
+		return l
+	}
+
+	/* loads the keyspaces as Restore does, from the checkpoint if any */
+	load := func(at time.Time) (*RestoreCheckpoint, error) {
+		archive, err := archiveFingerprint(baseDir, []string{"ks1", "ks2"})
+		Ω(err).ShouldNot(HaveOccurred())
+		c, err := resumeRestoreCheckpoint(cassandra, archive, at)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(c.save()).Should(Succeed())
+		for _, keyspace := range []string{"ks1", "ks2"} {
+			if err = restoreKeyspace(cassandra, filepath.Join(baseDir, keyspace), c); err != nil {
+				return c, err
+			}
+		}
+		return c, nil
+	}
+
+	It("skips the tables that a failed restore loaded, when it is retried", func() {
+		failOn("secrets")
+		c, err := load(now)
+		Ω(err).Should(HaveOccurred())
+		Ω(c.Tables).Should(ConsistOf("ks1.orders", "ks1.users"))
+		Ω(calls()).Should(Equal([]string{"orders", "secrets", "users"}))
+
+		failOn()
+		c, err = load(now.Add(time.Hour))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(c.StartedAt).Should(Equal(now))
+		Ω(c.Tables).Should(ConsistOf("ks1.orders", "ks1.users", "ks2.secrets"))
+		Ω(calls()).Should(Equal([]string{"secrets"}))
+
+		Ω(clearRestoreCheckpoint()).Should(Succeed())
+		Ω(RestoreCheckpointFile).ShouldNot(BeAnExistingFile())
+		Ω(clearRestoreCheckpoint()).Should(Succeed())
+	})
+
+	It("starts over for another archive", func() {
+		failOn("secrets")
+		_, err := load(now)
+		Ω(err).Should(HaveOccurred())
+		calls()
+
+		Ω(ioutil.WriteFile(filepath.Join(baseDir, "ks1", "users", "mc-1-big-Data.db"), []byte("more users"), 0644)).Should(Succeed())
+		failOn()
+		c, err := load(now.Add(time.Hour))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(c.StartedAt).Should(Equal(now.Add(time.Hour)))
+		Ω(calls()).Should(Equal([]string{"orders", "secrets", "users"}))
+	})
+
+	It("starts over when the failed restore is too old", func() {
+		failOn("secrets")
+		_, err := load(now)
+		Ω(err).Should(HaveOccurred())
+		calls()
+
+		failOn()
+		_, err = load(now.Add(time.Duration(DefaultResumeMaxAge+1) * time.Hour))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(calls()).Should(Equal([]string{"orders", "secrets", "users"}))
+	})
+
+	It("ignores corrupted checkpoints", func() {
+		Ω(ioutil.WriteFile(RestoreCheckpointFile, []byte("{not json"), 0600)).Should(Succeed())
+		c, err := load(now)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(c.Tables).Should(HaveLen(3))
+		Ω(calls()).Should(Equal([]string{"orders", "secrets", "users"}))
+	})
+
+	It("loads everything without a checkpoint", func() {
+		Ω(restoreKeyspace(cassandra, filepath.Join(baseDir, "ks1"), nil)).Should(Succeed())
+		Ω(calls()).Should(Equal([]string{"orders", "users"}))
+		Ω(RestoreCheckpointFile).ShouldNot(BeAnExistingFile())
+	})
+
+	It("fingerprints archives by their files, whatever the order of their keyspaces", func() {
+		a, err := archiveFingerprint(baseDir, []string{"ks1", "ks2"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(archiveFingerprint(baseDir, []string{"ks2", "ks1"})).Should(Equal(a))
+		Ω(archiveFingerprint(baseDir, []string{"ks1"})).ShouldNot(Equal(a))
+	})
+})
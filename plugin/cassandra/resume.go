@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Resuming backups
+//
+// When `cassandra_resume` is true, a backup that fails leaves the
+// `shield-backup` snapshot and the keyspaces it already staged (hard-linked)
+// in place, along with a checkpoint file that lists them.  The next backup
+// then resumes from there: it does not clear nor take the snapshot again,
+// and only stages the keyspaces that are not listed in the checkpoint,
+// before archiving the whole lot.
+//
+// The snapshot is a point-in-time copy, so resuming against it is safe, but
+// the archive of a resumed backup holds the data of the node as it was at
+// the first attempt, not as it is when the backup completes.  A checkpoint
+// is only resumed from for `cassandra_resume_max_age` hours (12 by default)
+// after its snapshot was taken; past that, or when the keyspaces and tables
+// selected for backup changed, or when the snapshot is gone, the backup
+// starts over with a fresh snapshot.  Until it is resumed, the snapshot
+// keeps its SSTables from being reclaimed by compaction, which costs disk
+// space.
+
+// CheckpointFile is where the checkpoint of a failed backup is kept, next
+// to (and not within) the staging directory, which gets archived.
+var CheckpointFile = "/var/vcap/store/shield/cassandra.checkpoint"
+
+// Checkpoint records the progress of a backup, for it to be resumed.
+type Checkpoint struct {
+	// When the snapshot was taken.
+	SnapshotAt time.Time `json:"snapshot_at"`
+	// What the snapshot is of (see snapshotSelection).
+	Selection string `json:"selection"`
+	// The keyspaces that are fully staged.
+	Keyspaces []string `json:"keyspaces"`
+}
+
+// snapshotSelection describes the keyspaces and tables selected for backup,
+// so that a checkpoint is not resumed with another selection.
+func snapshotSelection(cassandra *CassandraInfo, savedKeyspaces []string) string {
+	b, _ := json.Marshal(struct {
+		Keyspaces []string            `json:"keyspaces"`
+		Exclude   []string            `json:"exclude"`
+		Tables    map[string][]string `json:"tables"`
+	}{savedKeyspaces, cassandra.ExcludeKeyspaces, cassandra.IncludeTables})
+	return string(b)
+}
+
+func newCheckpoint(cassandra *CassandraInfo, savedKeyspaces []string, now time.Time) *Checkpoint {
+	return &Checkpoint{
+		SnapshotAt: now.UTC(),
+		Selection:  snapshotSelection(cassandra, savedKeyspaces),
+		Keyspaces:  []string{},
+	}
+}
+
+// resumeCheckpoint returns the checkpoint to resume the backup from, or nil
+// when it must start over.
+func resumeCheckpoint(cassandra *CassandraInfo, savedKeyspaces []string, now time.Time) (*Checkpoint, error) {
+	b, err := ioutil.ReadFile(CheckpointFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var checkpoint Checkpoint
+	if err = json.Unmarshal(b, &checkpoint); err != nil {
+		plugin.Fprintf(os.Stderr, "@Y{Ignoring the corrupted checkpoint file %s: %s}\n", CheckpointFile, err)
+		return nil, nil
+	}
+	if age := now.Sub(checkpoint.SnapshotAt); age > time.Duration(cassandra.ResumeMaxAge)*time.Hour {
+		plugin.Fprintf(os.Stderr, "@Y{Not resuming the previous backup: its snapshot is %s old, more than %d hours}\n", age.Round(time.Minute), cassandra.ResumeMaxAge)
+		return nil, nil
+	}
+	if checkpoint.Selection != snapshotSelection(cassandra, savedKeyspaces) {
+		plugin.Fprintf(os.Stderr, "@Y{Not resuming the previous backup: the keyspaces or tables to back up have changed}\n")
+		return nil, nil
+	}
+	snapshots, err := filepath.Glob(filepath.Join(cassandra.DataDir, "*", "*", "snapshots", cassandra.snapshotName()))
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		plugin.Fprintf(os.Stderr, "@Y{Not resuming the previous backup: the '%s' snapshot is gone}\n", cassandra.snapshotName())
+		return nil, nil
+	}
+	return &checkpoint, nil
+}
+
+// staged tells whether the keyspace was fully staged already.
+func (c *Checkpoint) staged(keyspace string) bool {
+	if c == nil {
+		return false
+	}
+	for _, k := range c.Keyspaces {
+		if k == keyspace {
+			return true
+		}
+	}
+	return false
+}
+
+// save writes the checkpoint out, atomically.
+func (c *Checkpoint) save() error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := CheckpointFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, CheckpointFile)
+}
+
+// clearCheckpoint removes the checkpoint file, if any.
+func clearCheckpoint() error {
+	err := os.Remove(CheckpointFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// stageKeyspaces hard-links the snapshot of the given keyspaces into
+// baseDir (see hardLinkKeyspace), and returns the ones that have data,
+// along with the size of those that were left out for being larger than
+// cassandra_max_keyspace_bytes.  When checkpoint is set, the keyspaces it
+// lists are not staged again, and the others are recorded into it once
+// staged.
+func stageKeyspaces(cassandra *CassandraInfo, savedKeyspaces, keyspaces []string, baseDir string, checkpoint *Checkpoint) ([]string, map[string]int64, error) {
+	backedUp := []string{}
+	skipped := map[string]int64{}
+	for _, keyspace := range keyspaces {
+		if !keyspaceSaved(cassandra, savedKeyspaces, keyspace) {
+			plugin.DEBUG("Excluding keyspace '%s'", keyspace)
+			continue
+		}
+		if cassandra.IncludeTables != nil && len(cassandra.IncludeTables[keyspace]) == 0 {
+			plugin.DEBUG("Excluding keyspace '%s', which has no table to include", keyspace)
+			continue
+		}
+
+		if checkpoint.staged(keyspace) {
+			plugin.DEBUG("Keyspace '%s' was staged by a previous run", keyspace)
+		} else {
+			/* whatever a failed run left of it */
+			if err := os.RemoveAll(filepath.Join(baseDir, keyspace)); err != nil {
+				return nil, nil, err
+			}
+			if cassandra.MaxKeyspaceBytes > 0 {
+				n, err := keyspaceBytes(cassandra.DataDir, keyspace, cassandra.snapshotName(), cassandra.SkipComponents)
+				if err != nil {
+					return nil, nil, err
+				}
+				if n > cassandra.MaxKeyspaceBytes {
+					plugin.Fprintf(os.Stderr, "@Y{Leaving keyspace '%s' out of the backup: its snapshot holds %d bytes, more than cassandra_max_keyspace_bytes (%d)}\n",
+						keyspace, n, cassandra.MaxKeyspaceBytes)
+					skipped[keyspace] = n
+					continue
+				}
+			}
+			if err := hardLinkKeyspace(cassandra.DataDir, baseDir, keyspace, cassandra.snapshotName(), cassandra.SkipComponents); err != nil {
+				return nil, nil, err
+			}
+			if checkpoint != nil {
+				checkpoint.Keyspaces = append(checkpoint.Keyspaces, keyspace)
+				if err := checkpoint.save(); err != nil {
+					return nil, nil, fmt.Errorf("unable to save the checkpoint of the backup: %s", err)
+				}
+			}
+		}
+
+		if _, err := os.Lstat(filepath.Join(baseDir, keyspace)); os.IsNotExist(err) {
+			plugin.DEBUG("Leaving keyspace '%s' out of the archive, as none of its tables has snapshot data", keyspace)
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		backedUp = append(backedUp, keyspace)
+	}
+	return backedUp, skipped, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Resuming Backups", func() {
+	var (
+		tmp, dataDir, baseDir string
+		checkpointFile        string
+		cassandra             *CassandraInfo
+		now                   time.Time
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-cassandra-resume-")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		dataDir = filepath.Join(tmp, "data")
+		baseDir = filepath.Join(tmp, "backup")
+		Ω(copyTree("test/fixtures", dataDir)).Should(Succeed())
+		Ω(os.MkdirAll(baseDir, 0755)).Should(Succeed())
+
+		checkpointFile = CheckpointFile
+		CheckpointFile = filepath.Join(tmp, "cassandra.checkpoint")
+
+		cassandra = &CassandraInfo{
+			DataDir:          dataDir,
+			ExcludeKeyspaces: []string{"system"},
+			SkipComponents:   DefaultSkipComponents,
+			Resume:           true,
+			ResumeMaxAge:     DefaultResumeMaxAge,
+		}
+		now = time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	})
+
+	AfterEach(func() {
+		CheckpointFile = checkpointFile
+		os.RemoveAll(tmp)
+	})
+
+	It("records the staged keyspaces as it goes", func() {
+		checkpoint := newCheckpoint(cassandra, nil, now)
+		Ω(checkpoint.save()).Should(Succeed())
+
+		backedUp, _, err := stageKeyspaces(cassandra, nil, []string{"ks1", "ks2"}, baseDir, checkpoint)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(backedUp).Should(Equal([]string{"ks1", "ks2"}))
+
+		saved, err := resumeCheckpoint(cassandra, nil, now.Add(time.Hour))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(saved).ShouldNot(BeNil())
+		Ω(saved.Keyspaces).Should(Equal([]string{"ks1", "ks2"}))
+		Ω(saved.SnapshotAt).Should(Equal(now))
+	})
+
+	It("skips the keyspaces staged by the failed run, and stages the others anew", func() {
+		/* the failed run staged ks1, and was halfway through ks2 */
+		checkpoint := newCheckpoint(cassandra, nil, now)
+		checkpoint.Keyspaces = []string{"ks1"}
+		Ω(checkpoint.save()).Should(Succeed())
+		Ω(os.MkdirAll(filepath.Join(baseDir, "ks1", "orders"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(baseDir, "ks1", "orders", "staged-before"), []byte("x"), 0644)).Should(Succeed())
+		Ω(os.MkdirAll(filepath.Join(baseDir, "ks2", "secrets"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(baseDir, "ks2", "secrets", "mc-1-big-Data.db"), []byte("partial"), 0644)).Should(Succeed())
+
+		checkpoint, err := resumeCheckpoint(cassandra, nil, now.Add(time.Hour))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(checkpoint).ShouldNot(BeNil())
+
+		backedUp, _, err := stageKeyspaces(cassandra, nil, []string{"ks1", "ks2"}, baseDir, checkpoint)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(backedUp).Should(Equal([]string{"ks1", "ks2"}))
+		Ω(listDir(filepath.Join(baseDir, "ks1", "orders"))).Should(Equal([]string{"staged-before"}))
+		Ω(listDir(filepath.Join(baseDir, "ks2", "secrets"))).Should(Equal([]string{"mc-1-big-CompressionInfo.db", "mc-1-big-Data.db"}))
+		Ω(ioutil.ReadFile(filepath.Join(baseDir, "ks2", "secrets", "mc-1-big-Data.db"))).ShouldNot(Equal([]byte("partial")))
+		Ω(checkpoint.Keyspaces).Should(Equal([]string{"ks1", "ks2"}))
+	})
+
+	It("starts over without a checkpoint, or with a stale or corrupted one", func() {
+		Ω(resumeCheckpoint(cassandra, nil, now)).Should(BeNil())
+
+		Ω(newCheckpoint(cassandra, nil, now).save()).Should(Succeed())
+		Ω(resumeCheckpoint(cassandra, nil, now.Add(11*time.Hour))).ShouldNot(BeNil())
+		Ω(resumeCheckpoint(cassandra, nil, now.Add(13*time.Hour))).Should(BeNil())
+
+		Ω(ioutil.WriteFile(CheckpointFile, []byte("{not json"), 0600)).Should(Succeed())
+		Ω(resumeCheckpoint(cassandra, nil, now)).Should(BeNil())
+	})
+
+	It("starts over when the selection of keyspaces changed", func() {
+		Ω(newCheckpoint(cassandra, nil, now).save()).Should(Succeed())
+		Ω(resumeCheckpoint(cassandra, []string{"ks1"}, now)).Should(BeNil())
+
+		cassandra.IncludeTables = map[string][]string{"ks1": {"orders"}}
+		Ω(resumeCheckpoint(cassandra, nil, now)).Should(BeNil())
+	})
+
+	It("starts over when the snapshot is gone", func() {
+		Ω(newCheckpoint(cassandra, nil, now).save()).Should(Succeed())
+		Ω(os.RemoveAll(filepath.Join(dataDir, "ks1", "orders-5bc52802de2511e6a6b5d13f3c2b2a1a", "snapshots"))).Should(Succeed())
+		Ω(os.RemoveAll(filepath.Join(dataDir, "ks1", "snapshots"))).Should(Succeed())
+		Ω(os.RemoveAll(filepath.Join(dataDir, "ks2", "secrets-7a1f3c40de2611e6a6b5d13f3c2b2a1a", "snapshots"))).Should(Succeed())
+		Ω(resumeCheckpoint(cassandra, nil, now)).Should(BeNil())
+	})
+
+	It("clears the checkpoint", func() {
+		Ω(clearCheckpoint()).Should(Succeed())
+		Ω(newCheckpoint(cassandra, nil, now).save()).Should(Succeed())
+		Ω(clearCheckpoint()).Should(Succeed())
+		_, err := os.Stat(CheckpointFile)
+		Ω(os.IsNotExist(err)).Should(BeTrue())
+	})
+})
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Archive root
+//
+// Archives are rooted at "./" by default: keyspace directories and the files
+// of the plugin (manifest, users, schemas) sit at the top of the tar.  When
+// `cassandra_archive_root` is set, the backup is staged one directory deeper,
+// and archived as `<root>/...` instead, so that a `tar tvf` of the archive
+// tells what it is.  Restores strip that directory again, after extracting
+// the archive, and restore archives without it (i.e. older ones) as they
+// are.
+
+var archiveRootRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// archiveRootFor returns the `cassandra_archive_root` of the endpoint, once
+// checked to be a single, plain directory name.
+func archiveRootFor(endpoint plugin.ShieldEndpoint) (string, error) {
+	root, err := endpoint.StringValueDefault("cassandra_archive_root", DefaultArchiveRoot)
+	if err != nil {
+		return "", err
+	}
+	if root != "" && !archiveRootRegexp.MatchString(root) {
+		return "", plugin.ConfigError{Key: "cassandra_archive_root",
+			Err: fmt.Errorf("cassandra_archive_root must be a single directory name, like 'cassandra-backup' (got '%s')", root)}
+	}
+	return root, nil
+}
+
+// stripArchiveRoot moves the contents of dir/root up into dir, when the
+// archive extracted into dir holds nothing but that root directory (and not,
+// say, a keyspace that happens to be named like it).
+func stripArchiveRoot(dir, root string) error {
+	if root == "" {
+		return nil
+	}
+	top, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(top) != 1 || top[0].Name() != root || !top[0].IsDir() {
+		plugin.DEBUG("The archive is not rooted at '%s/'; restoring it as is", root)
+		return nil
+	}
+	rootDir := filepath.Join(dir, root)
+
+	/* out of the way first, should the root be named like one of its entries */
+	tmp := filepath.Join(dir, ".shield-archive-root")
+	if err := os.Rename(rootDir, tmp); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.Rename(filepath.Join(tmp, entry.Name()), filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	plugin.DEBUG("Stripped the '%s' root directory of the archive", root)
+	return os.Remove(tmp)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("Archive Root", func() {
+	var (
+		tmp       string
+		src, dst  string
+		cassandra *CassandraInfo
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-cassandra-root-")
+		Ω(err).ShouldNot(HaveOccurred())
+		src = filepath.Join(tmp, "src")
+		dst = filepath.Join(tmp, "dst")
+		Ω(os.MkdirAll(filepath.Join(src, "cassandra-backup"), 0755)).Should(Succeed())
+		Ω(os.Mkdir(dst, 0755)).Should(Succeed())
+		Ω(backupTree(filepath.Join(src, "cassandra-backup"), 2, 2, 1000)).Should(Succeed())
+
+		cassandra = &CassandraInfo{Tar: "tar", TarJobs: 1, ArchiveRoot: "cassandra-backup"}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	/* extracts a plain tar archive of `entries` of src into dst */
+	extract := func(entries string) {
+		r, w, err := os.Pipe()
+		Ω(err).ShouldNot(HaveOccurred())
+		go func() {
+			plugin.ExecWithOptions(plugin.ExecOptions{Cmd: fmt.Sprintf("tar -c -C %s -f - %s", src, entries), Stdout: w, ExpectRC: []int{0}})
+			w.Close()
+		}()
+		Ω(untar(cassandra, bufio.NewReader(r), dst)).Should(Succeed())
+		r.Close()
+	}
+
+	It("accepts single directory names only", func() {
+		Ω(archiveRootFor(plugin.ShieldEndpoint{})).Should(Equal(""))
+		Ω(archiveRootFor(plugin.ShieldEndpoint{"cassandra_archive_root": "cassandra-backup"})).Should(Equal("cassandra-backup"))
+		for _, root := range []string{".", "..", "a/b", "/abs", ".hidden", "with space"} {
+			_, err := archiveRootFor(plugin.ShieldEndpoint{"cassandra_archive_root": root})
+			Ω(err).Should(BeAssignableToTypeOf(plugin.ConfigError{}), root)
+		}
+	})
+
+	It("strips the root directory of the archive on restore", func() {
+		extract("cassandra-backup")
+		Ω(stripArchiveRoot(dst, cassandra.ArchiveRoot)).Should(Succeed())
+		Ω(treeContents(dst)).Should(Equal(treeContents(filepath.Join(src, "cassandra-backup"))))
+	})
+
+	It("restores rootless archives as they are", func() {
+		extract("-C cassandra-backup .")
+		Ω(stripArchiveRoot(dst, cassandra.ArchiveRoot)).Should(Succeed())
+		Ω(treeContents(dst)).Should(Equal(treeContents(filepath.Join(src, "cassandra-backup"))))
+
+		/* with a keyspace named like the root */
+		Ω(os.RemoveAll(dst)).Should(Succeed())
+		Ω(os.Mkdir(dst, 0755)).Should(Succeed())
+		Ω(os.Rename(filepath.Join(src, "cassandra-backup", "ks1"), filepath.Join(src, "cassandra-backup", "cassandra-backup"))).Should(Succeed())
+		extract("-C cassandra-backup .")
+		Ω(stripArchiveRoot(dst, cassandra.ArchiveRoot)).Should(Succeed())
+		Ω(treeContents(dst)).Should(Equal(treeContents(filepath.Join(src, "cassandra-backup"))))
+	})
+
+	It("strips a root named like one of its entries", func() {
+		Ω(os.Rename(filepath.Join(src, "cassandra-backup", "ks1"), filepath.Join(src, "cassandra-backup", "cassandra-backup"))).Should(Succeed())
+		extract("cassandra-backup")
+		Ω(stripArchiveRoot(dst, cassandra.ArchiveRoot)).Should(Succeed())
+		Ω(treeContents(dst)).Should(Equal(treeContents(filepath.Join(src, "cassandra-backup"))))
+	})
+
+	It("roots multiplexed archives too", func() {
+		cassandra.TarJobs = 2
+		names, contents, err := muxStreams(src, cassandra.ArchiveRoot)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(names).Should(Equal([]string{".", "ks1", "ks2"}))
+		Ω(contents[0]).Should(Equal([]string{"cassandra-backup/" + ManifestFile}))
+		Ω(contents[1]).Should(Equal([]string{"cassandra-backup/ks1"}))
+
+		f, err := os.Create(filepath.Join(tmp, "archive"))
+		Ω(err).ShouldNot(HaveOccurred())
+		defer f.Close()
+		Ω(muxArchive(cassandra, src, f)).Should(Succeed())
+		_, err = f.Seek(0, 0)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(untar(cassandra, bufio.NewReader(f), dst)).Should(Succeed())
+		Ω(listDir(dst)).Should(Equal([]string{"cassandra-backup"}))
+		Ω(stripArchiveRoot(dst, cassandra.ArchiveRoot)).Should(Succeed())
+		Ω(treeContents(dst)).Should(Equal(treeContents(filepath.Join(src, "cassandra-backup"))))
+	})
+})
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Table IDs
+//
+// Each table has an ID (the CFID) that Cassandra appends to the name of its
+// data directory, i.e. `orders-5bc52802de2511e6a6b5d13f3c2b2a1a`.  A table
+// that is dropped and created again gets a new ID, and so a new directory.
+// Archives only name table directories after their tables, so that
+// `sstableloader` streams their SSTables into whatever table has that name
+// in the live schema, whatever its ID.
+//
+// The IDs that tables had at backup time are recorded in the manifest.  On
+// restore, the tables of the archive are checked against the live schema,
+// before anything is loaded: tables that were recreated since the backup
+// are reported, and tables that do not exist (anymore) make the restore
+// fail, since `sstableloader` would fail on them halfway through.
+
+// TablesQuery lists all the tables of the cluster, with their IDs.
+const TablesQuery = "SELECT keyspace_name, table_name, id FROM system_schema.tables;"
+
+// parseCQLRows extracts the values of a multi-column cqlsh result, i.e.
+//
+//	 keyspace_name | table_name | id
+//	---------------+------------+--------------------------------------
+//	           ks1 |     orders | 5bc52802-de25-11e6-a6b5-d13f3c2b2a1a
+//
+//	(1 rows)
+func parseCQLRows(out []byte) [][]string {
+	rows := [][]string{}
+	header := true
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if header {
+			header = !strings.HasPrefix(line, "---")
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "(") {
+			break
+		}
+		row := strings.Split(line, "|")
+		for i := range row {
+			row[i] = strings.TrimSpace(row[i])
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// normalizeTableID turns table IDs into the form that data directories use,
+// i.e. without dashes.
+func normalizeTableID(id string) string {
+	return strings.ToLower(strings.Replace(id, "-", "", -1))
+}
+
+// liveTableIDs asks the cluster for the IDs of its tables, by
+// "keyspace.table" name.
+func liveTableIDs(cassandra *CassandraInfo) (map[string]string, error) {
+	out, err := cqlsh(cassandra, TablesQuery)
+	if err != nil {
+		return nil, err
+	}
+	ids := map[string]string{}
+	for _, row := range parseCQLRows(out) {
+		if len(row) != 3 {
+			return nil, fmt.Errorf("unexpected row in system_schema.tables: %v", row)
+		}
+		ids[row[0]+"."+row[1]] = normalizeTableID(row[2])
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no table found in system_schema.tables")
+	}
+	return ids, nil
+}
+
+// snapshotTableIDs lists the IDs of the tables that have a snapshot in the
+// given keyspaces, by "keyspace.table" name, from their data directories.
+func snapshotTableIDs(dataDir, snapshot string, keyspaces []string) (map[string]string, error) {
+	ids := map[string]string{}
+	for _, keyspace := range keyspaces {
+		entries, err := ioutil.ReadDir(filepath.Join(dataDir, keyspace))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			idx := strings.LastIndex(entry.Name(), "-")
+			if !isTableDir(entry) || idx < 0 {
+				continue
+			}
+			_, err := os.Lstat(filepath.Join(dataDir, keyspace, entry.Name(), "snapshots", snapshot))
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			ids[keyspace+"."+entry.Name()[:idx]] = normalizeTableID(entry.Name()[idx+1:])
+		}
+	}
+	return ids, nil
+}
+
+// recordTableIDs adds the table IDs to the manifest of the archive.
+func recordTableIDs(baseDir string, ids map[string]string) error {
+	manifest, err := readManifest(baseDir)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		manifest = &Manifest{}
+	}
+	manifest.TableIDs = ids
+
+	b, err := yaml.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(baseDir, ManifestFile)
+	plugin.DEBUG("Writing manifest file '%s'", path)
+	return plugin.WriteStagingFile(path, b, 0644)
+}
+
+// archivedTables lists the tables of the given keyspaces of an extracted
+// archive, as "keyspace.table".
+func archivedTables(baseDir string, keyspaces []string) ([]string, error) {
+	tables := []string{}
+	for _, keyspace := range keyspaces {
+		entries, err := ioutil.ReadDir(filepath.Join(baseDir, keyspace))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				tables = append(tables, keyspace+"."+entry.Name())
+			}
+		}
+	}
+	sort.Strings(tables)
+	return tables, nil
+}
+
+// checkLiveTables checks the tables of the keyspaces to restore against
+// the live schema.  When the live schema can't be queried, the check is
+// skipped with a warning, and `sstableloader` gets to tell.
+func checkLiveTables(cassandra *CassandraInfo, baseDir string, keyspaces []string, manifest *Manifest) error {
+	tables, err := archivedTables(baseDir, keyspaces)
+	if err != nil {
+		return err
+	}
+	live, err := liveTableIDs(cassandra)
+	if err != nil {
+		plugin.Fprintf(os.Stderr, "@Y{Unable to query the live schema (%s); not checking the tables to restore}\n", err)
+		return nil
+	}
+
+	var backedUp map[string]string
+	if manifest != nil {
+		backedUp = manifest.TableIDs
+	}
+	missing := []string{}
+	for _, table := range tables {
+		id, ok := live[table]
+		if !ok {
+			missing = append(missing, table)
+			continue
+		}
+		if old, ok := backedUp[table]; ok && old != id {
+			plugin.Fprintf(os.Stderr, "@Y{Table %s was recreated since the backup (id %s, now %s); loading its data into the live table}\n", table, old, id)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("tables of the archive do not exist in the cluster: %s; create them (with the schema they had) before restoring", strings.Join(missing, ", "))
+	}
+	return nil
+}
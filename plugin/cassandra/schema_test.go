@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Table IDs", func() {
+	var (
+		tmp, dataDir, baseDir string
+		output                []byte
+		saved                 func(*CassandraInfo, string) ([]byte, error)
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-cassandra-")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		dataDir = filepath.Join(tmp, "data")
+		baseDir = filepath.Join(tmp, "backup")
+		Ω(copyTree("test/fixtures", dataDir)).Should(Succeed())
+		Ω(os.MkdirAll(baseDir, 0755)).Should(Succeed())
+		Ω(hardLinkKeyspace(dataDir, baseDir, "ks1", SnapshotName, DefaultSkipComponents)).Should(Succeed())
+		Ω(hardLinkKeyspace(dataDir, baseDir, "ks2", SnapshotName, DefaultSkipComponents)).Should(Succeed())
+
+		/* ks1.orders was dropped and created again since the backup */
+		output, err = ioutil.ReadFile("test/system_schema_tables.txt")
+		Ω(err).ShouldNot(HaveOccurred())
+		saved = cqlsh
+		cqlsh = func(cassandra *CassandraInfo, query string) ([]byte, error) {
+			Ω(query).Should(Equal(TablesQuery))
+			return output, nil
+		}
+	})
+
+	AfterEach(func() {
+		cqlsh = saved
+		os.RemoveAll(tmp)
+	})
+
+	It("parses multi-column cqlsh output", func() {
+		rows := parseCQLRows(output)
+		Ω(rows).Should(HaveLen(3))
+		Ω(rows[1]).Should(Equal([]string{"ks1", "orders", "9e2a6f10-1b7c-11e7-8f3e-2b6c1d0e4f5a"}))
+	})
+
+	It("reads the table IDs from the data directory and from the live schema", func() {
+		Ω(snapshotTableIDs(dataDir, SnapshotName, []string{"ks1", "ks2"})).Should(Equal(map[string]string{
+			"ks1.orders":  "5bc52802de2511e6a6b5d13f3c2b2a1a",
+			"ks2.secrets": "7a1f3c40de2611e6a6b5d13f3c2b2a1a",
+		}))
+		Ω(liveTableIDs(&CassandraInfo{})).Should(HaveKeyWithValue("ks1.orders", "9e2a6f101b7c11e78f3e2b6c1d0e4f5a"))
+	})
+
+	It("records the table IDs in the manifest, along with encryption facts", func() {
+		Ω(checkEncryption(&CassandraInfo{Config: "test/cassandra.yaml"}, baseDir)).Should(Succeed())
+		ids, err := snapshotTableIDs(dataDir, SnapshotName, []string{"ks1", "ks2"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(recordTableIDs(baseDir, ids)).Should(Succeed())
+
+		manifest, err := readManifest(baseDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(manifest.EncryptedTables).Should(Equal([]string{"ks2.secrets"}))
+		Ω(manifest.TableIDs).Should(Equal(ids))
+	})
+
+	It("accepts tables that were recreated since the backup", func() {
+		ids, err := snapshotTableIDs(dataDir, SnapshotName, []string{"ks1", "ks2"})
+		Ω(err).ShouldNot(HaveOccurred())
+		manifest := &Manifest{TableIDs: ids}
+		Ω(checkLiveTables(&CassandraInfo{}, baseDir, []string{"ks1", "ks2"}, manifest)).Should(Succeed())
+		Ω(checkLiveTables(&CassandraInfo{}, baseDir, []string{"ks1"}, nil)).Should(Succeed())
+	})
+
+	It("fails on tables that do not exist in the cluster", func() {
+		Ω(os.Mkdir(filepath.Join(baseDir, "ks1", "invoices"), 0755)).Should(Succeed())
+		err := checkLiveTables(&CassandraInfo{}, baseDir, []string{"ks1", "ks2"}, nil)
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(HavePrefix("tables of the archive do not exist in the cluster: ks1.invoices;"))
+	})
+
+	It("does not check anything when the live schema can't be queried", func() {
+		output = []byte("")
+		Ω(os.Mkdir(filepath.Join(baseDir, "ks1", "invoices"), 0755)).Should(Succeed())
+		Ω(checkLiveTables(&CassandraInfo{}, baseDir, []string{"ks1"}, nil)).Should(Succeed())
+	})
+})
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Keyspace size limit
+//
+// When `cassandra_max_keyspace_bytes` is set, the keyspaces whose snapshot
+// holds more than that many bytes of SSTable files (not counting the
+// components left out by `cassandra_skip_components`) are left out of the
+// backup, with a warning, e.g. for a separate process to dump them in full.
+// They are listed in `shield-manifest.yml`, with their size, so that what
+// the archive is missing is on record.
+
+// keyspaceBytes returns how many bytes of SSTable files the given snapshot
+// of the tables of a keyspace holds, as they would be staged.
+func keyspaceBytes(dataDir, keyspace, snapshot string, skip []string) (int64, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(dataDir, keyspace))
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for _, tableDirInfo := range entries {
+		if !isTableDir(tableDirInfo) {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(dataDir, keyspace, tableDirInfo.Name(), "snapshots", snapshot))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		for _, file := range files {
+			if file.Mode().IsRegular() && !skipComponent(file.Name(), skip) {
+				n += file.Size()
+			}
+		}
+	}
+	return n, nil
+}
+
+// recordSkippedKeyspaces lists the keyspaces that were left out of the
+// backup for their size into the manifest file, at the root of baseDir.
+func recordSkippedKeyspaces(baseDir string, skipped map[string]int64) error {
+	manifest, err := readManifest(baseDir)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		manifest = &Manifest{}
+	}
+	manifest.SkippedKeyspaces = skipped
+
+	b, err := yaml.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(baseDir, ManifestFile)
+	plugin.DEBUG("Writing manifest file '%s'", path)
+	return plugin.WriteStagingFile(path, b, 0644)
+}
+
+// skippedNames returns the names of the skipped keyspaces, sorted.
+func skippedNames(skipped map[string]int64) []string {
+	names := []string{}
+	for keyspace := range skipped {
+		names = append(names, keyspace)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Keyspace Size Limit", func() {
+	var (
+		tmp, dataDir, baseDir string
+		cassandra             *CassandraInfo
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-cassandra-")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		dataDir = filepath.Join(tmp, "data")
+		baseDir = filepath.Join(tmp, "backup")
+		Ω(copyTree("test/fixtures", dataDir)).Should(Succeed())
+		Ω(os.MkdirAll(baseDir, 0755)).Should(Succeed())
+		cassandra = &CassandraInfo{DataDir: dataDir, SkipComponents: DefaultSkipComponents}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	It("sizes the snapshot of keyspaces as it would be staged", func() {
+		n, err := keyspaceBytes(dataDir, "ks1", SnapshotName, DefaultSkipComponents)
+		Ω(err).ShouldNot(HaveOccurred())
+		/* the temporary components and the stray ks1/snapshots are left out */
+		Ω(n).Should(Equal(int64(25 + 30 + 26 + 31 + 25)))
+
+		n, err = keyspaceBytes(dataDir, "ks2", SnapshotName, DefaultSkipComponents)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(n).Should(Equal(int64(57 + 25)))
+	})
+
+	It("leaves the keyspaces over the limit out of the backup", func() {
+		cassandra.MaxKeyspaceBytes = 100
+		backedUp, skipped, err := stageKeyspaces(cassandra, nil, []string{"ks1", "ks2"}, baseDir, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(backedUp).Should(Equal([]string{"ks2"}))
+		Ω(skipped).Should(Equal(map[string]int64{"ks1": 137}))
+		Ω(listDir(baseDir)).Should(Equal([]string{"ks2"}))
+
+		Ω(recordSkippedKeyspaces(baseDir, skipped)).Should(Succeed())
+		manifest, err := readManifest(baseDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(manifest.SkippedKeyspaces).Should(Equal(map[string]int64{"ks1": 137}))
+	})
+
+	It("backs up keyspaces of any size by default", func() {
+		backedUp, skipped, err := stageKeyspaces(cassandra, nil, []string{"ks1", "ks2"}, baseDir, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(backedUp).Should(Equal([]string{"ks1", "ks2"}))
+		Ω(skipped).Should(BeEmpty())
+	})
+})
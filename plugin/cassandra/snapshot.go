@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Nodetool timeouts
+//
+// On a heavily loaded node, `nodetool snapshot` (which flushes the memtables
+// first) can hang for a long time, and the backup with it.  When
+// `cassandra_nodetool_timeout` is set, the nodetool commands that take and
+// clear the snapshot are killed once they ran for that many seconds, and the
+// backup fails with a message that tells the timeout apart from other
+// failures.  The partial snapshot is then cleared, even when
+// `cassandra_keep_snapshot` is true, since nothing useful can be learned
+// from it.
+//
+// A snapshot that a previous run failed to fully clear makes `nodetool
+// snapshot` fail with "Snapshot shield-backup already exists."; the snapshot
+// is then cleared, and taken again, once.
+
+// snapshotExistsRegexp matches what nodetool says when the snapshot it is
+// asked to take already exists.
+var snapshotExistsRegexp = regexp.MustCompile(`(?i)snapshot .*already exists`)
+
+// snapshotExists tells whether a nodetool command failed because the
+// snapshot already exists.
+func snapshotExists(err error) bool {
+	e, ok := err.(plugin.ExecError)
+	return ok && snapshotExistsRegexp.MatchString(e.Stderr)
+}
+
+// nodetool runs a nodetool command line, within the configured timeout.
+func nodetool(cassandra *CassandraInfo, cmd string) error {
+	plugin.DEBUG("Executing: `%s`", cmd)
+	return plugin.ExecWithOptions(plugin.ExecOptions{
+		Cmd:     cmd,
+		Stdin:   os.Stdin,
+		Stderr:  os.Stderr,
+		Timeout: time.Duration(cassandra.NodetoolTimeout) * time.Second,
+	})
+}
+
+// clearSnapshot clears the backup snapshot.
+func clearSnapshot(cassandra *CassandraInfo) error {
+	return nodetool(cassandra, fmt.Sprintf("%s/nodetool clearsnapshot -t %s", cassandra.BinDir, cassandra.snapshotName()))
+}
+
+// releaseSnapshot clears the backup snapshot once the backup is over (`err`
+// is how it ended), unless the next backup resumes from it, it is kept as a
+// generation, or `cassandra_keep_snapshot` asks to keep it.
+func releaseSnapshot(cassandra *CassandraInfo, snapshotted bool, err error) {
+	if cassandra.Resume && snapshotted && err != nil {
+		plugin.Fprintf(os.Stderr, "@Y{Keeping the '%s' snapshot and the staged keyspaces, for the next backup to resume from,}\n", cassandra.snapshotName())
+		plugin.Fprintf(os.Stderr, "@Y{within %d hours of the snapshot.}\n", cassandra.ResumeMaxAge)
+		return
+	}
+	if cassandra.SnapshotGenerations > 0 && snapshotted && err == nil {
+		if err := keepGeneration(cassandra); err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Clear expired snapshots}  %s\n", err)
+		}
+		return
+	}
+	if cassandra.KeepSnapshot && snapshotted {
+		plugin.Fprintf(os.Stderr, "@Y{Keeping the '%s' snapshot, as requested; its disk space will not be reclaimed until}\n", cassandra.snapshotName())
+		plugin.Fprintf(os.Stderr, "@Y{you run `nodetool clearsnapshot -t %s` on this node.}\n", cassandra.snapshotName())
+		return
+	}
+	plugin.DEBUG("Clearing snapshot '%s'", cassandra.snapshotName())
+	if err := clearSnapshot(cassandra); err != nil {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Clear snapshot}\n")
+		return
+	}
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Clear snapshot}\n")
+}
+
+// takeSnapshot takes the backup snapshot, with the commands that
+// snapshotCommands() returns.  When the snapshot already exists, it is
+// cleared and all the commands are run again, once: clearing it throws away
+// what the previous commands snapshotted too.
+func takeSnapshot(cassandra *CassandraInfo, savedKeyspaces []string) error {
+	plugin.DEBUG("Creating a new '%s' snapshot", cassandra.snapshotName())
+	err := runSnapshotCommands(cassandra, savedKeyspaces)
+	if snapshotExists(err) {
+		plugin.Fprintf(os.Stderr, "@Y{Snapshot '%s' already exists, left behind by a previous run; clearing it and trying again}\n", cassandra.snapshotName())
+		if err = clearSnapshot(cassandra); err == nil {
+			err = runSnapshotCommands(cassandra, savedKeyspaces)
+		}
+	}
+	if _, ok := err.(plugin.ExecTimeoutError); ok {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Create new snapshot}  timed out after %ds\n", cassandra.NodetoolTimeout)
+		plugin.Fprintf(os.Stderr, "@Y{The node may be overloaded; raise cassandra_nodetool_timeout if snapshots are just slow.}\n")
+		return err
+	}
+	if err != nil {
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Create new snapshot}\n")
+		return err
+	}
+	if cassandra.SkipFlush {
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Create new snapshot}  @Y{without flushing memtables}\n")
+		return nil
+	}
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Create new snapshot}\n")
+	return nil
+}
+
+// runSnapshotCommands runs the commands that take the backup snapshot, and
+// stops at the first one that fails.
+func runSnapshotCommands(cassandra *CassandraInfo, savedKeyspaces []string) error {
+	for _, cmd := range snapshotCommands(cassandra, savedKeyspaces) {
+		if err := nodetool(cassandra, cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("Stale Snapshots", func() {
+	var bindir string
+
+	BeforeEach(func() {
+		var err error
+		bindir, err = ioutil.TempDir("", "nodetool")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(bindir)
+	})
+
+	/* a nodetool that logs what it is asked, and fails the first `exists`
+	   snapshots as if a previous one was still there */
+	fake := func(exists int) {
+		script := "#!/bin/sh\n" +
+			"echo \"$@\" >> " + filepath.Join(bindir, "calls") + "\n" +
+			"if [ \"$1\" = snapshot ] && [ $(grep -c ^snapshot " + filepath.Join(bindir, "calls") + ") -le " + strconv.Itoa(exists) + " ]; then\n" +
+			"  echo 'error: Snapshot shield-backup already exists.' >&2\n" +
+			"  echo '-- StackTrace --' >&2\n" +
+			"  exit 2\n" +
+			"fi\n"
+		Ω(ioutil.WriteFile(filepath.Join(bindir, "nodetool"), []byte(script), 0755)).Should(Succeed())
+	}
+
+	It("clears the snapshot and takes it again when it already exists", func() {
+		fake(1)
+		cassandra := &CassandraInfo{BinDir: bindir, IncludeTables: map[string][]string{"ks1": {"t1", "t2"}}}
+
+		Ω(takeSnapshot(cassandra, []string{"ks1"})).Should(Succeed())
+		Ω(ioutil.ReadFile(filepath.Join(bindir, "calls"))).Should(Equal([]byte(
+			"snapshot -t shield-backup -cf t1 ks1\n" +
+				"clearsnapshot -t shield-backup\n" +
+				"snapshot -t shield-backup -cf t1 ks1\n" +
+				"snapshot -t shield-backup -cf t2 ks1\n")))
+	})
+
+	It("only tries again once", func() {
+		fake(2)
+		cassandra := &CassandraInfo{BinDir: bindir}
+
+		err := takeSnapshot(cassandra, []string{"ks1"})
+		Ω(err).Should(HaveOccurred())
+		Ω(snapshotExists(err)).Should(BeTrue())
+		Ω(ioutil.ReadFile(filepath.Join(bindir, "calls"))).Should(Equal([]byte(
+			"snapshot -t shield-backup ks1\n" +
+				"clearsnapshot -t shield-backup\n" +
+				"snapshot -t shield-backup ks1\n")))
+	})
+
+	It("does not mistake other failures for a stale snapshot", func() {
+		Ω(snapshotExists(plugin.ExecError{Cmd: "nodetool", RC: 1, Stderr: "nodetool: Failed to connect to '127.0.0.1:7199'"})).Should(BeFalse())
+		Ω(snapshotExists(plugin.ExecTimeoutError{Cmd: "nodetool"})).Should(BeFalse())
+		Ω(snapshotExists(nil)).Should(BeFalse())
+	})
+})
+
+var _ = Describe("Nodetool Timeouts", func() {
+	var bindir string
+	var grace time.Duration
+
+	BeforeEach(func() {
+		var err error
+		bindir, err = ioutil.TempDir("", "nodetool")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		/* a nodetool that hangs on snapshots, and logs what it is asked */
+		script := "#!/bin/sh\n" +
+			"echo \"$@\" >> " + filepath.Join(bindir, "calls") + "\n" +
+			"if [ \"$1\" = snapshot ]; then sleep 30; fi\n"
+		Ω(ioutil.WriteFile(filepath.Join(bindir, "nodetool"), []byte(script), 0755)).Should(Succeed())
+
+		grace = plugin.ExecKillGrace
+		plugin.ExecKillGrace = time.Second
+	})
+
+	AfterEach(func() {
+		plugin.ExecKillGrace = grace
+		os.RemoveAll(bindir)
+	})
+
+	It("gives up on snapshots that take longer than the timeout", func() {
+		cassandra := &CassandraInfo{BinDir: bindir, NodetoolTimeout: 1}
+
+		started := time.Now()
+		err := takeSnapshot(cassandra, []string{"ks1"})
+		Ω(time.Since(started)).Should(BeNumerically("<", 10*time.Second))
+		Ω(err).Should(HaveOccurred())
+		Ω(err).Should(BeAssignableToTypeOf(plugin.ExecTimeoutError{}))
+
+		Ω(clearSnapshot(cassandra)).Should(Succeed())
+		Ω(ioutil.ReadFile(filepath.Join(bindir, "calls"))).Should(Equal([]byte(
+			"snapshot -t shield-backup ks1\n" +
+				"clearsnapshot -t shield-backup\n")))
+	})
+})
+
+var _ = Describe("Releasing the Snapshot", func() {
+	var (
+		fake   *plugin.FakeExec
+		stderr *os.File
+		saved  *os.File
+	)
+
+	BeforeEach(func() {
+		fake = plugin.NewFakeExec()
+		var err error
+		stderr, err = ioutil.TempFile("", "shield-cassandra-stderr-")
+		Ω(err).ShouldNot(HaveOccurred())
+		saved, os.Stderr = os.Stderr, stderr
+	})
+
+	AfterEach(func() {
+		os.Stderr = saved
+		stderr.Close()
+		os.Remove(stderr.Name())
+		fake.Restore()
+	})
+
+	printed := func() string {
+		b, err := ioutil.ReadFile(stderr.Name())
+		Ω(err).ShouldNot(HaveOccurred())
+		return string(b)
+	}
+
+	It("clears the snapshot after the backup, by default", func() {
+		releaseSnapshot(&CassandraInfo{BinDir: "/bin"}, true, nil)
+		Ω(fake.Commands()).Should(Equal([]string{`/bin/nodetool clearsnapshot -t shield-backup`}))
+		Ω(printed()).Should(ContainSubstring("Clear snapshot"))
+		Ω(printed()).ShouldNot(ContainSubstring("Keeping"))
+	})
+
+	It("keeps the snapshot with cassandra_keep_snapshot, and warns about its disk space", func() {
+		releaseSnapshot(&CassandraInfo{BinDir: "/bin", KeepSnapshot: true}, true, nil)
+		Ω(fake.Commands()).ShouldNot(ContainElement(ContainSubstring("clearsnapshot")))
+		Ω(printed()).Should(ContainSubstring("Keeping the 'shield-backup' snapshot, as requested; its disk space will not be reclaimed until"))
+		Ω(printed()).Should(ContainSubstring("you run `nodetool clearsnapshot -t shield-backup` on this node."))
+	})
+
+	It("keeps the snapshot with cassandra_keep_snapshot, even when the backup failed", func() {
+		releaseSnapshot(&CassandraInfo{BinDir: "/bin", KeepSnapshot: true}, true, fmt.Errorf("tar failed"))
+		Ω(fake.Commands()).Should(BeEmpty())
+		Ω(printed()).Should(ContainSubstring("its disk space will not be reclaimed"))
+	})
+
+	It("clears what a failed snapshot left behind, whatever cassandra_keep_snapshot says", func() {
+		releaseSnapshot(&CassandraInfo{BinDir: "/bin", KeepSnapshot: true}, false, fmt.Errorf("snapshot failed"))
+		Ω(fake.Commands()).Should(Equal([]string{`/bin/nodetool clearsnapshot -t shield-backup`}))
+		Ω(printed()).ShouldNot(ContainSubstring("disk space"))
+	})
+})
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Per-keyspace archives
+//
+// When `cassandra_split_keyspaces` is true, the backup is not one tar
+// archive: each keyspace directory is archived on its own (along with one
+// more archive for the files at the root of the backup: schema, users,
+// manifest...), and each archive is stored as a separate object, with the
+// storage plugin configured in `cassandra_chunk_store`.  What SHIELD gets
+// (and stores with the storage of the job) is a small JSON manifest, that
+// maps each archive to its object:
+//
+//    {
+//      "format"   : "shield-cassandra-split/1",
+//      "size"     : 1610612736,
+//      "archives" : [
+//        { "name": ".",   "key": "...", "size": 20480,      "sha256": "..." },
+//        { "name": "ks1", "key": "...", "size": 1073741824, "sha256": "..." },
+//        { "name": "ks2", "key": "...", "size": 536850432,  "sha256": "..." }
+//      ]
+//    }
+//
+// The names are those of the directories at the root of the backup (under
+// `cassandra_archive_root`, if set): keyspaces, and the commit logs, if
+// any.  "." is the archive of the files at the root, which every restore
+// needs.  The keys are the ones the chunk store returned for the objects;
+// each object is a plain tar archive, rooted like the whole archive would
+// be.
+//
+// The contract with the chunk store is the one of chunked backups: objects
+// are stored with `store`, read back with `retrieve -k <key>`, and purged
+// with `purge -k <key>` when the backup fails half-way.  They are not known
+// to SHIELD, which only ever sees the manifest.
+//
+// On restore, when the archive read from standard input is such a manifest,
+// only the objects of the keyspaces to restore (as set by
+// `cassandra_include_keyspaces` and `cassandra_exclude_keyspaces`) are
+// retrieved, along with the root one, and checked against their size and
+// SHA-256.  They are extracted as the streams of a multiplexed archive (see
+// mux.go), each with its own `tar`.  Restores refuse manifests whose format
+// they do not know: a later version of the format gets a new number.
+
+const SplitManifestFormat = "shield-cassandra-split/1"
+
+type SplitArchive struct {
+	Name   string `json:"name"`
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type SplitManifest struct {
+	Format   string         `json:"format"`
+	Size     int64          `json:"size"`
+	Archives []SplitArchive `json:"archives"`
+}
+
+// storeSplitArchive runs `tar -c` for the given entries of baseDir, and
+// stores its output as a single object.
+func storeSplitArchive(cassandra *CassandraInfo, baseDir string, entries []string) (SplitArchive, error) {
+	cmd := fmt.Sprintf("%s -c -C %s -f -", cassandra.Tar, baseDir)
+	for _, entry := range entries {
+		cmd = fmt.Sprintf("%s \"%s\"", cmd, entry)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return SplitArchive{}, err
+	}
+	errs := make(chan error, 1)
+	go func() {
+		plugin.DEBUG("Executing `%s`", cmd)
+		err := plugin.ExecWithOptions(plugin.ExecOptions{Cmd: cmd, Stdout: w, ExpectRC: []int{0}})
+		w.Close()
+		errs <- err
+	}()
+
+	digest := newChunkDigest()
+	key, err := storeChunk(*cassandra.ChunkStore, io.TeeReader(r, digest))
+	/* a failing chunk store must not leave tar hanging */
+	r.Close()
+	if terr := <-errs; terr != nil && err == nil {
+		/* what was stored is only part of the archive */
+		if perr := purgeChunk(*cassandra.ChunkStore, key); perr != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Purge %s}  %s\n", key, perr)
+		}
+		err = terr
+	}
+	if err != nil {
+		return SplitArchive{}, err
+	}
+	return SplitArchive{Key: key, Size: digest.size, SHA256: digest.sum()}, nil
+}
+
+// storeSplit stores one archive per keyspace of baseDir (and one for the
+// files at its root), up to `cassandra_tar_jobs` at a time, and returns the
+// manifest.  When any of them fails, those that were stored are purged.
+func storeSplit(cassandra *CassandraInfo, baseDir string) (*SplitManifest, error) {
+	names, contents, err := muxStreams(baseDir, cassandra.ArchiveRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	archives := make([]SplitArchive, len(names))
+	errs := make([]error, len(names))
+	jobs := make(chan struct{}, cassandra.TarJobs)
+	var wg sync.WaitGroup
+	for i := range names {
+		wg.Add(1)
+		jobs <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			archives[i], errs[i] = storeSplitArchive(cassandra, baseDir, contents[i])
+			archives[i].Name = names[i]
+			if errs[i] != nil {
+				plugin.Fprintf(os.Stderr, "@R{\u2717 Store the archive of '%s'}  %s\n", names[i], errs[i])
+			} else {
+				plugin.Fprintf(os.Stderr, "@G{\u2713 Store the archive of '%s'}  @C{%s} (%d bytes)\n", names[i], archives[i].Key, archives[i].Size)
+			}
+			<-jobs
+		}(i)
+	}
+	wg.Wait()
+
+	manifest := &SplitManifest{Format: SplitManifestFormat, Archives: []SplitArchive{}}
+	for i := range names {
+		if errs[i] != nil && err == nil {
+			err = fmt.Errorf("archiving '%s' failed: %s", names[i], errs[i])
+		}
+		if archives[i].Key != "" {
+			manifest.Archives = append(manifest.Archives, archives[i])
+			manifest.Size += archives[i].Size
+		}
+	}
+
+	if err != nil {
+		manifest.purge(*cassandra.ChunkStore)
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// splitArchive stores the per-keyspace archives of baseDir, and prints the
+// manifest on standard output.
+func splitArchive(cassandra *CassandraInfo, baseDir string) error {
+	manifest, err := storeSplit(cassandra, baseDir)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		manifest.purge(*cassandra.ChunkStore)
+		return err
+	}
+	fmt.Printf("%s\n", b)
+	plugin.Fprintf(os.Stderr, "@G{\u2713 Store per-keyspace archives}  %d archives, %d bytes\n", len(manifest.Archives), manifest.Size)
+	return nil
+}
+
+// purge removes the archives of the manifest from the chunk store.
+func (m *SplitManifest) purge(store ChunkStore) {
+	for _, archive := range m.Archives {
+		if err := purgeChunk(store, archive.Key); err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Purge the archive of '%s'}  %s: %s\n", archive.Name, archive.Key, err)
+			continue
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Purge the archive of '%s'}  @C{%s}\n", archive.Name, archive.Key)
+	}
+}
+
+// check makes sure the manifest is one this plugin knows how to restore.
+func (m *SplitManifest) check() error {
+	if m.Format != SplitManifestFormat {
+		return fmt.Errorf("unsupported split manifest format '%s'", m.Format)
+	}
+	var size int64
+	seen := map[string]bool{}
+	for _, archive := range m.Archives {
+		if archive.Name == "" || seen[archive.Name] {
+			return fmt.Errorf("split manifest lists the archive of '%s' more than once, or without a name", archive.Name)
+		}
+		seen[archive.Name] = true
+		size += archive.Size
+	}
+	if size != m.Size {
+		return fmt.Errorf("archives of the split manifest add up to %d bytes, instead of %d", size, m.Size)
+	}
+	return nil
+}
+
+// restoredArchives returns the archives of the manifest that the restore
+// needs: the root one, the commit logs, and those of the keyspaces that pass
+// the include and exclude lists.
+func restoredArchives(cassandra *CassandraInfo, m *SplitManifest) []SplitArchive {
+	sort.Strings(cassandra.ExcludeKeyspaces)
+	savedKeyspaces := computeSavedKeyspaces(cassandra.IncludeKeyspaces, cassandra.ExcludeKeyspaces)
+
+	archives := []SplitArchive{}
+	for _, archive := range m.Archives {
+		if archive.Name != "." && archive.Name != CommitlogDir && !keyspaceSaved(cassandra, savedKeyspaces, archive.Name) {
+			plugin.DEBUG("Not retrieving the archive of keyspace '%s'", archive.Name)
+			continue
+		}
+		archives = append(archives, archive)
+	}
+	return archives
+}
+
+// muxFrameWriter writes what it is given as frames of a stream of a
+// multiplexed archive.
+type muxFrameWriter struct {
+	w      io.Writer
+	stream int
+}
+
+func (f *muxFrameWriter) Write(b []byte) (int, error) {
+	for n := 0; n < len(b); n += MuxFrameSize {
+		end := n + MuxFrameSize
+		if end > len(b) {
+			end = len(b)
+		}
+		if err := writeMuxFrame(f.w, f.stream, b[n:end]); err != nil {
+			return n, err
+		}
+	}
+	return len(b), nil
+}
+
+// retrieveSplit writes the archives of the manifest that the restore needs
+// to `out`, as the streams of a multiplexed archive, checking each one on
+// the way.
+func retrieveSplit(cassandra *CassandraInfo, m *SplitManifest, out io.Writer) error {
+	if err := m.check(); err != nil {
+		return err
+	}
+	archives := restoredArchives(cassandra, m)
+	names := []string{}
+	for _, archive := range archives {
+		names = append(names, archive.Name)
+	}
+
+	b, err := json.Marshal(MuxIndex{Format: MuxArchiveFormat, Streams: names})
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	if _, err = w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	for i, archive := range archives {
+		digest := newChunkDigest()
+		err := retrieveChunk(*cassandra.ChunkStore, archive.Key, io.MultiWriter(&muxFrameWriter{w: w, stream: i}, digest))
+		if err == nil && (digest.size != archive.Size || digest.sum() != archive.SHA256) {
+			err = fmt.Errorf("the archive of '%s' (%s) is corrupted: got %d bytes with SHA-256 %s, expected %d bytes with SHA-256 %s",
+				archive.Name, archive.Key, digest.size, digest.sum(), archive.Size, archive.SHA256)
+		}
+		if err == nil {
+			err = writeMuxFrame(w, i, nil)
+		}
+		if err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Retrieve the archive of '%s'}  %s\n", archive.Name, err)
+			return err
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Retrieve the archive of '%s'}  %d bytes\n", archive.Name, archive.Size)
+	}
+	return w.Flush()
+}
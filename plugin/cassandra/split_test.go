@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Per-Keyspace Archives", func() {
+	var (
+		tmp, baseDir string
+		store        ChunkStore
+		cassandra    *CassandraInfo
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-cassandra-split-")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(os.Mkdir(filepath.Join(tmp, "chunks"), 0755)).Should(Succeed())
+		Ω(os.Mkdir(filepath.Join(tmp, "restore"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "store"), []byte(chunkStore), 0755)).Should(Succeed())
+		store = ChunkStore{Plugin: filepath.Join(tmp, "store")}
+		cassandra = &CassandraInfo{Tar: "tar", TarJobs: 1, ChunkStore: &store}
+
+		baseDir = filepath.Join(tmp, "backup")
+		for _, ks := range []string{"ks1", "ks2"} {
+			Ω(os.MkdirAll(filepath.Join(baseDir, ks, "t1"), 0755)).Should(Succeed())
+			Ω(ioutil.WriteFile(filepath.Join(baseDir, ks, "t1", "nb-1-big-Data.db"), []byte(ks+" data"), 0644)).Should(Succeed())
+		}
+		Ω(ioutil.WriteFile(filepath.Join(baseDir, "schema.cql"), []byte("CREATE KEYSPACE ks1 ..."), 0644)).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	restore := func(manifest *SplitManifest) error {
+		b, err := json.Marshal(manifest)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "archive"), b, 0644)).Should(Succeed())
+
+		stdin := os.Stdin
+		defer func() { os.Stdin = stdin }()
+		os.Stdin, err = os.Open(filepath.Join(tmp, "archive"))
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.Stdin.Close()
+		return extractArchive(cassandra, filepath.Join(tmp, "restore"))
+	}
+
+	restored := func(path string) string {
+		b, err := ioutil.ReadFile(filepath.Join(tmp, "restore", path))
+		if os.IsNotExist(err) {
+			return ""
+		}
+		Ω(err).ShouldNot(HaveOccurred())
+		return string(b)
+	}
+
+	It("stores each keyspace as its own object, and restores them all", func() {
+		manifest, err := storeSplit(cassandra, baseDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(manifest.Format).Should(Equal(SplitManifestFormat))
+		Ω(manifest.Archives).Should(HaveLen(3))
+		for i, name := range []string{".", "ks1", "ks2"} {
+			Ω(manifest.Archives[i].Name).Should(Equal(name))
+			Ω(manifest.Archives[i].Key).ShouldNot(BeEmpty())
+		}
+
+		Ω(restore(manifest)).Should(Succeed())
+		Ω(restored("schema.cql")).Should(Equal("CREATE KEYSPACE ks1 ..."))
+		Ω(restored("ks1/t1/nb-1-big-Data.db")).Should(Equal("ks1 data"))
+		Ω(restored("ks2/t1/nb-1-big-Data.db")).Should(Equal("ks2 data"))
+	})
+
+	It("only retrieves the archives of the keyspaces to restore", func() {
+		manifest, err := storeSplit(cassandra, baseDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		/* ks1 can't be retrieved anymore, which must not matter */
+		Ω(os.Remove(filepath.Join(tmp, "chunks", manifest.Archives[1].Key))).Should(Succeed())
+
+		cassandra.IncludeKeyspaces = []string{"ks2"}
+		Ω(restore(manifest)).Should(Succeed())
+		Ω(restored("schema.cql")).ShouldNot(BeEmpty())
+		Ω(restored("ks1/t1/nb-1-big-Data.db")).Should(BeEmpty())
+		Ω(restored("ks2/t1/nb-1-big-Data.db")).Should(Equal("ks2 data"))
+	})
+
+	It("purges the archives it stored when one fails", func() {
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "fail-3"), nil, 0644)).Should(Succeed())
+		_, err := storeSplit(cassandra, baseDir)
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(HavePrefix("archiving 'ks2' failed"))
+		Ω(ioutil.ReadDir(filepath.Join(tmp, "chunks"))).Should(BeEmpty())
+	})
+
+	It("detects corrupted archives, and unknown formats", func() {
+		manifest, err := storeSplit(cassandra, baseDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		manifest.Archives[2].SHA256 = manifest.Archives[1].SHA256
+		Ω(restore(manifest)).Should(HaveOccurred())
+
+		manifest.Format = "shield-cassandra-split/2"
+		Ω(retrieveSplit(cassandra, manifest, ioutil.Discard)).Should(MatchError("unsupported split manifest format 'shield-cassandra-split/2'"))
+	})
+
+	It("requires a chunk store, without chunks nor dedup", func() {
+		endpoint := map[string]interface{}{
+			"cassandra_split_keyspaces": true,
+		}
+		_, err := cassandraInfo(endpoint)
+		Ω(err).Should(MatchError(ContainSubstring("cassandra_chunk_store is required when cassandra_split_keyspaces is set")))
+
+		endpoint["cassandra_chunk_store"] = map[string]interface{}{"plugin": "fs"}
+		endpoint["cassandra_dedup"] = true
+		_, err = cassandraInfo(endpoint)
+		Ω(err).Should(MatchError(ContainSubstring("can't be combined")))
+	})
+})
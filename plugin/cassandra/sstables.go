@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// SSTable format versions
+//
+// The name of each SSTable file starts with the version of the format it was
+// written in: `ka` (Cassandra 2.1), `la` (2.2), `ma` to `me` (3.x), `na` and
+// `nb` (4.x), `oa` (5.0), and so on.  Versions sort in the order they were
+// introduced.  The versions found in each table of the backup are recorded
+// into the manifest.
+//
+// Once a cluster is upgraded, `sstableloader` still streams older SSTables
+// of its archives, but they are kept in their older format, until they are
+// compacted away, or rewritten by `nodetool upgradesstables`.  On restore,
+// when the archive holds SSTables that are older than the newest format
+// found in the data directory of the node, a warning tells so, and when
+// `cassandra_upgrade_sstables` is true, `nodetool upgradesstables` is run for
+// the keyspaces that hold them, once they are loaded.
+
+// sstableFormatRegexp matches the Data component of SSTables, and captures
+// the version of their format, for the current naming (`nb-1-big-Data.db`,
+// `oa-3fw2_0ix2_...-bti-Data.db`) and the one before Cassandra 2.2
+// (`ks-table-ka-1-Data.db`).
+var sstableFormatRegexp = regexp.MustCompile(`(?:^|-)([a-z]{2})-[0-9a-z_]+-(?:[a-z]+-)?Data\.db$`)
+
+// sstableFormat returns the format version of an SSTable, from the name of
+// one of its files.
+func sstableFormat(name string) (string, bool) {
+	m := sstableFormatRegexp.FindStringSubmatch(name)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// dirFormats lists the format versions of the SSTables of a directory.
+func dirFormats(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*-Data.db"))
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	formats := []string{}
+	for _, file := range files {
+		if format, ok := sstableFormat(filepath.Base(file)); ok && !seen[format] {
+			seen[format] = true
+			formats = append(formats, format)
+		}
+	}
+	sort.Strings(formats)
+	return formats, nil
+}
+
+// archivedFormats lists the format versions of the SSTables of each table
+// of the given keyspaces of an archive, by "keyspace.table".
+func archivedFormats(baseDir string, keyspaces []string) (map[string][]string, error) {
+	tables, err := archivedTables(baseDir, keyspaces)
+	if err != nil {
+		return nil, err
+	}
+	formats := map[string][]string{}
+	for _, table := range tables {
+		parts := strings.SplitN(table, ".", 2)
+		f, err := dirFormats(filepath.Join(baseDir, parts[0], parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		if len(f) > 0 {
+			formats[table] = f
+		}
+	}
+	return formats, nil
+}
+
+// recordSSTableFormats records the format versions of the SSTables of the
+// backup into its manifest.
+func recordSSTableFormats(baseDir string, keyspaces []string) error {
+	formats, err := archivedFormats(baseDir, keyspaces)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := readManifest(baseDir)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		manifest = &Manifest{}
+	}
+	manifest.SSTableFormats = formats
+
+	b, err := yaml.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(baseDir, ManifestFile)
+	plugin.DEBUG("Writing manifest file '%s'", path)
+	return plugin.WriteStagingFile(path, b, 0644)
+}
+
+// nodeFormat returns the newest format version of the SSTables of the data
+// directory of the node, or "" when there are none.
+func nodeFormat(dataDir string) (string, error) {
+	tableDirs, err := filepath.Glob(filepath.Join(dataDir, "*", "*"))
+	if err != nil {
+		return "", err
+	}
+	newest := ""
+	for _, dir := range tableDirs {
+		if info, err := os.Stat(dir); err != nil || !isTableDir(info) {
+			continue
+		}
+		formats, err := dirFormats(dir)
+		if err != nil {
+			return "", err
+		}
+		if len(formats) > 0 && formats[len(formats)-1] > newest {
+			newest = formats[len(formats)-1]
+		}
+	}
+	return newest, nil
+}
+
+// outdatedKeyspaces lists the keyspaces that hold SSTables in a format older
+// than `format`, with the formats of their tables (see archivedFormats).
+func outdatedKeyspaces(formats map[string][]string, format string) []string {
+	seen := map[string]bool{}
+	keyspaces := []string{}
+	for table, f := range formats {
+		keyspace := strings.SplitN(table, ".", 2)[0]
+		if len(f) > 0 && f[0] < format && !seen[keyspace] {
+			seen[keyspace] = true
+			keyspaces = append(keyspaces, keyspace)
+		}
+	}
+	sort.Strings(keyspaces)
+	return keyspaces
+}
+
+// upgradeSSTables tells about the restored keyspaces that hold SSTables
+// older than the format of the node, and runs `nodetool upgradesstables`
+// for them, when `cassandra_upgrade_sstables` is true.  When the format of
+// the node can't be told, all the restored keyspaces are upgraded: SSTables
+// that are current already are left alone.  It returns the keyspaces that
+// were upgraded.
+func upgradeSSTables(cassandra *CassandraInfo, baseDir string, keyspaces []string, manifest *Manifest) ([]string, error) {
+	/* archives made before formats were recorded are looked at instead */
+	var (
+		formats map[string][]string
+		err     error
+	)
+	if manifest != nil && manifest.SSTableFormats != nil {
+		formats = manifest.SSTableFormats
+	} else if formats, err = archivedFormats(baseDir, keyspaces); err != nil {
+		return nil, err
+	}
+	restored := map[string][]string{}
+	for _, keyspace := range keyspaces {
+		for table, f := range formats {
+			if strings.HasPrefix(table, keyspace+".") {
+				restored[table] = f
+			}
+		}
+	}
+
+	format, err := nodeFormat(cassandra.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	outdated := keyspaces
+	if format != "" {
+		outdated = outdatedKeyspaces(restored, format)
+	}
+	if len(outdated) == 0 {
+		return nil, nil
+	}
+	if !cassandra.UpgradeSSTables {
+		if format != "" {
+			plugin.Fprintf(os.Stderr, "@Y{Keyspaces %s hold SSTables older than the '%s' format of this node;}\n", strings.Join(outdated, ", "), format)
+			plugin.Fprintf(os.Stderr, "@Y{set cassandra_upgrade_sstables to have them rewritten by `nodetool upgradesstables`}\n")
+		}
+		return nil, nil
+	}
+
+	for _, keyspace := range outdated {
+		cmd := fmt.Sprintf("%s/nodetool upgradesstables %s", cassandra.BinDir, keyspace)
+		plugin.DEBUG("Executing: `%s`", cmd)
+		if err := plugin.Exec(cmd, plugin.STDIN); err != nil {
+			return nil, fmt.Errorf("unable to upgrade the SSTables of keyspace '%s': %s", keyspace, err)
+		}
+	}
+	return outdated, nil
+}
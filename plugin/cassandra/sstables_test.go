@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SSTable Formats", func() {
+	var tmp, dataDir, baseDir, bindir string
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-cassandra-")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		dataDir = filepath.Join(tmp, "data")
+		baseDir = filepath.Join(tmp, "backup")
+		bindir = filepath.Join(tmp, "bin")
+		Ω(copyTree("test/fixtures", filepath.Join(tmp, "fixtures"))).Should(Succeed())
+		Ω(os.MkdirAll(baseDir, 0755)).Should(Succeed())
+		Ω(hardLinkKeyspace(filepath.Join(tmp, "fixtures"), baseDir, "ks1", SnapshotName, DefaultSkipComponents)).Should(Succeed())
+		Ω(hardLinkKeyspace(filepath.Join(tmp, "fixtures"), baseDir, "ks2", SnapshotName, DefaultSkipComponents)).Should(Succeed())
+
+		/* a nodetool that logs what it is asked */
+		Ω(os.MkdirAll(bindir, 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(bindir, "nodetool"),
+			[]byte("#!/bin/sh\necho \"$@\" >> "+filepath.Join(bindir, "calls")+"\n"), 0755)).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	/* the node writes SSTables in the `format` format */
+	node := func(format string) {
+		dir := filepath.Join(dataDir, "system", "local-7ad54392bcdd35a684174e047860b377")
+		Ω(os.MkdirAll(dir, 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(dir, format+"-12-big-Data.db"), []byte("data"), 0644)).Should(Succeed())
+	}
+
+	calls := func() string {
+		b, _ := ioutil.ReadFile(filepath.Join(bindir, "calls"))
+		return string(b)
+	}
+
+	It("reads the format version from the name of SSTables", func() {
+		for name, format := range map[string]string{
+			"mc-1-big-Data.db":                            "mc",
+			"nb-42-big-Data.db":                           "nb",
+			"oa-3fw2_0ix2_2jnv42h3s0m0yxz2h0-bti-Data.db": "oa",
+			"ks1-orders-ka-7-Data.db":                     "ka",
+			"nb-42-big-Index.db":                          "",
+			"mc-tmp-3-big-Data.db":                        "",
+		} {
+			f, ok := sstableFormat(name)
+			Ω(ok).Should(Equal(format != ""), name)
+			Ω(f).Should(Equal(format), name)
+		}
+	})
+
+	It("records the formats of each table in the manifest", func() {
+		Ω(recordSSTableFormats(baseDir, []string{"ks1", "ks2"})).Should(Succeed())
+		manifest, err := readManifest(baseDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(manifest.SSTableFormats).Should(Equal(map[string][]string{
+			"ks1.orders":  {"mc"},
+			"ks2.secrets": {"mc"},
+		}))
+	})
+
+	It("upgrades the keyspaces that hold older SSTables than the node, when asked to", func() {
+		node("nb")
+		manifest := &Manifest{SSTableFormats: map[string][]string{
+			"ks1.orders":  {"mc", "nb"},
+			"ks2.secrets": {"nb"},
+		}}
+		cassandra := &CassandraInfo{BinDir: bindir, DataDir: dataDir, UpgradeSSTables: true}
+
+		Ω(upgradeSSTables(cassandra, baseDir, []string{"ks1", "ks2"}, manifest)).Should(Equal([]string{"ks1"}))
+		Ω(calls()).Should(Equal("upgradesstables ks1\n"))
+	})
+
+	It("only warns about them, otherwise", func() {
+		node("nb")
+		cassandra := &CassandraInfo{BinDir: bindir, DataDir: dataDir}
+
+		Ω(upgradeSSTables(cassandra, baseDir, []string{"ks1", "ks2"}, nil)).Should(BeEmpty())
+		Ω(calls()).Should(BeEmpty())
+	})
+
+	It("leaves archives of the same format alone", func() {
+		node("mc")
+		cassandra := &CassandraInfo{BinDir: bindir, DataDir: dataDir, UpgradeSSTables: true}
+
+		Ω(upgradeSSTables(cassandra, baseDir, []string{"ks1", "ks2"}, nil)).Should(BeEmpty())
+		Ω(calls()).Should(BeEmpty())
+	})
+
+	It("upgrades all the restored keyspaces when the format of the node is unknown", func() {
+		cassandra := &CassandraInfo{BinDir: bindir, DataDir: dataDir, UpgradeSSTables: true}
+
+		Ω(upgradeSSTables(cassandra, baseDir, []string{"ks2"}, nil)).Should(Equal([]string{"ks2"}))
+		Ω(calls()).Should(Equal("upgradesstables ks2\n"))
+	})
+})
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Table scoping
+//
+// When `cassandra_include_tables` lists "keyspace.table" names, only those
+// tables are snapshotted, with one `nodetool snapshot -cf <table>` per table,
+// instead of snapshotting whole keyspaces and leaving most of the snapshot
+// out of the archive, which saves the disk space and the time of flushing
+// and hard-linking the other tables.  The keyspace rules still apply on top
+// of it: tables of excluded keyspaces are not backed up.
+
+// parseIncludeTables groups the "keyspace.table" names of
+// `cassandra_include_tables` by keyspace.  A nil list means all tables.
+func parseIncludeTables(names []string) (map[string][]string, error) {
+	if names == nil {
+		return nil, nil
+	}
+	tables := map[string][]string{}
+	for _, name := range names {
+		parts := strings.Split(name, ".")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("'%s' is not a keyspace.table name", name)
+		}
+		tables[parts[0]] = append(tables[parts[0]], parts[1])
+	}
+	for _, t := range tables {
+		sort.Strings(t)
+	}
+	return tables, nil
+}
+
+// keyspaceSaved tells whether the keyspace passes the include and exclude
+// lists; savedKeyspaces is the result of computeSavedKeyspaces(), and the
+// exclude list must be sorted.
+func keyspaceSaved(cassandra *CassandraInfo, savedKeyspaces []string, keyspace string) bool {
+	if savedKeyspaces == nil {
+		idx := sort.SearchStrings(cassandra.ExcludeKeyspaces, keyspace)
+		return idx >= len(cassandra.ExcludeKeyspaces) || cassandra.ExcludeKeyspaces[idx] != keyspace
+	}
+	idx := sort.SearchStrings(savedKeyspaces, keyspace)
+	return idx < len(savedKeyspaces) && savedKeyspaces[idx] == keyspace
+}
+
+// restoredKeyspaces lists the keyspaces of the archive extracted in baseDir
+// that pass the include and exclude lists, and warns about the included ones
+// that the archive does not hold, neither as data nor as schema.
+func restoredKeyspaces(cassandra *CassandraInfo, savedKeyspaces []string, baseDir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	archived := map[string]bool{}
+	keyspaces := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == CommitlogDir {
+			continue
+		}
+		keyspace := entry.Name()
+		archived[keyspace] = true
+		if !keyspaceSaved(cassandra, savedKeyspaces, keyspace) {
+			plugin.DEBUG("Excluding keyspace '%s'", keyspace)
+			continue
+		}
+		keyspaces = append(keyspaces, keyspace)
+	}
+	schemas, err := archivedSchemas(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, keyspace := range schemas {
+		archived[keyspace] = true
+	}
+
+	for _, keyspace := range savedKeyspaces {
+		if !archived[keyspace] {
+			plugin.Fprintf(os.Stderr, "@Y{Keyspace '%s' is not in the archive; nothing to restore for it}\n", keyspace)
+		}
+	}
+	return keyspaces, nil
+}
+
+// snapshotCommands returns the `nodetool snapshot` commands that take the
+// backup snapshot: one per included table when `cassandra_include_tables`
+// is set, and a single one for the saved keyspaces (or all of them)
+// otherwise.
+func snapshotCommands(cassandra *CassandraInfo, savedKeyspaces []string) []string {
+	nodetool := fmt.Sprintf("%s/nodetool snapshot -t %s", cassandra.BinDir, cassandra.snapshotName())
+	if cassandra.SkipFlush {
+		nodetool += " --skip-flush"
+	}
+	if cassandra.IncludeTables == nil {
+		cmd := nodetool
+		for _, keyspace := range savedKeyspaces {
+			cmd = fmt.Sprintf("%s \"%s\"", cmd, keyspace)
+		}
+		return []string{cmd}
+	}
+
+	keyspaces := []string{}
+	for keyspace := range cassandra.IncludeTables {
+		keyspaces = append(keyspaces, keyspace)
+	}
+	sort.Strings(keyspaces)
+
+	cmds := []string{}
+	for _, keyspace := range keyspaces {
+		if !keyspaceSaved(cassandra, savedKeyspaces, keyspace) {
+			plugin.DEBUG("Not snapshotting the tables of excluded keyspace '%s'", keyspace)
+			continue
+		}
+		for _, table := range cassandra.IncludeTables[keyspace] {
+			cmds = append(cmds, fmt.Sprintf("%s -cf \"%s\" \"%s\"", nodetool, table, keyspace))
+		}
+	}
+	return cmds
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Table Scoping", func() {
+	It("groups the included tables by keyspace", func() {
+		tables, err := parseIncludeTables(nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(tables).Should(BeNil())
+
+		tables, err = parseIncludeTables([]string{"ks1.users", "ks2.events", "ks1.orders"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(tables).Should(Equal(map[string][]string{
+			"ks1": {"orders", "users"},
+			"ks2": {"events"},
+		}))
+
+		for _, name := range []string{"ks1", "ks1.", ".users", "ks1.users.x"} {
+			_, err = parseIncludeTables([]string{name})
+			Ω(err).Should(HaveOccurred(), name)
+		}
+	})
+
+	It("snapshots whole keyspaces when no table is listed", func() {
+		cassandra := &CassandraInfo{BinDir: "/bin"}
+		Ω(snapshotCommands(cassandra, nil)).Should(Equal([]string{
+			`/bin/nodetool snapshot -t shield-backup`,
+		}))
+		Ω(snapshotCommands(cassandra, []string{"ks1", "ks2"})).Should(Equal([]string{
+			`/bin/nodetool snapshot -t shield-backup "ks1" "ks2"`,
+		}))
+	})
+
+	It("skips the flush of memtables, when asked to", func() {
+		cassandra := &CassandraInfo{BinDir: "/bin", SkipFlush: true}
+		Ω(snapshotCommands(cassandra, []string{"ks1"})).Should(Equal([]string{
+			`/bin/nodetool snapshot -t shield-backup --skip-flush "ks1"`,
+		}))
+
+		cassandra.IncludeTables = map[string][]string{"ks1": {"users"}}
+		Ω(snapshotCommands(cassandra, nil)).Should(Equal([]string{
+			`/bin/nodetool snapshot -t shield-backup --skip-flush -cf "users" "ks1"`,
+		}))
+	})
+
+	It("snapshots each listed table of the saved keyspaces", func() {
+		cassandra := &CassandraInfo{
+			BinDir:           "/bin",
+			ExcludeKeyspaces: []string{"system"},
+			IncludeTables: map[string][]string{
+				"ks1":    {"orders", "users"},
+				"ks2":    {"events"},
+				"system": {"peers"},
+			},
+		}
+		Ω(snapshotCommands(cassandra, nil)).Should(Equal([]string{
+			`/bin/nodetool snapshot -t shield-backup -cf "orders" "ks1"`,
+			`/bin/nodetool snapshot -t shield-backup -cf "users" "ks1"`,
+			`/bin/nodetool snapshot -t shield-backup -cf "events" "ks2"`,
+		}))
+		Ω(snapshotCommands(cassandra, []string{"ks2"})).Should(Equal([]string{
+			`/bin/nodetool snapshot -t shield-backup -cf "events" "ks2"`,
+		}))
+
+		cassandra.IncludeTables = map[string][]string{}
+		Ω(snapshotCommands(cassandra, nil)).Should(BeEmpty())
+	})
+})
+
+var _ = Describe("Keyspace Restore", func() {
+	var tmp, baseDir, bindir string
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-cassandra-")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		/* an archive of the whole node, as extracted */
+		baseDir = filepath.Join(tmp, "backup")
+		bindir = filepath.Join(tmp, "bin")
+		Ω(copyTree("test/fixtures", filepath.Join(tmp, "fixtures"))).Should(Succeed())
+		Ω(os.MkdirAll(filepath.Join(baseDir, "system_auth", "roles-5bc52802de2511e6a6b5d13f3c2b2a1b"), 0755)).Should(Succeed())
+		Ω(hardLinkKeyspace(filepath.Join(tmp, "fixtures"), baseDir, "ks1", SnapshotName, DefaultSkipComponents)).Should(Succeed())
+		Ω(hardLinkKeyspace(filepath.Join(tmp, "fixtures"), baseDir, "ks2", SnapshotName, DefaultSkipComponents)).Should(Succeed())
+		Ω(ioutil.WriteFile(schemaFile(baseDir, "ks3"), []byte("CREATE KEYSPACE ks3;\n"), 0644)).Should(Succeed())
+
+		/* an sstableloader that logs what it is asked */
+		Ω(os.MkdirAll(bindir, 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(bindir, "sstableloader"),
+			[]byte("#!/bin/sh\nfor a; do table=$a; done\nbasename \"$table\" >> "+filepath.Join(bindir, "calls")+"\n"), 0755)).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	restore := func(include, exclude []string) ([]string, string) {
+		cassandra := &CassandraInfo{BinDir: bindir, IncludeKeyspaces: include, ExcludeKeyspaces: exclude}
+		sort.Strings(cassandra.ExcludeKeyspaces)
+		keyspaces, err := restoredKeyspaces(cassandra, computeSavedKeyspaces(include, exclude), baseDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		for _, keyspace := range keyspaces {
+			Ω(restoreKeyspace(cassandra, filepath.Join(baseDir, keyspace), nil)).Should(Succeed())
+		}
+		b, _ := ioutil.ReadFile(filepath.Join(bindir, "calls"))
+		return keyspaces, string(b)
+	}
+
+	It("restores all the keyspaces of the archive but the excluded ones", func() {
+		keyspaces, calls := restore(nil, DefaultExcludeKeyspaces)
+		Ω(keyspaces).Should(Equal([]string{"ks1", "ks2"}))
+		Ω(calls).Should(Equal("orders\nsecrets\n"))
+	})
+
+	It("restores a single keyspace out of a multi-keyspace archive", func() {
+		keyspaces, calls := restore([]string{"ks2"}, DefaultExcludeKeyspaces)
+		Ω(keyspaces).Should(Equal([]string{"ks2"}))
+		Ω(calls).Should(Equal("secrets\n"))
+	})
+
+	It("restores nothing for included keyspaces the archive does not hold", func() {
+		keyspaces, calls := restore([]string{"ks3", "ks4"}, nil)
+		Ω(keyspaces).Should(BeEmpty())
+		Ω(calls).Should(BeEmpty())
+	})
+})
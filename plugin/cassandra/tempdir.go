@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Temporary directory
+//
+// Backups hard-link the files of the snapshot into `cassandra_tempdir`
+// before archiving them (so do restores of snapshot generations), which
+// only works when it is on the same filesystem as `cassandra_datadir`.
+// Rather than failing on EXDEV (cross-device link) halfway through a
+// backup, after the snapshot was taken, both are compared up front, by
+// the device that holds them, by `validate` and before backups.
+
+// deviceOf returns the device that holds path, or its closest parent when
+// it does not exist yet.
+var deviceOf = func(path string) (uint64, error) {
+	for {
+		info, err := os.Stat(path)
+		if err == nil {
+			stat, ok := info.Sys().(*syscall.Stat_t)
+			if !ok {
+				return 0, fmt.Errorf("unable to tell which device holds '%s'", path)
+			}
+			return uint64(stat.Dev), nil
+		}
+		if !os.IsNotExist(err) || filepath.Dir(path) == path {
+			return 0, err
+		}
+		path = filepath.Dir(path)
+	}
+}
+
+// checkSameFilesystem fails when the snapshot files of dataDir can't be
+// hard-linked into tempDir, for them being on different filesystems.
+func checkSameFilesystem(dataDir, tempDir string) error {
+	dataDev, err := deviceOf(dataDir)
+	if err != nil {
+		return err
+	}
+	tempDev, err := deviceOf(tempDir)
+	if err != nil {
+		return err
+	}
+	if dataDev != tempDev {
+		return plugin.ConfigError{
+			Key: "cassandra_tempdir",
+			Err: fmt.Errorf("cassandra_tempdir (%s) is not on the same filesystem as cassandra_datadir (%s), so the snapshot files can't be hard-linked there; set cassandra_tempdir to a directory of that filesystem, e.g. %s",
+				tempDir, dataDir, filepath.Join(filepath.Dir(filepath.Clean(dataDir)), "shield-tmp")),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("Temporary Directory", func() {
+	var stat func(string) (uint64, error)
+
+	BeforeEach(func() {
+		stat = deviceOf
+	})
+
+	AfterEach(func() {
+		deviceOf = stat
+	})
+
+	devices := func(devs map[string]uint64) {
+		deviceOf = func(path string) (uint64, error) {
+			for prefix, dev := range devs {
+				if strings.HasPrefix(path, prefix) {
+					return dev, nil
+				}
+			}
+			return 0, fmt.Errorf("stat %s: no such file or directory", path)
+		}
+	}
+
+	It("accepts a temporary directory on the filesystem of the data", func() {
+		devices(map[string]uint64{"/var/vcap/store": 2049})
+		Ω(checkSameFilesystem(DefaultDataDir, DefaultTempDir)).Should(Succeed())
+	})
+
+	It("rejects a temporary directory on another filesystem, with a way out", func() {
+		devices(map[string]uint64{"/var/vcap/store": 2049, "/var/vcap/data": 2050})
+		err := checkSameFilesystem(DefaultDataDir, "/var/vcap/data/shield/cassandra")
+		Ω(err).Should(BeAssignableToTypeOf(plugin.ConfigError{}))
+		Ω(err.(plugin.ConfigError).Key).Should(Equal("cassandra_tempdir"))
+		Ω(err.Error()).Should(ContainSubstring("not on the same filesystem"))
+		Ω(err.Error()).Should(ContainSubstring("set cassandra_tempdir"))
+		Ω(err.Error()).Should(ContainSubstring("/var/vcap/store/cassandra/shield-tmp"))
+	})
+
+	It("passes stat failures on, as they are", func() {
+		devices(map[string]uint64{"/var/vcap/data": 2050})
+		err := checkSameFilesystem(DefaultDataDir, "/var/vcap/data/shield/cassandra")
+		Ω(err).Should(HaveOccurred())
+		Ω(err).ShouldNot(BeAssignableToTypeOf(plugin.ConfigError{}))
+	})
+
+	It("looks at the closest parent of directories that do not exist yet", func() {
+		tmp, err := ioutil.TempDir("", "shield-cassandra-tempdir-")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(tmp)
+
+		dev, err := deviceOf(tmp)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(deviceOf(filepath.Join(tmp, "not", "yet"))).Should(Equal(dev))
+		Ω(checkSameFilesystem(tmp, filepath.Join(tmp, "staging"))).Should(Succeed())
+	})
+})
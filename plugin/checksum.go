@@ -0,0 +1,242 @@
+package plugin
+
+/*
+
+Archives can get corrupted on their way from the target plugin to the store
+(and back): a flaky network, or an intermediary that cuts the stream short.
+tar only notices some of it, and nothing at all when the stream is cut at a
+record boundary.  Plugins that frame their archives with a checksum write
+them as:
+
+    shield-checksum/1 sha256\n
+    <the archive, as is>
+    \nshield-checksum/1 sha256 <sha256 of the archive, in hex> <size, 20 digits>\n
+
+The header tells restores that a checksum follows the archive; the trailer
+is fixed-length (112 bytes), so that readers only have to hold the last 112
+bytes of the stream back to find it.  A stream that ends without a trailer
+that matches what was read (its size, then its sum) is a ChecksumError:
+restores read the archive to the end, and check it, before trusting what
+they unpacked.  Archives that come without the header are passed through
+unchecked, as they always were.
+
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const ChecksumFormat = "shield-checksum/1"
+
+var (
+	checksumHeader    = []byte(ChecksumFormat + " sha256\n")
+	checksumTrailerFn = "\n" + ChecksumFormat + " sha256 %064x %020d\n"
+)
+
+// ChecksumTrailerSize is the size of the trailer of checksummed archives.
+var ChecksumTrailerSize = len(fmt.Sprintf(checksumTrailerFn, make([]byte, sha256.Size), 0))
+
+// ChecksumError is returned when a checksummed archive is not what was
+// written: it was cut short, or corrupted on the way.
+type ChecksumError struct {
+	Err string
+}
+
+func (e ChecksumError) Error() string {
+	return fmt.Sprintf("the archive failed its checksum: %s", e.Err)
+}
+
+// ChecksumWriter frames what is written through it with a checksum.
+type ChecksumWriter struct {
+	w    io.Writer
+	hash hash.Hash
+	n    int64
+}
+
+// NewChecksumWriter writes the checksum header to w, and returns the writer
+// that the archive is to be written to.  Close writes the trailer.
+func NewChecksumWriter(w io.Writer) (*ChecksumWriter, error) {
+	if _, err := w.Write(checksumHeader); err != nil {
+		return nil, err
+	}
+	return &ChecksumWriter{w: w, hash: sha256.New()}, nil
+}
+
+func (c *ChecksumWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if n > 0 {
+		c.hash.Write(b[:n])
+		c.n += int64(n)
+	}
+	return n, err
+}
+
+// Close writes the trailer, once the whole archive was written.  It does
+// not close the underlying writer.
+func (c *ChecksumWriter) Close() error {
+	_, err := fmt.Fprintf(c.w, checksumTrailerFn, c.hash.Sum(nil), c.n)
+	return err
+}
+
+// ChecksumReader reads an archive, without its checksum framing, if it has
+// any, and checks it once the whole stream was read.
+type ChecksumReader struct {
+	r       *bufio.Reader
+	framed  bool
+	hash    hash.Hash
+	n       int64
+	buf     []byte
+	held    []byte
+	err     error
+	checked bool
+}
+
+// NewChecksumReader returns a reader of the archive read from r.
+func NewChecksumReader(r io.Reader) *ChecksumReader {
+	c := &ChecksumReader{r: bufio.NewReaderSize(r, 64*1024)}
+	if b, _ := c.r.Peek(len(checksumHeader)); bytes.Equal(b, checksumHeader) {
+		c.r.Discard(len(checksumHeader))
+		c.framed, c.hash = true, sha256.New()
+		c.buf = make([]byte, 64*1024)
+	}
+	return c
+}
+
+// Framed tells whether the archive comes with a checksum.
+func (c *ChecksumReader) Framed() bool {
+	return c.framed
+}
+
+// Read returns the bytes of the archive.  Instead of io.EOF, it returns a
+// ChecksumError at the end of an archive that does not match its checksum.
+func (c *ChecksumReader) Read(b []byte) (int, error) {
+	if !c.framed {
+		return c.r.Read(b)
+	}
+
+	/* the last ChecksumTrailerSize bytes are held back, until the end of
+	   the stream tells whether they are the trailer, or more archive */
+	for c.err == nil && len(c.held) <= ChecksumTrailerSize {
+		n, err := c.r.Read(c.buf)
+		c.held = append(c.held, c.buf[:n]...)
+		c.err = err
+	}
+	if n := len(c.held) - ChecksumTrailerSize; n > 0 {
+		if n > len(b) {
+			n = len(b)
+		}
+		copy(b, c.held[:n])
+		c.held = c.held[n:]
+		c.hash.Write(b[:n])
+		c.n += int64(n)
+		return n, nil
+	}
+	if c.err == io.EOF && !c.checked {
+		c.checked = true
+		if err := c.check(); err != nil {
+			c.err = err
+		}
+	}
+	return 0, c.err
+}
+
+// check tells whether the trailer matches the archive that was read.
+func (c *ChecksumReader) check() error {
+	var (
+		sum  []byte
+		size int64
+	)
+	if len(c.held) != ChecksumTrailerSize {
+		return ChecksumError{Err: "it is truncated (there is no checksum at the end of the stream)"}
+	}
+	if _, err := fmt.Sscanf(string(c.held), checksumTrailerFn, &sum, &size); err != nil {
+		return ChecksumError{Err: "it is truncated (there is no checksum at the end of the stream)"}
+	}
+	if size != c.n {
+		return ChecksumError{Err: fmt.Sprintf("%d bytes were read, instead of %d", c.n, size)}
+	}
+	if got := c.hash.Sum(nil); !bytes.Equal(got, sum) {
+		return ChecksumError{Err: fmt.Sprintf("its sha256 is %x, instead of %x", got, sum)}
+	}
+	DEBUG("the archive matches its checksum (sha256 %x, %d bytes)", sum, size)
+	return nil
+}
+
+// Verify reads what is left of the archive (readers of tar archives stop
+// at their end-of-archive records), and returns the ChecksumError, if any.
+// Archives without a checksum always pass.
+func (c *ChecksumReader) Verify() error {
+	_, err := io.Copy(ioutil.Discard, c)
+	return err
+}
+
+// ChecksumOutput returns a pipe whose content is written to out, framed
+// with a checksum.  The returned function waits until it is all written,
+// once the pipe was closed.
+func ChecksumOutput(out io.Writer) (*os.File, func() error, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	errs := make(chan error, 1)
+	go func() {
+		defer r.Close()
+		c, err := NewChecksumWriter(out)
+		if err == nil {
+			if _, err = io.Copy(c, r); err == nil {
+				err = c.Close()
+			}
+		}
+		errs <- err
+	}()
+	return w, func() error { return <-errs }, nil
+}
+
+// ChecksumInput returns a pipe that the archive read from in is written to,
+// without its checksum framing, if it has any.  The returned function closes
+// the pipe, once the archive was read, and returns a ChecksumError if it
+// does not match its checksum.  Whatever made the reader of the pipe stop
+// early, the rest of the archive is still read, to be checked.
+func ChecksumInput(in io.Reader) (*os.File, func() error, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	c := NewChecksumReader(in)
+	if c.Framed() {
+		DEBUG("the archive comes with a checksum, which it is checked against")
+	}
+	errs := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(&droppingWriter{w: w}, c)
+		w.Close()
+		errs <- err
+	}()
+	return r, func() error {
+		r.Close()
+		return <-errs
+	}, nil
+}
+
+// droppingWriter drops what is written to it once its writer failed, so
+// that what it is copied from is read to the end anyway.
+type droppingWriter struct {
+	w      io.Writer
+	failed bool
+}
+
+func (d *droppingWriter) Write(b []byte) (int, error) {
+	if !d.failed {
+		if _, err := d.w.Write(b); err != nil {
+			d.failed = true
+		}
+	}
+	return len(b), nil
+}
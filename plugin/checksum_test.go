@@ -0,0 +1,110 @@
+package plugin
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Checksummed Archives", func() {
+	data := func(n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(i * 7)
+		}
+		return b
+	}
+
+	frame := func(archive []byte) []byte {
+		var buf bytes.Buffer
+		c, err := NewChecksumWriter(&buf)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = c.Write(archive)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(c.Close()).Should(Succeed())
+		return buf.Bytes()
+	}
+
+	read := func(stream []byte) ([]byte, error) {
+		c := NewChecksumReader(bytes.NewReader(stream))
+		Ω(c.Framed()).Should(BeTrue())
+		return ioutil.ReadAll(c)
+	}
+
+	It("gives the archive back, as it was written", func() {
+		for _, size := range []int{0, 1, ChecksumTrailerSize, 64*1024 + 5, 1024 * 1024} {
+			stream := frame(data(size))
+			Ω(stream).Should(HavePrefix(ChecksumFormat + " sha256\n"))
+			Ω(len(stream)).Should(Equal(len(ChecksumFormat+" sha256\n") + size + ChecksumTrailerSize))
+
+			archive, err := read(stream)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(bytes.Equal(archive, data(size))).Should(BeTrue())
+		}
+	})
+
+	It("catches truncated archives", func() {
+		stream := frame(data(1024 * 1024))
+		for _, cut := range []int{1, ChecksumTrailerSize, ChecksumTrailerSize + 512, 512 * 1024} {
+			_, err := read(stream[:len(stream)-cut])
+			Ω(err).Should(BeAssignableToTypeOf(ChecksumError{}), "cut %d bytes", cut)
+			Ω(err.Error()).Should(ContainSubstring("truncated"))
+		}
+	})
+
+	It("catches flipped bits", func() {
+		stream := frame(data(1024 * 1024))
+		stream[len(stream)/2] ^= 0x10
+		_, err := read(stream)
+		Ω(err).Should(BeAssignableToTypeOf(ChecksumError{}))
+		Ω(err.Error()).Should(ContainSubstring("sha256"))
+	})
+
+	It("catches archives that lost (or gained) bytes along the way", func() {
+		stream := frame(data(64 * 1024))
+		mid := len(stream) / 2
+		_, err := read(append(append([]byte{}, stream[:mid]...), stream[mid+1:]...))
+		Ω(err).Should(BeAssignableToTypeOf(ChecksumError{}))
+		Ω(err.Error()).Should(ContainSubstring("65535 bytes were read, instead of 65536"))
+	})
+
+	It("passes archives without a checksum through, unchecked", func() {
+		c := NewChecksumReader(bytes.NewReader(data(4096)))
+		Ω(c.Framed()).Should(BeFalse())
+		archive, err := ioutil.ReadAll(c)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(archive).Should(Equal(data(4096)))
+		Ω(c.Verify()).Should(Succeed())
+	})
+
+	It("checks the whole archive, even when its reader stops early", func() {
+		stream := frame(data(1024 * 1024))
+		stream[len(stream)-ChecksumTrailerSize-1] ^= 0x01
+
+		in, verify, err := ChecksumInput(bytes.NewReader(stream))
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = io.ReadFull(in, make([]byte, 1024))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(verify()).Should(BeAssignableToTypeOf(ChecksumError{}))
+	})
+
+	It("frames what goes through a pipe", func() {
+		var buf bytes.Buffer
+		out, wait, err := ChecksumOutput(&buf)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = out.Write(data(100000))
+		Ω(err).ShouldNot(HaveOccurred())
+		out.Close()
+		Ω(wait()).Should(Succeed())
+
+		in, verify, err := ChecksumInput(bytes.NewReader(buf.Bytes()))
+		Ω(err).ShouldNot(HaveOccurred())
+		archive, err := ioutil.ReadAll(in)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(verify()).Should(Succeed())
+		Ω(bytes.Equal(archive, data(100000))).Should(BeTrue())
+	})
+})
@@ -0,0 +1,37 @@
+package plugin
+
+// Cleaner can be implemented by plugins that may leave partial data behind,
+// in the backing storage (i.e. interrupted uploads) or on the target system
+// (i.e. temporary files of an interrupted backup).  It is
+// used by the `cleanup` command, which is meant to be run as a periodic
+// maintenance task.  With dryRun set, leftovers must only be listed, and
+// nothing removed.
+type Cleaner interface {
+	Cleanup(endpoint ShieldEndpoint, dryRun bool) error
+}
+
+func cleanup(p Plugin, endpoint ShieldEndpoint, dryRun bool) error {
+	c, ok := p.(Cleaner)
+	if !ok {
+		return UnsupportedActionError{Action: "cleanup"}
+	}
+	return c.Cleanup(endpoint, dryRun)
+}
+
+// ClusterCleaner can be implemented by target plugins that back up one node
+// of a cluster at a time, and may leave partial data behind on the other
+// nodes when a cluster-wide backup is aborted.  It is used by the
+// `cleanup-cluster` command, which is only ever run on purpose, by an
+// operator.  With dryRun set, what would be removed, and from which nodes,
+// must only be listed.
+type ClusterCleaner interface {
+	CleanupCluster(endpoint ShieldEndpoint, dryRun bool) error
+}
+
+func cleanupCluster(p Plugin, endpoint ShieldEndpoint, dryRun bool) error {
+	c, ok := p.(ClusterCleaner)
+	if !ok {
+		return UnsupportedActionError{Action: "cleanup-cluster"}
+	}
+	return c.CleanupCluster(endpoint, dryRun)
+}
@@ -0,0 +1,182 @@
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+
+When many jobs run on the same host at once, their xtrabackup, tar or
+sstableloader processes compete for the same disks and CPUs, and all of
+them end up slower than if they had run one after the other.  Setting
+$SHIELD_PLUGIN_MAX_CONCURRENCY to a positive number caps how many backups
+and restores may run heavy commands (see HeavyCommands) on the host at
+the same time.  The others queue until a slot frees up.
+
+Slots are lock files in SlotDir, held with flock(2) by the plugin process
+while any of its heavy commands runs.  The kernel drops the lock when the
+process exits, however it does, so the slots of crashed or killed plugins
+are never lost.  All the heavy commands of a plugin share its slot: a
+backup that pipes tar into a filter never waits on itself.
+
+Only backup and restore actions take slots; stores and retrievals, which
+are fed by (or feed) a backup or a restore through a pipe, never wait, or
+a full host could deadlock.
+
+*/
+
+// HeavyCommands are the commands (by base name) that wait for a slot
+// before they run, when the concurrency of the host is limited.  Plugins
+// may add their own.
+var HeavyCommands = map[string]bool{
+	"tar":           true,
+	"xtrabackup":    true,
+	"innobackupex":  true,
+	"sstableloader": true,
+	"mysqldump":     true,
+	"pg_dump":       true,
+	"pg_dumpall":    true,
+	"pg_restore":    true,
+	"mongodump":     true,
+	"mongorestore":  true,
+}
+
+// SlotDir is where the lock files of the slots are, for all the plugins
+// of the host.
+var SlotDir = filepath.Join(os.TempDir(), "shield-plugin-slots")
+
+// How often queued plugins check for a free slot.
+var SlotPollInterval = time.Second
+
+// slots is the share of the host-wide slots that this process holds.
+type slots struct {
+	max int
+
+	lock  sync.Mutex
+	held  *os.File
+	users int
+}
+
+// The slots that heavy commands take, as configured by the environment.
+var execSlots slots
+
+// maxConcurrency reads $SHIELD_PLUGIN_MAX_CONCURRENCY, or returns 0 if it
+// is not set, for no limit.
+func maxConcurrency() (int, error) {
+	s := os.Getenv("SHIELD_PLUGIN_MAX_CONCURRENCY")
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("SHIELD_PLUGIN_MAX_CONCURRENCY must be a whole number, 0 for no limit (got '%s')", s)
+	}
+	return n, nil
+}
+
+// setConcurrency limits the heavy commands of this process to the slots
+// of the host.
+func setConcurrency() error {
+	n, err := maxConcurrency()
+	if err != nil {
+		return err
+	}
+	execSlots.max = n
+	if n > 0 {
+		DEBUG("running heavy commands within %d slots for the host, in '%s'", n, SlotDir)
+	}
+	return nil
+}
+
+// tryLockSlot takes slot i of dir, or returns nil if another process has
+// it.
+func tryLockSlot(dir string, i int) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("slot-%d", i)), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// acquireSlot waits for one of the first max slots of dir to be free, and
+// takes it.  Closing the file it returns frees the slot.
+func acquireSlot(dir string, max int, waiting func()) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	/* let the plugins of other users take slots too */
+	os.Chmod(dir, 0777|os.ModeSticky)
+
+	for {
+		for i := 0; i < max; i++ {
+			f, err := tryLockSlot(dir, i)
+			if err != nil {
+				return nil, err
+			}
+			if f != nil {
+				DEBUG("took slot %d of %d, in '%s'", i, max, dir)
+				return f, nil
+			}
+		}
+		if waiting != nil {
+			waiting()
+			waiting = nil
+		}
+		time.Sleep(SlotPollInterval)
+	}
+}
+
+// acquire holds a slot for this process, while the heavy command name runs,
+// waiting for one if need be.
+func (s *slots) acquire(name string) error {
+	if s.max <= 0 {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.held == nil {
+		f, err := acquireSlot(SlotDir, s.max, func() {
+			SetStep("waiting for a slot to run '%s'", name)
+			Fprintf(os.Stderr, "@Y{All %d slots for heavy commands on this host are taken; waiting for one to run '%s'}\n", s.max, name)
+		})
+		if err != nil {
+			return fmt.Errorf("unable to take a slot to run '%s': %s", name, err)
+		}
+		s.held = f
+	}
+	s.users++
+	return nil
+}
+
+// release frees the slot of this process, once no heavy command of its
+// runs anymore.
+func (s *slots) release() {
+	if s.max <= 0 {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.users--
+	if s.users == 0 && s.held != nil {
+		s.held.Close()
+		s.held = nil
+	}
+}
+
+// heavy tells whether cmd (a path, or a name) is one of the HeavyCommands.
+func heavy(cmd string) bool {
+	return HeavyCommands[filepath.Base(cmd)]
+}
@@ -0,0 +1,137 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Host Concurrency Limit", func() {
+	var (
+		tmp          string
+		slotDir      string
+		pollInterval time.Duration
+		held         []*os.File
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-slots-")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		slotDir, pollInterval, held = SlotDir, SlotPollInterval, nil
+		SlotDir, SlotPollInterval = tmp, 10*time.Millisecond
+		HeavyCommands["exec_tester"] = true
+	})
+
+	AfterEach(func() {
+		for _, f := range held {
+			f.Close()
+		}
+		delete(HeavyCommands, "exec_tester")
+		os.Unsetenv("SHIELD_PLUGIN_MAX_CONCURRENCY")
+		execSlots = slots{}
+		SlotDir, SlotPollInterval = slotDir, pollInterval
+		os.RemoveAll(tmp)
+	})
+
+	take := func(max int) *os.File {
+		f, err := acquireSlot(tmp, max, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		held = append(held, f)
+		return f
+	}
+
+	It("reads the limit from the environment", func() {
+		Ω(maxConcurrency()).Should(Equal(0))
+		os.Setenv("SHIELD_PLUGIN_MAX_CONCURRENCY", "3")
+		Ω(maxConcurrency()).Should(Equal(3))
+		for _, bad := range []string{"-1", "two", "1.5"} {
+			os.Setenv("SHIELD_PLUGIN_MAX_CONCURRENCY", bad)
+			_, err := maxConcurrency()
+			Ω(err).Should(HaveOccurred(), "'%s' should be rejected", bad)
+		}
+	})
+
+	It("tells heavy commands from the others", func() {
+		Ω(heavy("tar")).Should(BeTrue())
+		Ω(heavy("/var/vcap/packages/cassandra/bin/sstableloader")).Should(BeTrue())
+		Ω(heavy("rm")).Should(BeFalse())
+	})
+
+	It("queues for a slot until one is released", func() {
+		take(2)
+		second := take(2)
+
+		acquired := make(chan *os.File, 1)
+		waited := make(chan bool, 1)
+		go func() {
+			defer GinkgoRecover()
+			f, err := acquireSlot(tmp, 2, func() { waited <- true })
+			Ω(err).ShouldNot(HaveOccurred())
+			acquired <- f
+		}()
+		Eventually(waited).Should(Receive())
+		Consistently(acquired, 100*time.Millisecond).ShouldNot(Receive())
+
+		second.Close()
+		var f *os.File
+		Eventually(acquired).Should(Receive(&f))
+		held = append(held, f)
+	})
+
+	It("gets the slots of dead processes back", func() {
+		if _, err := exec.LookPath("flock"); err != nil {
+			Skip("flock is not installed")
+		}
+		cmd := exec.Command("flock", "-o", filepath.Join(tmp, "slot-0"), "sleep", "60")
+		Ω(cmd.Start()).Should(Succeed())
+		Eventually(func() *os.File {
+			f, err := tryLockSlot(tmp, 0)
+			Ω(err).ShouldNot(HaveOccurred())
+			if f != nil {
+				f.Close()
+			}
+			return f
+		}).Should(BeNil())
+
+		Ω(cmd.Process.Kill()).Should(Succeed())
+		cmd.Wait()
+		take(1)
+	})
+
+	It("has heavy commands wait for a slot", func() {
+		os.Setenv("SHIELD_PLUGIN_MAX_CONCURRENCY", "1")
+		Ω(setConcurrency()).Should(Succeed())
+		other := take(1)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- ExecWithOptions(ExecOptions{Cmd: "test/bin/exec_tester 0"})
+		}()
+		Consistently(done, 100*time.Millisecond).ShouldNot(Receive())
+
+		other.Close()
+		Eventually(done).Should(Receive(BeNil()))
+		Ω(execSlots.held).Should(BeNil())
+
+		/* and the others do not */
+		other = take(1)
+		Ω(ExecWithOptions(ExecOptions{Cmd: "true"})).Should(Succeed())
+	})
+
+	It("shares the slot of the process between its heavy commands", func() {
+		os.Setenv("SHIELD_PLUGIN_MAX_CONCURRENCY", "1")
+		Ω(setConcurrency()).Should(Succeed())
+		Ω(execSlots.acquire("tar")).Should(Succeed())
+		Ω(ExecWithOptions(ExecOptions{Cmd: "test/bin/exec_tester 0"})).Should(Succeed())
+		Ω(execSlots.held).ShouldNot(BeNil())
+		execSlots.release()
+		Ω(execSlots.held).Should(BeNil())
+	})
+})
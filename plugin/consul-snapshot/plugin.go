@@ -193,7 +193,7 @@ func (p ConsulPlugin) Validate(endpoint plugin.ShieldEndpoint) error {
 	}
 
 	if fail {
-		return fmt.Errorf("consul: invalid configuration")
+		return plugin.ValidationError{Plugin: "consul"}
 	}
 	return nil
 }
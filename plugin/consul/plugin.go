@@ -43,7 +43,6 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"io"
 	"os"
 
@@ -148,7 +147,7 @@ func (p ConsulPlugin) Validate(endpoint ShieldEndpoint) error {
 	}
 
 	if fail {
-		return fmt.Errorf("consul: invalid configuration")
+		return ValidationError{Plugin: "consul"}
 	}
 	return nil
 }
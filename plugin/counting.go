@@ -0,0 +1,121 @@
+package plugin
+
+/*
+
+CountingReader and CountingWriter count the bytes that go through them, and
+can feed them to a hash along the way (i.e. sha256.New()), so that plugins
+get the size, and a checksum, of the streams they move without reading them
+twice.  Counts can be read while the stream flows, from another goroutine
+(the status endpoint does); sums only once the stream is done.
+
+When the outcome of the action is asked for (with --result-file or
+--result-fd), or its progress (with --status-port), Exec() counts what the
+commands it runs read from the standard input of the plugin, and write to
+its standard output, i.e. the archive.  That total is the `bytes` of the
+result and of the status, unless the plugin reports a figure of its own with
+ReportBytes().  Counting puts a pipe (and a copy) between the commands and
+the standard streams, which are otherwise handed over to them as is, which
+is why it is not done unless asked for.
+
+*/
+
+import (
+	"hash"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// CountingReader counts the bytes read through it.
+type CountingReader struct {
+	r    io.Reader
+	n    int64
+	hash hash.Hash
+}
+
+// NewCountingReader wraps r, feeding what is read to h, unless it is nil.
+func NewCountingReader(r io.Reader, h hash.Hash) *CountingReader {
+	return &CountingReader{r: r, hash: h}
+}
+
+func (c *CountingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if n > 0 {
+		if c.hash != nil {
+			c.hash.Write(b[:n])
+		}
+		atomic.AddInt64(&c.n, int64(n))
+	}
+	return n, err
+}
+
+// Count returns how many bytes were read so far.
+func (c *CountingReader) Count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// Sum returns the hash of what was read, or nil without a hash.
+func (c *CountingReader) Sum() []byte {
+	if c.hash == nil {
+		return nil
+	}
+	return c.hash.Sum(nil)
+}
+
+// CountingWriter counts the bytes written through it.
+type CountingWriter struct {
+	w    io.Writer
+	n    int64
+	hash hash.Hash
+}
+
+// NewCountingWriter wraps w, feeding what is written to h, unless it is
+// nil.  Only the bytes that w took are counted (and hashed).
+func NewCountingWriter(w io.Writer, h hash.Hash) *CountingWriter {
+	return &CountingWriter{w: w, hash: h}
+}
+
+func (c *CountingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if n > 0 {
+		if c.hash != nil {
+			c.hash.Write(b[:n])
+		}
+		atomic.AddInt64(&c.n, int64(n))
+	}
+	return n, err
+}
+
+// Count returns how many bytes were written so far.
+func (c *CountingWriter) Count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// Sum returns the hash of what was written, or nil without a hash.
+func (c *CountingWriter) Sum() []byte {
+	if c.hash == nil {
+		return nil
+	}
+	return c.hash.Sum(nil)
+}
+
+// The standard input and output of the plugin, as Exec() hands them over
+// to the commands it runs; counted, when counting is on.
+var (
+	execStdin  io.Reader = os.Stdin
+	execStdout io.Writer = os.Stdout
+
+	streamedBytes func() int64
+)
+
+// countStreams has Exec() count the bytes that go through the standard
+// input and output of the plugin.
+func countStreams() {
+	in := NewCountingReader(os.Stdin, nil)
+	out := NewCountingWriter(os.Stdout, nil)
+	execStdin, execStdout = in, out
+	streamedBytes = func() int64 {
+		return in.Count() + out.Count()
+	}
+	DEBUG("counting the bytes streamed through standard input and output")
+}
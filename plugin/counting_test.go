@@ -0,0 +1,100 @@
+package plugin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Counting Streams", func() {
+	data := func(n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(i * 7)
+		}
+		return b
+	}
+
+	It("counts (and hashes) what is read, as io.Copy does", func() {
+		for _, size := range []int{0, 1, 32*1024 + 5, 1024 * 1024} {
+			in := NewCountingReader(bytes.NewReader(data(size)), sha256.New())
+			n, err := io.Copy(ioutil.Discard, in)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(in.Count()).Should(Equal(n))
+			Ω(in.Count()).Should(Equal(int64(size)))
+
+			sum := sha256.Sum256(data(size))
+			Ω(in.Sum()).Should(Equal(sum[:]))
+		}
+	})
+
+	It("counts (and hashes) what is written, as io.Copy does", func() {
+		for _, size := range []int{0, 1, 32*1024 + 5, 1024 * 1024} {
+			var buf bytes.Buffer
+			out := NewCountingWriter(&buf, sha256.New())
+			n, err := io.Copy(out, bytes.NewReader(data(size)))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(out.Count()).Should(Equal(n))
+			Ω(bytes.Equal(buf.Bytes(), data(size))).Should(BeTrue())
+
+			sum := sha256.Sum256(data(size))
+			Ω(out.Sum()).Should(Equal(sum[:]))
+		}
+	})
+
+	It("hashes nothing without a hash", func() {
+		in := NewCountingReader(bytes.NewReader(data(10)), nil)
+		io.Copy(ioutil.Discard, in)
+		Ω(in.Count()).Should(Equal(int64(10)))
+		Ω(in.Sum()).Should(BeNil())
+	})
+
+	Context("through Exec", func() {
+		var (
+			tmp    string
+			stdout *os.File
+		)
+
+		BeforeEach(func() {
+			var err error
+			tmp, err = ioutil.TempDir("", "shield-plugin-counting-")
+			Ω(err).ShouldNot(HaveOccurred())
+			stdout = os.Stdout
+			resultBytes = nil
+		})
+
+		AfterEach(func() {
+			os.Stdout = stdout
+			execStdin, execStdout, streamedBytes = os.Stdin, os.Stdout, nil
+			resultBytes = nil
+			os.RemoveAll(tmp)
+		})
+
+		It("reports the bytes that commands streamed to standard output", func() {
+			out, err := os.Create(filepath.Join(tmp, "archive"))
+			Ω(err).ShouldNot(HaveOccurred())
+			defer out.Close()
+			os.Stdout = out
+
+			Ω(reportedBytes()).Should(BeNil())
+			countStreams()
+			Ω(Exec("head -c 100000 /dev/zero", STDOUT)).Should(Succeed())
+			Ω(Exec("head -c 2345 /dev/zero", STDOUT)).Should(Succeed())
+			Ω(*reportedBytes()).Should(Equal(int64(102345)))
+
+			fi, err := os.Stat(filepath.Join(tmp, "archive"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(fi.Size()).Should(Equal(int64(102345)))
+
+			/* what the plugin reports wins */
+			ReportBytes(42)
+			Ω(*reportedBytes()).Should(Equal(int64(42)))
+		})
+	})
+})
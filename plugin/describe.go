@@ -0,0 +1,88 @@
+package plugin
+
+/*
+
+The `describe` command prints everything there is to know about a plugin,
+for tooling (UIs, catalogs) to read in one go: the `info` metadata, the
+`schema` fields, the example and default endpoints, and the capabilities
+of the plugin, i.e. which of the optional commands it supports.  The
+document is versioned by its `schema_version`: fields may be added to it,
+but not removed or changed, without bumping it.
+
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// DescribeSchemaVersion is the version of the document that `describe`
+// prints.
+const DescribeSchemaVersion = 1
+
+// Capabilities tells what a plugin can be used for, and which of the
+// optional commands it supports.
+type Capabilities struct {
+	Target          bool `json:"target"`
+	Store           bool `json:"store"`
+	Cleanup         bool `json:"cleanup"`
+	ListSnapshots   bool `json:"list_snapshots"`
+	BulkPurge       bool `json:"bulk_purge"`
+	Reconcile       bool `json:"reconcile"`
+	RetrieveRestore bool `json:"retrieve_restore"`
+	CleanupCluster  bool `json:"cleanup_cluster"`
+}
+
+// Description is the document that `describe` prints.
+type Description struct {
+	SchemaVersion int            `json:"schema_version"`
+	Name          string         `json:"name"`
+	Author        string         `json:"author"`
+	Version       string         `json:"version"`
+	Features      PluginFeatures `json:"features"`
+	Capabilities  Capabilities   `json:"capabilities"`
+	Fields        []Field        `json:"fields"`
+	Example       string         `json:"example,omitempty"`
+	Defaults      string         `json:"defaults,omitempty"`
+}
+
+// pluginCapabilities looks at the features that the plugin declares, and
+// at the optional interfaces it implements.
+func pluginCapabilities(p Plugin, info PluginInfo) Capabilities {
+	c := Capabilities{
+		Target: info.Features.Target == "yes",
+		Store:  info.Features.Store == "yes",
+	}
+	_, c.Cleanup = p.(Cleaner)
+	_, c.ListSnapshots = p.(SnapshotLister)
+	_, c.BulkPurge = p.(BulkPurger)
+	_, c.Reconcile = p.(StoreLister)
+	_, c.RetrieveRestore = p.(StreamRestorer)
+	_, c.CleanupCluster = p.(ClusterCleaner)
+	return c
+}
+
+// describePlugin returns the `describe` document of the plugin.
+func describePlugin(p Plugin) ([]byte, error) {
+	info := p.Meta()
+	fields, err := checkFields(info)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.MarshalIndent(Description{
+		SchemaVersion: DescribeSchemaVersion,
+		Name:          info.Name,
+		Author:        info.Author,
+		Version:       info.Version,
+		Features:      info.Features,
+		Capabilities:  pluginCapabilities(p, info),
+		Fields:        fields,
+		Example:       info.Example,
+		Defaults:      info.Defaults,
+	}, "", "    ")
+	if err != nil {
+		return nil, JSONError{Err: fmt.Sprintf("Could not create plugin description: %s", err.Error())}
+	}
+	return b, nil
+}
@@ -0,0 +1,89 @@
+package plugin
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// describedPlugin is a target that also lists snapshots and cleans up.
+type describedPlugin struct {
+	info PluginInfo
+}
+
+func (p describedPlugin) Validate(ShieldEndpoint) error         { return nil }
+func (p describedPlugin) Backup(ShieldEndpoint) error           { return nil }
+func (p describedPlugin) Restore(ShieldEndpoint) error          { return nil }
+func (p describedPlugin) Store(ShieldEndpoint) (string, error)  { return "", UNIMPLEMENTED }
+func (p describedPlugin) Retrieve(ShieldEndpoint, string) error { return UNIMPLEMENTED }
+func (p describedPlugin) Purge(ShieldEndpoint, string) error    { return UNIMPLEMENTED }
+func (p describedPlugin) Meta() PluginInfo                      { return p.info }
+
+func (p describedPlugin) Snapshots(ShieldEndpoint) ([]Snapshot, error) { return nil, nil }
+func (p describedPlugin) Cleanup(ShieldEndpoint, bool) error           { return nil }
+
+var _ = Describe("Plugin Description", func() {
+	info := PluginInfo{
+		Name:     "Described Plugin",
+		Author:   "SHIELD",
+		Version:  "1.2.3",
+		Features: PluginFeatures{Target: "yes", Store: "no"},
+		Example:  `{ "path": "/data" }`,
+		Defaults: `{ "path": "/var/data" }`,
+		Fields: []Field{
+			{Name: "path", Label: "Path", Type: TextField, Default: "/var/data"},
+			{Name: "quick", Label: "Quick", Type: BooleanField, Default: false},
+		},
+	}
+
+	describe := func(p Plugin) map[string]interface{} {
+		b, err := describePlugin(p)
+		Ω(err).ShouldNot(HaveOccurred())
+		var d map[string]interface{}
+		Ω(json.Unmarshal(b, &d)).Should(Succeed())
+		return d
+	}
+
+	It("combines the metadata, the fields and the capabilities", func() {
+		d := describe(describedPlugin{info: info})
+		Ω(d["schema_version"]).Should(BeEquivalentTo(DescribeSchemaVersion))
+		Ω(d["name"]).Should(Equal("Described Plugin"))
+		Ω(d["author"]).Should(Equal("SHIELD"))
+		Ω(d["version"]).Should(Equal("1.2.3"))
+		Ω(d["features"]).Should(Equal(map[string]interface{}{"target": "yes", "store": "no"}))
+		Ω(d["example"]).Should(Equal(`{ "path": "/data" }`))
+		Ω(d["defaults"]).Should(Equal(`{ "path": "/var/data" }`))
+		Ω(d["fields"]).Should(HaveLen(2))
+		Ω(d["capabilities"]).Should(Equal(map[string]interface{}{
+			"target":           true,
+			"store":            false,
+			"cleanup":          true,
+			"list_snapshots":   true,
+			"bulk_purge":       false,
+			"reconcile":        false,
+			"retrieve_restore": false,
+			"cleanup_cluster":  false,
+		}))
+	})
+
+	It("tells stream restorers apart", func() {
+		c := pluginCapabilities(&streamPlugin{}, PluginInfo{Features: PluginFeatures{Target: "yes", Store: "yes"}})
+		Ω(c).Should(Equal(Capabilities{Target: true, Store: true, RetrieveRestore: true}))
+	})
+
+	It("lists no fields as an empty list", func() {
+		d := describe(describedPlugin{info: PluginInfo{Name: "bare"}})
+		Ω(d["fields"]).Should(Equal([]interface{}{}))
+		Ω(d).ShouldNot(HaveKey("example"))
+	})
+
+	It("fails on malformed fields, as schema does", func() {
+		bad := info
+		bad.Fields = []Field{{Name: "path", Type: "dropdown"}}
+		_, err := describePlugin(describedPlugin{info: bad})
+		Ω(err).Should(HaveOccurred())
+		_, err = pluginSchema(bad)
+		Ω(err).Should(HaveOccurred())
+	})
+})
@@ -63,7 +63,7 @@ func (p DummyPlugin) Validate(endpoint plugin.ShieldEndpoint) error {
 	}
 
 	if fail {
-		return fmt.Errorf("dummy: invalid configuration")
+		return plugin.ValidationError{Plugin: "dummy"}
 	}
 	return nil
 }
@@ -30,16 +30,16 @@ func getEndpoint(j string) (ShieldEndpoint, error) {
 
 // StringValue ...
 func (endpoint ShieldEndpoint) StringValue(key string) (string, error) {
-	_, ok := endpoint[key]
+	v, ok := endpoint.lookup(key)
 	if !ok {
 		return "", EndpointMissingRequiredDataError{Key: key}
 	}
 
-	if reflect.TypeOf(endpoint[key]).Kind() != reflect.String {
+	if reflect.TypeOf(v).Kind() != reflect.String {
 		return "", EndpointDataTypeMismatchError{Key: key, DesiredType: "string"}
 	}
 
-	return endpoint[key].(string), nil
+	return v.(string), nil
 }
 
 // StringValueDefault ...
@@ -56,16 +56,16 @@ func (endpoint ShieldEndpoint) StringValueDefault(key string, def string) (strin
 
 // FloatValue ...
 func (endpoint ShieldEndpoint) FloatValue(key string) (float64, error) {
-	_, ok := endpoint[key]
+	v, ok := endpoint.lookup(key)
 	if !ok {
 		return 0, EndpointMissingRequiredDataError{Key: key}
 	}
 
-	if reflect.TypeOf(endpoint[key]).Kind() != reflect.Float64 {
+	if reflect.TypeOf(v).Kind() != reflect.Float64 {
 		return 0, EndpointDataTypeMismatchError{Key: key, DesiredType: "numeric"}
 	}
 
-	return endpoint[key].(float64), nil
+	return v.(float64), nil
 }
 
 // FloatValueDefault ...
@@ -82,16 +82,16 @@ func (endpoint ShieldEndpoint) FloatValueDefault(key string, def float64) (float
 
 // BooleanValue ...
 func (endpoint ShieldEndpoint) BooleanValue(key string) (bool, error) {
-	_, ok := endpoint[key]
+	v, ok := endpoint.lookup(key)
 	if !ok {
 		return false, EndpointMissingRequiredDataError{Key: key}
 	}
 
-	if reflect.TypeOf(endpoint[key]).Kind() != reflect.Bool {
+	if reflect.TypeOf(v).Kind() != reflect.Bool {
 		return false, EndpointDataTypeMismatchError{Key: key, DesiredType: "boolean"}
 	}
 
-	return endpoint[key].(bool), nil
+	return v.(bool), nil
 }
 
 // BooleanValueDefault ...
@@ -108,16 +108,16 @@ func (endpoint ShieldEndpoint) BooleanValueDefault(key string, def bool) (bool,
 
 // ArrayValue ...
 func (endpoint ShieldEndpoint) ArrayValue(key string) ([]interface{}, error) {
-	_, ok := endpoint[key]
+	v, ok := endpoint.lookup(key)
 	if !ok {
 		return nil, EndpointMissingRequiredDataError{Key: key}
 	}
 
-	if reflect.TypeOf(endpoint[key]).Kind() != reflect.Slice {
+	if reflect.TypeOf(v).Kind() != reflect.Slice {
 		return nil, EndpointDataTypeMismatchError{Key: key, DesiredType: "array"}
 	}
 
-	return endpoint[key].([]interface{}), nil
+	return v.([]interface{}), nil
 }
 
 // ArrayValueDefault ...
@@ -138,14 +138,14 @@ func (endpoint ShieldEndpoint) ArrayValueDefault(key string, def []string) ([]st
 
 // MapValue ...
 func (endpoint ShieldEndpoint) MapValue(key string) (map[string]interface{}, error) {
-	_, ok := endpoint[key]
+	v, ok := endpoint.lookup(key)
 	if !ok {
 		return nil, EndpointMissingRequiredDataError{Key: key}
 	}
 
-	if reflect.TypeOf(endpoint[key]).Kind() != reflect.Map {
+	if reflect.TypeOf(v).Kind() != reflect.Map {
 		return nil, EndpointDataTypeMismatchError{Key: key, DesiredType: "map"}
 	}
 
-	return endpoint[key].(map[string]interface{}), nil
+	return v.(map[string]interface{}), nil
 }
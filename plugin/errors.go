@@ -2,6 +2,7 @@ package plugin
 
 import (
 	"fmt"
+	"time"
 )
 
 /*
@@ -55,6 +56,74 @@ func (e ExecFailure) Error() string {
 	return e.Err
 }
 
+// ExecError is returned when an external command ran, but failed (i.e. it
+// exited with an unexpected return code, or was killed by a signal).  RC is
+// -1 if the command did not exit normally, and Stderr holds the tail end of
+// what it wrote to its standard error.  The message of the error ends with
+// the summary of that output, when there is one (see SummarizeOutput).
+type ExecError struct {
+	Cmd    string
+	RC     int
+	Stderr string
+	Err    error
+}
+
+func (e ExecError) Error() string {
+	if summary := e.Summary(); summary != "" {
+		return fmt.Sprintf("Unable to exec '%s': %s: %s", e.Cmd, e.Err, summary)
+	}
+	return fmt.Sprintf("Unable to exec '%s': %s", e.Cmd, e.Err)
+}
+
+// Summary returns the summary of the error output of the command.
+func (e ExecError) Summary() string {
+	return SummarizeOutput(e.Stderr)
+}
+
+func (e ExecError) Unwrap() error {
+	return e.Err
+}
+
+// ExecTimeoutError is returned when an external command did not finish in
+// time (see ExecOptions.Timeout), and was killed.
+type ExecTimeoutError struct {
+	Cmd     string
+	Timeout time.Duration
+}
+
+func (e ExecTimeoutError) Error() string {
+	return fmt.Sprintf("'%s' timed out after %s, and was killed", e.Cmd, e.Timeout)
+}
+
+// ValidationError is returned by Validate() when the endpoint configuration
+// is not suitable for the plugin.  Details about each of the offending
+// fields have already been printed out by then.
+type ValidationError struct {
+	Plugin string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s: invalid configuration", e.Plugin)
+}
+
+// ConfigError is returned when an endpoint configuration value is present,
+// and of the right type, but does not make sense to the plugin.
+type ConfigError struct {
+	Key string
+	Err error
+}
+
+func (e ConfigError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("Invalid '%s' value in endpoint json", e.Key)
+	}
+	return e.Err.Error()
+}
+
+func (e ConfigError) Unwrap() error {
+	return e.Err
+}
+
 type JSONError struct {
 	Err string
 }
@@ -0,0 +1,45 @@
+package plugin
+
+import (
+	"fmt"
+	"os/exec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// wrapped mimics errors that plugins wrap with some more context.
+type wrapped struct {
+	msg string
+	err error
+}
+
+func (w wrapped) Error() string { return w.msg + ": " + w.err.Error() }
+func (w wrapped) Unwrap() error { return w.err }
+
+var _ = Describe("Plugin Errors", func() {
+	It("maps each kind of error to its exit code", func() {
+		Ω(codeForError(nil)).Should(Equal(SUCCESS))
+		Ω(codeForError(UnsupportedActionError{Action: "store"})).Should(Equal(UNSUPPORTED_ACTION))
+		Ω(codeForError(EndpointMissingRequiredDataError{Key: "bucket"})).Should(Equal(ENDPOINT_MISSING_KEY))
+		Ω(codeForError(EndpointDataTypeMismatchError{Key: "port", DesiredType: "string"})).Should(Equal(ENDPOINT_BAD_DATA))
+		Ω(codeForError(ConfigError{Key: "signature_version"})).Should(Equal(ENDPOINT_BAD_DATA))
+		Ω(codeForError(ExecFailure{Err: "nope"})).Should(Equal(EXEC_FAILURE))
+		Ω(codeForError(ExecError{Cmd: "tar", RC: 2, Err: &exec.ExitError{}})).Should(Equal(EXEC_FAILURE))
+		Ω(codeForError(JSONError{Err: "bad json"})).Should(Equal(JSON_FAILURE))
+		Ω(codeForError(MissingRestoreKeyError{})).Should(Equal(RESTORE_KEY_REQUIRED))
+		Ω(codeForError(ValidationError{Plugin: "fs"})).Should(Equal(PLUGIN_FAILURE))
+		Ω(codeForError(fmt.Errorf("something else"))).Should(Equal(PLUGIN_FAILURE))
+	})
+
+	It("sees through wrapped errors", func() {
+		err := wrapped{msg: "backup failed", err: ExecError{Cmd: "nodetool", RC: 1, Err: fmt.Errorf("exit status 1")}}
+		Ω(codeForError(err)).Should(Equal(EXEC_FAILURE))
+	})
+
+	It("keeps the historical messages", func() {
+		Ω(ValidationError{Plugin: "cassandra"}.Error()).Should(Equal("cassandra: invalid configuration"))
+		Ω(ConfigError{Key: "s3_restore_days", Err: fmt.Errorf("Invalid `s3_restore_days`")}.Error()).Should(Equal("Invalid `s3_restore_days`"))
+		Ω(ConfigError{Key: "s3_restore_days"}.Error()).Should(Equal("Invalid 's3_restore_days' value in endpoint json"))
+	})
+})
@@ -1,11 +1,14 @@
 package plugin
 
 import (
+	"bufio"
 	"fmt"
 	"github.com/mattn/go-shellwords"
+	"io"
 	"os"
 	"os/exec"
 	"syscall"
+	"time"
 )
 
 const NOPIPE = 0
@@ -13,44 +16,138 @@ const STDIN = 1
 const STDOUT = 2
 
 type ExecOptions struct {
-	Stdout   *os.File
-	Stdin    *os.File
+	Stdout   io.Writer
+	Stdin    io.Reader
 	Stderr   *os.File
 	Cmd      string
 	ExpectRC []int
+
+	// BufferSize, if positive, puts a buffer of that many bytes between
+	// the command and its Stdin / Stdout, so that large sequential streams
+	// (i.e. tar archives) are moved in large chunks.  Otherwise, the command
+	// reads and writes them directly.
+	BufferSize int
+
+	// RunAs, if set, is the user to run the command as.
+	RunAs *RunAs
+
+	// Timeout, if positive, is how long the command may run.  Past that,
+	// it is sent a SIGTERM (along with the processes it spawned), then a
+	// SIGKILL if it is still there ExecKillGrace later, and ExecWithOptions
+	// returns an ExecTimeoutError.
+	Timeout time.Duration
 }
 
+// How long commands that timed out get to exit on SIGTERM, before they
+// are killed for good.
+var ExecKillGrace = 10 * time.Second
+
+// How much of the standard error of failed commands to keep around,
+// in ExecError.Stderr.
+const ExecStderrTail = 4096
+
+// tailBuffer only keeps the last `max` bytes written to it.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(b []byte) (int, error) {
+	t.buf = append(t.buf, b...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(b), nil
+}
+
+// Executor is what runs the commands of ExecWithOptions() (and Exec()).
+// Tests swap it for a fake one (see FakeExec), to exercise the plugins that
+// shell out without the tools they run.
+var Executor = execWithOptions
+
 func ExecWithOptions(opts ExecOptions) error {
+	return Executor(opts)
+}
+
+func execWithOptions(opts ExecOptions) (err error) {
 	cmdArgs, err := shellwords.Parse(opts.Cmd)
 	if err != nil {
-		return ExecFailure{Err: fmt.Sprintf("Could not parse '%s' into exec-able command: %s", opts.Cmd, err.Error())}
+		return ExecFailure{Err: fmt.Sprintf("Could not parse '%s' into exec-able command: %s", Redact(opts.Cmd), err.Error())}
 	}
-	DEBUG("Executing '%s' with arguments %v", cmdArgs[0], cmdArgs[1:])
+	DEBUG("Executing '%s' with arguments %s", cmdArgs[0], Redact(fmt.Sprintf("%v", cmdArgs[1:])))
 
+	rc := 0
+	if tracing {
+		start := time.Now()
+		TRACE("%s start %s", traceStamp(start), Redact(opts.Cmd))
+		defer func() { traceExec(opts.Cmd, start, rc, err) }()
+	}
+
+	name := cmdArgs[0]
+	if heavy(name) {
+		if err = execSlots.acquire(name); err != nil {
+			return err
+		}
+		defer execSlots.release()
+	}
+	SetStep("running '%s'", name)
+	cmdArgs = execPriority.wrap(cmdArgs)
 	cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
+	if cred := opts.RunAs.credential(); cred != nil {
+		DEBUG("running '%s' as %s", name, opts.RunAs)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
+	if opts.Timeout > 0 {
+		/* in its own process group, to be killed along with its children */
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.Setpgid = true
+	}
+	var stdout *bufio.Writer
 	if opts.Stdout != nil {
 		cmd.Stdout = opts.Stdout
+		if opts.BufferSize > 0 {
+			stdout = bufio.NewWriterSize(opts.Stdout, opts.BufferSize)
+			cmd.Stdout = stdout
+		}
 	}
+	stderr := &tailBuffer{max: ExecStderrTail}
+	cmd.Stderr = stderr
 	if opts.Stderr != nil {
-		cmd.Stderr = opts.Stderr
+		cmd.Stderr = io.MultiWriter(opts.Stderr, stderr)
 	}
 	if opts.Stdin != nil {
 		cmd.Stdin = opts.Stdin
+		if opts.BufferSize > 0 {
+			cmd.Stdin = bufio.NewReaderSize(opts.Stdin, opts.BufferSize)
+		}
 	}
 
 	if len(opts.ExpectRC) == 0 {
 		opts.ExpectRC = []int{0}
 	}
 
-	err = cmd.Run()
+	err = run(cmd, opts.Timeout)
+	if _, ok := err.(ExecTimeoutError); ok {
+		rc = -1
+		return ExecTimeoutError{Cmd: name, Timeout: opts.Timeout}
+	}
+	if stdout != nil {
+		if ferr := stdout.Flush(); ferr != nil && err == nil {
+			err = ferr
+		}
+	}
 	if err != nil {
+		rc = -1
 		// make sure we got an Exit error
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			sys := exitErr.ProcessState.Sys()
 			// os.ProcessState.Sys() may not return syscall.WaitStatus on non-UNIX machines,
 			// so currently this feature only works on UNIX, but shouldn't crash on other OSes
-			if rc, ok := sys.(syscall.WaitStatus); ok {
-				code := rc.ExitStatus()
+			if status, ok := sys.(syscall.WaitStatus); ok {
+				code := status.ExitStatus()
+				rc = code
 				// -1 indicates signals, stops, or traps, so force an error
 				if code >= 0 {
 					for _, expect := range opts.ExpectRC {
@@ -61,22 +158,63 @@ func ExecWithOptions(opts ExecOptions) error {
 				}
 			}
 		}
-		return ExecFailure{Err: fmt.Sprintf("Unable to exec '%s': %s", cmdArgs[0], err.Error())}
+		if len(stderr.buf) > 0 {
+			DEBUG("'%s' failed (%s), the end of its standard error reads:\n%s", name, err, stderr.buf)
+		}
+		return ExecError{Cmd: name, RC: rc, Stderr: string(stderr.buf), Err: err}
 	}
 	return nil
 }
 
+// run runs the command, and kills its process group if it is still running
+// after `timeout` (unless it is zero).
+func run(cmd *exec.Cmd, timeout time.Duration) error {
+	if timeout <= 0 {
+		return cmd.Run()
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+	}
+	DEBUG("'%s' timed out after %s; sending SIGTERM", cmd.Path, timeout)
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(ExecKillGrace):
+		DEBUG("'%s' is still running %s after SIGTERM; sending SIGKILL", cmd.Path, ExecKillGrace)
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+	}
+	return ExecTimeoutError{Timeout: timeout}
+}
+
+// ExecBufferSize is the BufferSize used by Exec().  Plugins that stream
+// large archives to (or from) consumers that read in bursts can raise it.
+//
+// It defaults to no buffering: benchmarking a tar-like stream (10KB writes)
+// to a pipe shows the extra copy through a 64KB or 1MB buffer to be about
+// 20% slower than letting the command write to the pipe directly.
+var ExecBufferSize = 0
+
 func Exec(cmdString string, flags int) error {
 	opts := ExecOptions{
-		Cmd:    cmdString,
-		Stderr: os.Stderr,
+		Cmd:        cmdString,
+		Stderr:     os.Stderr,
+		BufferSize: ExecBufferSize,
 	}
 
 	if flags&STDOUT == STDOUT {
-		opts.Stdout = os.Stdout
+		opts.Stdout = execStdout
 	}
 	if flags&STDIN == STDIN {
-		opts.Stdin = os.Stdin
+		opts.Stdin = execStdin
 	}
 
 	return ExecWithOptions(opts)
@@ -1,9 +1,14 @@
 package plugin_test
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -99,5 +104,108 @@ var _ = Describe("Plugin Commands", func() {
 	It("Returns an error for commands that cannot be parsed", func() {
 		err := plugin.Exec("this '\"cannot be parsed", plugin.NOPIPE)
 		Expect(err).Should(HaveOccurred())
+
+		var failure plugin.ExecFailure
+		Expect(errors.As(err, &failure)).Should(BeTrue())
+	})
+	It("Returns an ExecError with the return code and stderr of failed commands", func() {
+		err := plugin.ExecWithOptions(plugin.ExecOptions{
+			Cmd: "test/bin/exec_tester 3",
+		})
+		Expect(err).Should(HaveOccurred())
+		Expect(err.Error()).Should(HavePrefix("Unable to exec 'test/bin/exec_tester': "))
+
+		var execErr plugin.ExecError
+		Expect(errors.As(err, &execErr)).Should(BeTrue())
+		Expect(execErr.RC).Should(Equal(3))
+		Expect(execErr.Stderr).Should(Equal("This goes to stderr\n"))
+
+		var exitErr *exec.ExitError
+		Expect(errors.As(err, &exitErr)).Should(BeTrue())
+	})
+	It("Kills commands that run past their timeout", func() {
+		defer func(grace time.Duration) { plugin.ExecKillGrace = grace }(plugin.ExecKillGrace)
+		plugin.ExecKillGrace = time.Second
+
+		started := time.Now()
+		err := plugin.ExecWithOptions(plugin.ExecOptions{
+			Cmd:     "sleep 30",
+			Timeout: 100 * time.Millisecond,
+		})
+		Expect(time.Since(started)).Should(BeNumerically("<", 5*time.Second))
+		Expect(err).Should(HaveOccurred())
+
+		var timeout plugin.ExecTimeoutError
+		Expect(errors.As(err, &timeout)).Should(BeTrue())
+		Expect(timeout.Cmd).Should(Equal("sleep"))
+		Expect(timeout.Timeout).Should(Equal(100 * time.Millisecond))
+
+		Expect(plugin.ExecWithOptions(plugin.ExecOptions{
+			Cmd:     "test/bin/exec_tester 0",
+			Timeout: 5 * time.Second,
+		})).Should(Succeed())
+	})
+	It("Streams stdin and stdout through a buffer, when asked to", func() {
+		data := make([]byte, 100000)
+		for i := range data {
+			data[i] = byte(i % 251)
+		}
+
+		rStdin, wStdin, err := os.Pipe()
+		Expect(err).ShouldNot(HaveOccurred())
+		go func() {
+			wStdin.Write(data)
+			wStdin.Close()
+		}()
+
+		rStdout, wStdout, err := os.Pipe()
+		Expect(err).ShouldNot(HaveOccurred())
+		stdoutC := make(chan string)
+		go drain(rStdout, stdoutC)
+
+		err = plugin.ExecWithOptions(plugin.ExecOptions{
+			Cmd:        "cat",
+			Stdin:      rStdin,
+			Stdout:     wStdout,
+			BufferSize: 4096,
+		})
+		wStdout.Close()
+
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(<-stdoutC).Should(Equal(string(data)))
 	})
 })
+
+// Stream 64MB out of a command, in 10KB records (the default blocking of
+// tar), to a consumer that reads 4KB at a time.
+//
+//	go test ./plugin -run XXX -bench ExecStdout
+func benchmarkExecStdout(b *testing.B, size int) {
+	for i := 0; i < b.N; i++ {
+		r, w, err := os.Pipe()
+		if err != nil {
+			b.Fatal(err)
+		}
+		done := make(chan int64)
+		go func() {
+			n, _ := io.CopyBuffer(ioutil.Discard, r, make([]byte, 4096))
+			done <- n
+		}()
+
+		err = plugin.ExecWithOptions(plugin.ExecOptions{
+			Cmd:        "dd if=/dev/zero bs=10240 count=6554",
+			Stdout:     w,
+			BufferSize: size,
+		})
+		w.Close()
+		b.SetBytes(<-done)
+		r.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkExecStdoutUnbuffered(b *testing.B)  { benchmarkExecStdout(b, 0) }
+func BenchmarkExecStdoutBuffered64K(b *testing.B) { benchmarkExecStdout(b, 64*1024) }
+func BenchmarkExecStdoutBuffered1M(b *testing.B)  { benchmarkExecStdout(b, 1024*1024) }
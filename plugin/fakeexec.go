@@ -0,0 +1,131 @@
+package plugin
+
+/*
+
+Plugins like cassandra and xtrabackup do most of their work with external
+commands (nodetool, xtrabackup, tar...), which test environments don't have.
+FakeExec takes the place of Executor for the duration of a test, records the
+commands that the plugin runs through Exec() and ExecWithOptions(), and runs
+the handler of the first pattern they match instead, if any, the patterns
+registered last being tried first:
+
+    fake := plugin.NewFakeExec()
+    defer fake.Restore()
+    fake.On(`/nodetool snapshot `, plugin.FakeFailure(2, "error: Snapshot shield-backup already exists."))
+    fake.On(`^tar -c `, plugin.FakeOutput("not really an archive"))
+
+    ...
+    Ω(fake.Commands()).Should(ContainElement(MatchRegexp(`nodetool clearsnapshot`)))
+
+Commands that match no pattern succeed, without output; their standard
+input, if any, is read to the end, as if they consumed it.  Commands that
+plugins run on their own (with os/exec) are not faked.
+
+*/
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// FakeCommand stands in for a command, given the options it was run with.
+type FakeCommand func(opts ExecOptions) error
+
+type fakeHandler struct {
+	pattern *regexp.Regexp
+	run     FakeCommand
+}
+
+// FakeExec is a fake Executor.
+type FakeExec struct {
+	lock     sync.Mutex
+	commands []string
+	handlers []fakeHandler
+	previous func(ExecOptions) error
+}
+
+// NewFakeExec installs a FakeExec as the Executor, until Restore is called.
+func NewFakeExec() *FakeExec {
+	f := &FakeExec{previous: Executor}
+	Executor = f.exec
+	return f
+}
+
+// Restore puts back the Executor that NewFakeExec replaced.
+func (f *FakeExec) Restore() {
+	Executor = f.previous
+}
+
+// On runs `run` instead of the commands that match the regular expression
+// `pattern`.
+func (f *FakeExec) On(pattern string, run FakeCommand) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.handlers = append(f.handlers, fakeHandler{pattern: regexp.MustCompile(pattern), run: run})
+}
+
+// Commands returns the commands that were run so far, in order.
+func (f *FakeExec) Commands() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.commands...)
+}
+
+func (f *FakeExec) exec(opts ExecOptions) error {
+	f.lock.Lock()
+	f.commands = append(f.commands, opts.Cmd)
+	var run FakeCommand
+	for i := len(f.handlers) - 1; i >= 0; i-- {
+		if f.handlers[i].pattern.MatchString(opts.Cmd) {
+			run = f.handlers[i].run
+			break
+		}
+	}
+	f.lock.Unlock()
+
+	DEBUG("Faking `%s`", Redact(opts.Cmd))
+	if run == nil {
+		if opts.Stdin != nil {
+			io.Copy(ioutil.Discard, opts.Stdin)
+		}
+		return nil
+	}
+	return run(opts)
+}
+
+// FakeOutput is a command that writes `out` on its standard output.
+func FakeOutput(out string) FakeCommand {
+	return func(opts ExecOptions) error {
+		if opts.Stdout == nil {
+			return nil
+		}
+		_, err := io.WriteString(opts.Stdout, out)
+		return err
+	}
+}
+
+// FakeFailure is a command that exits with `rc`, after writing `stderr` on
+// its standard error.  As with real commands, return codes that the options
+// expect are not failures.
+func FakeFailure(rc int, stderr string) FakeCommand {
+	return func(opts ExecOptions) error {
+		if opts.Stderr != nil {
+			io.WriteString(opts.Stderr, stderr)
+		}
+		for _, expect := range opts.ExpectRC {
+			if rc == expect {
+				return nil
+			}
+		}
+		return ExecError{
+			Cmd:    strings.Fields(opts.Cmd)[0],
+			RC:     rc,
+			Stderr: stderr,
+			Err:    fmt.Errorf("exit status %d", rc),
+		}
+	}
+}
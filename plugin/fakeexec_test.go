@@ -0,0 +1,63 @@
+package plugin
+
+import (
+	"bytes"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fake Executor", func() {
+	var fake *FakeExec
+
+	BeforeEach(func() {
+		fake = NewFakeExec()
+	})
+
+	AfterEach(func() {
+		fake.Restore()
+	})
+
+	It("records the commands, and runs the handler of the last pattern they match", func() {
+		fake.On(`^nodetool `, FakeOutput("any nodetool"))
+		fake.On(`^nodetool snapshot `, FakeOutput("snapshot taken"))
+
+		var out bytes.Buffer
+		Ω(ExecWithOptions(ExecOptions{Cmd: "nodetool snapshot -t shield-backup ks1", Stdout: &out})).Should(Succeed())
+		Ω(ExecWithOptions(ExecOptions{Cmd: "nodetool clearsnapshot -t shield-backup", Stdout: &out})).Should(Succeed())
+		Ω(Exec("/no/such/command --at-all", NOPIPE)).Should(Succeed())
+
+		Ω(out.String()).Should(Equal("snapshot takenany nodetool"))
+		Ω(fake.Commands()).Should(Equal([]string{
+			"nodetool snapshot -t shield-backup ks1",
+			"nodetool clearsnapshot -t shield-backup",
+			"/no/such/command --at-all",
+		}))
+	})
+
+	It("fails commands like they would, unless their return code is expected", func() {
+		fake.On(`^grep `, FakeFailure(1, "no match\n"))
+
+		err := ExecWithOptions(ExecOptions{Cmd: "grep -q shield /etc/hosts"})
+		Ω(err).Should(BeAssignableToTypeOf(ExecError{}))
+		Ω(err.(ExecError).Cmd).Should(Equal("grep"))
+		Ω(err.(ExecError).RC).Should(Equal(1))
+		Ω(err.(ExecError).Stderr).Should(Equal("no match\n"))
+
+		Ω(ExecWithOptions(ExecOptions{Cmd: "grep -q shield /etc/hosts", ExpectRC: []int{0, 1}})).Should(Succeed())
+	})
+
+	It("consumes the input of the commands it has no handler for", func() {
+		in := strings.NewReader("an archive")
+		Ω(ExecWithOptions(ExecOptions{Cmd: "tar -x -f -", Stdin: in})).Should(Succeed())
+		Ω(in.Len()).Should(BeZero())
+	})
+
+	It("puts the real executor back", func() {
+		fake.Restore()
+		var out bytes.Buffer
+		Ω(ExecWithOptions(ExecOptions{Cmd: "echo real", Stdout: &out})).Should(Succeed())
+		Ω(out.String()).Should(Equal("real\n"))
+	})
+})
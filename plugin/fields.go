@@ -0,0 +1,82 @@
+package plugin
+
+/*
+
+Fields describe the endpoint configuration a plugin understands, so that
+user interfaces (the web UI, the CLI) can render a form for it without
+having to know anything about the plugin itself.  See docs/plugins.md for
+the meaning of each attribute.
+
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Field types, as understood by the SHIELD user interfaces
+const (
+	TextField      = "text"
+	PasswordField  = "password"
+	MultilineField = "multiline"
+	NumberField    = "number"
+	BooleanField   = "boolean"
+	ListField      = "list"
+)
+
+// Field describes a single endpoint configuration key
+type Field struct {
+	Name        string      `json:"name"`
+	Label       string      `json:"label"`
+	Required    bool        `json:"required"`
+	Placeholder string      `json:"placeholder,omitempty"`
+	Type        string      `json:"type"`
+	Format      string      `json:"format,omitempty"`
+	Invalid     string      `json:"invalid,omitempty"`
+	Help        string      `json:"help,omitempty"`
+	Examples    []string    `json:"examples,omitempty"`
+	Default     interface{} `json:"default,omitempty"`
+	Aliases     []string    `json:"aliases,omitempty"`
+}
+
+func validFieldType(t string) bool {
+	switch t {
+	case TextField, PasswordField, MultilineField, NumberField, BooleanField, ListField:
+		return true
+	}
+	return false
+}
+
+// checkFields returns the fields of the plugin, once checked to be
+// well-formed.
+func checkFields(info PluginInfo) ([]Field, error) {
+	fields := info.Fields
+	if fields == nil {
+		fields = []Field{}
+	}
+	for _, f := range fields {
+		if f.Name == "" {
+			return nil, JSONError{Err: fmt.Sprintf("%s: configuration field with no name found", info.Name)}
+		}
+		if !validFieldType(f.Type) {
+			return nil, JSONError{Err: fmt.Sprintf("%s: configuration field '%s' has unknown type '%s'", info.Name, f.Name, f.Type)}
+		}
+		if f.Format != "" && f.Invalid == "" {
+			return nil, JSONError{Err: fmt.Sprintf("%s: configuration field '%s' has a format but no invalid message", info.Name, f.Name)}
+		}
+	}
+	return fields, nil
+}
+
+func pluginSchema(info PluginInfo) ([]byte, error) {
+	fields, err := checkFields(info)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.MarshalIndent(fields, "", "    ")
+	if err != nil {
+		return nil, JSONError{Err: fmt.Sprintf("Could not create plugin schema output: %s", err.Error())}
+	}
+	return b, nil
+}
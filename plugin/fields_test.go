@@ -0,0 +1,51 @@
+package plugin
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Plugin Schema", func() {
+	schema := func(fields []Field) ([]map[string]interface{}, error) {
+		b, err := pluginSchema(PluginInfo{Name: "schema", Fields: fields})
+		if err != nil {
+			return nil, err
+		}
+		var s []map[string]interface{}
+		Ω(json.Unmarshal(b, &s)).Should(Succeed())
+		return s, nil
+	}
+
+	It("lists the fields, in order, leaving out the attributes that are not set", func() {
+		s, err := schema([]Field{
+			{Name: "path", Label: "Path", Type: TextField, Required: true, Help: "Where the data is."},
+			{Name: "port", Label: "Port", Type: NumberField, Format: `^\d+$`, Invalid: "Not a port.", Default: 9042},
+			{Name: "keyspaces", Label: "Keyspaces", Type: ListField, Placeholder: "(unset: all keyspaces)", Aliases: []string{"keyspace"}},
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(s).Should(Equal([]map[string]interface{}{
+			{"name": "path", "label": "Path", "type": "text", "required": true, "help": "Where the data is."},
+			{"name": "port", "label": "Port", "type": "number", "required": false, "format": `^\d+$`, "invalid": "Not a port.", "default": float64(9042)},
+			{"name": "keyspaces", "label": "Keyspaces", "type": "list", "required": false, "placeholder": "(unset: all keyspaces)", "aliases": []interface{}{"keyspace"}},
+		}))
+	})
+
+	It("lists no fields as an empty list", func() {
+		b, err := pluginSchema(PluginInfo{Name: "bare"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(b)).Should(Equal("[]"))
+	})
+
+	It("refuses malformed fields", func() {
+		for _, f := range []Field{
+			{Label: "No Name", Type: TextField},
+			{Name: "path", Type: "dropdown"},
+			{Name: "port", Type: NumberField, Format: `^\d+$`},
+		} {
+			_, err := schema([]Field{f})
+			Ω(err).Should(BeAssignableToTypeOf(JSONError{}), "field %v", f)
+		}
+	})
+})
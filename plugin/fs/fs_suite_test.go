@@ -0,0 +1,12 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestFSPlugin(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "FS Plugin Test Suite")
+}
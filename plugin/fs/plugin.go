@@ -23,15 +23,29 @@
 //        "include":"glob-of-files-to-include", // optional
 //        "exclude":"glob-of-files-to-exclude", // optional
 //        "bsdtar":"path-to-bsdtar",            // optional
+//        "fs_shard_depth":2,                   // optional, for stores
 //        "base_dir":"base-directory-to-backup"
 //    }
 //
 // Default Configuration
 //
 //    {
-//        "bsdtar": "/var/vcap/packages/bsdtar/bin/bsdtar"
+//        "bsdtar": "/var/vcap/packages/bsdtar/bin/bsdtar",
+//        "fs_shard_depth": 0
 //    }
 //
+// `base_dir` must be an existing directory, that the plugin can write to.
+//
+// STORE DETAILS
+//
+// Archives are stored under `base_dir`, as `<YYYY>/<MM>/<DD>/<timestamp>-<UUID>`
+// files, which is also their storage handle. With `fs_shard_depth` set (up to
+// 4), they are spread over that many levels of subdirectories, named after the
+// SHA-1 of their storage handle (`ab/cd/<YYYY>/...` for a depth of 2), to keep
+// directories small when there are lots of archives. Retrieving and purging
+// archives computes the same path again, and looks at the other depths too,
+// so that archives stored before the depth was changed can still be found.
+//
 // BACKUP DETAILS
 //
 // The `fs` plugin uses `bsdtar` to back up all files located in `base_dir`
@@ -46,6 +60,10 @@
 // It does not clean up the directory first, so any files that exist on the FS, but are
 // not in the restored archive will not be removed.
 //
+// Archives stored with the `fs` plugin can be restored straight out of the
+// store, in a single process, with `retrieve-restore`: the archive file is
+// fed to `bsdtar` directly, instead of going through SHIELD.
+//
 // DEPENDENCIES
 //
 // This plugin relies on the `bsdtar` utility. Please ensure that it is present on the
@@ -57,7 +75,9 @@ package main
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/starkandwayne/goutils/ansi"
@@ -85,13 +105,16 @@ func main() {
   "include"  : "*.txt",            # UNIX glob of files to include in backup
   "exclude"  : "*.o",              # ... and another for what to exclude
 
-  "bsdtar"   : "/usr/bin/bsdtar"   # where is the BSD tar utility?
+  "bsdtar"   : "/usr/bin/bsdtar",  # where is the BSD tar utility?
                                    # (GNU tar is insufficient)
+
+  "fs_shard_depth" : 2             # spread stored archives over ab/cd/ subdirectories
 }
 `,
 		Defaults: `
 {
-  "bsdtar" : "/var/vcap/packages/bsdtar/bin/bsdtar"
+  "bsdtar" : "/var/vcap/packages/bsdtar/bin/bsdtar",
+  "fs_shard_depth" : 0
 }
 `,
 	}
@@ -103,10 +126,11 @@ func main() {
 type FSPlugin plugin.PluginInfo
 
 type FSConfig struct {
-	Include  string
-	Exclude  string
-	BasePath string
-	BsdTar   string
+	Include    string
+	Exclude    string
+	BasePath   string
+	BsdTar     string
+	ShardDepth int
 }
 
 func (p FSPlugin) Meta() plugin.PluginInfo {
@@ -134,14 +158,41 @@ func getFSConfig(endpoint plugin.ShieldEndpoint) (*FSConfig, error) {
 		return nil, err
 	}
 
+	depth, err := endpoint.FloatValueDefault("fs_shard_depth", DefaultShardDepth)
+	if err != nil {
+		return nil, err
+	}
+	if depth < 0 || depth > MaxShardDepth || depth != float64(int(depth)) {
+		return nil, plugin.ConfigError{Key: "fs_shard_depth", Err: fmt.Errorf("Invalid `fs_shard_depth` specified (`%v`). Expected a whole number between 0 and %d", depth, MaxShardDepth)}
+	}
+
 	return &FSConfig{
-		Include:  include,
-		Exclude:  exclude,
-		BasePath: base_dir,
-		BsdTar:   bsdtar,
+		Include:    include,
+		Exclude:    exclude,
+		BasePath:   base_dir,
+		BsdTar:     bsdtar,
+		ShardDepth: int(depth),
 	}, nil
 }
 
+// checkBaseDir makes sure that the base directory exists, and that files
+// can be written to it, by creating (and removing) one.
+func checkBaseDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := ioutil.TempFile(dir, ".shield-fs-")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %s", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
 func (p FSPlugin) Validate(endpoint plugin.ShieldEndpoint) error {
 	var (
 		s    string
@@ -153,6 +204,9 @@ func (p FSPlugin) Validate(endpoint plugin.ShieldEndpoint) error {
 	if err != nil {
 		ansi.Printf("@R{\u2717 base_dir  %s}\n", err)
 		fail = true
+	} else if err = checkBaseDir(s); err != nil {
+		ansi.Printf("@R{\u2717 base_dir  %s}\n", err)
+		fail = true
 	} else {
 		ansi.Printf("@G{\u2713 base_dir}  files in @C{%s} will be backed up\n", s)
 	}
@@ -187,8 +241,21 @@ func (p FSPlugin) Validate(endpoint plugin.ShieldEndpoint) error {
 		ansi.Printf("@G{\u2713 bsdtar}    @C{%s}\n", s)
 	}
 
+	f, err := endpoint.FloatValueDefault("fs_shard_depth", DefaultShardDepth)
+	if err != nil {
+		ansi.Printf("@R{\u2717 fs_shard_depth  %s}\n", err)
+		fail = true
+	} else if f < 0 || f > MaxShardDepth || f != float64(int(f)) {
+		ansi.Printf("@R{\u2717 fs_shard_depth  must be a whole number between 0 and %d}\n", MaxShardDepth)
+		fail = true
+	} else if f == 0 {
+		ansi.Printf("@G{\u2713 fs_shard_depth}  archives will be stored right under base_dir\n")
+	} else {
+		ansi.Printf("@G{\u2713 fs_shard_depth}  @C{%d} levels of subdirectories\n", int(f))
+	}
+
 	if fail {
-		return fmt.Errorf("fs: invalid configuration")
+		return plugin.ValidationError{Plugin: "fs"}
 	}
 	return nil
 }
@@ -218,6 +285,10 @@ func (p FSPlugin) Backup(endpoint plugin.ShieldEndpoint) error {
 }
 
 func (p FSPlugin) Restore(endpoint plugin.ShieldEndpoint) error {
+	return p.RestoreFrom(endpoint, os.Stdin)
+}
+
+func (p FSPlugin) RestoreFrom(endpoint plugin.ShieldEndpoint, in io.Reader) error {
 	cfg, err := getFSConfig(endpoint)
 	if err != nil {
 		return err
@@ -226,7 +297,12 @@ func (p FSPlugin) Restore(endpoint plugin.ShieldEndpoint) error {
 	os.MkdirAll(cfg.BasePath, 0777)
 	cmd := fmt.Sprintf("%s -x -C %s -f -", cfg.BsdTar, cfg.BasePath)
 	plugin.DEBUG("Executing `%s`", cmd)
-	err = plugin.Exec(cmd, plugin.STDIN)
+	err = plugin.ExecWithOptions(plugin.ExecOptions{
+		Cmd:        cmd,
+		Stdin:      in,
+		Stderr:     os.Stderr,
+		BufferSize: plugin.ExecBufferSize,
+	})
 	if err != nil {
 		return err
 	}
@@ -247,40 +323,50 @@ func (p FSPlugin) Store(endpoint plugin.ShieldEndpoint) (string, error) {
 
 	dir := fmt.Sprintf("%04d/%02d/%02d", year, mon, day)
 	file := fmt.Sprintf("%04d-%02d-%02d-%02d%02d%02d-%s", year, mon, day, hour, min, sec, uuid)
+	key := fmt.Sprintf("%s/%s", dir, file)
+	path := shardPath(cfg.BasePath, key, cfg.ShardDepth)
 
-	err = os.MkdirAll(fmt.Sprintf("%s/%s", cfg.BasePath, dir), 0777) // umask will lower...
+	err = os.MkdirAll(filepath.Dir(path), 0777) // umask will lower...
 	if err != nil {
 		return "", err
 	}
 
-	f, err := os.Create(fmt.Sprintf("%s/%s/%s", cfg.BasePath, dir, file))
+	f, err := os.Create(path)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
 
-	if _, err = io.Copy(f, os.Stdin); err != nil {
+	n, err := io.Copy(f, os.Stdin)
+	if err != nil {
 		return "", err
 	}
+	plugin.ReportBytes(n)
 
-	return fmt.Sprintf("%s/%s", dir, file), nil
+	return key, nil
 }
 
 func (p FSPlugin) Retrieve(endpoint plugin.ShieldEndpoint, file string) error {
+	return p.RetrieveTo(endpoint, file, os.Stdout)
+}
+
+func (p FSPlugin) RetrieveTo(endpoint plugin.ShieldEndpoint, file string, out io.Writer) error {
 	cfg, err := getFSConfig(endpoint)
 	if err != nil {
 		return err
 	}
 
-	f, err := os.Open(fmt.Sprintf("%s/%s", cfg.BasePath, file))
+	f, err := os.Open(cfg.locate(file))
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	if _, err = io.Copy(os.Stdout, f); err != nil {
+	n, err := io.Copy(out, f)
+	if err != nil {
 		return err
 	}
+	plugin.ReportBytes(n)
 
 	return nil
 }
@@ -291,7 +377,7 @@ func (p FSPlugin) Purge(endpoint plugin.ShieldEndpoint, file string) error {
 		return err
 	}
 
-	err = os.Remove(fmt.Sprintf("%s/%s", cfg.BasePath, file))
+	err = os.Remove(cfg.locate(file))
 	if err != nil {
 		return err
 	}
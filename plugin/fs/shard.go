@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Sharding
+//
+// When `fs_shard_depth` is set, archives are not stored right under
+// `base_dir`, but `fs_shard_depth` levels of directories deeper, in
+// directories named after the first bytes of the SHA-1 of their key
+// (`ab/cd/<key>` for a depth of 2), so that no directory ends up holding
+// too many of them.  The key that SHIELD is handed back is the same either
+// way, and the path of an archive is computed from it again on retrieve and
+// purge.  Archives stored with another depth (i.e. before the sharding was
+// enabled) are looked for at the other depths too, so that changing it
+// does not lose track of them.
+
+const (
+	DefaultShardDepth = 0
+	MaxShardDepth     = 4
+)
+
+// shardDir returns the shard directories of a key, for the given depth.
+func shardDir(key string, depth int) string {
+	sum := sha1.Sum([]byte(key))
+	h := hex.EncodeToString(sum[:])
+	dirs := make([]string, depth)
+	for i := range dirs {
+		dirs[i] = h[2*i : 2*i+2]
+	}
+	return filepath.Join(dirs...)
+}
+
+// shardPath returns where the archive of a key is stored, for the given
+// depth.
+func shardPath(base, key string, depth int) string {
+	return filepath.Join(base, shardDir(key, depth), strings.TrimPrefix(key, "/"))
+}
+
+// locate returns the path of the archive of a key, trying the configured
+// depth first, then the other ones.  When the archive is nowhere to be
+// found, the path for the configured depth is returned, for the error to
+// tell about it.
+func (cfg *FSConfig) locate(key string) string {
+	path := shardPath(cfg.BasePath, key, cfg.ShardDepth)
+	if fileExists(path) {
+		return path
+	}
+	for depth := 0; depth <= MaxShardDepth; depth++ {
+		if depth == cfg.ShardDepth {
+			continue
+		}
+		if other := shardPath(cfg.BasePath, key, depth); fileExists(other) {
+			return other
+		}
+	}
+	return path
+}
+
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
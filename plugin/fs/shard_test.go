@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("Sharding", func() {
+	var base string
+
+	BeforeEach(func() {
+		var err error
+		base, err = ioutil.TempDir("", "shield-fs-")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(base)
+	})
+
+	key := "2024/01/02/2024-01-02-030405-0f0e0d0c-0b0a-4908-8706-050403020100"
+
+	It("derives the shard directories from the hash of the key", func() {
+		/* sha1(key) starts with c01b */
+		Ω(shardDir(key, 0)).Should(Equal(""))
+		Ω(shardDir(key, 1)).Should(Equal("c0"))
+		Ω(shardDir(key, 2)).Should(Equal("c0/1b"))
+		Ω(shardPath("/store", key, 2)).Should(Equal("/store/c0/1b/" + key))
+		Ω(shardPath("/store", key, 0)).Should(Equal("/store/" + key))
+	})
+
+	It("always computes the same path for the same key", func() {
+		for depth := 0; depth <= MaxShardDepth; depth++ {
+			Ω(shardPath("/store", key, depth)).Should(Equal(shardPath("/store", key, depth)))
+		}
+		Ω(shardDir("2024/01/02/other", 2)).ShouldNot(Equal(shardDir(key, 2)))
+	})
+
+	It("finds archives stored with another depth", func() {
+		cfg := &FSConfig{BasePath: base, ShardDepth: 2}
+		Ω(cfg.locate(key)).Should(Equal(shardPath(base, key, 2)))
+
+		legacy := shardPath(base, key, 0)
+		Ω(os.MkdirAll(filepath.Dir(legacy), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(legacy, []byte("archive"), 0644)).Should(Succeed())
+		Ω(cfg.locate(key)).Should(Equal(legacy))
+
+		sharded := shardPath(base, key, 2)
+		Ω(os.MkdirAll(filepath.Dir(sharded), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(sharded, []byte("archive"), 0644)).Should(Succeed())
+		Ω(cfg.locate(key)).Should(Equal(sharded))
+	})
+
+	It("retrieves and purges archives from their shard", func() {
+		endpoint := plugin.ShieldEndpoint{"base_dir": base, "fs_shard_depth": 2.0}
+		path := shardPath(base, key, 2)
+		Ω(os.MkdirAll(filepath.Dir(path), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(path, []byte("archive"), 0644)).Should(Succeed())
+
+		var out bytes.Buffer
+		Ω(FSPlugin{}.RetrieveTo(endpoint, key, &out)).Should(Succeed())
+		Ω(out.String()).Should(Equal("archive"))
+		Ω(FSPlugin{}.Purge(endpoint, key)).Should(Succeed())
+		Ω(fileExists(path)).Should(BeFalse())
+	})
+
+	It("only accepts a few levels of shards", func() {
+		endpoint := plugin.ShieldEndpoint{"base_dir": base, "fs_shard_depth": 2.0}
+		cfg, err := getFSConfig(endpoint)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(cfg.ShardDepth).Should(Equal(2))
+
+		for _, depth := range []float64{-1, 1.5, MaxShardDepth + 1} {
+			endpoint["fs_shard_depth"] = depth
+			_, err = getFSConfig(endpoint)
+			Ω(err).Should(HaveOccurred(), "depth %v", depth)
+		}
+	})
+
+	It("requires an existing and writable base directory", func() {
+		Ω(checkBaseDir(base)).Should(Succeed())
+		Ω(checkBaseDir(filepath.Join(base, "nope"))).ShouldNot(Succeed())
+
+		file := filepath.Join(base, "file")
+		Ω(ioutil.WriteFile(file, []byte{}, 0644)).Should(Succeed())
+		Ω(checkBaseDir(file)).Should(MatchError(file + " is not a directory"))
+	})
+})
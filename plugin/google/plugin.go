@@ -153,7 +153,7 @@ func (p GooglePlugin) Validate(endpoint plugin.ShieldEndpoint) error {
 	}
 
 	if fail {
-		return fmt.Errorf("google: invalid configuration")
+		return plugin.ValidationError{Plugin: "google"}
 	}
 	return nil
 }
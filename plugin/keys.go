@@ -0,0 +1,126 @@
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Key Providers
+//
+// Plugins that encrypt archives need keys, which are best kept out of the
+// endpoint (and thus out of the SHIELD database).  A KeyProvider fetches
+// the key when it is needed, from wherever the `key_provider` endpoint key
+// says:
+//
+//    file   the contents of the `key_file` file, on the host the plugin
+//           runs on (a trailing newline is not part of the key)
+//    env    the value of the `key_env` environment variable of the plugin
+//
+// Key management services (AWS KMS, Vault...) hand out data keys, wrapped
+// in a master key they keep.  Providers for them fit the same interface,
+// with a factory registered under their name (see RegisterKeyProvider);
+// none ships yet.
+
+// KeyProvider fetches the key that a plugin encrypts or decrypts with.
+type KeyProvider interface {
+	// Key returns the key.
+	Key() ([]byte, error)
+
+	// String tells where the key comes from, without revealing it, for
+	// the `validate` action and debug logs.
+	String() string
+}
+
+// KeyProviderFactory returns the KeyProvider that an endpoint configures.
+type KeyProviderFactory func(endpoint ShieldEndpoint) (KeyProvider, error)
+
+var keyProviders = map[string]KeyProviderFactory{
+	"file": newFileKeyProvider,
+	"env":  newEnvKeyProvider,
+}
+
+// RegisterKeyProvider makes a kind of KeyProvider available, under the name
+// that `key_provider` selects it with.  Registering a name again replaces
+// its factory, i.e. with a fake provider, in tests.
+func RegisterKeyProvider(name string, factory KeyProviderFactory) {
+	keyProviders[name] = factory
+}
+
+// GetKeyProvider returns the KeyProvider that the `key_provider` key of the
+// endpoint selects, or nil when it is not set.
+func GetKeyProvider(endpoint ShieldEndpoint) (KeyProvider, error) {
+	name, err := endpoint.StringValueDefault("key_provider", "")
+	if err != nil || name == "" {
+		return nil, err
+	}
+	factory, ok := keyProviders[name]
+	if !ok {
+		names := []string{}
+		for name := range keyProviders {
+			names = append(names, "'"+name+"'")
+		}
+		sort.Strings(names)
+		return nil, ConfigError{Key: "key_provider", Err: fmt.Errorf("unknown key provider '%s' (expecting %s)", name, strings.Join(names, ", "))}
+	}
+	return factory(endpoint)
+}
+
+// FileKeyProvider reads the key from a file.
+type FileKeyProvider struct {
+	Path string
+}
+
+func newFileKeyProvider(endpoint ShieldEndpoint) (KeyProvider, error) {
+	path, err := endpoint.StringValue("key_file")
+	if err != nil {
+		return nil, err
+	}
+	return FileKeyProvider{Path: path}, nil
+}
+
+// Key reads the file, less its trailing newline.
+func (p FileKeyProvider) Key() ([]byte, error) {
+	b, err := ioutil.ReadFile(p.Path)
+	if err != nil {
+		return nil, ConfigError{Key: "key_file", Err: fmt.Errorf("unable to read the key file: %s", err)}
+	}
+	b = bytes.TrimRight(b, "\r\n")
+	if len(b) == 0 {
+		return nil, ConfigError{Key: "key_file", Err: fmt.Errorf("key file %s is empty", p.Path)}
+	}
+	return b, nil
+}
+
+func (p FileKeyProvider) String() string {
+	return fmt.Sprintf("file %s", p.Path)
+}
+
+// EnvKeyProvider takes the key from an environment variable.
+type EnvKeyProvider struct {
+	Name string
+}
+
+func newEnvKeyProvider(endpoint ShieldEndpoint) (KeyProvider, error) {
+	name, err := endpoint.StringValue("key_env")
+	if err != nil {
+		return nil, err
+	}
+	return EnvKeyProvider{Name: name}, nil
+}
+
+// Key returns the value of the variable.
+func (p EnvKeyProvider) Key() ([]byte, error) {
+	key, ok := os.LookupEnv(p.Name)
+	if !ok || key == "" {
+		return nil, ConfigError{Key: "key_env", Err: fmt.Errorf("environment variable $%s is not set", p.Name)}
+	}
+	return []byte(key), nil
+}
+
+func (p EnvKeyProvider) String() string {
+	return fmt.Sprintf("environment variable $%s", p.Name)
+}
@@ -0,0 +1,95 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+/* fakeKeyProvider hands out a fixed key, as a key management service would */
+type fakeKeyProvider struct {
+	key string
+}
+
+func (p fakeKeyProvider) Key() ([]byte, error) {
+	return []byte(p.key), nil
+}
+
+func (p fakeKeyProvider) String() string {
+	return "the fake key service"
+}
+
+var _ = Describe("Key Providers", func() {
+	var tmp string
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-keys-")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	It("has no key provider unless key_provider is set", func() {
+		p, err := GetKeyProvider(ShieldEndpoint{"key_file": "/path/to/key"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(p).Should(BeNil())
+	})
+
+	It("reads keys from files, less their trailing newline", func() {
+		path := filepath.Join(tmp, "key")
+		Ω(ioutil.WriteFile(path, []byte("s3cr3t\n"), 0600)).Should(Succeed())
+
+		p, err := GetKeyProvider(ShieldEndpoint{"key_provider": "file", "key_file": path})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(p.String()).Should(Equal("file " + path))
+		Ω(p.Key()).Should(Equal([]byte("s3cr3t")))
+
+		Ω(ioutil.WriteFile(path, []byte("\n"), 0600)).Should(Succeed())
+		_, err = p.Key()
+		Ω(err).Should(MatchError(ContainSubstring("is empty")))
+
+		_, err = FileKeyProvider{Path: filepath.Join(tmp, "nope")}.Key()
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("takes keys from environment variables", func() {
+		defer os.Unsetenv("SHIELD_TEST_KEY")
+		os.Setenv("SHIELD_TEST_KEY", "s3cr3t")
+
+		p, err := GetKeyProvider(ShieldEndpoint{"key_provider": "env", "key_env": "SHIELD_TEST_KEY"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(p.String()).Should(Equal("environment variable $SHIELD_TEST_KEY"))
+		Ω(p.Key()).Should(Equal([]byte("s3cr3t")))
+
+		os.Unsetenv("SHIELD_TEST_KEY")
+		_, err = p.Key()
+		Ω(err).Should(MatchError(ContainSubstring("is not set")))
+	})
+
+	It("requires the settings of the provider", func() {
+		_, err := GetKeyProvider(ShieldEndpoint{"key_provider": "file"})
+		Ω(err).Should(Equal(EndpointMissingRequiredDataError{Key: "key_file"}))
+		_, err = GetKeyProvider(ShieldEndpoint{"key_provider": "env"})
+		Ω(err).Should(Equal(EndpointMissingRequiredDataError{Key: "key_env"}))
+	})
+
+	It("rejects unknown providers, and takes registered ones", func() {
+		_, err := GetKeyProvider(ShieldEndpoint{"key_provider": "fake"})
+		Ω(err).Should(MatchError("unknown key provider 'fake' (expecting 'env', 'file')"))
+
+		RegisterKeyProvider("fake", func(endpoint ShieldEndpoint) (KeyProvider, error) {
+			return fakeKeyProvider{key: "k3y"}, nil
+		})
+		defer delete(keyProviders, "fake")
+
+		p, err := GetKeyProvider(ShieldEndpoint{"key_provider": "fake"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(p.Key()).Should(Equal([]byte("k3y")))
+	})
+})
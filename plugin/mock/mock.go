@@ -129,7 +129,7 @@ func (p MockPlugin) Validate(endpoint plugin.ShieldEndpoint) error {
 	}
 
 	if fail {
-		return fmt.Errorf("mock plugin: invalid configuration")
+		return plugin.ValidationError{Plugin: "mock plugin"}
 	}
 	return nil
 }
@@ -175,7 +175,7 @@ func (p MongoPlugin) Validate(endpoint ShieldEndpoint) error {
 	}
 
 	if fail {
-		return fmt.Errorf("mongo: invalid configuration")
+		return ValidationError{Plugin: "mongo"}
 	}
 	return nil
 }
@@ -250,6 +250,7 @@ func mongoConnectionInfo(endpoint ShieldEndpoint) (*MongoConnectionInfo, error)
 		return nil, err
 	}
 	DEBUG("MONGO_PWD: '%s'", password)
+	RegisterSecret(password)
 
 	host, err := endpoint.StringValueDefault("mongo_host", DefaultHost)
 	if err != nil {
@@ -0,0 +1,12 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestMySQLPlugin(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "MySQL Plugin Test Suite")
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/starkandwayne/goutils/ansi"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+// Databases that only hold server metadata, and that cannot (and need not)
+// be dumped and restored.
+var SystemDatabases = []string{"information_schema", "performance_schema", "sys"}
+
+func isSystemDatabase(name string) bool {
+	for _, db := range SystemDatabases {
+		if name == db {
+			return true
+		}
+	}
+	return false
+}
+
+// listDatabases returns the databases to dump in parallel mode; either
+// those from `mysql_database`, or all the non-system databases the
+// server knows about.
+func listDatabases(info *MySQLConnectionInfo) ([]string, error) {
+	if info.Database != "" {
+		return strings.Fields(info.Database), nil
+	}
+
+	dsn, err := connectionclientString(info)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SHOW DATABASES")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dbs []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if !isSystemDatabase(name) {
+			dbs = append(dbs, name)
+		}
+	}
+	return dbs, rows.Err()
+}
+
+// dumpOptions makes sure that each mysqldump process runs its own
+// consistent transaction.  Consistency only holds per database, since
+// each one is dumped over a separate connection.
+func dumpOptions(options string) string {
+	for _, opt := range strings.Fields(options) {
+		if opt == "--single-transaction" {
+			return options
+		}
+	}
+	return strings.TrimSpace(options + " --single-transaction")
+}
+
+// parallelBackup dumps each database to its own file, using up to
+// `parallelism` concurrent mysqldump processes, and then writes all of
+// the dumps to standard output, as a tar archive of `<database>.sql` files.
+// If any of the dumps fails, nothing is written, and the error names all of
+// the databases that failed.
+func parallelBackup(info *MySQLConnectionInfo, parallelism int) error {
+	dbs, err := listDatabases(info)
+	if err != nil {
+		ansi.Fprintf(os.Stderr, "@R{\u2717 List databases to back up}\n")
+		return err
+	}
+	ansi.Fprintf(os.Stderr, "@G{\u2713 List databases to back up} (%d found)\n", len(dbs))
+
+	dir, err := ioutil.TempDir("", "shield-mysql-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	options := dumpOptions(info.Options)
+	jobs := make(chan string)
+	errs := make(chan string, len(dbs))
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for db := range jobs {
+				if err := dumpDatabase(info, options, db, filepath.Join(dir, db+".sql")); err != nil {
+					ansi.Fprintf(os.Stderr, "@R{\u2717 Dump database %s}\n", db)
+					errs <- fmt.Sprintf("%s: %s", db, err)
+					continue
+				}
+				ansi.Fprintf(os.Stderr, "@G{\u2713 Dump database %s}\n", db)
+			}
+		}()
+	}
+	for _, db := range dbs {
+		jobs <- db
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+
+	failed := []string{}
+	for err := range errs {
+		failed = append(failed, err)
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("unable to dump %d of %d database(s):\n  %s", len(failed), len(dbs), strings.Join(failed, "\n  "))
+	}
+
+	if err := writeArchive(os.Stdout, dir, dbs); err != nil {
+		ansi.Fprintf(os.Stderr, "@R{\u2717 Stream archive of database dumps}\n")
+		return err
+	}
+	ansi.Fprintf(os.Stderr, "@G{\u2713 Stream archive of database dumps}\n")
+	return nil
+}
+
+func dumpDatabase(info *MySQLConnectionInfo, options, db, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	single := *info
+	single.Database = db
+	cmd := fmt.Sprintf("%s/mysqldump %s %s", info.Bin, options, connectionString(&single, true))
+	DEBUG("Executing: `%s` > %s", cmd, path)
+	return ExecWithOptions(ExecOptions{
+		Cmd:    cmd,
+		Stdout: f,
+		Stderr: os.Stderr,
+	})
+}
+
+func writeArchive(out io.Writer, dir string, dbs []string) error {
+	tw := tar.NewWriter(out)
+	for _, db := range dbs {
+		path := filepath.Join(dir, db+".sql")
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// isArchive checks for the magic number of (POSIX / GNU) tar archives,
+// to tell the output of a parallel backup from a plain SQL dump.
+func isArchive(header []byte) bool {
+	return len(header) >= 262 && bytes.HasPrefix(header[257:], []byte("ustar"))
+}
+
+// restoreStream feeds a backup to the `mysql` client command; each of the
+// `<database>.sql` files of a parallel backup archive gets its own run of
+// the client, and plain SQL dumps are fed as-is.
+func restoreStream(cmd string, in io.Reader) error {
+	r := bufio.NewReaderSize(in, 1024)
+	header, _ := r.Peek(512)
+	if !isArchive(header) {
+		return feed(cmd, r)
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !strings.HasSuffix(hdr.Name, ".sql") {
+			DEBUG("skipping unexpected archive entry '%s'", hdr.Name)
+			continue
+		}
+		db := strings.TrimSuffix(filepath.Base(hdr.Name), ".sql")
+		if err := feed(cmd, tr); err != nil {
+			ansi.Fprintf(os.Stderr, "@R{\u2717 Restore database %s}\n", db)
+			return err
+		}
+		ansi.Fprintf(os.Stderr, "@G{\u2713 Restore database %s}\n", db)
+	}
+}
+
+// feed runs cmd with the contents of in as its standard input.
+func feed(cmd string, in io.Reader) error {
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(wr, in)
+		wr.Close()
+		copied <- err
+	}()
+
+	DEBUG("Exec: %s", cmd)
+	err = ExecWithOptions(ExecOptions{
+		Cmd:    cmd,
+		Stdin:  rd,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	})
+	rd.Close()
+	if cerr := <-copied; err == nil && cerr != nil {
+		err = cerr
+	}
+	return err
+}
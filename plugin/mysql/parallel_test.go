@@ -0,0 +1,196 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("Parallel Backups", func() {
+	var (
+		tmp  string
+		fake *FakeExec
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-mysql-parallel-")
+		Ω(err).ShouldNot(HaveOccurred())
+		fake = NewFakeExec()
+	})
+
+	AfterEach(func() {
+		fake.Restore()
+		os.RemoveAll(tmp)
+	})
+
+	/* stdout runs fn, and returns what it wrote on its standard output */
+	stdout := func(fn func() error) ([]byte, error) {
+		f, err := ioutil.TempFile(tmp, "stdout")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer f.Close()
+
+		saved := os.Stdout
+		os.Stdout = f
+		err = fn()
+		os.Stdout = saved
+
+		b, rerr := ioutil.ReadFile(f.Name())
+		Ω(rerr).ShouldNot(HaveOccurred())
+		return b, err
+	}
+
+	/* entries returns the names and contents of the files of a tar archive */
+	entries := func(b []byte) ([]string, map[string]string) {
+		names := []string{}
+		files := map[string]string{}
+		tr := tar.NewReader(bytes.NewReader(b))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return names, files
+			}
+			Ω(err).ShouldNot(HaveOccurred())
+			data, err := ioutil.ReadAll(tr)
+			Ω(err).ShouldNot(HaveOccurred())
+			names = append(names, hdr.Name)
+			files[hdr.Name] = string(data)
+		}
+	}
+
+	archive := func(files ...string) []byte {
+		var b bytes.Buffer
+		tw := tar.NewWriter(&b)
+		for i := 0; i < len(files); i += 2 {
+			Ω(tw.WriteHeader(&tar.Header{Name: files[i], Mode: 0644, Size: int64(len(files[i+1]))})).Should(Succeed())
+			_, err := tw.Write([]byte(files[i+1]))
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+		Ω(tw.Close()).Should(Succeed())
+		return b.Bytes()
+	}
+
+	/* fed records what each run of the mysql client was fed */
+	var (
+		lock sync.Mutex
+		fed  []string
+	)
+	client := func(opts ExecOptions) error {
+		b, err := ioutil.ReadAll(opts.Stdin)
+		lock.Lock()
+		fed = append(fed, string(b))
+		lock.Unlock()
+		return err
+	}
+	BeforeEach(func() {
+		fed = nil
+	})
+
+	info := func(dbs string) *MySQLConnectionInfo {
+		return &MySQLConnectionInfo{Bin: "/usr/bin", Host: "db", Port: "3306", User: "root", Database: dbs}
+	}
+
+	It("archives the dumps in the order of the databases, whichever finishes first", func() {
+		for _, db := range []string{"zeta", "alpha", "mid"} {
+			fake.On(`/mysqldump .*--databases `+db+` `, FakeOutput("-- dump of "+db+"\n"))
+		}
+
+		b, err := stdout(func() error { return parallelBackup(info("zeta alpha mid"), 3) })
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(isArchive(b)).Should(BeTrue())
+
+		names, files := entries(b)
+		Ω(names).Should(Equal([]string{"zeta.sql", "alpha.sql", "mid.sql"}))
+		Ω(files["alpha.sql"]).Should(Equal("-- dump of alpha\n"))
+
+		/* each mysqldump runs its own transaction */
+		for _, cmd := range fake.Commands() {
+			Ω(cmd).Should(MatchRegexp(`^/usr/bin/mysqldump --single-transaction --databases \w+ -h db -P 3306 -u root$`))
+		}
+		Ω(fake.Commands()).Should(HaveLen(3))
+	})
+
+	It("writes dumps that take more than one read into the archive whole", func() {
+		big := bytes.Repeat([]byte("INSERT INTO t VALUES (1);\n"), 10000)
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "app.sql"), big, 0644)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "empty.sql"), nil, 0644)).Should(Succeed())
+
+		var b bytes.Buffer
+		Ω(writeArchive(&b, tmp, []string{"empty", "app"})).Should(Succeed())
+		names, files := entries(b.Bytes())
+		Ω(names).Should(Equal([]string{"empty.sql", "app.sql"}))
+		Ω(files["app.sql"]).Should(Equal(string(big)))
+		Ω(files["empty.sql"]).Should(BeEmpty())
+
+		Ω(writeArchive(&b, tmp, []string{"missing"})).ShouldNot(Succeed())
+	})
+
+	It("names all of the databases whose dump failed, and writes nothing", func() {
+		fake.On(`/mysqldump .*--databases (bad1|bad2) `, FakeFailure(2, "mysqldump: Got error: 1044: Access denied"))
+
+		b, err := stdout(func() error { return parallelBackup(info("good1 bad2 good2 bad1"), 2) })
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(HavePrefix("unable to dump 2 of 4 database(s):\n  bad1: "))
+		Ω(err.Error()).Should(MatchRegexp(`\n  bad2: .*exit status 2`))
+		Ω(err.Error()).ShouldNot(ContainSubstring("good"))
+		Ω(b).Should(BeEmpty())
+
+		/* the other databases were dumped all the same */
+		Ω(fake.Commands()).Should(HaveLen(4))
+	})
+
+	It("tells archives from plain SQL dumps", func() {
+		Ω(isArchive(archive("app.sql", "SELECT 1;"))).Should(BeTrue())
+		Ω(isArchive([]byte("-- MySQL dump 10.13\nCREATE DATABASE app;\n"))).Should(BeFalse())
+		Ω(isArchive(nil)).Should(BeFalse())
+		Ω(isArchive(bytes.Repeat([]byte("x"), 600))).Should(BeFalse())
+	})
+
+	It("feeds plain SQL dumps to a single run of the client, as-is", func() {
+		fake.On(`^/usr/bin/mysql `, client)
+		dump := "-- MySQL dump 10.13\n" + string(bytes.Repeat([]byte("INSERT INTO t VALUES (1);\n"), 1000))
+		Ω(restoreStream("/usr/bin/mysql -h db", bytes.NewReader([]byte(dump)))).Should(Succeed())
+		Ω(fed).Should(Equal([]string{dump}))
+
+		Ω(restoreStream("/usr/bin/mysql -h db", bytes.NewReader([]byte("SELECT 1;")))).Should(Succeed())
+		Ω(fed).Should(HaveLen(2))
+		Ω(fed[1]).Should(Equal("SELECT 1;"))
+	})
+
+	It("feeds each dump of an archive to its own run of the client, in order", func() {
+		fake.On(`^/usr/bin/mysql `, client)
+		in := archive(
+			"zeta.sql", "-- dump of zeta\n",
+			"README", "not a dump",
+			"alpha.sql", "-- dump of alpha\n",
+		)
+		Ω(restoreStream("/usr/bin/mysql -h db", bytes.NewReader(in))).Should(Succeed())
+		Ω(fed).Should(Equal([]string{"-- dump of zeta\n", "-- dump of alpha\n"}))
+	})
+
+	It("stops at the first database it can't restore", func() {
+		runs := 0
+		fake.On(`^/usr/bin/mysql `, func(opts ExecOptions) error {
+			if runs++; runs == 2 {
+				ioutil.ReadAll(opts.Stdin)
+				return FakeFailure(1, "ERROR 1046 (3D000): No database selected")(opts)
+			}
+			return client(opts)
+		})
+		in := archive("a.sql", "-- a\n", "b.sql", "-- b\n", "c.sql", "-- c\n")
+		err := restoreStream("/usr/bin/mysql -h db", bytes.NewReader(in))
+		Ω(err).Should(HaveOccurred())
+		Ω(fed).Should(Equal([]string{"-- a\n"}))
+		Ω(fake.Commands()).Should(HaveLen(2))
+		Ω(err.Error()).Should(ContainSubstring("exit status 1"))
+	})
+})
@@ -25,7 +25,12 @@
 //        "mysql_read_replica" : "hostname/ip",  # optional
 //        "mysql_database"     : "db",           # optional
 //        "mysql_options"      : "--quick",      # optional
-//        "mysql_bindir"       : "/path/to/bin"  # optional
+//        "mysql_bindir"       : "/path/to/bin", # optional
+//        "mysql_dump_parallelism" : 1,          # optional
+//        "mysql_ssl_mode"     : "verify-full",  # optional
+//        "mysql_ssl_ca"       : "/path/to/ca.pem",     # optional
+//        "mysql_ssl_cert"     : "/path/to/client.pem", # optional
+//        "mysql_ssl_key"      : "/path/to/client.key"  # optional
 //    }
 //
 // Default Configuration
@@ -33,7 +38,8 @@
 //    {
 //        "mysql_host"   : "127.0.0.1",
 //        "mysql_port"   : "3306",
-//        "mysql_bindir" : "/var/vcap/packages/shield-mysql/bin"
+//        "mysql_bindir" : "/var/vcap/packages/shield-mysql/bin",
+//        "mysql_dump_parallelism" : 1
 //    }
 //
 // BACKUP DETAILS
@@ -46,9 +52,27 @@
 // The mysql_options setting can apply mysqldump specific options like --force, --quick and/or
 // --single-transaction
 //
+// The `mysql_ssl_mode` setting secures the connections to the server: `disable`, `require`
+// (encrypted, but the certificate of the server is not checked), `verify-ca` (it must be
+// signed by the CA in `mysql_ssl_ca`) or `verify-full` (it must also be issued for the host).
+// It is passed to mysqldump and mysql as `--ssl-mode`, along with `--ssl-ca`, and with
+// `--ssl-cert` and `--ssl-key` when `mysql_ssl_cert` and `mysql_ssl_key` point to a client
+// certificate. These options need the clients of MySQL 5.7.11 or newer. All of these files
+// must exist on the SHIELD agent; validating the endpoint checks that they do. Managed cloud
+// databases usually require `verify-full`, with the CA bundle of the provider.
+//
 // Backing up with the `mysql` plugin will not drop any existing connections to the database,
 // or restart the service.
 //
+// When `mysql_dump_parallelism` is greater than 1, each database (from `mysql_database`,
+// which can then list several space-separated databases, or all of the non-system
+// databases found on the server) is dumped by its own `mysqldump` process, to a
+// temporary file, with up to `mysql_dump_parallelism` dumps running at the same time.
+// The dumps are then streamed out as a tar archive of `<database>.sql` files. Each
+// dump runs with `--single-transaction`, over its own connection, so each database
+// is consistent on its own, but consistency ACROSS databases is NOT guaranteed in
+// parallel mode. The temporary directory needs enough room for all the dumps.
+//
 //RESTORE DETAILS
 //
 // To restore, the `mysql` plugin connects to the mysql server using the `mysql` command.
@@ -58,6 +82,9 @@
 //
 // Restoring with the `mysql` plugin should not interrupt established connections to the service.
 //
+// Archives produced by parallel backups are detected automatically, and each of the
+// database dumps they contain is fed to its own `mysql` command.
+//
 // DEPENDENCIES
 //
 // This plugin relies on the `mysqldump` and `mysql` utilities. Please ensure
@@ -81,8 +108,9 @@ import (
 )
 
 var (
-	DefaultHost = "127.0.0.1"
-	DefaultPort = "3306"
+	DefaultHost        = "127.0.0.1"
+	DefaultPort        = "3306"
+	DefaultParallelism = 1
 )
 
 func main() {
@@ -103,14 +131,20 @@ func main() {
   "mysql_read_replica" : "hostname/ip",  # optional
   "mysql_database"     : "db",           # optional
   "mysql_options"      : "--quick",      # optional
-  "mysql_bindir"       : "/path/to/bin"  # optional
+  "mysql_bindir"       : "/path/to/bin", # optional
+  "mysql_dump_parallelism" : 4,          # optional, dump databases concurrently
+  "mysql_ssl_mode"     : "verify-full",         # optional: disable, require, verify-ca or verify-full
+  "mysql_ssl_ca"       : "/path/to/ca.pem",     # optional, CA certificates to verify the server with
+  "mysql_ssl_cert"     : "/path/to/client.pem", # optional, client certificate, for mutual TLS
+  "mysql_ssl_key"      : "/path/to/client.key"  # optional, key of the client certificate
 }
 `,
 		Defaults: `
 {
   "mysql_host"   : "127.0.0.1",
   "mysql_port"   : "3306",
-  "mysql_bindir" : "/var/vcap/packages/shield-mysql/bin"
+  "mysql_bindir" : "/var/vcap/packages/shield-mysql/bin",
+  "mysql_dump_parallelism" : 1
 }
 `,
 	}
@@ -121,14 +155,16 @@ func main() {
 type MySQLPlugin PluginInfo
 
 type MySQLConnectionInfo struct {
-	Host     string
-	Port     string
-	User     string
-	Password string
-	Bin      string
-	Replica  string
-	Database string
-	Options  string
+	Host        string
+	Port        string
+	User        string
+	Password    string
+	Bin         string
+	Replica     string
+	Database    string
+	Options     string
+	Parallelism int
+	SSLSettings
 }
 
 func (p MySQLPlugin) Meta() PluginInfo {
@@ -207,8 +243,75 @@ func (p MySQLPlugin) Validate(endpoint ShieldEndpoint) error {
 		ansi.Printf("@G{\u2713 mysql_options}       @C{%s}\n", s)
 	}
 
+	f, err := endpoint.FloatValueDefault("mysql_dump_parallelism", float64(DefaultParallelism))
+	if err != nil {
+		ansi.Printf("@R{\u2717 mysql_dump_parallelism  %s}\n", err)
+		fail = true
+	} else if f < 1 || f != float64(int(f)) {
+		ansi.Printf("@R{\u2717 mysql_dump_parallelism  must be a positive whole number}\n")
+		fail = true
+	} else if f == 1 {
+		ansi.Printf("@G{\u2713 mysql_dump_parallelism}  databases will be dumped serially\n")
+	} else {
+		ansi.Printf("@G{\u2713 mysql_dump_parallelism}  @C{%d} databases will be dumped at a time\n", int(f))
+	}
+
+	var ssl SSLSettings
+	sslErrors := map[string]error{}
+	for key, value := range map[string]*string{
+		"mysql_ssl_mode": &ssl.SSLMode,
+		"mysql_ssl_ca":   &ssl.SSLCA,
+		"mysql_ssl_cert": &ssl.SSLCert,
+		"mysql_ssl_key":  &ssl.SSLKey,
+	} {
+		if *value, err = endpoint.StringValueDefault(key, ""); err != nil {
+			sslErrors[key] = err
+		}
+	}
+	if len(sslErrors) == 0 {
+		if err, ok := CheckSSL("mysql", ssl).(ConfigError); ok {
+			sslErrors[err.Key] = err
+		}
+	}
+
+	if err = sslErrors["mysql_ssl_mode"]; err != nil {
+		ansi.Printf("@R{\u2717 mysql_ssl_mode      %s}\n", err)
+		fail = true
+	} else if ssl.SSLMode == "" {
+		ansi.Printf("@G{\u2713 mysql_ssl_mode}      using the client default (@C{PREFERRED})\n")
+	} else {
+		ansi.Printf("@G{\u2713 mysql_ssl_mode}      @C{%s}\n", ssl.SSLMode)
+	}
+
+	if err = sslErrors["mysql_ssl_ca"]; err != nil {
+		ansi.Printf("@R{\u2717 mysql_ssl_ca        %s}\n", err)
+		fail = true
+	} else if ssl.SSLCA == "" {
+		ansi.Printf("@G{\u2713 mysql_ssl_ca}        none\n")
+	} else {
+		ansi.Printf("@G{\u2713 mysql_ssl_ca}        @C{%s}\n", ssl.SSLCA)
+	}
+
+	if err = sslErrors["mysql_ssl_cert"]; err != nil {
+		ansi.Printf("@R{\u2717 mysql_ssl_cert      %s}\n", err)
+		fail = true
+	} else if ssl.SSLCert == "" {
+		ansi.Printf("@G{\u2713 mysql_ssl_cert}      none\n")
+	} else {
+		ansi.Printf("@G{\u2713 mysql_ssl_cert}      @C{%s}\n", ssl.SSLCert)
+	}
+
+	if err = sslErrors["mysql_ssl_key"]; err != nil {
+		ansi.Printf("@R{\u2717 mysql_ssl_key       %s}\n", err)
+		fail = true
+	} else if ssl.SSLKey == "" {
+		ansi.Printf("@G{\u2713 mysql_ssl_key}       none\n")
+	} else {
+		ansi.Printf("@G{\u2713 mysql_ssl_key}       @C{%s}\n", ssl.SSLKey)
+	}
+
 	if fail {
-		return fmt.Errorf("mysql: invalid configuration")
+		return ValidationError{Plugin: "mysql"}
 	}
 	return nil
 }
@@ -224,6 +327,10 @@ func (p MySQLPlugin) Backup(endpoint ShieldEndpoint) error {
 		mysql.Host = mysql.Replica
 	}
 
+	if mysql.Parallelism > 1 {
+		return parallelBackup(mysql, mysql.Parallelism)
+	}
+
 	cmd := fmt.Sprintf("%s/mysqldump %s %s", mysql.Bin, mysql.Options, connectionString(mysql, true))
 	DEBUG("Executing: `%s`", cmd)
 	return Exec(cmd, STDOUT)
@@ -245,8 +352,7 @@ func (p MySQLPlugin) Restore(endpoint ShieldEndpoint) error {
 		return mysqlrestorefull(mysql, cmd)
 	} else {
 		fmt.Fprintf(os.Stderr, `Restore Database %s \n`, dbname)
-		DEBUG("Exec: %s", cmd)
-		return Exec(cmd, STDIN)
+		return restoreStream(cmd, os.Stdin)
 	}
 }
 
@@ -276,11 +382,15 @@ func connectionString(info *MySQLConnectionInfo, backup bool) string {
 	} else {
 		db = ""
 	}
-	return fmt.Sprintf("%s -h %s -P %s -u %s", db, info.Host, info.Port, info.User)
+	return fmt.Sprintf("%s -h %s -P %s -u %s%s", db, info.Host, info.Port, info.User, sslOptions(info))
 }
 
-func connectionclientString(info *MySQLConnectionInfo) string {
-	return fmt.Sprintf("%s:%s@tcp(%s:%s)/", info.User, info.Password, info.Host, info.Port)
+func connectionclientString(info *MySQLConnectionInfo) (string, error) {
+	params, err := sslParams(info)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", info.User, info.Password, info.Host, info.Port, params), nil
 }
 
 func mysqlrestorefull(info *MySQLConnectionInfo, cmd string) error {
@@ -295,7 +405,11 @@ func mysqlrestorefull(info *MySQLConnectionInfo, cmd string) error {
 	}
 
 	var i int
-	db, err := sql.Open("mysql", connectionclientString(info))
+	dsn, err := connectionclientString(info)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("mysql", dsn)
 	if err != nil {
 		ansi.Fprintf(os.Stderr, " @R{\u2717 MySQL Instance Connection}\n")
 		return err
@@ -334,8 +448,7 @@ func mysqlrestorefull(info *MySQLConnectionInfo, cmd string) error {
 		}
 	}
 	ansi.Fprintf(os.Stderr, " @G{\u2713 MySQL Updating restore parameters}\n")
-	DEBUG("Exec: %s --init-command='set sql_log_bin=0'", cmd)
-	err = Exec(fmt.Sprintf("%s --init-command='set sql_log_bin=0'", cmd), STDIN)
+	err = restoreStream(fmt.Sprintf("%s --init-command='set sql_log_bin=0'", cmd), os.Stdin)
 	if err != nil {
 		ansi.Fprintf(os.Stderr, " @R{\u2717 Restoring instance} \n")
 		return err
@@ -417,14 +530,43 @@ func mysqlConnectionInfo(endpoint ShieldEndpoint) (*MySQLConnectionInfo, error)
 	}
 	DEBUG("MYSQL_BINDIR: '%s'", bin)
 
-	return &MySQLConnectionInfo{
-		Host:     host,
-		Port:     port,
-		User:     user,
-		Password: password,
-		Bin:      bin,
-		Replica:  replica,
-		Database: db,
-		Options:  options,
-	}, nil
+	parallelism, err := endpoint.FloatValueDefault("mysql_dump_parallelism", float64(DefaultParallelism))
+	if err != nil {
+		return nil, err
+	}
+	if parallelism < 1 {
+		return nil, ConfigError{Key: "mysql_dump_parallelism", Err: fmt.Errorf("mysql_dump_parallelism must be at least 1")}
+	}
+	DEBUG("MYSQL_DUMP_PARALLELISM: %d", int(parallelism))
+
+	info := &MySQLConnectionInfo{
+		Host:        host,
+		Port:        port,
+		User:        user,
+		Password:    password,
+		Bin:         bin,
+		Replica:     replica,
+		Database:    db,
+		Options:     options,
+		Parallelism: int(parallelism),
+	}
+
+	if info.SSLMode, err = endpoint.StringValueDefault("mysql_ssl_mode", ""); err != nil {
+		return nil, err
+	}
+	if info.SSLCA, err = endpoint.StringValueDefault("mysql_ssl_ca", ""); err != nil {
+		return nil, err
+	}
+	if info.SSLCert, err = endpoint.StringValueDefault("mysql_ssl_cert", ""); err != nil {
+		return nil, err
+	}
+	if info.SSLKey, err = endpoint.StringValueDefault("mysql_ssl_key", ""); err != nil {
+		return nil, err
+	}
+	if err = CheckSSL("mysql", info.SSLSettings); err != nil {
+		return nil, err
+	}
+	DEBUG("MYSQL_SSL_MODE: '%s'", info.SSLMode)
+
+	return info, nil
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// TLS connections
+//
+// `mysql_ssl_mode` sets how the connections to the server are secured:
+// `disable`, `require` (encrypted, without checking the certificate of the
+// server), `verify-ca` (signed by the CA in `mysql_ssl_ca`), or
+// `verify-full` (signed by that CA, and issued for the host).  They map to
+// the `--ssl-mode` values of the mysql and mysqldump clients (DISABLED,
+// REQUIRED, VERIFY_CA and VERIFY_IDENTITY), which need MySQL 5.7.11 or
+// newer.  `mysql_ssl_cert` and `mysql_ssl_key` hold the client certificate
+// and key, for servers that want them.  Left empty, the client default
+// applies (PREFERRED: encrypted if the server offers it).
+//
+// The connections the plugin makes itself (to list the databases of
+// parallel backups, and to set global variables around full restores) use
+// the same settings, through a TLS config registered with the driver.
+
+// sslModeOptions maps the SSL modes to the values of `--ssl-mode`.
+var sslModeOptions = map[string]string{
+	"disable":     "DISABLED",
+	"require":     "REQUIRED",
+	"verify-ca":   "VERIFY_CA",
+	"verify-full": "VERIFY_IDENTITY",
+}
+
+// TLSConfigName is the name the TLS config of the endpoint is registered
+// with, for the driver.
+const TLSConfigName = "shield"
+
+// sslOptions returns the TLS options of the mysql and mysqldump commands.
+func sslOptions(info *MySQLConnectionInfo) string {
+	if info.SSLMode == "" {
+		return ""
+	}
+	opts := fmt.Sprintf(" --ssl-mode=%s", sslModeOptions[info.SSLMode])
+	if info.SSLMode == "disable" {
+		return opts
+	}
+	if info.SSLCA != "" {
+		opts += fmt.Sprintf(` --ssl-ca="%s"`, info.SSLCA)
+	}
+	if info.SSLCert != "" {
+		opts += fmt.Sprintf(` --ssl-cert="%s" --ssl-key="%s"`, info.SSLCert, info.SSLKey)
+	}
+	return opts
+}
+
+// tlsConfig builds the TLS config of the connections the plugin makes
+// itself, the way the clients would.
+func tlsConfig(info *MySQLConnectionInfo) (*tls.Config, error) {
+	cfg := &tls.Config{}
+	if info.SSLCert != "" {
+		cert, err := tls.LoadX509KeyPair(info.SSLCert, info.SSLKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the client certificate: %s", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	var roots *x509.CertPool
+	if info.SSLCA != "" {
+		pem, err := ioutil.ReadFile(info.SSLCA)
+		if err != nil {
+			return nil, err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificate found in %s", info.SSLCA)
+		}
+	}
+
+	switch info.SSLMode {
+	case "verify-full":
+		/* the driver sets ServerName to the host it connects to */
+		cfg.RootCAs = roots
+	case "verify-ca":
+		/* check the chain, but not the name the certificate was issued for */
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			certs := make([]*x509.Certificate, len(raw))
+			for i := range raw {
+				cert, err := x509.ParseCertificate(raw[i])
+				if err != nil {
+					return err
+				}
+				certs[i] = cert
+			}
+			if len(certs) == 0 {
+				return fmt.Errorf("the server presented no certificate")
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range certs[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+			return err
+		}
+	default:
+		cfg.InsecureSkipVerify = true
+	}
+	return cfg, nil
+}
+
+// sslParams registers the TLS config of the endpoint with the driver, if
+// TLS is asked for, and returns the DSN parameters that select it.
+func sslParams(info *MySQLConnectionInfo) (string, error) {
+	switch info.SSLMode {
+	case "":
+		return "", nil
+	case "disable":
+		return "?tls=false", nil
+	}
+	cfg, err := tlsConfig(info)
+	if err != nil {
+		return "", err
+	}
+	if err = mysql.RegisterTLSConfig(TLSConfigName, cfg); err != nil {
+		return "", err
+	}
+	return "?tls=" + TLSConfigName, nil
+}
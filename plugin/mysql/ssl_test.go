@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+// certificate issues a certificate for name, signed by the CA (or by
+// itself, without one), and returns it with its key.
+func certificate(name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Ω(err).ShouldNot(HaveOccurred())
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	Ω(err).ShouldNot(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Ω(err).ShouldNot(HaveOccurred())
+	return cert, key
+}
+
+var _ = Describe("TLS Connections", func() {
+	var tmp string
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-mysql-ssl-")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	writePEM := func(name, kind string, der []byte) string {
+		path := filepath.Join(tmp, name)
+		Ω(ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600)).Should(Succeed())
+		return path
+	}
+
+	It("maps the SSL modes to --ssl-mode, and quotes the files", func() {
+		for _, t := range []struct {
+			ssl  SSLSettings
+			opts string
+		}{
+			{SSLSettings{}, ""},
+			{SSLSettings{SSLCA: "/ca.pem"}, ""},
+			{SSLSettings{SSLMode: "disable", SSLCA: "/ca.pem"}, ` --ssl-mode=DISABLED`},
+			{SSLSettings{SSLMode: "require"}, ` --ssl-mode=REQUIRED`},
+			{SSLSettings{SSLMode: "verify-ca", SSLCA: "/ca.pem"}, ` --ssl-mode=VERIFY_CA --ssl-ca="/ca.pem"`},
+			{SSLSettings{SSLMode: "verify-full", SSLCA: "/ca.pem"}, ` --ssl-mode=VERIFY_IDENTITY --ssl-ca="/ca.pem"`},
+			{SSLSettings{SSLMode: "require", SSLCert: "/my certs/cert.pem", SSLKey: "/my certs/key.pem"},
+				` --ssl-mode=REQUIRED --ssl-cert="/my certs/cert.pem" --ssl-key="/my certs/key.pem"`},
+		} {
+			Ω(sslOptions(&MySQLConnectionInfo{SSLSettings: t.ssl})).Should(Equal(t.opts), "%+v", t.ssl)
+		}
+
+		for _, mode := range SSLModes {
+			Ω(sslModeOptions).Should(HaveKey(mode))
+		}
+	})
+
+	It("checks the chain of the server certificate, but not its name, to verify-ca", func() {
+		ca, caKey := certificate("Test CA", true, nil, nil)
+		server, _ := certificate("db.example.com", false, ca, caKey)
+		other, otherKey := certificate("Other CA", true, nil, nil)
+		foreign, _ := certificate("db.example.com", false, other, otherKey)
+
+		cfg, err := tlsConfig(&MySQLConnectionInfo{SSLSettings: SSLSettings{
+			SSLMode: "verify-ca",
+			SSLCA:   writePEM("ca.pem", "CERTIFICATE", ca.Raw),
+		}})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(cfg.InsecureSkipVerify).Should(BeTrue())
+		Ω(cfg.VerifyPeerCertificate).ShouldNot(BeNil())
+
+		Ω(cfg.VerifyPeerCertificate([][]byte{server.Raw}, nil)).Should(Succeed())
+		Ω(cfg.VerifyPeerCertificate([][]byte{server.Raw, ca.Raw}, nil)).Should(Succeed())
+		Ω(cfg.VerifyPeerCertificate([][]byte{foreign.Raw}, nil)).ShouldNot(Succeed())
+		Ω(cfg.VerifyPeerCertificate([][]byte{foreign.Raw, other.Raw}, nil)).ShouldNot(Succeed())
+		Ω(cfg.VerifyPeerCertificate([][]byte{}, nil)).Should(MatchError("the server presented no certificate"))
+		Ω(cfg.VerifyPeerCertificate([][]byte{[]byte("garbage")}, nil)).ShouldNot(Succeed())
+	})
+
+	It("leaves the name check to the driver to verify-full", func() {
+		ca, _ := certificate("Test CA", true, nil, nil)
+		cfg, err := tlsConfig(&MySQLConnectionInfo{SSLSettings: SSLSettings{
+			SSLMode: "verify-full",
+			SSLCA:   writePEM("ca.pem", "CERTIFICATE", ca.Raw),
+		}})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(cfg.InsecureSkipVerify).Should(BeFalse())
+		Ω(cfg.VerifyPeerCertificate).Should(BeNil())
+		Ω(cfg.RootCAs).ShouldNot(BeNil())
+	})
+
+	It("encrypts without checking anything to require", func() {
+		cfg, err := tlsConfig(&MySQLConnectionInfo{SSLSettings: SSLSettings{SSLMode: "require"}})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(cfg.InsecureSkipVerify).Should(BeTrue())
+		Ω(cfg.VerifyPeerCertificate).Should(BeNil())
+	})
+
+	It("presents the client certificate", func() {
+		ca, caKey := certificate("Test CA", true, nil, nil)
+		client, clientKey := certificate("shield", false, ca, caKey)
+		der, err := x509.MarshalECPrivateKey(clientKey)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		cfg, err := tlsConfig(&MySQLConnectionInfo{SSLSettings: SSLSettings{
+			SSLMode: "require",
+			SSLCert: writePEM("cert.pem", "CERTIFICATE", client.Raw),
+			SSLKey:  writePEM("key.pem", "EC PRIVATE KEY", der),
+		}})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(cfg.Certificates).Should(HaveLen(1))
+
+		_, err = tlsConfig(&MySQLConnectionInfo{SSLSettings: SSLSettings{
+			SSLMode: "require",
+			SSLCert: filepath.Join(tmp, "cert.pem"),
+			SSLKey:  filepath.Join(tmp, "cert.pem"),
+		}})
+		Ω(err).Should(MatchError(ContainSubstring("unable to load the client certificate")))
+	})
+
+	It("wants a PEM certificate in the CA file", func() {
+		_, err := tlsConfig(&MySQLConnectionInfo{SSLSettings: SSLSettings{
+			SSLMode: "verify-ca",
+			SSLCA:   writePEM("ca.pem", "PRIVATE KEY", []byte("not a certificate")),
+		}})
+		Ω(err).Should(MatchError(ContainSubstring("no PEM certificate found in")))
+	})
+})
@@ -0,0 +1,202 @@
+package plugin
+
+/*
+
+Notifications let operators hear about plugin runs out-of-band, without
+going through SHIELD core.  If the endpoint configuration carries a
+`notify_url`, a small JSON document describing the outcome of the action
+is POSTed to it once the action is done (`job_id` is only there when the
+plugin was given a job ID, and `summary` when the action failed because a
+command did, and what that command wrote to its standard error has lines
+that look like errors):
+
+    {
+      "plugin"   : "Cassandra Backup Plugin",
+      "action"   : "backup",
+      "job_id"   : "5c5d4a2e-0e8f-4d4b-9a53-2f1b0c0e6a1d",
+      "status"   : "failure",
+      "duration" : 12.5,
+      "error"    : "Unable to exec 'nodetool': exit status 2: error: Keyspace ks9 does not exist",
+      "summary"  : "error: Keyspace ks9 does not exist"
+    }
+
+The summary is short enough for chat messages (e.g. Slack webhooks); the
+full error output of the command is only on the standard error of the
+plugin, and in its DEBUG output.
+
+`notify_on` chooses which outcomes are worth a notification (`success`,
+`failure` or `always`, the default), and `notify_token`, if set, is sent
+as a bearer token in the Authorization header.
+
+Failing to notify never fails the action itself; it is only reported on
+standard error.  The `validate` action rejects `notify_url`s that are not
+http(s) URLs, and `notify_on` values other than the three above, so that
+such mistakes show before the notifications that never come.
+
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"time"
+)
+
+const (
+	NotifyOnSuccess = "success"
+	NotifyOnFailure = "failure"
+	NotifyAlways    = "always"
+)
+
+var NotifyTimeout = 10 * time.Second
+
+type notification struct {
+	Plugin   string  `json:"plugin"`
+	Action   string  `json:"action"`
+	JobID    string  `json:"job_id,omitempty"`
+	Status   string  `json:"status"`
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
+	Summary  string  `json:"summary,omitempty"`
+}
+
+func notify(endpoint ShieldEndpoint, info PluginInfo, action string, started time.Time, actionErr error) {
+	url, err := endpoint.StringValueDefault("notify_url", "")
+	if err != nil {
+		Fprintf(os.Stderr, "@Y{unable to send notification: %s}\n", err)
+		return
+	}
+	if url == "" {
+		return
+	}
+
+	on, err := endpoint.StringValueDefault("notify_on", NotifyAlways)
+	if err != nil {
+		Fprintf(os.Stderr, "@Y{unable to send notification: %s}\n", err)
+		return
+	}
+	if !validNotifyOn(on) {
+		Fprintf(os.Stderr, "@Y{unable to send notification: invalid notify_on value '%s' (expecting '%s', '%s' or '%s')}\n",
+			on, NotifyOnSuccess, NotifyOnFailure, NotifyAlways)
+		return
+	}
+
+	token, err := endpoint.StringValueDefault("notify_token", "")
+	if err != nil {
+		Fprintf(os.Stderr, "@Y{unable to send notification: %s}\n", err)
+		return
+	}
+
+	n := notification{
+		Plugin:   info.Name,
+		Action:   action,
+		JobID:    jobID,
+		Status:   NotifyOnSuccess,
+		Duration: time.Since(started).Seconds(),
+	}
+	if actionErr != nil {
+		n.Status = NotifyOnFailure
+		n.Error = actionErr.Error()
+		var execErr ExecError
+		if errors.As(actionErr, &execErr) {
+			n.Summary = execErr.Summary()
+		}
+	}
+	if on != NotifyAlways && on != n.Status {
+		DEBUG("not notifying %s of %s (notify_on is '%s')", url, n.Status, on)
+		return
+	}
+
+	if err := postNotification(url, token, n); err != nil {
+		Fprintf(os.Stderr, "@Y{unable to send notification to %s: %s}\n", url, err)
+		return
+	}
+	DEBUG("notified %s of %s %s", url, action, n.Status)
+}
+
+func validNotifyOn(on string) bool {
+	return on == NotifyOnSuccess || on == NotifyOnFailure || on == NotifyAlways
+}
+
+// checkNotifyURL checks that a notify_url is an http(s) URL, with a host.
+func checkNotifyURL(url string) error {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("'%s' is not an http or https URL", url)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("'%s' has no host", url)
+	}
+	return nil
+}
+
+// validateNotify prints out the notification settings, for the `validate`
+// action.
+func validateNotify(endpoint ShieldEndpoint) error {
+	fail := false
+	if _, ok := endpoint["notify_url"]; ok {
+		url, err := endpoint.StringValue("notify_url")
+		if err == nil {
+			err = checkNotifyURL(url)
+		}
+		if err != nil {
+			Printf("@R{\u2717 notify_url  %s}\n", err)
+			fail = true
+		} else {
+			Printf("@G{\u2713 notify_url}  @C{%s}\n", url)
+		}
+	}
+
+	if _, ok := endpoint["notify_on"]; ok {
+		on, err := endpoint.StringValue("notify_on")
+		if err == nil && !validNotifyOn(on) {
+			err = fmt.Errorf("invalid value '%s' (expecting '%s', '%s' or '%s')", on, NotifyOnSuccess, NotifyOnFailure, NotifyAlways)
+		}
+		if err != nil {
+			Printf("@R{\u2717 notify_on  %s}\n", err)
+			fail = true
+		} else {
+			Printf("@G{\u2713 notify_on}  @C{%s}\n", on)
+		}
+	}
+
+	if fail {
+		return ValidationError{Plugin: "notifications"}
+	}
+	return nil
+}
+
+func postNotification(url, token string, n notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := &http.Client{Timeout: NotifyTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("received HTTP %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Notifications", func() {
+	var (
+		server   *httptest.Server
+		received []notification
+		auth     string
+	)
+
+	info := PluginInfo{Name: "Test Plugin"}
+
+	BeforeEach(func() {
+		received = nil
+		auth = ""
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var n notification
+			Expect(json.NewDecoder(r.Body).Decode(&n)).Should(Succeed())
+			received = append(received, n)
+			auth = r.Header.Get("Authorization")
+		}))
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("does nothing without a notify_url", func() {
+		notify(ShieldEndpoint{}, info, "backup", time.Now(), nil)
+		Expect(received).Should(BeEmpty())
+	})
+	It("posts successes and failures by default", func() {
+		endpoint := ShieldEndpoint{"notify_url": server.URL}
+		notify(endpoint, info, "backup", time.Now(), nil)
+		notify(endpoint, info, "restore", time.Now(), fmt.Errorf("it broke"))
+
+		Expect(received).Should(HaveLen(2))
+		Expect(received[0].Plugin).Should(Equal("Test Plugin"))
+		Expect(received[0].Action).Should(Equal("backup"))
+		Expect(received[0].Status).Should(Equal("success"))
+		Expect(received[0].Error).Should(Equal(""))
+		Expect(received[1].Action).Should(Equal("restore"))
+		Expect(received[1].Status).Should(Equal("failure"))
+		Expect(received[1].Error).Should(Equal("it broke"))
+		Expect(auth).Should(Equal(""))
+	})
+	It("sends the summary of the error output of failed commands", func() {
+		endpoint := ShieldEndpoint{"notify_url": server.URL}
+		err := ExecError{Cmd: "nodetool", RC: 2, Stderr: "error: Keyspace ks9 does not exist\n", Err: fmt.Errorf("exit status 2")}
+		notify(endpoint, info, "backup", time.Now(), fmt.Errorf("snapshot failed: %w", err))
+
+		Expect(received).Should(HaveLen(1))
+		Expect(received[0].Error).Should(Equal("snapshot failed: Unable to exec 'nodetool': exit status 2: error: Keyspace ks9 does not exist"))
+		Expect(received[0].Summary).Should(Equal("error: Keyspace ks9 does not exist"))
+	})
+	It("sends the job ID, if there is one", func() {
+		defer func() { jobID = "" }()
+		jobID = "job-42"
+		notify(ShieldEndpoint{"notify_url": server.URL}, info, "backup", time.Now(), nil)
+		Expect(received).Should(HaveLen(1))
+		Expect(received[0].JobID).Should(Equal("job-42"))
+	})
+	It("honors notify_on", func() {
+		endpoint := ShieldEndpoint{"notify_url": server.URL, "notify_on": "failure"}
+		notify(endpoint, info, "backup", time.Now(), nil)
+		Expect(received).Should(BeEmpty())
+		notify(endpoint, info, "backup", time.Now(), fmt.Errorf("it broke"))
+		Expect(received).Should(HaveLen(1))
+	})
+	It("sends the notify_token as a bearer token", func() {
+		endpoint := ShieldEndpoint{"notify_url": server.URL, "notify_token": "s3cr3t"}
+		notify(endpoint, info, "backup", time.Now(), nil)
+		Expect(auth).Should(Equal("Bearer s3cr3t"))
+	})
+	It("reports unreachable notification targets as errors", func() {
+		Expect(postNotification(server.URL+"/nope\x7f", "", notification{})).ShouldNot(Succeed())
+		server.Close()
+		Expect(postNotification(server.URL, "", notification{})).ShouldNot(Succeed())
+	})
+	It("validates notify_url and notify_on", func() {
+		for _, t := range []struct {
+			endpoint ShieldEndpoint
+			valid    bool
+		}{
+			{ShieldEndpoint{}, true},
+			{ShieldEndpoint{"notify_url": "http://hooks.example.com/shield"}, true},
+			{ShieldEndpoint{"notify_url": "https://hooks.example.com:8443/shield?x=1"}, true},
+			{ShieldEndpoint{"notify_url": server.URL, "notify_on": "success"}, true},
+			{ShieldEndpoint{"notify_on": "failure"}, true},
+			{ShieldEndpoint{"notify_on": "always"}, true},
+
+			{ShieldEndpoint{"notify_url": ""}, false},
+			{ShieldEndpoint{"notify_url": "hooks.example.com/shield"}, false},
+			{ShieldEndpoint{"notify_url": "ftp://hooks.example.com/shield"}, false},
+			{ShieldEndpoint{"notify_url": "mailto:ops@example.com"}, false},
+			{ShieldEndpoint{"notify_url": "https:///shield"}, false},
+			{ShieldEndpoint{"notify_url": "http://hooks.example.com/\x7f"}, false},
+			{ShieldEndpoint{"notify_url": 42}, false},
+			{ShieldEndpoint{"notify_on": "failures"}, false},
+			{ShieldEndpoint{"notify_on": "Success"}, false},
+			{ShieldEndpoint{"notify_on": ""}, false},
+			{ShieldEndpoint{"notify_url": server.URL, "notify_on": "never"}, false},
+		} {
+			err := validateNotify(t.endpoint)
+			if t.valid {
+				Expect(err).ShouldNot(HaveOccurred(), "%v", t.endpoint)
+			} else {
+				Expect(err).Should(BeAssignableToTypeOf(ValidationError{}), "%v", t.endpoint)
+			}
+		}
+	})
+})
@@ -0,0 +1,86 @@
+package plugin
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mattn/go-isatty"
+	"github.com/starkandwayne/goutils/ansi"
+)
+
+// Plugins should print their validation and progress messages through
+// Printf() and Fprintf(), instead of calling the ansi package directly.
+// These only emit color codes when they are writing to a terminal, and
+// never if either of the NO_COLOR or SHIELD_PLUGIN_NO_COLOR environment
+// variables is set, so that redirected output (i.e. task logs) stays
+// plain text.
+//
+// When the plugin runs on behalf of a job (see SetJobID), every line of
+// these messages, and of DEBUG() output, is prefixed with the job ID, so
+// that the output of concurrent runs can be told apart in shared logs.
+
+var (
+	colorLock sync.Mutex
+	jobID     string
+)
+
+// SetJobID sets the job ID that prefixes all messages.  It is exported in
+// the SHIELD_JOB_ID environment variable too, for child processes (i.e.
+// other plugins) to pick it up.
+func SetJobID(id string) {
+	jobID = id
+	os.Setenv("SHIELD_JOB_ID", id)
+}
+
+// JobID returns the job ID this plugin runs for, or "" if there is none.
+func JobID() string {
+	return jobID
+}
+
+// prefixLines prefixes each line of a message with the job ID, if any.
+func prefixLines(msg string) string {
+	if jobID == "" {
+		return msg
+	}
+	lines := strings.SplitAfter(msg, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = "[" + jobID + "] " + line
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// Colorable returns true if ANSI color codes should be sent to out.
+func Colorable(out io.Writer) bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("SHIELD_PLUGIN_NO_COLOR") != "" {
+		return false
+	}
+	if f, ok := out.(*os.File); ok {
+		return isatty.IsTerminal(f.Fd())
+	}
+	return false
+}
+
+// colorize formats a message with ansi color markup (i.e. `@G{ok}`),
+// keeping the colors only if the message is headed for out.
+func colorize(out io.Writer, format string, args ...interface{}) string {
+	colorLock.Lock()
+	defer colorLock.Unlock()
+
+	ansi.Color(Colorable(out))
+	return ansi.Sprintf(format, args...)
+}
+
+// Fprintf writes a message with ansi color markup to out.
+func Fprintf(out io.Writer, format string, args ...interface{}) (int, error) {
+	return fmt.Fprint(out, prefixLines(colorize(out, format, args...)))
+}
+
+// Printf writes a message with ansi color markup to standard output.
+func Printf(format string, args ...interface{}) (int, error) {
+	return Fprintf(os.Stdout, format, args...)
+}
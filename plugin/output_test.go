@@ -0,0 +1,59 @@
+package plugin
+
+import (
+	"bytes"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Colored Output", func() {
+	BeforeEach(func() {
+		os.Unsetenv("NO_COLOR")
+		os.Unsetenv("SHIELD_PLUGIN_NO_COLOR")
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("NO_COLOR")
+		os.Unsetenv("SHIELD_PLUGIN_NO_COLOR")
+	})
+
+	It("strips color codes when not writing to a terminal", func() {
+		var out bytes.Buffer
+		Fprintf(&out, "@G{\u2713 %s}  @C{%s}\n", "Step", "details")
+		Ω(out.String()).Should(Equal("\u2713 Step  details\n"))
+	})
+
+	It("never colors regular files", func() {
+		f, err := os.Open(os.DevNull)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer f.Close()
+		Ω(Colorable(f)).Should(BeFalse())
+	})
+
+	It("honors NO_COLOR and SHIELD_PLUGIN_NO_COLOR", func() {
+		Ω(Colorable(&bytes.Buffer{})).Should(BeFalse())
+
+		os.Setenv("NO_COLOR", "1")
+		Ω(Colorable(os.Stderr)).Should(BeFalse())
+		os.Unsetenv("NO_COLOR")
+
+		os.Setenv("SHIELD_PLUGIN_NO_COLOR", "yes")
+		Ω(Colorable(os.Stderr)).Should(BeFalse())
+	})
+	It("prefixes every line with the job ID, if there is one", func() {
+		defer func() {
+			jobID = ""
+			os.Unsetenv("SHIELD_JOB_ID")
+		}()
+
+		SetJobID("job-42")
+		Ω(os.Getenv("SHIELD_JOB_ID")).Should(Equal("job-42"))
+
+		var out bytes.Buffer
+		Fprintf(&out, "@G{\u2713 %s}\n  @C{%s}\n", "Step", "details")
+		Fprintf(&out, "no newline")
+		Ω(out.String()).Should(Equal("[job-42] \u2713 Step\n[job-42]   details\n[job-42] no newline"))
+	})
+})
@@ -15,9 +15,11 @@ plugin.Exec() can be used to easily run external commands sending their stdin/st
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/jhunt/go-cli"
 	env "github.com/jhunt/go-envirotron"
@@ -28,18 +30,37 @@ type Opt struct {
 	HelpShort bool   `cli:"-h"`
 	HelpFull  bool   `cli:"--help"`
 	Debug     bool   `cli:"-D, --debug",env:"DEBUG"`
+	Trace     bool   `cli:"--trace" env:"SHIELD_PLUGIN_TRACE"`
 	Version   bool   `cli:"-v, --version"`
 	Endpoint  string `cli:"-e,--endpoint"`
+	Target    string `cli:"-t, --target"`
 	Key       string `cli:"-k, --key"`
-
-	Info     struct{} `cli:"info"`
-	Example  struct{} `cli:"example"`
-	Validate struct{} `cli:"validate"`
-	Backup   struct{} `cli:"backup"`
-	Restore  struct{} `cli:"restore"`
-	Store    struct{} `cli:"store"`
-	Retrieve struct{} `cli:"retrieve"`
-	Purge    struct{} `cli:"purge"`
+	KeysFrom  string `cli:"--keys-from"`
+	DryRun    bool   `cli:"-n, --dry-run"`
+	JobID     string `cli:"--job-id" env:"SHIELD_JOB_ID"`
+
+	ResultFile string `cli:"--result-file"`
+	ResultFD   int    `cli:"--result-fd"`
+
+	StatusPort int    `cli:"--status-port"`
+	StatusBind string `cli:"--status-bind"`
+
+	Info      struct{} `cli:"info"`
+	Schema    struct{} `cli:"schema"`
+	Describe  struct{} `cli:"describe"`
+	Example   struct{} `cli:"example"`
+	Validate  struct{} `cli:"validate"`
+	Backup    struct{} `cli:"backup"`
+	Restore   struct{} `cli:"restore"`
+	Store     struct{} `cli:"store"`
+	Retrieve  struct{} `cli:"retrieve"`
+	Purge     struct{} `cli:"purge"`
+	Cleanup   struct{} `cli:"cleanup"`
+	Reconcile struct{} `cli:"reconcile"`
+
+	ListSnapshots   struct{} `cli:"list-snapshots"`
+	RetrieveRestore struct{} `cli:"retrieve-restore"`
+	CleanupCluster  struct{} `cli:"cleanup-cluster"`
 }
 
 type Plugin interface {
@@ -58,8 +79,9 @@ type PluginInfo struct {
 	Version  string         `json:"version"`
 	Features PluginFeatures `json:"features"`
 
-	Example  string `json:"-"`
-	Defaults string `json:"-"`
+	Example  string  `json:"-"`
+	Defaults string  `json:"-"`
+	Fields   []Field `json:"-"`
 }
 
 type PluginFeatures struct {
@@ -77,17 +99,18 @@ func DEBUG(format string, args ...interface{}) {
 			lines[i] = "DEBUG> " + line
 		}
 		content = strings.Join(lines, "\n")
-		fmt.Fprintf(os.Stderr, "%s\n", content)
+		fmt.Fprintf(os.Stderr, "%s\n", prefixLines(content))
 	}
 }
 
 func Run(p Plugin) {
 	var opt Opt
 	info := p.Meta()
+	registerAliases(info.Fields)
 	env.Override(&opt)
 	command, args, err := cli.Parse(&opt)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "!!! %s\n", err.Error())
+		Fprintf(os.Stderr, "@R{!!! %s}\n", err.Error())
 		fmt.Fprintf(os.Stderr, "USAGE: %s [OPTIONS...] COMMAND [OPTIONS...]\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Try %s --help for more information.\n", os.Args[0])
 		os.Exit(USAGE)
@@ -95,6 +118,12 @@ func Run(p Plugin) {
 	if opt.Debug {
 		debug = true
 	}
+	if opt.Trace {
+		tracing = true
+	}
+	if opt.JobID != "" {
+		SetJobID(opt.JobID)
+	}
 
 	if opt.HelpShort {
 		fmt.Fprintf(os.Stderr, "%s v%s - %s\n", info.Name, info.Version, info.Author)
@@ -102,16 +131,37 @@ func Run(p Plugin) {
 		fmt.Fprintf(os.Stderr, `OPTIONS
   -h, --help      Get some help. (--help provides more detail; -h, less)
   -D, --debug     Enable debugging.
+      --trace     Log every command run, with its duration and exit code
+                  (or set $SHIELD_PLUGIN_TRACE).
   -v, --version   Print the version of this plugin and exit.
+      --job-id    Prefix all messages with this job ID (or $SHIELD_JOB_ID).
+      --result-file PATH, --result-fd FD
+                  Write the outcome of the command there, as a JSON line.
+      --status-port PORT, --status-bind ADDR
+                  Serve the progress of the command over HTTP, on
+                  http://ADDR:PORT/status (ADDR is 127.0.0.1 by default).
 
 COMMANDS
   info                         Print plugin information (name / version / author)
+  schema                       Print endpoint configuration metadata, as JSON
+  describe                     Print all of the above, and capabilities, as JSON
   validate -e JSON             Validate endpoint JSON/configuration
   backup   -e JSON             Backup a target
   restore  -e JSON             Replay a backup archive to a target
   store    -e JSON             Store a backup archive
   retrieve -e JSON -k KEY      Stream a backup archive from storage
   purge    -e JSON -k KEY      Delete a backup archive from storage
+  purge    -e JSON --keys-from FILE
+                               Delete several backup archives from storage
+  cleanup  -e JSON [--dry-run] Remove leftovers of interrupted operations
+  list-snapshots -e JSON       List the snapshots kept on a target, as JSON
+  cleanup-cluster -e JSON [--dry-run]
+                               Remove what aborted backups left on the nodes of a cluster
+  retrieve-restore -e JSON -t JSON -k KEY
+                               Restore a backup archive straight from storage
+
+Without a command, the command and endpoint are read from standard input,
+as a line of JSON: {"action":"backup","endpoint":{...}}
 `)
 		if info.Example != "" {
 			fmt.Fprintf(os.Stderr, "\nEXAMPLE ENDPOINT CONFIGURATION\n%s\n", info.Example)
@@ -128,7 +178,15 @@ COMMANDS
 		fmt.Fprintf(os.Stderr, `OPTIONS
   -h, --help      Get some help. (--help provides more detail; -h, less)
   -D, --debug     Enable debugging.
+      --trace     Log every command run, with its duration and exit code
+                  (or set $SHIELD_PLUGIN_TRACE).
   -v, --version   Print the version of this plugin and exit.
+      --job-id    Prefix all messages with this job ID (or $SHIELD_JOB_ID).
+      --result-file PATH, --result-fd FD
+                  Write the outcome of the command there, as a JSON line.
+      --status-port PORT, --status-bind ADDR
+                  Serve the progress of the command over HTTP, on
+                  http://ADDR:PORT/status (ADDR is 127.0.0.1 by default).
 
   -e, --endpoint  JSON string representing what to backup / where to back it up.
 
@@ -141,6 +199,24 @@ GENERAL COMMANDS
     Print information about this plugin, in JSON format, to standard output.
 
 
+  schema
+
+    Print the endpoint configuration metadata for this plugin, in JSON
+    format, to standard output.  This is a list of field definitions
+    (name, label, type, default, etc.) that user interfaces can use to
+    render a form for editing endpoints.  See docs/plugins.md.
+
+
+  describe
+
+    Print everything about this plugin, as a single JSON document, to
+    standard output: the information of 'info', the fields of 'schema',
+    the example and default endpoints, and the capabilities of the
+    plugin (what it can be used for, and which optional commands it
+    supports).  Its top-level 'schema_version' is the version of the
+    document.  See docs/plugins.md.
+
+
   validate --endpoint ENDPOINT-JSON
 
     Validates the given ENDPOINT-JSON to ensure that it is (a) well-formed
@@ -162,6 +238,21 @@ BACKUP COMMANDS
     Reads a raw (uncompressed) backup archive on standard input and attempts to
     replay it to the given target.
 
+  list-snapshots --endpoint TARGET-ENDPOINT-JSON
+
+    Prints the snapshots that the plugin keeps on the target system, as
+    JSON: their name, generation, creation time and size.  Nothing is
+    changed.  Not all plugins support this command.
+
+  cleanup-cluster [--dry-run] --endpoint TARGET-ENDPOINT-JSON
+
+    Removes what an aborted cluster-wide backup may have left behind on
+    the target system, on this node and on the peer nodes that the
+    endpoint lists (i.e. snapshots).  This is never done on its own: an
+    operator runs it, from one node, to recover.  With --dry-run, what
+    would be removed, and from which nodes, is only listed.  Not all
+    plugins support this command.
+
 
 STORAGE COMMANDS
 
@@ -181,6 +272,137 @@ STORAGE COMMANDS
 
     Removes a backup archive from the backing storage, using the
     STORAGE-HANDLE given by a previous 'store' command.
+
+  purge --keys-from FILE --endpoint STORE-ENDPOINT-JSON
+
+    Removes several backup archives from the backing storage, reading
+    their STORAGE-HANDLEs from FILE (or standard input, if FILE is '-'),
+    one per line.  Plugins that support it delete them in bulk.
+
+  cleanup [--dry-run] --endpoint ENDPOINT-JSON
+
+    Removes the leftovers of interrupted operations: partial uploads
+    from the backing storage, or temporary files of backups on the
+    target system.  With --dry-run, they are only listed.  Not all
+    plugins support this command.
+
+  reconcile --keys-from FILE --endpoint STORE-ENDPOINT-JSON
+
+    Compares the STORAGE-HANDLEs read from FILE (or standard input, if
+    FILE is '-'), one per line, with the archives that are actually in
+    the backing storage, and prints, as JSON, those that are missing
+    from it, and the archives that are not in FILE (orphans).  Nothing
+    is removed.  Not all plugins support this command.
+
+  retrieve-restore --key STORAGE-HANDLE --endpoint STORE-ENDPOINT-JSON
+                   --target TARGET-ENDPOINT-JSON
+
+    Retrieves a backup archive from the backing storage, like 'retrieve',
+    and replays it to the target, like 'restore', in the same process,
+    without the archive going through SHIELD.  Only plugins that are both
+    a store and a target, and know how to stream archives from one to
+    the other, support this command; others fail with an unsupported
+    action, and 'retrieve' and 'restore' are to be run separately.
+
+
+STANDARD INPUT
+
+  When no command is given (and standard input is not a terminal),
+  the request is read from standard input instead, as a single line
+  of JSON, so that credentials stay out of the process table:
+
+    {"action":"retrieve","endpoint":{...},"key":"STORAGE-HANDLE"}
+
+  'key' is only needed for retrieve, purge and retrieve-restore, and
+  'target', the target endpoint, only for retrieve-restore.  The line must end
+  with a newline; for restore and store, the archive follows it.
+  Options are still given on the command line.
+
+
+NOTIFICATIONS
+
+  Any endpoint may set 'notify_url' to have the outcome of backup,
+  restore, store, retrieve and purge commands POSTed to that URL, as
+  a JSON document (plugin, action, status, duration and error).
+  'notify_on' can be set to 'success', 'failure' or 'always' (the
+  default), and 'notify_token' is sent as a bearer token, if set.
+  Failing to notify does not fail the command, but 'validate' fails
+  on a 'notify_url' that is not an http(s) URL, or a bad 'notify_on'.
+
+
+SCHEDULING
+
+  Any endpoint may set 'nice_level' (0 to 19) and / or 'ionice_class'
+  ('idle' or 'best-effort') to run all the commands that the plugin
+  spawns at a lower CPU and / or I/O priority, through the 'nice' and
+  'ionice' utilities.  By default, priorities are left untouched.
+
+  Set the SHIELD_PLUGIN_MAX_CONCURRENCY environment variable to cap how
+  many backups and restores may run heavy commands (tar, xtrabackup,
+  sstableloader, dump and restore tools) on the host at the same time.
+  The others wait for their turn.  Slots are held with file locks in
+  the temporary directory, that are released when the plugin exits,
+  even if it crashes.
+
+
+STAGING
+
+  Target endpoints may set 'staging_mode', an octal mode like '0700',
+  to have the directories and files in which backup data is staged
+  on disk created with that mode (files without the execute bits),
+  instead of the modes each plugin picks.  The owner must keep full
+  access.  Data the plugin does not create itself (i.e. hard links
+  to live database files) keeps its own mode.
+
+  Staging directories are removed once the plugin is done, whether it
+  succeeded or not.  Target endpoints may set 'keep_staging_on_failure'
+  to true to leave them behind when a backup or a restore fails, for
+  inspection; their path is printed.  The next run removes them.
+
+
+OUTPUT
+
+  Progress and validation messages are only colored when they are
+  written to a terminal.  Set the NO_COLOR or SHIELD_PLUGIN_NO_COLOR
+  environment variable to always get plain text.
+
+  When a job ID is given (with --job-id, or the SHIELD_JOB_ID
+  environment variable), every message line (debugging included) is
+  prefixed with '[JOB-ID] ', so that the lifecycle of a single job can
+  be grepped out of logs shared by concurrent runs.  The job ID is
+  also sent in notifications, and passed on to the plugins and
+  commands that the plugin runs.
+
+
+RESULTS
+
+  With --result-file PATH (or --result-fd FD, for a file descriptor
+  that the caller opened, i.e. 3), the outcome of the command is also
+  written there, as a single line of JSON, for orchestrators to read
+  instead of parsing messages:
+
+    {"version":1,"action":"store","status":"success","key":"...",
+     "bytes":1048576,"duration_ms":1234}
+
+  'status' is 'success' or 'failure' (with an 'error' message), 'key'
+  is only there for successful stores, and 'bytes' only when the
+  plugin knows how much data it moved.  'version' is the version of
+  the schema; fields may be added to it, but not removed or changed.
+
+
+STATUS
+
+  With --status-port PORT, the plugin serves the progress of the
+  command over HTTP while it runs, and stops when it is done:
+
+    $ curl http://127.0.0.1:PORT/status
+    {"action":"backup","elapsed":1234.5,"bytes":1048576,
+     "step":"running 'xtrabackup'"}
+
+  'elapsed' is in seconds, 'bytes' is only there once the plugin
+  knows how much data it moved, and 'step' is what it is busy with.
+  It only listens on localhost, unless --status-bind says otherwise;
+  there is no authentication.
 `)
 		os.Exit(0)
 	}
@@ -196,6 +418,21 @@ STORAGE COMMANDS
 		os.Exit(0)
 	}
 
+	if command == "" && !stdinIsTerminal() {
+		req, err := readRequest(os.Stdin)
+		if err != nil {
+			Fprintf(os.Stderr, "@R{%s}\n", err.Error())
+			os.Exit(codeForError(err))
+		}
+		command, opt.Endpoint = req.Action, string(req.Endpoint)
+		if req.Key != "" {
+			opt.Key = req.Key
+		}
+		if len(req.Target) > 0 {
+			opt.Target = string(req.Target)
+		}
+	}
+
 	switch command {
 	case "info":
 		json, err := json.MarshalIndent(info, "", "    ")
@@ -206,32 +443,58 @@ STORAGE COMMANDS
 		fmt.Printf("%s\n", json)
 		os.Exit(0)
 
+	case "schema":
+		json, err := pluginSchema(info)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(JSON_FAILURE)
+		}
+		fmt.Printf("%s\n", json)
+		os.Exit(0)
+
+	case "describe":
+		json, err := describePlugin(p)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(JSON_FAILURE)
+		}
+		fmt.Printf("%s\n", json)
+		os.Exit(0)
+
 	default:
 		err = dispatch(p, command, opt)
 		DEBUG("'%s' action returned %#v", command, err)
 		if err != nil {
-			switch err.(type) {
-			case UnsupportedActionError:
-				if err.(UnsupportedActionError).Action == "" {
-					e := err.(UnsupportedActionError)
-					e.Action = command
-					err = e
-				}
-			}
-			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			Fprintf(os.Stderr, "@R{%s}\n", err.Error())
 			os.Exit(codeForError(err))
 		}
 	}
 	os.Exit(0)
 }
 
-func dispatch(p Plugin, mode string, opt Opt) error {
-	var err error
+func dispatch(p Plugin, mode string, opt Opt) (err error) {
 	var key string
 	var endpoint ShieldEndpoint
 
 	DEBUG("'%s' action requested with options %#v", mode, opt)
 
+	started := time.Now()
+	startStatus(mode, started)
+	if opt.ResultFile != "" || opt.ResultFD > 0 || opt.StatusPort > 0 {
+		countStreams()
+	}
+	defer serveStatus(opt)()
+	defer func() {
+		if e, ok := err.(UnsupportedActionError); ok && e.Action == "" {
+			e.Action = mode
+			err = e
+		}
+		if endpoint != nil && mode != "validate" {
+			notify(endpoint, p.Meta(), mode, started, err)
+		}
+		writeResult(opt, mode, key, started, err)
+	}()
+
 	switch mode {
 	case "validate":
 		endpoint, err = getEndpoint(opt.Endpoint)
@@ -239,23 +502,53 @@ func dispatch(p Plugin, mode string, opt Opt) error {
 			return err
 		}
 		err = p.Validate(endpoint)
+		if err == nil {
+			err = validatePriority(endpoint)
+		}
+		if err == nil {
+			err = validateStagingMode(endpoint)
+		}
+		if err == nil {
+			err = validateNotify(endpoint)
+		}
 	case "backup":
 		endpoint, err = getEndpoint(opt.Endpoint)
 		if err != nil {
 			return err
 		}
+		if err = setPriority(endpoint); err != nil {
+			return err
+		}
+		if err = setStagingMode(endpoint); err != nil {
+			return err
+		}
+		if err = setConcurrency(); err != nil {
+			return err
+		}
 		err = p.Backup(endpoint)
 	case "restore":
 		endpoint, err = getEndpoint(opt.Endpoint)
 		if err != nil {
 			return err
 		}
+		if err = setPriority(endpoint); err != nil {
+			return err
+		}
+		if err = setStagingMode(endpoint); err != nil {
+			return err
+		}
+		if err = setConcurrency(); err != nil {
+			return err
+		}
 		err = p.Restore(endpoint)
 	case "store":
 		endpoint, err = getEndpoint(opt.Endpoint)
 		if err != nil {
 			return err
 		}
+		if err = setPriority(endpoint); err != nil {
+			return err
+		}
 		key, err = p.Store(endpoint)
 		output, jsonErr := json.MarshalIndent(struct {
 			Key string `json:"key"`
@@ -269,6 +562,9 @@ func dispatch(p Plugin, mode string, opt Opt) error {
 		if err != nil {
 			return err
 		}
+		if err = setPriority(endpoint); err != nil {
+			return err
+		}
 		if opt.Key == "" {
 			return MissingRestoreKeyError{}
 		}
@@ -279,10 +575,94 @@ func dispatch(p Plugin, mode string, opt Opt) error {
 		if err != nil {
 			return err
 		}
+		if err = setPriority(endpoint); err != nil {
+			return err
+		}
+		if opt.KeysFrom != "" {
+			keys, err := readKeys(opt.KeysFrom)
+			if err != nil {
+				return err
+			}
+			if opt.Key != "" {
+				keys = append(keys, opt.Key)
+			}
+			if len(keys) == 0 {
+				return MissingRestoreKeyError{}
+			}
+			return purgeKeys(p, endpoint, keys)
+		}
 		if opt.Key == "" {
 			return MissingRestoreKeyError{}
 		}
 		err = p.Purge(endpoint, opt.Key)
+
+	case "cleanup":
+		endpoint, err = getEndpoint(opt.Endpoint)
+		if err != nil {
+			return err
+		}
+		err = cleanup(p, endpoint, opt.DryRun)
+
+	case "list-snapshots":
+		endpoint, err = getEndpoint(opt.Endpoint)
+		if err != nil {
+			return err
+		}
+		err = listSnapshots(p, endpoint)
+
+	case "cleanup-cluster":
+		endpoint, err = getEndpoint(opt.Endpoint)
+		if err != nil {
+			return err
+		}
+		err = cleanupCluster(p, endpoint, opt.DryRun)
+
+	case "reconcile":
+		endpoint, err = getEndpoint(opt.Endpoint)
+		if err != nil {
+			return err
+		}
+		if opt.KeysFrom == "" && opt.Key == "" {
+			return MissingRestoreKeyError{}
+		}
+		keys := []string{}
+		if opt.KeysFrom != "" {
+			if keys, err = readKeys(opt.KeysFrom); err != nil {
+				return err
+			}
+		}
+		if opt.Key != "" {
+			keys = append(keys, opt.Key)
+		}
+		err = reconcile(p, endpoint, keys)
+
+	case "retrieve-restore":
+		endpoint, err = getEndpoint(opt.Endpoint)
+		if err != nil {
+			return err
+		}
+		if opt.Target == "" {
+			return fmt.Errorf("Missing required --target flag")
+		}
+		var target ShieldEndpoint
+		if target, err = getEndpoint(opt.Target); err != nil {
+			return err
+		}
+		/* the restore is what does the heavy lifting */
+		if err = setPriority(target); err != nil {
+			return err
+		}
+		if err = setStagingMode(target); err != nil {
+			return err
+		}
+		if err = setConcurrency(); err != nil {
+			return err
+		}
+		if opt.Key == "" {
+			return MissingRestoreKeyError{}
+		}
+		return retrieveRestore(p, endpoint, opt.Key, target)
+
 	default:
 		return UnsupportedActionError{Action: mode}
 	}
@@ -304,27 +684,35 @@ func GenUUID() string {
 }
 
 func codeForError(e error) int {
-	var code int
-	if e != nil {
-		switch e.(type) {
-		case UnsupportedActionError:
-			code = UNSUPPORTED_ACTION
-		case EndpointMissingRequiredDataError:
-			code = ENDPOINT_MISSING_KEY
-		case EndpointDataTypeMismatchError:
-			code = ENDPOINT_BAD_DATA
-		case ExecFailure:
-			code = EXEC_FAILURE
-		case JSONError:
-			code = JSON_FAILURE
-		case MissingRestoreKeyError:
-			code = RESTORE_KEY_REQUIRED
-		default:
-			code = PLUGIN_FAILURE
-		}
-	} else {
-		code = SUCCESS
+	if e == nil {
+		return SUCCESS
 	}
 
-	return code
+	var (
+		unsupported UnsupportedActionError
+		missingKey  EndpointMissingRequiredDataError
+		mismatch    EndpointDataTypeMismatchError
+		config      ConfigError
+		failure     ExecFailure
+		execErr     ExecError
+		timeout     ExecTimeoutError
+		jsonErr     JSONError
+		restoreKey  MissingRestoreKeyError
+	)
+	switch {
+	case errors.As(e, &unsupported):
+		return UNSUPPORTED_ACTION
+	case errors.As(e, &missingKey):
+		return ENDPOINT_MISSING_KEY
+	case errors.As(e, &mismatch), errors.As(e, &config):
+		return ENDPOINT_BAD_DATA
+	case errors.As(e, &failure), errors.As(e, &execErr), errors.As(e, &timeout):
+		return EXEC_FAILURE
+	case errors.As(e, &jsonErr):
+		return JSON_FAILURE
+	case errors.As(e, &restoreKey):
+		return RESTORE_KEY_REQUIRED
+	default:
+		return PLUGIN_FAILURE
+	}
 }
@@ -24,6 +24,10 @@
 //        "pg_port":"port-above-pg-server-listens-on", # optional
 //        "pg_database": "name-of-db-to-backup",       # optional
 //        "pg_bindir": "PostgreSQL binaries directory" # optional
+//        "pg_ssl_mode": "verify-full",                # optional
+//        "pg_ssl_ca":   "/path/to/ca.pem",            # optional
+//        "pg_ssl_cert": "/path/to/client.pem",        # optional
+//        "pg_ssl_key":  "/path/to/client.key"         # optional
 //    }
 //
 // Default Configuration
@@ -48,6 +52,17 @@
 // '/var/vcap/packages/postgres-9.4/bin', which is provided by the
 // `agent-pgtools' package in the SHIELD BOSH release.
 //
+// The `pg_ssl_mode` field is optional. It sets how the connections to the
+// server are secured: `disable`, `require` (encrypted, but the certificate of
+// the server is not checked), `verify-ca` (the certificate must be signed by
+// the CA in `pg_ssl_ca`) or `verify-full` (it must also be issued for
+// `pg_host`). If not specified, libpq only encrypts connections when the
+// server offers it. The `pg_ssl_cert` and `pg_ssl_key` fields point to a
+// client certificate and its key, for servers that require them. All of
+// these files must exist on the SHIELD agent; validating the endpoint checks
+// that they do. Managed cloud databases usually require `verify-full`, with
+// the CA bundle of the provider.
+//
 // BACKUP DETAILS
 //
 // The `postgres` plugin makes use of `pg_dumpall -c` to back up all databases
@@ -114,7 +129,12 @@ func main() {
 
   "pg_port"     : "5432",             # Port that PostgreSQL is listening on
   "pg_database" : "db1",              # Limit backup/restore operation to this database
-  "pg_bindir"   : "/path/to/pg/bin"   # Where to find the psql command
+  "pg_bindir"   : "/path/to/pg/bin",  # Where to find the psql command
+
+  "pg_ssl_mode" : "verify-full",          # disable, require, verify-ca or verify-full
+  "pg_ssl_ca"   : "/path/to/ca.pem",      # CA certificates to verify the server with
+  "pg_ssl_cert" : "/path/to/client.pem",  # Client certificate, for mutual TLS
+  "pg_ssl_key"  : "/path/to/client.key"   # Key of the client certificate
 }
 `,
 		Defaults: `
@@ -137,6 +157,7 @@ type PostgresConnectionInfo struct {
 	Password string
 	Bin      string
 	Database string
+	SSLSettings
 }
 
 func (p PostgresPlugin) Meta() PluginInfo {
@@ -193,8 +214,62 @@ func (p PostgresPlugin) Validate(endpoint ShieldEndpoint) error {
 		ansi.Printf("@G{\u2713 pg_database}  @C{%s}\n", s)
 	}
 
+	var ssl SSLSettings
+	sslErrors := map[string]error{}
+	for key, value := range map[string]*string{
+		"pg_ssl_mode": &ssl.SSLMode,
+		"pg_ssl_ca":   &ssl.SSLCA,
+		"pg_ssl_cert": &ssl.SSLCert,
+		"pg_ssl_key":  &ssl.SSLKey,
+	} {
+		if *value, err = endpoint.StringValueDefault(key, ""); err != nil {
+			sslErrors[key] = err
+		}
+	}
+	if len(sslErrors) == 0 {
+		if err, ok := CheckSSL("pg", ssl).(ConfigError); ok {
+			sslErrors[err.Key] = err
+		}
+	}
+
+	if err = sslErrors["pg_ssl_mode"]; err != nil {
+		ansi.Printf("@R{\u2717 pg_ssl_mode  %s}\n", err)
+		fail = true
+	} else if ssl.SSLMode == "" {
+		ansi.Printf("@G{\u2713 pg_ssl_mode}  using the client default (@C{prefer})\n")
+	} else {
+		ansi.Printf("@G{\u2713 pg_ssl_mode}  @C{%s}\n", ssl.SSLMode)
+	}
+
+	if err = sslErrors["pg_ssl_ca"]; err != nil {
+		ansi.Printf("@R{\u2717 pg_ssl_ca    %s}\n", err)
+		fail = true
+	} else if ssl.SSLCA == "" {
+		ansi.Printf("@G{\u2713 pg_ssl_ca}    none\n")
+	} else {
+		ansi.Printf("@G{\u2713 pg_ssl_ca}    @C{%s}\n", ssl.SSLCA)
+	}
+
+	if err = sslErrors["pg_ssl_cert"]; err != nil {
+		ansi.Printf("@R{\u2717 pg_ssl_cert  %s}\n", err)
+		fail = true
+	} else if ssl.SSLCert == "" {
+		ansi.Printf("@G{\u2713 pg_ssl_cert}  none\n")
+	} else {
+		ansi.Printf("@G{\u2713 pg_ssl_cert}  @C{%s}\n", ssl.SSLCert)
+	}
+
+	if err = sslErrors["pg_ssl_key"]; err != nil {
+		ansi.Printf("@R{\u2717 pg_ssl_key   %s}\n", err)
+		fail = true
+	} else if ssl.SSLKey == "" {
+		ansi.Printf("@G{\u2713 pg_ssl_key}   none\n")
+	} else {
+		ansi.Printf("@G{\u2713 pg_ssl_key}   @C{%s}\n", ssl.SSLKey)
+	}
+
 	if fail {
-		return fmt.Errorf("postgres: invalid configuration")
+		return ValidationError{Plugin: "postgres"}
 	}
 	return nil
 }
@@ -303,6 +378,7 @@ func setupEnvironmentVariables(pg *PostgresConnectionInfo) {
 	os.Setenv("PGPASSWORD", pg.Password)
 	os.Setenv("PGHOST", pg.Host)
 	os.Setenv("PGPORT", pg.Port)
+	setupSSLEnvironment(pg)
 }
 
 func pgConnectionInfo(endpoint ShieldEndpoint) (*PostgresConnectionInfo, error) {
@@ -342,12 +418,31 @@ func pgConnectionInfo(endpoint ShieldEndpoint) (*PostgresConnectionInfo, error)
 	}
 	DEBUG("PGBINDIR: '%s'", bin)
 
-	return &PostgresConnectionInfo{
+	pg := &PostgresConnectionInfo{
 		Host:     host,
 		Port:     port,
 		User:     user,
 		Password: password,
 		Bin:      bin,
 		Database: database,
-	}, nil
+	}
+
+	if pg.SSLMode, err = endpoint.StringValueDefault("pg_ssl_mode", ""); err != nil {
+		return nil, err
+	}
+	if pg.SSLCA, err = endpoint.StringValueDefault("pg_ssl_ca", ""); err != nil {
+		return nil, err
+	}
+	if pg.SSLCert, err = endpoint.StringValueDefault("pg_ssl_cert", ""); err != nil {
+		return nil, err
+	}
+	if pg.SSLKey, err = endpoint.StringValueDefault("pg_ssl_key", ""); err != nil {
+		return nil, err
+	}
+	if err = CheckSSL("pg", pg.SSLSettings); err != nil {
+		return nil, err
+	}
+	DEBUG("PGSSLMODE: '%s'", pg.SSLMode)
+
+	return pg, nil
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+// TLS connections
+//
+// `pg_ssl_mode` sets how psql, pg_dump and pg_dumpall secure their
+// connection to the server (it is handed over as PGSSLMODE): `disable`,
+// `require` (encrypted, without checking the certificate of the server),
+// `verify-ca` (signed by the CA in `pg_ssl_ca`), or `verify-full` (signed by
+// that CA, and issued for `pg_host`).  Left empty, the libpq default applies
+// (`prefer`: encrypted if the server offers it).  `pg_ssl_cert` and
+// `pg_ssl_key` hold the client certificate and key, for servers that want
+// them (PGSSLCERT and PGSSLKEY); the key file must not be readable by group
+// or others, or libpq ignores it.
+
+// setupSSLEnvironment hands the TLS settings over to libpq.
+func setupSSLEnvironment(pg *PostgresConnectionInfo) {
+	for name, value := range map[string]string{
+		"PGSSLMODE":     pg.SSLMode,
+		"PGSSLROOTCERT": pg.SSLCA,
+		"PGSSLCERT":     pg.SSLCert,
+		"PGSSLKEY":      pg.SSLKey,
+	} {
+		if value == "" {
+			continue
+		}
+		DEBUG("   %s=%s", name, value)
+		os.Setenv(name, value)
+	}
+}
@@ -0,0 +1,108 @@
+package plugin
+
+import (
+	"fmt"
+	"strconv"
+)
+
+/*
+
+Backups compete with production workloads for CPU and disk I/O.  Any
+endpoint can set `nice_level` (0-19) and / or `ionice_class` (`idle` or
+`best-effort`), to have every command spawned through Exec() and
+ExecWithOptions() run at a lower priority, by way of the `nice` and
+`ionice` utilities.  By default, priorities are left alone.
+
+*/
+
+const (
+	IONiceIdle       = "idle"
+	IONiceBestEffort = "best-effort"
+
+	MaxNiceLevel = 19
+)
+
+// The `ionice -c` numbers for each of the supported scheduling classes.
+var ioniceClasses = map[string]string{
+	IONiceIdle:       "3",
+	IONiceBestEffort: "2",
+}
+
+type priority struct {
+	nice    int
+	ioclass string
+}
+
+// The priority to run spawned commands at, as configured by the endpoint
+// of the action being run.
+var execPriority priority
+
+func priorityFor(endpoint ShieldEndpoint) (priority, error) {
+	n, err := endpoint.FloatValueDefault("nice_level", 0)
+	if err != nil {
+		return priority{}, err
+	}
+	if n < 0 || n > MaxNiceLevel || n != float64(int(n)) {
+		return priority{}, ConfigError{Key: "nice_level",
+			Err: fmt.Errorf("nice_level must be a whole number between 0 and %d (got %v)", MaxNiceLevel, n)}
+	}
+
+	class, err := endpoint.StringValueDefault("ionice_class", "")
+	if err != nil {
+		return priority{}, err
+	}
+	if _, ok := ioniceClasses[class]; class != "" && !ok {
+		return priority{}, ConfigError{Key: "ionice_class",
+			Err: fmt.Errorf("ionice_class must be either '%s' or '%s' (got '%s')", IONiceIdle, IONiceBestEffort, class)}
+	}
+
+	return priority{nice: int(n), ioclass: class}, nil
+}
+
+// setPriority configures the priority of all subsequently spawned commands.
+func setPriority(endpoint ShieldEndpoint) error {
+	p, err := priorityFor(endpoint)
+	if err != nil {
+		return err
+	}
+	execPriority = p
+	if p.nice > 0 || p.ioclass != "" {
+		DEBUG("running commands with nice level %d, ionice class '%s'", p.nice, p.ioclass)
+	}
+	return nil
+}
+
+// validatePriority prints out the scheduling configuration, for the
+// `validate` action.
+func validatePriority(endpoint ShieldEndpoint) error {
+	_, hasNice := endpoint["nice_level"]
+	_, hasIONice := endpoint["ionice_class"]
+	if !hasNice && !hasIONice {
+		return nil
+	}
+
+	p, err := priorityFor(endpoint)
+	if err != nil {
+		Printf("@R{\u2717 scheduling  %s}\n", err)
+		return ValidationError{Plugin: "scheduling"}
+	}
+	Printf("@G{\u2713 nice_level}    @C{%d}\n", p.nice)
+	if p.ioclass == "" {
+		Printf("@G{\u2713 ionice_class}  not set\n")
+	} else {
+		Printf("@G{\u2713 ionice_class}  @C{%s}\n", p.ioclass)
+	}
+	return nil
+}
+
+// wrap prefixes the command arguments with the `ionice` and `nice`
+// invocations needed to run at the configured priority.
+func (p priority) wrap(args []string) []string {
+	if p.nice > 0 {
+		args = append([]string{"nice", "-n", strconv.Itoa(p.nice)}, args...)
+	}
+	if p.ioclass != "" {
+		args = append([]string{"ionice", "-c", ioniceClasses[p.ioclass]}, args...)
+	}
+	return args
+}
@@ -0,0 +1,53 @@
+package plugin
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Command Scheduling Priority", func() {
+	AfterEach(func() {
+		execPriority = priority{}
+	})
+
+	It("leaves commands alone by default", func() {
+		p, err := priorityFor(ShieldEndpoint{})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(p.wrap([]string{"tar", "-cf", "-", "."})).Should(Equal([]string{"tar", "-cf", "-", "."}))
+	})
+
+	It("wraps commands with nice and ionice", func() {
+		p, err := priorityFor(ShieldEndpoint{"nice_level": 10.0, "ionice_class": "idle"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(p.wrap([]string{"tar", "-cf", "-", "."})).Should(Equal([]string{
+			"ionice", "-c", "3", "nice", "-n", "10", "tar", "-cf", "-", ".",
+		}))
+
+		p, err = priorityFor(ShieldEndpoint{"ionice_class": "best-effort"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(p.wrap([]string{"xtrabackup"})).Should(Equal([]string{"ionice", "-c", "2", "xtrabackup"}))
+	})
+
+	It("validates the ranges", func() {
+		for _, bad := range []ShieldEndpoint{
+			{"nice_level": -5.0},
+			{"nice_level": 20.0},
+			{"nice_level": 2.5},
+			{"nice_level": "high"},
+			{"ionice_class": "realtime"},
+		} {
+			_, err := priorityFor(bad)
+			Ω(err).Should(HaveOccurred(), "endpoint %v should be rejected", bad)
+		}
+	})
+
+	It("applies the priority to executed commands", func() {
+		Ω(setPriority(ShieldEndpoint{"nice_level": 5.0})).Should(Succeed())
+		Ω(ExecWithOptions(ExecOptions{Cmd: "test/bin/exec_tester 0"})).Should(Succeed())
+
+		err := ExecWithOptions(ExecOptions{Cmd: "test/bin/exec_tester 1"})
+		Ω(err).Should(HaveOccurred())
+		Ω(err.(ExecError).Cmd).Should(Equal("test/bin/exec_tester"))
+		Ω(err.(ExecError).RC).Should(Equal(1))
+	})
+})
@@ -0,0 +1,54 @@
+package plugin
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+// BulkPurger can be implemented by storage plugins that are able to remove
+// several backup archives at once, more efficiently than one at a time.
+// It is used by `purge --keys-from`; plugins that do not implement it get
+// their Purge() method called once for each key.
+type BulkPurger interface {
+	PurgeAll(ShieldEndpoint, []string) error
+}
+
+// readKeys reads storage handles, one per line, from the named file (or
+// from standard input, if the path is "-").  Blank lines are ignored.
+func readKeys(path string) ([]string, error) {
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	keys := []string{}
+	s := bufio.NewScanner(in)
+	for s.Scan() {
+		if key := strings.TrimSpace(s.Text()); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys, s.Err()
+}
+
+func purgeKeys(p Plugin, endpoint ShieldEndpoint, keys []string) error {
+	if bulk, ok := p.(BulkPurger); ok && len(keys) > 1 {
+		DEBUG("purging %d keys in bulk", len(keys))
+		return bulk.PurgeAll(endpoint, keys)
+	}
+
+	for _, key := range keys {
+		DEBUG("purging '%s'", key)
+		if err := p.Purge(endpoint, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -153,7 +153,7 @@ func (p RabbitMQBrokerPlugin) Validate(endpoint plugin.ShieldEndpoint) error {
 	}
 
 	if fail {
-		return fmt.Errorf("rabbitmq-broker: invalid configuration")
+		return plugin.ValidationError{Plugin: "rabbitmq-broker"}
 	}
 	return nil
 }
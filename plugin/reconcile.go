@@ -0,0 +1,73 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// StoreLister can be implemented by storage plugins that are able to list
+// the archives they hold.  It is used by the `reconcile` command, which
+// compares them with the storage handles that SHIELD knows about.  Keys
+// must be returned in the very form Store() returned them.
+type StoreLister interface {
+	StoredKeys(ShieldEndpoint) ([]string, error)
+}
+
+// Reconciliation is what the `reconcile` command reports: the keys that
+// SHIELD knows about but that are missing from the store, and the archives
+// of the store that SHIELD does not know about (orphans).
+type Reconciliation struct {
+	Known   int      `json:"known"`
+	Stored  int      `json:"stored"`
+	Missing []string `json:"missing"`
+	Orphans []string `json:"orphans"`
+}
+
+// reconcileKeys compares the keys SHIELD knows about with those that are
+// in the store.  Both lists are reported sorted, without duplicates.
+func reconcileKeys(known, stored []string) Reconciliation {
+	inStore := map[string]bool{}
+	for _, key := range stored {
+		inStore[key] = true
+	}
+	isKnown := map[string]bool{}
+	for _, key := range known {
+		isKnown[key] = true
+	}
+
+	r := Reconciliation{Known: len(isKnown), Stored: len(inStore), Missing: []string{}, Orphans: []string{}}
+	for key := range isKnown {
+		if !inStore[key] {
+			r.Missing = append(r.Missing, key)
+		}
+	}
+	for key := range inStore {
+		if !isKnown[key] {
+			r.Orphans = append(r.Orphans, key)
+		}
+	}
+	sort.Strings(r.Missing)
+	sort.Strings(r.Orphans)
+	return r
+}
+
+func reconcile(p Plugin, endpoint ShieldEndpoint, keys []string) error {
+	l, ok := p.(StoreLister)
+	if !ok {
+		return UnsupportedActionError{Action: "reconcile"}
+	}
+	stored, err := l.StoredKeys(endpoint)
+	if err != nil {
+		return err
+	}
+	r := reconcileKeys(keys, stored)
+	DEBUG("%d known keys, %d stored: %d missing, %d orphans", r.Known, r.Stored, len(r.Missing), len(r.Orphans))
+
+	output, err := json.MarshalIndent(r, "", "    ")
+	if err != nil {
+		return JSONError{Err: fmt.Sprintf("Could not JSON encode reconciliation: %s", err.Error())}
+	}
+	fmt.Printf("%s\n", string(output))
+	return nil
+}
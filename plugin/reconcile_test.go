@@ -0,0 +1,32 @@
+package plugin
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reconciliation", func() {
+	It("reports missing keys and orphans, sorted and without duplicates", func() {
+		r := reconcileKeys(
+			[]string{"b/2", "a/1", "c/3", "a/1"},
+			[]string{"d/4", "a/1", "c/3", "e/5"},
+		)
+		Ω(r.Known).Should(Equal(3))
+		Ω(r.Stored).Should(Equal(4))
+		Ω(r.Missing).Should(Equal([]string{"b/2"}))
+		Ω(r.Orphans).Should(Equal([]string{"d/4", "e/5"}))
+	})
+
+	It("reports empty lists, rather than nulls, when nothing drifted", func() {
+		r := reconcileKeys([]string{"a/1"}, []string{"a/1"})
+		Ω(r.Missing).ShouldNot(BeNil())
+		Ω(r.Missing).Should(BeEmpty())
+		Ω(r.Orphans).ShouldNot(BeNil())
+		Ω(r.Orphans).Should(BeEmpty())
+	})
+
+	It("is not supported by plugins that can't list their archives", func() {
+		err := reconcile(nil, ShieldEndpoint{}, []string{})
+		Ω(err).Should(Equal(UnsupportedActionError{Action: "reconcile"}))
+	})
+})
@@ -121,7 +121,7 @@ func (p RedisBrokerPlugin) Validate(endpoint plugin.ShieldEndpoint) error {
 	}
 
 	if fail {
-		return fmt.Errorf("postgres: invalid configuration")
+		return plugin.ValidationError{Plugin: "postgres"}
 	}
 	return nil
 }
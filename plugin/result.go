@@ -0,0 +1,129 @@
+package plugin
+
+/*
+
+Results give SHIELD core (or any other orchestrator) the outcome of a plugin
+run in a structured form, so that it does not have to scrape the messages
+written to standard error, which are meant for humans, and may be colored.
+When the plugin is given `--result-file PATH`, or `--result-fd FD` (i.e. 3,
+a descriptor that the caller opened for the plugin), a single line of JSON
+is written there once the action is done, whatever its outcome:
+
+    {"version":1,"action":"store","status":"success","key":"2024/01/02/...","bytes":1048576,"duration_ms":1234}
+    {"version":1,"action":"backup","status":"failure","duration_ms":532,"error":"Unable to exec 'tar': exit status 2"}
+
+Version 1 of the schema has the following fields:
+
+    version      always 1; bumped on incompatible changes
+    action       the command that was run (backup, restore, store, ...)
+    status       "success" or "failure"
+    key          the storage handle, for a successful store
+    bytes        how many bytes the action moved, when the plugin knows
+                 (or as counted by Exec(); see CountingReader)
+    duration_ms  how long the action took, in milliseconds
+    error        the error message, on failure
+
+Fields may be added to version 1, but not removed or changed; consumers
+must ignore fields they do not know.  Standard output is left alone, since
+it carries the archive (or the key) and standard error keeps the messages.
+Failing to write the result never fails the action; it is only reported on
+standard error.
+
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ResultVersion is the version of the result schema.
+const ResultVersion = 1
+
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+type Result struct {
+	Version    int    `json:"version"`
+	Action     string `json:"action"`
+	Status     string `json:"status"`
+	Key        string `json:"key,omitempty"`
+	Bytes      *int64 `json:"bytes,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+var (
+	resultBytes *int64
+	resultLock  sync.Mutex
+)
+
+// ReportBytes records how many bytes the current action moved (i.e. the
+// size of the archive it stored), for the result and the status endpoint.
+func ReportBytes(n int64) {
+	resultLock.Lock()
+	resultBytes = &n
+	resultLock.Unlock()
+}
+
+func reportedBytes() *int64 {
+	resultLock.Lock()
+	defer resultLock.Unlock()
+	if resultBytes == nil && streamedBytes != nil {
+		/* what Exec() streamed, when it counts */
+		if n := streamedBytes(); n > 0 {
+			return &n
+		}
+	}
+	return resultBytes
+}
+
+func newResult(action, key string, started time.Time, err error) Result {
+	r := Result{
+		Version:    ResultVersion,
+		Action:     action,
+		Status:     ResultSuccess,
+		Key:        key,
+		Bytes:      reportedBytes(),
+		DurationMS: int64(time.Since(started) / time.Millisecond),
+	}
+	if err != nil {
+		r.Status = ResultFailure
+		r.Key = ""
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// writeResult writes the result of the action where --result-file or
+// --result-fd say, if anywhere.
+func writeResult(opt Opt, action, key string, started time.Time, actionErr error) {
+	if opt.ResultFile == "" && opt.ResultFD <= 0 {
+		return
+	}
+	b, err := json.Marshal(newResult(action, key, started, actionErr))
+	if err != nil {
+		Fprintf(os.Stderr, "@Y{unable to write the result: %s}\n", err)
+		return
+	}
+
+	var f *os.File
+	if opt.ResultFile != "" {
+		f, err = os.OpenFile(opt.ResultFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			Fprintf(os.Stderr, "@Y{unable to write the result: %s}\n", err)
+			return
+		}
+	} else {
+		f = os.NewFile(uintptr(opt.ResultFD), fmt.Sprintf("fd %d", opt.ResultFD))
+	}
+	defer f.Close()
+
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		Fprintf(os.Stderr, "@Y{unable to write the result to %s: %s}\n", f.Name(), err)
+	}
+}
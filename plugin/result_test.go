@@ -0,0 +1,84 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Results", func() {
+	var tmp string
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-plugin-result-")
+		Ω(err).ShouldNot(HaveOccurred())
+		resultBytes = nil
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+		resultBytes = nil
+	})
+
+	read := func(path string) map[string]interface{} {
+		b, err := ioutil.ReadFile(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(b).Should(HaveSuffix("\n"))
+		Ω(b[:len(b)-1]).ShouldNot(ContainSubstring("\n"))
+		var r map[string]interface{}
+		Ω(json.Unmarshal(b, &r)).Should(Succeed())
+		return r
+	}
+
+	It("writes a successful store as a single JSON line", func() {
+		path := filepath.Join(tmp, "result")
+		ReportBytes(1024)
+		writeResult(Opt{ResultFile: path}, "store", "some/key", time.Now().Add(-2*time.Second), nil)
+
+		r := read(path)
+		Ω(r["version"]).Should(BeEquivalentTo(ResultVersion))
+		Ω(r["action"]).Should(Equal("store"))
+		Ω(r["status"]).Should(Equal("success"))
+		Ω(r["key"]).Should(Equal("some/key"))
+		Ω(r["bytes"]).Should(BeEquivalentTo(1024))
+		Ω(r["duration_ms"]).Should(BeNumerically(">=", 2000))
+		Ω(r).ShouldNot(HaveKey("error"))
+	})
+
+	It("writes failures with their error, and leaves unknown fields out", func() {
+		path := filepath.Join(tmp, "result")
+		writeResult(Opt{ResultFile: path}, "backup", "", time.Now(), fmt.Errorf("it broke"))
+
+		r := read(path)
+		Ω(r["status"]).Should(Equal("failure"))
+		Ω(r["error"]).Should(Equal("it broke"))
+		Ω(r).ShouldNot(HaveKey("key"))
+		Ω(r).ShouldNot(HaveKey("bytes"))
+	})
+
+	It("writes the result to a file descriptor", func() {
+		path := filepath.Join(tmp, "result")
+		f, err := os.Create(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer f.Close()
+		/* writeResult closes the descriptor it is given, and f closes its own */
+		fd, err := syscall.Dup(int(f.Fd()))
+		Ω(err).ShouldNot(HaveOccurred())
+		writeResult(Opt{ResultFD: fd}, "purge", "", time.Now(), nil)
+
+		Ω(read(path)["action"]).Should(Equal("purge"))
+	})
+
+	It("writes nothing when not asked to", func() {
+		writeResult(Opt{}, "backup", "", time.Now(), nil)
+		Ω(ioutil.ReadDir(tmp)).Should(BeEmpty())
+	})
+})
@@ -0,0 +1,60 @@
+package plugin
+
+import (
+	"sort"
+	"time"
+)
+
+// StoredObject is a backup archive, as a storage plugin lists it.
+type StoredObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// ApplyRetention returns the objects that fall out of a retention policy,
+// and can be purged, oldest first.  Objects are kept when they are among the
+// `keepCount` most recent ones, OR when they are less than `keepDays` days
+// old; either rule is enough to keep an object.
+//
+// Objects that were last modified at the very same time as the oldest of
+// the `keepCount` most recent ones are kept too, so that ties never get an
+// object purged while another one, just as old, is kept.  Zero (or negative)
+// values disable the matching rule; when both are disabled, there is no
+// policy to apply, and nothing is purged.
+func ApplyRetention(objects []StoredObject, keepDays int, keepCount int) []StoredObject {
+	return applyRetention(objects, keepDays, keepCount, time.Now())
+}
+
+func applyRetention(objects []StoredObject, keepDays int, keepCount int, now time.Time) []StoredObject {
+	toDelete := []StoredObject{}
+	if keepDays <= 0 && keepCount <= 0 {
+		return toDelete
+	}
+
+	sorted := make([]StoredObject, len(objects))
+	copy(sorted, objects)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].LastModified.Equal(sorted[j].LastModified) {
+			return sorted[i].Key > sorted[j].Key
+		}
+		return sorted[i].LastModified.After(sorted[j].LastModified)
+	})
+
+	cutoff := now.Add(-time.Duration(keepDays) * 24 * time.Hour)
+	for i, o := range sorted {
+		if keepCount > 0 && (i < keepCount || o.LastModified.Equal(sorted[keepCount-1].LastModified)) {
+			continue
+		}
+		if keepDays > 0 && o.LastModified.After(cutoff) {
+			continue
+		}
+		toDelete = append(toDelete, o)
+	}
+
+	/* oldest first */
+	for i, j := 0, len(toDelete)-1; i < j; i, j = i+1, j-1 {
+		toDelete[i], toDelete[j] = toDelete[j], toDelete[i]
+	}
+	return toDelete
+}
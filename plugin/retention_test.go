@@ -0,0 +1,67 @@
+package plugin
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Retention", func() {
+	now := time.Date(2017, 6, 15, 12, 0, 0, 0, time.UTC)
+	daysAgo := func(key string, days int) StoredObject {
+		return StoredObject{Key: key, LastModified: now.Add(-time.Duration(days) * 24 * time.Hour)}
+	}
+	keys := func(objects []StoredObject) []string {
+		l := []string{}
+		for _, o := range objects {
+			l = append(l, o.Key)
+		}
+		return l
+	}
+
+	objects := []StoredObject{
+		daysAgo("d3", 3),
+		daysAgo("d0", 0),
+		daysAgo("d10", 10),
+		daysAgo("d1", 1),
+		daysAgo("d5", 5),
+	}
+
+	It("keeps the most recent objects", func() {
+		Ω(keys(applyRetention(objects, 0, 2, now))).Should(Equal([]string{"d10", "d5", "d3"}))
+	})
+
+	It("keeps the objects that are recent enough", func() {
+		Ω(keys(applyRetention(objects, 4, 0, now))).Should(Equal([]string{"d10", "d5"}))
+	})
+
+	It("keeps objects that either rule keeps", func() {
+		Ω(keys(applyRetention(objects, 2, 4, now))).Should(Equal([]string{"d10"}))
+		Ω(keys(applyRetention(objects, 6, 1, now))).Should(Equal([]string{"d10"}))
+	})
+
+	It("purges nothing without a policy", func() {
+		Ω(applyRetention(objects, 0, 0, now)).Should(BeEmpty())
+		Ω(applyRetention(objects, -1, -1, now)).Should(BeEmpty())
+	})
+
+	It("purges nothing when there is nothing to purge", func() {
+		Ω(applyRetention(nil, 1, 1, now)).Should(BeEmpty())
+		Ω(applyRetention(objects, 0, 10, now)).Should(BeEmpty())
+	})
+
+	It("keeps objects that are just as old as the oldest object kept by count", func() {
+		tied := append([]StoredObject{daysAgo("d3-bis", 3)}, objects...)
+		Ω(keys(applyRetention(tied, 0, 3, now))).Should(Equal([]string{"d10", "d5"}))
+	})
+
+	It("purges objects that are exactly keepDays old", func() {
+		Ω(keys(applyRetention(objects, 3, 0, now))).Should(Equal([]string{"d10", "d5", "d3"}))
+	})
+
+	It("does not reorder the objects it is given", func() {
+		applyRetention(objects, 1, 1, now)
+		Ω(keys(objects)).Should(Equal([]string{"d3", "d0", "d10", "d1", "d5"}))
+	})
+})
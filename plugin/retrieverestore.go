@@ -0,0 +1,54 @@
+package plugin
+
+import (
+	"io"
+	"io/ioutil"
+)
+
+// StreamRestorer can be implemented by plugins that are both a store and a
+// target (i.e. `fs`), to restore archives straight out of their storage,
+// in a single process, instead of having SHIELD pipe the output of a
+// `retrieve` into a `restore`.  It is used by the `retrieve-restore`
+// command.  RetrieveTo() must write the archive to out, just like
+// Retrieve() writes it to standard output, and RestoreFrom() must read it
+// from in, like Restore() reads it from standard input; neither may use
+// standard input or output for anything else.
+//
+// Plugins that do not implement it have `retrieve-restore` fail as an
+// unsupported action, and SHIELD is expected to fall back to running
+// `retrieve` and `restore` separately.
+type StreamRestorer interface {
+	RetrieveTo(store ShieldEndpoint, key string, out io.Writer) error
+	RestoreFrom(target ShieldEndpoint, in io.Reader) error
+}
+
+// retrieveRestore retrieves an archive from the store, and restores it to
+// the target, through an in-memory pipe.  When both fail, the retrieve
+// error is the one reported, since it is what made the restore fail.
+func retrieveRestore(p Plugin, store ShieldEndpoint, key string, target ShieldEndpoint) error {
+	s, ok := p.(StreamRestorer)
+	if !ok {
+		return UnsupportedActionError{Action: "retrieve-restore"}
+	}
+
+	r, w := io.Pipe()
+	retrieved := make(chan error, 1)
+	go func() {
+		err := s.RetrieveTo(store, key, w)
+		w.CloseWithError(err)
+		retrieved <- err
+	}()
+
+	err := s.RestoreFrom(target, r)
+	if err == nil {
+		/* whatever the restore left unread, i.e. tar padding */
+		io.Copy(ioutil.Discard, r)
+	}
+	/* unblocks the retrieve, when the restore gave up halfway through */
+	r.Close()
+
+	if rerr := <-retrieved; rerr != nil && rerr != io.ErrClosedPipe {
+		return rerr
+	}
+	return err
+}
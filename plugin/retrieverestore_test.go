@@ -0,0 +1,103 @@
+package plugin
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// streamPlugin stores archives in memory, and restores them into restored.
+type streamPlugin struct {
+	archives map[string][]byte
+	restored []byte
+
+	retrieveErr error
+	restoreErr  error
+	readAtMost  int
+}
+
+func (p *streamPlugin) Validate(ShieldEndpoint) error         { return nil }
+func (p *streamPlugin) Backup(ShieldEndpoint) error           { return UNIMPLEMENTED }
+func (p *streamPlugin) Restore(ShieldEndpoint) error          { return UNIMPLEMENTED }
+func (p *streamPlugin) Store(ShieldEndpoint) (string, error)  { return "", UNIMPLEMENTED }
+func (p *streamPlugin) Retrieve(ShieldEndpoint, string) error { return UNIMPLEMENTED }
+func (p *streamPlugin) Purge(ShieldEndpoint, string) error    { return UNIMPLEMENTED }
+func (p *streamPlugin) Meta() PluginInfo                      { return PluginInfo{Name: "stream"} }
+
+func (p *streamPlugin) RetrieveTo(store ShieldEndpoint, key string, out io.Writer) error {
+	/* in small writes, for the pipe to be exercised */
+	data := p.archives[key]
+	for len(data) > 0 {
+		n := 3
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := out.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return p.retrieveErr
+}
+
+func (p *streamPlugin) RestoreFrom(target ShieldEndpoint, in io.Reader) error {
+	if p.readAtMost > 0 {
+		in = io.LimitReader(in, int64(p.readAtMost))
+	}
+	var err error
+	if p.restored, err = ioutil.ReadAll(in); err != nil {
+		return err
+	}
+	return p.restoreErr
+}
+
+var _ = Describe("Retrieve and Restore in One Process", func() {
+	var p *streamPlugin
+
+	BeforeEach(func() {
+		p = &streamPlugin{archives: map[string][]byte{
+			"a/b/c": bytes.Repeat([]byte("archive "), 1000),
+		}}
+	})
+
+	It("restores the archive straight out of the store", func() {
+		Ω(retrieveRestore(p, ShieldEndpoint{}, "a/b/c", ShieldEndpoint{})).Should(Succeed())
+		Ω(p.restored).Should(Equal(p.archives["a/b/c"]))
+	})
+
+	It("succeeds when the restore leaves the end of the archive unread", func() {
+		p.readAtMost = 10
+		Ω(retrieveRestore(p, ShieldEndpoint{}, "a/b/c", ShieldEndpoint{})).Should(Succeed())
+		Ω(p.restored).Should(Equal([]byte("archive ar")))
+	})
+
+	It("reports the retrieve failure, which broke the restore", func() {
+		p.retrieveErr = errors.New("connection reset")
+		err := retrieveRestore(p, ShieldEndpoint{}, "a/b/c", ShieldEndpoint{})
+		Ω(err).Should(MatchError("connection reset"))
+	})
+
+	It("reports the restore failure, and stops retrieving", func() {
+		p.readAtMost = 10
+		p.restoreErr = errors.New("disk full")
+		err := retrieveRestore(p, ShieldEndpoint{}, "a/b/c", ShieldEndpoint{})
+		Ω(err).Should(MatchError("disk full"))
+	})
+
+	It("is not supported by plugins that can't stream archives", func() {
+		err := retrieveRestore(nil, ShieldEndpoint{}, "a/b/c", ShieldEndpoint{})
+		Ω(err).Should(Equal(UnsupportedActionError{Action: "retrieve-restore"}))
+	})
+
+	It("reads the target endpoint from standard input requests", func() {
+		req, err := readRequest(bytes.NewBufferString(`{"action":"retrieve-restore","endpoint":{"base_dir":"/store"},"key":"a/b/c","target":{"base_dir":"/data"}}` + "\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+		target, err := getEndpoint(string(req.Target))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(target.StringValue("base_dir")).Should(Equal("/data"))
+	})
+})
@@ -0,0 +1,92 @@
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// RunAs is an OS user that spawned commands can be run as, instead of the
+// user the plugin runs as, i.e. to read files that only the service user can
+// read.  Privileges can only be dropped when the plugin runs as root.
+type RunAs struct {
+	User   string
+	Uid    uint32
+	Gid    uint32
+	Groups []uint32
+}
+
+// LookupRunAs looks a user up, by name or by uid.
+func LookupRunAs(name string) (*RunAs, error) {
+	u, err := user.Lookup(name)
+	if _, isUID := err.(user.UnknownUserError); isUID {
+		if _, perr := strconv.ParseUint(name, 10, 32); perr == nil {
+			u, err = user.LookupId(name)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to find user '%s': %s", name, err)
+	}
+
+	r := &RunAs{User: u.Username}
+	id, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user '%s' has a non-numeric uid '%s'", name, u.Uid)
+	}
+	r.Uid = uint32(id)
+	id, err = strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user '%s' has a non-numeric gid '%s'", name, u.Gid)
+	}
+	r.Gid = uint32(id)
+
+	groups, err := u.GroupIds()
+	if err != nil {
+		DEBUG("unable to list the groups of user '%s' (%s); only using its primary group", name, err)
+		groups = []string{}
+	}
+	for _, g := range groups {
+		if id, err := strconv.ParseUint(g, 10, 32); err == nil {
+			r.Groups = append(r.Groups, uint32(id))
+		}
+	}
+	return r, nil
+}
+
+func (r *RunAs) String() string {
+	return fmt.Sprintf("%s (uid %d, gid %d)", r.User, r.Uid, r.Gid)
+}
+
+// Chown gives a file (i.e. a scratch directory created by the plugin) to
+// the user, so that the commands run as that user can write to it.
+func (r *RunAs) Chown(path string) error {
+	if r == nil || os.Geteuid() != 0 {
+		return nil
+	}
+	return os.Chown(path, int(r.Uid), int(r.Gid))
+}
+
+// credential returns the credential to spawn commands with, or nil when
+// they are to be run as the plugin user: when privileges can't be dropped,
+// commands are run as is, with a warning.
+func (r *RunAs) credential() *syscall.Credential {
+	if r == nil || uint32(os.Geteuid()) == r.Uid {
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		warnRunAs(r)
+		return nil
+	}
+	return &syscall.Credential{Uid: r.Uid, Gid: r.Gid, Groups: r.Groups}
+}
+
+var warnedRunAs bool
+
+func warnRunAs(r *RunAs) {
+	if !warnedRunAs {
+		Fprintf(os.Stderr, "@Y{Not running as root; unable to run commands as %s}\n", r)
+		warnedRunAs = true
+	}
+}
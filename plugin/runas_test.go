@@ -0,0 +1,57 @@
+package plugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Running Commands As Another User", func() {
+	It("looks users up by name and by uid", func() {
+		r, err := LookupRunAs("root")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(r.User).Should(Equal("root"))
+		Ω(r.Uid).Should(Equal(uint32(0)))
+
+		r, err = LookupRunAs("0")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(r.User).Should(Equal("root"))
+
+		_, err = LookupRunAs("no-such-user-hopefully")
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(HavePrefix("unable to find user 'no-such-user-hopefully'"))
+	})
+
+	It("leaves commands alone without a user to run them as", func() {
+		var r *RunAs
+		Ω(r.credential()).Should(BeNil())
+		Ω(r.Chown("/nonexistent")).Should(Succeed())
+	})
+
+	It("drops privileges when running as root", func() {
+		if os.Geteuid() != 0 {
+			Skip("not running as root")
+		}
+		r, err := LookupRunAs("nobody")
+		if err != nil {
+			Skip("no 'nobody' user")
+		}
+
+		tmp, err := ioutil.TempDir("", "shield-runas-")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(tmp)
+		out, err := os.Create(filepath.Join(tmp, "out"))
+		Ω(err).ShouldNot(HaveOccurred())
+		defer out.Close()
+
+		Ω(ExecWithOptions(ExecOptions{Cmd: "id -u", Stdout: out, RunAs: r})).Should(Succeed())
+		b, err := ioutil.ReadFile(filepath.Join(tmp, "out"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(strings.TrimSpace(string(b))).Should(Equal(fmt.Sprintf("%d", r.Uid)))
+	})
+})
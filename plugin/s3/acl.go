@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// When `s3_acl` is set, new archives are stored with that canned ACL.  This
+// is what writing to a bucket of another AWS account takes, for its owner to
+// have control over the archives: `bucket-owner-full-control`.  Buckets that
+// enforce bucket owner object ownership (which disables ACLs) only accept
+// that one, and refuse stores with any other.
+//
+// The ACL is set when an upload starts, so multipart uploads are only
+// resumed with the same ACL.
+
+const (
+	DefaultACL = ""
+
+	ACLHeader = "X-Amz-Acl"
+)
+
+// CannedACLs are the canned ACLs that S3 knows of, for objects.
+var CannedACLs = []string{
+	"private",
+	"public-read",
+	"public-read-write",
+	"authenticated-read",
+	"aws-exec-read",
+	"bucket-owner-read",
+	"bucket-owner-full-control",
+}
+
+func validACL(acl string) bool {
+	if acl == "" {
+		return true
+	}
+	for _, known := range CannedACLs {
+		if acl == known {
+			return true
+		}
+	}
+	return false
+}
+
+func cannedACLs() string {
+	return "'" + strings.Join(CannedACLs, "', '") + "'"
+}
+
+// aclHeaders adds the ACL header (if any) to the headers of a new object.
+func (s3 S3ConnectionInfo) aclHeaders(h http.Header) {
+	if s3.ACL == "" {
+		return
+	}
+	h.Set(ACLHeader, s3.ACL)
+}
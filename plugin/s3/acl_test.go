@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("Canned ACL", func() {
+	var (
+		server  *httptest.Server
+		info    S3ConnectionInfo
+		headers []http.Header
+	)
+
+	BeforeEach(func() {
+		headers = []http.Header{}
+		server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			_, location := r.URL.Query()["location"]
+			switch {
+			case r.Method == "GET" && location:
+				fmt.Fprintf(w, `<LocationConstraint>us-east-1</LocationConstraint>`)
+			case r.Method == "PUT":
+				headers = append(headers, r.Header)
+			case r.Method == "POST":
+				headers = append(headers, r.Header)
+				fmt.Fprintf(w, `<InitiateMultipartUploadResult><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`)
+			default:
+				Fail(fmt.Sprintf("unexpected %s %s", r.Method, r.URL))
+			}
+		}))
+
+		u, err := url.Parse(server.URL)
+		Ω(err).ShouldNot(HaveOccurred())
+		info = S3ConnectionInfo{
+			Host:              u.Hostname(),
+			Port:              u.Port(),
+			SkipSSLValidation: true,
+			AccessKey:         "AKID",
+			SecretKey:         "secret",
+			Bucket:            "bucket",
+			SignatureVersion:  "4",
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("stores archives with the configured ACL, in one go or in parts", func() {
+		info.ACL = "bucket-owner-full-control"
+		api, err := info.API()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		_, err = api.PutObject("2017/01/01/archive", []byte("archive"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(api.CreateMultipartUpload("2017/01/01/large")).Should(Equal("upload-1"))
+
+		Ω(headers).Should(HaveLen(2))
+		for _, h := range headers {
+			Ω(h.Get(ACLHeader)).Should(Equal("bucket-owner-full-control"))
+			/* the ACL is part of what is signed */
+			Ω(h.Get("Authorization")).Should(MatchRegexp(`SignedHeaders=[^,]*x-amz-acl`))
+		}
+	})
+
+	It("leaves the ACL to the bucket unless asked to", func() {
+		api, err := info.API()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		_, err = api.PutObject("2017/01/01/archive", []byte("archive"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(headers).Should(HaveLen(1))
+		Ω(headers[0].Get(ACLHeader)).Should(BeEmpty())
+	})
+
+	It("only accepts the canned ACLs of S3", func() {
+		endpoint := plugin.ShieldEndpoint{
+			"access_key_id":     "AKID",
+			"secret_access_key": "secret",
+			"bucket":            "bucket",
+		}
+		for _, acl := range append([]string{""}, CannedACLs...) {
+			endpoint["s3_acl"] = acl
+			s3, err := getS3ConnInfo(endpoint)
+			Ω(err).ShouldNot(HaveOccurred(), acl)
+			Ω(s3.ACL).Should(Equal(acl))
+		}
+
+		for _, acl := range []string{"bucket-owner-full", "Private", "log-delivery-write", "public"} {
+			endpoint["s3_acl"] = acl
+			_, err := getS3ConnInfo(endpoint)
+			Ω(err).Should(BeAssignableToTypeOf(plugin.ConfigError{}), acl)
+			Ω(err.(plugin.ConfigError).Key).Should(Equal("s3_acl"))
+			Ω(err.Error()).Should(ContainSubstring("'bucket-owner-full-control'"))
+		}
+	})
+})
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Archive checksums
+//
+// Archives are stored along with the SHA-256 of what was uploaded (that is,
+// once compressed), in the `sha256` metadata of their object, which S3 keeps
+// whatever encryption the bucket uses.  Archives stored with a single PUT
+// carry it from the start.  Multipart uploads only know it once the last
+// part is sent, so it is recorded afterwards, by copying the object onto
+// itself with the metadata replaced: that happens on the S3 side, but only
+// for objects of up to MaxCopySize bytes, and it is skipped when Object Lock
+// is on, since the copy would leave a second, locked version behind.  An
+// archive whose checksum can't be recorded is still stored, with a warning.
+//
+// Retrieving an archive that comes with its SHA-256 checks what was read
+// against it, once it was read to the end, and fails if they differ.
+
+const (
+	// ChecksumHeader is the metadata header that records the SHA-256 of
+	// an archive.
+	ChecksumHeader = "X-Amz-Meta-Sha256"
+)
+
+// MaxCopySize is the size of the largest object S3 copies with a single
+// request.
+var MaxCopySize int64 = 5 * 1024 * 1024 * 1024
+
+// RecordChecksum adds the SHA-256 of an object to its metadata, by copying
+// it onto itself; since the copy replaces all of the metadata, `headers`
+// must carry the rest of it.
+func (api *S3API) RecordChecksum(key, sum string, headers http.Header) error {
+	headers.Set(ChecksumHeader, sum)
+	headers.Set("X-Amz-Copy-Source", uriEncode("/"+api.info.Bucket+"/"+strings.TrimPrefix(key, "/"), true))
+	headers.Set("X-Amz-Metadata-Directive", "REPLACE")
+	res, err := api.Do("PUT", key, nil, headers, nil)
+	if err != nil {
+		return err
+	}
+
+	/* like completing an upload, a copy may fail with a 200 OK */
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	return errorDocument(b, key)
+}
+
+// recordChecksum records the SHA-256 of an archive stored in parts, when it
+// can; failing to do so is only warned about.
+func (s3 S3ConnectionInfo) recordChecksum(api *S3API, path, sum string, size int64) {
+	if s3.ObjectLockMode != "" {
+		plugin.DEBUG("not recording the SHA-256 of %s: with Object Lock, copying it would keep a second version", path)
+		return
+	}
+	if size > MaxCopySize {
+		plugin.DEBUG("not recording the SHA-256 of %s: at %d bytes, it is too large to be copied", path, size)
+		return
+	}
+	if err := api.RecordChecksum(objectKey(path), sum, s3.objectHeaders()); err != nil {
+		plugin.Fprintf(os.Stderr, "@Y{unable to record the SHA-256 of %s (%s); retrieving it won't check it}\n", path, err)
+		return
+	}
+	plugin.DEBUG("recorded SHA-256 %s of %s", sum, path)
+}
+
+// checksumReader reads an archive, and fails at the end of it if it does
+// not have the SHA-256 it was stored with.
+type checksumReader struct {
+	io.ReadCloser
+	key  string
+	want string
+	hash hash.Hash
+}
+
+func (r *checksumReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.hash.Write(b[:n])
+	if err == io.EOF {
+		if got := hex.EncodeToString(r.hash.Sum(nil)); !strings.EqualFold(got, r.want) {
+			return n, fmt.Errorf("%s was corrupted: its SHA-256 is %s, but it was stored with %s", r.key, got, r.want)
+		}
+		plugin.DEBUG("verified SHA-256 %s of %s", r.want, r.key)
+	}
+	return n, err
+}
+
+// verifyChecksum returns a reader of the archive read from `r` that checks
+// it against the SHA-256 in its metadata, if it has one.
+func verifyChecksum(key string, headers http.Header, r io.ReadCloser) io.ReadCloser {
+	want := headers.Get(ChecksumHeader)
+	if want == "" {
+		plugin.DEBUG("%s was stored without its SHA-256; unable to verify it", key)
+		return r
+	}
+	return &checksumReader{ReadCloser: r, key: key, want: want, hash: sha256.New()}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Archives can be compressed by the plugin itself, on their way to S3, for
+// target plugins that produce uncompressed streams.  The algorithm is
+// recorded in the metadata of the object, so that retrieving the archive
+// picks the right decompressor, whatever `s3_compression` is set to by then.
+// Objects without that metadata (i.e. stored before this existed) are
+// returned as is.
+//
+// gzip compression is done in-process; zstd compression runs the `zstd`
+// command.  Both use a single core, which caps how fast large archives get
+// stored.  When `s3_compressor_bin` is set, that command compresses archives
+// instead: a parallel compressor that writes the same format, i.e. `pigz`
+// for gzip, or `pzstd` (or `zstd` itself, with threads) for zstd.  It runs
+// `s3_compressor_threads` threads, or as many as there are cores when that
+// is 0.  When the command can't be found, archives are compressed the usual
+// way, with a warning.  Archives are decompressed the usual way either way.
+//
+// Compressing what is already compressed (i.e. the SSTables of Cassandra
+// tables, or encrypted archives) burns CPU for nothing.  When
+// `s3_compression_min_ratio` is set, the first CompressionSampleSize bytes of
+// the archive are compressed with a fast gzip first, as a sample; when they
+// don't shrink by at least that ratio, the archive is stored uncompressed.
+// The decision is recorded in the metadata of the object, along with the
+// ratio of the sample, and retrieving the archive follows it.
+
+const (
+	DefaultCompression         = "none"
+	DefaultCompressionMinRatio = 0
+
+	// CompressionSampleSize is how much of the archive is sampled, to
+	// tell whether it is worth compressing.
+	CompressionSampleSize = 4 * 1024 * 1024
+
+	// CompressionHeader is the metadata header that records how an
+	// archive was compressed by this plugin.
+	CompressionHeader = "X-Amz-Meta-Shield-Compression"
+
+	// CompressionRatioHeader is the metadata header that records the
+	// ratio of the sample, when the archive was sampled.
+	CompressionRatioHeader = "X-Amz-Meta-Shield-Compression-Ratio"
+)
+
+// ZstdCommand is the zstd executable used to (de)compress zstd archives.
+var ZstdCommand = "zstd"
+
+const (
+	DefaultCompressorBin     = ""
+	DefaultCompressorThreads = 0
+)
+
+func validCompression(c string) bool {
+	return c == "none" || c == "gzip" || c == "zstd"
+}
+
+func (s3 S3ConnectionInfo) compression() string {
+	if s3.Compression == "" {
+		return "none"
+	}
+	return s3.Compression
+}
+
+// objectHeaders returns the headers to create new objects with.
+func (s3 S3ConnectionInfo) objectHeaders() http.Header {
+	h := http.Header{"Content-Type": []string{"application/x-gzip"}}
+	if s3.compression() != "none" || s3.sampleRatio > 0 {
+		h.Set(CompressionHeader, s3.compression())
+	}
+	if s3.sampleRatio > 0 {
+		h.Set(CompressionRatioHeader, fmt.Sprintf("%.2f", s3.sampleRatio))
+	}
+	s3.lockHeaders(h, time.Now())
+	s3.aclHeaders(h)
+	return h
+}
+
+// compressor returns the command line of the parallel compressor that
+// compresses archives, or nil when they are compressed the usual way.
+func (s3 S3ConnectionInfo) compressor() []string {
+	if s3.CompressorBin == "" || s3.compression() == "none" {
+		return nil
+	}
+	if err := plugin.RequireBinaries(s3.CompressorBin); err != nil {
+		plugin.Fprintf(os.Stderr, "@Y{s3_compressor_bin is not usable (%s); compressing with %s the usual way}\n", err, s3.compression())
+		return nil
+	}
+
+	args := []string{s3.CompressorBin, "-q", "-c"}
+	if filepath.Base(s3.CompressorBin) == "zstd" {
+		/* zstd runs a single thread, unless told otherwise; 0 is all cores */
+		return append(args, fmt.Sprintf("-T%d", s3.CompressorThreads))
+	}
+	/* pigz and pzstd run as many threads as there are cores, by default */
+	if s3.CompressorThreads > 0 {
+		args = append(args, "-p", strconv.Itoa(s3.CompressorThreads))
+	}
+	return args
+}
+
+// compressArchive returns the archive read from `in`, compressed the way
+// the endpoint says.
+func (s3 S3ConnectionInfo) compressArchive(in io.Reader) (io.ReadCloser, error) {
+	if cmd := s3.compressor(); cmd != nil {
+		return compressCommand(cmd, in)
+	}
+	return compress(s3.Compression, in)
+}
+
+// sampleCompression compresses the first CompressionSampleSize bytes read
+// from `in` with gzip, at its fastest, and returns how much they shrank
+// (their size, divided by their compressed size), along with a reader that
+// replays them before the rest of `in`.
+func sampleCompression(in io.Reader) (float64, io.Reader, error) {
+	sample := make([]byte, CompressionSampleSize)
+	n, err := io.ReadFull(in, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, nil, err
+	}
+	sample = sample[:n]
+
+	var b bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&b, gzip.BestSpeed)
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err = gz.Write(sample); err != nil {
+		return 0, nil, err
+	}
+	if err = gz.Close(); err != nil {
+		return 0, nil, err
+	}
+	return float64(n) / float64(b.Len()), io.MultiReader(bytes.NewReader(sample), in), nil
+}
+
+// sample decides whether the archive read from `in` is worth compressing,
+// when `s3_compression_min_ratio` is set, and turns compression off when it
+// isn't.  It returns the reader to read the archive from.
+func (s3 *S3ConnectionInfo) sample(in io.Reader) (io.Reader, error) {
+	if s3.compression() == "none" || s3.CompressMinRatio <= 0 {
+		return in, nil
+	}
+
+	ratio, in, err := sampleCompression(in)
+	if err != nil {
+		return nil, err
+	}
+	s3.sampleRatio = ratio
+	if ratio < s3.CompressMinRatio {
+		plugin.DEBUG("The archive sample only shrinks %.2f times (expecting %.2f); storing it uncompressed", ratio, s3.CompressMinRatio)
+		s3.Compression = "none"
+	} else {
+		plugin.DEBUG("The archive sample shrinks %.2f times; compressing it with %s", ratio, s3.Compression)
+	}
+	return in, nil
+}
+
+// compressedStream is a compressed view of an archive stream.  Errors of
+// the compressor (and of the original stream) are returned by Read, before
+// the end of the stream, so that a broken archive never gets stored.
+type compressedStream struct {
+	io.Reader
+	close func() error
+}
+
+func (c compressedStream) Close() error {
+	return c.close()
+}
+
+// compress returns the archive read from `in`, compressed with `algo`.
+func compress(algo string, in io.Reader) (io.ReadCloser, error) {
+	switch algo {
+	case "", "none":
+		return compressedStream{Reader: in, close: func() error { return nil }}, nil
+
+	case "gzip":
+		r, w := io.Pipe()
+		go func() {
+			gz := gzip.NewWriter(w)
+			_, err := io.Copy(gz, in)
+			if err == nil {
+				err = gz.Close()
+			}
+			w.CloseWithError(err)
+		}()
+		return compressedStream{Reader: r, close: r.Close}, nil
+
+	case "zstd":
+		return compressCommand([]string{ZstdCommand, "-q", "-c"}, in)
+	}
+	return nil, fmt.Errorf("unsupported compression '%s'", algo)
+}
+
+// compressCommand returns the archive read from `in`, compressed by the
+// command line `args`, which writes to its standard output.  The command
+// runs like any other (see plugin.ExecWithOptions), at the priority of the
+// endpoint; its failure is returned by Read, instead of the end of the
+// stream, and closing the stream before its end stops the command.
+func compressCommand(args []string, in io.Reader) (io.ReadCloser, error) {
+	r, w := io.Pipe()
+	go func() {
+		err := plugin.ExecWithOptions(plugin.ExecOptions{
+			Cmd:      commandLine(args),
+			Stdin:    in,
+			Stdout:   w,
+			Stderr:   os.Stderr,
+			ExpectRC: []int{0},
+		})
+		if err != nil {
+			err = fmt.Errorf("unable to compress the archive with %s: %s", args[0], err)
+		}
+		w.CloseWithError(err)
+	}()
+	return compressedStream{Reader: r, close: r.Close}, nil
+}
+
+// commandLine quotes each of `args`, for ExecWithOptions to split them
+// back, whatever they hold.
+func commandLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+	}
+	return strings.Join(quoted, " ")
+}
+
+// decompress copies the archive read from `in` to `out`, decompressing it
+// with `algo`.
+func decompress(algo string, in io.Reader, out io.Writer) error {
+	switch algo {
+	case "", "none":
+		_, err := io.Copy(out, in)
+		return err
+
+	case "gzip":
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(out, gz); err != nil {
+			return err
+		}
+		return gz.Close()
+
+	case "zstd":
+		err := plugin.ExecWithOptions(plugin.ExecOptions{
+			Cmd:      commandLine([]string{ZstdCommand, "-q", "-d", "-c"}),
+			Stdin:    in,
+			Stdout:   out,
+			Stderr:   os.Stderr,
+			ExpectRC: []int{0},
+		})
+		if err != nil {
+			return fmt.Errorf("unable to decompress the archive with %s: %s", ZstdCommand, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("archive was compressed with '%s', which is not supported", algo)
+}
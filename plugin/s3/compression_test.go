@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os/exec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("Compression Sampling", func() {
+	/* random bytes don't compress, like compressed or encrypted archives */
+	incompressible := func(size int) []byte {
+		b := make([]byte, size)
+		rand.New(rand.NewSource(42)).Read(b)
+		return b
+	}
+	compressible := func(size int) []byte {
+		return bytes.Repeat([]byte("INSERT INTO users VALUES (42, 'someone');\n"), size/42+1)[:size]
+	}
+
+	It("estimates how much an archive shrinks, and replays what it sampled", func() {
+		for _, archive := range [][]byte{compressible(CompressionSampleSize + 1000), incompressible(1000)} {
+			ratio, in, err := sampleCompression(bytes.NewReader(archive))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.ReadAll(in)).Should(Equal(archive))
+			if archive[0] == 'I' {
+				Ω(ratio).Should(BeNumerically(">", 10))
+			} else {
+				Ω(ratio).Should(BeNumerically("<", 1.01))
+			}
+		}
+	})
+
+	It("stores incompressible archives uncompressed, and records it", func() {
+		info := S3ConnectionInfo{Compression: "zstd", CompressMinRatio: 1.1}
+		in, err := info.sample(bytes.NewReader(incompressible(1000)))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ioutil.ReadAll(in)).Should(HaveLen(1000))
+		Ω(info.Compression).Should(Equal("none"))
+
+		h := info.objectHeaders()
+		Ω(h.Get(CompressionHeader)).Should(Equal("none"))
+		Ω(h.Get(CompressionRatioHeader)).Should(MatchRegexp(`^0\.9\d$`))
+	})
+
+	It("compresses archives that shrink enough", func() {
+		info := S3ConnectionInfo{Compression: "gzip", CompressMinRatio: 1.1}
+		_, err := info.sample(bytes.NewReader(compressible(1000)))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(info.Compression).Should(Equal("gzip"))
+		Ω(info.objectHeaders().Get(CompressionHeader)).Should(Equal("gzip"))
+		Ω(info.objectHeaders().Get(CompressionRatioHeader)).ShouldNot(BeEmpty())
+	})
+
+	It("does not sample without a minimum ratio, or without compression", func() {
+		for _, info := range []S3ConnectionInfo{
+			{Compression: "gzip"},
+			{Compression: "none", CompressMinRatio: 1.1},
+		} {
+			compression := info.compression()
+			_, err := info.sample(bytes.NewReader(incompressible(1000)))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(info.compression()).Should(Equal(compression))
+			Ω(info.objectHeaders().Get(CompressionRatioHeader)).Should(BeEmpty())
+		}
+		Ω(S3ConnectionInfo{}.objectHeaders().Get(CompressionHeader)).Should(BeEmpty())
+	})
+})
+
+var _ = Describe("Parallel Compression", func() {
+	/* gzip stands in for pigz, which takes the same flags */
+	It("runs the parallel compressor with the configured threads", func() {
+		Ω(S3ConnectionInfo{Compression: "gzip", CompressorBin: "gzip"}.compressor()).Should(Equal([]string{"gzip", "-q", "-c"}))
+		Ω(S3ConnectionInfo{Compression: "gzip", CompressorBin: "gzip", CompressorThreads: 4}.compressor()).Should(Equal([]string{"gzip", "-q", "-c", "-p", "4"}))
+	})
+
+	It("tells zstd how many threads to run, all cores by default", func() {
+		if _, err := exec.LookPath(ZstdCommand); err != nil {
+			Skip("zstd is not installed")
+		}
+		Ω(S3ConnectionInfo{Compression: "zstd", CompressorBin: "zstd"}.compressor()).Should(Equal([]string{"zstd", "-q", "-c", "-T0"}))
+		Ω(S3ConnectionInfo{Compression: "zstd", CompressorBin: "zstd", CompressorThreads: 2}.compressor()).Should(Equal([]string{"zstd", "-q", "-c", "-T2"}))
+	})
+
+	It("falls back to the usual compression when there is no parallel compressor", func() {
+		Ω(S3ConnectionInfo{Compression: "gzip"}.compressor()).Should(BeNil())
+		Ω(S3ConnectionInfo{Compression: "none", CompressorBin: "gzip"}.compressor()).Should(BeNil())
+		Ω(S3ConnectionInfo{Compression: "gzip", CompressorBin: "/nonexistent/pigz"}.compressor()).Should(BeNil())
+
+		archive := bytes.Repeat([]byte("INSERT INTO users VALUES (42, 'someone');\n"), 1000)
+		in, err := S3ConnectionInfo{Compression: "gzip", CompressorBin: "/nonexistent/pigz"}.compressArchive(bytes.NewReader(archive))
+		Ω(err).ShouldNot(HaveOccurred())
+		var out bytes.Buffer
+		Ω(decompress("gzip", in, &out)).Should(Succeed())
+		Ω(out.Bytes()).Should(Equal(archive))
+	})
+
+	It("runs the compressors like any other command", func() {
+		fake := plugin.NewFakeExec()
+		defer fake.Restore()
+		fake.On(`pigz`, plugin.FakeOutput("compressed"))
+		fake.On(`zstd" "-q" "-d"`, plugin.FakeFailure(1, "zstd: unknown header"))
+
+		in, err := compressCommand([]string{"/opt/my tools/pigz", "-q", "-c", "-p", "4"}, bytes.NewReader([]byte("archive")))
+		Ω(err).ShouldNot(HaveOccurred())
+		b, err := ioutil.ReadAll(in)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(b)).Should(Equal("compressed"))
+		Ω(in.Close()).Should(Succeed())
+
+		err = decompress("zstd", bytes.NewReader([]byte("not zstd")), ioutil.Discard)
+		Ω(err).Should(MatchError(ContainSubstring("unable to decompress the archive with zstd")))
+
+		Ω(fake.Commands()).Should(Equal([]string{
+			`"/opt/my tools/pigz" "-q" "-c" "-p" "4"`,
+			`"zstd" "-q" "-d" "-c"`,
+		}))
+	})
+
+	It("reports the failure of the compressor instead of the end of the archive", func() {
+		fake := plugin.NewFakeExec()
+		defer fake.Restore()
+		fake.On(`pigz`, func(opts plugin.ExecOptions) error {
+			opts.Stdout.Write([]byte("half of it"))
+			return plugin.FakeFailure(1, "pigz: abort: write error")(opts)
+		})
+
+		in, err := compressCommand([]string{"pigz", "-q", "-c"}, bytes.NewReader([]byte("archive")))
+		Ω(err).ShouldNot(HaveOccurred())
+		b, err := ioutil.ReadAll(in)
+		Ω(string(b)).Should(Equal("half of it"))
+		Ω(err).Should(MatchError(ContainSubstring("unable to compress the archive with pigz")))
+	})
+
+	It("writes archives that decompress the usual way", func() {
+		archive := bytes.Repeat([]byte("INSERT INTO users VALUES (42, 'someone');\n"), 1000)
+		in, err := S3ConnectionInfo{Compression: "gzip", CompressorBin: "gzip"}.compressArchive(bytes.NewReader(archive))
+		Ω(err).ShouldNot(HaveOccurred())
+		defer in.Close()
+
+		var out bytes.Buffer
+		Ω(decompress("gzip", in, &out)).Should(Succeed())
+		Ω(out.Bytes()).Should(Equal(archive))
+	})
+})
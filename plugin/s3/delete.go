@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// S3 refuses DeleteObjects requests with more keys than that.
+var DeleteObjectsBatchSize = 1000
+
+type deleteRequest struct {
+	XMLName xml.Name       `xml:"Delete"`
+	Quiet   bool           `xml:"Quiet"`
+	Objects []deleteObject `xml:"Object"`
+}
+
+type deleteObject struct {
+	Key string `xml:"Key"`
+}
+
+type deleteResult struct {
+	Errors []struct {
+		Key     string `xml:"Key"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	} `xml:"Error"`
+}
+
+// DeleteObjects removes keys from the bucket, issuing as few (quiet)
+// DeleteObjects requests as possible.  Keys that S3 failed to delete are
+// all reported in the returned error.
+func (api *S3API) DeleteObjects(keys []string) error {
+	failed := []string{}
+	for start := 0; start < len(keys); start += DeleteObjectsBatchSize {
+		end := start + DeleteObjectsBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		req := deleteRequest{Quiet: true}
+		for _, key := range keys[start:end] {
+			req.Objects = append(req.Objects, deleteObject{Key: key})
+		}
+		body, err := xml.Marshal(req)
+		if err != nil {
+			return err
+		}
+
+		plugin.DEBUG("deleting %d objects (%d to %d of %d)", end-start, start+1, end, len(keys))
+		res, err := api.Do("POST", "", url.Values{"delete": []string{""}},
+			http.Header{"Content-Type": []string{"application/xml"}}, append([]byte(xml.Header), body...))
+		if err != nil {
+			return err
+		}
+
+		var result deleteResult
+		var buf bytes.Buffer
+		_, err = buf.ReadFrom(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		if err := xml.Unmarshal(buf.Bytes(), &result); err != nil {
+			return err
+		}
+		for _, e := range result.Errors {
+			failed = append(failed, fmt.Sprintf("%s (%s: %s)", e.Key, e.Code, e.Message))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to delete %d object(s):\n  %s", len(failed), strings.Join(failed, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Bulk Purge", func() {
+	var (
+		server   *httptest.Server
+		api      *S3API
+		lock     sync.Mutex
+		requests [][]string
+		failKeys map[string]bool
+	)
+
+	BeforeEach(func() {
+		requests = [][]string{}
+		failKeys = map[string]bool{}
+
+		server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Ω(r.Method).Should(Equal("POST"))
+			Ω(r.URL.Path).Should(Equal("/bucket/"))
+			Ω(r.URL.RawQuery).Should(Equal("delete"))
+			Ω(r.Header.Get("Authorization")).ShouldNot(BeEmpty())
+			Ω(r.Header.Get("Content-Md5")).ShouldNot(BeEmpty())
+
+			b, err := ioutil.ReadAll(r.Body)
+			Ω(err).ShouldNot(HaveOccurred())
+			var req deleteRequest
+			Ω(xml.Unmarshal(b, &req)).Should(Succeed())
+			Ω(req.Quiet).Should(BeTrue())
+
+			keys := []string{}
+			errors := ""
+			for _, o := range req.Objects {
+				keys = append(keys, o.Key)
+				if failKeys[o.Key] {
+					errors += fmt.Sprintf("<Error><Key>%s</Key><Code>AccessDenied</Code><Message>Access Denied</Message></Error>", o.Key)
+				}
+			}
+			lock.Lock()
+			requests = append(requests, keys)
+			lock.Unlock()
+
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><DeleteResult>%s</DeleteResult>`, errors)
+		}))
+
+		u, err := url.Parse(server.URL)
+		Ω(err).ShouldNot(HaveOccurred())
+		api, err = S3ConnectionInfo{
+			Host:              u.Hostname(),
+			Port:              u.Port(),
+			SkipSSLValidation: true,
+			AccessKey:         "AKID",
+			SecretKey:         "secret",
+			Bucket:            "bucket",
+			SignatureVersion:  "2",
+		}.API()
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	keys := func(n int) []string {
+		l := make([]string, n)
+		for i := range l {
+			l[i] = fmt.Sprintf("2017/01/01/archive-%04d", i)
+		}
+		return l
+	}
+
+	It("batches 1500 keys into two DeleteObjects requests", func() {
+		all := keys(1500)
+		Ω(api.DeleteObjects(all)).Should(Succeed())
+
+		Ω(requests).Should(HaveLen(2))
+		Ω(requests[0]).Should(HaveLen(1000))
+		Ω(requests[1]).Should(HaveLen(500))
+		Ω(append(requests[0], requests[1]...)).Should(Equal(all))
+	})
+
+	It("sends a single request for a small number of keys", func() {
+		Ω(api.DeleteObjects(keys(3))).Should(Succeed())
+		Ω(requests).Should(HaveLen(1))
+		Ω(requests[0]).Should(HaveLen(3))
+	})
+
+	It("reports the keys that could not be deleted", func() {
+		all := keys(1200)
+		failKeys[all[10]] = true
+		failKeys[all[1100]] = true
+
+		err := api.DeleteObjects(all)
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("failed to delete 2 object(s)"))
+		Ω(err.Error()).Should(ContainSubstring(all[10] + " (AccessDenied: Access Denied)"))
+		Ω(err.Error()).Should(ContainSubstring(all[1100]))
+		Ω(requests).Should(HaveLen(2))
+	})
+})
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Parallel downloads
+//
+// A single GET streams an archive at the pace of one connection.  Archives
+// that were uploaded in parts (see multipart.go) are retrieved with up to
+// `s3_download_concurrency` ranged GETs at once instead, of
+// DownloadChunkSize bytes each.  The ranges are written out strictly in
+// order, so the restore gets the very same stream either way, and at most
+// `s3_download_concurrency` of them are held in memory at any time: a range
+// is only requested once the one that many ranges before it is written out.
+// Each ranged GET carries the ETag of the object in an If-Match header, so
+// that an object overwritten halfway through the download fails it, rather
+// than being spliced with its older version.
+
+const (
+	DefaultDownloadConcurrency = 4
+)
+
+var DownloadChunkSize int64 = 16 * 1024 * 1024
+
+// multipartObject tells whether an object was uploaded in parts, from its
+// ETag, which then ends with a dash and the number of parts.
+func multipartObject(etag string) bool {
+	return strings.Contains(strings.Trim(etag, `"`), "-")
+}
+
+// GetRange returns the `size` bytes of an object found at offset `from`,
+// as long as the object still has the given ETag.
+func (api *S3API) GetRange(key, etag string, from, size int64) ([]byte, error) {
+	headers := http.Header{}
+	headers.Set("Range", fmt.Sprintf("bytes=%d-%d", from, from+size-1))
+	headers.Set("If-Match", etag)
+	res, err := api.Do("GET", key, nil, headers, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) != size {
+		return nil, fmt.Errorf("%s: got %d bytes at offset %d, instead of %d", key, len(b), from, size)
+	}
+	return b, nil
+}
+
+type downloadedRange struct {
+	data []byte
+	err  error
+}
+
+// download writes the `size` bytes of an object to `out`, with up to
+// `concurrency` ranged GETs at once.
+func (api *S3API) download(key, etag string, size int64, concurrency int, out io.Writer) error {
+	ranges := int((size + DownloadChunkSize - 1) / DownloadChunkSize)
+	pending := make([]chan downloadedRange, ranges)
+	fetch := func(i int) {
+		/* buffered, so that fetches still running after a failure can end */
+		pending[i] = make(chan downloadedRange, 1)
+		from := int64(i) * DownloadChunkSize
+		n := DownloadChunkSize
+		if from+n > size {
+			n = size - from
+		}
+		go func(ch chan<- downloadedRange) {
+			data, err := api.GetRange(key, etag, from, n)
+			ch <- downloadedRange{data: data, err: err}
+		}(pending[i])
+	}
+
+	plugin.DEBUG("downloading %s (%d bytes) in %d ranges, up to %d at once", key, size, ranges, concurrency)
+	for i := 0; i < concurrency && i < ranges; i++ {
+		fetch(i)
+	}
+	for i := 0; i < ranges; i++ {
+		r := <-pending[i]
+		if r.err != nil {
+			return r.err
+		}
+		if next := i + concurrency; next < ranges {
+			fetch(next)
+		}
+		if _, err := out.Write(r.data); err != nil {
+			return err
+		}
+		pending[i] = nil
+	}
+	return nil
+}
+
+// ObjectReader returns the contents of an object, as they stream in,
+// downloading them in parallel when the object was uploaded in parts, and
+// is larger than a single range.
+func (api *S3API) ObjectReader(key string, headers http.Header, concurrency int) (io.ReadCloser, error) {
+	size, _ := strconv.ParseInt(headers.Get("Content-Length"), 10, 64)
+	etag := headers.Get("ETag")
+	if concurrency <= 1 || etag == "" || !multipartObject(etag) || size <= DownloadChunkSize {
+		return api.GetObject(key)
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(api.download(key, etag, size, concurrency, w))
+	}()
+	return r, nil
+}
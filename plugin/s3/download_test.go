@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// rangeServer serves a single object, honoring Range and If-Match headers,
+// after `latency`, plus `perMiB` for each MiB sent, the way a connection of
+// limited bandwidth would, and counts the requests in flight.
+type rangeServer struct {
+	sync.Mutex
+	data     []byte
+	etag     string
+	latency  time.Duration
+	perMiB   time.Duration
+	inflight int
+	most     int
+	requests int
+}
+
+func (s *rangeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	s.requests++
+	s.inflight++
+	if s.inflight > s.most {
+		s.most = s.inflight
+	}
+	data, etag := s.data, s.etag
+	s.Unlock()
+	defer func() {
+		s.Lock()
+		s.inflight--
+		s.Unlock()
+	}()
+
+	if m := r.Header.Get("If-Match"); m != "" && m != etag {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(w, `<Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold</Message></Error>`)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	var from, to int
+	if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &from, &to); err != nil {
+		s.send(w, data)
+		return
+	}
+	if from >= len(data) {
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		fmt.Fprintf(w, `<Error><Code>InvalidRange</Code><Message>The requested range is not satisfiable</Message></Error>`)
+		return
+	}
+	if to >= len(data) {
+		to = len(data) - 1
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", from, to, len(data)))
+	w.WriteHeader(http.StatusPartialContent)
+	s.send(w, data[from:to+1])
+}
+
+func (s *rangeServer) send(w http.ResponseWriter, data []byte) {
+	time.Sleep(s.latency + time.Duration(len(data))*s.perMiB/(1024*1024))
+	w.Write(data)
+}
+
+func (s *rangeServer) headers() http.Header {
+	h := http.Header{}
+	h.Set("ETag", s.etag)
+	h.Set("Content-Length", fmt.Sprintf("%d", len(s.data)))
+	return h
+}
+
+// rangeAPI starts a TLS server for s, and returns a client for it.
+func rangeAPI(s *rangeServer) (*httptest.Server, *S3API, error) {
+	server := httptest.NewTLSServer(s)
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		server.Close()
+		return nil, nil, err
+	}
+	api, err := S3ConnectionInfo{
+		Host:              u.Hostname(),
+		Port:              u.Port(),
+		SkipSSLValidation: true,
+		AccessKey:         "AKID",
+		SecretKey:         "secret",
+		Bucket:            "bucket",
+		SignatureVersion:  "2",
+	}.API()
+	if err != nil {
+		server.Close()
+		return nil, nil, err
+	}
+	return server, api, nil
+}
+
+// rangeData returns n bytes that differ from one range to the next.
+func rangeData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i / 7)
+	}
+	return data
+}
+
+var _ = Describe("Parallel Downloads", func() {
+	var (
+		fake      *rangeServer
+		server    *httptest.Server
+		api       *S3API
+		chunkSize int64
+	)
+
+	BeforeEach(func() {
+		chunkSize = DownloadChunkSize
+		DownloadChunkSize = 1000
+
+		fake = &rangeServer{data: rangeData(10500), etag: `"0123456789abcdef-3"`, latency: 5 * time.Millisecond}
+		var err error
+		server, api, err = rangeAPI(fake)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		DownloadChunkSize = chunkSize
+		server.Close()
+	})
+
+	It("reassembles the ranges of multipart archives in order", func() {
+		r, err := api.ObjectReader("some/archive", fake.headers(), 4)
+		Ω(err).ShouldNot(HaveOccurred())
+		b, err := ioutil.ReadAll(r)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(r.Close()).Should(Succeed())
+		Ω(bytes.Equal(b, fake.data)).Should(BeTrue())
+
+		Ω(fake.requests).Should(Equal(11))
+		Ω(fake.most).Should(BeNumerically(">", 1))
+		Ω(fake.most).Should(BeNumerically("<=", 4))
+	})
+
+	It("uses a single GET for other archives, or when asked to", func() {
+		for _, c := range []struct {
+			etag        string
+			concurrency int
+		}{
+			{`"0123456789abcdef"`, 4},
+			{`"0123456789abcdef-3"`, 1},
+		} {
+			fake.requests = 0
+			fake.etag = c.etag
+			r, err := api.ObjectReader("some/archive", fake.headers(), c.concurrency)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.ReadAll(r)).Should(Equal(fake.data))
+			Ω(r.Close()).Should(Succeed())
+			Ω(fake.requests).Should(Equal(1))
+		}
+	})
+
+	It("fails when the archive is overwritten during the download", func() {
+		headers := fake.headers()
+		fake.etag = `"fedcba9876543210-3"`
+		r, err := api.ObjectReader("some/archive", headers, 4)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = ioutil.ReadAll(r)
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("pre-conditions"))
+	})
+
+	It("fails on short ranges", func() {
+		headers := fake.headers()
+		fake.data = fake.data[:9500]
+		r, err := api.ObjectReader("some/archive", headers, 4)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = ioutil.ReadAll(r)
+		Ω(err).Should(HaveOccurred())
+	})
+})
+
+// benchmarkDownload retrieves a 64MiB multipart archive from a server that
+// takes 20ms to answer each request, and 5ms to send each MiB, with
+// `concurrency` ranged GETs at once.
+func benchmarkDownload(b *testing.B, concurrency int) {
+	chunkSize := DownloadChunkSize
+	DownloadChunkSize = 4 * 1024 * 1024
+	defer func() { DownloadChunkSize = chunkSize }()
+
+	fake := &rangeServer{data: rangeData(64 * 1024 * 1024), etag: `"0123456789abcdef-8"`, latency: 20 * time.Millisecond, perMiB: 5 * time.Millisecond}
+	server, api, err := rangeAPI(fake)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer server.Close()
+
+	b.SetBytes(int64(len(fake.data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, err := api.ObjectReader("some/archive", fake.headers(), concurrency)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = ioutil.ReadAll(r); err != nil {
+			b.Fatal(err)
+		}
+		r.Close()
+	}
+}
+
+func BenchmarkSerialDownload(b *testing.B)    { benchmarkDownload(b, 1) }
+func BenchmarkParallelDownload4(b *testing.B) { benchmarkDownload(b, 4) }
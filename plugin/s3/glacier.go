@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	minio "github.com/minio/minio-go"
+	"github.com/starkandwayne/goutils/ansi"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+const (
+	DefaultAutoRestore         = false
+	DefaultRestoreDays         = 1
+	DefaultRestoreTier         = "Standard"
+	DefaultRestoreTimeoutHours = 48
+)
+
+// How often to check on an in-progress restore of an archived object: first
+// after RestorePollInterval, then twice as long after each check, up to
+// MaxRestorePollInterval, since restores take minutes to hours.
+var (
+	RestorePollInterval    = time.Minute
+	MaxRestorePollInterval = 15 * time.Minute
+)
+
+func validRestoreTier(t string) bool {
+	return t == "Expedited" || t == "Standard" || t == "Bulk"
+}
+
+// archived returns true if the object described by the given HEAD
+// response headers lives in one of the archival storage classes.
+func archived(h http.Header) bool {
+	class := h.Get("X-Amz-Storage-Class")
+	return class == "GLACIER" || class == "DEEP_ARCHIVE"
+}
+
+// restoreStatus parses the `x-amz-restore` header of an archived object,
+// which looks like `ongoing-request="false", expiry-date="..."` once a
+// restore has been requested.
+func restoreStatus(h http.Header) (requested, ongoing bool) {
+	v := h.Get("X-Amz-Restore")
+	if v == "" {
+		return false, false
+	}
+	return true, strings.Contains(v, `ongoing-request="true"`)
+}
+
+func (api *S3API) Head(key string) (http.Header, error) {
+	res, err := api.Do("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return res.Header, nil
+}
+
+// RestoreObject asks S3 to bring an archived object back into standard
+// storage for `days` days, using the given retrieval tier.
+func (api *S3API) RestoreObject(key string, days int, tier string) error {
+	body := fmt.Sprintf(`<RestoreRequest><Days>%d</Days><GlacierJobParameters><Tier>%s</Tier></GlacierJobParameters></RestoreRequest>`, days, tier)
+	res, err := api.Do("POST", key, url.Values{"restore": []string{""}}, http.Header{"Content-Type": []string{"application/xml"}}, []byte(body))
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "RestoreAlreadyInProgress" {
+			return nil
+		}
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// EnsureRestored makes sure that the object at key can be retrieved,
+// requesting a restore if it has been archived, and waiting for that
+// restore to complete, for up to `timeout`.
+func (api *S3API) EnsureRestored(key string, days int, tier string, timeout time.Duration) error {
+	h, err := api.Head(key)
+	if err != nil {
+		return err
+	}
+	if !archived(h) {
+		return nil
+	}
+
+	requested, ongoing := restoreStatus(h)
+	if requested && !ongoing {
+		ansi.Fprintf(os.Stderr, "@G{\u2713 Archived object %s has already been restored}\n", key)
+		return nil
+	}
+
+	if !requested {
+		plugin.DEBUG("requesting %s restore of %s (storage class %s), for %d day(s)", tier, key, h.Get("X-Amz-Storage-Class"), days)
+		if err := api.RestoreObject(key, days, tier); err != nil {
+			ansi.Fprintf(os.Stderr, "@R{\u2717 Request restore of archived object %s}\n", key)
+			return err
+		}
+	}
+	ansi.Fprintf(os.Stderr, "@G{\u2713 Request restore of archived object %s} (@C{%s} tier)\n", key, tier)
+
+	started := time.Now()
+	interval := RestorePollInterval
+	for {
+		left := timeout - time.Since(started)
+		if left <= 0 {
+			ansi.Fprintf(os.Stderr, "@R{\u2717 Restore of archived object %s did not complete} after %s\n", key, time.Since(started))
+			return fmt.Errorf("gave up waiting for the restore of archived object %s after %s (see `s3_restore_timeout_hours`); S3 goes on restoring it, and retrieving it again later will not request another restore", key, timeout)
+		}
+		if interval > left {
+			interval = left
+		}
+		time.Sleep(interval)
+		h, err = api.Head(key)
+		if err != nil {
+			return err
+		}
+		if _, ongoing = restoreStatus(h); !ongoing {
+			break
+		}
+		plugin.DEBUG("restore of %s still in progress, after %s", key, time.Since(started))
+		if interval *= 2; interval > MaxRestorePollInterval {
+			interval = MaxRestorePollInterval
+		}
+	}
+	ansi.Fprintf(os.Stderr, "@G{\u2713 Restore of archived object %s completed} after %s\n", key, time.Since(started))
+	return nil
+}
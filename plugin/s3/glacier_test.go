@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	minio "github.com/minio/minio-go"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// glacierServer serves a single object that was archived to GLACIER: it
+// refuses to hand it over until it is restored, which takes `checks` HEAD
+// requests once the restore was requested (or right away, when `busy`, as
+// if someone else had requested it).
+type glacierServer struct {
+	sync.Mutex
+	data     []byte
+	checks   int
+	requests []string
+	restores []string
+	heads    []time.Time
+	busy     bool
+}
+
+func (s *glacierServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	s.requests = append(s.requests, r.Method)
+	requested := len(s.restores) > 0 || s.busy
+	restored := requested && s.checks <= 0
+
+	switch {
+	case r.Method == "POST" && r.URL.RawQuery == "restore":
+		body, _ := ioutil.ReadAll(r.Body)
+		if s.busy {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, `<Error><Code>RestoreAlreadyInProgress</Code><Message>Object restore is already in progress</Message></Error>`)
+			return
+		}
+		s.restores = append(s.restores, string(body))
+		w.WriteHeader(http.StatusAccepted)
+
+	case r.Method == "HEAD":
+		s.heads = append(s.heads, time.Now())
+		w.Header().Set("X-Amz-Storage-Class", "GLACIER")
+		if requested {
+			if restored {
+				w.Header().Set("X-Amz-Restore", `ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`)
+			} else {
+				w.Header().Set("X-Amz-Restore", `ongoing-request="true"`)
+				s.checks--
+			}
+		}
+
+	case r.Method == "GET" && !restored:
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `<Error><Code>InvalidObjectState</Code><Message>The operation is not valid for the object's storage class</Message></Error>`)
+
+	case r.Method == "GET":
+		w.Write(s.data)
+
+	default:
+		Fail(fmt.Sprintf("unexpected request %s %s", r.Method, r.URL))
+	}
+}
+
+var _ = Describe("Archived Objects", func() {
+	var (
+		fake     *glacierServer
+		server   *httptest.Server
+		api      *S3API
+		interval time.Duration
+		most     time.Duration
+	)
+
+	BeforeEach(func() {
+		interval, most = RestorePollInterval, MaxRestorePollInterval
+		RestorePollInterval, MaxRestorePollInterval = 5*time.Millisecond, 20*time.Millisecond
+
+		fake = &glacierServer{data: []byte("archived data"), checks: 5}
+		server = httptest.NewTLSServer(fake)
+		u, err := url.Parse(server.URL)
+		Ω(err).ShouldNot(HaveOccurred())
+		api, err = S3ConnectionInfo{
+			Host:              u.Hostname(),
+			Port:              u.Port(),
+			SkipSSLValidation: true,
+			AccessKey:         "AKID",
+			SecretKey:         "secret",
+			Bucket:            "bucket",
+			SignatureVersion:  "4",
+			Region:            "us-east-1",
+		}.API()
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		RestorePollInterval, MaxRestorePollInterval = interval, most
+		server.Close()
+	})
+
+	It("can't retrieve archived objects until they are restored", func() {
+		_, err := api.GetObject("some/archive")
+		Ω(minio.ToErrorResponse(err).Code).Should(Equal("InvalidObjectState"))
+	})
+
+	It("requests restores with the given lifetime and tier", func() {
+		Ω(api.RestoreObject("some/archive", 3, "Bulk")).Should(Succeed())
+		Ω(fake.restores).Should(Equal([]string{
+			`<RestoreRequest><Days>3</Days><GlacierJobParameters><Tier>Bulk</Tier></GlacierJobParameters></RestoreRequest>`,
+		}))
+	})
+
+	It("takes restores already in progress for granted", func() {
+		fake.busy = true
+		Ω(api.RestoreObject("some/archive", 1, "Standard")).Should(Succeed())
+		Ω(fake.restores).Should(BeEmpty())
+	})
+
+	It("restores archived objects, and waits until they are", func() {
+		Ω(api.EnsureRestored("some/archive", 1, "Expedited", time.Minute)).Should(Succeed())
+		Ω(fake.restores).Should(HaveLen(1))
+		Ω(fake.restores[0]).Should(ContainSubstring("<Tier>Expedited</Tier>"))
+
+		r, err := api.GetObject("some/archive")
+		Ω(err).ShouldNot(HaveOccurred())
+		b, err := ioutil.ReadAll(r)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(b)).Should(Equal("archived data"))
+
+		/* and then it is there to be retrieved */
+		Ω(api.EnsureRestored("some/archive", 1, "Expedited", time.Minute)).Should(Succeed())
+		Ω(fake.restores).Should(HaveLen(1))
+	})
+
+	It("waits longer and longer between checks, up to a point", func() {
+		fake.checks = 6
+		Ω(api.EnsureRestored("some/archive", 1, "Standard", time.Minute)).Should(Succeed())
+		Ω(fake.heads).Should(HaveLen(8))
+
+		/* the first HEAD is the one that finds the object archived */
+		waits := []time.Duration{}
+		for i := 1; i < len(fake.heads); i++ {
+			waits = append(waits, fake.heads[i].Sub(fake.heads[i-1]))
+		}
+		Ω(waits[0]).Should(BeNumerically(">=", 5*time.Millisecond))
+		Ω(waits[1]).Should(BeNumerically(">=", 10*time.Millisecond))
+		for _, wait := range waits[2:] {
+			Ω(wait).Should(BeNumerically(">=", 20*time.Millisecond))
+			Ω(wait).Should(BeNumerically("<", 200*time.Millisecond))
+		}
+	})
+
+	It("waits for restores that were requested before", func() {
+		fake.busy = true
+		Ω(api.EnsureRestored("some/archive", 1, "Standard", time.Minute)).Should(Succeed())
+		Ω(fake.requests).ShouldNot(ContainElement("POST"))
+		Ω(fake.heads).Should(HaveLen(6))
+	})
+
+	It("gives up on restores that take too long", func() {
+		fake.checks = 1000
+		started := time.Now()
+		err := api.EnsureRestored("some/archive", 1, "Bulk", 100*time.Millisecond)
+		Ω(err).Should(MatchError(ContainSubstring("gave up waiting for the restore of archived object some/archive after 100ms (see `s3_restore_timeout_hours`)")))
+		Ω(time.Since(started)).Should(BeNumerically("<", time.Second))
+		Ω(fake.restores).Should(HaveLen(1))
+	})
+})
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Keys
+//
+// The `prefix` is spelled every which way (`backups`, `backups/`, `/backups`,
+// `backups//nightly`), so it is normalized once, as the endpoint is read:
+// without a leading slash, without repeated slashes, and with a single
+// trailing slash, unless it is empty (the root of the bucket).  The keys of
+// the archives are made by appending to it, it is what objects and uploads
+// are listed under, and it is what multipart uploads are matched against,
+// so that `backups` does not match `backups2/...`.
+//
+// The storage handles that Retrieve and Purge are given are used as they
+// were returned by Store, but for their leading slash (see objectKey), so
+// that archives stored before keys were normalized can still be found.
+
+// normalizePrefix returns the prefix as keys are made with it.
+func normalizePrefix(prefix string) string {
+	parts := []string{}
+	for _, part := range strings.Split(prefix, "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return strings.Join(parts, "/") + "/"
+}
+
+// objectKey returns the key of the object that a storage handle names.
+func objectKey(handle string) string {
+	return strings.TrimPrefix(handle, "/")
+}
+
+// genBackupPath returns the storage handle of a new archive, under the
+// prefix.  Handles of archives stored at the root of the bucket start with
+// a slash, as they always have.
+func (s3 S3ConnectionInfo) genBackupPath() string {
+	t := time.Now()
+	year, mon, day := t.Date()
+	hour, min, sec := t.Clock()
+	uuid := plugin.GenUUID()
+	path := fmt.Sprintf("%s%04d/%02d/%02d/%04d-%02d-%02d-%02d%02d%02d-%s", s3.PathPrefix, year, mon, day, year, mon, day, hour, min, sec, uuid)
+	if s3.PathPrefix == "" {
+		path = "/" + path
+	}
+	return path
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("Prefix and Key Normalization", func() {
+	/* the date, time and UUID that genBackupPath() appends to the prefix */
+	const archive = `\d{4}/\d{2}/\d{2}/\d{4}-\d{2}-\d{2}-\d{6}-[0-9a-f-]{36}$`
+
+	It("makes the same keys, however the prefix is spelled", func() {
+		for _, t := range []struct {
+			prefix     string
+			normalized string
+			key        string
+		}{
+			{"", "", `^/`},
+			{"/", "", `^/`},
+			{"//", "", `^/`},
+			{"backups", "backups/", `^backups/`},
+			{"backups/", "backups/", `^backups/`},
+			{"/backups", "backups/", `^backups/`},
+			{"/backups/", "backups/", `^backups/`},
+			{"backups//", "backups/", `^backups/`},
+			{"backups///", "backups/", `^backups/`},
+			{"//backups//nightly///", "backups/nightly/", `^backups/nightly/`},
+			{"shield/production", "shield/production/", `^shield/production/`},
+		} {
+			info, err := getS3ConnInfo(plugin.ShieldEndpoint{
+				"access_key_id":     "AKID",
+				"secret_access_key": "secret",
+				"bucket":            "bucket",
+				"prefix":            t.prefix,
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(info.PathPrefix).Should(Equal(t.normalized), "prefix '%s'", t.prefix)
+			Ω(info.genBackupPath()).Should(MatchRegexp(t.key+archive), "prefix '%s'", t.prefix)
+			Ω(info.genBackupPath()).ShouldNot(ContainSubstring("//"), "prefix '%s'", t.prefix)
+		}
+	})
+
+	It("takes storage handles as they were returned by Store", func() {
+		Ω(objectKey("/2024/01/31/2024-01-31-020000-uuid")).Should(Equal("2024/01/31/2024-01-31-020000-uuid"))
+		Ω(objectKey("backups/2024/01/31/2024-01-31-020000-uuid")).Should(Equal("backups/2024/01/31/2024-01-31-020000-uuid"))
+		/* older archives are found where they were stored */
+		Ω(objectKey("backups//2024/01/31/uuid")).Should(Equal("backups//2024/01/31/uuid"))
+	})
+})
@@ -0,0 +1,697 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	minio "github.com/minio/minio-go"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Archives are uploaded in parts of MultipartPartSize bytes.  S3 allows at
+// most 10,000 parts per upload, which puts the largest archive we can store
+// at about 640GB.  Archives of up to `s3_multipart_threshold` MiB are
+// uploaded with a plain PUT request instead: since the size of the archive
+// stream is not known upfront, that much of it is buffered, along with one
+// more byte, to tell whether the stream goes on beyond the threshold.
+//
+// In-progress multipart uploads are tracked in a local state file, so that
+// a store that gets interrupted can be resumed by the next one: the parts
+// that S3 already holds are skipped if the new archive stream has the very
+// same bytes there (i.e. when the same archive is being stored again), and
+// overwritten otherwise.  An upload is only resumed by a store of the same
+// target (the one SHIELD hands over in SHIELD_TARGET_PLUGIN and
+// SHIELD_TARGET_ENDPOINT), since another target would upload an archive of
+// its own there: the interrupted uploads of other targets are aborted
+// instead, like those that were abandoned for longer than
+// `s3_stale_upload_hours`, so that S3 stops billing for them.
+//
+// What S3 stores is checked against what we sent, to catch corruption in
+// flight.  The ETag of an object stored with a single PUT is the MD5 of its
+// contents, and so is the ETag of each part of a multipart upload, unless
+// the object is encrypted with SSE-KMS or SSE-C: their ETags are not MD5s,
+// and are not compared.  The ETag of a multipart object is not the MD5 of
+// the archive either (it is the MD5 of the MD5s of its parts, followed by a
+// dash and the number of parts); the SHA-256 of the archive is recorded in
+// its metadata instead, and checked by retrieves (see checksum.go).  Each
+// part is also checked by S3 itself, against the Content-MD5 header, and the
+// X-Amz-Content-Sha256 payload hash when using v4 signatures.
+
+const (
+	DefaultStaleUploadHours   = 24
+	DefaultMultipartThreshold = 16
+	MaxMultipartThreshold     = 5 * 1024
+)
+
+var (
+	MultipartPartSize  = 64 * 1024 * 1024
+	DefaultUploadState = filepath.Join(os.TempDir(), "shield-s3-uploads.json")
+)
+
+type uploadedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+	Size       int    `xml:"Size,omitempty"`
+}
+
+type multipartUpload struct {
+	Key       string    `xml:"Key"`
+	UploadID  string    `xml:"UploadId"`
+	Initiated time.Time `xml:"Initiated"`
+}
+
+func (api *S3API) readXML(res *http.Response, v interface{}) error {
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(b, v)
+}
+
+// PutObject uploads a (small) object with a single request, along with its
+// SHA-256, and returns the headers of the response (and its ETag).
+func (api *S3API) PutObject(key string, data []byte) (http.Header, error) {
+	headers := api.info.objectHeaders()
+	headers.Set(ChecksumHeader, hexSHA256(data))
+	res, err := api.Do("PUT", key, nil, headers, data)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return res.Header, nil
+}
+
+// CreateMultipartUpload starts a new multipart upload, and returns its ID.
+func (api *S3API) CreateMultipartUpload(key string) (string, error) {
+	res, err := api.Do("POST", key, url.Values{"uploads": []string{""}}, api.info.objectHeaders(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err = api.readXML(res, &result); err != nil {
+		return "", err
+	}
+	return result.UploadID, nil
+}
+
+// UploadPart sends one part of a multipart upload, and returns the headers
+// of the response (and its ETag).
+func (api *S3API) UploadPart(key, id string, n int, data []byte) (http.Header, error) {
+	res, err := api.Do("PUT", key, url.Values{
+		"uploadId":   []string{id},
+		"partNumber": []string{strconv.Itoa(n)},
+	}, nil, data)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return res.Header, nil
+}
+
+// ListParts returns the parts S3 already holds for a multipart upload,
+// indexed by part number.
+func (api *S3API) ListParts(key, id string) (map[int]uploadedPart, error) {
+	parts := map[int]uploadedPart{}
+	marker := ""
+	for {
+		q := url.Values{"uploadId": []string{id}}
+		if marker != "" {
+			q.Set("part-number-marker", marker)
+		}
+		res, err := api.Do("GET", key, q, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Parts       []uploadedPart `xml:"Part"`
+			IsTruncated bool           `xml:"IsTruncated"`
+			NextMarker  string         `xml:"NextPartNumberMarker"`
+		}
+		if err = api.readXML(res, &result); err != nil {
+			return nil, err
+		}
+		for _, p := range result.Parts {
+			parts[p.PartNumber] = p
+		}
+		if !result.IsTruncated || result.NextMarker == "" {
+			return parts, nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+// CompleteMultipartUpload assembles the given parts into the final object,
+// and returns its ETag.
+func (api *S3API) CompleteMultipartUpload(key, id string, parts []uploadedPart) (string, error) {
+	req := struct {
+		XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+		Parts   []uploadedPart `xml:"Part"`
+	}{Parts: parts}
+	body, err := xml.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := api.Do("POST", key, url.Values{"uploadId": []string{id}},
+		http.Header{"Content-Type": []string{"application/xml"}}, append([]byte(xml.Header), body...))
+	if err != nil {
+		return "", err
+	}
+
+	// S3 may report a failure to complete the upload with a 200 OK,
+	// and an error document as the body.
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if err = errorDocument(b, key); err != nil {
+		return "", err
+	}
+	var result struct {
+		ETag string `xml:"ETag"`
+	}
+	xml.Unmarshal(b, &result)
+	return result.ETag, nil
+}
+
+// errorDocument returns the error that the body of a 200 OK response
+// holds, if it is an S3 error document.
+func errorDocument(b []byte, key string) error {
+	var doc struct {
+		XMLName xml.Name
+	}
+	if xml.Unmarshal(b, &doc) != nil || doc.XMLName.Local != "Error" {
+		return nil
+	}
+	e := minio.ErrorResponse{}
+	xml.Unmarshal(b, &e)
+	if e.Key == "" {
+		e.Key = key
+	}
+	return e
+}
+
+// AbortMultipartUpload discards a multipart upload, and all of its parts.
+func (api *S3API) AbortMultipartUpload(key, id string) error {
+	res, err := api.Do("DELETE", key, url.Values{"uploadId": []string{id}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// ListMultipartUploads returns all the in-progress multipart uploads of
+// the bucket, for keys that start with prefix.
+func (api *S3API) ListMultipartUploads(prefix string) ([]multipartUpload, error) {
+	uploads := []multipartUpload{}
+	keyMarker, idMarker := "", ""
+	for {
+		q := url.Values{"uploads": []string{""}}
+		if prefix != "" {
+			q.Set("prefix", prefix)
+		}
+		if keyMarker != "" {
+			q.Set("key-marker", keyMarker)
+			q.Set("upload-id-marker", idMarker)
+		}
+		res, err := api.Do("GET", "", q, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Uploads       []multipartUpload `xml:"Upload"`
+			IsTruncated   bool              `xml:"IsTruncated"`
+			NextKeyMarker string            `xml:"NextKeyMarker"`
+			NextIDMarker  string            `xml:"NextUploadIdMarker"`
+		}
+		if err = api.readXML(res, &result); err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, result.Uploads...)
+		if !result.IsTruncated || result.NextKeyMarker == "" {
+			return uploads, nil
+		}
+		keyMarker, idMarker = result.NextKeyMarker, result.NextIDMarker
+	}
+}
+
+// uploadRecord tracks an in-progress multipart upload, in the local state
+// file.  Path is the storage handle the archive will be known by, once
+// stored.  Compression (and the ACL) are recorded in the metadata of the
+// upload when it starts, so that an upload can only be resumed with the same
+// settings.  Target identifies the target whose archive is being uploaded
+// (see uploadTarget).
+type uploadRecord struct {
+	Host        string    `json:"host"`
+	Bucket      string    `json:"bucket"`
+	Path        string    `json:"path"`
+	Target      string    `json:"target,omitempty"`
+	UploadID    string    `json:"upload_id"`
+	PartSize    int       `json:"part_size"`
+	Compression string    `json:"compression,omitempty"`
+	ACL         string    `json:"acl,omitempty"`
+	Started     time.Time `json:"started"`
+	PID         int       `json:"pid"`
+}
+
+func (r uploadRecord) key() string {
+	return objectKey(r.Path)
+}
+
+func (r uploadRecord) compression() string {
+	if r.Compression == "" {
+		return "none"
+	}
+	return r.Compression
+}
+
+// The state file maps "bucket/key" to the record of its upload.
+type uploadState map[string]uploadRecord
+
+// uploadTarget identifies the target this plugin stores an archive of, from
+// what SHIELD hands over in the environment, or returns "" when run outside
+// of SHIELD.  The endpoint is hashed, since it holds credentials.
+func uploadTarget() string {
+	name, endpoint := os.Getenv("SHIELD_TARGET_PLUGIN"), os.Getenv("SHIELD_TARGET_ENDPOINT")
+	if name == "" && endpoint == "" {
+		return ""
+	}
+	return hexSHA256([]byte(name + "\n" + endpoint))
+}
+
+func stateKey(bucket, path string) string {
+	return bucket + "/" + objectKey(path)
+}
+
+// processAlive tells whether the process that owns an upload is still
+// running (i.e. is still uploading).
+var processAlive = func(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// withUploadState runs fn against the contents of the state file, while
+// holding an exclusive lock on it, and saves whatever changes fn made.
+func withUploadState(path string, fn func(uploadState) error) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	state := uploadState{}
+	if len(bytes.TrimSpace(b)) > 0 {
+		if err = json.Unmarshal(b, &state); err != nil {
+			return fmt.Errorf("corrupt upload state file %s: %s", path, err)
+		}
+	}
+
+	if err = fn(state); err != nil {
+		return err
+	}
+
+	b, err = json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = f.WriteAt(b, 0)
+	return err
+}
+
+// claimUpload looks for an interrupted upload of the same target to resume,
+// in the state file.  Abandoned uploads that are too old, that can't be
+// resumed anymore, or that are another target's, are dropped from the state
+// file, and returned so that they get aborted.
+func (s3 S3ConnectionInfo) claimUpload() (*uploadRecord, []uploadRecord, error) {
+	var (
+		resume  *uploadRecord
+		expired []uploadRecord
+	)
+
+	err := withUploadState(s3.UploadState, func(state uploadState) error {
+		for id, r := range state {
+			if r.Host != s3.endpoint() || r.Bucket != s3.Bucket || processAlive(r.PID) {
+				continue
+			}
+			if time.Since(r.Started) > s3.staleUploadAge() || r.PartSize != MultipartPartSize || r.Target != s3.target {
+				expired = append(expired, r)
+				delete(state, id)
+				continue
+			}
+			if !strings.HasPrefix(r.key(), s3.PathPrefix) || r.compression() != s3.compression() || r.ACL != s3.ACL {
+				continue
+			}
+			if resume == nil || r.Started.After(resume.Started) {
+				rec := r
+				resume = &rec
+			}
+		}
+		if resume != nil {
+			resume.PID = os.Getpid()
+			state[stateKey(resume.Bucket, resume.Path)] = *resume
+		}
+		return nil
+	})
+	return resume, expired, err
+}
+
+func (s3 S3ConnectionInfo) saveUpload(r uploadRecord) error {
+	return withUploadState(s3.UploadState, func(state uploadState) error {
+		state[stateKey(r.Bucket, r.Path)] = r
+		return nil
+	})
+}
+
+func (s3 S3ConnectionInfo) forgetUpload(r uploadRecord) error {
+	return withUploadState(s3.UploadState, func(state uploadState) error {
+		delete(state, stateKey(r.Bucket, r.Path))
+		return nil
+	})
+}
+
+// forgetUploads drops aborted uploads from the state file.
+func (s3 S3ConnectionInfo) forgetUploads(aborted []uploadRecord) error {
+	if len(aborted) == 0 {
+		return nil
+	}
+	return withUploadState(s3.UploadState, func(state uploadState) error {
+		for _, r := range aborted {
+			delete(state, stateKey(r.Bucket, r.Path))
+		}
+		return nil
+	})
+}
+
+// abortStaleUploads aborts the multipart uploads that have been lingering
+// under the prefix for longer than `s3_stale_upload_hours`, whichever host
+// started them, except the one being resumed.  Failing to list or abort
+// them is only warned about: the store goes on.
+func (s3 S3ConnectionInfo) abortStaleUploads(api *S3API, resuming string) {
+	uploads, err := api.ListMultipartUploads(s3.PathPrefix)
+	if err != nil {
+		plugin.Fprintf(os.Stderr, "@Y{unable to look for stale uploads to abort: %s}\n", err)
+		return
+	}
+
+	aborted := []uploadRecord{}
+	for _, u := range uploads {
+		if u.UploadID == resuming || time.Since(u.Initiated) <= s3.staleUploadAge() {
+			continue
+		}
+		plugin.DEBUG("aborting stale upload %s of %s (started %s)", u.UploadID, u.Key, u.Initiated)
+		if err := api.AbortMultipartUpload(u.Key, u.UploadID); err != nil {
+			plugin.Fprintf(os.Stderr, "@Y{unable to abort stale upload of %s: %s}\n", u.Key, err)
+			continue
+		}
+		aborted = append(aborted, uploadRecord{Bucket: s3.Bucket, Path: u.Key})
+	}
+	if err := s3.forgetUploads(aborted); err != nil {
+		plugin.Fprintf(os.Stderr, "@Y{unable to update %s: %s}\n", s3.UploadState, err)
+	}
+}
+
+func (s3 S3ConnectionInfo) staleUploadAge() time.Duration {
+	return time.Duration(s3.StaleUploadHours) * time.Hour
+}
+
+// multipartThreshold returns how many bytes an archive may have, and still
+// be stored with a single request; it is a part, unless configured.
+func (s3 S3ConnectionInfo) multipartThreshold() int {
+	if s3.MultipartThreshold <= 0 {
+		return MultipartPartSize
+	}
+	return s3.MultipartThreshold
+}
+
+func partETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// encryptedETag tells whether the ETag of a response is something else than
+// the MD5 of what was sent, because S3 encrypted it with SSE-KMS (or
+// DSSE-KMS), or with a key of the client (SSE-C).
+func encryptedETag(h http.Header) bool {
+	return strings.HasPrefix(h.Get("X-Amz-Server-Side-Encryption"), "aws:kms") ||
+		h.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != ""
+}
+
+// checkETag compares the ETag of a response of S3 with the one we expect,
+// and fails if they differ.  Some S3 emulations do not return ETags at all,
+// and the ETags of encrypted objects are not MD5s; there is nothing to
+// check then.
+func checkETag(what string, h http.Header, want string) error {
+	got := h.Get("ETag")
+	if got == "" {
+		plugin.DEBUG("no ETag returned for %s; unable to verify it", what)
+		return nil
+	}
+	if encryptedETag(h) {
+		plugin.DEBUG("%s is encrypted with SSE-KMS or SSE-C, so its ETag is not its MD5; unable to verify it", what)
+		return nil
+	}
+	if !strings.EqualFold(strings.Trim(got, `"`), strings.Trim(want, `"`)) {
+		return fmt.Errorf("%s was corrupted in transit: S3 reports ETag %s, expected %s", what, got, want)
+	}
+	plugin.DEBUG("verified ETag %s of %s", got, what)
+	return nil
+}
+
+// upload stores the archive read from `in`, resuming an interrupted upload
+// if there is one, and returns its storage handle.
+func (s3 S3ConnectionInfo) upload(api *S3API, in io.Reader) (string, error) {
+	rec, expired, err := s3.claimUpload()
+	if err != nil {
+		return "", err
+	}
+	for _, r := range expired {
+		plugin.DEBUG("aborting abandoned upload %s of %s (started %s)", r.UploadID, r.Path, r.Started)
+		if err := api.AbortMultipartUpload(r.key(), r.UploadID); err != nil {
+			plugin.Fprintf(os.Stderr, "@Y{unable to abort abandoned upload of %s: %s}\n", r.Path, err)
+		}
+	}
+
+	parts := map[int]uploadedPart{}
+	if rec != nil {
+		plugin.DEBUG("found interrupted upload %s of %s; trying to resume it", rec.UploadID, rec.Path)
+		parts, err = api.ListParts(rec.key(), rec.UploadID)
+		if minio.ToErrorResponse(err).Code == "NoSuchUpload" {
+			plugin.DEBUG("upload %s is gone; starting over", rec.UploadID)
+			if err = s3.forgetUpload(*rec); err != nil {
+				return "", err
+			}
+			rec, parts = nil, map[int]uploadedPart{}
+		} else if err != nil {
+			return "", err
+		}
+	}
+	resuming := ""
+	if rec != nil {
+		resuming = rec.UploadID
+	}
+	s3.abortStaleUploads(api, resuming)
+
+	if rec == nil {
+		/* one byte past the threshold tells whether the archive goes beyond it */
+		head := make([]byte, s3.multipartThreshold()+1)
+		n, err := io.ReadFull(in, head)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			path := s3.genBackupPath()
+			plugin.DEBUG("storing %d bytes in %s, with a single request", n, path)
+			h, err := api.PutObject(objectKey(path), head[:n])
+			if err != nil {
+				return "", err
+			}
+			if err = checkETag(path, h, partETag(head[:n])); err != nil {
+				/* don't leave a corrupted archive behind */
+				if derr := api.DeleteObjects([]string{objectKey(path)}); derr != nil {
+					plugin.Fprintf(os.Stderr, "@Y{unable to delete corrupted archive %s: %s}\n", path, derr)
+				}
+				return "", err
+			}
+			return path, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		plugin.DEBUG("archive is larger than %d bytes; storing it in parts", len(head)-1)
+		in = io.MultiReader(bytes.NewReader(head), in)
+	}
+
+	buf := make([]byte, MultipartPartSize)
+	n, err := io.ReadFull(in, buf)
+	last := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !last {
+		return "", err
+	}
+
+	if rec == nil {
+		path := s3.genBackupPath()
+		id, err := api.CreateMultipartUpload(objectKey(path))
+		if err != nil {
+			return "", err
+		}
+		rec = &uploadRecord{
+			Host:        s3.endpoint(),
+			Bucket:      s3.Bucket,
+			Path:        path,
+			Target:      s3.target,
+			UploadID:    id,
+			PartSize:    MultipartPartSize,
+			Compression: s3.compression(),
+			ACL:         s3.ACL,
+			Started:     time.Now(),
+			PID:         os.Getpid(),
+		}
+		if err = s3.saveUpload(*rec); err != nil {
+			return "", err
+		}
+		plugin.DEBUG("started multipart upload %s of %s", id, path)
+	}
+
+	completed := []uploadedPart{}
+	skipped := 0
+	/* the parts S3 already holds are read again, so the sum covers them too */
+	sum := sha256.New()
+	var size int64
+	for number := 1; ; number++ {
+		data := buf[:n]
+		etag := partETag(data)
+		sum.Write(data)
+		size += int64(n)
+		if p, ok := parts[number]; ok && p.Size == n && p.ETag == etag {
+			plugin.DEBUG("part %d of %s is already uploaded; skipping it", number, rec.Path)
+			skipped++
+		} else {
+			plugin.DEBUG("uploading part %d (%d bytes) of %s", number, n, rec.Path)
+			var got http.Header
+			got, err = api.UploadPart(rec.key(), rec.UploadID, number, data)
+			if err == nil {
+				err = checkETag(fmt.Sprintf("part %d of %s", number, rec.Path), got, etag)
+			}
+			if err != nil {
+				plugin.Fprintf(os.Stderr, "@Y{upload of %s was interrupted; the next store will try to resume it}\n", rec.Path)
+				return "", err
+			}
+		}
+		completed = append(completed, uploadedPart{PartNumber: number, ETag: etag})
+
+		if last {
+			break
+		}
+		n, err = io.ReadFull(in, buf)
+		if err == io.EOF {
+			break
+		}
+		last = err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			plugin.Fprintf(os.Stderr, "@Y{upload of %s was interrupted; the next store will try to resume it}\n", rec.Path)
+			return "", err
+		}
+	}
+
+	if _, err = api.CompleteMultipartUpload(rec.key(), rec.UploadID, completed); err != nil {
+		return "", err
+	}
+	if skipped > 0 {
+		plugin.Fprintf(os.Stderr, "@G{resumed upload of %s; %d of %d parts were already uploaded}\n", rec.Path, skipped, len(completed))
+	}
+	/* the archive is stored: its key must make it back to SHIELD */
+	if err = s3.forgetUpload(*rec); err != nil {
+		plugin.Fprintf(os.Stderr, "@Y{unable to update %s: %s}\n", s3.UploadState, err)
+	}
+	s3.recordChecksum(api, rec.Path, hex.EncodeToString(sum.Sum(nil)), size)
+	return rec.Path, nil
+}
+
+// Cleanup lists (or aborts) the multipart uploads that have been lingering
+// under the configured prefix for longer than `s3_stale_upload_hours`.
+func (p S3Plugin) Cleanup(endpoint plugin.ShieldEndpoint, dryRun bool) error {
+	s3, err := getS3ConnInfo(endpoint)
+	if err != nil {
+		return err
+	}
+	api, err := s3.API()
+	if err != nil {
+		return err
+	}
+
+	uploads, err := api.ListMultipartUploads(s3.PathPrefix)
+	if err != nil {
+		return err
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].Initiated.Before(uploads[j].Initiated)
+	})
+
+	aborted := []uploadRecord{}
+	stale := 0
+	for _, u := range uploads {
+		age := time.Since(u.Initiated)
+		if age <= s3.staleUploadAge() {
+			plugin.Printf("  %s  @C{%s}  (in progress, started %s ago)\n", u.UploadID, u.Key, age-age%time.Minute)
+			continue
+		}
+
+		stale++
+		if dryRun {
+			plugin.Printf("@Y{- %s  %s}  (stale, started %s ago)\n", u.UploadID, u.Key, age-age%time.Minute)
+			continue
+		}
+		if err := api.AbortMultipartUpload(u.Key, u.UploadID); err != nil {
+			plugin.Printf("@R{\u2717 %s  %s  %s}\n", u.UploadID, u.Key, err)
+			continue
+		}
+		plugin.Printf("@G{\u2713 %s}  @C{%s}  aborted\n", u.UploadID, u.Key)
+		aborted = append(aborted, uploadRecord{Bucket: s3.Bucket, Path: u.Key})
+	}
+
+	if err = s3.forgetUploads(aborted); err != nil {
+		return err
+	}
+
+	if len(aborted) < stale && !dryRun {
+		return fmt.Errorf("failed to abort %d of %d stale upload(s)", stale-len(aborted), stale)
+	}
+	return nil
+}
@@ -0,0 +1,726 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeUpload is a multipart upload, as seen by the fake S3 server.
+type fakeUpload struct {
+	key         string
+	initiated   time.Time
+	parts       map[int][]byte
+	compression string
+}
+
+// failingReader returns whatever its reader has, and then fails, the way
+// a backup stream would when the backup breaks half-way.
+type failingReader struct {
+	r io.Reader
+}
+
+func (f *failingReader) Read(b []byte) (int, error) {
+	n, err := f.r.Read(b)
+	if err == io.EOF {
+		return n, errors.New("backup stream broke")
+	}
+	return n, err
+}
+
+var _ = Describe("Multipart Uploads", func() {
+	var (
+		server  *httptest.Server
+		info    S3ConnectionInfo
+		api     *S3API
+		tmp     string
+		lock    sync.Mutex
+		nextID  int
+		uploads map[string]*fakeUpload
+		objects map[string][]byte
+		meta    map[string]string
+		sums    map[string]string
+		puts    int
+		parts   int
+		copies  int
+		aborts  []string
+		corrupt bool
+		sse     http.Header
+
+		listFails     bool
+		completeFails bool
+		copyFails     bool
+
+		partSize int
+		alive    func(int) bool
+	)
+
+	md5etag := func(b []byte) string {
+		sum := md5.Sum(b)
+		return `"` + hex.EncodeToString(sum[:]) + `"`
+	}
+	etag := md5etag
+
+	BeforeEach(func() {
+		nextID = 0
+		uploads = map[string]*fakeUpload{}
+		objects = map[string][]byte{}
+		meta = map[string]string{}
+		sums = map[string]string{}
+		puts = 0
+		parts = 0
+		copies = 0
+		aborts = []string{}
+		corrupt = false
+		sse = nil
+		listFails = false
+		completeFails = false
+		copyFails = false
+
+		server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			lock.Lock()
+			defer lock.Unlock()
+
+			q := r.URL.Query()
+			key := r.URL.Path[len("/bucket/"):]
+			body, err := ioutil.ReadAll(r.Body)
+			Ω(err).ShouldNot(HaveOccurred())
+			if corrupt && r.Method == "PUT" && len(body) > 0 {
+				/* flip a bit, as a faulty network path would */
+				body[0] ^= 0x01
+			}
+			etag := etag
+			if sse != nil {
+				/* the ETags of encrypted objects are not their MD5 */
+				for k, v := range sse {
+					w.Header()[k] = v
+				}
+				etag = func(b []byte) string {
+					sum := md5.Sum(append([]byte("encrypted "), b...))
+					return `"` + hex.EncodeToString(sum[:]) + `"`
+				}
+			}
+
+			_, listing := q["uploads"]
+			_, deleting := q["delete"]
+			id := q.Get("uploadId")
+			u := uploads[id]
+			if id != "" && u == nil {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprintf(w, `<Error><Code>NoSuchUpload</Code><Message>The specified upload does not exist.</Message></Error>`)
+				return
+			}
+
+			switch {
+			case r.Method == "POST" && listing:
+				nextID++
+				id := fmt.Sprintf("upload-%d", nextID)
+				uploads[id] = &fakeUpload{key: key, initiated: time.Now(), parts: map[int][]byte{}, compression: r.Header.Get(CompressionHeader)}
+				fmt.Fprintf(w, `<InitiateMultipartUploadResult><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, key, id)
+
+			case r.Method == "GET" && listing && listFails:
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintf(w, `<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+
+			case r.Method == "GET" && listing:
+				fmt.Fprintf(w, `<ListMultipartUploadsResult>`)
+				for id, u := range uploads {
+					if !strings.HasPrefix(u.key, q.Get("prefix")) {
+						continue
+					}
+					fmt.Fprintf(w, `<Upload><Key>%s</Key><UploadId>%s</UploadId><Initiated>%s</Initiated></Upload>`,
+						u.key, id, u.initiated.UTC().Format(time.RFC3339))
+				}
+				fmt.Fprintf(w, `<IsTruncated>false</IsTruncated></ListMultipartUploadsResult>`)
+
+			case r.Method == "PUT" && id != "":
+				n, err := strconv.Atoi(q.Get("partNumber"))
+				Ω(err).ShouldNot(HaveOccurred())
+				u.parts[n] = body
+				parts++
+				w.Header().Set("ETag", etag(body))
+
+			case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "" && copyFails:
+				/* S3 reports some failures to copy with a 200 OK */
+				fmt.Fprintf(w, `<Error><Code>InternalError</Code><Message>We encountered an internal error. Please try again.</Message></Error>`)
+
+			case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+				Ω(r.Header.Get("X-Amz-Copy-Source")).Should(Equal("/bucket/" + key))
+				Ω(r.Header.Get("X-Amz-Metadata-Directive")).Should(Equal("REPLACE"))
+				Ω(objects).Should(HaveKey(key))
+				copies++
+				meta[key] = r.Header.Get(CompressionHeader)
+				sums[key] = r.Header.Get(ChecksumHeader)
+				fmt.Fprintf(w, `<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>`, etag(objects[key]))
+
+			case r.Method == "PUT":
+				puts++
+				objects[key] = body
+				meta[key] = r.Header.Get(CompressionHeader)
+				sums[key] = r.Header.Get(ChecksumHeader)
+				w.Header().Set("ETag", etag(body))
+
+			case r.Method == "HEAD":
+				if _, ok := objects[key]; !ok {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				if meta[key] != "" {
+					w.Header().Set(CompressionHeader, meta[key])
+				}
+				if sums[key] != "" {
+					w.Header().Set(ChecksumHeader, sums[key])
+				}
+
+			case r.Method == "POST" && deleting:
+				var req deleteRequest
+				Ω(xml.Unmarshal(body, &req)).Should(Succeed())
+				for _, o := range req.Objects {
+					delete(objects, o.Key)
+				}
+				fmt.Fprintf(w, `<DeleteResult></DeleteResult>`)
+
+			case r.Method == "GET" && id != "":
+				numbers := []int{}
+				for n := range u.parts {
+					numbers = append(numbers, n)
+				}
+				sort.Ints(numbers)
+				fmt.Fprintf(w, `<ListPartsResult>`)
+				for _, n := range numbers {
+					fmt.Fprintf(w, `<Part><PartNumber>%d</PartNumber><ETag>%s</ETag><Size>%d</Size></Part>`, n, etag(u.parts[n]), len(u.parts[n]))
+				}
+				fmt.Fprintf(w, `<IsTruncated>false</IsTruncated></ListPartsResult>`)
+
+			case r.Method == "POST" && id != "" && completeFails:
+				/* S3 reports some failures to complete with a 200 OK */
+				fmt.Fprintf(w, `<Error><Code>InternalError</Code><Message>We encountered an internal error. Please try again.</Message></Error>`)
+
+			case r.Method == "POST" && id != "":
+				var req struct {
+					Parts []uploadedPart `xml:"Part"`
+				}
+				Ω(xml.Unmarshal(body, &req)).Should(Succeed())
+				var data bytes.Buffer
+				sums := md5.New()
+				for i, p := range req.Parts {
+					Ω(p.PartNumber).Should(Equal(i + 1))
+					Ω(p.ETag).Should(Equal(md5etag(u.parts[p.PartNumber])))
+					data.Write(u.parts[p.PartNumber])
+					sum := md5.Sum(u.parts[p.PartNumber])
+					sums.Write(sum[:])
+				}
+				objects[u.key] = data.Bytes()
+				meta[u.key] = u.compression
+				delete(uploads, id)
+				fmt.Fprintf(w, `<CompleteMultipartUploadResult><Key>%s</Key><ETag>"%s-%d"</ETag></CompleteMultipartUploadResult>`,
+					u.key, hex.EncodeToString(sums.Sum(nil)), len(req.Parts))
+
+			case r.Method == "DELETE" && id != "":
+				aborts = append(aborts, id)
+				delete(uploads, id)
+				w.WriteHeader(http.StatusNoContent)
+
+			default:
+				Fail(fmt.Sprintf("unexpected request %s %s", r.Method, r.URL))
+			}
+		}))
+
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-s3-")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		u, err := url.Parse(server.URL)
+		Ω(err).ShouldNot(HaveOccurred())
+		info = S3ConnectionInfo{
+			Host:              u.Hostname(),
+			Port:              u.Port(),
+			SkipSSLValidation: true,
+			AccessKey:         "AKID",
+			SecretKey:         "secret",
+			Bucket:            "bucket",
+			PathPrefix:        "backups",
+			SignatureVersion:  "2",
+			UploadState:       filepath.Join(tmp, "uploads.json"),
+			StaleUploadHours:  DefaultStaleUploadHours,
+		}
+		api, err = info.API()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		partSize = MultipartPartSize
+		MultipartPartSize = 16
+		alive = processAlive
+		processAlive = func(pid int) bool { return false }
+	})
+
+	AfterEach(func() {
+		MultipartPartSize = partSize
+		processAlive = alive
+		server.Close()
+		os.RemoveAll(tmp)
+	})
+
+	archive := func(n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte('a' + i%26)
+		}
+		return b
+	}
+
+	tracked := func() uploadState {
+		var state uploadState
+		Ω(withUploadState(info.UploadState, func(s uploadState) error {
+			state = s
+			return nil
+		})).Should(Succeed())
+		return state
+	}
+
+	It("stores small archives with a single request", func() {
+		path, err := info.upload(api, bytes.NewReader(archive(10)))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(puts).Should(Equal(1))
+		Ω(objects[strings.TrimPrefix(path, "/")]).Should(Equal(archive(10)))
+		Ω(uploads).Should(BeEmpty())
+	})
+
+	It("stores archives up to s3_multipart_threshold with a single request", func() {
+		info.MultipartThreshold = 24
+		path, err := info.upload(api, bytes.NewReader(archive(24)))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(puts).Should(Equal(1))
+		Ω(parts).Should(Equal(0))
+		Ω(objects[strings.TrimPrefix(path, "/")]).Should(Equal(archive(24)))
+	})
+
+	It("stores archives beyond s3_multipart_threshold in parts", func() {
+		info.MultipartThreshold = 24
+		path, err := info.upload(api, bytes.NewReader(archive(25)))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(puts).Should(Equal(0))
+		Ω(parts).Should(Equal(2))
+		Ω(objects[strings.TrimPrefix(path, "/")]).Should(Equal(archive(25)))
+		Ω(tracked()).Should(BeEmpty())
+
+		info.MultipartThreshold = 8
+		path, err = info.upload(api, bytes.NewReader(archive(10)))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(puts).Should(Equal(0))
+		Ω(parts).Should(Equal(3))
+		Ω(objects[strings.TrimPrefix(path, "/")]).Should(Equal(archive(10)))
+	})
+
+	It("verifies the MD5 of small archives against their ETag", func() {
+		corrupt = true
+		_, err := info.upload(api, bytes.NewReader(archive(10)))
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("was corrupted in transit"))
+		Ω(puts).Should(Equal(1))
+		Ω(objects).Should(BeEmpty())
+	})
+
+	It("stores large archives in parts", func() {
+		path, err := info.upload(api, bytes.NewReader(archive(40)))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(puts).Should(Equal(0))
+		Ω(objects[strings.TrimPrefix(path, "/")]).Should(Equal(archive(40)))
+		Ω(uploads).Should(BeEmpty())
+		Ω(tracked()).Should(BeEmpty())
+	})
+
+	It("verifies the ETag of each part of large archives", func() {
+		corrupt = true
+		_, err := info.upload(api, bytes.NewReader(archive(40)))
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("part 1 of"))
+		Ω(err.Error()).Should(ContainSubstring("was corrupted in transit"))
+		Ω(objects).Should(BeEmpty())
+	})
+
+	It("only compares ETags that are MD5s", func() {
+		Ω(checkETag("x", http.Header{"Etag": {`"ABC"`}}, `"abc"`)).Should(Succeed())
+		Ω(checkETag("x", http.Header{}, `"abc"`)).Should(Succeed())
+		Ω(checkETag("x", http.Header{"Etag": {`"abd"`}}, `"abc"`)).ShouldNot(Succeed())
+		Ω(checkETag("x", http.Header{"Etag": {`"abd"`}, "X-Amz-Server-Side-Encryption": {"AES256"}}, `"abc"`)).ShouldNot(Succeed())
+
+		Ω(checkETag("x", http.Header{"Etag": {`"abd"`}, "X-Amz-Server-Side-Encryption": {"aws:kms"}}, `"abc"`)).Should(Succeed())
+		Ω(checkETag("x", http.Header{"Etag": {`"abd"`}, "X-Amz-Server-Side-Encryption": {"aws:kms:dsse"}}, `"abc"`)).Should(Succeed())
+		Ω(checkETag("x", http.Header{"Etag": {`"abd"`}, "X-Amz-Server-Side-Encryption-Customer-Algorithm": {"AES256"}}, `"abc"`)).Should(Succeed())
+	})
+
+	It("stores archives on buckets that encrypt them with SSE-KMS or SSE-C", func() {
+		for _, h := range []http.Header{
+			{"X-Amz-Server-Side-Encryption": {"aws:kms"}},
+			{"X-Amz-Server-Side-Encryption-Customer-Algorithm": {"AES256"}},
+		} {
+			sse = h
+			path, err := info.upload(api, bytes.NewReader(archive(10)))
+			Ω(err).ShouldNot(HaveOccurred(), "%v", h)
+			Ω(objects[strings.TrimPrefix(path, "/")]).Should(Equal(archive(10)))
+
+			path, err = info.upload(api, bytes.NewReader(archive(40)))
+			Ω(err).ShouldNot(HaveOccurred(), "%v", h)
+			Ω(objects[strings.TrimPrefix(path, "/")]).Should(Equal(archive(40)))
+		}
+	})
+
+	It("records the SHA-256 of the archives, however they are stored", func() {
+		path, err := info.upload(api, bytes.NewReader(archive(10)))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(sums[strings.TrimPrefix(path, "/")]).Should(Equal(hexSHA256(archive(10))))
+		Ω(copies).Should(Equal(0))
+
+		info.Compression = "gzip"
+		path, err = info.upload(api, bytes.NewReader(archive(40)))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(sums[strings.TrimPrefix(path, "/")]).Should(Equal(hexSHA256(archive(40))))
+		Ω(copies).Should(Equal(1))
+		/* replacing the metadata keeps the rest of it */
+		Ω(meta[strings.TrimPrefix(path, "/")]).Should(Equal("gzip"))
+	})
+
+	It("records the SHA-256 of resumed uploads, parts already uploaded included", func() {
+		_, err := info.upload(api, &failingReader{r: bytes.NewReader(archive(40)[:32])})
+		Ω(err).Should(HaveOccurred())
+		path, err := info.upload(api, bytes.NewReader(archive(40)))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(sums[strings.TrimPrefix(path, "/")]).Should(Equal(hexSHA256(archive(40))))
+	})
+
+	It("stores archives whose SHA-256 can't be recorded all the same", func() {
+		copyFails = true
+		path, err := info.upload(api, bytes.NewReader(archive(40)))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(objects[strings.TrimPrefix(path, "/")]).Should(Equal(archive(40)))
+		Ω(sums[strings.TrimPrefix(path, "/")]).Should(BeEmpty())
+		copyFails = false
+
+		size := MaxCopySize
+		defer func() { MaxCopySize = size }()
+		MaxCopySize = 32
+		_, err = info.upload(api, bytes.NewReader(archive(40)))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(copies).Should(Equal(0))
+
+		MaxCopySize = size
+		info.ObjectLockMode, info.ObjectLockDays = "GOVERNANCE", 1
+		_, err = info.upload(api, bytes.NewReader(archive(40)))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(copies).Should(Equal(0))
+	})
+
+	It("checks retrieved archives against their SHA-256", func() {
+		read := func(data []byte, sum string) ([]byte, error) {
+			h := http.Header{}
+			if sum != "" {
+				h.Set(ChecksumHeader, sum)
+			}
+			return ioutil.ReadAll(verifyChecksum("backups/archive", h, ioutil.NopCloser(bytes.NewReader(data))))
+		}
+
+		b, err := read(archive(40), hexSHA256(archive(40)))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(b).Should(Equal(archive(40)))
+		_, err = read(archive(40), strings.ToUpper(hexSHA256(archive(40))))
+		Ω(err).ShouldNot(HaveOccurred())
+		b, err = read(archive(40), "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(b).Should(Equal(archive(40)))
+
+		_, err = read(archive(39), hexSHA256(archive(40)))
+		Ω(err).Should(MatchError(ContainSubstring("backups/archive was corrupted: its SHA-256 is " + hexSHA256(archive(39)))))
+	})
+
+	Context("with compression", func() {
+		roundTrip := func(compression string, size int) {
+			info.Compression = compression
+			api, err := info.API()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			in, err := compress(info.Compression, bytes.NewReader(archive(size)))
+			Ω(err).ShouldNot(HaveOccurred())
+			path, err := info.upload(api, in)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(in.Close()).Should(Succeed())
+
+			stored := objects[strings.TrimPrefix(path, "/")]
+			if compression == "none" {
+				Ω(stored).Should(Equal(archive(size)))
+			} else {
+				Ω(stored).ShouldNot(Equal(archive(size)))
+			}
+
+			headers, err := api.Head(strings.TrimPrefix(path, "/"))
+			Ω(err).ShouldNot(HaveOccurred())
+			recorded := headers.Get(CompressionHeader)
+			if compression == "none" {
+				Ω(recorded).Should(Equal(""))
+			} else {
+				Ω(recorded).Should(Equal(compression))
+			}
+
+			var out bytes.Buffer
+			Ω(decompress(recorded, bytes.NewReader(stored), &out)).Should(Succeed())
+			Ω(out.Bytes()).Should(Equal(archive(size)))
+		}
+
+		BeforeEach(func() {
+			MultipartPartSize = 64
+		})
+
+		for _, compression := range []string{"none", "gzip", "zstd"} {
+			compression := compression
+			It(fmt.Sprintf("stores and retrieves %s-compressed archives", compression), func() {
+				if compression == "zstd" {
+					if _, err := exec.LookPath(ZstdCommand); err != nil {
+						Skip("zstd is not installed")
+					}
+				}
+				roundTrip(compression, 10)
+				roundTrip(compression, 100000)
+			})
+		}
+
+		It("does not store archives whose stream broke", func() {
+			info.Compression = "gzip"
+			api, err := info.API()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			in, err := compress(info.Compression, &failingReader{bytes.NewReader(archive(10))})
+			Ω(err).ShouldNot(HaveOccurred())
+			defer in.Close()
+			_, err = info.upload(api, in)
+			Ω(err).Should(MatchError("backup stream broke"))
+			Ω(objects).Should(BeEmpty())
+		})
+
+		It("rejects unknown algorithms", func() {
+			_, err := compress("lzma", bytes.NewReader(archive(10)))
+			Ω(err).Should(HaveOccurred())
+			Ω(decompress("lzma", bytes.NewReader(archive(10)), ioutil.Discard)).ShouldNot(Succeed())
+		})
+	})
+
+	It("resumes an interrupted upload, skipping identical parts", func() {
+		_, err := info.upload(api, &failingReader{r: bytes.NewReader(archive(40)[:32])})
+		Ω(err).Should(HaveOccurred())
+		Ω(uploads).Should(HaveLen(1))
+		Ω(tracked()).Should(HaveLen(1))
+
+		var first string
+		for _, r := range tracked() {
+			first = r.Path
+		}
+		Ω(parts).Should(Equal(2))
+
+		path, err := info.upload(api, bytes.NewReader(archive(40)))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(path).Should(Equal(first))
+		Ω(parts).Should(Equal(3))
+		Ω(objects[strings.TrimPrefix(path, "/")]).Should(Equal(archive(40)))
+		Ω(aborts).Should(BeEmpty())
+		Ω(tracked()).Should(BeEmpty())
+	})
+
+	It("only resumes the interrupted upload of the same target", func() {
+		info.target = "target-1"
+		_, err := info.upload(api, &failingReader{r: bytes.NewReader(archive(40)[:32])})
+		Ω(err).Should(HaveOccurred())
+		/* both jobs ran at the same time, and were interrupted */
+		processAlive = func(pid int) bool { return true }
+		info.target = "target-2"
+		_, err = info.upload(api, &failingReader{r: bytes.NewReader(archive(40)[:32])})
+		Ω(err).Should(HaveOccurred())
+		processAlive = func(pid int) bool { return false }
+		Ω(uploads).Should(HaveLen(2))
+		Ω(tracked()).Should(HaveLen(2))
+
+		var first, second string
+		for _, r := range tracked() {
+			if r.Target == "target-1" {
+				first = r.UploadID
+			} else {
+				second = r.Path
+			}
+		}
+		Ω(first).ShouldNot(BeEmpty())
+		Ω(second).ShouldNot(BeEmpty())
+
+		path, err := info.upload(api, bytes.NewReader(archive(40)))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(path).Should(Equal(second))
+		Ω(objects[strings.TrimPrefix(path, "/")]).Should(Equal(archive(40)))
+
+		/* the other target's upload would never be resumed by this one */
+		Ω(aborts).Should(Equal([]string{first}))
+		Ω(uploads).Should(BeEmpty())
+		Ω(tracked()).Should(BeEmpty())
+	})
+
+	It("identifies the target from what SHIELD hands over", func() {
+		defer os.Unsetenv("SHIELD_TARGET_PLUGIN")
+		defer os.Unsetenv("SHIELD_TARGET_ENDPOINT")
+		os.Unsetenv("SHIELD_TARGET_PLUGIN")
+		os.Unsetenv("SHIELD_TARGET_ENDPOINT")
+		Ω(uploadTarget()).Should(BeEmpty())
+
+		os.Setenv("SHIELD_TARGET_PLUGIN", "postgres")
+		os.Setenv("SHIELD_TARGET_ENDPOINT", `{"pg_host":"db1","pg_password":"s3cr3t"}`)
+		target := uploadTarget()
+		Ω(target).ShouldNot(BeEmpty())
+		Ω(target).ShouldNot(ContainSubstring("s3cr3t"))
+
+		os.Setenv("SHIELD_TARGET_ENDPOINT", `{"pg_host":"db2","pg_password":"s3cr3t"}`)
+		Ω(uploadTarget()).ShouldNot(Equal(target))
+	})
+
+	It("does not resume uploads that are still in progress", func() {
+		_, err := info.upload(api, &failingReader{r: bytes.NewReader(archive(32))})
+		Ω(err).Should(HaveOccurred())
+
+		processAlive = func(pid int) bool { return true }
+		_, err = info.upload(api, bytes.NewReader(archive(40)))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(uploads).Should(HaveLen(1))
+		Ω(tracked()).Should(HaveLen(1))
+	})
+
+	It("aborts uploads that were abandoned for too long", func() {
+		_, err := info.upload(api, &failingReader{r: bytes.NewReader(archive(32))})
+		Ω(err).Should(HaveOccurred())
+		Ω(withUploadState(info.UploadState, func(state uploadState) error {
+			for k, r := range state {
+				r.Started = r.Started.Add(-48 * time.Hour)
+				state[k] = r
+			}
+			return nil
+		})).Should(Succeed())
+
+		_, err = info.upload(api, bytes.NewReader(archive(40)))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(aborts).Should(HaveLen(1))
+		Ω(uploads).Should(BeEmpty())
+		Ω(tracked()).Should(BeEmpty())
+	})
+
+	It("aborts the stale uploads under the prefix, wherever they were started", func() {
+		old := time.Now().Add(-48 * time.Hour)
+		uploads["elsewhere-1"] = &fakeUpload{key: "backups/2017/01/01/old", initiated: old, parts: map[int][]byte{}}
+		uploads["elsewhere-2"] = &fakeUpload{key: "other/2017/01/01/old", initiated: old, parts: map[int][]byte{}}
+		uploads["elsewhere-3"] = &fakeUpload{key: "backups/2017/01/01/young", initiated: time.Now(), parts: map[int][]byte{}}
+
+		_, err := info.upload(api, bytes.NewReader(archive(10)))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(aborts).Should(Equal([]string{"elsewhere-1"}))
+		Ω(uploads).Should(HaveKey("elsewhere-2"))
+		Ω(uploads).Should(HaveKey("elsewhere-3"))
+	})
+
+	It("stores the archive even when stale uploads can't be looked for", func() {
+		listFails = true
+		path, err := info.upload(api, bytes.NewReader(archive(40)))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(objects[strings.TrimPrefix(path, "/")]).Should(Equal(archive(40)))
+	})
+
+	It("returns no key until the upload is completed", func() {
+		completeFails = true
+		path, err := info.upload(api, bytes.NewReader(archive(40)))
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("internal error"))
+		Ω(path).Should(BeEmpty())
+		Ω(objects).Should(BeEmpty())
+		Ω(tracked()).Should(HaveLen(1))
+
+		var first string
+		for _, r := range tracked() {
+			first = r.Path
+		}
+		completeFails = false
+		path, err = info.upload(api, bytes.NewReader(archive(40)))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(path).Should(Equal(first))
+		Ω(objects[strings.TrimPrefix(path, "/")]).Should(Equal(archive(40)))
+		Ω(tracked()).Should(BeEmpty())
+	})
+
+	It("uploads the parts that differ from the interrupted upload", func() {
+		_, err := info.upload(api, &failingReader{r: bytes.NewReader(archive(32))})
+		Ω(err).Should(HaveOccurred())
+
+		changed := archive(40)
+		changed[20] = '!'
+		path, err := info.upload(api, bytes.NewReader(changed))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(parts).Should(Equal(4))
+		Ω(objects[strings.TrimPrefix(path, "/")]).Should(Equal(changed))
+	})
+
+	It("starts over when the upload is gone from S3", func() {
+		_, err := info.upload(api, &failingReader{r: bytes.NewReader(archive(32))})
+		Ω(err).Should(HaveOccurred())
+		lock.Lock()
+		uploads = map[string]*fakeUpload{}
+		lock.Unlock()
+
+		path, err := info.upload(api, bytes.NewReader(archive(40)))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(objects[strings.TrimPrefix(path, "/")]).Should(Equal(archive(40)))
+		Ω(tracked()).Should(BeEmpty())
+	})
+
+	Context("cleaning up", func() {
+		BeforeEach(func() {
+			uploads["old"] = &fakeUpload{key: "backups/old", initiated: time.Now().Add(-72 * time.Hour), parts: map[int][]byte{}}
+			uploads["new"] = &fakeUpload{key: "backups/new", initiated: time.Now().Add(-time.Hour), parts: map[int][]byte{}}
+		})
+
+		endpoint := func() map[string]interface{} {
+			return map[string]interface{}{
+				"s3_host":               info.Host,
+				"s3_port":               info.Port,
+				"skip_ssl_validation":   true,
+				"access_key_id":         info.AccessKey,
+				"secret_access_key":     info.SecretKey,
+				"bucket":                info.Bucket,
+				"prefix":                info.PathPrefix,
+				"signature_version":     "2",
+				"s3_upload_state":       info.UploadState,
+				"s3_stale_upload_hours": float64(24),
+			}
+		}
+
+		It("only lists stale uploads in dry-run mode", func() {
+			Ω(S3Plugin{}.Cleanup(endpoint(), true)).Should(Succeed())
+			Ω(aborts).Should(BeEmpty())
+			Ω(uploads).Should(HaveLen(2))
+		})
+
+		It("aborts stale uploads", func() {
+			Ω(S3Plugin{}.Cleanup(endpoint(), false)).Should(Succeed())
+			Ω(aborts).Should(Equal([]string{"old"}))
+			Ω(uploads).Should(HaveKey("new"))
+		})
+	})
+})
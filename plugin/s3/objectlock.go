@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	minio "github.com/minio/minio-go"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Archives can be made immutable with S3 Object Lock: when
+// `s3_object_lock_mode` is set, each new object is stored with that
+// retention mode, and a retain-until date `s3_object_lock_days` days after
+// the store.  Until then, S3 refuses to delete (or overwrite) the object
+// version; in GOVERNANCE mode, users with the s3:BypassGovernanceRetention
+// permission can still remove it, while in COMPLIANCE mode nobody can, not
+// even the root account of the bucket.
+//
+// Object Lock has to be enabled on the bucket (which can only be done when
+// it is created, and turns versioning on).  Deleting a locked object without
+// naming its version only hides it behind a delete marker, so purges check
+// the retention of the objects first, and fail for those that are still
+// locked, rather than reporting as purged archives that S3 keeps (and bills
+// for) until their retention expires.
+
+const (
+	DefaultObjectLockMode = ""
+	DefaultObjectLockDays = 0
+
+	ObjectLockModeHeader  = "X-Amz-Object-Lock-Mode"
+	ObjectLockUntilHeader = "X-Amz-Object-Lock-Retain-Until-Date"
+)
+
+func validObjectLockMode(m string) bool {
+	return m == "" || m == "GOVERNANCE" || m == "COMPLIANCE"
+}
+
+// retainUntil returns the retain-until date of objects stored at `now`.
+func (s3 S3ConnectionInfo) retainUntil(now time.Time) time.Time {
+	return now.Add(time.Duration(s3.ObjectLockDays) * 24 * time.Hour).UTC().Truncate(time.Second)
+}
+
+// lockHeaders adds the Object Lock headers (if any) to the headers of a new
+// object.
+func (s3 S3ConnectionInfo) lockHeaders(h http.Header, now time.Time) {
+	if s3.ObjectLockMode == "" {
+		return
+	}
+	h.Set(ObjectLockModeHeader, s3.ObjectLockMode)
+	h.Set(ObjectLockUntilHeader, s3.retainUntil(now).Format(time.RFC3339))
+}
+
+// ObjectLockEnabled tells whether Object Lock is enabled on the bucket.
+func (api *S3API) ObjectLockEnabled() (bool, error) {
+	res, err := api.Do("GET", "", url.Values{"object-lock": []string{""}}, nil, nil)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "ObjectLockConfigurationNotFoundError" {
+			return false, nil
+		}
+		return false, err
+	}
+
+	var config struct {
+		Enabled string `xml:"ObjectLockEnabled"`
+	}
+	if err = api.readXML(res, &config); err != nil {
+		return false, err
+	}
+	return config.Enabled == "Enabled", nil
+}
+
+// checkObjectLock makes sure that objects can be stored with the configured
+// retention, so that stores fail with a clear message when they cannot.
+func (api *S3API) checkObjectLock() error {
+	if api.info.ObjectLockMode == "" {
+		return nil
+	}
+	enabled, err := api.ObjectLockEnabled()
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return plugin.ConfigError{Key: "s3_object_lock_mode", Err: fmt.Errorf("Object Lock is not enabled on bucket %s", api.info.Bucket)}
+	}
+	return nil
+}
+
+// lockedUntil returns the retention of an object, as given by the headers
+// of a HEAD response; the zero time means that the object is not locked.
+func lockedUntil(h http.Header, now time.Time) (string, time.Time) {
+	mode := h.Get(ObjectLockModeHeader)
+	until, err := time.Parse(time.RFC3339, h.Get(ObjectLockUntilHeader))
+	if mode == "" || err != nil || !until.After(now) {
+		return "", time.Time{}
+	}
+	return mode, until
+}
+
+// unlocked splits keys into those that can be purged, and the (messages
+// about the) ones that are still locked.  Buckets without Object Lock (or
+// whose configuration cannot be read) have no locked objects.
+func (api *S3API) unlocked(keys []string) ([]string, []string, error) {
+	enabled, err := api.ObjectLockEnabled()
+	if err != nil {
+		plugin.DEBUG("unable to check the Object Lock configuration of bucket %s (%s); assuming it has none", api.info.Bucket, err)
+		return keys, nil, nil
+	}
+	if !enabled {
+		return keys, nil, nil
+	}
+
+	now := time.Now()
+	ok, locked := []string{}, []string{}
+	for _, key := range keys {
+		h, err := api.Head(key)
+		if err != nil {
+			code := minio.ToErrorResponse(err).Code
+			if code == "NoSuchKey" || code == "NotFound" {
+				ok = append(ok, key)
+				continue
+			}
+			return nil, nil, err
+		}
+		if mode, until := lockedUntil(h, now); !until.IsZero() {
+			locked = append(locked, fmt.Sprintf("%s (locked in %s mode until %s)", key, mode, until.Format(time.RFC3339)))
+			continue
+		}
+		ok = append(ok, key)
+	}
+	return ok, locked, nil
+}
+
+// lockedError reports the objects that could not be purged because of
+// their retention.
+func lockedError(locked []string) error {
+	return fmt.Errorf("refusing to purge %d object(s) that are still under Object Lock retention:\n  %s",
+		len(locked), strings.Join(locked, "\n  "))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Object Lock", func() {
+	var (
+		server  *httptest.Server
+		info    S3ConnectionInfo
+		lock    sync.Mutex
+		enabled bool
+		locks   map[string]time.Time
+		puts    []http.Header
+		heads   []string
+	)
+
+	BeforeEach(func() {
+		enabled = true
+		locks = map[string]time.Time{}
+		puts = []http.Header{}
+		heads = []string{}
+
+		server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			lock.Lock()
+			defer lock.Unlock()
+
+			key := r.URL.Path[len("/bucket/"):]
+			_, config := r.URL.Query()["object-lock"]
+			switch {
+			case r.Method == "GET" && config:
+				if !enabled {
+					w.WriteHeader(http.StatusNotFound)
+					fmt.Fprintf(w, `<Error><Code>ObjectLockConfigurationNotFoundError</Code><Message>Object Lock configuration does not exist for this bucket</Message></Error>`)
+					return
+				}
+				fmt.Fprintf(w, `<ObjectLockConfiguration><ObjectLockEnabled>Enabled</ObjectLockEnabled></ObjectLockConfiguration>`)
+
+			case r.Method == "HEAD":
+				heads = append(heads, key)
+				until, ok := locks[key]
+				if !ok {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				if !until.IsZero() {
+					w.Header().Set(ObjectLockModeHeader, "COMPLIANCE")
+					w.Header().Set(ObjectLockUntilHeader, until.UTC().Format("2006-01-02T15:04:05.000Z"))
+				}
+
+			case r.Method == "PUT":
+				puts = append(puts, r.Header)
+
+			default:
+				Fail(fmt.Sprintf("unexpected %s %s", r.Method, r.URL))
+			}
+		}))
+
+		u, err := url.Parse(server.URL)
+		Ω(err).ShouldNot(HaveOccurred())
+		info = S3ConnectionInfo{
+			Host:              u.Hostname(),
+			Port:              u.Port(),
+			SkipSSLValidation: true,
+			AccessKey:         "AKID",
+			SecretKey:         "secret",
+			Bucket:            "bucket",
+			SignatureVersion:  "2",
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("stores archives with the configured retention", func() {
+		info.ObjectLockMode = "GOVERNANCE"
+		info.ObjectLockDays = 30
+		api, err := info.API()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(api.checkObjectLock()).Should(Succeed())
+		before := time.Now().UTC().Truncate(time.Second)
+		_, err = api.PutObject("2017/01/01/archive", []byte("archive"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(puts).Should(HaveLen(1))
+		Ω(puts[0].Get(ObjectLockModeHeader)).Should(Equal("GOVERNANCE"))
+		Ω(puts[0].Get("Content-Md5")).ShouldNot(BeEmpty())
+		until, err := time.Parse(time.RFC3339, puts[0].Get(ObjectLockUntilHeader))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(until).Should(BeTemporally(">=", before.Add(30*24*time.Hour)))
+		Ω(until).Should(BeTemporally("<", before.Add(30*24*time.Hour+time.Minute)))
+	})
+
+	It("does not lock archives unless asked to", func() {
+		api, err := info.API()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		_, err = api.PutObject("2017/01/01/archive", []byte("archive"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(puts).Should(HaveLen(1))
+		Ω(puts[0].Get(ObjectLockModeHeader)).Should(BeEmpty())
+		Ω(puts[0].Get(ObjectLockUntilHeader)).Should(BeEmpty())
+	})
+
+	It("refuses to store locked archives in a bucket without Object Lock", func() {
+		enabled = false
+		info.ObjectLockMode = "COMPLIANCE"
+		info.ObjectLockDays = 1
+		api, err := info.API()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = api.checkObjectLock()
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("Object Lock is not enabled on bucket bucket"))
+	})
+
+	It("sets apart the archives that are still locked", func() {
+		locks["old"] = time.Now().Add(-time.Hour)
+		locks["new"] = time.Now().Add(48 * time.Hour)
+		locks["plain"] = time.Time{}
+		api, err := info.API()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		ok, locked, err := api.unlocked([]string{"old", "new", "plain", "gone"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ok).Should(Equal([]string{"old", "plain", "gone"}))
+		Ω(locked).Should(HaveLen(1))
+		Ω(locked[0]).Should(HavePrefix("new (locked in COMPLIANCE mode until "))
+
+		err = lockedError(locked)
+		Ω(err.Error()).Should(ContainSubstring("refusing to purge 1 object(s) that are still under Object Lock retention"))
+	})
+
+	It("does not check the retention of archives in buckets without Object Lock", func() {
+		enabled = false
+		api, err := info.API()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		ok, locked, err := api.unlocked([]string{"a", "b"})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ok).Should(Equal([]string{"a", "b"}))
+		Ω(locked).Should(BeEmpty())
+		Ω(heads).Should(BeEmpty())
+	})
+})
@@ -22,12 +22,37 @@
 //        "s3_host":             "s3.amazonaws.com", # default
 //        "access_key_id":       "your-access-key-id",
 //        "secret_access_key":   "your-secret-access-key",
+//        "s3_session_token":    ""    # session token of temporary keys (STS, SSO, federation)
+//        "s3_profile":          ""    # shared AWS config profile to take the keys (and region) from
 //        "skip_ssl_validation":  false,
+//        "s3_ca_cert":          "/path/to/ca.pem" # CA certificates to trust, for self-signed endpoints
 //        "bucket":              "bucket-name",
 //        "prefix":              "/path/inside/bucket/to/place/backup/data",
 //        "signature_version":   "4",  # should be 2 or 4. Defaults to 4
 //        "socks5_proxy":        ""    # optionally defined SOCKS5 proxy to use for the s3 communications
 //        "s3_port":             ""    # optionally defined port to use for the s3 communications
+//        "s3_region":           ""    # region of the bucket; detected automatically if empty
+//        "s3_auto_restore":     false # restore archived (Glacier) objects before retrieving them
+//        "s3_restore_days":     1     # how long restored objects stay available
+//        "s3_restore_tier":     "Standard" # Glacier retrieval tier: Expedited, Standard or Bulk
+//        "s3_restore_timeout_hours": 48 # how long to wait for a restore to complete
+//        "s3_upload_state":     "/tmp/shield-s3-uploads.json" # where to track in-progress uploads
+//        "s3_stale_upload_hours": 24  # abort uploads abandoned for longer than that
+//        "s3_compression":      "none" # compress archives with none, gzip or zstd
+//        "s3_compression_min_ratio": 0 # store archives that compress worse than that uncompressed
+//        "s3_compressor_bin":   ""    # parallel compressor to use instead (i.e. pigz)
+//        "s3_compressor_threads": 0   # threads of the parallel compressor; 0 for all cores
+//        "s3_object_lock_mode": ""    # lock new archives in GOVERNANCE or COMPLIANCE mode
+//        "s3_object_lock_days": 0     # how many days new archives stay locked
+//        "s3_acl":              ""    # canned ACL of new archives (i.e. bucket-owner-full-control)
+//        "s3_connect_timeout":  30    # seconds to connect to S3 (or the proxy)
+//        "s3_request_timeout":  0     # seconds S3 may stay silent; 0 waits forever
+//        "s3_requester_pays":   false # acknowledge the charges of requester-pays buckets
+//        "s3_use_dualstack":    false # use the dual-stack (IPv4 + IPv6) AWS endpoints
+//        "s3_validate_retries": 2     # retries of the bucket check on network errors
+//        "s3_download_concurrency": 4 # ranged GETs at once, to retrieve multipart archives
+//        "s3_verify_readback":  false # check that new archives exist, whole, once stored
+//        "s3_multipart_threshold": 16 # MiB above which archives are uploaded in parts
 //    }
 //
 // Default Configuration
@@ -35,14 +60,97 @@
 //    {
 //        "s3_host"             : "s3.amazonawd.com",
 //        "signature_version"   : "4",
-//        "skip_ssl_validation" : false
+//        "skip_ssl_validation" : false,
+//        "s3_auto_restore"     : false,
+//        "s3_restore_days"     : 1,
+//        "s3_restore_tier"     : "Standard",
+//        "s3_restore_timeout_hours" : 48,
+//        "s3_upload_state"     : "$TMPDIR/shield-s3-uploads.json",
+//        "s3_stale_upload_hours" : 24,
+//        "s3_compression"      : "none",
+//        "s3_compression_min_ratio" : 0,
+//        "s3_compressor_bin"   : "",
+//        "s3_compressor_threads" : 0,
+//        "s3_object_lock_mode" : "",
+//        "s3_object_lock_days" : 0,
+//        "s3_acl"              : "",
+//        "s3_connect_timeout"  : 30,
+//        "s3_request_timeout"  : 0,
+//        "s3_requester_pays"   : false,
+//        "s3_use_dualstack"    : false,
+//        "s3_validate_retries" : 2,
+//        "s3_download_concurrency" : 4,
+//        "s3_verify_readback"  : false,
+//        "s3_multipart_threshold" : 16,
+//        "s3_profile"          : ""
 //    }
 //
 // `prefix` will default to the empty string, and backups will be placed in the
-// root of the bucket.
+// root of the bucket. Leading, trailing and repeated slashes don't matter:
+// `backups`, `/backups` and `backups/` all place backups under `backups/`.
 //
 // The `s3_port` field is optional. If specified, `s3_host` cannot be empty.
 //
+// Rather than `access_key_id` and `secret_access_key`, the endpoint can set
+// `s3_profile`, to take the keys (and a session token) from that profile of
+// the shared AWS config files (`~/.aws/credentials` and `~/.aws/config`, or
+// wherever `AWS_SHARED_CREDENTIALS_FILE` and `AWS_CONFIG_FILE` point) on the
+// SHIELD agent. Inline keys win over the profile, and `s3_region` wins over
+// the region of the profile. One or the other is required: there is no
+// fallback on environment variables or instance roles.
+//
+// Temporary keys, as issued by AWS STS to SSO or federated users, come with a
+// session token, which goes in `s3_session_token`, along with the inline
+// keys, and is sent with each request. Temporary keys expire (within hours,
+// usually), and the plugin can't renew them: once they do, every request is
+// denied (with `ExpiredToken`), and backups fail until the endpoint is given
+// fresh keys and token. Validating the endpoint says so, and only tells that
+// they are still valid at that time. Keep temporary keys for short-lived or
+// one-off jobs; scheduled jobs need keys that last, or a profile that is kept
+// up to date on the SHIELD agent.
+//
+// The `s3_region` field is optional too. When it is empty, the region of the
+// bucket is looked up with a GetBucketLocation request. When it is wrong, S3
+// tells the plugin where the bucket really lives, and the plugin retries the
+// request in that region, logging the correction. Setting it correctly saves
+// a round-trip (and a warning) on each run.
+//
+// S3-compatible services (i.e. on-premise Minio or Ceph) often use certificates
+// signed by a private CA. Point `s3_ca_cert` to a PEM bundle of the CA certificates
+// to trust (on top of the system ones), rather than setting `skip_ssl_validation`,
+// which turns verification off altogether, and should only be a last resort. When
+// `s3_ca_cert` is set, certificates are always verified. A warning is logged
+// whenever they are not.
+//
+// Connecting to S3 (or to the SOCKS5 proxy) fails after `s3_connect_timeout`
+// seconds. When `s3_request_timeout` is set, any request (store, retrieve, purge,
+// and the HEAD and LIST requests that go with them) also fails when S3 takes more
+// than that many seconds to start responding, or when the connection stalls for
+// that long in the middle of an upload or download. It is 0 by default, which
+// means waiting forever, as before; a few minutes is a sensible value.
+//
+// Set `s3_requester_pays` for buckets configured so that the requester pays for
+// requests and downloads: every request then carries the `x-amz-request-payer`
+// header, without which S3 denies access to such buckets. The charges go to the
+// AWS account that owns the access key.
+//
+// Set `s3_use_dualstack` to reach S3 through its dual-stack endpoints
+// (`s3.dualstack.<region>.amazonaws.com`), which answer over IPv6 as well as IPv4.
+// They only exist on Amazon S3, so `s3_host` and `s3_port` must be left alone. The
+// endpoints are regional: when `s3_region` is empty, the region of the bucket is
+// looked up through the us-east-1 dual-stack endpoint first.
+//
+// Validating the endpoint also checks that the bucket can be reached, with a
+// HEAD request. Network errors and 5xx answers are retried up to
+// `s3_validate_retries` times (2 by default), a second apart, so that a blip
+// does not fail the validation; denied access, bad credentials and missing
+// buckets fail it right away. Set it to 0 to never retry.
+//
+// Archives that were uploaded in parts are retrieved with up to
+// `s3_download_concurrency` ranged GETs at once (4 by default), of 16MiB
+// each, and reassembled in order; this holds as many ranges in memory.  Set
+// it to 1 to retrieve all archives with a single GET.
+//
 // STORE DETAILS
 //
 // When storing data, this plugin connects to the S3 service, and uploads the data
@@ -53,29 +161,158 @@
 // Upon successful storage, the plugin then returns this filename to SHIELD to use
 // as the `store_key` when the data needs to be retrieved, or purged.
 //
+// Archives of up to `s3_multipart_threshold` MiB (16 by default) are stored with a
+// single PUT request, which saves the requests (and the upload state) a multipart
+// upload takes; as much of the archive is buffered in memory, to find out whether
+// it is any larger. S3 refuses PUT requests of more than 5GiB, so it can't be set
+// any higher than 5120.
+//
+// Large archives are uploaded in parts (multipart upload). In-progress uploads are
+// tracked in the local `s3_upload_state` file, so that when a store is interrupted,
+// the next store resumes the upload instead of starting over: the parts that S3
+// already holds are skipped when the archive stream has the very same bytes there,
+// and uploaded again otherwise. The resumed archive keeps the storage key it was
+// first given. Only a store of the same target resumes an upload; the next store
+// of another target aborts it instead, as it does with the interrupted uploads
+// that were not resumed within `s3_stale_upload_hours`, so that S3 stops billing
+// for their parts. Each store also aborts the multipart uploads under `prefix`
+// that were started longer ago than that, wherever they were started from (like
+// the `cleanup` command does), and only warns when it can't list or abort them.
+//
+// The storage key is only handed over to SHIELD once the archive is complete in
+// S3: once the single request that stores it succeeded, or once the multipart
+// upload is completed (CompleteMultipartUpload succeeded, without an error in its
+// response) and its ETag checked. A store that fails before that returns no key,
+// so that SHIELD never records an archive that does not exist.
+//
+// Archives stored with a single request are checked against the ETag S3 returns,
+// which is the MD5 of the object; if they differ, the archive was corrupted in
+// transit, and the store fails (and removes the corrupted object). Multipart
+// uploads get no such plain MD5: the ETag of each part is checked instead. ETags
+// are not MD5s on buckets that encrypt objects with SSE-KMS (or with SSE-C keys),
+// and are not compared there. S3 also checks each request body against its
+// Content-MD5 and (with v4 signatures) SHA-256 payload hash.
+//
+// The SHA-256 of each archive is recorded in its `sha256` metadata, and checked
+// when it is retrieved: once it was read to the end, a retrieve fails if what was
+// read has another SHA-256. Multipart archives only get it once they are stored,
+// from a copy of the object onto itself, which S3 only does for objects of up to
+// 5 GiB, and which is skipped with `s3_object_lock_mode` (it would keep a second,
+// locked, version around): larger archives, and those of locked buckets, are
+// retrieved unchecked, as are the archives stored before this existed.
+//
+// When `s3_verify_readback` is true, the archive is also read back once stored,
+// with a HEAD request, before its key is handed over to SHIELD: the store fails
+// unless the archive exists, with as many bytes as were uploaded. This catches
+// S3-compatible stores that acknowledge writes they then lose, or that only
+// show new objects after a while: a missing archive is looked for 3 times, a
+// second apart. An archive of the wrong size is left in the bucket, for
+// inspection. It costs a request per store, and is off by default.
+//
+// When `s3_compression` is set to `gzip` or `zstd`, the plugin compresses the
+// archive itself, on its way to S3, for target plugins that only produce raw
+// (uncompressed) streams. The algorithm is recorded in the `shield-compression`
+// metadata of the object.
+//
+// Archives that are compressed already gain nothing from it. When
+// `s3_compression_min_ratio` is set (i.e. to 1.1), the first 4 MiB of the archive
+// are compressed with gzip, as a sample, and the archive is stored uncompressed
+// when they shrink less than that: 1.1 means by less than 10%. The decision and the
+// ratio of the sample are recorded in the `shield-compression` and
+// `shield-compression-ratio` metadata of the object. The sample is always gzipped,
+// even with `zstd` compression: it only estimates how compressible the archive is.
+//
+// Compression runs on a single core, which can make it the bottleneck of backups
+// of large targets. When `s3_compressor_bin` is set, archives are compressed by
+// that command instead, a parallel compressor that writes the `s3_compression`
+// format: `pigz` for gzip, `pzstd` or `zstd` for zstd. It runs
+// `s3_compressor_threads` threads, or one per core when that is 0 (the default).
+// This trades CPU for time: the compressor takes that many cores away from the
+// target, which may run on the same host, while the backup runs. When the
+// command can't be found, validation warns about it, and archives are compressed
+// the usual way. Archives are always decompressed the usual way.
+//
+// When `s3_object_lock_mode` is set, archives are stored with an S3 Object Lock
+// retention, in that mode, for `s3_object_lock_days` days, during which they
+// cannot be deleted or overwritten.  The bucket must have been created with
+// Object Lock enabled; stores fail otherwise.  In `GOVERNANCE` mode, users with
+// the `s3:BypassGovernanceRetention` permission can still remove locked archives.
+// In `COMPLIANCE` mode, nobody can, not even the administrators of the AWS
+// account, until the retention expires: make sure `s3_object_lock_days` does not
+// exceed the retention of the backup jobs, or their archives will fail to purge.
+//
+// When `s3_acl` is set, archives are stored with that canned ACL: `private`,
+// `public-read`, `public-read-write`, `authenticated-read`, `aws-exec-read`,
+// `bucket-owner-read` or `bucket-owner-full-control`.  Storing into the bucket of
+// another AWS account takes `bucket-owner-full-control`, for the owner of the
+// bucket to have control over the archives.  Buckets that enforce bucket owner
+// object ownership (with ACLs disabled) refuse any other ACL.
+//
 // RETRIEVE DETAILS
 //
 // When retrieving data, this plugin connects to the S3 service, and retrieves the data
 // located in the specified bucket, identified by the `store_key` provided by SHIELD.
 //
+// Archives that were compressed by the plugin are decompressed on the fly, using the
+// algorithm recorded in their metadata (regardless of the current `s3_compression`).
+//
+// When several keys are purged at once (with `purge --keys-from`), they are deleted
+// with DeleteObjects requests, of up to 1000 keys each, instead of one request per key.
+//
+// Objects that have been transitioned to the GLACIER or DEEP_ARCHIVE storage classes
+// (by a bucket lifecycle policy, for instance) cannot be retrieved directly. When
+// `s3_auto_restore` is set, the plugin will issue a restore request for such objects,
+// using the `s3_restore_tier` retrieval tier, wait until the restore completes, and
+// then stream the object as usual. The restored copy stays available for
+// `s3_restore_days` days. Be aware that restores can take minutes (Expedited), hours
+// (Standard, typically 3 to 5) or even the better part of a day (Bulk, 5 to 12 hours,
+// and up to 48 hours from DEEP_ARCHIVE), during which the retrieve operation will keep
+// waiting: it checks on the restore after a minute, then twice as long after each
+// check, up to every 15 minutes. It gives up after `s3_restore_timeout_hours` (48 by
+// default) with an error; S3 goes on with the restore all the same, and retrieving the
+// archive again later picks it up, instead of requesting another one.
+//
 // PURGE DETAILS
 //
 // When purging data, this plugin connects to the S3 service, and deletes the data
 // located in the specified bucket, identified by the `store_key` provided by SHIELD.
 //
+// On buckets with Object Lock enabled, the retention of each archive is checked
+// before it is deleted.  Archives that are still locked are not deleted (S3 would
+// only hide them behind a delete marker), and the purge fails, saying until when
+// they are locked.  Since Object Lock turns versioning on, a lifecycle rule that
+// expires noncurrent versions is needed for purged archives to actually go away.
+//
+// CLEANUP DETAILS
+//
+// The `cleanup` command lists all the multipart uploads that are still in progress
+// under the `prefix` of the bucket, and aborts those that were started more than
+// `s3_stale_upload_hours` ago, whether they are tracked in the local state file or
+// not (i.e. when they were started from another host). With `--dry-run`, stale
+// uploads are only listed. Make sure `s3_stale_upload_hours` is well above the time
+// it takes to store your largest archive.
+//
+// RECONCILE DETAILS
+//
+// The `reconcile` command lists the objects under the `prefix` of the bucket, with
+// ListObjectsV2 requests, and compares them with the storage handles it is given.
+// Every object under the prefix counts, so objects that were not stored by SHIELD
+// (i.e. the chunks of chunked Cassandra backups) are reported as orphans too; give
+// each kind of data its own prefix to tell them apart.
+//
 // DEPENDENCIES
 //
-// None.
+// The `zstd` command, to store or retrieve archives with zstd compression.
+// The `s3_compressor_bin` command (i.e. `pigz`), if any, to store archives.
 //
 package main
 
 import (
-	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
-	"strings"
 	"time"
 
 	minio "github.com/minio/minio-go"
@@ -107,25 +344,338 @@ func main() {
 		},
 		Example: `
 {
-  "access_key_id"       : "your-access-key-id",       # REQUIRED
-  "secret_access_key"   : "your-secret-access-key",   # REQUIRED
+  "access_key_id"       : "your-access-key-id",       # REQUIRED, unless s3_profile is set
+  "secret_access_key"   : "your-secret-access-key",   # REQUIRED, unless s3_profile is set
+  "s3_session_token"    : "your-session-token",       # only for temporary keys, which expire
+  "s3_profile"          : "",                         # shared AWS config profile to use instead
   "bucket"              : "name-of-your-bucket",      # REQUIRED
 
   "s3_host"             : "s3.amazonaws.com",    # override Amazon S3 endpoint
   "s3_port"             : ""                     # optional port to access s3_host on
+  "s3_region"           : "eu-west-1",           # region of the bucket (detected if empty)
   "skip_ssl_validation" : false,                 # Skip certificate verification (not recommended)
+  "s3_ca_cert"          : "/path/to/ca.pem",     # CA certificates to trust, for private CAs
   "prefix"              : "/path/in/bucket",     # where to store archives, inside the bucket
   "signature_version"   : "4",                   # AWS signature version; must be '2' or '4'
-  "socks5_proxy"        : ""                     # optional SOCKS5 proxy for accessing S3
+  "socks5_proxy"        : "",                    # optional SOCKS5 proxy for accessing S3
+
+  "s3_auto_restore"     : false,                 # restore archived (Glacier) objects on retrieve
+  "s3_restore_days"     : 1,                     # how long to keep restored objects around
+  "s3_restore_tier"     : "Standard",            # Expedited, Standard or Bulk
+  "s3_restore_timeout_hours" : 48,               # how long to wait for a restore to complete
+
+  "s3_upload_state"     : "/var/tmp/shield-s3-uploads.json",  # where to track in-progress uploads
+  "s3_stale_upload_hours" : 24,                  # abort uploads abandoned for longer than that
+
+  "s3_compression"      : "none",                # compress archives: none, gzip or zstd
+  "s3_compression_min_ratio" : 1.1,              # unless a sample shrinks less than 10%
+  "s3_compressor_bin"   : "pigz",                # compress on several cores, with that command
+  "s3_compressor_threads" : 4,                   # how many (0 for all of them)
+
+  "s3_object_lock_mode" : "GOVERNANCE",          # lock new archives: GOVERNANCE or COMPLIANCE
+  "s3_object_lock_days" : 30,                    # how many days new archives stay locked
+
+  "s3_acl"              : "bucket-owner-full-control", # for the owner of the bucket to control archives
+
+  "s3_connect_timeout"  : 30,                    # seconds to connect to S3 (or the proxy)
+  "s3_request_timeout"  : 300,                   # seconds S3 may stay silent (0 = forever)
+
+  "s3_requester_pays"   : false,                 # pay for requests to requester-pays buckets
+  "s3_use_dualstack"    : false,                 # reach S3 over IPv6 (or IPv4)
+
+  "s3_validate_retries" : 2,                     # retries of the bucket check on network errors
+  "s3_download_concurrency" : 4,                 # ranged GETs at once, to retrieve multipart archives
+  "s3_verify_readback"  : true,                  # check that new archives exist, whole, once stored
+  "s3_multipart_threshold" : 16                  # MiB above which archives are uploaded in parts
 }
 `,
 		Defaults: `
 {
   "s3_host"             : "s3.amazonawd.com",
   "signature_version"   : "4",
-  "skip_ssl_validation" : false
+  "skip_ssl_validation" : false,
+  "s3_auto_restore"     : false,
+  "s3_restore_days"     : 1,
+  "s3_restore_tier"     : "Standard",
+  "s3_restore_timeout_hours" : 48,
+  "s3_stale_upload_hours" : 24,
+  "s3_compression"      : "none",
+  "s3_compression_min_ratio" : 0,
+  "s3_compressor_bin"   : "",
+  "s3_compressor_threads" : 0,
+  "s3_object_lock_mode" : "",
+  "s3_object_lock_days" : 0,
+  "s3_acl"              : "",
+  "s3_connect_timeout"  : 30,
+  "s3_request_timeout"  : 0,
+  "s3_requester_pays"   : false,
+  "s3_use_dualstack"    : false,
+  "s3_validate_retries" : 2,
+  "s3_download_concurrency" : 4,
+  "s3_verify_readback"  : false,
+  "s3_multipart_threshold" : 16,
+  "s3_profile"          : ""
 }
 `,
+		Fields: []plugin.Field{
+			{
+				Name:        "s3_host",
+				Label:       "S3 Host",
+				Type:        plugin.TextField,
+				Placeholder: DefaultS3Host,
+				Default:     DefaultS3Host,
+				Help:        "If you use something other than Amazon S3 itself, you will need to provide the name/address of the storage solution.",
+				Examples:    []string{"192.168.99.43", "storage.example.com"},
+			},
+			{
+				Name:        "s3_port",
+				Label:       "S3 Port",
+				Type:        plugin.TextField,
+				Placeholder: "(auto-detect)",
+				Format:      `^\d+$`,
+				Invalid:     "The S3 port must be numeric",
+				Help:        "If your non-AWS solution runs on a non-standard port (i.e. not 80/443), you will need to provide it.",
+				Examples:    []string{"9920", "4443", "8080"},
+			},
+			{
+				Name:        "s3_region",
+				Label:       "S3 Region",
+				Type:        plugin.TextField,
+				Placeholder: "(auto-detect)",
+				Help:        "The AWS region the bucket lives in. If left empty (or if it is wrong) it will be detected automatically.",
+				Examples:    []string{"us-east-1", "eu-west-1"},
+			},
+			{
+				Name:  "access_key_id",
+				Label: "Access Key ID",
+				Type:  plugin.TextField,
+				Help:  "Your Access Key ID, used to authenticate to S3. Required, unless an AWS profile is set.",
+			},
+			{
+				Name:  "secret_access_key",
+				Label: "Secret Access Key",
+				Type:  plugin.PasswordField,
+				Help:  "The Secret Access Key that goes with your Access Key ID. Required, unless an AWS profile is set.",
+			},
+			{
+				Name:  "s3_session_token",
+				Label: "Session Token",
+				Type:  plugin.PasswordField,
+				Help:  "The session token that goes with temporary keys (i.e. from STS, SSO or federated logins). Temporary keys expire, after which backups fail until they are replaced.",
+			},
+			{
+				Name:     "s3_profile",
+				Label:    "AWS Profile",
+				Type:     plugin.TextField,
+				Help:     "A profile of the shared AWS config files (~/.aws/credentials and ~/.aws/config) of the SHIELD agent, to take the keys and the region from, when the Access Key ID is left empty.",
+				Examples: []string{"default", "backups"},
+			},
+			{
+				Name:     "bucket",
+				Label:    "Bucket Name",
+				Type:     plugin.TextField,
+				Required: true,
+				Help:     "Name of the bucket to store backup archives in.",
+			},
+			{
+				Name:        "prefix",
+				Label:       "Bucket Path Prefix",
+				Type:        plugin.TextField,
+				Placeholder: "(root of the bucket)",
+				Help:        "An optional sub-path of the bucket to use for storing archives.",
+				Examples:    []string{"/backups", "shield/production"},
+			},
+			{
+				Name:     "signature_version",
+				Label:    "Signature Version",
+				Type:     plugin.TextField,
+				Default:  DefaultSigVersion,
+				Format:   `^[24]$`,
+				Invalid:  "The AWS signature version must be either '2' or '4'",
+				Help:     "Which version of the AWS request signing algorithm to use.",
+				Examples: []string{"2", "4"},
+			},
+			{
+				Name:        "socks5_proxy",
+				Label:       "SOCKS5 Proxy",
+				Type:        plugin.TextField,
+				Placeholder: "(no proxy)",
+				Help:        "The host:port of a SOCKS5 proxy to use for all S3 communications.",
+				Examples:    []string{"proxy.example.com:1080"},
+			},
+			{
+				Name:    "skip_ssl_validation",
+				Label:   "Skip SSL Validation",
+				Type:    plugin.BooleanField,
+				Default: DefaultSkipSSLValidation,
+				Help:    "Whether or not to skip verification of the S3 server's certificate (not recommended; prefer a CA certificate).",
+			},
+			{
+				Name:     "s3_ca_cert",
+				Label:    "CA Certificate",
+				Type:     plugin.TextField,
+				Help:     "Path to a PEM bundle of CA certificates to trust, for S3-compatible services with certificates signed by a private CA.",
+				Examples: []string{"/var/vcap/jobs/shield-agent/config/s3-ca.pem"},
+			},
+			{
+				Name:    "s3_auto_restore",
+				Label:   "Restore Archived Objects",
+				Type:    plugin.BooleanField,
+				Default: DefaultAutoRestore,
+				Help:    "Whether or not to restore archived (Glacier) objects before retrieving them. This can take hours.",
+			},
+			{
+				Name:    "s3_restore_days",
+				Label:   "Restored Object Lifetime",
+				Type:    plugin.NumberField,
+				Default: DefaultRestoreDays,
+				Help:    "How many days restored copies of archived objects stay available.",
+			},
+			{
+				Name:     "s3_restore_tier",
+				Label:    "Restore Tier",
+				Type:     plugin.TextField,
+				Default:  DefaultRestoreTier,
+				Format:   `^(Expedited|Standard|Bulk)$`,
+				Invalid:  "The restore tier must be one of 'Expedited', 'Standard' or 'Bulk'",
+				Help:     "The Glacier retrieval tier to use when restoring archived objects.",
+				Examples: []string{"Expedited", "Standard", "Bulk"},
+			},
+			{
+				Name:    "s3_restore_timeout_hours",
+				Label:   "Restore Timeout",
+				Type:    plugin.NumberField,
+				Default: DefaultRestoreTimeoutHours,
+				Help:    "How many hours to wait for the restore of an archived object to complete, before giving up on the retrieve.",
+			},
+			{
+				Name:        "s3_upload_state",
+				Label:       "Upload State File",
+				Type:        plugin.TextField,
+				Placeholder: DefaultUploadState,
+				Help:        "Local file where in-progress multipart uploads are tracked, so that interrupted uploads can be resumed.",
+			},
+			{
+				Name:    "s3_stale_upload_hours",
+				Label:   "Stale Upload Age",
+				Type:    plugin.NumberField,
+				Default: DefaultStaleUploadHours,
+				Help:    "How many hours an interrupted upload may wait to be resumed, before it gets aborted.",
+			},
+			{
+				Name:     "s3_compression",
+				Label:    "Compression",
+				Type:     plugin.TextField,
+				Default:  DefaultCompression,
+				Format:   `^(none|gzip|zstd)$`,
+				Invalid:  "The compression must be one of 'none', 'gzip' or 'zstd'",
+				Help:     "How to compress archives before storing them, for targets that do not compress their backups. Archives are always decompressed according to how they were stored.",
+				Examples: []string{"none", "gzip", "zstd"},
+			},
+			{
+				Name:    "s3_compression_min_ratio",
+				Label:   "Minimum Compression Ratio",
+				Type:    plugin.NumberField,
+				Default: DefaultCompressionMinRatio,
+				Help:    "Store archives uncompressed when a 4 MiB sample does not shrink by that ratio (i.e. 1.1 for 10%), like already compressed data. 0 always compresses.",
+			},
+			{
+				Name:     "s3_compressor_bin",
+				Label:    "Parallel Compressor",
+				Type:     plugin.TextField,
+				Default:  DefaultCompressorBin,
+				Help:     "A command that compresses archives on several cores, in the format of the compression (i.e. pigz for gzip). Archives are compressed the usual way if it can't be found.",
+				Examples: []string{"pigz", "pzstd", "/usr/local/bin/pigz"},
+			},
+			{
+				Name:    "s3_compressor_threads",
+				Label:   "Compressor Threads",
+				Type:    plugin.NumberField,
+				Default: DefaultCompressorThreads,
+				Help:    "How many threads the parallel compressor runs. 0 runs one per core.",
+			},
+			{
+				Name:     "s3_object_lock_mode",
+				Label:    "Object Lock Mode",
+				Type:     plugin.TextField,
+				Format:   `^(GOVERNANCE|COMPLIANCE)?$`,
+				Invalid:  "The Object Lock mode must be either 'GOVERNANCE' or 'COMPLIANCE'",
+				Help:     "Store archives with an S3 Object Lock retention in that mode, so that they cannot be deleted until it expires. The bucket must have Object Lock enabled. In COMPLIANCE mode, not even administrators can delete locked archives.",
+				Examples: []string{"GOVERNANCE", "COMPLIANCE"},
+			},
+			{
+				Name:    "s3_object_lock_days",
+				Label:   "Object Lock Days",
+				Type:    plugin.NumberField,
+				Default: DefaultObjectLockDays,
+				Help:    "How many days archives stay locked after they are stored. Archives cannot be purged before then.",
+			},
+			{
+				Name:     "s3_acl",
+				Label:    "Canned ACL",
+				Type:     plugin.TextField,
+				Format:   `^(private|public-read|public-read-write|authenticated-read|aws-exec-read|bucket-owner-read|bucket-owner-full-control)?$`,
+				Invalid:  "The ACL must be one of the canned ACLs of S3, i.e. 'bucket-owner-full-control'",
+				Help:     "Store archives with that canned ACL. Buckets of other AWS accounts need 'bucket-owner-full-control', for their owner to control the archives.",
+				Examples: []string{"bucket-owner-full-control", "private"},
+			},
+			{
+				Name:    "s3_connect_timeout",
+				Label:   "Connect Timeout (seconds)",
+				Type:    plugin.NumberField,
+				Default: DefaultConnectTimeout,
+				Help:    "How long to wait for connections to S3 (or to the SOCKS5 proxy) to be established.",
+			},
+			{
+				Name:    "s3_request_timeout",
+				Label:   "Request Timeout (seconds)",
+				Type:    plugin.NumberField,
+				Default: DefaultRequestTimeout,
+				Help:    "How long S3 may take to start responding, or stay silent halfway through a transfer, before the request fails. 0 means no timeout.",
+			},
+			{
+				Name:    "s3_requester_pays",
+				Label:   "Requester Pays",
+				Type:    plugin.BooleanField,
+				Default: DefaultRequesterPays,
+				Help:    "Whether the bucket is a requester-pays bucket; the charges for storing, retrieving and purging archives then go to the owner of the access key.",
+			},
+			{
+				Name:    "s3_use_dualstack",
+				Label:   "Use Dual-Stack Endpoints",
+				Type:    plugin.BooleanField,
+				Default: DefaultUseDualstack,
+				Help:    "Whether to reach Amazon S3 through its dual-stack endpoints, which support IPv6. Not available for other S3-compatible services.",
+			},
+			{
+				Name:    "s3_validate_retries",
+				Label:   "Validation Retries",
+				Type:    plugin.NumberField,
+				Default: DefaultValidateRetries,
+				Help:    "How many times to check the bucket again, when validating the endpoint, after network errors. Denied access or missing buckets are not retried.",
+			},
+			{
+				Name:    "s3_download_concurrency",
+				Label:   "Download Concurrency",
+				Type:    plugin.NumberField,
+				Default: DefaultDownloadConcurrency,
+				Help:    "How many ranges of an archive uploaded in parts to download at once, when restoring it. Each one holds 16MiB of memory. Set it to 1 to download archives with a single request.",
+			},
+			{
+				Name:    "s3_verify_readback",
+				Label:   "Verify Read-Back",
+				Type:    plugin.BooleanField,
+				Default: DefaultVerifyReadback,
+				Help:    "Whether to check that each archive exists in the bucket, with the size it was uploaded with, before reporting it stored. Costs one more request per backup.",
+			},
+			{
+				Name:    "s3_multipart_threshold",
+				Label:   "Multipart Threshold (MiB)",
+				Type:    plugin.NumberField,
+				Default: DefaultMultipartThreshold,
+				Help:    "How large (in MiB) an archive may be, and still be stored with a single request; larger ones are uploaded in parts. As much of each archive is held in memory. At most 5120 (5GiB).",
+			},
+		},
 	}
 
 	plugin.Run(p)
@@ -134,15 +684,42 @@ func main() {
 type S3Plugin plugin.PluginInfo
 
 type S3ConnectionInfo struct {
-	Host              string
-	SkipSSLValidation bool
-	AccessKey         string
-	SecretKey         string
-	Bucket            string
-	PathPrefix        string
-	SignatureVersion  string
-	SOCKS5Proxy       string
-	Port              string
+	Host                string
+	SkipSSLValidation   bool
+	CACert              string
+	AccessKey           string
+	SecretKey           string
+	SessionToken        string
+	Bucket              string
+	PathPrefix          string
+	SignatureVersion    string
+	SOCKS5Proxy         string
+	Port                string
+	Region              string
+	AutoRestore         bool
+	RestoreDays         int
+	RestoreTier         string
+	RestoreTimeoutHours int
+	UploadState         string
+	StaleUploadHours    int
+	Compression         string
+	CompressMinRatio    float64
+	CompressorBin       string
+	CompressorThreads   int
+	ObjectLockMode      string
+	ObjectLockDays      int
+	ACL                 string
+	ConnectTimeout      int
+	RequestTimeout      int
+	RequesterPays       bool
+	UseDualstack        bool
+	ValidateRetries     int
+	DownloadConcurrency int
+	VerifyReadback      bool
+	MultipartThreshold  int
+
+	sampleRatio float64
+	target      string
 }
 
 func (p S3Plugin) Meta() plugin.PluginInfo {
@@ -164,10 +741,12 @@ func (p S3Plugin) Validate(endpoint plugin.ShieldEndpoint) error {
 		ansi.Printf("@G{\u2713 s3_host}              @C{%s}\n", s)
 	}
 
-	s, err = endpoint.StringValue("access_key_id")
+	s, err = endpoint.StringValueDefault("access_key_id", "")
 	if err != nil {
 		ansi.Printf("@R{\u2717 access_key_id        %s}\n", err)
 		fail = true
+	} else if s == "" {
+		ansi.Printf("@G{\u2713 access_key_id}        (from s3_profile)\n")
 	} else {
 		ansi.Printf("@G{\u2713 access_key_id}        @C{%s}\n", s)
 	}
@@ -185,14 +764,52 @@ func (p S3Plugin) Validate(endpoint plugin.ShieldEndpoint) error {
 		}
 	}
 
-	s, err = endpoint.StringValue("secret_access_key")
+	s, err = endpoint.StringValueDefault("s3_region", "")
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_region      %s}\n", err)
+		fail = true
+	} else if s == "" {
+		ansi.Printf("@G{\u2713 s3_region}      will be detected automatically\n")
+	} else {
+		ansi.Printf("@G{\u2713 s3_region}      @C{%s}\n", s)
+	}
+
+	s, err = endpoint.StringValueDefault("secret_access_key", "")
 	if err != nil {
 		ansi.Printf("@R{\u2717 secret_access_key    %s}\n", err)
 		fail = true
+	} else if s == "" {
+		ansi.Printf("@G{\u2713 secret_access_key}    (from s3_profile)\n")
 	} else {
 		ansi.Printf("@G{\u2713 secret_access_key}    @C{%s}\n", s)
 	}
 
+	s, err = endpoint.StringValueDefault("s3_session_token", "")
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_session_token     %s}\n", err)
+		fail = true
+	} else if s == "" {
+		ansi.Printf("@G{\u2713 s3_session_token}     (none)\n")
+	} else {
+		ansi.Printf("@G{\u2713 s3_session_token}     @C{set}\n")
+		ansi.Printf("@Y{  the keys are temporary: once they expire, backups fail until they are replaced}\n")
+	}
+
+	s, err = endpoint.StringValueDefault("s3_profile", DefaultProfile)
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_profile           %s}\n", err)
+		fail = true
+	} else if creds, err := endpointCredentials(endpoint); err != nil {
+		ansi.Printf("@R{\u2717 s3_profile           %s}\n", err)
+		fail = true
+	} else if s == "" {
+		ansi.Printf("@G{\u2713 s3_profile}           (none)\n")
+	} else if creds.Name == "" {
+		ansi.Printf("@G{\u2713 s3_profile}           @C{%s}, overridden by the inline keys\n", s)
+	} else {
+		ansi.Printf("@G{\u2713 s3_profile}           @C{%s}, with access key @C{%s}\n", s, creds.AccessKey)
+	}
+
 	s, err = endpoint.StringValue("bucket")
 	if err != nil {
 		ansi.Printf("@R{\u2717 bucket               %s}\n", err)
@@ -205,10 +822,9 @@ func (p S3Plugin) Validate(endpoint plugin.ShieldEndpoint) error {
 	if err != nil {
 		ansi.Printf("@R{\u2717 prefix               %s}\n", err)
 		fail = true
-	} else if s == "" {
+	} else if s = normalizePrefix(s); s == "" {
 		ansi.Printf("@G{\u2713 prefix}               (none)\n")
 	} else {
-		s = strings.TrimLeft(s, "/")
 		ansi.Printf("@G{\u2713 prefix}               @C{%s}\n", s)
 	}
 
@@ -243,8 +859,300 @@ func (p S3Plugin) Validate(endpoint plugin.ShieldEndpoint) error {
 		ansi.Printf("@G{\u2713 skip_ssl_validation}  @C{no}, SSL @Y{WILL} be validated\n")
 	}
 
+	s, err = endpoint.StringValueDefault("s3_ca_cert", "")
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_ca_cert           %s}\n", err)
+		fail = true
+	} else if s == "" {
+		ansi.Printf("@G{\u2713 s3_ca_cert}           (system CAs only)\n")
+	} else if _, err = loadCACert(s); err != nil {
+		ansi.Printf("@R{\u2717 s3_ca_cert           %s}\n", err)
+		fail = true
+	} else if tf {
+		ansi.Printf("@G{\u2713 s3_ca_cert}           @C{%s}, SSL @Y{WILL} be validated (despite skip_ssl_validation)\n", s)
+	} else {
+		ansi.Printf("@G{\u2713 s3_ca_cert}           @C{%s}\n", s)
+	}
+
+	tf, err = endpoint.BooleanValueDefault("s3_auto_restore", DefaultAutoRestore)
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_auto_restore      %s}\n", err)
+		fail = true
+	} else if tf {
+		ansi.Printf("@G{\u2713 s3_auto_restore}      @C{yes}, archived objects will be restored before retrieval\n")
+	} else {
+		ansi.Printf("@G{\u2713 s3_auto_restore}      @C{no}, archived objects will @Y{NOT} be retrievable\n")
+	}
+
+	f, err := endpoint.FloatValueDefault("s3_restore_days", DefaultRestoreDays)
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_restore_days      %s}\n", err)
+		fail = true
+	} else if f < 1 || f != float64(int(f)) {
+		ansi.Printf("@R{\u2717 s3_restore_days      must be a whole number of days, at least 1}\n")
+		fail = true
+	} else {
+		ansi.Printf("@G{\u2713 s3_restore_days}      @C{%d}\n", int(f))
+	}
+
+	s, err = endpoint.StringValueDefault("s3_restore_tier", DefaultRestoreTier)
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_restore_tier      %s}\n", err)
+		fail = true
+	} else if !validRestoreTier(s) {
+		ansi.Printf("@R{\u2717 s3_restore_tier      Unexpected restore tier '%s' found (expecting 'Expedited', 'Standard' or 'Bulk')}\n", s)
+		fail = true
+	} else {
+		ansi.Printf("@G{\u2713 s3_restore_tier}      @C{%s}\n", s)
+	}
+
+	f, err = endpoint.FloatValueDefault("s3_restore_timeout_hours", DefaultRestoreTimeoutHours)
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_restore_timeout_hours  %s}\n", err)
+		fail = true
+	} else if f < 1 || f != float64(int(f)) {
+		ansi.Printf("@R{\u2717 s3_restore_timeout_hours  must be a whole number of hours, at least 1}\n")
+		fail = true
+	} else {
+		ansi.Printf("@G{\u2713 s3_restore_timeout_hours}  @C{%d}\n", int(f))
+	}
+
+	s, err = endpoint.StringValueDefault("s3_upload_state", DefaultUploadState)
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_upload_state      %s}\n", err)
+		fail = true
+	} else {
+		ansi.Printf("@G{\u2713 s3_upload_state}      @C{%s}\n", s)
+	}
+
+	f, err = endpoint.FloatValueDefault("s3_stale_upload_hours", DefaultStaleUploadHours)
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_stale_upload_hours  %s}\n", err)
+		fail = true
+	} else if f < 1 || f != float64(int(f)) {
+		ansi.Printf("@R{\u2717 s3_stale_upload_hours  must be a whole number of hours, at least 1}\n")
+		fail = true
+	} else {
+		ansi.Printf("@G{\u2713 s3_stale_upload_hours}  @C{%d}\n", int(f))
+	}
+
+	s, err = endpoint.StringValueDefault("s3_compression", DefaultCompression)
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_compression       %s}\n", err)
+		fail = true
+	} else if !validCompression(s) {
+		ansi.Printf("@R{\u2717 s3_compression       Unexpected compression '%s' found (expecting 'none', 'gzip' or 'zstd')}\n", s)
+		fail = true
+	} else if s == "zstd" {
+		if err = plugin.RequireBinaries(ZstdCommand); err != nil {
+			ansi.Printf("@R{\u2717 s3_compression       %s}\n", err)
+			fail = true
+		} else {
+			ansi.Printf("@G{\u2713 s3_compression}       @C{%s}\n", s)
+		}
+	} else {
+		ansi.Printf("@G{\u2713 s3_compression}       @C{%s}\n", s)
+	}
+
+	f, err = endpoint.FloatValueDefault("s3_compression_min_ratio", DefaultCompressionMinRatio)
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_compression_min_ratio  %s}\n", err)
+		fail = true
+	} else if f < 0 {
+		ansi.Printf("@R{\u2717 s3_compression_min_ratio  must not be negative}\n")
+		fail = true
+	} else if f == 0 {
+		ansi.Printf("@G{\u2713 s3_compression_min_ratio}  @C{none}, archives are always compressed\n")
+	} else if s == "none" {
+		ansi.Printf("@G{\u2713 s3_compression_min_ratio}  @C{%v}, @Y{unused without s3_compression}\n", f)
+	} else {
+		ansi.Printf("@G{\u2713 s3_compression_min_ratio}  @C{%v}\n", f)
+	}
+
+	compression := s
+	s, err = endpoint.StringValueDefault("s3_compressor_bin", DefaultCompressorBin)
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_compressor_bin    %s}\n", err)
+		fail = true
+	} else if s == "" {
+		ansi.Printf("@G{\u2713 s3_compressor_bin}    @C{none}, archives are compressed on a single core\n")
+	} else if compression == "none" {
+		ansi.Printf("@G{\u2713 s3_compressor_bin}    @C{%s}, @Y{unused without s3_compression}\n", s)
+	} else if err = plugin.RequireBinaries(s); err != nil {
+		ansi.Printf("@G{\u2713 s3_compressor_bin}    @C{%s}, @Y{%s; archives will be compressed on a single core}\n", s, err)
+	} else {
+		ansi.Printf("@G{\u2713 s3_compressor_bin}    @C{%s}\n", s)
+	}
+
+	f, err = endpoint.FloatValueDefault("s3_compressor_threads", DefaultCompressorThreads)
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_compressor_threads  %s}\n", err)
+		fail = true
+	} else if f < 0 || f != float64(int(f)) {
+		ansi.Printf("@R{\u2717 s3_compressor_threads  must be a whole number of threads, or 0}\n")
+		fail = true
+	} else if f == 0 {
+		ansi.Printf("@G{\u2713 s3_compressor_threads}  @C{one per core}\n")
+	} else {
+		ansi.Printf("@G{\u2713 s3_compressor_threads}  @C{%d}\n", int(f))
+	}
+
+	s, err = endpoint.StringValueDefault("s3_object_lock_mode", DefaultObjectLockMode)
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_object_lock_mode  %s}\n", err)
+		fail = true
+	} else if !validObjectLockMode(s) {
+		ansi.Printf("@R{\u2717 s3_object_lock_mode  Unexpected Object Lock mode '%s' found (expecting 'GOVERNANCE' or 'COMPLIANCE')}\n", s)
+		fail = true
+	} else if s == "" {
+		ansi.Printf("@G{\u2713 s3_object_lock_mode}  (archives will not be locked)\n")
+	} else if s == "COMPLIANCE" {
+		ansi.Printf("@G{\u2713 s3_object_lock_mode}  @C{%s}, locked archives can @Y{NOT} be deleted by anyone\n", s)
+	} else {
+		ansi.Printf("@G{\u2713 s3_object_lock_mode}  @C{%s}\n", s)
+	}
+
+	f, err = endpoint.FloatValueDefault("s3_object_lock_days", DefaultObjectLockDays)
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_object_lock_days  %s}\n", err)
+		fail = true
+	} else if f < 0 || f != float64(int(f)) {
+		ansi.Printf("@R{\u2717 s3_object_lock_days  must be a whole number of days}\n")
+		fail = true
+	} else if s != "" && f < 1 {
+		ansi.Printf("@R{\u2717 s3_object_lock_days  must be at least 1 when s3_object_lock_mode is set}\n")
+		fail = true
+	} else if s == "" && f > 0 {
+		ansi.Printf("@R{\u2717 s3_object_lock_days  requires s3_object_lock_mode to be set}\n")
+		fail = true
+	} else {
+		ansi.Printf("@G{\u2713 s3_object_lock_days}  @C{%d}\n", int(f))
+	}
+
+	s, err = endpoint.StringValueDefault("s3_acl", DefaultACL)
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_acl               %s}\n", err)
+		fail = true
+	} else if !validACL(s) {
+		ansi.Printf("@R{\u2717 s3_acl               Unexpected canned ACL '%s' found (expecting one of %s)}\n", s, cannedACLs())
+		fail = true
+	} else if s == "" {
+		ansi.Printf("@G{\u2713 s3_acl}               (the default ACL of the bucket)\n")
+	} else {
+		ansi.Printf("@G{\u2713 s3_acl}               @C{%s}\n", s)
+	}
+
+	f, err = endpoint.FloatValueDefault("s3_connect_timeout", DefaultConnectTimeout)
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_connect_timeout   %s}\n", err)
+		fail = true
+	} else if f < 1 || f != float64(int(f)) {
+		ansi.Printf("@R{\u2717 s3_connect_timeout   must be a whole number of seconds, at least 1}\n")
+		fail = true
+	} else {
+		ansi.Printf("@G{\u2713 s3_connect_timeout}   @C{%ds}\n", int(f))
+	}
+
+	f, err = endpoint.FloatValueDefault("s3_request_timeout", DefaultRequestTimeout)
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_request_timeout   %s}\n", err)
+		fail = true
+	} else if f < 0 || f != float64(int(f)) {
+		ansi.Printf("@R{\u2717 s3_request_timeout   must be a whole number of seconds}\n")
+		fail = true
+	} else if f == 0 {
+		ansi.Printf("@G{\u2713 s3_request_timeout}   @C{none}, requests will @Y{NOT} time out\n")
+	} else {
+		ansi.Printf("@G{\u2713 s3_request_timeout}   @C{%ds}\n", int(f))
+	}
+
+	tf, err = endpoint.BooleanValueDefault("s3_requester_pays", DefaultRequesterPays)
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_requester_pays    %s}\n", err)
+		fail = true
+	} else if tf {
+		ansi.Printf("@G{\u2713 s3_requester_pays}    @C{yes}, requests will be charged to the owner of the access key\n")
+	} else {
+		ansi.Printf("@G{\u2713 s3_requester_pays}    @C{no}\n")
+	}
+
+	tf, err = endpoint.BooleanValueDefault("s3_use_dualstack", DefaultUseDualstack)
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_use_dualstack     %s}\n", err)
+		fail = true
+	} else if !tf {
+		ansi.Printf("@G{\u2713 s3_use_dualstack}     @C{no}\n")
+	} else if host, _ := endpoint.StringValueDefault("s3_host", DefaultS3Host); host != DefaultS3Host {
+		ansi.Printf("@R{\u2717 s3_use_dualstack     dual-stack endpoints only exist on Amazon S3, not on %s}\n", host)
+		fail = true
+	} else if port, _ := endpoint.StringValueDefault("s3_port", ""); port != "" {
+		ansi.Printf("@R{\u2717 s3_use_dualstack     can't be combined with s3_port}\n")
+		fail = true
+	} else {
+		ansi.Printf("@G{\u2713 s3_use_dualstack}     @C{yes}, S3 will be reached over IPv6 or IPv4\n")
+	}
+
+	f, err = endpoint.FloatValueDefault("s3_validate_retries", DefaultValidateRetries)
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_validate_retries  %s}\n", err)
+		fail = true
+	} else if f < 0 || f != float64(int(f)) {
+		ansi.Printf("@R{\u2717 s3_validate_retries  must be a whole number of retries}\n")
+		fail = true
+	} else {
+		ansi.Printf("@G{\u2713 s3_validate_retries}  @C{%d}\n", int(f))
+	}
+
+	f, err = endpoint.FloatValueDefault("s3_download_concurrency", DefaultDownloadConcurrency)
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_download_concurrency  %s}\n", err)
+		fail = true
+	} else if f < 1 || f != float64(int(f)) {
+		ansi.Printf("@R{\u2717 s3_download_concurrency  must be a whole number of downloads, at least 1}\n")
+		fail = true
+	} else if f == 1 {
+		ansi.Printf("@G{\u2713 s3_download_concurrency}  @C{1}, archives will be retrieved with a single request\n")
+	} else {
+		ansi.Printf("@G{\u2713 s3_download_concurrency}  @C{%d} ranged requests at once, for archives uploaded in parts\n", int(f))
+	}
+
+	tf, err = endpoint.BooleanValueDefault("s3_verify_readback", DefaultVerifyReadback)
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_verify_readback   %s}\n", err)
+		fail = true
+	} else if tf {
+		ansi.Printf("@G{\u2713 s3_verify_readback}   @C{yes}, archives will be read back once stored\n")
+	} else {
+		ansi.Printf("@G{\u2713 s3_verify_readback}   @C{no}\n")
+	}
+
+	f, err = endpoint.FloatValueDefault("s3_multipart_threshold", DefaultMultipartThreshold)
+	if err != nil {
+		ansi.Printf("@R{\u2717 s3_multipart_threshold  %s}\n", err)
+		fail = true
+	} else if f < 1 || f > MaxMultipartThreshold || f != float64(int(f)) {
+		ansi.Printf("@R{\u2717 s3_multipart_threshold  must be a whole number of MiB, from 1 to %d}\n", MaxMultipartThreshold)
+		fail = true
+	} else {
+		ansi.Printf("@G{\u2713 s3_multipart_threshold}  archives larger than @C{%dMiB} will be uploaded in parts\n", int(f))
+	}
+
 	if fail {
-		return fmt.Errorf("s3: invalid configuration")
+		return plugin.ValidationError{Plugin: "s3"}
+	}
+
+	/* only reach out to S3 once the configuration checks out */
+	attempts, err := reachBucket(endpoint)
+	if err != nil {
+		ansi.Printf("@R{\u2717 bucket reachable     %s}\n", err)
+		if token, _ := endpoint.StringValueDefault("s3_session_token", ""); token != "" {
+			ansi.Printf("@Y{  the temporary keys may have expired: try again with fresh keys and session token}\n")
+		}
+		return plugin.ValidationError{Plugin: "s3"}
+	} else if attempts > 1 {
+		ansi.Printf("@G{\u2713 bucket reachable}     after %d attempts\n", attempts)
+	} else {
+		ansi.Printf("@G{\u2713 bucket reachable}\n")
 	}
 	return nil
 }
@@ -262,20 +1170,37 @@ func (p S3Plugin) Store(endpoint plugin.ShieldEndpoint) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	client, err := s3.Connect()
+	/* decide on compression first, for the API to record it */
+	stdin, err := s3.sample(os.Stdin)
 	if err != nil {
 		return "", err
 	}
+	api, err := s3.API()
+	if err != nil {
+		return "", err
+	}
+
+	if err = api.checkObjectLock(); err != nil {
+		return "", err
+	}
 
-	path := s3.genBackupPath()
-	plugin.DEBUG("Storing data in %s", path)
+	in, err := s3.compressArchive(stdin)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
 
-	// FIXME: should we do something with the size of the write performed?
-	// Removing leading slash until https://github.com/minio/minio/issues/3256 is fixed
-	_, err = client.PutObject(s3.Bucket, strings.TrimPrefix(path, "/"), os.Stdin, "application/x-gzip")
+	uploaded := &countingReader{r: in}
+	path, err := s3.upload(api, uploaded)
 	if err != nil {
 		return "", err
 	}
+	plugin.DEBUG("Stored data in %s", path)
+	if s3.VerifyReadback {
+		if err = verifyReadback(api, path, uploaded.n); err != nil {
+			return "", err
+		}
+	}
 
 	return path, nil
 }
@@ -285,16 +1210,40 @@ func (p S3Plugin) Retrieve(endpoint plugin.ShieldEndpoint, file string) error {
 	if err != nil {
 		return err
 	}
-	client, err := s3.Connect()
+	api, err := s3.API()
 	if err != nil {
 		return err
 	}
+	file = objectKey(file)
+	if s3.AutoRestore {
+		if err = api.EnsureRestored(file, s3.RestoreDays, s3.RestoreTier, time.Duration(s3.RestoreTimeoutHours)*time.Hour); err != nil {
+			return err
+		}
+	}
+	headers, err := api.Head(file)
+	if err != nil {
+		return err
+	}
+	compression := headers.Get(CompressionHeader)
+	plugin.DEBUG("%s was stored with compression '%s'", file, compression)
+	if ratio := headers.Get(CompressionRatioHeader); ratio != "" {
+		plugin.DEBUG("%s was sampled before it was stored, and shrank %s times", file, ratio)
+	}
 
-	reader, err := client.GetObject(s3.Bucket, file)
+	reader, err := api.ObjectReader(file, headers, s3.DownloadConcurrency)
 	if err != nil {
+		if minio.ToErrorResponse(err).Code == "InvalidObjectState" {
+			return fmt.Errorf("%s: object has been archived, and must be restored first (see `s3_auto_restore`)", file)
+		}
 		return err
 	}
-	if _, err = io.Copy(os.Stdout, reader); err != nil {
+	reader = verifyChecksum(file, headers, reader)
+	if err = decompress(compression, reader, os.Stdout); err == nil {
+		/* decompressors may stop short of the end, where the checksum is checked */
+		_, err = io.Copy(ioutil.Discard, reader)
+	}
+	if err != nil {
+		reader.Close()
 		return err
 	}
 
@@ -311,16 +1260,48 @@ func (p S3Plugin) Purge(endpoint plugin.ShieldEndpoint, file string) error {
 	if err != nil {
 		return err
 	}
-	client, err := s3.Connect()
+	api, err := s3.API()
+	if err != nil {
+		return err
+	}
+	file = objectKey(file)
+	_, locked, err := api.unlocked([]string{file})
 	if err != nil {
 		return err
 	}
+	if len(locked) > 0 {
+		return lockedError(locked)
+	}
+
+	return api.DeleteObject(file)
+}
 
-	err = client.RemoveObject(s3.Bucket, file)
+// PurgeAll removes several archives at once, with (batched) DeleteObjects
+// requests, instead of one DELETE request per archive.
+func (p S3Plugin) PurgeAll(endpoint plugin.ShieldEndpoint, files []string) error {
+	s3, err := getS3ConnInfo(endpoint)
+	if err != nil {
+		return err
+	}
+	api, err := s3.API()
 	if err != nil {
 		return err
 	}
 
+	keys := make([]string, len(files))
+	for i, file := range files {
+		keys[i] = objectKey(file)
+	}
+	files, locked, err := api.unlocked(keys)
+	if err != nil {
+		return err
+	}
+	if err = api.DeleteObjects(files); err != nil {
+		return err
+	}
+	if len(locked) > 0 {
+		return lockedError(locked)
+	}
 	return nil
 }
 
@@ -335,12 +1316,12 @@ func getS3ConnInfo(e plugin.ShieldEndpoint) (S3ConnectionInfo, error) {
 		return S3ConnectionInfo{}, err
 	}
 
-	key, err := e.StringValue("access_key_id")
+	caCert, err := e.StringValueDefault("s3_ca_cert", "")
 	if err != nil {
 		return S3ConnectionInfo{}, err
 	}
 
-	secret, err := e.StringValue("secret_access_key")
+	creds, err := endpointCredentials(e)
 	if err != nil {
 		return S3ConnectionInfo{}, err
 	}
@@ -354,11 +1335,11 @@ func getS3ConnInfo(e plugin.ShieldEndpoint) (S3ConnectionInfo, error) {
 	if err != nil {
 		return S3ConnectionInfo{}, err
 	}
-	prefix = strings.TrimLeft(prefix, "/")
+	prefix = normalizePrefix(prefix)
 
 	sigVer, err := e.StringValueDefault("signature_version", DefaultSigVersion)
 	if !validSigVersion(sigVer) {
-		return S3ConnectionInfo{}, fmt.Errorf("Invalid `signature_version` specified (`%s`). Expected `2` or `4`", sigVer)
+		return S3ConnectionInfo{}, plugin.ConfigError{Key: "signature_version", Err: fmt.Errorf("Invalid `signature_version` specified (`%s`). Expected `2` or `4`", sigVer)}
 	}
 
 	proxy, err := e.StringValueDefault("socks5_proxy", "")
@@ -371,60 +1352,227 @@ func getS3ConnInfo(e plugin.ShieldEndpoint) (S3ConnectionInfo, error) {
 		return S3ConnectionInfo{}, err
 	}
 
-	return S3ConnectionInfo{
-		Host:              host,
-		SkipSSLValidation: insecure_ssl,
-		AccessKey:         key,
-		SecretKey:         secret,
-		Bucket:            bucket,
-		PathPrefix:        prefix,
-		SignatureVersion:  sigVer,
-		SOCKS5Proxy:       proxy,
-		Port:              port,
-	}, nil
-}
+	autoRestore, err := e.BooleanValueDefault("s3_auto_restore", DefaultAutoRestore)
+	if err != nil {
+		return S3ConnectionInfo{}, err
+	}
 
-func (s3 S3ConnectionInfo) genBackupPath() string {
-	t := time.Now()
-	year, mon, day := t.Date()
-	hour, min, sec := t.Clock()
-	uuid := plugin.GenUUID()
-	path := fmt.Sprintf("%s/%04d/%02d/%02d/%04d-%02d-%02d-%02d%02d%02d-%s", s3.PathPrefix, year, mon, day, year, mon, day, hour, min, sec, uuid)
-	// Remove double slashes
-	path = strings.Replace(path, "//", "/", -1)
-	return path
-}
+	restoreDays, err := e.FloatValueDefault("s3_restore_days", DefaultRestoreDays)
+	if err != nil {
+		return S3ConnectionInfo{}, err
+	}
+	if restoreDays < 1 {
+		return S3ConnectionInfo{}, plugin.ConfigError{Key: "s3_restore_days", Err: fmt.Errorf("Invalid `s3_restore_days` specified (`%v`). Expected at least 1 day", restoreDays)}
+	}
 
-func (s3 S3ConnectionInfo) Connect() (*minio.Client, error) {
-	var s3Client *minio.Client
-	var err error
+	region, err := e.StringValueDefault("s3_region", "")
+	if err != nil {
+		return S3ConnectionInfo{}, err
+	}
+	if region == "" {
+		region = creds.Region
+	}
 
-	s3Host := s3.Host
-	if s3.Port != "" {
-		s3Host = s3.Host + ":" + s3.Port
+	restoreTier, err := e.StringValueDefault("s3_restore_tier", DefaultRestoreTier)
+	if err != nil {
+		return S3ConnectionInfo{}, err
+	}
+	if !validRestoreTier(restoreTier) {
+		return S3ConnectionInfo{}, plugin.ConfigError{Key: "s3_restore_tier", Err: fmt.Errorf("Invalid `s3_restore_tier` specified (`%s`). Expected `Expedited`, `Standard` or `Bulk`", restoreTier)}
 	}
 
-	if s3.SignatureVersion == "2" {
-		s3Client, err = minio.NewV2(s3Host, s3.AccessKey, s3.SecretKey, false)
-	} else {
-		s3Client, err = minio.NewV4(s3Host, s3.AccessKey, s3.SecretKey, false)
+	restoreTimeout, err := e.FloatValueDefault("s3_restore_timeout_hours", DefaultRestoreTimeoutHours)
+	if err != nil {
+		return S3ConnectionInfo{}, err
+	}
+	if restoreTimeout < 1 {
+		return S3ConnectionInfo{}, plugin.ConfigError{Key: "s3_restore_timeout_hours", Err: fmt.Errorf("Invalid `s3_restore_timeout_hours` specified (`%v`). Expected at least 1 hour", restoreTimeout)}
 	}
+
+	uploadState, err := e.StringValueDefault("s3_upload_state", DefaultUploadState)
 	if err != nil {
-		return nil, err
+		return S3ConnectionInfo{}, err
+	}
+
+	staleHours, err := e.FloatValueDefault("s3_stale_upload_hours", DefaultStaleUploadHours)
+	if err != nil {
+		return S3ConnectionInfo{}, err
+	}
+	if staleHours < 1 {
+		return S3ConnectionInfo{}, plugin.ConfigError{Key: "s3_stale_upload_hours", Err: fmt.Errorf("Invalid `s3_stale_upload_hours` specified (`%v`). Expected at least 1 hour", staleHours)}
+	}
+
+	compression, err := e.StringValueDefault("s3_compression", DefaultCompression)
+	if err != nil {
+		return S3ConnectionInfo{}, err
+	}
+	if !validCompression(compression) {
+		return S3ConnectionInfo{}, plugin.ConfigError{Key: "s3_compression", Err: fmt.Errorf("Invalid `s3_compression` specified (`%s`). Expected `none`, `gzip` or `zstd`", compression)}
+	}
+
+	minRatio, err := e.FloatValueDefault("s3_compression_min_ratio", DefaultCompressionMinRatio)
+	if err != nil {
+		return S3ConnectionInfo{}, err
+	}
+	if minRatio < 0 {
+		return S3ConnectionInfo{}, plugin.ConfigError{Key: "s3_compression_min_ratio", Err: fmt.Errorf("Invalid `s3_compression_min_ratio` specified (`%v`). Expected a positive ratio, or 0", minRatio)}
+	}
+
+	compressorBin, err := e.StringValueDefault("s3_compressor_bin", DefaultCompressorBin)
+	if err != nil {
+		return S3ConnectionInfo{}, err
+	}
+
+	compressorThreads, err := e.FloatValueDefault("s3_compressor_threads", DefaultCompressorThreads)
+	if err != nil {
+		return S3ConnectionInfo{}, err
+	}
+	if compressorThreads < 0 || compressorThreads != float64(int(compressorThreads)) {
+		return S3ConnectionInfo{}, plugin.ConfigError{Key: "s3_compressor_threads", Err: fmt.Errorf("Invalid `s3_compressor_threads` specified (`%v`). Expected a whole number of threads, or 0", compressorThreads)}
+	}
+
+	lockMode, err := e.StringValueDefault("s3_object_lock_mode", DefaultObjectLockMode)
+	if err != nil {
+		return S3ConnectionInfo{}, err
+	}
+	if !validObjectLockMode(lockMode) {
+		return S3ConnectionInfo{}, plugin.ConfigError{Key: "s3_object_lock_mode", Err: fmt.Errorf("Invalid `s3_object_lock_mode` specified (`%s`). Expected `GOVERNANCE` or `COMPLIANCE`", lockMode)}
+	}
+
+	lockDays, err := e.FloatValueDefault("s3_object_lock_days", DefaultObjectLockDays)
+	if err != nil {
+		return S3ConnectionInfo{}, err
+	}
+	if lockMode != "" && lockDays < 1 {
+		return S3ConnectionInfo{}, plugin.ConfigError{Key: "s3_object_lock_days", Err: fmt.Errorf("Invalid `s3_object_lock_days` specified (`%v`). Expected at least 1 day", lockDays)}
+	}
+
+	acl, err := e.StringValueDefault("s3_acl", DefaultACL)
+	if err != nil {
+		return S3ConnectionInfo{}, err
+	}
+	if !validACL(acl) {
+		return S3ConnectionInfo{}, plugin.ConfigError{Key: "s3_acl", Err: fmt.Errorf("Invalid `s3_acl` specified (`%s`). Expected one of %s", acl, cannedACLs())}
+	}
+
+	connectTimeout, err := e.FloatValueDefault("s3_connect_timeout", DefaultConnectTimeout)
+	if err != nil {
+		return S3ConnectionInfo{}, err
 	}
+	if connectTimeout < 1 {
+		return S3ConnectionInfo{}, plugin.ConfigError{Key: "s3_connect_timeout", Err: fmt.Errorf("Invalid `s3_connect_timeout` specified (`%v`). Expected at least 1 second", connectTimeout)}
+	}
+
+	requestTimeout, err := e.FloatValueDefault("s3_request_timeout", DefaultRequestTimeout)
+	if err != nil {
+		return S3ConnectionInfo{}, err
+	}
+	if requestTimeout < 0 {
+		return S3ConnectionInfo{}, plugin.ConfigError{Key: "s3_request_timeout", Err: fmt.Errorf("Invalid `s3_request_timeout` specified (`%v`). Expected a positive number of seconds, or 0", requestTimeout)}
+	}
+
+	requesterPays, err := e.BooleanValueDefault("s3_requester_pays", DefaultRequesterPays)
+	if err != nil {
+		return S3ConnectionInfo{}, err
+	}
+
+	dualstack, err := e.BooleanValueDefault("s3_use_dualstack", DefaultUseDualstack)
+	if err != nil {
+		return S3ConnectionInfo{}, err
+	}
+	if dualstack && (host != DefaultS3Host || port != "") {
+		return S3ConnectionInfo{}, plugin.ConfigError{Key: "s3_use_dualstack", Err: fmt.Errorf("Invalid `s3_use_dualstack` specified. Dual-stack endpoints only exist on Amazon S3, so `s3_host` and `s3_port` can't be set along with it")}
+	}
+
+	validateRetries, err := e.FloatValueDefault("s3_validate_retries", DefaultValidateRetries)
+	if err != nil {
+		return S3ConnectionInfo{}, err
+	}
+	if validateRetries < 0 {
+		return S3ConnectionInfo{}, plugin.ConfigError{Key: "s3_validate_retries", Err: fmt.Errorf("Invalid `s3_validate_retries` specified (`%v`). Expected a positive number of retries, or 0", validateRetries)}
+	}
+
+	downloadConcurrency, err := e.FloatValueDefault("s3_download_concurrency", DefaultDownloadConcurrency)
+	if err != nil {
+		return S3ConnectionInfo{}, err
+	}
+	if downloadConcurrency < 1 {
+		return S3ConnectionInfo{}, plugin.ConfigError{Key: "s3_download_concurrency", Err: fmt.Errorf("Invalid `s3_download_concurrency` specified (`%v`). Expected a number of downloads, at least 1", downloadConcurrency)}
+	}
+
+	verifyReadback, err := e.BooleanValueDefault("s3_verify_readback", DefaultVerifyReadback)
+	if err != nil {
+		return S3ConnectionInfo{}, err
+	}
+
+	multipartThreshold, err := e.FloatValueDefault("s3_multipart_threshold", DefaultMultipartThreshold)
+	if err != nil {
+		return S3ConnectionInfo{}, err
+	}
+	if multipartThreshold < 1 || multipartThreshold > MaxMultipartThreshold || multipartThreshold != float64(int(multipartThreshold)) {
+		return S3ConnectionInfo{}, plugin.ConfigError{Key: "s3_multipart_threshold", Err: fmt.Errorf("Invalid `s3_multipart_threshold` specified (`%v`). Expected a whole number of MiB, from 1 to %d", multipartThreshold, MaxMultipartThreshold)}
+	}
+
+	return S3ConnectionInfo{
+		Host:                host,
+		SkipSSLValidation:   insecure_ssl,
+		CACert:              caCert,
+		AccessKey:           creds.AccessKey,
+		SecretKey:           creds.SecretKey,
+		SessionToken:        creds.SessionToken,
+		Bucket:              bucket,
+		PathPrefix:          prefix,
+		SignatureVersion:    sigVer,
+		SOCKS5Proxy:         proxy,
+		Port:                port,
+		Region:              region,
+		AutoRestore:         autoRestore,
+		RestoreDays:         int(restoreDays),
+		RestoreTier:         restoreTier,
+		RestoreTimeoutHours: int(restoreTimeout),
+		UploadState:         uploadState,
+		StaleUploadHours:    int(staleHours),
+		Compression:         compression,
+		CompressMinRatio:    minRatio,
+		CompressorBin:       compressorBin,
+		CompressorThreads:   int(compressorThreads),
+		ObjectLockMode:      lockMode,
+		ObjectLockDays:      int(lockDays),
+		ACL:                 acl,
+		ConnectTimeout:      int(connectTimeout),
+		RequestTimeout:      int(requestTimeout),
+		RequesterPays:       requesterPays,
+		UseDualstack:        dualstack,
+		ValidateRetries:     int(validateRetries),
+		DownloadConcurrency: int(downloadConcurrency),
+		VerifyReadback:      verifyReadback,
+		MultipartThreshold:  int(multipartThreshold) * 1024 * 1024,
+		target:              uploadTarget(),
+	}, nil
+}
 
-	transport := http.DefaultTransport
-	transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: s3.SkipSSLValidation}
+func (s3 S3ConnectionInfo) Transport() (http.RoundTripper, error) {
+	tlsConfig, err := s3.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		Dial:                  s3.dial(s3.dialer().Dial),
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: s3.requestTimeout(),
+		ExpectContinueTimeout: 1 * time.Second,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+	}
 	if s3.SOCKS5Proxy != "" {
-		dialer, err := proxy.SOCKS5("tcp", s3.SOCKS5Proxy, nil, proxy.Direct)
+		dialer, err := proxy.SOCKS5("tcp", s3.SOCKS5Proxy, nil, s3.dialer())
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "can't connect to the proxy:", err)
 			os.Exit(1)
 		}
-		transport.(*http.Transport).Dial = dialer.Dial
+		transport.Dial = s3.dial(dialer.Dial)
 	}
-
-	s3Client.SetCustomTransport(transport)
-
-	return s3Client, nil
+	return transport, nil
 }
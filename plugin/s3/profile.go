@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Shared config profiles
+//
+// Instead of inline `access_key_id` and `secret_access_key`, the endpoint
+// can name a profile of the AWS shared config files with `s3_profile`, the
+// way the AWS CLI and SDKs do.  The profile is looked up in the credentials
+// file (`$AWS_SHARED_CREDENTIALS_FILE`, or `~/.aws/credentials`) as
+// `[name]`, and in the config file (`$AWS_CONFIG_FILE`, or `~/.aws/config`)
+// as `[profile name]`, or `[default]`.  Its `aws_access_key_id`,
+// `aws_secret_access_key`, `aws_session_token` and `region` are used, the
+// keys of the credentials file winning over those of the config file.
+//
+// Inline keys (with `s3_session_token`, for temporary keys) win over the
+// profile, and `s3_region` wins over the region of the profile.  There is no
+// default credential chain beyond that (no environment variables, no
+// instance role): without inline keys, nor a profile, the endpoint is
+// invalid.  Profiles that get their credentials some other way
+// (`role_arn`, `credential_process`, `sso_*`) are not supported.
+
+const (
+	DefaultProfile = ""
+
+	SecurityTokenHeader = "X-Amz-Security-Token"
+)
+
+// awsProfile holds the settings of a shared config profile that the plugin
+// knows what to do with.
+type awsProfile struct {
+	Name         string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Region       string
+}
+
+// sharedConfigFiles returns the paths of the shared credentials and config
+// files, honouring the environment variables the AWS CLI honours.
+func sharedConfigFiles() (string, string) {
+	home := os.Getenv("HOME")
+	credentials := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credentials == "" {
+		credentials = filepath.Join(home, ".aws", "credentials")
+	}
+	config := os.Getenv("AWS_CONFIG_FILE")
+	if config == "" {
+		config = filepath.Join(home, ".aws", "config")
+	}
+	return credentials, config
+}
+
+// readSharedConfig reads the sections of an INI file, by name; a missing
+// file has no section.
+func readSharedConfig(path string) (map[string]map[string]string, error) {
+	sections := map[string]map[string]string{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return sections, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var section map[string]string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(raw, " ") || strings.HasPrefix(raw, "\t") {
+			/* nested settings (i.e. the `s3 =` block of the config file) */
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.Join(strings.Fields(line[1:len(line)-1]), " ")
+			if sections[name] == nil {
+				sections[name] = map[string]string{}
+			}
+			section = sections[name]
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s, line %d: expected `key = value`", path, n)
+		}
+		if section == nil {
+			return nil, fmt.Errorf("%s, line %d: `%s` is not in a [section]", path, n, strings.TrimSpace(kv[0]))
+		}
+		section[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return sections, scanner.Err()
+}
+
+// loadProfile looks the named profile up in the shared config files.
+func loadProfile(name string) (awsProfile, error) {
+	credentialsFile, configFile := sharedConfigFiles()
+	credentials, err := readSharedConfig(credentialsFile)
+	if err != nil {
+		return awsProfile{}, err
+	}
+	config, err := readSharedConfig(configFile)
+	if err != nil {
+		return awsProfile{}, err
+	}
+
+	section, ok := config["profile "+name]
+	if !ok && name == "default" {
+		section, ok = config["default"]
+	}
+	settings := map[string]string{}
+	for k, v := range section {
+		settings[k] = v
+	}
+	if keys, found := credentials[name]; found {
+		ok = true
+		for k, v := range keys {
+			settings[k] = v
+		}
+	}
+	if !ok {
+		return awsProfile{}, fmt.Errorf("no `%s` profile in %s, nor in %s", name, credentialsFile, configFile)
+	}
+
+	profile := awsProfile{
+		Name:         name,
+		AccessKey:    settings["aws_access_key_id"],
+		SecretKey:    settings["aws_secret_access_key"],
+		SessionToken: settings["aws_session_token"],
+		Region:       settings["region"],
+	}
+	if profile.AccessKey == "" || profile.SecretKey == "" {
+		for _, k := range []string{"role_arn", "credential_process", "sso_start_url", "sso_session"} {
+			if settings[k] != "" {
+				return awsProfile{}, fmt.Errorf("the `%s` profile gets its credentials with `%s`, which is not supported; it needs aws_access_key_id and aws_secret_access_key", name, k)
+			}
+		}
+		return awsProfile{}, fmt.Errorf("the `%s` profile has no aws_access_key_id and aws_secret_access_key", name)
+	}
+	return profile, nil
+}
+
+// endpointCredentials returns the keys (and session token) to sign requests
+// with, and the region of the profile, if any, from either the inline keys
+// or the profile of the endpoint.
+func endpointCredentials(e plugin.ShieldEndpoint) (awsProfile, error) {
+	key, err := e.StringValueDefault("access_key_id", "")
+	if err != nil {
+		return awsProfile{}, err
+	}
+	secret, err := e.StringValueDefault("secret_access_key", "")
+	if err != nil {
+		return awsProfile{}, err
+	}
+	token, err := e.StringValueDefault("s3_session_token", "")
+	if err != nil {
+		return awsProfile{}, err
+	}
+	name, err := e.StringValueDefault("s3_profile", DefaultProfile)
+	if err != nil {
+		return awsProfile{}, err
+	}
+
+	switch {
+	case token != "" && key == "":
+		return awsProfile{}, plugin.ConfigError{Key: "s3_session_token", Err: fmt.Errorf("`s3_session_token` is set, but `access_key_id` and `secret_access_key`, which it goes with, are not")}
+	case key != "" && secret == "":
+		return awsProfile{}, plugin.ConfigError{Key: "secret_access_key", Err: fmt.Errorf("`access_key_id` is set, but `secret_access_key` is not")}
+	case key == "" && secret != "":
+		return awsProfile{}, plugin.ConfigError{Key: "access_key_id", Err: fmt.Errorf("`secret_access_key` is set, but `access_key_id` is not")}
+	case key == "" && name == "":
+		return awsProfile{}, plugin.ConfigError{Key: "access_key_id", Err: fmt.Errorf("`access_key_id` and `secret_access_key` are required, unless `s3_profile` is set")}
+	}
+
+	var profile awsProfile
+	if name != "" {
+		profile, err = loadProfile(name)
+		if err != nil && key == "" {
+			return awsProfile{}, plugin.ConfigError{Key: "s3_profile", Err: err}
+		}
+		if err != nil {
+			/* the inline keys do without it; only its region is lost */
+			plugin.DEBUG("ignoring the `%s` profile (%s), in favor of the inline keys", name, err)
+			profile = awsProfile{}
+		}
+	}
+	if key != "" {
+		if name != "" {
+			plugin.DEBUG("using the inline access_key_id, rather than the keys of the `%s` profile", name)
+		}
+		profile.AccessKey, profile.SecretKey, profile.SessionToken = key, secret, token
+	}
+	return profile, nil
+}
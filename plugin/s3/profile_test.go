@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("Shared Config Profiles", func() {
+	var (
+		tmp                 string
+		credentials, config string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-s3-profile-")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		credentials, config = os.Getenv("AWS_SHARED_CREDENTIALS_FILE"), os.Getenv("AWS_CONFIG_FILE")
+		os.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(tmp, "credentials"))
+		os.Setenv("AWS_CONFIG_FILE", filepath.Join(tmp, "config"))
+
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "credentials"), []byte(`
+[default]
+aws_access_key_id = DEFAULTKEY
+aws_secret_access_key = default-secret
+
+# temporary keys
+[backups]
+aws_access_key_id     = BACKUPSKEY
+aws_secret_access_key = backups-secret
+aws_session_token     = backups-token
+`), 0600)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "config"), []byte(`
+[default]
+region = us-west-2
+
+[profile backups]
+region = eu-west-3
+aws_access_key_id = OVERRIDDEN
+s3 =
+  max_concurrent_requests = 20
+
+[profile config-only]
+aws_access_key_id = CONFIGKEY
+aws_secret_access_key = config-secret
+
+[profile assumed]
+role_arn = arn:aws:iam::123456789012:role/backups
+source_profile = default
+`), 0600)).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		os.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentials)
+		os.Setenv("AWS_CONFIG_FILE", config)
+		os.RemoveAll(tmp)
+	})
+
+	endpoint := func(kv ...string) plugin.ShieldEndpoint {
+		e := plugin.ShieldEndpoint{"bucket": "bucket"}
+		for i := 0; i < len(kv); i += 2 {
+			e[kv[i]] = kv[i+1]
+		}
+		return e
+	}
+
+	It("takes the keys and the region from the named profile", func() {
+		info, err := getS3ConnInfo(endpoint("s3_profile", "backups"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(info.AccessKey).Should(Equal("BACKUPSKEY"))
+		Ω(info.SecretKey).Should(Equal("backups-secret"))
+		Ω(info.SessionToken).Should(Equal("backups-token"))
+		Ω(info.Region).Should(Equal("eu-west-3"))
+
+		info, err = getS3ConnInfo(endpoint("s3_profile", "default"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(info.AccessKey).Should(Equal("DEFAULTKEY"))
+		Ω(info.SessionToken).Should(Equal(""))
+		Ω(info.Region).Should(Equal("us-west-2"))
+
+		info, err = getS3ConnInfo(endpoint("s3_profile", "config-only"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(info.AccessKey).Should(Equal("CONFIGKEY"))
+	})
+
+	It("prefers the inline keys and s3_region to the profile", func() {
+		info, err := getS3ConnInfo(endpoint(
+			"s3_profile", "backups",
+			"access_key_id", "AKID",
+			"secret_access_key", "secret",
+			"s3_region", "ap-south-1"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(info.AccessKey).Should(Equal("AKID"))
+		Ω(info.SecretKey).Should(Equal("secret"))
+		Ω(info.SessionToken).Should(Equal(""))
+		Ω(info.Region).Should(Equal("ap-south-1"))
+
+		info, err = getS3ConnInfo(endpoint("s3_profile", "backups", "access_key_id", "AKID", "secret_access_key", "secret"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(info.Region).Should(Equal("eu-west-3"))
+	})
+
+	It("requires either the inline keys, or a profile", func() {
+		_, err := getS3ConnInfo(endpoint())
+		Ω(err).Should(BeAssignableToTypeOf(plugin.ConfigError{}))
+		Ω(err.(plugin.ConfigError).Key).Should(Equal("access_key_id"))
+
+		_, err = getS3ConnInfo(endpoint("s3_profile", "backups", "access_key_id", "AKID"))
+		Ω(err).Should(BeAssignableToTypeOf(plugin.ConfigError{}))
+		Ω(err.(plugin.ConfigError).Key).Should(Equal("secret_access_key"))
+	})
+
+	It("takes the session token of temporary inline keys", func() {
+		info, err := getS3ConnInfo(endpoint(
+			"s3_profile", "default",
+			"access_key_id", "ASIATEMPORARY",
+			"secret_access_key", "temporary-secret",
+			"s3_session_token", "temporary-token"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(info.AccessKey).Should(Equal("ASIATEMPORARY"))
+		Ω(info.SecretKey).Should(Equal("temporary-secret"))
+		Ω(info.SessionToken).Should(Equal("temporary-token"))
+
+		_, err = getS3ConnInfo(endpoint("s3_profile", "backups", "s3_session_token", "temporary-token"))
+		Ω(err).Should(BeAssignableToTypeOf(plugin.ConfigError{}))
+		Ω(err.(plugin.ConfigError).Key).Should(Equal("s3_session_token"))
+	})
+
+	It("fails on missing profiles, and on profiles without keys", func() {
+		_, err := getS3ConnInfo(endpoint("s3_profile", "nope"))
+		Ω(err).Should(BeAssignableToTypeOf(plugin.ConfigError{}))
+		Ω(err.Error()).Should(ContainSubstring("no `nope` profile"))
+
+		_, err = getS3ConnInfo(endpoint("s3_profile", "assumed"))
+		Ω(err).Should(BeAssignableToTypeOf(plugin.ConfigError{}))
+		Ω(err.Error()).Should(ContainSubstring("`role_arn`, which is not supported"))
+	})
+
+	It("sends the session token of the profile along with each request", func() {
+		var token string
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token = r.Header.Get(SecurityTokenHeader)
+		}))
+		defer server.Close()
+
+		u, err := url.Parse(server.URL)
+		Ω(err).ShouldNot(HaveOccurred())
+		info, err := getS3ConnInfo(endpoint("s3_profile", "backups", "s3_host", u.Hostname(), "s3_port", u.Port()))
+		Ω(err).ShouldNot(HaveOccurred())
+		info.SignatureVersion, info.SkipSSLValidation = "2", true
+		api, err := info.API()
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = api.Head("some/archive")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(token).Should(Equal("backups-token"))
+
+		info, err = getS3ConnInfo(endpoint("access_key_id", "ASIATEMPORARY", "secret_access_key", "temporary-secret", "s3_session_token", "temporary-token", "s3_host", u.Hostname(), "s3_port", u.Port()))
+		Ω(err).ShouldNot(HaveOccurred())
+		info.SignatureVersion, info.SkipSSLValidation = "2", true
+		api, err = info.API()
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = api.Head("some/archive")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(token).Should(Equal("temporary-token"))
+	})
+})
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	minio "github.com/minio/minio-go"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Read-back verification
+//
+// When `s3_verify_readback` is true, a successful store is only reported to
+// SHIELD once a HEAD request on the new archive confirms that it exists, with
+// as many bytes as were uploaded.  Some S3-compatible stores acknowledge
+// writes that they lose, or only show new objects after a while; a missing
+// archive is asked for again, up to `readbackAttempts` times, a second apart,
+// while an archive of the wrong size fails the store right away.  It costs a
+// request (and its round-trip) per store, which is why it is off by default.
+
+const DefaultVerifyReadback = false
+
+var (
+	// readbackAttempts is how many times to look for a new archive.
+	readbackAttempts = 3
+	// readbackDelay is how long to wait before looking for it again.
+	readbackDelay = 1 * time.Second
+)
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// verifyReadback checks that the archive stored at `path` can be found,
+// and has `size` bytes.
+func verifyReadback(api *S3API, path string, size int64) error {
+	key := objectKey(path)
+	for attempt := 1; ; attempt++ {
+		h, err := api.Head(key)
+		if err != nil {
+			code := minio.ToErrorResponse(err).Code
+			missing := code == "NotFound" || code == "NoSuchKey"
+			if (!missing && !transient(err)) || attempt >= readbackAttempts {
+				return fmt.Errorf("unable to read %s back, once stored: %s", path, err)
+			}
+			plugin.DEBUG("read-back #%d of %s failed (%s); trying again in %s", attempt, path, err, readbackDelay)
+			time.Sleep(readbackDelay)
+			continue
+		}
+
+		stored, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("unable to read the size of %s back, once stored: %s", path, err)
+		}
+		if stored != size {
+			return fmt.Errorf("%s was not stored whole: S3 reports %d bytes, but %d were uploaded", path, stored, size)
+		}
+		plugin.DEBUG("read %s back, with its %d bytes", path, size)
+		return nil
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Read-Back Verification", func() {
+	var (
+		server   *httptest.Server
+		api      *S3API
+		objects  map[string][]byte
+		heads    []string
+		misses   int
+		shortBy  int
+		attempts int
+		delay    time.Duration
+	)
+
+	BeforeEach(func() {
+		objects = map[string][]byte{}
+		heads = []string{}
+		misses, shortBy = 0, 0
+		server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+			switch r.Method {
+			case "PUT":
+				body, _ := ioutil.ReadAll(r.Body)
+				objects[key] = body
+				w.Header().Set("ETag", `"`+partETag(body)+`"`)
+			case "HEAD":
+				heads = append(heads, key)
+				data, ok := objects[key]
+				if !ok || misses > 0 {
+					misses--
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)-shortBy))
+			}
+		}))
+
+		u, err := url.Parse(server.URL)
+		Ω(err).ShouldNot(HaveOccurred())
+		api, err = S3ConnectionInfo{
+			Host:              u.Hostname(),
+			Port:              u.Port(),
+			SkipSSLValidation: true,
+			AccessKey:         "AKID",
+			SecretKey:         "secret",
+			Bucket:            "bucket",
+			SignatureVersion:  "2",
+		}.API()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		attempts, delay = readbackAttempts, readbackDelay
+		readbackDelay = 0
+	})
+
+	AfterEach(func() {
+		readbackAttempts, readbackDelay = attempts, delay
+		server.Close()
+	})
+
+	store := func(data []byte) (string, int64) {
+		in := &countingReader{r: bytes.NewReader(data)}
+		b, err := ioutil.ReadAll(in)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = api.PutObject("backups/archive", b)
+		Ω(err).ShouldNot(HaveOccurred())
+		return "/backups/archive", in.n
+	}
+
+	It("checks the size of the stored archive with a HEAD request", func() {
+		path, size := store([]byte("some archive"))
+		Ω(size).Should(Equal(int64(12)))
+		Ω(verifyReadback(api, path, size)).Should(Succeed())
+		Ω(heads).Should(Equal([]string{"backups/archive"}))
+	})
+
+	It("fails when the archive was not stored whole", func() {
+		path, size := store([]byte("some archive"))
+		shortBy = 4
+		err := verifyReadback(api, path, size)
+		Ω(err).Should(MatchError("/backups/archive was not stored whole: S3 reports 8 bytes, but 12 were uploaded"))
+		Ω(heads).Should(HaveLen(1))
+	})
+
+	It("looks for archives that do not show up right away", func() {
+		path, size := store([]byte("some archive"))
+		misses = 2
+		Ω(verifyReadback(api, path, size)).Should(Succeed())
+		Ω(heads).Should(HaveLen(3))
+	})
+
+	It("fails when the archive can't be found", func() {
+		err := verifyReadback(api, "/backups/lost", 12)
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("unable to read /backups/lost back"))
+		Ω(heads).Should(HaveLen(readbackAttempts))
+	})
+})
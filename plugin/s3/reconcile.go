@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/url"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// ListObjects returns the keys of all the objects of the bucket that start
+// with prefix, with as many ListObjectsV2 requests as it takes.
+func (api *S3API) ListObjects(prefix string) ([]string, error) {
+	keys := []string{}
+	token := ""
+	for {
+		q := url.Values{"list-type": []string{"2"}}
+		if prefix != "" {
+			q.Set("prefix", prefix)
+		}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		res, err := api.Do("GET", "", q, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated bool   `xml:"IsTruncated"`
+			NextToken   string `xml:"NextContinuationToken"`
+		}
+		if err = api.readXML(res, &result); err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !result.IsTruncated || result.NextToken == "" {
+			return keys, nil
+		}
+		token = result.NextToken
+	}
+}
+
+// StoredKeys lists the objects under the configured prefix, as storage
+// handles: with a leading slash when there is no prefix, just like
+// genBackupPath() makes them.  Every object under the prefix is listed,
+// archive or not.
+func (p S3Plugin) StoredKeys(endpoint plugin.ShieldEndpoint) ([]string, error) {
+	s3, err := getS3ConnInfo(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	api, err := s3.API()
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := api.ListObjects(s3.PathPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if s3.PathPrefix == "" {
+		for i := range keys {
+			keys[i] = "/" + keys[i]
+		}
+	}
+	plugin.DEBUG("found %d objects under prefix '%s'", len(keys), s3.PathPrefix)
+	return keys, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reconciliation", func() {
+	var (
+		server  *httptest.Server
+		u       *url.URL
+		objects []string
+		pages   int
+	)
+
+	BeforeEach(func() {
+		objects = []string{}
+		pages = 0
+
+		/* a fake ListObjectsV2, with pages of 2 keys, and the page number as token */
+		server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Ω(r.Method).Should(Equal("GET"))
+			Ω(r.URL.Path).Should(Equal("/bucket/"))
+			q := r.URL.Query()
+			Ω(q.Get("list-type")).Should(Equal("2"))
+			pages++
+
+			keys := []string{}
+			for _, key := range objects {
+				if strings.HasPrefix(key, q.Get("prefix")) {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			start, _ := strconv.Atoi(q.Get("continuation-token"))
+			end := start + 2
+			if end > len(keys) {
+				end = len(keys)
+			}
+
+			fmt.Fprintf(w, `<ListBucketResult>`)
+			for _, key := range keys[start:end] {
+				fmt.Fprintf(w, `<Contents><Key>%s</Key><Size>1</Size></Contents>`, key)
+			}
+			if end < len(keys) {
+				fmt.Fprintf(w, `<IsTruncated>true</IsTruncated><NextContinuationToken>%d</NextContinuationToken>`, end)
+			} else {
+				fmt.Fprintf(w, `<IsTruncated>false</IsTruncated>`)
+			}
+			fmt.Fprintf(w, `</ListBucketResult>`)
+		}))
+
+		var err error
+		u, err = url.Parse(server.URL)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	endpoint := func(prefix string) map[string]interface{} {
+		return map[string]interface{}{
+			"s3_host":             u.Hostname(),
+			"s3_port":             u.Port(),
+			"skip_ssl_validation": true,
+			"access_key_id":       "AKID",
+			"secret_access_key":   "secret",
+			"bucket":              "bucket",
+			"prefix":              prefix,
+			"signature_version":   "2",
+		}
+	}
+
+	It("lists the objects under the prefix, page after page", func() {
+		objects = []string{"backups/2017/01/01/a", "backups/2017/01/02/b", "backups/2017/01/03/c", "backupsx/d", "other/e"}
+
+		keys, err := S3Plugin{}.StoredKeys(endpoint("/backups"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(keys).Should(Equal([]string{"backups/2017/01/01/a", "backups/2017/01/02/b", "backups/2017/01/03/c"}))
+		Ω(pages).Should(Equal(2))
+	})
+
+	It("lists keys the way they were stored when there is no prefix", func() {
+		objects = []string{"2017/01/01/a"}
+
+		keys, err := S3Plugin{}.StoredKeys(endpoint(""))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(keys).Should(Equal([]string{"/2017/01/01/a"}))
+	})
+})
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Bucket Region Detection", func() {
+	var (
+		server  *httptest.Server
+		info    S3ConnectionInfo
+		regions []string
+	)
+
+	// signedRegion extracts the region from the credential scope of a
+	// Signature Version 4 Authorization header.
+	signedRegion := func(r *http.Request) string {
+		auth := r.Header.Get("Authorization")
+		i := strings.Index(auth, "Credential=")
+		if i < 0 {
+			return ""
+		}
+		scope := strings.Split(strings.SplitN(auth[i+len("Credential="):], ",", 2)[0], "/")
+		if len(scope) < 3 {
+			return ""
+		}
+		return scope[2]
+	}
+
+	BeforeEach(func() {
+		regions = []string{}
+		server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			region := signedRegion(r)
+			regions = append(regions, region)
+
+			if _, ok := r.URL.Query()["location"]; ok {
+				fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">eu-west-3</LocationConstraint>`)
+				return
+			}
+			if region != "eu-west-3" {
+				w.Header().Set("X-Amz-Bucket-Region", "eu-west-3")
+				w.WriteHeader(http.StatusMovedPermanently)
+				fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>PermanentRedirect</Code><Message>The bucket you are attempting to access must be addressed using the specified endpoint.</Message></Error>`)
+				return
+			}
+			w.Header().Set("X-Amz-Storage-Class", "STANDARD")
+		}))
+
+		u, err := url.Parse(server.URL)
+		Ω(err).ShouldNot(HaveOccurred())
+		info = S3ConnectionInfo{
+			Host:              u.Hostname(),
+			Port:              u.Port(),
+			SkipSSLValidation: true,
+			AccessKey:         "AKID",
+			SecretKey:         "secret",
+			Bucket:            "bucket",
+			SignatureVersion:  "4",
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("self-corrects when the configured region is wrong", func() {
+		info.Region = "us-west-1"
+		api, err := info.API()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		h, err := api.Head("some/archive")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(h.Get("X-Amz-Storage-Class")).Should(Equal("STANDARD"))
+		Ω(regions).Should(Equal([]string{"us-west-1", "eu-west-3"}))
+
+		region, err := api.Region()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(region).Should(Equal("eu-west-3"))
+
+		// subsequent requests go straight to the right region
+		_, err = api.Head("another/archive")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(regions).Should(Equal([]string{"us-west-1", "eu-west-3", "eu-west-3"}))
+	})
+
+	It("looks the region up when none is configured", func() {
+		api, err := info.API()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		_, err = api.Head("some/archive")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(regions).Should(Equal([]string{"us-east-1", "eu-west-3"}))
+	})
+
+	It("does not retry errors that have nothing to do with regions", func() {
+		info.Region = "eu-west-3"
+		server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			regions = append(regions, signedRegion(r))
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+		})
+		api, err := info.API()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		_, err = api.Head("some/archive")
+		Ω(err).Should(HaveOccurred())
+		Ω(regions).Should(HaveLen(1))
+	})
+})
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	minio "github.com/minio/minio-go"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// S3API issues signed requests against the S3 API directly.
+type S3API struct {
+	info   S3ConnectionInfo
+	client *http.Client
+	region string
+}
+
+func (s3 S3ConnectionInfo) API() (*S3API, error) {
+	transport, err := s3.Transport()
+	if err != nil {
+		return nil, err
+	}
+	return &S3API{
+		info:   s3,
+		client: &http.Client{Transport: transport},
+		region: s3.Region,
+	}, nil
+}
+
+func (s3 S3ConnectionInfo) endpoint() string {
+	if s3.Port != "" {
+		return s3.Host + ":" + s3.Port
+	}
+	return s3.Host
+}
+
+// host returns the host[:port] to send requests to.  Buckets that live
+// outside of us-east-1 are accessed through their regional AWS endpoint,
+// and all of them through their dual-stack endpoint with `s3_use_dualstack`.
+func (api *S3API) host() string {
+	if api.info.UseDualstack {
+		return dualstackHost(api.region)
+	}
+	if api.info.Host == DefaultS3Host && api.info.Port == "" &&
+		api.region != "" && api.region != "us-east-1" {
+		return "s3." + api.region + ".amazonaws.com"
+	}
+	return api.info.endpoint()
+}
+
+// URL returns the path-style URL of an object (or of the bucket itself,
+// if key is empty).
+func (api *S3API) URL(key string, query url.Values) *url.URL {
+	u := &url.URL{
+		Scheme: "https",
+		Host:   api.host(),
+		Path:   "/" + api.info.Bucket + "/",
+	}
+	if key != "" {
+		u.Path += strings.TrimPrefix(key, "/")
+	}
+	u.RawPath = uriEncode(u.Path, true)
+	if query != nil {
+		u.RawQuery = encodeQuery(query)
+	}
+	return u
+}
+
+// encodeQuery encodes query parameters, leaving valueless sub-resources
+// (like `?restore` or `?delete`) without the trailing '='.
+func encodeQuery(q url.Values) string {
+	parts := []string{}
+	for _, kv := range strings.Split(canonicalQuery(q), "&") {
+		parts = append(parts, strings.TrimSuffix(kv, "="))
+	}
+	return strings.Join(parts, "&")
+}
+
+// Region returns the region of the bucket, asking S3 about it the first
+// time round.
+func (api *S3API) Region() (string, error) {
+	if api.region != "" {
+		return api.region, nil
+	}
+
+	api.region = "us-east-1"
+	res, err := api.Do("GET", "", url.Values{"location": []string{""}}, nil, nil)
+	if err != nil {
+		api.region = ""
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var location string
+	if err := xml.NewDecoder(res.Body).Decode(&location); err != nil {
+		api.region = ""
+		return "", err
+	}
+	if location == "EU" {
+		location = "eu-west-1"
+	}
+	if location != "" {
+		api.region = location
+	}
+	plugin.DEBUG("bucket %s lives in region %s", api.info.Bucket, api.region)
+	return api.region, nil
+}
+
+// Do sends a signed request to S3, and returns the response if it was
+// successful (2xx).  S3 error documents are returned as minio.ErrorResponse
+// errors, so that callers can inspect the error Code.
+//
+// If S3 tells us that the bucket lives in another region than the one we
+// signed the request for (i.e. because `s3_region` is wrong), the request
+// is sent again, once, to the right region.
+func (api *S3API) Do(method, key string, query url.Values, headers http.Header, body []byte) (*http.Response, error) {
+	res, err := api.do(method, key, query, headers, body)
+	if err == nil || api.info.SignatureVersion == "2" {
+		return res, err
+	}
+
+	region := wrongRegion(err, api.region)
+	if region == "" {
+		return nil, err
+	}
+	plugin.Fprintf(os.Stderr, "@Y{bucket %s lives in region %s, not %s; retrying there}\n", api.info.Bucket, region, api.region)
+	api.region = region
+	return api.do(method, key, query, headers, body)
+}
+
+// wrongRegion returns the actual region of the bucket, if err says that
+// the request was sent to (or signed for) the wrong region.
+func wrongRegion(err error, current string) string {
+	e := minio.ToErrorResponse(err)
+	switch e.Code {
+	case "PermanentRedirect", "AuthorizationHeaderMalformed", "MovedPermanently", "IllegalLocationConstraintException":
+		if e.AmzBucketRegion != "" && e.AmzBucketRegion != current {
+			return e.AmzBucketRegion
+		}
+	}
+	return ""
+}
+
+func (api *S3API) do(method, key string, query url.Values, headers http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, api.URL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	if api.info.RequesterPays {
+		req.Header.Set(RequestPayerHeader, "requester")
+	}
+	if api.info.SessionToken != "" {
+		req.Header.Set(SecurityTokenHeader, api.info.SessionToken)
+	}
+	if len(body) > 0 {
+		sum := md5.Sum(body)
+		req.Header.Set("Content-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+
+	if api.info.SignatureVersion == "2" {
+		signV2(req, api.info.AccessKey, api.info.SecretKey, time.Now())
+	} else {
+		region := api.region
+		if region == "" {
+			if region, err = api.Region(); err != nil {
+				return nil, err
+			}
+		}
+		req.Header.Set("X-Amz-Content-Sha256", hexSHA256(body))
+		signV4(req, api.info.AccessKey, api.info.SecretKey, region, time.Now())
+	}
+
+	plugin.DEBUG("S3 API: %s %s", method, req.URL.String())
+	res, err := api.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		return nil, errorResponse(res, key)
+	}
+	return res, nil
+}
+
+func errorResponse(res *http.Response, key string) error {
+	e := minio.ErrorResponse{}
+	b, _ := ioutil.ReadAll(res.Body)
+	if len(b) == 0 || xml.Unmarshal(b, &e) != nil {
+		e.Code = strings.Replace(http.StatusText(res.StatusCode), " ", "", -1)
+		e.Message = fmt.Sprintf("%s (HTTP %d)", http.StatusText(res.StatusCode), res.StatusCode)
+	}
+	if e.Key == "" {
+		e.Key = key
+	}
+	e.AmzBucketRegion = res.Header.Get("X-Amz-Bucket-Region")
+	if e.AmzBucketRegion == "" {
+		// AuthorizationHeaderMalformed errors carry the expected region
+		// in their body instead.
+		var r struct {
+			Region string `xml:"Region"`
+		}
+		if xml.Unmarshal(b, &r) == nil {
+			e.AmzBucketRegion = r.Region
+		}
+	}
+	return e
+}
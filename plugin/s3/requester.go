@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io"
+)
+
+// Requester pays and dual-stack endpoints
+//
+// Requests against requester-pays buckets must acknowledge that the
+// requester is charged for them, with the `x-amz-request-payer` header, or
+// S3 refuses them (403 AccessDenied).  The minio client has no way to add
+// it, so all the requests go through S3API, which signs it along with the
+// other `x-amz-*` headers.
+//
+// Dual-stack endpoints (`s3.dualstack.<region>.amazonaws.com`) answer over
+// IPv6 as well as IPv4; they only exist on AWS, and are regional, so the
+// region of the bucket is detected first when it is not configured.
+
+const (
+	DefaultRequesterPays = false
+	DefaultUseDualstack  = false
+
+	RequestPayerHeader = "X-Amz-Request-Payer"
+)
+
+// dualstackHost returns the dual-stack endpoint of a region.
+func dualstackHost(region string) string {
+	if region == "" {
+		region = "us-east-1"
+	}
+	return "s3.dualstack." + region + ".amazonaws.com"
+}
+
+// GetObject returns the contents of an object, as they stream in.
+func (api *S3API) GetObject(key string) (io.ReadCloser, error) {
+	res, err := api.Do("GET", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// DeleteObject removes an object from the bucket.
+func (api *S3API) DeleteObject(key string) error {
+	res, err := api.Do("DELETE", key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("Requester Pays", func() {
+	var (
+		server *httptest.Server
+		info   S3ConnectionInfo
+		payers []string
+	)
+
+	BeforeEach(func() {
+		payers = []string{}
+		server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			payers = append(payers, r.Method+" "+r.Header.Get(RequestPayerHeader))
+			switch {
+			case r.Method == "GET" && r.URL.Query().Get("list-type") == "2":
+				fmt.Fprintf(w, `<ListBucketResult><Contents><Key>a</Key></Contents></ListBucketResult>`)
+			case r.Method == "GET":
+				fmt.Fprintf(w, "archive")
+			case r.Method == "PUT":
+				w.Header().Set("ETag", `"`+partETag([]byte("archive"))+`"`)
+			case r.Method == "DELETE":
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}))
+
+		u, err := url.Parse(server.URL)
+		Ω(err).ShouldNot(HaveOccurred())
+		info = S3ConnectionInfo{
+			Host:              u.Hostname(),
+			Port:              u.Port(),
+			SkipSSLValidation: true,
+			AccessKey:         "AKID",
+			SecretKey:         "secret",
+			Bucket:            "bucket",
+			SignatureVersion:  "2",
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	requests := func(info S3ConnectionInfo) {
+		api, err := info.API()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		_, err = api.PutObject("some/archive", []byte("archive"))
+		Ω(err).ShouldNot(HaveOccurred())
+		r, err := api.GetObject("some/archive")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ioutil.ReadAll(r)).Should(Equal([]byte("archive")))
+		Ω(r.Close()).Should(Succeed())
+		Ω(api.ListObjects("some/")).Should(Equal([]string{"a"}))
+		Ω(api.DeleteObject("some/archive")).Should(Succeed())
+	}
+
+	It("acknowledges the charges on every request, for requester-pays buckets", func() {
+		info.RequesterPays = true
+		requests(info)
+		Ω(payers).Should(Equal([]string{"PUT requester", "GET requester", "GET requester", "DELETE requester"}))
+	})
+
+	It("does not, otherwise", func() {
+		requests(info)
+		Ω(payers).Should(Equal([]string{"PUT ", "GET ", "GET ", "DELETE "}))
+	})
+
+	It("signs the header, like the other x-amz-* headers", func() {
+		req, err := http.NewRequest("GET", "https://s3.amazonaws.com/bucket/key", nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		req.Header.Set(RequestPayerHeader, "requester")
+		signV4(req, "AKID", "secret", "us-east-1", time.Now())
+		Ω(req.Header.Get("Authorization")).Should(ContainSubstring("x-amz-request-payer"))
+	})
+})
+
+var _ = Describe("Dual-Stack Endpoints", func() {
+	It("sends requests to the dual-stack endpoint of the region", func() {
+		api, err := S3ConnectionInfo{Host: DefaultS3Host, Bucket: "bucket", Region: "eu-west-3", UseDualstack: true}.API()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(api.URL("key", nil).Host).Should(Equal("s3.dualstack.eu-west-3.amazonaws.com"))
+	})
+
+	It("looks the region up through the us-east-1 dual-stack endpoint", func() {
+		api, err := S3ConnectionInfo{Host: DefaultS3Host, Bucket: "bucket", UseDualstack: true}.API()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(api.URL("", nil).Host).Should(Equal("s3.dualstack.us-east-1.amazonaws.com"))
+	})
+
+	It("only works with Amazon S3", func() {
+		_, err := getS3ConnInfo(plugin.ShieldEndpoint{
+			"s3_host":           "minio.example.com",
+			"access_key_id":     "AKID",
+			"secret_access_key": "secret",
+			"bucket":            "bucket",
+			"s3_use_dualstack":  true,
+		})
+		Ω(err).Should(HaveOccurred())
+		Ω(err).Should(BeAssignableToTypeOf(plugin.ConfigError{}))
+	})
+})
@@ -0,0 +1,12 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestS3Plugin(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "S3 Plugin Test Suite")
+}
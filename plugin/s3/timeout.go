@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// Connections to S3 (or to the SOCKS5 proxy) that can't be established
+// within `s3_connect_timeout` seconds are given up on.  When
+// `s3_request_timeout` is set, requests also fail when S3 does not start
+// to respond within that many seconds, or when the connection makes no
+// progress (nothing is read nor written) for that long, halfway through
+// an upload or a download; otherwise, a stuck connection, i.e. behind a
+// flaky proxy, could hang a store or a retrieve forever.
+
+const (
+	DefaultConnectTimeout = 30
+	DefaultRequestTimeout = 0
+)
+
+func (s3 S3ConnectionInfo) connectTimeout() time.Duration {
+	return time.Duration(s3.ConnectTimeout) * time.Second
+}
+
+func (s3 S3ConnectionInfo) requestTimeout() time.Duration {
+	return time.Duration(s3.RequestTimeout) * time.Second
+}
+
+// dialer returns what connects to S3, or to the SOCKS5 proxy.
+func (s3 S3ConnectionInfo) dialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout:   s3.connectTimeout(),
+		KeepAlive: 30 * time.Second,
+	}
+}
+
+// dial connects to addr, through the given dialer, and makes the connection
+// fail whenever it makes no progress for `s3_request_timeout`.
+func (s3 S3ConnectionInfo) dial(dial func(network, addr string) (net.Conn, error)) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		conn, err := dial(network, addr)
+		if err != nil || s3.RequestTimeout <= 0 {
+			return conn, err
+		}
+		return &idleTimeoutConn{Conn: conn, timeout: s3.requestTimeout()}, nil
+	}
+}
+
+// idleTimeoutConn is a connection whose reads and writes time out when
+// nothing goes through it for a while.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
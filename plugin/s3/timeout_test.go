@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Timeouts", func() {
+	var (
+		server  *httptest.Server
+		release chan struct{}
+		stall   string
+	)
+
+	BeforeEach(func() {
+		release = make(chan struct{})
+		stall = ""
+		server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if stall == "body" {
+				w.Header().Set("Content-Length", "10")
+				fmt.Fprintf(w, "01234")
+				w.(http.Flusher).Flush()
+			}
+			if stall != "" {
+				<-release
+			}
+			fmt.Fprintf(w, "56789")
+		}))
+	})
+
+	AfterEach(func() {
+		close(release)
+		server.Close()
+	})
+
+	get := func(s3 S3ConnectionInfo) ([]byte, error) {
+		s3.SkipSSLValidation = true
+		transport, err := s3.Transport()
+		Ω(err).ShouldNot(HaveOccurred())
+		res, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		return ioutil.ReadAll(res.Body)
+	}
+
+	It("builds the client with the configured timeouts", func() {
+		s3 := S3ConnectionInfo{ConnectTimeout: 7, RequestTimeout: 42}
+		transport, err := s3.Transport()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(transport.(*http.Transport).ResponseHeaderTimeout).Should(Equal(42 * time.Second))
+		Ω(s3.dialer().Timeout).Should(Equal(7 * time.Second))
+	})
+
+	It("waits for S3 as long as it takes, by default", func() {
+		b, err := get(S3ConnectionInfo{ConnectTimeout: DefaultConnectTimeout, RequestTimeout: DefaultRequestTimeout})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(b)).Should(Equal("56789"))
+	})
+
+	It("gives up on requests that S3 does not respond to", func() {
+		stall = "headers"
+		started := time.Now()
+		_, err := get(S3ConnectionInfo{ConnectTimeout: 5, RequestTimeout: 1})
+		Ω(err).Should(HaveOccurred())
+		Ω(time.Since(started)).Should(BeNumerically("<", 5*time.Second))
+	})
+
+	It("gives up on transfers that stall halfway", func() {
+		stall = "body"
+		started := time.Now()
+		_, err := get(S3ConnectionInfo{ConnectTimeout: 5, RequestTimeout: 1})
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("timeout"))
+		Ω(time.Since(started)).Should(BeNumerically("<", 5*time.Second))
+	})
+})
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// warnedInsecure makes sure that skipping TLS verification is only
+// reported once per run, however many clients get set up.
+var warnedInsecure bool
+
+// loadCACert reads a PEM bundle of CA certificates into the system pool.
+func loadCACert(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		plugin.DEBUG("unable to load the system CA pool (%s); only trusting %s", err, path)
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM-encoded certificate found in %s", path)
+	}
+	return pool, nil
+}
+
+// tlsConfig returns the TLS configuration of the clients that talk to S3.
+// When `s3_ca_cert` is set, its CAs are trusted, on top of the system ones,
+// and certificates are verified even if `skip_ssl_validation` is set too.
+func (s3 S3ConnectionInfo) tlsConfig() (*tls.Config, error) {
+	if s3.CACert != "" {
+		pool, err := loadCACert(s3.CACert)
+		if err != nil {
+			return nil, plugin.ConfigError{Key: "s3_ca_cert", Err: err}
+		}
+		if s3.SkipSSLValidation && !warnedInsecure {
+			plugin.Fprintf(os.Stderr, "@Y{s3_ca_cert is set; ignoring skip_ssl_validation, and verifying the certificate of %s}\n", s3.Host)
+			warnedInsecure = true
+		}
+		return &tls.Config{RootCAs: pool}, nil
+	}
+
+	if s3.SkipSSLValidation && !warnedInsecure {
+		plugin.Fprintf(os.Stderr, "@Y{WARNING: the certificate of %s is NOT verified (skip_ssl_validation); consider setting s3_ca_cert instead}\n", s3.Host)
+		warnedInsecure = true
+	}
+	return &tls.Config{InsecureSkipVerify: s3.SkipSSLValidation}, nil
+}
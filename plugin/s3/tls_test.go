@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TLS Verification", func() {
+	var (
+		server *httptest.Server
+		tmp    string
+		caCert string
+	)
+
+	BeforeEach(func() {
+		server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(200)
+		}))
+
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-s3-tls-")
+		Ω(err).ShouldNot(HaveOccurred())
+		caCert = filepath.Join(tmp, "ca.pem")
+		b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.TLS.Certificates[0].Certificate[0]})
+		Ω(ioutil.WriteFile(caCert, b, 0644)).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(tmp)
+	})
+
+	get := func(s3 S3ConnectionInfo) error {
+		transport, err := s3.Transport()
+		Ω(err).ShouldNot(HaveOccurred())
+		/* don't reuse connections that were verified differently */
+		transport.(*http.Transport).CloseIdleConnections()
+		res, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+
+	It("rejects self-signed certificates by default", func() {
+		Ω(get(S3ConnectionInfo{})).ShouldNot(Succeed())
+	})
+
+	It("trusts the CAs of s3_ca_cert", func() {
+		Ω(get(S3ConnectionInfo{CACert: caCert})).Should(Succeed())
+	})
+
+	It("verifies certificates when s3_ca_cert is set, even with skip_ssl_validation", func() {
+		s3 := S3ConnectionInfo{CACert: caCert, SkipSSLValidation: true}
+		tlsConfig, err := s3.tlsConfig()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(tlsConfig.InsecureSkipVerify).Should(BeFalse())
+		Ω(tlsConfig.RootCAs).ShouldNot(BeNil())
+	})
+
+	It("skips verification as a last resort", func() {
+		Ω(get(S3ConnectionInfo{SkipSSLValidation: true})).Should(Succeed())
+	})
+
+	It("fails on CA bundles without certificates", func() {
+		Ω(ioutil.WriteFile(caCert, []byte("not a certificate"), 0644)).Should(Succeed())
+		_, err := S3ConnectionInfo{CACert: caCert}.Transport()
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("no PEM-encoded certificate found"))
+	})
+})
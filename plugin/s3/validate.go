@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"time"
+
+	minio "github.com/minio/minio-go"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+// Once its configuration checks out, Validate makes sure that the bucket can
+// be reached, with a HEAD request on it.  Network errors, and the 5xx errors
+// S3 answers with when it is busy, are retried up to `s3_validate_retries`
+// times, a second apart, so that a blip does not fail the validation (and
+// block the creation of jobs).  Errors that retrying won't fix, like denied
+// access, bad credentials or a missing bucket, fail it right away.
+
+const DefaultValidateRetries = 2
+
+// validateRetryDelay is how long to wait before checking the bucket again.
+var validateRetryDelay = 1 * time.Second
+
+// HeadBucket checks that the bucket exists, and can be accessed.
+func (api *S3API) HeadBucket() error {
+	res, err := api.Do("HEAD", "", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// transient tells whether an error is worth retrying the request for.
+func transient(err error) bool {
+	switch e := err.(type) {
+	case *url.Error:
+		/* not certificate errors, only what failed on the network */
+		return transient(e.Err)
+	case net.Error:
+		return true
+	case minio.ErrorResponse:
+		/* bodiless errors (i.e. to HEAD requests) get their HTTP status as code */
+		switch e.Code {
+		case "RequestTimeout", "SlowDown", "InternalError", "ServiceUnavailable",
+			"InternalServerError", "BadGateway", "GatewayTimeout":
+			return true
+		}
+	}
+	return false
+}
+
+// checkBucket checks that the bucket can be reached, trying again after
+// transient errors, up to `retries` times.  It returns how many attempts
+// were made.
+func checkBucket(api *S3API, retries int) (int, error) {
+	for attempt := 1; ; attempt++ {
+		err := api.HeadBucket()
+		if err == nil || !transient(err) || attempt > retries {
+			return attempt, err
+		}
+		plugin.DEBUG("bucket check #%d failed (%s); trying again in %s", attempt, err, validateRetryDelay)
+		time.Sleep(validateRetryDelay)
+	}
+}
+
+// reachBucket checks that the bucket of an endpoint can be reached (see
+// checkBucket).
+func reachBucket(endpoint plugin.ShieldEndpoint) (int, error) {
+	s3, err := getS3ConnInfo(endpoint)
+	if err != nil {
+		return 0, err
+	}
+	api, err := s3.API()
+	if err != nil {
+		return 0, err
+	}
+	return checkBucket(api, s3.ValidateRetries)
+}
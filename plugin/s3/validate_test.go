@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("Bucket Check", func() {
+	var (
+		server   *httptest.Server
+		info     S3ConnectionInfo
+		statuses []int
+		heads    int
+		delay    time.Duration
+	)
+
+	BeforeEach(func() {
+		statuses = []int{}
+		heads = 0
+		server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Ω(r.Method).Should(Equal("HEAD"))
+			Ω(r.URL.Path).Should(Equal("/bucket/"))
+			heads++
+			if len(statuses) > 0 {
+				w.WriteHeader(statuses[0])
+				statuses = statuses[1:]
+			}
+		}))
+
+		u, err := url.Parse(server.URL)
+		Ω(err).ShouldNot(HaveOccurred())
+		info = S3ConnectionInfo{
+			Host:              u.Hostname(),
+			Port:              u.Port(),
+			SkipSSLValidation: true,
+			AccessKey:         "AKID",
+			SecretKey:         "secret",
+			Bucket:            "bucket",
+			SignatureVersion:  "2",
+		}
+
+		delay = validateRetryDelay
+		validateRetryDelay = 0
+	})
+
+	AfterEach(func() {
+		validateRetryDelay = delay
+		server.Close()
+	})
+
+	check := func(retries int) (int, error) {
+		api, err := info.API()
+		Ω(err).ShouldNot(HaveOccurred())
+		return checkBucket(api, retries)
+	}
+
+	It("tries again after a transient failure", func() {
+		statuses = []int{http.StatusServiceUnavailable}
+		attempts, err := check(DefaultValidateRetries)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(attempts).Should(Equal(2))
+		Ω(heads).Should(Equal(2))
+	})
+
+	It("gives up after the configured number of retries", func() {
+		statuses = []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable}
+		attempts, err := check(2)
+		Ω(err).Should(HaveOccurred())
+		Ω(attempts).Should(Equal(3))
+
+		statuses = []int{http.StatusServiceUnavailable}
+		attempts, err = check(0)
+		Ω(err).Should(HaveOccurred())
+		Ω(attempts).Should(Equal(1))
+	})
+
+	It("does not retry denied access, nor missing buckets", func() {
+		for _, status := range []int{http.StatusForbidden, http.StatusNotFound} {
+			heads = 0
+			statuses = []int{status}
+			attempts, err := check(DefaultValidateRetries)
+			Ω(err).Should(HaveOccurred())
+			Ω(attempts).Should(Equal(1))
+			Ω(heads).Should(Equal(1))
+		}
+	})
+
+	It("retries network errors", func() {
+		server.Close()
+		attempts, err := check(DefaultValidateRetries)
+		Ω(err).Should(HaveOccurred())
+		Ω(transient(err)).Should(BeTrue())
+		Ω(attempts).Should(Equal(DefaultValidateRetries + 1))
+	})
+
+	It("validates an endpoint whose bucket is reachable at the second attempt", func() {
+		statuses = []int{http.StatusServiceUnavailable}
+		endpoint := plugin.ShieldEndpoint{
+			"s3_host":             info.Host,
+			"s3_port":             info.Port,
+			"skip_ssl_validation": true,
+			"access_key_id":       "AKID",
+			"secret_access_key":   "secret",
+			"bucket":              "bucket",
+			"signature_version":   "2",
+		}
+		Ω(S3Plugin{}.Validate(endpoint)).Should(Succeed())
+		Ω(heads).Should(Equal(2))
+
+		statuses = []int{http.StatusForbidden}
+		Ω(S3Plugin{}.Validate(endpoint)).ShouldNot(Succeed())
+	})
+})
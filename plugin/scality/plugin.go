@@ -204,7 +204,7 @@ func (p ScalityPlugin) Validate(endpoint plugin.ShieldEndpoint) error {
 	}
 
 	if fail {
-		return fmt.Errorf("scality: invalid configuration")
+		return plugin.ValidationError{Plugin: "scality"}
 	}
 	return nil
 }
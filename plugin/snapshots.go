@@ -0,0 +1,51 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// SnapshotLister can be implemented by target plugins that keep snapshots
+// of the data they back up on the target system itself.  It is used by the
+// `list-snapshots` command, which prints them as JSON.
+type SnapshotLister interface {
+	Snapshots(ShieldEndpoint) ([]Snapshot, error)
+}
+
+// Snapshot is a snapshot kept on the target system.  Generation tells the
+// snapshots of a series apart, when the plugin keeps several of them; Bytes
+// is the size of the files of the snapshot, whether or not they share their
+// blocks with the live data.
+type Snapshot struct {
+	Name       string    `json:"name"`
+	Generation string    `json:"generation,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	Bytes      int64     `json:"bytes"`
+}
+
+func listSnapshots(p Plugin, endpoint ShieldEndpoint) error {
+	l, ok := p.(SnapshotLister)
+	if !ok {
+		return UnsupportedActionError{Action: "list-snapshots"}
+	}
+	snapshots, err := l.Snapshots(endpoint)
+	if err != nil {
+		return err
+	}
+	if snapshots == nil {
+		snapshots = []Snapshot{}
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.Before(snapshots[j].CreatedAt)
+	})
+	DEBUG("%d snapshots", len(snapshots))
+
+	output, err := json.MarshalIndent(snapshots, "", "    ")
+	if err != nil {
+		return JSONError{Err: fmt.Sprintf("Could not JSON encode snapshots: %s", err.Error())}
+	}
+	fmt.Printf("%s\n", string(output))
+	return nil
+}
@@ -0,0 +1,13 @@
+package plugin
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Listing Snapshots", func() {
+	It("is not supported by plugins that keep no snapshots", func() {
+		err := listSnapshots(nil, ShieldEndpoint{})
+		Ω(err).Should(Equal(UnsupportedActionError{Action: "list-snapshots"}))
+	})
+})
@@ -0,0 +1,94 @@
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SSLModes are the ways a plugin can secure its connections to a database
+// server: `disable`, `require` (encrypted, without checking the certificate
+// of the server), `verify-ca` (signed by a given CA), or `verify-full`
+// (signed by that CA, and issued for the host).  An empty mode leaves the
+// client default in place.
+var SSLModes = []string{"disable", "require", "verify-ca", "verify-full"}
+
+// SSLSettings are the TLS settings of an endpoint: the SSL mode, the CA to
+// check the server against, and the client certificate and key.
+type SSLSettings struct {
+	SSLMode string
+	SSLCA   string
+	SSLCert string
+	SSLKey  string
+}
+
+// ValidSSLMode tells whether mode is one of SSLModes, or empty.
+func ValidSSLMode(mode string) bool {
+	if mode == "" {
+		return true
+	}
+	for _, m := range SSLModes {
+		if mode == m {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifiesServer tells whether an SSL mode checks the certificate of the
+// server, against the CA.
+func VerifiesServer(mode string) bool {
+	return mode == "verify-ca" || mode == "verify-full"
+}
+
+// CheckSSLFile checks that a certificate (or key) file exists.
+func CheckSSLFile(path string) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if st.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return nil
+}
+
+// CheckSSL checks that the TLS settings of an endpoint go together, and that
+// the files they name exist.  The ConfigError it returns names the faulty
+// option, i.e. `<prefix>_ssl_mode`, `<prefix>_ssl_ca`, `<prefix>_ssl_cert` or
+// `<prefix>_ssl_key`.
+func CheckSSL(prefix string, ssl SSLSettings) error {
+	key := func(name string) string {
+		return prefix + "_ssl_" + name
+	}
+
+	if !ValidSSLMode(ssl.SSLMode) {
+		return ConfigError{Key: key("mode"), Err: fmt.Errorf("invalid SSL mode '%s' (expected one of %s)", ssl.SSLMode, strings.Join(SSLModes, ", "))}
+	}
+	if ssl.SSLMode == "disable" {
+		return nil
+	}
+	if VerifiesServer(ssl.SSLMode) && ssl.SSLCA == "" {
+		return ConfigError{Key: key("ca"), Err: fmt.Errorf("%s is required to %s", key("ca"), ssl.SSLMode)}
+	}
+	if ssl.SSLCert != "" && ssl.SSLKey == "" {
+		return ConfigError{Key: key("key"), Err: fmt.Errorf("%s is required with %s", key("key"), key("cert"))}
+	}
+	if ssl.SSLKey != "" && ssl.SSLCert == "" {
+		return ConfigError{Key: key("cert"), Err: fmt.Errorf("%s is required with %s", key("cert"), key("key"))}
+	}
+	files := []struct{ key, path string }{
+		{key("ca"), ssl.SSLCA},
+		{key("cert"), ssl.SSLCert},
+		{key("key"), ssl.SSLKey},
+	}
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+		if err := CheckSSLFile(f.path); err != nil {
+			return ConfigError{Key: f.key, Err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TLS Settings", func() {
+	var tmp, ca, cert, key string
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-ssl-")
+		Ω(err).ShouldNot(HaveOccurred())
+		ca, cert, key = filepath.Join(tmp, "ca.pem"), filepath.Join(tmp, "cert.pem"), filepath.Join(tmp, "key.pem")
+		for _, f := range []string{ca, cert, key} {
+			Ω(ioutil.WriteFile(f, []byte("PEM"), 0600)).Should(Succeed())
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	It("knows the SSL modes, and which of them check the server", func() {
+		for _, mode := range append(SSLModes, "") {
+			Ω(ValidSSLMode(mode)).Should(BeTrue(), "mode '%s'", mode)
+		}
+		for _, mode := range []string{"prefer", "allow", "REQUIRED", "verify_ca", " require"} {
+			Ω(ValidSSLMode(mode)).Should(BeFalse(), "mode '%s'", mode)
+		}
+
+		Ω(VerifiesServer("verify-ca")).Should(BeTrue())
+		Ω(VerifiesServer("verify-full")).Should(BeTrue())
+		Ω(VerifiesServer("require")).Should(BeFalse())
+		Ω(VerifiesServer("disable")).Should(BeFalse())
+		Ω(VerifiesServer("")).Should(BeFalse())
+	})
+
+	It("only takes certificate files that exist", func() {
+		Ω(CheckSSLFile(ca)).Should(Succeed())
+		Ω(CheckSSLFile(filepath.Join(tmp, "nope.pem"))).ShouldNot(Succeed())
+		Ω(CheckSSLFile(tmp)).Should(MatchError(tmp + " is a directory"))
+	})
+
+	It("checks that the settings go together, naming the faulty option", func() {
+		missing := filepath.Join(tmp, "nope.pem")
+		for _, t := range []struct {
+			ssl SSLSettings
+			key string
+		}{
+			{SSLSettings{}, ""},
+			{SSLSettings{SSLMode: "require"}, ""},
+			{SSLSettings{SSLMode: "verify-ca", SSLCA: ca}, ""},
+			{SSLSettings{SSLMode: "verify-full", SSLCA: ca, SSLCert: cert, SSLKey: key}, ""},
+			{SSLSettings{SSLCA: ca, SSLCert: cert, SSLKey: key}, ""},
+			/* nothing else matters when TLS is off */
+			{SSLSettings{SSLMode: "disable", SSLCA: missing, SSLCert: cert}, ""},
+
+			{SSLSettings{SSLMode: "prefer"}, "mysql_ssl_mode"},
+			{SSLSettings{SSLMode: "verify-ca"}, "mysql_ssl_ca"},
+			{SSLSettings{SSLMode: "verify-full", SSLCert: cert, SSLKey: key}, "mysql_ssl_ca"},
+			{SSLSettings{SSLMode: "require", SSLCert: cert}, "mysql_ssl_key"},
+			{SSLSettings{SSLMode: "require", SSLKey: key}, "mysql_ssl_cert"},
+			{SSLSettings{SSLMode: "verify-ca", SSLCA: missing}, "mysql_ssl_ca"},
+			{SSLSettings{SSLMode: "verify-ca", SSLCA: tmp}, "mysql_ssl_ca"},
+			{SSLSettings{SSLMode: "require", SSLCert: missing, SSLKey: key}, "mysql_ssl_cert"},
+			{SSLSettings{SSLCert: cert, SSLKey: missing}, "mysql_ssl_key"},
+		} {
+			err := CheckSSL("mysql", t.ssl)
+			if t.key == "" {
+				Ω(err).ShouldNot(HaveOccurred(), "%+v", t.ssl)
+			} else {
+				Ω(err).Should(BeAssignableToTypeOf(ConfigError{}), "%+v", t.ssl)
+				Ω(err.(ConfigError).Key).Should(Equal(t.key), "%+v", t.ssl)
+			}
+		}
+	})
+
+	It("names the options after the plugin that has them", func() {
+		err := CheckSSL("pg", SSLSettings{SSLMode: "verify-full"})
+		Ω(err).Should(BeAssignableToTypeOf(ConfigError{}))
+		Ω(err.(ConfigError).Key).Should(Equal("pg_ssl_ca"))
+		Ω(err).Should(MatchError("pg_ssl_ca is required to verify-full"))
+
+		err = CheckSSL("pg", SSLSettings{SSLMode: "require", SSLCert: cert})
+		Ω(err).Should(MatchError("pg_ssl_key is required with pg_ssl_cert"))
+
+		err = CheckSSL("pg", SSLSettings{SSLMode: "verify"})
+		Ω(err).Should(MatchError("invalid SSL mode 'verify' (expected one of disable, require, verify-ca, verify-full)"))
+	})
+})
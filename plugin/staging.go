@@ -0,0 +1,155 @@
+package plugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+/*
+
+Target plugins stage backup data on disk (i.e. the directories of hard-linked
+SSTables of the cassandra plugin, or the xtrabackup target directory), and
+that data may hold sensitive rows, if only briefly.  Each plugin creates its staging
+directories and files with modes of its own choosing, but any endpoint can
+set `staging_mode`, an octal mode like "0700", to have all of them created
+with that mode instead: directories get it as is, and files get it without
+the execute bits.  The mode is applied with chmod, so that the umask does not
+get in the way.  The owner must keep full access, or the plugin could not
+fill, nor clean up, its own staging directories.
+
+Staging directories are removed at the end of each run, whether it succeeded
+or not.  When `keep_staging_on_failure` is true, the staging directories of a
+run that fails are left behind instead, for the operator to inspect (i.e. the
+half-prepared xtrabackup target directory of a failed restore), and their path
+is printed; successful runs still clean up after themselves.  The next run of
+the plugin removes them, as it does for runs that were interrupted.
+
+*/
+
+var stagingModeRegexp = regexp.MustCompile(`^0?[0-7]{3}$`)
+
+// The mode to create staging directories with, as configured by the
+// endpoint of the action being run; 0 leaves plugins to their own modes.
+var stagingMode os.FileMode
+
+// Whether to leave the staging directories of failed runs behind, as
+// configured by the endpoint of the action being run.
+var keepStagingOnFailure bool
+
+func stagingModeFor(endpoint ShieldEndpoint) (os.FileMode, error) {
+	s, err := endpoint.StringValueDefault("staging_mode", "")
+	if err != nil || s == "" {
+		return 0, err
+	}
+	if !stagingModeRegexp.MatchString(s) {
+		return 0, ConfigError{Key: "staging_mode",
+			Err: fmt.Errorf("staging_mode must be an octal mode, like '0700' (got '%s')", s)}
+	}
+	m, _ := strconv.ParseUint(s, 8, 32)
+	if m&0700 != 0700 {
+		return 0, ConfigError{Key: "staging_mode",
+			Err: fmt.Errorf("staging_mode must give the owner full access (rwx), like '0700' (got '%s')", s)}
+	}
+	return os.FileMode(m), nil
+}
+
+// setStagingMode configures the mode of all subsequently created staging
+// directories and files, and whether to keep them when the run fails.
+func setStagingMode(endpoint ShieldEndpoint) error {
+	m, err := stagingModeFor(endpoint)
+	if err != nil {
+		return err
+	}
+	stagingMode = m
+	if m != 0 {
+		DEBUG("creating staging directories with mode %04o, and files with mode %04o", m, m&^0111)
+	}
+
+	keepStagingOnFailure, err = endpoint.BooleanValueDefault("keep_staging_on_failure", false)
+	if err != nil {
+		return err
+	}
+	if keepStagingOnFailure {
+		DEBUG("keeping the staging directories of failed runs")
+	}
+	return nil
+}
+
+// validateStagingMode prints out the staging mode, for the `validate`
+// action.
+func validateStagingMode(endpoint ShieldEndpoint) error {
+	fail := false
+	if _, ok := endpoint["staging_mode"]; ok {
+		m, err := stagingModeFor(endpoint)
+		if err != nil {
+			Printf("@R{\u2717 staging_mode  %s}\n", err)
+			fail = true
+		} else {
+			Printf("@G{\u2713 staging_mode}  directories @C{%04o}, files @C{%04o}\n", m, m&^0111)
+		}
+	}
+
+	if _, ok := endpoint["keep_staging_on_failure"]; ok {
+		keep, err := endpoint.BooleanValueDefault("keep_staging_on_failure", false)
+		if err != nil {
+			Printf("@R{\u2717 keep_staging_on_failure  %s}\n", err)
+			fail = true
+		} else if keep {
+			Printf("@G{\u2713 keep_staging_on_failure}  @C{yes}, failed runs leave their staging directories behind\n")
+		} else {
+			Printf("@G{\u2713 keep_staging_on_failure}  @C{no}\n")
+		}
+	}
+
+	if fail {
+		return ValidationError{Plugin: "staging"}
+	}
+	return nil
+}
+
+// StagingMode returns the `staging_mode` of the endpoint, or 0 when it is
+// not set.
+func StagingMode() os.FileMode {
+	return stagingMode
+}
+
+// KeepStaging tells whether the staging directory dir, of a run that ended
+// with err, is to be left behind rather than removed: only when the run
+// failed, and the endpoint sets `keep_staging_on_failure`.  It prints the
+// path of the directories it keeps.
+func KeepStaging(dir string, err error) bool {
+	if err == nil || !keepStagingOnFailure {
+		return false
+	}
+	Fprintf(os.Stderr, "@Y{Keeping the staging directory %s of this failed run, for inspection (keep_staging_on_failure);}\n", dir)
+	Fprintf(os.Stderr, "@Y{the next run will remove it.}\n")
+	return true
+}
+
+// MkdirStaging creates a staging directory, along with any missing parent,
+// with the `staging_mode` of the endpoint, or with def when it is not set.
+func MkdirStaging(path string, def os.FileMode) error {
+	if stagingMode == 0 {
+		return os.MkdirAll(path, def)
+	}
+	if err := os.MkdirAll(path, stagingMode); err != nil {
+		return err
+	}
+	return os.Chmod(path, stagingMode)
+}
+
+// WriteStagingFile writes a staging file, with the `staging_mode` of the
+// endpoint (without its execute bits), or with def when it is not set.
+func WriteStagingFile(path string, data []byte, def os.FileMode) error {
+	if stagingMode == 0 {
+		return ioutil.WriteFile(path, data, def)
+	}
+	mode := stagingMode &^ 0111
+	if err := ioutil.WriteFile(path, data, mode); err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
@@ -0,0 +1,131 @@
+package plugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Staging Mode", func() {
+	var tmp string
+	var umask int
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-staging-")
+		Ω(err).ShouldNot(HaveOccurred())
+		umask = syscall.Umask(022)
+	})
+
+	AfterEach(func() {
+		syscall.Umask(umask)
+		stagingMode = 0
+		os.RemoveAll(tmp)
+	})
+
+	mode := func(path string) os.FileMode {
+		fi, err := os.Stat(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		return fi.Mode().Perm()
+	}
+
+	It("parses octal modes that leave the owner full access", func() {
+		for s, m := range map[string]os.FileMode{"": 0, "0700": 0700, "750": 0750, "0777": 0777} {
+			Ω(stagingModeFor(ShieldEndpoint{"staging_mode": s})).Should(Equal(m), s)
+		}
+		Ω(stagingModeFor(ShieldEndpoint{})).Should(Equal(os.FileMode(0)))
+
+		for _, s := range []string{"0800", "rwx", "07000", "0600", "0500", "70"} {
+			_, err := stagingModeFor(ShieldEndpoint{"staging_mode": s})
+			Ω(err).Should(HaveOccurred(), s)
+			Ω(codeForError(err)).Should(Equal(ENDPOINT_BAD_DATA))
+		}
+	})
+
+	It("leaves plugins to their own modes by default", func() {
+		Ω(setStagingMode(ShieldEndpoint{})).Should(Succeed())
+		Ω(MkdirStaging(filepath.Join(tmp, "a", "b"), 0755)).Should(Succeed())
+		Ω(mode(filepath.Join(tmp, "a", "b"))).Should(Equal(os.FileMode(0755)))
+		Ω(WriteStagingFile(filepath.Join(tmp, "a", "f"), []byte("rows"), 0644)).Should(Succeed())
+		Ω(mode(filepath.Join(tmp, "a", "f"))).Should(Equal(os.FileMode(0644)))
+	})
+
+	It("creates staging directories and files with the configured mode, whatever the umask", func() {
+		Ω(setStagingMode(ShieldEndpoint{"staging_mode": "0770"})).Should(Succeed())
+		Ω(MkdirStaging(filepath.Join(tmp, "a", "b"), 0755)).Should(Succeed())
+		Ω(mode(filepath.Join(tmp, "a", "b"))).Should(Equal(os.FileMode(0770)))
+		Ω(WriteStagingFile(filepath.Join(tmp, "a", "f"), []byte("rows"), 0644)).Should(Succeed())
+		Ω(mode(filepath.Join(tmp, "a", "f"))).Should(Equal(os.FileMode(0660)))
+		Ω(ioutil.ReadFile(filepath.Join(tmp, "a", "f"))).Should(Equal([]byte("rows")))
+
+		/* existing directories are locked down too */
+		Ω(os.MkdirAll(filepath.Join(tmp, "c"), 0755)).Should(Succeed())
+		Ω(MkdirStaging(filepath.Join(tmp, "c"), 0755)).Should(Succeed())
+		Ω(mode(filepath.Join(tmp, "c"))).Should(Equal(os.FileMode(0770)))
+	})
+})
+
+var _ = Describe("Keeping Staging Directories", func() {
+	var tmp string
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-staging-")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		keepStagingOnFailure = false
+		os.RemoveAll(tmp)
+	})
+
+	/* run stages some data, and cleans up the way plugins do */
+	run := func(fail error) (err error) {
+		dir := filepath.Join(tmp, "staging")
+		Ω(MkdirStaging(dir, 0755)).Should(Succeed())
+		defer func() {
+			if KeepStaging(dir, err) {
+				return
+			}
+			os.RemoveAll(dir)
+		}()
+		Ω(WriteStagingFile(filepath.Join(dir, "rows"), []byte("rows"), 0644)).Should(Succeed())
+		return fail
+	}
+
+	staged := func() bool {
+		_, err := os.Stat(filepath.Join(tmp, "staging", "rows"))
+		return err == nil
+	}
+
+	It("removes the staging directories of all runs by default", func() {
+		Ω(setStagingMode(ShieldEndpoint{})).Should(Succeed())
+		Ω(run(nil)).Should(Succeed())
+		Ω(staged()).Should(BeFalse())
+		Ω(run(fmt.Errorf("restore failed"))).ShouldNot(Succeed())
+		Ω(staged()).Should(BeFalse())
+	})
+
+	It("keeps the staging directories of failed runs, with keep_staging_on_failure", func() {
+		Ω(setStagingMode(ShieldEndpoint{"keep_staging_on_failure": true})).Should(Succeed())
+		Ω(run(fmt.Errorf("restore failed"))).ShouldNot(Succeed())
+		Ω(staged()).Should(BeTrue())
+	})
+
+	It("still removes the staging directories of successful runs, with keep_staging_on_failure", func() {
+		Ω(setStagingMode(ShieldEndpoint{"keep_staging_on_failure": true})).Should(Succeed())
+		Ω(run(nil)).Should(Succeed())
+		Ω(staged()).Should(BeFalse())
+	})
+
+	It("only takes booleans", func() {
+		Ω(setStagingMode(ShieldEndpoint{"keep_staging_on_failure": "sure"})).ShouldNot(Succeed())
+		Ω(validateStagingMode(ShieldEndpoint{"keep_staging_on_failure": "sure"})).ShouldNot(Succeed())
+		Ω(validateStagingMode(ShieldEndpoint{"keep_staging_on_failure": true})).Should(Succeed())
+	})
+})
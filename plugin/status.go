@@ -0,0 +1,120 @@
+package plugin
+
+/*
+
+The status endpoint lets operators check on a long backup (or restore, or
+upload...) while it runs, with a plain `curl`.  When the plugin is given
+`--status-port PORT`, it serves the progress of the action over HTTP, on
+localhost (or on the address given with `--status-bind`), until the action
+is done:
+
+    $ curl http://127.0.0.1:8999/status
+    {"action":"backup","elapsed":1234.5,"bytes":1048576,"step":"running 'xtrabackup'"}
+
+`elapsed` is in seconds, `bytes` is only there once the plugin reported
+how much data it moved (see ReportBytes), or once Exec counted some (see
+CountingReader), and `step` is what the plugin is busy with: the last step
+it announced with SetStep, or the command it last spawned through Exec.
+
+Failing to serve the status never fails the action; it is only reported
+on standard error.  There is no authentication: bind to another address
+than localhost with care.
+
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultStatusBind is the address the status endpoint listens on, unless
+// --status-bind says otherwise.
+const DefaultStatusBind = "127.0.0.1"
+
+type Status struct {
+	Action  string  `json:"action"`
+	Elapsed float64 `json:"elapsed"`
+	Bytes   *int64  `json:"bytes,omitempty"`
+	Step    string  `json:"step,omitempty"`
+}
+
+var status struct {
+	sync.Mutex
+	action  string
+	started time.Time
+	step    string
+}
+
+// SetStep records what the plugin is busy with, for the status endpoint.
+func SetStep(format string, args ...interface{}) {
+	step := fmt.Sprintf(format, args...)
+	status.Lock()
+	status.step = step
+	status.Unlock()
+}
+
+// startStatus records the action that is starting.
+func startStatus(action string, started time.Time) {
+	status.Lock()
+	status.action = action
+	status.started = started
+	status.step = ""
+	status.Unlock()
+}
+
+func currentStatus() Status {
+	status.Lock()
+	defer status.Unlock()
+	return Status{
+		Action:  status.action,
+		Elapsed: time.Since(status.started).Seconds(),
+		Bytes:   reportedBytes(),
+		Step:    status.step,
+	}
+}
+
+func serveStatusJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := json.Marshal(currentStatus())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
+
+// serveStatus starts the status endpoint, if --status-port is set, and
+// returns the function that stops it.
+func serveStatus(opt Opt) func() {
+	if opt.StatusPort <= 0 {
+		return func() {}
+	}
+	bind := opt.StatusBind
+	if bind == "" {
+		bind = DefaultStatusBind
+	}
+	addr := net.JoinHostPort(bind, fmt.Sprintf("%d", opt.StatusPort))
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		Fprintf(os.Stderr, "@Y{unable to serve the status: %s}\n", err)
+		return func() {}
+	}
+	DEBUG("serving the status on http://%s/status", l.Addr())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", serveStatusJSON)
+	server := &http.Server{Handler: mux}
+	go server.Serve(l)
+	return func() {
+		server.Close()
+	}
+}
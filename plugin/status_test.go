@@ -0,0 +1,62 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Status Endpoint", func() {
+	var port int
+
+	BeforeEach(func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Ω(err).ShouldNot(HaveOccurred())
+		port = l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		resultBytes = nil
+	})
+
+	AfterEach(func() {
+		resultBytes = nil
+	})
+
+	get := func() (*http.Response, error) {
+		return http.Get(fmt.Sprintf("http://127.0.0.1:%d/status", port))
+	}
+
+	It("serves the progress of the action until it is stopped", func() {
+		startStatus("backup", time.Now().Add(-90*time.Second))
+		stop := serveStatus(Opt{StatusPort: port})
+
+		SetStep("running '%s'", "tar")
+		ReportBytes(2048)
+		res, err := get()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(res.StatusCode).Should(Equal(200))
+		Ω(res.Header.Get("Content-Type")).Should(Equal("application/json"))
+
+		var s Status
+		Ω(json.NewDecoder(res.Body).Decode(&s)).Should(Succeed())
+		res.Body.Close()
+		Ω(s.Action).Should(Equal("backup"))
+		Ω(s.Elapsed).Should(BeNumerically(">=", 90))
+		Ω(*s.Bytes).Should(Equal(int64(2048)))
+		Ω(s.Step).Should(Equal("running 'tar'"))
+
+		stop()
+		_, err = get()
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("is off unless a port is given", func() {
+		serveStatus(Opt{})()
+		_, err := get()
+		Ω(err).Should(HaveOccurred())
+	})
+})
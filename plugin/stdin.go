@@ -0,0 +1,92 @@
+package plugin
+
+/*
+
+Endpoints hold credentials, and passing them with `--endpoint` puts them on
+the command line of the plugin, for anyone on the host to read in `ps`.
+When a plugin is run without a command, and its standard input is not a
+terminal, it reads the request from its standard input instead, as a single
+line of JSON:
+
+    {"action":"backup","endpoint":{"host":"...","password":"..."}}
+    {"action":"retrieve","endpoint":{...},"key":"2024/01/02/..."}
+
+`action` is the command to run, `endpoint` the endpoint configuration, as
+an object, `key` the storage handle, for retrieve and purge, and `target`
+the target endpoint configuration, for retrieve-restore.  Options
+(--debug, --job-id, --result-file, ...) are still given on the command line.
+
+The line must end with a newline, and is read byte by byte, so that nothing
+past it is consumed: for restore and store, the archive follows it, on the
+same standard input.  Running the plugin with a command keeps reading the
+endpoint from `--endpoint`, as it always did.
+
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// MaxStdinRequest is the size limit of requests read from standard input.
+const MaxStdinRequest = 1024 * 1024
+
+// StdinRequest is a request read from standard input.
+type StdinRequest struct {
+	Action   string          `json:"action"`
+	Endpoint json.RawMessage `json:"endpoint"`
+	Key      string          `json:"key,omitempty"`
+	Target   json.RawMessage `json:"target,omitempty"`
+}
+
+// stdinIsTerminal tells whether standard input is a terminal, on which no
+// request is to be expected.
+func stdinIsTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// readRequest reads a request off `in`, up to (and including) the newline
+// that ends it, and no further.
+func readRequest(in io.Reader) (StdinRequest, error) {
+	var (
+		req  StdinRequest
+		line []byte
+		b    = make([]byte, 1)
+	)
+	for {
+		n, err := in.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+			if len(line) > MaxStdinRequest {
+				return req, JSONError{Err: fmt.Sprintf("Request read from standard input is larger than %d bytes", MaxStdinRequest)}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return req, err
+		}
+	}
+
+	if len(bytes.TrimSpace(line)) == 0 {
+		return req, JSONError{Err: "No request found on standard input (and no command given)"}
+	}
+	if err := json.Unmarshal(line, &req); err != nil {
+		return req, JSONError{Err: fmt.Sprintf("Error trying to parse the request read from standard input as JSON: %s", err.Error())}
+	}
+	if req.Action == "" {
+		return req, JSONError{Err: "Request read from standard input has no 'action'"}
+	}
+	if len(req.Endpoint) == 0 || bytes.Equal(req.Endpoint, []byte("null")) {
+		return req, JSONError{Err: "Request read from standard input has no 'endpoint'"}
+	}
+	return req, nil
+}
@@ -0,0 +1,58 @@
+package plugin
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Requests on Standard Input", func() {
+	It("reads the action, the endpoint and the key", func() {
+		req, err := readRequest(strings.NewReader(`{"action":"retrieve","endpoint":{"password":"sekrit"},"key":"a/b/c"}` + "\n"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(req.Action).Should(Equal("retrieve"))
+		Ω(req.Key).Should(Equal("a/b/c"))
+
+		endpoint, err := getEndpoint(string(req.Endpoint))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(endpoint.StringValue("password")).Should(Equal("sekrit"))
+	})
+
+	It("leaves what follows the request to be read, i.e. the archive", func() {
+		in := bytes.NewBufferString(`{"action":"restore","endpoint":{}}` + "\n" + "archive\ndata")
+		req, err := readRequest(in)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(req.Action).Should(Equal("restore"))
+		Ω(ioutil.ReadAll(in)).Should(Equal([]byte("archive\ndata")))
+	})
+
+	It("accepts a request without a trailing newline", func() {
+		req, err := readRequest(strings.NewReader(`{"action":"backup","endpoint":{}}`))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(req.Action).Should(Equal("backup"))
+	})
+
+	It("rejects incomplete or malformed requests", func() {
+		for _, in := range []string{
+			"",
+			"\n",
+			"not json\n",
+			`{"endpoint":{}}` + "\n",
+			`{"action":"backup"}` + "\n",
+			`{"action":"backup","endpoint":null}` + "\n",
+		} {
+			_, err := readRequest(strings.NewReader(in))
+			Ω(err).Should(HaveOccurred(), in)
+			Ω(err).Should(BeAssignableToTypeOf(JSONError{}), in)
+		}
+	})
+
+	It("does not read more than MaxStdinRequest bytes", func() {
+		_, err := readRequest(strings.NewReader(`{"action":"` + strings.Repeat("x", MaxStdinRequest) + `"}` + "\n"))
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("larger than"))
+	})
+})
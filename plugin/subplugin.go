@@ -0,0 +1,53 @@
+package plugin
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Some plugins hand (parts of) their work over to other plugins, i.e. the
+// `tee` store plugin, that stores archives with several storage plugins.
+// SubPluginPath() and SubPluginCommand() run such sub-plugins the way
+// SHIELD would.
+
+// SubPluginPath finds the executable of a plugin, given its name: plugins
+// installed alongside the running one are preferred over those in $PATH.
+// Names that contain a slash are used as is.
+func SubPluginPath(name string) (string, error) {
+	if strings.Contains(name, "/") {
+		return name, nil
+	}
+	if self, err := os.Executable(); err == nil {
+		path := filepath.Join(filepath.Dir(self), name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return exec.LookPath(name)
+}
+
+// SubPluginCommand prepares the command that runs `action` with the given
+// plugin, against endpoint; args are appended to the command line (i.e.
+// "-k", key).  The standard error of the sub-plugin is ours.
+func SubPluginCommand(name string, endpoint map[string]interface{}, action string, args ...string) (*exec.Cmd, error) {
+	bin, err := SubPluginPath(name)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint == nil {
+		endpoint = map[string]interface{}{}
+	}
+	b, err := json.Marshal(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	args = append([]string{action, "--endpoint", string(b)}, args...)
+	DEBUG("Executing: `%s %s`", bin, action)
+	cmd := exec.Command(bin, args...)
+	cmd.Stderr = os.Stderr
+	return cmd, nil
+}
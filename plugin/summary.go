@@ -0,0 +1,48 @@
+package plugin
+
+import (
+	"regexp"
+	"strings"
+)
+
+// SummaryMaxLength is how long (in characters) the summaries of failed
+// commands may get, in errors and notifications.
+var SummaryMaxLength = 200
+
+// summaryRegexp matches the lines of error output that tell what went wrong,
+// e.g. the `[ERROR]` lines of xtrabackup, the `error:` lines of nodetool, or
+// the exceptions of Java tools, as opposed to their progress messages.
+var summaryRegexp = regexp.MustCompile(`\bERROR\b|\bFATAL\b|(?i:\berror:)|Exception\b`)
+
+// causeRegexp matches the root causes of Java stack traces.
+var causeRegexp = regexp.MustCompile(`^Caused by: `)
+
+// SummarizeOutput returns the line of the error output of a failed command
+// that is most likely to tell what went wrong, i.e. the first line that
+// reports an error or an exception, followed by the last `Caused by:` line
+// of the stack trace, if any.  The summary is cut short past
+// SummaryMaxLength characters.  It is empty when no line looks like an
+// error, in which case the output is best read in full.
+func SummarizeOutput(output string) string {
+	var summary, cause string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if summary == "" {
+			if summaryRegexp.MatchString(line) {
+				summary = line
+			}
+			continue
+		}
+		if causeRegexp.MatchString(line) {
+			cause = line
+		}
+	}
+	if cause != "" {
+		summary += " (" + cause + ")"
+	}
+
+	if r := []rune(summary); len(r) > SummaryMaxLength {
+		summary = strings.TrimSpace(string(r[:SummaryMaxLength])) + "..."
+	}
+	return summary
+}
@@ -0,0 +1,67 @@
+package plugin
+
+import (
+	"errors"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Error Summaries", func() {
+	It("picks the [ERROR] line out of xtrabackup logs", func() {
+		log := `xtrabackup: recognized server arguments: --datadir=/var/lib/mysql
+240131 02:00:01  version_check Connecting to MySQL server with DSN 'dbi:mysql:;mysql_read_default_group=xtrabackup' as 'root'  (using password: YES).
+xtrabackup version 8.0.35-30 based on MySQL server 8.0.35 Linux (x86_64)
+2024-01-31T02:00:01.123456-00:00 0 [Note] [MY-011825] [Xtrabackup] Connecting to MySQL server host: localhost, user: root
+2024-01-31T02:00:01.234567-00:00 0 [ERROR] [MY-011825] [Xtrabackup] Failed to connect to MySQL server: Access denied for user 'root'@'localhost' (using password: YES).
+2024-01-31T02:00:01.234600-00:00 0 [ERROR] [MY-011825] [Xtrabackup] failed to connect to MySQL server
+`
+		Ω(SummarizeOutput(log)).Should(Equal("2024-01-31T02:00:01.234567-00:00 0 [ERROR] [MY-011825] [Xtrabackup] Failed to connect to MySQL server: Access denied for user 'root'@'localhost' (using password: YES)."))
+	})
+
+	It("picks the error out of nodetool output", func() {
+		log := `error: Keyspace ks9 does not exist
+-- StackTrace --
+java.io.IOException: Keyspace ks9 does not exist
+	at org.apache.cassandra.service.StorageService.getValidKeyspace(StorageService.java:3393)
+	at org.apache.cassandra.service.StorageService.takeSnapshot(StorageService.java:3156)
+`
+		Ω(SummarizeOutput(log)).Should(Equal("error: Keyspace ks9 does not exist"))
+	})
+
+	It("adds the root cause of Java stack traces", func() {
+		log := `Established connection to initial hosts
+Opening sstables and calculating sections to stream
+Exception in thread "main" java.lang.RuntimeException: Could not load ks1
+	at org.apache.cassandra.tools.BulkLoader.load(BulkLoader.java:95)
+	at org.apache.cassandra.tools.BulkLoader.main(BulkLoader.java:51)
+Caused by: java.lang.RuntimeException: Could not retrieve endpoint ranges
+	at org.apache.cassandra.tools.BulkLoader$ExternalClient.init(BulkLoader.java:342)
+	... 2 more
+Caused by: NoHostAvailableException: All host(s) tried for query failed
+	at com.datastax.driver.core.ControlConnection.reconnectInternal(ControlConnection.java:233)
+`
+		Ω(SummarizeOutput(log)).Should(Equal(`Exception in thread "main" java.lang.RuntimeException: Could not load ks1 (Caused by: NoHostAvailableException: All host(s) tried for query failed)`))
+	})
+
+	It("cuts long summaries short", func() {
+		summary := SummarizeOutput("ERROR " + strings.Repeat("x", 500))
+		Ω([]rune(summary)).Should(HaveLen(SummaryMaxLength + 3))
+		Ω(summary).Should(HaveSuffix("..."))
+	})
+
+	It("has nothing to say about output that reports no error", func() {
+		Ω(SummarizeOutput("")).Should(Equal(""))
+		Ω(SummarizeOutput("This goes to stderr\n")).Should(Equal(""))
+		Ω(SummarizeOutput("Compaction of 3 errors-free sstables\n")).Should(Equal(""))
+	})
+
+	It("ends the message of failed commands with the summary", func() {
+		err := ExecError{Cmd: "nodetool", RC: 2, Stderr: "error: Keyspace ks9 does not exist\n", Err: errors.New("exit status 2")}
+		Ω(err.Error()).Should(Equal("Unable to exec 'nodetool': exit status 2: error: Keyspace ks9 does not exist"))
+
+		err.Stderr = "Nothing to see here\n"
+		Ω(err.Error()).Should(Equal("Unable to exec 'nodetool': exit status 2"))
+	})
+})
@@ -143,7 +143,7 @@ func (p SwiftPlugin) Validate(endpoint plugin.ShieldEndpoint) (err error) {
 		}
 	}
 	if fail {
-		return fmt.Errorf("swift: invalid configuration")
+		return plugin.ValidationError{Plugin: "swift"}
 	}
 	return
 }
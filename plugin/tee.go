@@ -0,0 +1,113 @@
+package plugin
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// How much data Tee() reads from its input at a time.
+const TeeChunkSize = 1024 * 1024
+
+// TeeError is returned by Tee() when some of the outputs failed.  Errors
+// holds one entry per output, in the order the outputs were given, and is
+// nil for the outputs that got the whole stream.
+type TeeError struct {
+	Errors []error
+}
+
+func (e TeeError) Error() string {
+	failed := []string{}
+	for i, err := range e.Errors {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("output #%d: %s", i+1, err))
+		}
+	}
+	return fmt.Sprintf("%d of %d output(s) failed: %s", len(failed), len(e.Errors), strings.Join(failed, "; "))
+}
+
+// Failed returns how many outputs failed.
+func (e TeeError) Failed() int {
+	n := 0
+	for _, err := range e.Errors {
+		if err != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Tee copies everything read from `in` to each of the `outs`, reading the
+// input only once.  Each output is fed by its own goroutine, through a
+// queue of at most `buffer` chunks of TeeChunkSize bytes; when the queue of
+// an output is full, reading stops until that output catches up, so the
+// slowest output throttles the whole stream, and memory usage stays bounded.
+//
+// An output that fails is dropped: the others keep getting the stream.  All
+// the outputs are closed once the input is exhausted (or cannot be read
+// anymore).  Tee returns the error encountered while reading the input, if
+// any, and otherwise a TeeError if any of the outputs failed.
+func Tee(in io.Reader, outs []io.WriteCloser, buffer int) error {
+	if buffer < 1 {
+		buffer = 1
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(outs))
+	queues := make([]chan []byte, len(outs))
+	for i, out := range outs {
+		queues[i] = make(chan []byte, buffer)
+		wg.Add(1)
+		go func(i int, out io.WriteCloser, q chan []byte) {
+			defer wg.Done()
+			for chunk := range q {
+				if errs[i] != nil {
+					/* keep draining, so that we never block the reader */
+					continue
+				}
+				if _, err := out.Write(chunk); err != nil {
+					DEBUG("tee: output #%d failed: %s", i+1, err)
+					errs[i] = err
+				}
+			}
+			if err := out.Close(); err != nil && errs[i] == nil {
+				errs[i] = err
+			}
+		}(i, out, queues[i])
+	}
+
+	var rerr error
+	for {
+		/* each chunk is shared by all outputs, so it cannot be reused */
+		chunk := make([]byte, TeeChunkSize)
+		n, err := io.ReadFull(in, chunk)
+		if n > 0 {
+			for _, q := range queues {
+				q <- chunk[:n]
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			rerr = err
+			break
+		}
+	}
+
+	for _, q := range queues {
+		close(q)
+	}
+	wg.Wait()
+
+	if rerr != nil {
+		return rerr
+	}
+	for _, err := range errs {
+		if err != nil {
+			return TeeError{Errors: errs}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,507 @@
+// The `tee` plugin for SHIELD is a storage plugin that stores each backup
+// archive to several other storage plugins at once (i.e. to a local `fs`
+// store, and to `s3` for disaster recovery), reading the backup stream only
+// once.
+//
+// PLUGIN FEATURES
+//
+// This plugin implements functionality suitable for use with the following
+// SHIELD Job components:
+//
+//    Target: no
+//    Store:  yes
+//
+// PLUGIN CONFIGURATION
+//
+// The endpoint configuration passed to this plugin lists the stores to
+// use, each with the name of its plugin, and the endpoint configuration to
+// give to that plugin. Your endpoint JSON should look something like this:
+//
+//    {
+//        "stores": [
+//            { "name": "local", "plugin": "fs", "endpoint": { "base_dir": "/var/backups" } },
+//            { "name": "dr",    "plugin": "s3", "endpoint": { "bucket": "backups", ... } }
+//        ],
+//        "tee_buffer":     16,   # how many MiB to buffer for each store
+//        "tee_min_stores": 0     # how many stores must succeed (0 means all)
+//    }
+//
+// Default Configuration
+//
+//    {
+//        "tee_buffer":     16,
+//        "tee_min_stores": 0
+//    }
+//
+// Store names must be unique; they default to the name of the plugin. Plugins
+// are looked up next to the `tee` plugin itself first, and then in $PATH,
+// unless they are given as a path.
+//
+// STORE DETAILS
+//
+// The backup stream is fanned out to one `store` process per store. Each of
+// them is fed through a buffer of `tee_buffer` MiB; when the buffer of a store
+// is full, the stream is paused until that store catches up, so the slowest
+// store sets the pace, and memory usage stays bounded. A store that fails is
+// dropped, and the others keep going.
+//
+// Once the stream is over, the outcome of each store is printed. If at least
+// `tee_min_stores` stores succeeded (all of them, by default), the store is
+// successful, and the failures are reported as warnings. Otherwise, the
+// copies that were stored successfully are purged, and the store fails,
+// listing the failure of each store.
+//
+// The `store_key` returned to SHIELD is a JSON object mapping the name of
+// each store that succeeded to the key that store returned.
+//
+// RETRIEVE DETAILS
+//
+// The archive is retrieved from the first store (in configuration order)
+// that has a copy of it. If a store fails before sending any data, the next
+// one is tried.
+//
+// PURGE DETAILS
+//
+// The archive is purged from all the stores that have a copy of it. All the
+// stores are tried, and all the failures are reported.
+//
+// DEPENDENCIES
+//
+// This plugin relies on the storage plugins it is configured to use.
+//
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/starkandwayne/shield/plugin"
+)
+
+var (
+	DefaultBuffer    = 16
+	DefaultMinStores = 0
+)
+
+func main() {
+	p := TeePlugin{
+		Name:    "Tee Storage Plugin",
+		Author:  "Stark & Wayne",
+		Version: "0.0.1",
+		Features: plugin.PluginFeatures{
+			Target: "no",
+			Store:  "yes",
+		},
+		Example: `
+{
+  "stores": [                                   # REQUIRED
+    { "name": "local", "plugin": "fs", "endpoint": { "base_dir": "/var/backups" } },
+    { "name": "dr",    "plugin": "s3", "endpoint": { "bucket": "backups", ... } }
+  ],
+
+  "tee_buffer"     : 16,    # how many MiB to buffer for each store
+  "tee_min_stores" : 0      # how many stores must succeed (0 means all of them)
+}
+`,
+		Defaults: `
+{
+  "tee_buffer"     : 16,
+  "tee_min_stores" : 0
+}
+`,
+		Fields: []plugin.Field{
+			{
+				Name:     "stores",
+				Label:    "Stores",
+				Type:     plugin.MultilineField,
+				Required: true,
+				Help:     "A JSON list of the stores to use, each with its `name`, `plugin`, and `endpoint` configuration.",
+			},
+			{
+				Name:    "tee_buffer",
+				Label:   "Buffer Size (MiB)",
+				Type:    plugin.NumberField,
+				Default: DefaultBuffer,
+				Help:    "How much of the backup stream to buffer for each store, in MiB. The slowest store throttles the stream once its buffer is full.",
+			},
+			{
+				Name:    "tee_min_stores",
+				Label:   "Minimum Successful Stores",
+				Type:    plugin.NumberField,
+				Default: DefaultMinStores,
+				Help:    "How many stores must succeed for the backup to succeed. 0 means all of them.",
+			},
+		},
+	}
+
+	plugin.Run(p)
+}
+
+type TeePlugin plugin.PluginInfo
+
+type Store struct {
+	Name     string                 `json:"name"`
+	Plugin   string                 `json:"plugin"`
+	Endpoint map[string]interface{} `json:"endpoint"`
+}
+
+type TeeInfo struct {
+	Stores    []Store
+	Buffer    int
+	MinStores int
+}
+
+func (p TeePlugin) Meta() plugin.PluginInfo {
+	return plugin.PluginInfo(p)
+}
+
+func (p TeePlugin) Validate(endpoint plugin.ShieldEndpoint) error {
+	var (
+		f    float64
+		err  error
+		fail bool
+	)
+
+	stores, err := getStores(endpoint)
+	if err != nil {
+		plugin.Printf("@R{\u2717 stores          %s}\n", err)
+		fail = true
+	} else {
+		for _, store := range stores {
+			plugin.Printf("@G{\u2713 stores}          @C{%s} (%s plugin)\n", store.Name, store.Plugin)
+		}
+	}
+
+	f, err = endpoint.FloatValueDefault("tee_buffer", float64(DefaultBuffer))
+	if err != nil {
+		plugin.Printf("@R{\u2717 tee_buffer      %s}\n", err)
+		fail = true
+	} else if f < 1 {
+		plugin.Printf("@R{\u2717 tee_buffer      must be at least 1 MiB}\n")
+		fail = true
+	} else {
+		plugin.Printf("@G{\u2713 tee_buffer}      @C{%d} MiB per store\n", int(f))
+	}
+
+	f, err = endpoint.FloatValueDefault("tee_min_stores", float64(DefaultMinStores))
+	if err != nil {
+		plugin.Printf("@R{\u2717 tee_min_stores  %s}\n", err)
+		fail = true
+	} else if f < 0 || (stores != nil && int(f) > len(stores)) {
+		plugin.Printf("@R{\u2717 tee_min_stores  must be between 0 and the number of stores}\n")
+		fail = true
+	} else if f == 0 {
+		plugin.Printf("@G{\u2713 tee_min_stores}  all stores must succeed\n")
+	} else {
+		plugin.Printf("@G{\u2713 tee_min_stores}  @C{%d}\n", int(f))
+	}
+
+	for _, store := range stores {
+		plugin.Printf("\n@C{%s}:\n", store.Name)
+		if err := run(store, nil, os.Stdout, "validate"); err != nil {
+			plugin.Printf("@R{\u2717 %s  %s}\n", store.Name, err)
+			fail = true
+		}
+	}
+
+	if fail {
+		return plugin.ValidationError{Plugin: "tee"}
+	}
+	return nil
+}
+
+func (p TeePlugin) Backup(endpoint plugin.ShieldEndpoint) error {
+	return plugin.UNIMPLEMENTED
+}
+
+func (p TeePlugin) Restore(endpoint plugin.ShieldEndpoint) error {
+	return plugin.UNIMPLEMENTED
+}
+
+func (p TeePlugin) Store(endpoint plugin.ShieldEndpoint) (string, error) {
+	tee, err := getTeeInfo(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	type proc struct {
+		store  Store
+		cmd    *exec.Cmd
+		stdout bytes.Buffer
+		key    string
+		err    error
+	}
+
+	procs := make([]*proc, len(tee.Stores))
+	outs := []io.WriteCloser{}
+	fed := []*proc{}
+	for i, store := range tee.Stores {
+		procs[i] = &proc{store: store}
+		procs[i].cmd, procs[i].err = command(store, "store")
+		if procs[i].err != nil {
+			continue
+		}
+		procs[i].cmd.Stdout = &procs[i].stdout
+		stdin, err := procs[i].cmd.StdinPipe()
+		if err != nil {
+			procs[i].err = err
+			continue
+		}
+		if err = procs[i].cmd.Start(); err != nil {
+			procs[i].err = err
+			continue
+		}
+		outs = append(outs, stdin)
+		fed = append(fed, procs[i])
+	}
+
+	/* failing stores are reported below; only a broken backup stream matters here */
+	err = plugin.Tee(os.Stdin, outs, tee.Buffer)
+	if _, ok := err.(plugin.TeeError); ok {
+		err = nil
+	}
+	if err != nil {
+		/* don't let the stores keep a truncated archive */
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Read backup stream}  %s\n", err)
+		for _, p := range fed {
+			p.cmd.Process.Kill()
+		}
+	}
+	for _, p := range fed {
+		if werr := p.cmd.Wait(); werr != nil {
+			p.err = werr
+			continue
+		}
+		var out struct {
+			Key string `json:"key"`
+		}
+		if jerr := json.Unmarshal(p.stdout.Bytes(), &out); jerr != nil {
+			p.err = fmt.Errorf("unable to parse store output: %s", jerr)
+		} else if out.Key == "" {
+			p.err = fmt.Errorf("no key returned")
+		} else {
+			p.key = out.Key
+		}
+	}
+
+	keys := map[string]string{}
+	failures := []string{}
+	for _, p := range procs {
+		if p.err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Store to %s}  %s\n", p.store.Name, p.err)
+			failures = append(failures, fmt.Sprintf("%s: %s", p.store.Name, p.err))
+			continue
+		}
+		plugin.Fprintf(os.Stderr, "@G{\u2713 Store to %s}  @C{%s}\n", p.store.Name, p.key)
+		keys[p.store.Name] = p.key
+	}
+
+	if err == nil && len(keys) >= tee.MinStores {
+		if len(failures) > 0 {
+			plugin.Fprintf(os.Stderr, "@Y{WARNING: archive stored to only %d of %d stores}\n", len(keys), len(procs))
+		}
+		b, err := json.Marshal(keys)
+		return string(b), err
+	}
+
+	/* the archive will not be recorded, so don't leave copies of it around */
+	for _, p := range procs {
+		if p.key == "" {
+			continue
+		}
+		if perr := run(p.store, nil, os.Stderr, "purge", "-k", p.key); perr != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Purge partial copy from %s}  %s\n", p.store.Name, perr)
+		} else {
+			plugin.Fprintf(os.Stderr, "@G{\u2713 Purge partial copy from %s}\n", p.store.Name)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("archive stored to %d of %d stores (%d required):\n  %s",
+		len(keys), len(procs), tee.MinStores, strings.Join(failures, "\n  "))
+}
+
+func (p TeePlugin) Retrieve(endpoint plugin.ShieldEndpoint, file string) error {
+	tee, err := getTeeInfo(endpoint)
+	if err != nil {
+		return err
+	}
+	keys, err := parseKey(file)
+	if err != nil {
+		return err
+	}
+
+	for _, store := range tee.Stores {
+		key, ok := keys[store.Name]
+		if !ok {
+			continue
+		}
+		out := &countingWriter{w: os.Stdout}
+		err = run(store, nil, out, "retrieve", "-k", key)
+		if err == nil {
+			plugin.Fprintf(os.Stderr, "@G{\u2713 Retrieve from %s}\n", store.Name)
+			return nil
+		}
+		plugin.Fprintf(os.Stderr, "@R{\u2717 Retrieve from %s}  %s\n", store.Name, err)
+		if out.n > 0 {
+			/* some of the archive was already sent; we can't start over */
+			return err
+		}
+	}
+	return fmt.Errorf("unable to retrieve the archive from any of the stores")
+}
+
+func (p TeePlugin) Purge(endpoint plugin.ShieldEndpoint, file string) error {
+	tee, err := getTeeInfo(endpoint)
+	if err != nil {
+		return err
+	}
+	keys, err := parseKey(file)
+	if err != nil {
+		return err
+	}
+
+	failures := []string{}
+	for _, store := range tee.Stores {
+		key, ok := keys[store.Name]
+		if !ok {
+			continue
+		}
+		delete(keys, store.Name)
+		if err = run(store, nil, os.Stderr, "purge", "-k", key); err != nil {
+			plugin.Fprintf(os.Stderr, "@R{\u2717 Purge from %s}  %s\n", store.Name, err)
+			failures = append(failures, fmt.Sprintf("%s: %s", store.Name, err))
+		} else {
+			plugin.Fprintf(os.Stderr, "@G{\u2713 Purge from %s}\n", store.Name)
+		}
+	}
+	for name := range keys {
+		failures = append(failures, fmt.Sprintf("%s: no such store configured", name))
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("unable to purge the archive from %d store(s):\n  %s", len(failures), strings.Join(failures, "\n  "))
+	}
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func parseKey(key string) (map[string]string, error) {
+	keys := map[string]string{}
+	if err := json.Unmarshal([]byte(key), &keys); err != nil {
+		return nil, fmt.Errorf("invalid tee store key '%s': %s", key, err)
+	}
+	return keys, nil
+}
+
+func command(store Store, args ...string) (*exec.Cmd, error) {
+	return plugin.SubPluginCommand(store.Plugin, store.Endpoint, args[0], args[1:]...)
+}
+
+func run(store Store, in io.Reader, out io.Writer, args ...string) error {
+	cmd, err := command(store, args...)
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = in
+	cmd.Stdout = out
+	return cmd.Run()
+}
+
+func getStores(endpoint plugin.ShieldEndpoint) ([]Store, error) {
+	raw, ok := endpoint["stores"]
+	if !ok {
+		return nil, plugin.EndpointMissingRequiredDataError{Key: "stores"}
+	}
+
+	/* the web UI hands us the JSON list as a string */
+	if s, ok := raw.(string); ok {
+		if err := json.Unmarshal([]byte(s), &raw); err != nil {
+			return nil, plugin.ConfigError{Key: "stores", Err: fmt.Errorf("invalid JSON: %s", err)}
+		}
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return nil, plugin.ConfigError{Key: "stores", Err: err}
+	}
+	var stores []Store
+	if err := json.Unmarshal(b, &stores); err != nil {
+		return nil, plugin.ConfigError{Key: "stores", Err: fmt.Errorf("must be a list of stores")}
+	}
+	if len(stores) == 0 {
+		return nil, plugin.ConfigError{Key: "stores", Err: fmt.Errorf("no stores configured")}
+	}
+
+	seen := map[string]bool{}
+	for i := range stores {
+		if stores[i].Plugin == "" {
+			return nil, plugin.ConfigError{Key: "stores", Err: fmt.Errorf("store #%d has no plugin", i+1)}
+		}
+		if stores[i].Name == "" {
+			stores[i].Name = filepath.Base(stores[i].Plugin)
+		}
+		if seen[stores[i].Name] {
+			return nil, plugin.ConfigError{Key: "stores", Err: fmt.Errorf("store name '%s' is used more than once", stores[i].Name)}
+		}
+		seen[stores[i].Name] = true
+		if stores[i].Endpoint == nil {
+			stores[i].Endpoint = map[string]interface{}{}
+		}
+	}
+	return stores, nil
+}
+
+func getTeeInfo(endpoint plugin.ShieldEndpoint) (*TeeInfo, error) {
+	stores, err := getStores(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer, err := endpoint.FloatValueDefault("tee_buffer", float64(DefaultBuffer))
+	if err != nil {
+		return nil, err
+	}
+	if buffer < 1 {
+		return nil, plugin.ConfigError{Key: "tee_buffer", Err: fmt.Errorf("tee_buffer must be at least 1 MiB")}
+	}
+	plugin.DEBUG("TEE_BUFFER: '%d'", int(buffer))
+
+	min, err := endpoint.FloatValueDefault("tee_min_stores", float64(DefaultMinStores))
+	if err != nil {
+		return nil, err
+	}
+	if min < 0 || int(min) > len(stores) {
+		return nil, plugin.ConfigError{Key: "tee_min_stores", Err: fmt.Errorf("tee_min_stores must be between 0 and %d", len(stores))}
+	}
+	if min == 0 {
+		min = float64(len(stores))
+	}
+	plugin.DEBUG("TEE_MIN_STORES: '%d'", int(min))
+
+	for _, store := range stores {
+		plugin.DEBUG("STORE: '%s' (%s plugin)", store.Name, store.Plugin)
+	}
+
+	return &TeeInfo{
+		Stores:    stores,
+		Buffer:    int(buffer) * 1024 * 1024 / plugin.TeeChunkSize,
+		MinStores: int(min),
+	}, nil
+}
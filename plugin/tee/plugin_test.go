@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeStore is a storage plugin that keeps archives in a local directory,
+// and that can be made to fail on purpose.
+const fakeStore = `#!/bin/sh
+set -e
+dir=$(dirname $0)
+name=$(basename $0)
+case $1 in
+store)
+	cat > $dir/$name.data
+	test ! -f $dir/$name.broken
+	echo '{"key":"'$name'-key"}'
+	;;
+retrieve)
+	test ! -f $dir/$name.broken
+	cat $dir/$name.data
+	;;
+purge)
+	echo $5 >> $dir/$name.purged
+	;;
+esac
+`
+
+var _ = Describe("Tee Plugin", func() {
+	var (
+		tmp   string
+		stdin *os.File
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-tee-")
+		Ω(err).ShouldNot(HaveOccurred())
+		for _, name := range []string{"local", "dr", "spare"} {
+			Ω(ioutil.WriteFile(filepath.Join(tmp, name), []byte(fakeStore), 0755)).Should(Succeed())
+		}
+		stdin = os.Stdin
+	})
+
+	AfterEach(func() {
+		os.Stdin = stdin
+		os.RemoveAll(tmp)
+	})
+
+	endpoint := func(min int, names ...string) map[string]interface{} {
+		stores := []interface{}{}
+		for _, name := range names {
+			stores = append(stores, map[string]interface{}{
+				"plugin":   filepath.Join(tmp, name),
+				"endpoint": map[string]interface{}{},
+			})
+		}
+		return map[string]interface{}{
+			"stores":         stores,
+			"tee_min_stores": float64(min),
+		}
+	}
+
+	backup := func(data string) {
+		in := filepath.Join(tmp, "backup")
+		Ω(ioutil.WriteFile(in, []byte(data), 0644)).Should(Succeed())
+		f, err := os.Open(in)
+		Ω(err).ShouldNot(HaveOccurred())
+		os.Stdin = f
+	}
+
+	broken := func(name string) {
+		Ω(ioutil.WriteFile(filepath.Join(tmp, name+".broken"), nil, 0644)).Should(Succeed())
+	}
+
+	contents := func(name string) string {
+		b, err := ioutil.ReadFile(filepath.Join(tmp, name))
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+
+	It("stores the archive to all the stores", func() {
+		backup("the archive")
+		key, err := TeePlugin{}.Store(endpoint(0, "local", "dr"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(contents("local.data")).Should(Equal("the archive"))
+		Ω(contents("dr.data")).Should(Equal("the archive"))
+
+		keys := map[string]string{}
+		Ω(json.Unmarshal([]byte(key), &keys)).Should(Succeed())
+		Ω(keys).Should(Equal(map[string]string{"local": "local-key", "dr": "dr-key"}))
+	})
+
+	It("fails, and purges the copies, when a required store fails", func() {
+		backup("the archive")
+		broken("dr")
+		_, err := TeePlugin{}.Store(endpoint(0, "local", "dr"))
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(HavePrefix("archive stored to 1 of 2 stores (2 required):\n  dr: "))
+		Ω(contents("local.purged")).Should(Equal("local-key\n"))
+	})
+
+	It("succeeds when enough stores succeed", func() {
+		backup("the archive")
+		broken("dr")
+		key, err := TeePlugin{}.Store(endpoint(2, "local", "dr", "spare"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(key).Should(Equal(`{"local":"local-key","spare":"spare-key"}`))
+		Ω(contents("local.purged")).Should(Equal(""))
+	})
+
+	It("retrieves from the next store when one fails", func() {
+		backup("the archive")
+		_, err := TeePlugin{}.Store(endpoint(0, "local", "dr"))
+		Ω(err).ShouldNot(HaveOccurred())
+		broken("local")
+
+		r, w, err := os.Pipe()
+		Ω(err).ShouldNot(HaveOccurred())
+		stdout := os.Stdout
+		os.Stdout = w
+		err = TeePlugin{}.Retrieve(endpoint(0, "local", "dr"), `{"local":"local-key","dr":"dr-key"}`)
+		os.Stdout = stdout
+		w.Close()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		b, err := ioutil.ReadAll(r)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(b)).Should(Equal("the archive"))
+	})
+
+	It("purges the archive from all the stores", func() {
+		err := TeePlugin{}.Purge(endpoint(0, "local", "dr"), `{"local":"local-key","dr":"dr-key"}`)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(contents("local.purged")).Should(Equal("local-key\n"))
+		Ω(contents("dr.purged")).Should(Equal("dr-key\n"))
+
+		err = TeePlugin{}.Purge(endpoint(0, "local"), `{"local":"local-key","gone":"gone-key"}`)
+		Ω(err).Should(MatchError("unable to purge the archive from 1 store(s):\n  gone: no such store configured"))
+	})
+
+	It("rejects invalid store lists", func() {
+		_, err := getStores(map[string]interface{}{"stores": `[{"plugin":"fs"},{"plugin":"/usr/bin/fs"}]`})
+		Ω(err).Should(MatchError("store name 'fs' is used more than once"))
+
+		_, err = getStores(map[string]interface{}{"stores": []interface{}{}})
+		Ω(err).Should(MatchError("no stores configured"))
+
+		stores, err := getStores(map[string]interface{}{"stores": `[{"name":"a","plugin":"fs"}]`})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(stores).Should(Equal([]Store{{Name: "a", Plugin: "fs", Endpoint: map[string]interface{}{}}}))
+	})
+})
@@ -0,0 +1,12 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestTeePlugin(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Tee Plugin Test Suite")
+}
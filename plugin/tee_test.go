@@ -0,0 +1,95 @@
+package plugin
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// teeOutput records what it gets, and can be made slow, or made to fail
+// after a given number of bytes.
+type teeOutput struct {
+	buf    bytes.Buffer
+	delay  time.Duration
+	failAt int
+	closed bool
+}
+
+func (t *teeOutput) Write(b []byte) (int, error) {
+	time.Sleep(t.delay)
+	if t.failAt > 0 && t.buf.Len()+len(b) > t.failAt {
+		return 0, errors.New("disk full")
+	}
+	return t.buf.Write(b)
+}
+
+func (t *teeOutput) Close() error {
+	t.closed = true
+	return nil
+}
+
+type brokenReader struct {
+	r io.Reader
+}
+
+func (b brokenReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("backup died")
+	}
+	return n, err
+}
+
+var _ = Describe("Tee", func() {
+	var data []byte
+
+	BeforeEach(func() {
+		data = bytes.Repeat([]byte("0123456789abcdef"), TeeChunkSize/16*3+1000)
+	})
+
+	It("copies the whole stream to every output", func() {
+		a, b := &teeOutput{}, &teeOutput{}
+		Ω(Tee(bytes.NewReader(data), []io.WriteCloser{a, b}, 2)).Should(Succeed())
+		Ω(a.buf.Bytes()).Should(Equal(data))
+		Ω(b.buf.Bytes()).Should(Equal(data))
+		Ω(a.closed).Should(BeTrue())
+		Ω(b.closed).Should(BeTrue())
+	})
+
+	It("waits for slow outputs", func() {
+		fast, slow := &teeOutput{}, &teeOutput{delay: 20 * time.Millisecond}
+		Ω(Tee(bytes.NewReader(data), []io.WriteCloser{fast, slow}, 1)).Should(Succeed())
+		Ω(slow.buf.Bytes()).Should(Equal(data))
+		Ω(fast.buf.Bytes()).Should(Equal(data))
+	})
+
+	It("keeps feeding the other outputs when one fails", func() {
+		ok, ko := &teeOutput{}, &teeOutput{failAt: TeeChunkSize + 1}
+		err := Tee(bytes.NewReader(data), []io.WriteCloser{ok, ko}, 1)
+		Ω(err).Should(HaveOccurred())
+
+		teeErr, is := err.(TeeError)
+		Ω(is).Should(BeTrue())
+		Ω(teeErr.Failed()).Should(Equal(1))
+		Ω(teeErr.Errors[0]).ShouldNot(HaveOccurred())
+		Ω(teeErr.Errors[1]).Should(MatchError("disk full"))
+		Ω(err.Error()).Should(Equal("1 of 2 output(s) failed: output #2: disk full"))
+
+		Ω(ok.buf.Bytes()).Should(Equal(data))
+		Ω(ko.buf.Len()).Should(Equal(TeeChunkSize))
+		Ω(ko.closed).Should(BeTrue())
+	})
+
+	It("returns errors reading the stream", func() {
+		out := &teeOutput{}
+		err := Tee(brokenReader{strings.NewReader("some data")}, []io.WriteCloser{out}, 1)
+		Ω(err).Should(MatchError("backup died"))
+		Ω(out.buf.String()).Should(Equal("some data"))
+		Ω(out.closed).Should(BeTrue())
+	})
+})
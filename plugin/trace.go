@@ -0,0 +1,89 @@
+package plugin
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+When tracing is enabled (with --trace, or $SHIELD_PLUGIN_TRACE), every
+command run through ExecWithOptions() is logged to standard error as it
+starts, and again as it ends, with its duration and exit code, whether it
+succeeded or not.  This is meant for the analysis of slow or failing
+backups, and is independent of --debug.
+
+Commands are logged with their secrets redacted: the values of any
+`--*password*=...` (or secret / token) options, and whatever plugins have
+registered with RegisterSecret(), i.e. the passwords they put on the
+command lines they build.
+
+*/
+
+var tracing bool
+
+// Where TRACE lines are written to.
+var traceOut io.Writer = os.Stderr
+
+var (
+	secretsLock sync.Mutex
+	secrets     []string
+)
+
+// Redacted is what secrets are replaced with, in traces.
+const Redacted = "<redacted>"
+
+var secretOptionRegexp = regexp.MustCompile(`(?i)(--?[a-z0-9_-]*(?:password|passwd|secret|token)[a-z0-9_-]*=)("[^"]*"|'[^']*'|\S+)`)
+
+// RegisterSecret has s redacted out of any traced command line.
+func RegisterSecret(s string) {
+	if s == "" {
+		return
+	}
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	secrets = append(secrets, s)
+}
+
+// Redact returns s with the secrets it holds replaced with Redacted.
+func Redact(s string) string {
+	secretsLock.Lock()
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, Redacted, -1)
+	}
+	secretsLock.Unlock()
+	return secretOptionRegexp.ReplaceAllString(s, "${1}"+Redacted)
+}
+
+// TRACE logs to standard error, when tracing is enabled.
+func TRACE(format string, args ...interface{}) {
+	if !tracing {
+		return
+	}
+	content := fmt.Sprintf(format, args...)
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		lines[i] = "TRACE> " + line
+	}
+	fmt.Fprintf(traceOut, "%s\n", prefixLines(strings.Join(lines, "\n")))
+}
+
+func traceStamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// traceExec logs the end of a command that started at start.
+func traceExec(cmd string, start time.Time, rc int, err error) {
+	end := time.Now()
+	outcome := "ok"
+	if err != nil {
+		outcome = Redact(err.Error())
+	}
+	TRACE("%s end   rc=%d duration=%s (%s): %s", traceStamp(end), rc,
+		end.Sub(start).Round(time.Millisecond), outcome, Redact(cmd))
+}
@@ -0,0 +1,54 @@
+package plugin
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Command Tracing", func() {
+	var out *bytes.Buffer
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		traceOut = out
+		tracing = true
+	})
+
+	AfterEach(func() {
+		tracing = false
+		traceOut = nil
+		secrets = nil
+	})
+
+	It("redacts registered secrets and password options", func() {
+		RegisterSecret("")
+		RegisterSecret("hunter2")
+		Ω(Redact(`sstableloader -u admin -pw "hunter2" -d host`)).Should(Equal(`sstableloader -u admin -pw "<redacted>" -d host`))
+		Ω(Redact(`xtrabackup --user=root --password=s3cr3t --target-dir=/x`)).Should(Equal(`xtrabackup --user=root --password=<redacted> --target-dir=/x`))
+		Ω(Redact(`tool --api-token='a b' --secret-key="c d" --verbose`)).Should(Equal(`tool --api-token=<redacted> --secret-key=<redacted> --verbose`))
+	})
+
+	It("logs the start, end, duration and exit code of successful commands", func() {
+		Ω(ExecWithOptions(ExecOptions{Cmd: "test/bin/exec_tester 0 --password=hunter2"})).Should(Succeed())
+		Ω(out.String()).Should(MatchRegexp(`^TRACE> \S+Z start test/bin/exec_tester 0 --password=<redacted>\n`))
+		Ω(out.String()).Should(MatchRegexp(`\nTRACE> \S+Z end   rc=0 duration=\S+ \(ok\): test/bin/exec_tester 0 --password=<redacted>\n$`))
+		Ω(out.String()).ShouldNot(ContainSubstring("hunter2"))
+	})
+
+	It("logs the exit code of failed commands, and of expected ones", func() {
+		Ω(ExecWithOptions(ExecOptions{Cmd: "test/bin/exec_tester 1"})).ShouldNot(Succeed())
+		Ω(out.String()).Should(MatchRegexp(`end   rc=1 duration=\S+ \(Unable to exec 'test/bin/exec_tester': exit status 1\)`))
+
+		out.Reset()
+		Ω(ExecWithOptions(ExecOptions{Cmd: "test/bin/exec_tester 1", ExpectRC: []int{0, 1}})).Should(Succeed())
+		Ω(out.String()).Should(MatchRegexp(`end   rc=1 duration=\S+ \(ok\)`))
+	})
+
+	It("logs nothing when tracing is disabled", func() {
+		tracing = false
+		Ω(ExecWithOptions(ExecOptions{Cmd: "test/bin/exec_tester 0"})).Should(Succeed())
+		Ω(out.String()).Should(BeEmpty())
+	})
+})
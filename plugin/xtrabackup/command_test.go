@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("Backup Commands", func() {
+	var (
+		tmp         string
+		listener    net.Listener
+		fake        *FakeExec
+		endpoint    ShieldEndpoint
+		realVersion func(string) ([]byte, error)
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-xtrabackup-commands-")
+		Ω(err).ShouldNot(HaveOccurred())
+		for _, db := range []string{"mysql", "app", "sessions"} {
+			Ω(os.MkdirAll(filepath.Join(tmp, "data", db), 0755)).Should(Succeed())
+		}
+		listener, err = net.Listen("unix", filepath.Join(tmp, "mysqld.sock"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		realVersion = xtrabackupVersion
+		xtrabackupVersion = func(bin string) ([]byte, error) {
+			return []byte(version80), nil
+		}
+		fake = NewFakeExec()
+
+		endpoint = ShieldEndpoint{
+			"mysql_user":           "root",
+			"mysql_password":       "s3cr3t",
+			"mysql_xtrabackup":     "/bin/xtrabackup",
+			"mysql_datadir":        filepath.Join(tmp, "data"),
+			"mysql_temp_targetdir": filepath.Join(tmp, "backups"),
+			"mysql_socket":         filepath.Join(tmp, "mysqld.sock"),
+		}
+	})
+
+	AfterEach(func() {
+		fake.Restore()
+		xtrabackupVersion = realVersion
+		listener.Close()
+		os.RemoveAll(tmp)
+	})
+
+	It("runs xtrabackup, then tar, with the options of the endpoint", func() {
+		endpoint["mysql_databases_exclude"] = "sessions"
+		endpoint["mysql_tables_exclude"] = "^app[.]cache"
+		endpoint["mysql_lock_ddl"] = true
+		endpoint["mysql_compress"] = "quicklz"
+
+		Ω(XtraBackupPlugin{}.Backup(endpoint)).Should(Succeed())
+		Ω(fake.Commands()).Should(Equal([]string{
+			"/bin/xtrabackup --backup --target-dir=" + filepath.Join(tmp, "backups") +
+				" --datadir=" + filepath.Join(tmp, "data") +
+				` --databases="app mysql" --tables-exclude="^app[.]cache" --lock-ddl --compress=quicklz` +
+				" --socket=" + filepath.Join(tmp, "mysqld.sock") +
+				" --user=root --password=s3cr3t",
+			"tar -cf - -C " + filepath.Join(tmp, "backups") + " .",
+		}))
+	})
+
+	It("leaves out the options that are not set", func() {
+		Ω(XtraBackupPlugin{}.Backup(endpoint)).Should(Succeed())
+		Ω(fake.Commands()).Should(Equal([]string{
+			"/bin/xtrabackup --backup --target-dir=" + filepath.Join(tmp, "backups") +
+				" --datadir=" + filepath.Join(tmp, "data") + " " +
+				" --socket=" + filepath.Join(tmp, "mysqld.sock") +
+				" --user=root --password=s3cr3t",
+			"tar -cf - -C " + filepath.Join(tmp, "backups") + " .",
+		}))
+	})
+
+	It("does not archive anything when xtrabackup fails", func() {
+		fake.On(`^/bin/xtrabackup --backup `, FakeFailure(1, "xtrabackup: Error: failed to connect to MySQL server\n"))
+
+		Ω(XtraBackupPlugin{}.Backup(endpoint)).ShouldNot(Succeed())
+		Ω(fake.Commands()).Should(HaveLen(1))
+	})
+})
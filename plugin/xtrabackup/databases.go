@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+// Database exclusion
+//
+// `xtrabackup --databases` only takes the databases to back up.  When
+// `mysql_databases_exclude` is set instead of `mysql_databases`, the
+// databases are enumerated from the data directory, where each one is a
+// subdirectory, and the `--databases` list is made of all of them but the
+// excluded ones.  Databases created after the list was built, while the
+// backup runs, are not backed up.
+
+// listDatabases returns the databases of a MySQL data directory, sorted.
+// Subdirectories that MySQL keeps for itself (i.e. `#innodb_temp`), and
+// `lost+found`, are not databases.
+func listDatabases(dataDir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	dbs := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || strings.HasPrefix(name, "#") || name == "lost+found" {
+			continue
+		}
+		dbs = append(dbs, name)
+	}
+	sort.Strings(dbs)
+	return dbs, nil
+}
+
+// databasesExcept returns the databases that are not excluded, along with
+// the excluded databases that do not exist.
+func databasesExcept(dbs, exclude []string) ([]string, []string) {
+	excluded := map[string]bool{}
+	for _, db := range exclude {
+		excluded[db] = true
+	}
+	kept := []string{}
+	for _, db := range dbs {
+		if excluded[db] {
+			delete(excluded, db)
+			continue
+		}
+		kept = append(kept, db)
+	}
+	missing := []string{}
+	for db := range excluded {
+		missing = append(missing, db)
+	}
+	sort.Strings(missing)
+	return kept, missing
+}
+
+// databasesOption returns the --databases flag to back up with, if any,
+// enumerating the databases when some are excluded.
+func (xtrabackup XtraBackupEndpoint) databasesOption() (string, error) {
+	if xtrabackup.Databases != "" {
+		return fmt.Sprintf(`--databases="%s"`, xtrabackup.Databases), nil
+	}
+	if len(xtrabackup.DatabasesExclude) == 0 {
+		return "", nil
+	}
+
+	if xtrabackup.DataDir == "" {
+		return "", ConfigError{Key: "mysql_datadir", Err: fmt.Errorf("mysql_databases_exclude requires the MySQL data directory, to list the databases; please set mysql_datadir")}
+	}
+	all, err := listDatabases(xtrabackup.DataDir)
+	if err != nil {
+		return "", err
+	}
+	dbs, missing := databasesExcept(all, xtrabackup.DatabasesExclude)
+	for _, db := range missing {
+		Fprintf(os.Stderr, "@Y{Excluded database '%s' does not exist in %s}\n", db, xtrabackup.DataDir)
+	}
+	if len(dbs) == 0 {
+		return "", fmt.Errorf("all the databases of %s are excluded; there is nothing to back up", xtrabackup.DataDir)
+	}
+	DEBUG("Backing up databases %v (excluding %v)", dbs, xtrabackup.DatabasesExclude)
+	return fmt.Sprintf(`--databases="%s"`, strings.Join(dbs, " ")), nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Database Exclusion", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "shield-xtrabackup-databases-")
+		Ω(err).ShouldNot(HaveOccurred())
+		for _, dir := range []string{"mysql", "app", "sessions", "#innodb_temp", "lost+found"} {
+			Ω(os.MkdirAll(filepath.Join(dataDir, dir), 0755)).Should(Succeed())
+		}
+		Ω(ioutil.WriteFile(filepath.Join(dataDir, "ibdata1"), []byte("data"), 0644)).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dataDir)
+	})
+
+	It("lists the databases of the data directory", func() {
+		Ω(listDatabases(dataDir)).Should(Equal([]string{"app", "mysql", "sessions"}))
+
+		_, err := listDatabases(filepath.Join(dataDir, "nope"))
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("leaves the excluded databases out", func() {
+		dbs, missing := databasesExcept([]string{"app", "mysql", "sessions"}, []string{"sessions", "gone"})
+		Ω(dbs).Should(Equal([]string{"app", "mysql"}))
+		Ω(missing).Should(Equal([]string{"gone"}))
+	})
+
+	It("builds the --databases flag", func() {
+		xtrabackup := XtraBackupEndpoint{DataDir: dataDir}
+		Ω(xtrabackup.databasesOption()).Should(Equal(""))
+
+		xtrabackup.DatabasesExclude = []string{"sessions"}
+		Ω(xtrabackup.databasesOption()).Should(Equal(`--databases="app mysql"`))
+
+		xtrabackup.Databases = "db1 db2"
+		Ω(xtrabackup.databasesOption()).Should(Equal(`--databases="db1 db2"`))
+	})
+
+	It("fails when all the databases are excluded", func() {
+		xtrabackup := XtraBackupEndpoint{DataDir: dataDir, DatabasesExclude: []string{"app", "mysql", "sessions"}}
+		_, err := xtrabackup.databasesOption()
+		Ω(err).Should(HaveOccurred())
+
+		xtrabackup = XtraBackupEndpoint{DatabasesExclude: []string{"app"}}
+		_, err = xtrabackup.databasesOption()
+		Ω(err).Should(HaveOccurred())
+	})
+})
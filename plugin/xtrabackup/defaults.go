@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+// readOptionFile reads the settings of a MySQL option file (i.e. my.cnf),
+// by group.  Dashes in option names are turned into underscores, as MySQL
+// treats them the same.  !include and !includedir directives are not
+// followed.
+func readOptionFile(path string) (map[string]map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readOptions(f, path)
+}
+
+// readOptions reads the settings of a MySQL option file from r; path only
+// shows up in messages.
+func readOptions(r io.Reader, path string) (map[string]map[string]string, error) {
+	groups := map[string]map[string]string{}
+	group := ""
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "", line[0] == '#', line[0] == ';':
+			continue
+		case line[0] == '!':
+			DEBUG("%s: not following `%s`", path, line)
+			continue
+		case line[0] == '[' && line[len(line)-1] == ']':
+			group = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if groups[group] == nil {
+			groups[group] = map[string]string{}
+		}
+		key := strings.Replace(strings.TrimSpace(kv[0]), "-", "_", -1)
+		groups[group][key] = strings.Trim(strings.TrimSpace(kv[1]), `"'`)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read %s: %s", path, err)
+	}
+	return groups, nil
+}
+
+// datadirFromDefaults reads the `datadir` setting of a MySQL option file
+// (i.e. my.cnf), the way xtrabackup does: from the [mysqld] group, unless
+// the [xtrabackup] group overrides it.  It returns "" if the file does not
+// set it.
+func datadirFromDefaults(path string) (string, error) {
+	groups, err := readOptionFile(path)
+	if err != nil {
+		return "", err
+	}
+	if dir, ok := groups["xtrabackup"]["datadir"]; ok {
+		return dir, nil
+	}
+	return groups["mysqld"]["datadir"], nil
+}
+
+// xtrabackupCmd returns the beginning of an xtrabackup command line, with
+// the defaults file if there is one; xtrabackup insists that it comes
+// first.
+func (xtrabackup XtraBackupEndpoint) xtrabackupCmd() string {
+	if xtrabackup.DefaultsFile == "" {
+		return xtrabackup.Bin
+	}
+	return fmt.Sprintf("%s --defaults-file=%s", xtrabackup.Bin, xtrabackup.DefaultsFile)
+}
+
+// datadirOption returns the --datadir flag, with a leading space, unless
+// the data directory is left for xtrabackup to find in the defaults file.
+func (xtrabackup XtraBackupEndpoint) datadirOption() string {
+	if xtrabackup.DataDir == "" {
+		return ""
+	}
+	return fmt.Sprintf(" --datadir=%s", xtrabackup.DataDir)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("MySQL Defaults File", func() {
+	var (
+		tmp, cnf, bin string
+		listener      net.Listener
+		fake          *FakeExec
+		realVersion   func(string) ([]byte, error)
+		endpoint      ShieldEndpoint
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-xtrabackup-defaults-")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(os.MkdirAll(filepath.Join(tmp, "data", "app"), 0755)).Should(Succeed())
+		listener, err = net.Listen("unix", filepath.Join(tmp, "mysqld.sock"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		cnf = filepath.Join(tmp, "my.cnf")
+		Ω(ioutil.WriteFile(cnf, []byte("[mysqld]\ndatadir = "+filepath.Join(tmp, "data")+"\n"), 0644)).Should(Succeed())
+
+		/* validate wants an xtrabackup that exists; the fake runs none of it */
+		bin = filepath.Join(tmp, "xtrabackup")
+		Ω(ioutil.WriteFile(bin, []byte("#!/bin/sh\n"), 0755)).Should(Succeed())
+		realVersion = xtrabackupVersion
+		xtrabackupVersion = func(bin string) ([]byte, error) {
+			return []byte(version80), nil
+		}
+		fake = NewFakeExec()
+
+		endpoint = ShieldEndpoint{
+			"mysql_user":           "root",
+			"mysql_password":       "s3cr3t",
+			"mysql_xtrabackup":     bin,
+			"mysql_defaults_file":  cnf,
+			"mysql_temp_targetdir": filepath.Join(tmp, "backups"),
+			"mysql_socket":         filepath.Join(tmp, "mysqld.sock"),
+		}
+	})
+
+	AfterEach(func() {
+		fake.Restore()
+		xtrabackupVersion = realVersion
+		listener.Close()
+		os.RemoveAll(tmp)
+	})
+
+	xtrabackupCommands := func() []string {
+		cmds := []string{}
+		for _, cmd := range fake.Commands() {
+			if strings.HasPrefix(cmd, bin+" ") {
+				cmds = append(cmds, cmd)
+			}
+		}
+		return cmds
+	}
+
+	It("comes first on the command line of backups", func() {
+		Ω(XtraBackupPlugin{}.Backup(endpoint)).Should(Succeed())
+		Ω(xtrabackupCommands()).Should(HaveLen(1))
+		Ω(xtrabackupCommands()[0]).Should(HavePrefix(bin + " --defaults-file=" + cnf + " --backup "))
+		Ω(xtrabackupCommands()[0]).Should(ContainSubstring(" --datadir=" + filepath.Join(tmp, "data") + " "))
+	})
+
+	It("comes first on the command line of restores", func() {
+		/* MySQL is not running, and the target directory gets created */
+		fake.On(`^bash -c " ps `, FakeFailure(1, ""))
+		fake.On(`^mkdir -p `, func(opts ExecOptions) error {
+			return os.MkdirAll(strings.TrimPrefix(opts.Cmd, "mkdir -p "), 0755)
+		})
+
+		stdin := os.Stdin
+		defer func() { os.Stdin = stdin }()
+		var err error
+		os.Stdin, err = os.Open(cnf)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.Stdin.Close()
+
+		Ω(XtraBackupPlugin{}.Restore(endpoint)).Should(Succeed())
+		Ω(xtrabackupCommands()).Should(Equal([]string{
+			bin + " --prepare --target-dir=" + filepath.Join(tmp, "backups"),
+			bin + " --defaults-file=" + cnf + " --move-back --target-dir=" + filepath.Join(tmp, "backups") + " --datadir=" + filepath.Join(tmp, "data"),
+		}))
+	})
+
+	It("makes mysql_datadir optional, and only then", func() {
+		delete(endpoint, "mysql_defaults_file")
+		xtrabackup, err := getXtraBackupEndpoint(endpoint)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(xtrabackup.DataDir).Should(Equal(DefaultDataDir))
+		endpoint["mysql_datadir"] = ""
+		Ω(XtraBackupPlugin{}.Validate(endpoint)).ShouldNot(Succeed())
+
+		endpoint["mysql_defaults_file"] = cnf
+		delete(endpoint, "mysql_datadir")
+		xtrabackup, err = getXtraBackupEndpoint(endpoint)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(xtrabackup.DataDir).Should(Equal(filepath.Join(tmp, "data")))
+		Ω(XtraBackupPlugin{}.Validate(endpoint)).Should(Succeed())
+
+		/* the file need not set it either: xtrabackup then finds it on its own */
+		Ω(ioutil.WriteFile(cnf, []byte("[client]\nport = 3306\n"), 0644)).Should(Succeed())
+		xtrabackup, err = getXtraBackupEndpoint(endpoint)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(xtrabackup.DataDir).Should(Equal(""))
+		Ω(xtrabackup.datadirOption()).Should(Equal(""))
+		Ω(XtraBackupPlugin{}.Validate(endpoint)).Should(Succeed())
+	})
+
+	It("is rejected by validate when it is missing or unreadable", func() {
+		endpoint["mysql_datadir"] = filepath.Join(tmp, "data")
+		Ω(XtraBackupPlugin{}.Validate(endpoint)).Should(Succeed())
+
+		endpoint["mysql_defaults_file"] = filepath.Join(tmp, "nope.cnf")
+		Ω(XtraBackupPlugin{}.Validate(endpoint)).ShouldNot(Succeed())
+
+		endpoint["mysql_defaults_file"] = tmp
+		Ω(XtraBackupPlugin{}.Validate(endpoint)).ShouldNot(Succeed())
+
+		if os.Geteuid() != 0 {
+			Ω(os.Chmod(cnf, 0)).Should(Succeed())
+			endpoint["mysql_defaults_file"] = cnf
+			Ω(XtraBackupPlugin{}.Validate(endpoint)).ShouldNot(Succeed())
+		}
+	})
+})
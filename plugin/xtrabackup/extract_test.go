@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("Extract-Only Restores", func() {
+	var (
+		tmp      string
+		endpoint ShieldEndpoint
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-xtrabackup-extract-")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(os.MkdirAll(filepath.Join(tmp, "backup", "app"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "backup", "app", "t.ibd"), []byte("backed up"), 0644)).Should(Succeed())
+		Ω(exec.Command("tar", "-cf", filepath.Join(tmp, "archive"), "-C", filepath.Join(tmp, "backup"), ".").Run()).Should(Succeed())
+
+		Ω(os.MkdirAll(filepath.Join(tmp, "data", "app"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "data", "app", "t.ibd"), []byte("live"), 0644)).Should(Succeed())
+
+		endpoint = ShieldEndpoint{
+			"mysql_user":         "root",
+			"mysql_password":     "s3cr3t",
+			"mysql_xtrabackup":   "/bin/true",
+			"mysql_datadir":      filepath.Join(tmp, "data"),
+			"mysql_extract_only": true,
+			"mysql_extract_dir":  filepath.Join(tmp, "extract"),
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	restore := func() error {
+		stdin := os.Stdin
+		defer func() { os.Stdin = stdin }()
+		var err error
+		os.Stdin, err = os.Open(filepath.Join(tmp, "archive"))
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.Stdin.Close()
+		return XtraBackupPlugin{}.Restore(endpoint)
+	}
+
+	live := func() string {
+		entries, err := ioutil.ReadDir(filepath.Join(tmp, "data", "app"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(entries).Should(HaveLen(1))
+		b, err := ioutil.ReadFile(filepath.Join(tmp, "data", "app", "t.ibd"))
+		Ω(err).ShouldNot(HaveOccurred())
+		return string(b)
+	}
+
+	It("unpacks the archive into the extract directory, leaving the data directory alone", func() {
+		Ω(restore()).Should(Succeed())
+		Ω(ioutil.ReadFile(filepath.Join(tmp, "extract", "app", "t.ibd"))).Should(Equal([]byte("backed up")))
+		Ω(live()).Should(Equal("live"))
+	})
+
+	It("unpacks into an existing, empty extract directory", func() {
+		Ω(os.Mkdir(filepath.Join(tmp, "extract"), 0755)).Should(Succeed())
+		Ω(restore()).Should(Succeed())
+		Ω(ioutil.ReadFile(filepath.Join(tmp, "extract", "app", "t.ibd"))).Should(Equal([]byte("backed up")))
+	})
+
+	It("refuses extract directories that are not empty", func() {
+		Ω(os.Mkdir(filepath.Join(tmp, "extract"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "extract", "previous"), []byte("left over"), 0644)).Should(Succeed())
+
+		err := restore()
+		Ω(err).Should(MatchError(ContainSubstring("is not empty")))
+		Ω(filepath.Join(tmp, "extract", "app")).ShouldNot(BeADirectory())
+		Ω(live()).Should(Equal("live"))
+	})
+})
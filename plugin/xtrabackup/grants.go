@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+var (
+	DefaultBackupGrants      = false
+	DefaultRestoreGrantsOnly = false
+	DefaultClient            = "/var/vcap/packages/shield-mysql/bin/mysql"
+)
+
+// GrantsFile is the file, at the root of the archive, that holds the users
+// and grants of the backed up server, as SQL statements.
+const GrantsFile = "shield-grants.sql"
+
+// mysqlAccount is a MySQL user account.
+type mysqlAccount struct {
+	User string
+	Host string
+}
+
+// String returns the account as it is written in SQL statements, i.e.
+// 'app'@'%'.
+func (a mysqlAccount) String() string {
+	quote := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	return fmt.Sprintf("'%s'@'%s'", quote.Replace(a.User), quote.Replace(a.Host))
+}
+
+// mysqlArgs returns the command line of the mysql client.
+func (xtrabackup XtraBackupEndpoint) mysqlArgs() []string {
+	args := []string{xtrabackup.Client}
+	if xtrabackup.DefaultsFile != "" {
+		args = append(args, "--defaults-file="+xtrabackup.DefaultsFile)
+	}
+	if xtrabackup.tcp {
+		args = append(args, "--protocol=TCP")
+	} else if xtrabackup.Socket != "" {
+		args = append(args, "--socket="+xtrabackup.Socket)
+	}
+	return append(args, "--user="+xtrabackup.User, "--password="+xtrabackup.Password)
+}
+
+// mysqlQuery runs an SQL statement with the mysql client, and returns the
+// rows of its result, one per line, with tab-separated columns.  In batch
+// mode, the client escapes backslashes, tabs, newlines and NUL bytes the
+// way SQL string literals do, so that statements it returns (with binary
+// password hashes in them) can be run again as they are.
+var mysqlQuery = func(xtrabackup XtraBackupEndpoint, sql string) (string, error) {
+	args := append(xtrabackup.mysqlArgs(), "--batch", "--skip-column-names")
+	DEBUG("Executing: `%s` with `%s`", args[0], sql)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(sql)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("`%s` failed: %s %s", sql, err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// rows splits the result of mysqlQuery into rows.
+func rows(out string) []string {
+	rows := []string{}
+	for _, row := range strings.Split(out, "\n") {
+		if row != "" {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// dumpGrants returns the SQL statements that recreate the user accounts of
+// the server, with their grants.  The accounts that MySQL uses internally
+// (mysql.sys, mysql.session, ...) are left out.  Servers that do not know
+// SHOW CREATE USER (MySQL 5.6) only get the GRANT statements, which carry
+// the password hashes there.
+func dumpGrants(xtrabackup XtraBackupEndpoint) (string, error) {
+	out, err := mysqlQuery(xtrabackup, "SELECT user, host FROM mysql.user ORDER BY user, host")
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "-- Users and grants, dumped by the SHIELD xtrabackup plugin\n")
+	for _, row := range rows(out) {
+		cols := strings.SplitN(row, "\t", 2)
+		if len(cols) != 2 {
+			return "", fmt.Errorf("unexpected row in the list of users: '%s'", row)
+		}
+		account := mysqlAccount{User: cols[0], Host: cols[1]}
+		if strings.HasPrefix(account.User, "mysql.") {
+			DEBUG("Skipping internal account %s", account)
+			continue
+		}
+
+		fmt.Fprintf(&b, "\n-- %s\n", account)
+		if create, err := mysqlQuery(xtrabackup, "SHOW CREATE USER "+account.String()); err != nil {
+			DEBUG("SHOW CREATE USER %s failed (%s); relying on SHOW GRANTS", account, err)
+		} else {
+			fmt.Fprintf(&b, "DROP USER IF EXISTS %s;\n%s;\n", account, strings.TrimSpace(create))
+		}
+		grants, err := mysqlQuery(xtrabackup, "SHOW GRANTS FOR "+account.String())
+		if err != nil {
+			return "", err
+		}
+		for _, grant := range rows(grants) {
+			fmt.Fprintf(&b, "%s;\n", grant)
+		}
+	}
+	fmt.Fprintf(&b, "\nFLUSH PRIVILEGES;\n")
+	return b.String(), nil
+}
+
+// backupGrants writes the users and grants of the server to the backup
+// directory, for them to be archived along with the data.
+func backupGrants(xtrabackup XtraBackupEndpoint, dir string) error {
+	sql, err := dumpGrants(xtrabackup)
+	if err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Dumping users and grants failed}\n")
+		return err
+	}
+	path := filepath.Join(dir, GrantsFile)
+	if err = WriteStagingFile(path, []byte(sql), 0600); err == nil {
+		/* tar, running as mysql_run_as, has to be able to read it */
+		err = xtrabackup.RunAs.Chown(path)
+	}
+	if err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Writing users and grants failed}\n")
+		return err
+	}
+	Fprintf(os.Stderr, "@G{\u2713 Dumped users and grants} to %s\n", GrantsFile)
+	return nil
+}
+
+// restoreGrants only applies the users and grants of the archive read from
+// standard input to the running server, and leaves the data alone.
+func restoreGrants(xtrabackup XtraBackupEndpoint) error {
+	dir := xtrabackup.TargetDir
+	removed, err := xtrabackup.clearTempTargetDir()
+	if err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Checking existing temporary backup directory failed} %s \n", dir)
+		return err
+	}
+	if removed {
+		Fprintf(os.Stderr, "@Y{Removed stale temporary backup directory %s, left behind by an interrupted run}\n", dir)
+	}
+	defer func() {
+		os.RemoveAll(dir)
+	}()
+	if err = MkdirStaging(dir, 0700); err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Creating temporary backup directory failed} %s \n", dir)
+		return err
+	}
+
+	cmdString := fmt.Sprintf("%s -xf - -C %s ./%s", xtrabackup.Tar, dir, GrantsFile)
+	DEBUG("Executing: `%s`", cmdString)
+	if err = untar(ExecOptions{Cmd: cmdString, Stderr: os.Stderr}, os.Stdin); err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Unpacking users and grants failed}\n")
+		Fprintf(os.Stderr, "@Y{Only backups taken with mysql_backup_grants hold users and grants.}\n")
+		return err
+	}
+	Fprintf(os.Stderr, "@G{\u2713 Unpacked users and grants}\n")
+
+	f, err := os.Open(filepath.Join(dir, GrantsFile))
+	if err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Applying users and grants failed}\n")
+		return err
+	}
+	defer f.Close()
+	err = ExecWithOptions(ExecOptions{
+		Cmd:      strings.Join(xtrabackup.mysqlArgs(), " "),
+		Stdin:    f,
+		Stdout:   os.Stderr,
+		ExpectRC: []int{0},
+	})
+	if err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Applying users and grants failed}\n")
+		return err
+	}
+	Fprintf(os.Stderr, "@G{\u2713 Applied users and grants}\n")
+	Fprintf(os.Stderr, "@Y{Grants-only mode: the MySQL data directory was not touched.}\n")
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Users and Grants", func() {
+	var query func(XtraBackupEndpoint, string) (string, error)
+
+	BeforeEach(func() {
+		query = mysqlQuery
+	})
+
+	AfterEach(func() {
+		mysqlQuery = query
+	})
+
+	fake := func(results map[string]string) {
+		mysqlQuery = func(_ XtraBackupEndpoint, sql string) (string, error) {
+			if out, ok := results[sql]; ok {
+				return out, nil
+			}
+			return "", fmt.Errorf("ERROR 1064 (42000): You have an error in your SQL syntax")
+		}
+	}
+
+	It("quotes accounts the way SQL statements do", func() {
+		Ω(mysqlAccount{User: "app", Host: "%"}.String()).Should(Equal(`'app'@'%'`))
+		Ω(mysqlAccount{User: `o'brien`, Host: `10.0.0.%`}.String()).Should(Equal(`'o\'brien'@'10.0.0.%'`))
+	})
+
+	It("dumps the users and their grants, but the internal ones", func() {
+		fake(map[string]string{
+			"SELECT user, host FROM mysql.user ORDER BY user, host": "app\t%\nmysql.sys\tlocalhost\n",
+			"SHOW CREATE USER 'app'@'%'":                            "CREATE USER 'app'@'%' IDENTIFIED WITH 'mysql_native_password' AS '*ABC'\n",
+			"SHOW GRANTS FOR 'app'@'%'":                             "GRANT USAGE ON *.* TO 'app'@'%'\nGRANT ALL PRIVILEGES ON `app`.* TO 'app'@'%'\n",
+		})
+		Ω(dumpGrants(XtraBackupEndpoint{})).Should(Equal(`-- Users and grants, dumped by the SHIELD xtrabackup plugin
+
+-- 'app'@'%'
+DROP USER IF EXISTS 'app'@'%';
+CREATE USER 'app'@'%' IDENTIFIED WITH 'mysql_native_password' AS '*ABC';
+GRANT USAGE ON *.* TO 'app'@'%';
+GRANT ALL PRIVILEGES ON ` + "`app`" + `.* TO 'app'@'%';
+
+FLUSH PRIVILEGES;
+`))
+	})
+
+	It("only dumps the grants of servers without SHOW CREATE USER", func() {
+		fake(map[string]string{
+			"SELECT user, host FROM mysql.user ORDER BY user, host": "app\tlocalhost\n",
+			"SHOW GRANTS FOR 'app'@'localhost'":                     "GRANT USAGE ON *.* TO 'app'@'localhost' IDENTIFIED BY PASSWORD '*ABC'\n",
+		})
+		Ω(dumpGrants(XtraBackupEndpoint{})).Should(Equal(`-- Users and grants, dumped by the SHIELD xtrabackup plugin
+
+-- 'app'@'localhost'
+GRANT USAGE ON *.* TO 'app'@'localhost' IDENTIFIED BY PASSWORD '*ABC';
+
+FLUSH PRIVILEGES;
+`))
+	})
+
+	It("fails when the users can't be listed", func() {
+		fake(map[string]string{})
+		_, err := dumpGrants(XtraBackupEndpoint{})
+		Ω(err).Should(HaveOccurred())
+	})
+})
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+// InnoDB settings
+//
+// A MySQL server only starts on restored data files if its InnoDB settings
+// match the ones of the backed up server, for those that shape the files:
+// page size, redo log size, system tablespace and undo tablespaces.
+// xtrabackup records them in the `backup-my.cnf` file it saves with each
+// backup, which ends up in the archive, and serves as its manifest.
+
+// innodbSettings are the settings that the restored files depend on.
+var innodbSettings = []string{
+	"innodb_page_size",
+	"innodb_log_file_size",
+	"innodb_log_files_in_group",
+	"innodb_redo_log_capacity",
+	"innodb_data_file_path",
+	"innodb_undo_tablespaces",
+	"innodb_checksum_algorithm",
+}
+
+// innodbSizes are the settings that hold a size, which may be written with
+// a K, M or G suffix.
+var innodbSizes = map[string]bool{
+	"innodb_page_size":         true,
+	"innodb_log_file_size":     true,
+	"innodb_redo_log_capacity": true,
+}
+
+// BackupConfigFile is the option file xtrabackup saves with each backup.
+const BackupConfigFile = "backup-my.cnf"
+
+// innodbConfig reads the InnoDB settings of the [mysqld] group of an
+// option file.
+func innodbConfig(path string) (map[string]string, error) {
+	groups, err := readOptionFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return innodbConfigOf(groups), nil
+}
+
+// innodbConfigOf picks the InnoDB settings out of the [mysqld] group of the
+// settings of an option file.
+func innodbConfigOf(groups map[string]map[string]string) map[string]string {
+	config := map[string]string{}
+	for _, key := range innodbSettings {
+		if v, ok := groups["mysqld"][key]; ok {
+			config[key] = v
+		}
+	}
+	return config
+}
+
+// normalizeSetting makes sizes comparable, i.e. `48M` and `50331648`.
+func normalizeSetting(key, value string) string {
+	if !innodbSizes[key] || value == "" {
+		return value
+	}
+	mult := int64(1)
+	switch strings.ToUpper(value[len(value)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	}
+	n := value
+	if mult > 1 {
+		n = value[:len(value)-1]
+	}
+	i, err := strconv.ParseInt(n, 10, 64)
+	if err != nil {
+		return value
+	}
+	return strconv.FormatInt(i*mult, 10)
+}
+
+// diffInnoDBConfig lists the settings of the backup that the target server
+// sets differently.  Settings that the target does not set are left out,
+// since the server default may well be what the backup used.
+func diffInnoDBConfig(backup, target map[string]string) []string {
+	diffs := []string{}
+	for _, key := range innodbSettings {
+		b, inBackup := backup[key]
+		t, inTarget := target[key]
+		if !inBackup || !inTarget {
+			continue
+		}
+		if normalizeSetting(key, b) != normalizeSetting(key, t) {
+			diffs = append(diffs, fmt.Sprintf("%s is %s in the backup, but %s on this server", key, b, t))
+		}
+	}
+	return diffs
+}
+
+// reportInnoDBConfig prints the InnoDB settings of a fresh backup, as
+// recorded in its backup-my.cnf.
+func reportInnoDBConfig(dir string) {
+	config, err := innodbConfig(filepath.Join(dir, BackupConfigFile))
+	if err != nil {
+		Fprintf(os.Stderr, "@Y{Unable to read the InnoDB settings of the backup: %s}\n", err)
+		return
+	}
+	keys := []string{}
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		DEBUG("backup InnoDB setting %s = %s", key, config[key])
+	}
+	Fprintf(os.Stderr, "@G{\u2713 Recorded InnoDB settings} in %s\n", BackupConfigFile)
+}
+
+// checkInnoDBConfig compares the InnoDB settings of an unpacked backup with
+// the ones of the option file of the target server, and warns about those
+// that diverge, since MySQL would not start on the restored files.  When
+// `mysql_innodb_config_file` is set, and `write` is true, the settings of
+// the backup are written there.
+func checkInnoDBConfig(xtrabackup XtraBackupEndpoint, dir string, write bool) error {
+	backup, err := innodbConfig(filepath.Join(dir, BackupConfigFile))
+	if os.IsNotExist(err) {
+		Fprintf(os.Stderr, "@Y{No %s in the backup; unable to check its InnoDB settings}\n", BackupConfigFile)
+		return nil
+	}
+	if err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Reading InnoDB settings of the backup failed}\n")
+		return err
+	}
+
+	if xtrabackup.DefaultsFile == "" {
+		DEBUG("no mysql_defaults_file; not comparing InnoDB settings")
+	} else {
+		target, err := innodbConfig(xtrabackup.DefaultsFile)
+		if err != nil {
+			Fprintf(os.Stderr, "@R{\u2717 Reading InnoDB settings of %s failed}\n", xtrabackup.DefaultsFile)
+			return err
+		}
+		diffs := diffInnoDBConfig(backup, target)
+		for _, diff := range diffs {
+			Fprintf(os.Stderr, "@Y{WARNING: %s (%s); MySQL may fail to start on the restored files}\n", diff, xtrabackup.DefaultsFile)
+		}
+		if len(diffs) == 0 {
+			Fprintf(os.Stderr, "@G{\u2713 Checked InnoDB settings} against %s\n", xtrabackup.DefaultsFile)
+		}
+	}
+
+	if write && xtrabackup.InnoDBConfigFile != "" {
+		if err = writeInnoDBConfig(xtrabackup.InnoDBConfigFile, backup); err != nil {
+			Fprintf(os.Stderr, "@R{\u2717 Writing InnoDB settings of the backup failed} %s\n", xtrabackup.InnoDBConfigFile)
+			return err
+		}
+		Fprintf(os.Stderr, "@G{\u2713 Wrote InnoDB settings of the backup} to %s\n", xtrabackup.InnoDBConfigFile)
+	}
+	return nil
+}
+
+// writeInnoDBConfig writes InnoDB settings as an option file, meant to be
+// included from the my.cnf of the server.
+func writeInnoDBConfig(path string, config map[string]string) error {
+	s := fmt.Sprintf("# InnoDB settings of the backup restored by SHIELD, on %s\n[mysqld]\n", time.Now().Format(time.RFC3339))
+	for _, key := range innodbSettings {
+		if v, ok := config[key]; ok {
+			s += fmt.Sprintf("%s=%s\n", key, v)
+		}
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(s); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
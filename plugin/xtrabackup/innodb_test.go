@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const backupMyCnf = `# This MySQL options file was generated by innobackupex.
+
+# The MySQL server
+[mysqld]
+innodb_checksum_algorithm=crc32
+innodb_log_checksum_algorithm=strict_crc32
+innodb_data_file_path=ibdata1:12M:autoextend
+innodb_log_files_in_group=2
+innodb_log_file_size=50331648
+innodb_page_size=16384
+innodb_undo_directory=./
+innodb_undo_tablespaces=0
+`
+
+var _ = Describe("InnoDB Settings", func() {
+	var tmp string
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-xtrabackup-")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ioutil.WriteFile(filepath.Join(tmp, BackupConfigFile), []byte(backupMyCnf), 0644)).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	It("reads the InnoDB settings of the [mysqld] group", func() {
+		config, err := innodbConfig(filepath.Join(tmp, BackupConfigFile))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(config).Should(HaveLen(6))
+		Ω(config["innodb_log_file_size"]).Should(Equal("50331648"))
+		Ω(config).ShouldNot(HaveKey("innodb_undo_directory"))
+	})
+
+	It("only reports the settings that the target sets differently", func() {
+		backup, err := innodbConfig(filepath.Join(tmp, BackupConfigFile))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "my.cnf"), []byte(`
+[client]
+innodb-page-size = 4096
+[mysqld]
+innodb-log-file-size = 48M
+innodb_page_size     = 8k
+`), 0644)).Should(Succeed())
+		target, err := innodbConfig(filepath.Join(tmp, "my.cnf"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(diffInnoDBConfig(backup, target)).Should(Equal([]string{
+			"innodb_page_size is 16384 in the backup, but 8k on this server",
+		}))
+	})
+
+	It("writes the InnoDB settings of the backup as an option file", func() {
+		xtrabackup := XtraBackupEndpoint{InnoDBConfigFile: filepath.Join(tmp, "innodb.cnf")}
+		Ω(checkInnoDBConfig(xtrabackup, tmp, false)).Should(Succeed())
+		_, err := os.Stat(xtrabackup.InnoDBConfigFile)
+		Ω(os.IsNotExist(err)).Should(BeTrue())
+
+		Ω(checkInnoDBConfig(xtrabackup, tmp, true)).Should(Succeed())
+		written, err := innodbConfig(xtrabackup.InnoDBConfigFile)
+		Ω(err).ShouldNot(HaveOccurred())
+		backup, err := innodbConfig(filepath.Join(tmp, BackupConfigFile))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(written).Should(Equal(backup))
+	})
+})
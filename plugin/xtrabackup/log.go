@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+// The xtrabackup log
+//
+// xtrabackup gives a detailed account of what it does on its standard
+// error, which is otherwise only shown when it fails.  When `mysql_log_file`
+// is set, what it writes there while backing up and preparing is appended to
+// that file, with the secrets redacted (see Redact), for the record.  The
+// file is opened as soon as the backup (or restore) starts, so that it is
+// there even when the backup fails before xtrabackup ran, and each run is
+// framed with a line that says when it started, and one that says how it
+// ended.
+
+type xtrabackupLog struct {
+	f         *os.File
+	operation string
+}
+
+// openLog opens (or creates) the log file, for an operation (i.e. backup),
+// or returns nil when there is no log file.
+func openLog(path, operation string) (*xtrabackupLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	l := &xtrabackupLog{f: f, operation: operation}
+	l.printf("%s started", operation)
+	return l, nil
+}
+
+func (l *xtrabackupLog) printf(format string, args ...interface{}) {
+	fmt.Fprintf(l.f, "=== %s %s\n", time.Now().UTC().Format(time.RFC3339), Redact(fmt.Sprintf(format, args...)))
+}
+
+// exec runs the xtrabackup command of opts, for a phase (i.e. prepare),
+// copying its standard error into the log.
+func (l *xtrabackupLog) exec(phase string, opts ExecOptions) error {
+	if l == nil {
+		return ExecWithOptions(opts)
+	}
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r := bufio.NewReader(rd)
+		for {
+			line, err := r.ReadString('\n')
+			if line != "" {
+				io.WriteString(l.f, Redact(line))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	l.printf("%s: %s", phase, opts.Cmd)
+	opts.Stderr = wr
+	err = ExecWithOptions(opts)
+	wr.Close()
+	<-done
+	rd.Close()
+	if err != nil {
+		l.printf("%s failed: %s", phase, err)
+	}
+	return err
+}
+
+// close records how the operation ended, and closes the log.
+func (l *xtrabackupLog) close(err error) {
+	if l == nil {
+		return
+	}
+	if err != nil {
+		l.printf("%s failed: %s", l.operation, err)
+	} else {
+		l.printf("%s succeeded", l.operation)
+	}
+	l.f.Close()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("xtrabackup Log", func() {
+	var (
+		tmp     string
+		logFile string
+		bin     string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-xtrabackup-log-")
+		Ω(err).ShouldNot(HaveOccurred())
+		logFile = filepath.Join(tmp, "xtrabackup.log")
+
+		/* an xtrabackup that talks on its standard error, and fails when asked to */
+		bin = filepath.Join(tmp, "xtrabackup")
+		Ω(ioutil.WriteFile(bin, []byte("#!/bin/sh\n"+
+			"echo \"xtrabackup: recognized client arguments: $*\" >&2\n"+
+			"echo 'xtrabackup: completed OK!' >&2\n"+
+			"echo 'not for the log'\n"+
+			"[ \"$1\" != --fail ]\n"), 0755)).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	read := func() string {
+		b, err := ioutil.ReadFile(logFile)
+		Ω(err).ShouldNot(HaveOccurred())
+		return string(b)
+	}
+
+	It("keeps what xtrabackup said, without its secrets", func() {
+		RegisterSecret("sw0rdf1sh")
+		l, err := openLog(logFile, "backup")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(l.exec("backup", ExecOptions{Cmd: bin + " --backup --user=root --password=sw0rdf1sh", ExpectRC: []int{0}})).Should(Succeed())
+		l.close(nil)
+
+		log := read()
+		Ω(log).Should(MatchRegexp(`^=== \S+Z backup started\n`))
+		Ω(log).Should(ContainSubstring("backup: " + bin + " --backup --user=root --password=<redacted>\n"))
+		Ω(log).Should(ContainSubstring("xtrabackup: recognized client arguments: --backup --user=root --password=<redacted>\n"))
+		Ω(log).Should(ContainSubstring("xtrabackup: completed OK!\n"))
+		Ω(log).Should(MatchRegexp(`\n=== \S+Z backup succeeded\n$`))
+		Ω(log).ShouldNot(ContainSubstring("sw0rdf1sh"))
+		Ω(log).ShouldNot(ContainSubstring("not for the log"))
+	})
+
+	It("records failures, and appends to what previous runs logged", func() {
+		Ω(ioutil.WriteFile(logFile, []byte("previous run\n"), 0640)).Should(Succeed())
+		l, err := openLog(logFile, "restore")
+		Ω(err).ShouldNot(HaveOccurred())
+		err = l.exec("prepare", ExecOptions{Cmd: bin + " --fail --prepare", ExpectRC: []int{0}})
+		Ω(err).Should(HaveOccurred())
+		l.close(err)
+
+		log := read()
+		Ω(log).Should(HavePrefix("previous run\n"))
+		Ω(log).Should(ContainSubstring("xtrabackup: recognized client arguments: --fail --prepare\n"))
+		Ω(log).Should(MatchRegexp(`\n=== \S+Z prepare failed: `))
+		Ω(log).Should(MatchRegexp(`\n=== \S+Z restore failed: `))
+	})
+
+	It("creates the log file even when the backup fails before xtrabackup ran", func() {
+		err := XtraBackupPlugin{}.Backup(ShieldEndpoint{
+			"mysql_user":           "root",
+			"mysql_password":       "secret",
+			"mysql_xtrabackup":     filepath.Join(tmp, "missing", "xtrabackup"),
+			"mysql_temp_targetdir": filepath.Join(tmp, "target"),
+			"mysql_log_file":       logFile,
+		})
+		Ω(err).Should(HaveOccurred())
+
+		log := read()
+		Ω(log).Should(MatchRegexp(`^=== \S+Z backup started\n`))
+		Ω(log).Should(MatchRegexp(`\n=== \S+Z backup failed: `))
+	})
+
+	It("runs xtrabackup as usual without a log file", func() {
+		var l *xtrabackupLog
+		Ω(openLog("", "backup")).Should(BeNil())
+		Ω(l.exec("backup", ExecOptions{Cmd: bin + " --backup", ExpectRC: []int{0}})).Should(Succeed())
+		l.close(nil)
+		Ω(logFile).ShouldNot(BeAnExistingFile())
+	})
+})
@@ -20,10 +20,36 @@
 //        "mysql_user":           "username-for-mysql",
 //        "mysql_password":       "password-for-above-user",
 //        "mysql_databases":      <list_of_databases>,       # OPTIONAL
+//        "mysql_databases_exclude": "db3 db4",              # OPTIONAL
+//        "mysql_tables":         "^db1[.]orders_",          # OPTIONAL
+//        "mysql_tables_exclude": "[.]tmp_",                 # OPTIONAL
+//        "mysql_defaults_file":  "/etc/mysql/my.cnf",       # OPTIONAL
 //        "mysql_datadir":        "/var/lib/mysql",          # OPTIONAL
 //        "mysql_xtrabackup":     "/path/to/xtrabackup",     # OPTIONAL
 //        "mysql_temp_targetdir": "/tmp/backups"             # OPTIONAL
 //        "mysql_tar":            "tar"                      # OPTIONAL
+//        "mysql_lock_ddl":                  false           # OPTIONAL
+//        "mysql_ftwrl_wait_timeout":        0               # OPTIONAL
+//        "mysql_kill_long_queries_timeout": 0               # OPTIONAL
+//        "mysql_compress":                  "zstd"          # OPTIONAL
+//        "mysql_use_memory":                "1G"            # OPTIONAL
+//        "mysql_extract_only":              false           # OPTIONAL
+//        "mysql_extract_dir":               "/path/to/dir"  # OPTIONAL
+//        "mysql_verify_after_restore":      false           # OPTIONAL
+//        "mysql_innochecksum":    "/path/to/innochecksum"   # OPTIONAL
+//        "mysql_myisamchk":       "/path/to/myisamchk"      # OPTIONAL
+//        "mysql_innodb_config_file": "/path/to/innodb.cnf"  # OPTIONAL
+//        "mysql_run_as":          "mysql"                   # OPTIONAL
+//        "mysql_safety_backup_dir": "/var/lib/mysql-safety" # OPTIONAL
+//        "mysql_force_partial_restore": false               # OPTIONAL
+//        "mysql_backup_grants":       false                 # OPTIONAL
+//        "mysql_restore_grants_only": false                 # OPTIONAL
+//        "mysql_client":          "/path/to/mysql"          # OPTIONAL
+//        "mysql_socket":          "/path/to/mysqld.sock"    # OPTIONAL
+//        "mysql_restore_preview":     false                 # OPTIONAL
+//        "mysql_slave_info":          false                 # OPTIONAL
+//        "mysql_log_file":        "/path/to/xtrabackup.log" # OPTIONAL
+//        "mysql_checksum":            false                 # OPTIONAL
 //    }
 //
 // Default Configuration
@@ -32,7 +58,22 @@
 //        "mysql_tar"           : "tar",
 //        "mysql_datadir"       : "/var/lib/mysql",
 //        "mysql_xtrabackup"    : "/var/vcap/packages/shield-mysql/bin/xtrabackup",
-//        "mysql_temp_targetdir": "/tmp/backups"
+//        "mysql_temp_targetdir": "/tmp/backups",
+//        "mysql_lock_ddl"                 : false,
+//        "mysql_ftwrl_wait_timeout"       : 0,
+//        "mysql_kill_long_queries_timeout": 0,
+//        "mysql_compress"                 : "",
+//        "mysql_use_memory"               : "",
+//        "mysql_extract_only"             : false,
+//        "mysql_verify_after_restore"     : false,
+//        "mysql_innochecksum"  : "/var/vcap/packages/shield-mysql/bin/innochecksum",
+//        "mysql_myisamchk"     : "/var/vcap/packages/shield-mysql/bin/myisamchk",
+//        "mysql_backup_grants"       : false,
+//        "mysql_restore_grants_only" : false,
+//        "mysql_client"        : "/var/vcap/packages/shield-mysql/bin/mysql",
+//        "mysql_restore_preview"     : false,
+//        "mysql_slave_info"          : false,
+//        "mysql_checksum"            : false
 //    }
 //
 // mysql_databases:
@@ -41,8 +82,27 @@
 // The list is of the form "databasename1[.table_name1] databasename2[.table_name2]".
 // If this option is not specified, all databases containing MyISAM and InnoDB tables will be backed up.
 //
+// mysql_databases_exclude:
+// A space-separated list of databases NOT to back up; all the other databases of the
+// data directory are. It can't be combined with `mysql_databases`. See BACKUP DETAILS.
+//
+// mysql_tables:
+// A regular expression, passed to `xtrabackup --tables`; only the tables whose fully
+// qualified name (in the "databasename.tablename" form) matches it are backed up.
+//
+// mysql_tables_exclude:
+// A regular expression, passed to `xtrabackup --tables-exclude`; tables whose fully
+// qualified name matches it are NOT backed up. It takes precedence over `mysql_tables`.
+//
+// mysql_defaults_file:
+// This option specifies a MySQL option file (i.e. `my.cnf`), passed to `xtrabackup`
+// with `--defaults-file` when backing up and restoring, so that it reads the datadir,
+// socket, InnoDB settings and so on from there. Preparing a backup still uses the
+// `backup-my.cnf` file that `xtrabackup` saves along with each backup.
+//
 // mysql_datadir:
-// This option specifies MySQL's datadir.
+// This option specifies MySQL's datadir. When `mysql_defaults_file` is set, it
+// defaults to the `datadir` that file sets (in the [xtrabackup] or [mysqld] group).
 //
 // mysql_xtrabackup:
 // This option specifies the absolute path to the `xtrabackup` tool.
@@ -51,16 +111,165 @@
 // This option specifies the absolute path to a temporary directory used by
 // the `xtrabackup` tool to backup the MySQL databases. It must be empty after
 // each run of the plugin. It must be as big as the estimated MySQL data directory.
+// As it is wiped before and after each run, it must not be a system directory
+// (like `/tmp` or `/var/vcap/store`), nor overlap with the MySQL data directory.
 //
 // mysql_tar:
 // This option specifies the absolute path to the `tar` tool.
 //
+// mysql_lock_ddl:
+// If true, `xtrabackup` blocks DDL statements with LOCK TABLES FOR BACKUP
+// for the whole duration of the backup, instead of relying on a global read lock.
+// This requires a server that supports backup locks (Percona Server 5.6+).
+//
+// mysql_ftwrl_wait_timeout:
+// Number of seconds to wait for long-running queries to finish before taking
+// the FLUSH TABLES WITH READ LOCK that is needed to copy non-InnoDB (MyISAM)
+// tables; the backup fails if they are still running after that delay.
+// 0 (the default) does not wait at all.
+//
+// mysql_kill_long_queries_timeout:
+// Number of seconds to let queries that block the FLUSH TABLES WITH READ LOCK
+// run, before killing them. 0 (the default) never kills any query.
+//
+// mysql_compress:
+// Compression algorithm `xtrabackup` compresses the backup files with, one of
+// `quicklz`, `lz4` or `zstd`. Empty (the default) does not compress them. Not all
+// versions of `xtrabackup` support all algorithms: `lz4` requires 2.4.21 or 8.0.20,
+// and `zstd` requires 8.0.30. See BACKUP DETAILS.
+//
+// mysql_use_memory:
+// How much memory `xtrabackup --prepare` gets, with `--use-memory`, i.e. `512M` or
+// `2G` (a number of bytes, with an optional K, M or G suffix). Empty (the default)
+// leaves it to `xtrabackup`, which uses 100M. See RESTORE DETAILS.
+//
+// mysql_extract_only:
+// If true, restoring only unpacks and prepares the backup in `mysql_extract_dir`,
+// and stops before moving it back to the data directory. See RESTORE DETAILS.
+//
+// mysql_extract_dir:
+// This option specifies where to unpack the backup in extract-only mode. It is
+// required when `mysql_extract_only` is true, and must not exist or be empty.
+//
+// mysql_verify_after_restore:
+// If true, the restored files are checked for corruption before the restore is
+// declared successful. See RESTORE DETAILS.
+//
+// mysql_innochecksum, mysql_myisamchk:
+// These options specify the absolute paths to the `innochecksum` and `myisamchk`
+// tools, used by `mysql_verify_after_restore`.
+//
+// mysql_innodb_config_file:
+// If set, restoring writes the InnoDB settings of the backup (from its `backup-my.cnf`)
+// to this option file, as a [mysqld] group, for the `my.cnf` of the server to `!include`.
+// See RESTORE DETAILS.
+//
+// mysql_run_as:
+// If set, `xtrabackup` and `tar` are run as this OS user (a name or a uid), i.e. the
+// user MySQL runs as, instead of the user the plugin runs as. See PRIVILEGES.
+//
+// mysql_safety_backup_dir:
+// If set, restoring moves the contents of the data directory below this directory,
+// instead of deleting them, and moves them back if the restore fails. It must be on
+// the same filesystem as the data directory. See RESTORE DETAILS.
+//
+// mysql_force_partial_restore:
+// If true, partial backups are moved back in place of the data directory even when
+// `mysql_safety_backup_dir` is set, instead of refusing them. See BACKUP DETAILS.
+//
+// mysql_backup_grants:
+// If true, the users and grants of the server are dumped, with the `mysql` client, to a
+// `shield-grants.sql` file at the root of the archive. See USERS AND GRANTS.
+//
+// mysql_restore_grants_only:
+// If true, restoring only applies the `shield-grants.sql` file of the archive to the
+// running server, and leaves the data alone. See USERS AND GRANTS.
+//
+// mysql_client:
+// This option specifies the absolute path to the `mysql` client, used by
+// `mysql_backup_grants` and `mysql_restore_grants_only`.
+//
+// mysql_socket:
+// This option specifies the path to the unix socket of the MySQL server, that xtrabackup
+// and the `mysql` client connect to. When it is not set, the socket is looked for in the
+// defaults file, then asked to the server over TCP, then in the usual places, and backups
+// fail with the list of the paths that were tried when none of them is a socket.
+//
+// mysql_restore_preview:
+// If true, restoring only reads the archive, and reports what it holds and what a
+// restore would change, without touching the data directory. See RESTORE PREVIEW.
+//
+// mysql_slave_info:
+// If true, backing up a replica records the position of its master in the binary log,
+// with `xtrabackup --slave-info`, to provision new replicas from the backup. See
+// REPLICA BACKUPS.
+//
+// mysql_log_file:
+// This option specifies the absolute path of a file to append what xtrabackup writes on
+// its standard error while backing up and preparing to, with the secrets redacted, for
+// audit and debugging. The file is created as soon as the backup or restore starts, and
+// each run is framed with lines that say when it started and how it ended.
+//
+// mysql_checksum:
+// If true, backups frame the archive with its SHA-256 checksum (format `shield-checksum/1`),
+// so that restores catch archives that were truncated or corrupted on their way to storage
+// and back, which tar alone does not always notice. Restores check archives that come with
+// a checksum whatever this option says, once they have been unpacked, and before anything
+// else is done with them; archives without one are restored as they always were. Framed
+// archives are not plain tar streams anymore: `tar tvf` cannot read them as is.
+//
 //
 // BACKUP DETAILS
 //
 // The `xtrabackup` plugin backs up all data in the data directory. If the `databases` option is specified
 // the plugin will only back up these databases.
 //
+// When `mysql_databases_exclude` is set, the databases are listed from the data directory
+// (one subdirectory each, minus the `#`-prefixed ones MySQL keeps for itself) before the
+// backup starts, and all of them but the excluded ones are passed to `--databases`.
+// Excluded databases that do not exist only cause a warning. Databases created while the
+// backup runs are not backed up.
+//
+// Setting `mysql_databases`, `mysql_databases_exclude`, `mysql_tables` or `mysql_tables_exclude`
+// produces a partial backup.
+// Partial backups come with restore caveats: InnoDB tables that are not part of the backup are
+// still referenced by the shared system tablespace (data dictionary), so restoring a partial
+// backup in place of the whole data directory leaves MySQL with dangling references to the
+// missing tables. The safe way to restore a partial backup is usually to export individual
+// tables (`xtrabackup --prepare --export`) and import their tablespaces into a running server.
+// The plugin has no such import path. The archive only tells that the backup is partial (from
+// the `partial` line of its `xtrabackup_info` file) once it is unpacked, after the data directory
+// was emptied. When `mysql_safety_backup_dir` is set, the restore then refuses to go on, and the
+// previous contents of the data directory are moved back, unless `mysql_force_partial_restore`
+// is true. Without a safety backup, there is nothing left to go back to: the restore only warns,
+// and moves the partial backup back in place of the whole data directory.
+// The restore preview warns about partial backups too: check a backup with
+// `mysql_restore_preview` before restoring it, and restore partial backups with
+// `mysql_extract_only`, to import their tables by hand.
+// Also note that the regular expressions are validated with Go's regexp syntax, which is close
+// to, but not exactly the same as, the POSIX syntax that `xtrabackup` uses.
+//
+// Before each backup, the plugin runs `xtrabackup --version` (once), and checks that
+// it supports the options it is about to pass, i.e. `mysql_lock_ddl` (2.4.8 or later)
+// and the `mysql_compress` algorithm, so that an unsupported setting fails with a clear
+// message. Compressed backups are decompressed on restore, before they are prepared;
+// this requires the `qpress`, `lz4` or `zstd` utility, depending on the algorithm.
+//
+// Archives are plain tar streams. When they come back compressed as a whole, because a
+// step of their own compressed them on their way to storage, restores tell gzip, bzip2, xz
+// and zstd streams apart from their first bytes, and decompress them on the way, with the
+// `gzip`, `bzip2`, `xz` or `zstd` utility.
+//
+// The temporary target directory is left for `xtrabackup` to create, except with
+// `mysql_run_as`, where the plugin creates it with mode 0750. When `staging_mode` is
+// set, the plugin always creates it, with that mode, and writes the users and grants
+// file with it too (without the execute bits), instead of 0600.
+//
+// The temporary target directory is removed at the end of each backup and restore.
+// When `keep_staging_on_failure` is true, it is left behind (and its path printed)
+// by a backup or a restore that fails, to find out what went wrong; the next run
+// removes it before it starts.
+//
 // RESTORE DETAILS
 //
 // To restore, the `xtrabackup` plugin moves back the backed up data files to
@@ -70,21 +279,135 @@
 // To complete the restore of a Galera cluster, all nodes must be stopped. The previously restored node must
 // be rebooted in bootstrap mode. The other nodes will be added to the second time to the cluster..
 //
+// When `mysql_extract_only` is true, the restore is not destructive: MySQL does not
+// need to be stopped, and the data directory is left alone. The backup is unpacked in
+// `mysql_extract_dir` and prepared with `xtrabackup --prepare`, which checks its
+// integrity, but it is not moved back. This lets operators inspect the contents of
+// a backup safely. The extract directory needs as much scratch space as the MySQL
+// data directory, and is left in place, to be cleaned up manually afterwards.
+//
+// When `mysql_verify_after_restore` is true, every InnoDB tablespace (`ibdata*` and
+// `*.ibd` files) is checked with `innochecksum`, and every MyISAM table with
+// `myisamchk --check --read-only`, once the files are in place (in the data
+// directory, or in the extract directory in extract-only mode). All corrupted files
+// are reported, and the restore fails if there is any, so that a bad restore is caught
+// before MySQL is started and production traffic hits it. The checks read every page
+// of every table, so they take about as long as reading the whole data directory.
+// They do not start MySQL, and cannot catch logical inconsistencies.
+//
+// Preparing replays the redo log through an InnoDB buffer pool, that `mysql_use_memory`
+// sizes. More memory makes the prepare of large backups faster, but it must fit in what
+// the host (or container) can spare, or the kernel kills `xtrabackup` halfway through
+// (out of memory), and the restore fails. Too little memory only slows the prepare
+// down. Half of the memory available to the restore is a reasonable start.
+//
+// MySQL does not start on restored files if its InnoDB settings that shape them
+// (`innodb_page_size`, `innodb_log_file_size`, `innodb_log_files_in_group`,
+// `innodb_redo_log_capacity`, `innodb_data_file_path`, `innodb_undo_tablespaces` and
+// `innodb_checksum_algorithm`) differ from the ones of the backed up server. These are
+// recorded in the `backup-my.cnf` file that `xtrabackup` saves with each backup. On
+// restore, they are compared with the [mysqld] group of `mysql_defaults_file` (if set),
+// and a warning is printed for each one that diverges; settings that the option file
+// does not set are not compared. When `mysql_innodb_config_file` is set, the settings
+// of the backup are written there, so that MySQL starts with them.
+//
+// Restoring deletes the contents of the data directory, unless `mysql_safety_backup_dir`
+// is set: they are then moved to a new `datadir-<timestamp>` directory below it, which
+// only takes a rename, since it has to be on the same filesystem. If the restore fails,
+// at any step, whatever it left in the data directory is deleted, and the previous
+// contents are moved back. The safety backup is only removed once the restore
+// succeeded (and passed `mysql_verify_after_restore`, if set). When the plugin gets
+// killed mid-restore, the safety backup stays there, to be moved back by hand.
+//
+// USERS AND GRANTS
+//
+// A physical backup holds the `mysql` system database, with the users and their grants,
+// like any other database, and a full restore brings them back along with the data:
+// there is no way to restore the data of a physical backup without its `mysql` database.
+// When `mysql_backup_grants` is true, the users and grants are also dumped as SQL
+// statements (SHOW CREATE USER and SHOW GRANTS) to a `shield-grants.sql` file, at the
+// root of the archive, so that they can be restored on their own. The accounts that
+// MySQL keeps for itself (`mysql.sys`, `mysql.session`...) are left out. Dumping them
+// needs the server to be running, which it is during backups.
+//
+// Full restores ignore that file: the users and grants come with the `mysql` database.
+// When `mysql_restore_grants_only` is true, restoring does not touch the data at all:
+// it applies the `shield-grants.sql` file of the archive to the running server, with
+// the `mysql` client. Each user is dropped and created again, with its password, then
+// granted its privileges, while users that are not in the backup are left alone. This
+// gives back the accounts of a backup without rolling the data back, i.e. after a
+// partial backup (one that excludes the `mysql` database with `mysql_databases_exclude`)
+// was restored, or to copy users over to another server. It can't be combined with
+// `mysql_extract_only`; in extract-only mode, the file is left in the extract directory.
+//
+// RESTORE PREVIEW
+//
+// When `mysql_restore_preview` is true, restoring is read-only: MySQL does not need to
+// be stopped, and nothing is written to disk. The archive is read as it streams in, to
+// list its databases and tables (from the names of their files), and to read the
+// `xtrabackup_info`, `xtrabackup_binlog_info` and `backup-my.cnf` files that `xtrabackup`
+// saves with each backup: the version of the backed up server, the version of
+// `xtrabackup`, when the backup was taken, and the binary log position (and GTID set)
+// it is consistent with. The backup is then compared with the data directory and the
+// running server, if any: the databases and tables that restoring would add, or would
+// delete, are listed, along with warnings about a different MySQL release series, a
+// partial backup, or InnoDB settings that diverge from `mysql_defaults_file`. The
+// report is printed on standard error, and as JSON on standard output. Tables are only
+// listed when the backup files are not compressed, or are compressed one by one (as
+// `xtrabackup --compress` does), and the metadata files are not read from compressed
+// backups. It can't be combined with `mysql_extract_only` or `mysql_restore_grants_only`.
+//
+// REPLICA BACKUPS
+//
+// A backup of a replica can provision more replicas of the same master, as long as it
+// records where the replica was in the binary log of its master. When `mysql_slave_info`
+// is true, backups are taken with `xtrabackup --slave-info`, which saves that position in
+// an `xtrabackup_slave_info` file, at the root of the archive, as the CHANGE MASTER TO
+// statement to run on the new replica (along with SET GLOBAL gtid_purged, when the
+// replica uses GTIDs). The plugin prints the position, and the statements, on standard
+// error once the backup is done, and the restore preview reports it. When the server is
+// not a replica, there is no position to record, and the backup only warns about it.
+// The statements leave out the host and credentials of the master, which have to be
+// added before running them.
+//
+// PRIVILEGES
+//
+// The files of the data directory usually belong to the user MySQL runs as, and only
+// that user can read and write them. When `mysql_run_as` is set, the plugin runs
+// `xtrabackup` (backup, decompress, prepare and move back) and `tar` as that user, and
+// gives it the temporary target directory (and the extract directory), so that the
+// restored files belong to it, without a `chown -R` afterwards. Its primary and
+// supplementary groups are set too. Privileges can only be dropped when the plugin
+// runs as root: otherwise, the commands run as the plugin user, with a warning.
+// The user must be able to reach `mysql_temp_targetdir` (or `mysql_extract_dir`).
+//
+// CLEANUP DETAILS
+//
+// A backup or restore that gets killed (i.e. with SIGKILL) leaves the temporary
+// target directory behind, full of data. Each backup and restore removes it before
+// starting, and the `cleanup` command removes it on demand, to reclaim the disk
+// space right away (with `--dry-run`, it only reports it). Do not run `cleanup`
+// while a backup or a restore is in progress.
+//
 // DEPENDENCIES
 //
 // This plugin relies on the `xtrabackup` and `tar` utilities. Please ensure
 // that they are present on the system that will be running the
-// backups + restores for MySQL.
+// backups + restores for MySQL. Verifying restores also requires the
+// `innochecksum` and `myisamchk` utilities that ship with MySQL. Restoring
+// compressed backups requires `qpress`, `lz4` or `zstd`. The
+// `validate` command checks that all the required utilities can be found.
 package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"syscall"
 
-	"github.com/starkandwayne/goutils/ansi"
-
 	. "github.com/starkandwayne/shield/plugin"
 )
 
@@ -93,6 +416,14 @@ var (
 	DefaultDataDir       = "/var/lib/mysql"
 	DefaultTempTargetDir = "/tmp/backups"
 	DefaultXtrabackup    = "/var/vcap/packages/shield-mysql/bin/xtrabackup"
+
+	DefaultLockDDL                = false
+	DefaultFTWRLWaitTimeout       = 0
+	DefaultKillLongQueriesTimeout = 0
+	DefaultCompress               = ""
+	DefaultUseMemory              = ""
+
+	DefaultExtractOnly = false
 )
 
 func main() {
@@ -111,11 +442,48 @@ func main() {
 
   "mysql_databases":      "db1,db2",              # List of databases to limit
                                                   # backup and recovery to.
+  "mysql_databases_exclude": "db3 db4",           # Or, databases to leave out of the backup
+  "mysql_tables":         "^db1[.]orders",        # Only back up tables matching this regex
+  "mysql_tables_exclude": "[.]tmp_",              # Skip tables matching this regex
 
+  "mysql_defaults_file":  "/etc/mysql/my.cnf",    # MySQL option file to read settings from
   "mysql_datadir":        "/var/lib/mysql",       # Path to the MySQL data directory
   "mysql_xtrabackup":     "/path/to/xtrabackup",  # Full path to the xtrabackup binary
   "mysql_temp_targetdir": "/tmp/backups"          # Temporary work directory
   "mysql_tar":            "tar"                   # Tar-compatible archival tool to use
+
+  "mysql_lock_ddl":                  true,        # Use backup locks, instead of a global read lock
+  "mysql_ftwrl_wait_timeout":        60,          # Seconds to wait for long queries before locking
+  "mysql_kill_long_queries_timeout": 30,          # Seconds before killing queries that block the lock
+  "mysql_compress":       "zstd",                 # Compress backup files (quicklz, lz4 or zstd)
+  "mysql_use_memory":     "1G",                   # Memory to prepare backups with, on restore
+
+  "mysql_extract_only":   false,                  # Only unpack and prepare backups, on restore
+  "mysql_extract_dir":    "/tmp/extract",         # Where to unpack them
+
+  "mysql_verify_after_restore": true,             # Check restored files for corruption
+  "mysql_innochecksum":   "/path/to/innochecksum",
+  "mysql_myisamchk":      "/path/to/myisamchk",
+
+  "mysql_innodb_config_file": "/etc/mysql/conf.d/innodb.cnf", # Where to write the InnoDB settings of restored backups
+
+  "mysql_run_as":         "mysql",                # Run xtrabackup and tar as this OS user
+
+  "mysql_safety_backup_dir": "/var/lib/mysql-safety", # Where to move the datadir contents, until the restore succeeds
+  "mysql_force_partial_restore": false,           # Restore partial backups all the same
+
+  "mysql_backup_grants":       true,              # Also dump users and grants, as SQL
+  "mysql_restore_grants_only": false,             # Only apply them to the running server, on restore
+  "mysql_client":         "/path/to/mysql",
+  "mysql_socket":         "/var/run/mysqld/mysqld.sock", # Found on its own when not set
+
+  "mysql_restore_preview": false,                 # Only report what a restore would change
+
+  "mysql_slave_info":     true,                   # Record the master position of replicas
+
+  "mysql_log_file":       "/var/vcap/sys/log/shield/xtrabackup.log", # Keep what xtrabackup said
+
+  "mysql_checksum":       true                    # Catch archives corrupted on the way
 }
 `,
 		Defaults: `
@@ -123,9 +491,261 @@ func main() {
   "mysql_tar"           : "tar",
   "mysql_datadir"       : "/var/lib/mysql",
   "mysql_xtrabackup"    : "/var/vcap/packages/shield-mysql/bin/xtrabackup",
-  "mysql_temp_targetdir": "/tmp/backups"
+  "mysql_temp_targetdir": "/tmp/backups",
+  "mysql_lock_ddl"                 : false,
+  "mysql_ftwrl_wait_timeout"       : 0,
+  "mysql_kill_long_queries_timeout": 0,
+  "mysql_compress"                 : "",
+  "mysql_use_memory"               : "",
+  "mysql_extract_only"             : false,
+  "mysql_verify_after_restore"     : false,
+  "mysql_innochecksum"  : "/var/vcap/packages/shield-mysql/bin/innochecksum",
+  "mysql_myisamchk"     : "/var/vcap/packages/shield-mysql/bin/myisamchk",
+  "mysql_backup_grants"       : false,
+  "mysql_restore_grants_only" : false,
+  "mysql_client"        : "/var/vcap/packages/shield-mysql/bin/mysql",
+  "mysql_restore_preview"     : false,
+  "mysql_slave_info"          : false,
+  "mysql_checksum"            : false
 }
 `,
+		Fields: []Field{
+			{
+				Name:     "mysql_user",
+				Label:    "MySQL Username",
+				Type:     TextField,
+				Required: true,
+				Help:     "Username to authenticate to MySQL as.",
+			},
+			{
+				Name:     "mysql_password",
+				Label:    "MySQL Password",
+				Type:     PasswordField,
+				Required: true,
+				Help:     "Password to authenticate to MySQL with.",
+			},
+			{
+				Name:        "mysql_databases",
+				Label:       "Databases to Backup",
+				Type:        TextField,
+				Placeholder: "(all databases)",
+				Help:        "A space-separated list of databases (or database.table) to limit backup and restore to.",
+				Examples:    []string{"db1 db2", "db1.table1"},
+			},
+			{
+				Name:     "mysql_databases_exclude",
+				Label:    "Databases to Exclude",
+				Type:     TextField,
+				Help:     "A space-separated list of databases to leave out of the backup; all the others are backed up. Can't be combined with the databases to backup.",
+				Examples: []string{"db3 db4"},
+			},
+			{
+				Name:     "mysql_tables",
+				Label:    "Tables to Backup",
+				Type:     TextField,
+				Help:     "A regular expression, matched against 'database.table' names, to limit the backup to. Partial backups have restore caveats.",
+				Examples: []string{"^db1[.]orders", "^(db1|db2)[.]"},
+			},
+			{
+				Name:     "mysql_tables_exclude",
+				Label:    "Tables to Exclude",
+				Type:     TextField,
+				Help:     "A regular expression, matched against 'database.table' names, of tables to leave out of the backup.",
+				Examples: []string{"[.]tmp_", "^db1[.]sessions$"},
+			},
+			{
+				Name:     "mysql_defaults_file",
+				Label:    "MySQL Option File",
+				Type:     TextField,
+				Help:     "Absolute path to a MySQL option file (my.cnf) for xtrabackup to read the datadir, socket and InnoDB settings from.",
+				Examples: []string{"/etc/mysql/my.cnf", "/var/vcap/jobs/mysql/config/my.cnf"},
+			},
+			{
+				Name:    "mysql_datadir",
+				Label:   "MySQL Data Directory",
+				Type:    TextField,
+				Default: DefaultDataDir,
+				Help:    "Absolute path to the MySQL data directory. Read from the MySQL option file, if there is one.",
+			},
+			{
+				Name:    "mysql_xtrabackup",
+				Label:   "Path to xtrabackup",
+				Type:    TextField,
+				Default: DefaultXtrabackup,
+				Help:    "Absolute path to the `xtrabackup` utility.",
+			},
+			{
+				Name:    "mysql_temp_targetdir",
+				Label:   "Temporary Directory",
+				Type:    TextField,
+				Default: DefaultTempTargetDir,
+				Help:    "A scratch directory, as big as the MySQL data directory, used while backing up and restoring.",
+			},
+			{
+				Name:    "mysql_tar",
+				Label:   "Path to tar",
+				Type:    TextField,
+				Default: DefaultTar,
+				Help:    "Tar-compatible archival tool to use.",
+			},
+			{
+				Name:    "mysql_lock_ddl",
+				Label:   "Lock DDL",
+				Type:    BooleanField,
+				Default: DefaultLockDDL,
+				Help:    "Block DDL statements with backup locks for the duration of the backup, instead of taking a global read lock.",
+			},
+			{
+				Name:    "mysql_ftwrl_wait_timeout",
+				Label:   "Read Lock Wait Timeout",
+				Type:    NumberField,
+				Default: DefaultFTWRLWaitTimeout,
+				Help:    "How many seconds to wait for long-running queries to finish before taking the global read lock (0 to not wait).",
+			},
+			{
+				Name:    "mysql_kill_long_queries_timeout",
+				Label:   "Kill Long Queries Timeout",
+				Type:    NumberField,
+				Default: DefaultKillLongQueriesTimeout,
+				Help:    "How many seconds to let queries that block the global read lock run before killing them (0 to never kill them).",
+			},
+			{
+				Name:        "mysql_compress",
+				Label:       "Compression",
+				Type:        TextField,
+				Placeholder: "(no compression)",
+				Format:      `^(quicklz|lz4|zstd)?$`,
+				Invalid:     "The compression must be one of 'quicklz', 'lz4' or 'zstd'",
+				Help:        "How xtrabackup compresses the backup files. lz4 requires xtrabackup 2.4.21 / 8.0.20, and zstd requires 8.0.30.",
+				Examples:    []string{"quicklz", "lz4", "zstd"},
+			},
+			{
+				Name:        "mysql_use_memory",
+				Label:       "Prepare Memory",
+				Type:        TextField,
+				Placeholder: "(xtrabackup default, 100M)",
+				Format:      `^[0-9]+[KMGkmg]?$`,
+				Invalid:     "The memory must be a size, like 512M or 2G",
+				Help:        "How much memory `xtrabackup --prepare` uses on restore. More is faster, but too much gets it killed on memory-limited hosts.",
+				Examples:    []string{"512M", "2G"},
+			},
+			{
+				Name:    "mysql_extract_only",
+				Label:   "Extract Only",
+				Type:    BooleanField,
+				Default: DefaultExtractOnly,
+				Help:    "Only unpack and prepare the backup in the extract directory on restore, without touching the MySQL data directory.",
+			},
+			{
+				Name:  "mysql_extract_dir",
+				Label: "Extract Directory",
+				Type:  TextField,
+				Help:  "Where to unpack the backup, in extract-only mode. Needs as much scratch space as the MySQL data directory.",
+			},
+			{
+				Name:    "mysql_verify_after_restore",
+				Label:   "Verify After Restore",
+				Type:    BooleanField,
+				Default: DefaultVerifyAfterRestore,
+				Help:    "Check the restored InnoDB and MyISAM files for corruption, before declaring the restore successful.",
+			},
+			{
+				Name:    "mysql_innochecksum",
+				Label:   "Path to innochecksum",
+				Type:    TextField,
+				Default: DefaultInnochecksum,
+				Help:    "Absolute path to the `innochecksum` utility, used to verify restored InnoDB tablespaces.",
+			},
+			{
+				Name:    "mysql_myisamchk",
+				Label:   "Path to myisamchk",
+				Type:    TextField,
+				Default: DefaultMyisamchk,
+				Help:    "Absolute path to the `myisamchk` utility, used to verify restored MyISAM tables.",
+			},
+			{
+				Name:     "mysql_innodb_config_file",
+				Label:    "InnoDB Settings File",
+				Type:     TextField,
+				Help:     "Option file to write the InnoDB settings of the backup to, on restore, for the MySQL option file to include.",
+				Examples: []string{"/etc/mysql/conf.d/innodb.cnf"},
+			},
+			{
+				Name:     "mysql_run_as",
+				Label:    "Run As",
+				Type:     TextField,
+				Help:     "OS user (name or uid) to run `xtrabackup` and `tar` as, i.e. the user MySQL runs as.  Only effective when the plugin runs as root.",
+				Examples: []string{"mysql"},
+			},
+			{
+				Name:     "mysql_safety_backup_dir",
+				Label:    "Safety Backup Directory",
+				Type:     TextField,
+				Help:     "Directory to move the contents of the data directory to, on restore, and to move them back from if the restore fails.  Must be on the same filesystem as the data directory.",
+				Examples: []string{"/var/lib/mysql-safety"},
+			},
+			{
+				Name:    "mysql_force_partial_restore",
+				Label:   "Force Partial Restores",
+				Type:    BooleanField,
+				Default: DefaultForcePartialRestore,
+				Help:    "Move partial backups back in place of the data directory, even though a safety backup could be rolled back to instead.",
+			},
+			{
+				Name:    "mysql_backup_grants",
+				Label:   "Backup Grants",
+				Type:    BooleanField,
+				Default: DefaultBackupGrants,
+				Help:    "Also dump the users and grants of the server, as SQL statements, so that they can be restored on their own.",
+			},
+			{
+				Name:    "mysql_restore_grants_only",
+				Label:   "Restore Grants Only",
+				Type:    BooleanField,
+				Default: DefaultRestoreGrantsOnly,
+				Help:    "Only apply the users and grants of the backup to the running server on restore, without touching the data.",
+			},
+			{
+				Name:    "mysql_client",
+				Label:   "Path to mysql",
+				Type:    TextField,
+				Default: DefaultClient,
+				Help:    "Absolute path to the `mysql` client, used to dump and apply users and grants.",
+			},
+			{
+				Name:  "mysql_socket",
+				Label: "MySQL Socket",
+				Type:  TextField,
+				Help:  "Path to the unix socket of the MySQL server. When not set, it is read from the defaults file, asked to the server, or looked for in the usual places.",
+			},
+			{
+				Name:    "mysql_restore_preview",
+				Label:   "Restore Preview",
+				Type:    BooleanField,
+				Default: DefaultRestorePreview,
+				Help:    "Only report what the backup holds, and what restoring it would change, without touching the data.",
+			},
+			{
+				Name:    "mysql_slave_info",
+				Label:   "Record Master Position",
+				Type:    BooleanField,
+				Default: DefaultSlaveInfo,
+				Help:    "When backing up a replica, record the binary log position of its master, to provision new replicas from the backup.",
+			},
+			{
+				Name:  "mysql_log_file",
+				Label: "xtrabackup Log File",
+				Type:  TextField,
+				Help:  "Absolute path of a file to append the output of xtrabackup to (backup and prepare), with secrets redacted, for audit.",
+			},
+			{
+				Name:    "mysql_checksum",
+				Label:   "Checksum Archives",
+				Type:    BooleanField,
+				Default: DefaultChecksum,
+				Help:    "Follow the archive with its SHA-256 checksum, for restores to catch archives that were truncated or corrupted on their way to storage and back.",
+			},
+		},
 	}
 
 	Run(p)
@@ -134,13 +754,61 @@ func main() {
 type XtraBackupPlugin PluginInfo
 
 type XtraBackupEndpoint struct {
-	Databases string
-	DataDir   string
-	User      string
-	Password  string
-	Bin       string
-	TargetDir string
-	Tar       string
+	Databases        string
+	DatabasesExclude []string
+	Tables           string
+	TablesExclude    string
+	DataDir          string
+	DefaultsFile     string
+	User             string
+	Password         string
+	Bin              string
+	TargetDir        string
+	Tar              string
+
+	LockDDL                bool
+	FTWRLWaitTimeout       int
+	KillLongQueriesTimeout int
+	Compress               string
+	UseMemory              string
+
+	ExtractOnly bool
+	ExtractDir  string
+
+	VerifyAfterRestore bool
+	Innochecksum       string
+	Myisamchk          string
+
+	InnoDBConfigFile string
+
+	RunAs *RunAs
+
+	SafetyBackupDir     string
+	ForcePartialRestore bool
+
+	BackupGrants      bool
+	RestoreGrantsOnly bool
+	Client            string
+
+	// Socket is the unix socket of the server, as set by mysql_socket,
+	// or as found by findSocket.
+	Socket string
+	// tcp makes the mysql client connect over TCP, for findSocket.
+	tcp bool
+
+	RestorePreview bool
+
+	SlaveInfo bool
+
+	// LogFile is where the output of xtrabackup is kept, and log is that
+	// file, once it has been opened.
+	LogFile string
+	log     *xtrabackupLog
+
+	Checksum bool
+
+	// Version is the version of Bin, once it has been detected.
+	Version *XtraBackupVersion
 }
 
 func (p XtraBackupPlugin) Meta() PluginInfo {
@@ -156,190 +824,613 @@ func (p XtraBackupPlugin) Validate(endpoint ShieldEndpoint) error {
 
 	s, err = endpoint.StringValue("mysql_user")
 	if err != nil {
-		ansi.Printf("@R{\u2717 mysql_user          %s}\n", err)
+		Printf("@R{\u2717 mysql_user          %s}\n", err)
 		fail = true
 	} else {
-		ansi.Printf("@G{\u2713 mysql_user}          @C{%s}\n", s)
+		Printf("@G{\u2713 mysql_user}          @C{%s}\n", s)
 	}
 
 	s, err = endpoint.StringValue("mysql_password")
 	if err != nil {
-		ansi.Printf("@R{\u2717 mysql_password      %s}\n", err)
+		Printf("@R{\u2717 mysql_password      %s}\n", err)
 		fail = true
 	} else {
-		ansi.Printf("@G{\u2713 mysql_password}      @C{%s}\n", s)
+		Printf("@G{\u2713 mysql_password}      @C{%s}\n", s)
 	}
 
 	s, err = endpoint.StringValueDefault("mysql_databases", "")
 	if err != nil {
-		ansi.Printf("@R{\u2717 mysql_databases  %s}\n", err)
+		Printf("@R{\u2717 mysql_databases  %s}\n", err)
+		fail = true
+	} else if s == "" {
+		Printf("@G{\u2713 mysql_databases}  no databases\n")
+	} else {
+		Printf("@G{\u2713 mysql_databases}  @C{%s}\n", s)
+	}
+	databases := s
+
+	s, err = endpoint.StringValueDefault("mysql_databases_exclude", "")
+	if err != nil {
+		Printf("@R{\u2717 mysql_databases_exclude  %s}\n", err)
 		fail = true
 	} else if s == "" {
-		ansi.Printf("@G{\u2713 mysql_databases}  no databases\n")
+		Printf("@G{\u2713 mysql_databases_exclude}  not set\n")
+	} else if databases != "" {
+		Printf("@R{\u2717 mysql_databases_exclude  can't be combined with mysql_databases}\n")
+		fail = true
+	} else {
+		Printf("@G{\u2713 mysql_databases_exclude}  @C{%s}\n", s)
+	}
+
+	for _, field := range []string{"mysql_tables", "mysql_tables_exclude"} {
+		s, err = endpoint.StringValueDefault(field, "")
+		if err != nil {
+			Printf("@R{\u2717 %s  %s}\n", field, err)
+			fail = true
+		} else if s == "" {
+			Printf("@G{\u2713 %s}  not set\n", field)
+		} else if _, err = regexp.Compile(s); err != nil {
+			Printf("@R{\u2717 %s  invalid regular expression: %s}\n", field, err)
+			fail = true
+		} else {
+			Printf("@G{\u2713 %s}  @C{%s}\n", field, s)
+		}
+	}
+
+	defaults, err := endpoint.StringValueDefault("mysql_defaults_file", "")
+	if err != nil {
+		Printf("@R{\u2717 mysql_defaults_file  %s}\n", err)
+		fail = true
+	} else if defaults == "" {
+		Printf("@G{\u2713 mysql_defaults_file}  not set\n")
+	} else if _, err := readOptionFile(defaults); err != nil {
+		Printf("@R{\u2717 mysql_defaults_file  %s}\n", err)
+		fail = true
+		defaults = ""
 	} else {
-		ansi.Printf("@G{\u2713 mysql_databases}  @C{%s}\n", s)
+		Printf("@G{\u2713 mysql_defaults_file}  @C{%s}\n", defaults)
 	}
 
-	s, err = endpoint.StringValueDefault("mysql_datadir", DefaultDataDir)
+	datadir := DefaultDataDir
+	if defaults != "" {
+		datadir = ""
+	}
+	s, err = endpoint.StringValueDefault("mysql_datadir", datadir)
 	if err != nil {
-		ansi.Printf("@R{\u2717 mysql_datadir  %s}\n", err)
+		Printf("@R{\u2717 mysql_datadir  %s}\n", err)
 		fail = true
+	} else if s == "" && defaults != "" {
+		if s, err = datadirFromDefaults(defaults); err != nil {
+			Printf("@R{\u2717 mysql_datadir  %s}\n", err)
+			fail = true
+		} else if s == "" {
+			Printf("@G{\u2713 mysql_datadir}  not set in @C{%s}; left for xtrabackup to find\n", defaults)
+		} else {
+			Printf("@G{\u2713 mysql_datadir}  @C{%s} (from @C{%s})\n", s, defaults)
+		}
 	} else if s == "" {
-		ansi.Printf("@R{\u2717 mysql_datadir}  no datadir\n")
+		Printf("@R{\u2717 mysql_datadir}  no datadir\n")
 		fail = true
 	} else {
-		ansi.Printf("@G{\u2713 mysql_datadir}  @C{%s}\n", s)
+		Printf("@G{\u2713 mysql_datadir}  @C{%s}\n", s)
 	}
+	datadir = s
 
 	s, err = endpoint.StringValueDefault("mysql_xtrabackup", DefaultXtrabackup)
 	if err != nil {
-		ansi.Printf("@R{\u2717 mysql_xtrabackup  %s}\n", err)
+		Printf("@R{\u2717 mysql_xtrabackup  %s}\n", err)
 		fail = true
 	} else if s == "" {
-		ansi.Printf("@R{\u2717 mysql_xtrabackup}  xtrabackup command not specified\n")
+		Printf("@R{\u2717 mysql_xtrabackup}  xtrabackup command not specified\n")
 		fail = true
 	} else {
-		ansi.Printf("@G{\u2713 mysql_xtrabackup}  @C{%s}\n", s)
+		Printf("@G{\u2713 mysql_xtrabackup}  @C{%s}\n", s)
 	}
 
 	s, err = endpoint.StringValueDefault("mysql_temp_targetdir", DefaultTempTargetDir)
 	if err != nil {
-		ansi.Printf("@R{\u2717 mysql_temp_targetdir  %s}\n", err)
+		Printf("@R{\u2717 mysql_temp_targetdir  %s}\n", err)
 		fail = true
 	} else if s == "" {
-		ansi.Printf("@R{\u2717 mysql_temp_targetdir}  no temporary target dir\n")
+		Printf("@R{\u2717 mysql_temp_targetdir}  no temporary target dir\n")
+		fail = true
+	} else if err = checkTempTargetDir(s, datadir); err != nil {
+		Printf("@R{\u2717 mysql_temp_targetdir  %s}\n", err)
 		fail = true
 	} else {
-		ansi.Printf("@G{\u2713 mysql_temp_targetdir}  @C{%s}\n", s)
+		Printf("@G{\u2713 mysql_temp_targetdir}  @C{%s}\n", s)
 	}
 
 	s, err = endpoint.StringValueDefault("mysql_tar", DefaultTar)
 	if err != nil {
-		ansi.Printf("@R{\u2717 mysql_tar  %s}\n", err)
+		Printf("@R{\u2717 mysql_tar  %s}\n", err)
+		fail = true
+	} else if s == "" {
+		Printf("@R{\u2717 mysql_tar}  tar command not specified\n")
+		fail = true
+	} else {
+		Printf("@G{\u2713 mysql_tar}  @C{%s}\n", s)
+	}
+
+	b, err := endpoint.BooleanValueDefault("mysql_lock_ddl", DefaultLockDDL)
+	if err != nil {
+		Printf("@R{\u2717 mysql_lock_ddl  %s}\n", err)
+		fail = true
+	} else if b {
+		Printf("@G{\u2713 mysql_lock_ddl}  @C{yes}, DDL will be blocked with backup locks\n")
+	} else {
+		Printf("@G{\u2713 mysql_lock_ddl}  @C{no}\n")
+	}
+
+	for _, field := range []struct {
+		name string
+		def  int
+	}{
+		{"mysql_ftwrl_wait_timeout", DefaultFTWRLWaitTimeout},
+		{"mysql_kill_long_queries_timeout", DefaultKillLongQueriesTimeout},
+	} {
+		n, err := timeoutValue(endpoint, field.name, field.def)
+		if err != nil {
+			Printf("@R{\u2717 %s  %s}\n", field.name, err)
+			fail = true
+		} else if n == 0 {
+			Printf("@G{\u2713 %s}  disabled\n", field.name)
+		} else {
+			Printf("@G{\u2713 %s}  @C{%d} seconds\n", field.name, n)
+		}
+	}
+
+	s, err = endpoint.StringValueDefault("mysql_compress", DefaultCompress)
+	if err != nil {
+		Printf("@R{\u2717 mysql_compress  %s}\n", err)
+		fail = true
+	} else if !validCompression(s) {
+		Printf("@R{\u2717 mysql_compress  must be one of quicklz, lz4 or zstd}\n")
+		fail = true
+	} else if s == "" {
+		Printf("@G{\u2713 mysql_compress}  no compression\n")
+	} else {
+		Printf("@G{\u2713 mysql_compress}  @C{%s}\n", s)
+	}
+
+	s, err = endpoint.StringValueDefault("mysql_use_memory", DefaultUseMemory)
+	if err != nil {
+		Printf("@R{\u2717 mysql_use_memory  %s}\n", err)
 		fail = true
 	} else if s == "" {
-		ansi.Printf("@R{\u2717 mysql_tar}  tar command not specified\n")
+		Printf("@G{\u2713 mysql_use_memory}  xtrabackup default\n")
+	} else if _, err = parseUseMemory(s); err != nil {
+		Printf("@R{\u2717 mysql_use_memory  %s}\n", err)
 		fail = true
 	} else {
-		ansi.Printf("@G{\u2713 mysql_tar}  @C{%s}\n", s)
+		Printf("@G{\u2713 mysql_use_memory}  @C{%s}\n", s)
+	}
+
+	b, err = endpoint.BooleanValueDefault("mysql_extract_only", DefaultExtractOnly)
+	if err != nil {
+		Printf("@R{\u2717 mysql_extract_only  %s}\n", err)
+		fail = true
+	} else {
+		Printf("@G{\u2713 mysql_extract_only}  @C{%t}\n", b)
+	}
+	extractOnly := b
+
+	s, err = endpoint.StringValueDefault("mysql_extract_dir", "")
+	if err != nil {
+		Printf("@R{\u2717 mysql_extract_dir  %s}\n", err)
+		fail = true
+	} else if s == "" && b {
+		Printf("@R{\u2717 mysql_extract_dir  required when mysql_extract_only is set}\n")
+		fail = true
+	} else if s == "" {
+		Printf("@G{\u2713 mysql_extract_dir}  not set\n")
+	} else {
+		Printf("@G{\u2713 mysql_extract_dir}  @C{%s}\n", s)
+	}
+
+	b, err = endpoint.BooleanValueDefault("mysql_verify_after_restore", DefaultVerifyAfterRestore)
+	if err != nil {
+		Printf("@R{\u2717 mysql_verify_after_restore  %s}\n", err)
+		fail = true
+	} else if b {
+		Printf("@G{\u2713 mysql_verify_after_restore}  @C{yes}, restored files will be checked for corruption\n")
+	} else {
+		Printf("@G{\u2713 mysql_verify_after_restore}  @C{no}\n")
+	}
+
+	for _, field := range []struct {
+		name string
+		def  string
+	}{
+		{"mysql_innochecksum", DefaultInnochecksum},
+		{"mysql_myisamchk", DefaultMyisamchk},
+	} {
+		s, err = endpoint.StringValueDefault(field.name, field.def)
+		if err != nil {
+			Printf("@R{\u2717 %s  %s}\n", field.name, err)
+			fail = true
+		} else if s == "" && b {
+			Printf("@R{\u2717 %s  required when mysql_verify_after_restore is set}\n", field.name)
+			fail = true
+		} else {
+			Printf("@G{\u2713 %s}  @C{%s}\n", field.name, s)
+		}
+	}
+
+	s, err = endpoint.StringValueDefault("mysql_innodb_config_file", "")
+	if err != nil {
+		Printf("@R{\u2717 mysql_innodb_config_file  %s}\n", err)
+		fail = true
+	} else if s == "" {
+		Printf("@G{\u2713 mysql_innodb_config_file}  not set\n")
+	} else if !filepath.IsAbs(s) {
+		Printf("@R{\u2717 mysql_innodb_config_file  must be an absolute path}\n")
+		fail = true
+	} else {
+		Printf("@G{\u2713 mysql_innodb_config_file}  @C{%s}\n", s)
+	}
+
+	s, err = endpoint.StringValueDefault("mysql_run_as", "")
+	if err != nil {
+		Printf("@R{\u2717 mysql_run_as  %s}\n", err)
+		fail = true
+	} else if s == "" {
+		Printf("@G{\u2713 mysql_run_as}  not set\n")
+	} else if runAs, err := LookupRunAs(s); err != nil {
+		Printf("@R{\u2717 mysql_run_as  %s}\n", err)
+		fail = true
+	} else {
+		Printf("@G{\u2713 mysql_run_as}  @C{%s}\n", runAs)
+	}
+
+	s, err = endpoint.StringValueDefault("mysql_safety_backup_dir", "")
+	if err != nil {
+		Printf("@R{\u2717 mysql_safety_backup_dir  %s}\n", err)
+		fail = true
+	} else if s == "" {
+		Printf("@G{\u2713 mysql_safety_backup_dir}  not set\n")
+	} else if !filepath.IsAbs(s) {
+		Printf("@R{\u2717 mysql_safety_backup_dir  must be an absolute path}\n")
+		fail = true
+	} else {
+		Printf("@G{\u2713 mysql_safety_backup_dir}  @C{%s}\n", s)
+	}
+
+	b, err = endpoint.BooleanValueDefault("mysql_force_partial_restore", DefaultForcePartialRestore)
+	if err != nil {
+		Printf("@R{\u2717 mysql_force_partial_restore  %s}\n", err)
+		fail = true
+	} else {
+		Printf("@G{\u2713 mysql_force_partial_restore}  @C{%t}\n", b)
+	}
+
+	grants, err := endpoint.BooleanValueDefault("mysql_backup_grants", DefaultBackupGrants)
+	if err != nil {
+		Printf("@R{\u2717 mysql_backup_grants  %s}\n", err)
+		fail = true
+	} else {
+		Printf("@G{\u2713 mysql_backup_grants}  @C{%t}\n", grants)
+	}
+
+	b, err = endpoint.BooleanValueDefault("mysql_restore_grants_only", DefaultRestoreGrantsOnly)
+	if err != nil {
+		Printf("@R{\u2717 mysql_restore_grants_only  %s}\n", err)
+		fail = true
+	} else if b && extractOnly {
+		Printf("@R{\u2717 mysql_restore_grants_only  can't be combined with mysql_extract_only}\n")
+		fail = true
+	} else {
+		Printf("@G{\u2713 mysql_restore_grants_only}  @C{%t}\n", b)
+	}
+	grantsOnly := b
+	grants = grants || b
+
+	s, err = endpoint.StringValueDefault("mysql_client", DefaultClient)
+	if err != nil {
+		Printf("@R{\u2717 mysql_client  %s}\n", err)
+		fail = true
+	} else if s == "" && grants {
+		Printf("@R{\u2717 mysql_client  required when mysql_backup_grants or mysql_restore_grants_only is set}\n")
+		fail = true
+	} else {
+		Printf("@G{\u2713 mysql_client}  @C{%s}\n", s)
+	}
+
+	s, err = endpoint.StringValueDefault("mysql_socket", "")
+	if err != nil {
+		Printf("@R{\u2717 mysql_socket  %s}\n", err)
+		fail = true
+	} else if s != "" && !filepath.IsAbs(s) {
+		Printf("@R{\u2717 mysql_socket  must be an absolute path}\n")
+		fail = true
+	} else if s == "" {
+		Printf("@G{\u2713 mysql_socket}  @C{(found on its own)}\n")
+	} else {
+		Printf("@G{\u2713 mysql_socket}  @C{%s}\n", s)
+	}
+
+	s, err = endpoint.StringValueDefault("mysql_log_file", "")
+	if err != nil {
+		Printf("@R{\u2717 mysql_log_file  %s}\n", err)
+		fail = true
+	} else if s != "" && !filepath.IsAbs(s) {
+		Printf("@R{\u2717 mysql_log_file  must be an absolute path}\n")
+		fail = true
+	} else if s == "" {
+		Printf("@G{\u2713 mysql_log_file}  @C{(none)}\n")
+	} else {
+		Printf("@G{\u2713 mysql_log_file}  @C{%s}\n", s)
+	}
+
+	b, err = endpoint.BooleanValueDefault("mysql_restore_preview", DefaultRestorePreview)
+	if err != nil {
+		Printf("@R{\u2717 mysql_restore_preview  %s}\n", err)
+		fail = true
+	} else if b && (extractOnly || grantsOnly) {
+		Printf("@R{\u2717 mysql_restore_preview  can't be combined with mysql_extract_only or mysql_restore_grants_only}\n")
+		fail = true
+	} else {
+		Printf("@G{\u2713 mysql_restore_preview}  @C{%t}\n", b)
+	}
+
+	b, err = endpoint.BooleanValueDefault("mysql_slave_info", DefaultSlaveInfo)
+	if err != nil {
+		Printf("@R{\u2717 mysql_slave_info  %s}\n", err)
+		fail = true
+	} else if b {
+		Printf("@G{\u2713 mysql_slave_info}  @C{yes}, the master position of replicas will be recorded\n")
+	} else {
+		Printf("@G{\u2713 mysql_slave_info}  @C{no}\n")
+	}
+
+	b, err = endpoint.BooleanValueDefault("mysql_checksum", DefaultChecksum)
+	if err != nil {
+		Printf("@R{\u2717 mysql_checksum  %s}\n", err)
+		fail = true
+	} else if b {
+		Printf("@G{\u2713 mysql_checksum}  @C{yes}, archives will be followed by their checksum\n")
+	} else {
+		Printf("@G{\u2713 mysql_checksum}  @C{no}\n")
+	}
+
+	if !fail {
+		xtrabackup, err := getXtraBackupEndpoint(endpoint)
+		if err != nil {
+			Printf("@R{\u2717 binaries  %s}\n", err)
+			fail = true
+		} else {
+			bins := []string{xtrabackup.Bin, xtrabackup.Tar}
+			if xtrabackup.VerifyAfterRestore {
+				bins = append(bins, xtrabackup.Innochecksum, xtrabackup.Myisamchk)
+			}
+			if xtrabackup.BackupGrants || xtrabackup.RestoreGrantsOnly {
+				bins = append(bins, xtrabackup.Client)
+			}
+			if err = RequireBinaries(bins...); err != nil {
+				Printf("@R{\u2717 binaries  %s}\n", err)
+				fail = true
+			} else {
+				Printf("@G{\u2713 binaries}  @C{%s}\n", strings.Join(bins, ", "))
+
+				if v, err := xtrabackup.version(); err != nil {
+					Printf("@R{\u2717 xtrabackup version  %s}\n", err)
+					fail = true
+				} else if err = xtrabackup.checkFeatures(); err != nil {
+					Printf("@R{\u2717 xtrabackup version  %s}\n", err)
+					fail = true
+				} else {
+					Printf("@G{\u2713 xtrabackup version}  @C{%s}\n", v)
+				}
+			}
+		}
 	}
 
 	if fail {
-		return fmt.Errorf("xtrabackup: invalid configuration")
+		return ValidationError{Plugin: "xtrabackup"}
 	}
 	return nil
 }
 
-func (p XtraBackupPlugin) Backup(endpoint ShieldEndpoint) error {
+func (p XtraBackupPlugin) Backup(endpoint ShieldEndpoint) (err error) {
 	xtrabackup, err := getXtraBackupEndpoint(endpoint)
 	if err != nil {
 		return err
 	}
+	if xtrabackup.log, err = openLog(xtrabackup.LogFile, "backup"); err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Open the xtrabackup log file} %s \n", xtrabackup.LogFile)
+		return err
+	}
+	defer func() { xtrabackup.log.close(err) }()
 
 	targetDir := xtrabackup.TargetDir
-	if fi, err := os.Lstat(targetDir); err == nil {
-		if fi.IsDir() {
-			err = os.RemoveAll(targetDir)
-		} else {
-			err = os.Remove(targetDir)
+	removed, err := xtrabackup.clearTempTargetDir()
+	if err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Check existing temporary target directory} %s \n", xtrabackup.TargetDir)
+		return err
+	}
+	if removed {
+		Fprintf(os.Stderr, "@Y{Removed stale temporary target directory %s, left behind by an interrupted run}\n", targetDir)
+	}
+	Fprintf(os.Stderr, "@G{\u2713 Check existing temporary target directory} %s \n", xtrabackup.TargetDir)
+	if err = xtrabackup.checkFeatures(); err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Check xtrabackup features}\n")
+		return err
+	}
+	Fprintf(os.Stderr, "@G{\u2713 Check xtrabackup features} xtrabackup %s\n", xtrabackup.Version)
+	if xtrabackup.Socket, err = findSocket(xtrabackup); err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Find the MySQL socket}\n")
+		return err
+	}
+	Fprintf(os.Stderr, "@G{\u2713 Find the MySQL socket} %s\n", xtrabackup.Socket)
+	defer func() {
+		if KeepStaging(targetDir, err) {
+			return
+		}
+		os.RemoveAll(targetDir)
+	}()
+	if xtrabackup.RunAs != nil || StagingMode() != 0 {
+		/* xtrabackup, running as mysql_run_as, has to be able to write there */
+		if err = MkdirStaging(targetDir, 0750); err == nil {
+			err = xtrabackup.RunAs.Chown(targetDir)
 		}
 		if err != nil {
-			ansi.Fprintf(os.Stderr, "@R{\u2717 Check existing temporary target directory} %s \n", xtrabackup.TargetDir)
+			Fprintf(os.Stderr, "@R{\u2717 Creating temporary target directory failed} %s \n", targetDir)
 			return err
 		}
 	}
-	ansi.Fprintf(os.Stderr, "@G{\u2713 Check existing temporary target directory} %s \n", xtrabackup.TargetDir)
-	defer func() {
-		os.RemoveAll(targetDir)
-	}()
-	dbs := ""
-	if xtrabackup.Databases != "" {
-		dbs = fmt.Sprintf(`--databases="%s"`, xtrabackup.Databases)
+	dbs, err := xtrabackup.databasesOption()
+	if err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Listing databases to back up failed}\n")
+		return err
+	}
+	if xtrabackup.Tables != "" {
+		dbs += fmt.Sprintf(` --tables="%s"`, xtrabackup.Tables)
+	}
+	if xtrabackup.TablesExclude != "" {
+		dbs += fmt.Sprintf(` --tables-exclude="%s"`, xtrabackup.TablesExclude)
 	}
 
 	// create backup files
-	cmdString := fmt.Sprintf("%s --backup --target-dir=%s --datadir=%s %s --user=%s --password=%s", xtrabackup.Bin, targetDir, xtrabackup.DataDir, dbs, xtrabackup.User, xtrabackup.Password)
+	cmdString := fmt.Sprintf("%s --backup --target-dir=%s%s %s%s%s%s%s --user=%s --password=%s", xtrabackup.xtrabackupCmd(), targetDir, xtrabackup.datadirOption(), dbs, xtrabackup.lockOptions(), xtrabackup.slaveInfoOption(), xtrabackup.compressOption(), xtrabackup.socketOption(), xtrabackup.User, xtrabackup.Password)
 	opts := ExecOptions{
 		Cmd:      cmdString,
 		Stdout:   os.Stdout,
 		ExpectRC: []int{0},
+		RunAs:    xtrabackup.RunAs,
 	}
 
 	DEBUG("Executing: `%s`", cmdString)
-	if err = ExecWithOptions(opts); err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 Creating backup files failed}\n")
+	if err = xtrabackup.log.exec("backup", opts); err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Creating backup files failed}\n")
 		return err
 	}
-	ansi.Fprintf(os.Stderr, "@G{\u2713 Created backup files}\n")
+	Fprintf(os.Stderr, "@G{\u2713 Created backup files}\n")
+	reportInnoDBConfig(targetDir)
+	if xtrabackup.SlaveInfo {
+		reportSlaveInfo(targetDir)
+	}
+	if xtrabackup.BackupGrants {
+		if err = backupGrants(xtrabackup, targetDir); err != nil {
+			return err
+		}
+	}
 
 	// create and return archive
 	cmdString = fmt.Sprintf("%s -cf - -C %s .", xtrabackup.Tar, targetDir)
-	if err = Exec(cmdString, STDOUT); err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 Creating archive failed}\n")
+	if err = xtrabackup.tar(cmdString, STDOUT); err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Creating archive failed}\n")
 		return err
 	}
-	ansi.Fprintf(os.Stderr, "@G{\u2713 Created archive}\n")
+	Fprintf(os.Stderr, "@G{\u2713 Created archive}\n")
 	// remove temporary target directory
 	return os.RemoveAll(targetDir)
 }
 
-func (p XtraBackupPlugin) Restore(endpoint ShieldEndpoint) error {
+func (p XtraBackupPlugin) Restore(endpoint ShieldEndpoint) (err error) {
 	xtrabackup, err := getXtraBackupEndpoint(endpoint)
 	if err != nil {
 		return err
 	}
+	if xtrabackup.RestorePreview {
+		return previewRestore(xtrabackup)
+	}
+	if xtrabackup.RestoreGrantsOnly {
+		if xtrabackup.Socket, err = findSocket(xtrabackup); err != nil {
+			Fprintf(os.Stderr, "@R{\u2717 Find the MySQL socket}\n")
+			return err
+		}
+		Fprintf(os.Stderr, "@G{\u2713 Find the MySQL socket} %s\n", xtrabackup.Socket)
+		return restoreGrants(xtrabackup)
+	}
+	if xtrabackup.log, err = openLog(xtrabackup.LogFile, "restore"); err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Open the xtrabackup log file} %s \n", xtrabackup.LogFile)
+		return err
+	}
+	defer func() { xtrabackup.log.close(err) }()
+	if xtrabackup.ExtractOnly {
+		return extractOnly(xtrabackup)
+	}
 	// mysql must be stopped
 	cmdString := "bash -c \" ps -efw | grep -F mysqld | grep -vE 'grep|mysqld_' &> /dev/null \""
 	if err = Exec(cmdString, STDOUT); err == nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 MySQL must be stopped} Stop it and restart restore\n")
+		Fprintf(os.Stderr, "@R{\u2717 MySQL must be stopped} Stop it and restart restore\n")
 		return err
 	}
-	ansi.Fprintf(os.Stderr, "@G{\u2713 MySQL is stopped}\n")
+	Fprintf(os.Stderr, "@G{\u2713 MySQL is stopped}\n")
 	// targetdir must not exist
 	backupDir := xtrabackup.TargetDir
-	if fi, err := os.Lstat(backupDir); err == nil {
-		if fi.IsDir() {
-			err = os.RemoveAll(backupDir)
-		} else {
-			err = os.Remove(backupDir)
-		}
-		if err != nil {
-			ansi.Fprintf(os.Stderr, "@R{\u2717 Checking existing temporary backup directory failed} %s \n", backupDir)
-			return err
-		}
+	removed, err := xtrabackup.clearTempTargetDir()
+	if err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Checking existing temporary backup directory failed} %s \n", backupDir)
+		return err
 	}
-	ansi.Fprintf(os.Stderr, "@G{\u2713 Checked temporary backup directory} %s \n", backupDir)
+	if removed {
+		Fprintf(os.Stderr, "@Y{Removed stale temporary backup directory %s, left behind by an interrupted run}\n", backupDir)
+	}
+	Fprintf(os.Stderr, "@G{\u2713 Checked temporary backup directory} %s \n", backupDir)
 	defer func() {
+		if KeepStaging(backupDir, err) {
+			return
+		}
 		os.RemoveAll(backupDir)
 	}()
 
 	// datadir exist
 	dataDir := xtrabackup.DataDir
+	if dataDir == "" {
+		Fprintf(os.Stderr, "@R{\u2717 mysql_datadir not set} and not found in %s \n", xtrabackup.DefaultsFile)
+		return ConfigError{Key: "mysql_datadir", Err: fmt.Errorf("unable to determine the MySQL data directory; please set mysql_datadir")}
+	}
 	fi, err := os.Lstat(dataDir)
 	if err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 mysql_datadir not exist} %s \n", dataDir)
+		Fprintf(os.Stderr, "@R{\u2717 mysql_datadir not exist} %s \n", dataDir)
 		return err
 	}
 	if !fi.IsDir() {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 mysql_datadir must be a directory} %s \n", dataDir)
+		Fprintf(os.Stderr, "@R{\u2717 mysql_datadir must be a directory} %s \n", dataDir)
 		return err
 	}
 	myuid := fi.Sys().(*syscall.Stat_t).Uid
 	mygid := fi.Sys().(*syscall.Stat_t).Gid
 
-	files, err := filepath.Glob(fmt.Sprintf("%s/*", dataDir))
-	if err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 unable to read the directory} %s \n", dataDir)
-		return err
-	}
-	for _, f := range files {
-		err = os.RemoveAll(f)
+	restored := false
+	if xtrabackup.SafetyBackupDir != "" {
+		safety, err := moveAside(dataDir, xtrabackup.SafetyBackupDir)
 		if err != nil {
-			ansi.Fprintf(os.Stderr, "@R{\u2717 unable to delete} %s \n", f)
+			Fprintf(os.Stderr, "@R{\u2717 Moving the datadir contents aside failed} %s \n", xtrabackup.SafetyBackupDir)
 			return err
 		}
+		Fprintf(os.Stderr, "@G{\u2713 Moved the datadir contents aside} to %s \n", safety.dir)
+		defer func() {
+			if restored {
+				if err := safety.discard(); err != nil {
+					Fprintf(os.Stderr, "@Y{Unable to remove the safety backup %s: %s}\n", safety.dir, err)
+					return
+				}
+				Fprintf(os.Stderr, "@G{\u2713 Removed the safety backup} %s \n", safety.dir)
+				return
+			}
+			if err := safety.rollback(); err != nil {
+				Fprintf(os.Stderr, "@R{\u2717 Rolling back the datadir failed: %s; its previous contents are in} %s \n", err, safety.dir)
+				return
+			}
+			Fprintf(os.Stderr, "@Y{Restore failed; moved the previous datadir contents back to %s}\n", dataDir)
+		}()
+	} else {
+		files, err := filepath.Glob(fmt.Sprintf("%s/*", dataDir))
+		if err != nil {
+			Fprintf(os.Stderr, "@R{\u2717 unable to read the directory} %s \n", dataDir)
+			return err
+		}
+		for _, f := range files {
+			err = os.RemoveAll(f)
+			if err != nil {
+				Fprintf(os.Stderr, "@R{\u2717 unable to delete} %s \n", f)
+				return err
+			}
+		}
 	}
-	ansi.Fprintf(os.Stderr, "@G{\u2713 Checked datadir directory} %s \n", dataDir)
+	Fprintf(os.Stderr, "@G{\u2713 Checked datadir directory} %s \n", dataDir)
 
 	// create tmp folder
 	cmdString = fmt.Sprintf("mkdir -p %s", backupDir)
@@ -350,44 +1441,66 @@ func (p XtraBackupPlugin) Restore(endpoint ShieldEndpoint) error {
 	}
 	DEBUG("Executing: `%s`", cmdString)
 	if err = ExecWithOptions(opts); err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 Creating temporary backup directory failed} %s \n", backupDir)
+		Fprintf(os.Stderr, "@R{\u2717 Creating temporary backup directory failed} %s \n", backupDir)
+		return err
+	}
+	if err = xtrabackup.RunAs.Chown(backupDir); err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Creating temporary backup directory failed} %s \n", backupDir)
 		return err
 	}
-	ansi.Fprintf(os.Stderr, "@G{\u2713 Created temporary backup directory} %s \n", backupDir)
+	Fprintf(os.Stderr, "@G{\u2713 Created temporary backup directory} %s \n", backupDir)
 
 	// unpack archive
 	cmdString = fmt.Sprintf("%s -xf - -C %s", xtrabackup.Tar, backupDir)
 	DEBUG("Executing: `%s`", cmdString)
-	if err = Exec(cmdString, STDIN); err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 Unpacking backup file failed} \n")
+	if err = xtrabackup.tar(cmdString, STDIN); err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Unpacking backup file failed} \n")
+		return err
+	}
+	Fprintf(os.Stderr, "@G{\u2713 Unpacked backup file} \n")
+	/* users and grants come back with the mysql database; that file is not MySQL's */
+	if err = os.Remove(filepath.Join(backupDir, GrantsFile)); err != nil && !os.IsNotExist(err) {
+		Fprintf(os.Stderr, "@R{\u2717 Removing %s from the backup failed}\n", GrantsFile)
+		return err
+	}
+	if err = xtrabackup.decompress(backupDir); err != nil {
 		return err
 	}
-	ansi.Fprintf(os.Stderr, "@G{\u2713 Unpacked backup file} \n")
-	cmdString = fmt.Sprintf("%s --prepare --target-dir=%s", xtrabackup.Bin, backupDir)
+	if err = checkInnoDBConfig(xtrabackup, backupDir, true); err != nil {
+		return err
+	}
+	if warnPartialBackup(backupDir) && xtrabackup.SafetyBackupDir != "" && !xtrabackup.ForcePartialRestore {
+		Fprintf(os.Stderr, "@R{\u2717 Refusing to restore a partial backup; set mysql_force_partial_restore to restore it all the same}\n")
+		err = fmt.Errorf("refusing to restore a partial backup (see `mysql_force_partial_restore`)")
+		return err
+	}
+	cmdString = xtrabackup.prepareCmd(backupDir)
 	opts = ExecOptions{
 		Cmd:      cmdString,
 		Stdout:   os.Stdout,
 		ExpectRC: []int{0},
+		RunAs:    xtrabackup.RunAs,
 	}
 	DEBUG("Executing: `%s`", cmdString)
-	if err = ExecWithOptions(opts); err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 The Xtrabackup Prepare operation failed}\n")
+	if err = xtrabackup.log.exec("prepare", opts); err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 The Xtrabackup Prepare operation failed}\n")
 		return err
 	}
-	ansi.Fprintf(os.Stderr, "@G{\u2713 The Xtrabackup Prepare operation is performed}\n")
+	Fprintf(os.Stderr, "@G{\u2713 The Xtrabackup Prepare operation is performed}\n")
 
-	cmdString = fmt.Sprintf("%s --move-back --target-dir=%s --datadir=%s", xtrabackup.Bin, backupDir, xtrabackup.DataDir)
+	cmdString = fmt.Sprintf("%s --move-back --target-dir=%s%s", xtrabackup.xtrabackupCmd(), backupDir, xtrabackup.datadirOption())
 	opts = ExecOptions{
 		Cmd:      cmdString,
 		Stdout:   os.Stdout,
 		ExpectRC: []int{0},
+		RunAs:    xtrabackup.RunAs,
 	}
 	DEBUG("Executing: `%s`", cmdString)
 	if err = ExecWithOptions(opts); err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 Restoring MySQL server failed}\n")
+		Fprintf(os.Stderr, "@R{\u2717 Restoring MySQL server failed}\n")
 		return err
 	}
-	ansi.Fprintf(os.Stderr, "@G{\u2713 Restored MySQL server}\n")
+	Fprintf(os.Stderr, "@G{\u2713 Restored MySQL server}\n")
 	// change uid and gid of restore file
 	err = filepath.Walk(xtrabackup.DataDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -399,15 +1512,87 @@ func (p XtraBackupPlugin) Restore(endpoint ShieldEndpoint) error {
 		return nil
 	})
 	if err != nil {
-		ansi.Fprintf(os.Stderr, "@R{\u2717 Changing files ownership failed}\n")
+		Fprintf(os.Stderr, "@R{\u2717 Changing files ownership failed}\n")
 		return err
 	}
 
-	ansi.Fprintf(os.Stderr, "@G{\u2713 Changed files ownership}\n")
+	Fprintf(os.Stderr, "@G{\u2713 Changed files ownership}\n")
+
+	if xtrabackup.VerifyAfterRestore {
+		if err = verifyDataDir(xtrabackup, xtrabackup.DataDir); err != nil {
+			return err
+		}
+	}
+	restored = true
 	// remove temporary target directory
 	return os.RemoveAll(xtrabackup.TargetDir)
 }
 
+// extractOnly unpacks and prepares the backup in the extract directory,
+// and stops before moving it back to the data directory.
+func extractOnly(xtrabackup XtraBackupEndpoint) error {
+	dir := xtrabackup.ExtractDir
+	if dir == "" {
+		return ConfigError{Key: "mysql_extract_dir", Err: fmt.Errorf("mysql_extract_dir is required when mysql_extract_only is set")}
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		Fprintf(os.Stderr, "@R{\u2717 Check extract directory} %s \n", dir)
+		return err
+	}
+	if len(entries) > 0 {
+		Fprintf(os.Stderr, "@R{\u2717 Check extract directory} %s \n", dir)
+		return fmt.Errorf("extract directory '%s' is not empty", dir)
+	}
+	if err = MkdirStaging(dir, 0755); err == nil {
+		err = xtrabackup.RunAs.Chown(dir)
+	}
+	if err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Check extract directory} %s \n", dir)
+		return err
+	}
+	Fprintf(os.Stderr, "@G{\u2713 Checked extract directory} %s \n", dir)
+
+	cmdString := fmt.Sprintf("%s -xf - -C %s", xtrabackup.Tar, dir)
+	DEBUG("Executing: `%s`", cmdString)
+	if err = xtrabackup.tar(cmdString, STDIN); err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Unpacking backup file failed} \n")
+		return err
+	}
+	Fprintf(os.Stderr, "@G{\u2713 Unpacked backup file} \n")
+	if err = xtrabackup.decompress(dir); err != nil {
+		return err
+	}
+	if err = checkInnoDBConfig(xtrabackup, dir, false); err != nil {
+		return err
+	}
+
+	cmdString = xtrabackup.prepareCmd(dir)
+	opts := ExecOptions{
+		Cmd:      cmdString,
+		Stdout:   os.Stdout,
+		ExpectRC: []int{0},
+		RunAs:    xtrabackup.RunAs,
+	}
+	DEBUG("Executing: `%s`", cmdString)
+	if err = xtrabackup.log.exec("prepare", opts); err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 The Xtrabackup Prepare operation failed}\n")
+		return err
+	}
+	Fprintf(os.Stderr, "@G{\u2713 The Xtrabackup Prepare operation is performed}\n")
+
+	if xtrabackup.VerifyAfterRestore {
+		if err = verifyDataDir(xtrabackup, dir); err != nil {
+			return err
+		}
+	}
+
+	Fprintf(os.Stderr, "@Y{Extract-only mode: the MySQL data directory was not touched.}\n")
+	Fprintf(os.Stderr, "@Y{The prepared backup is left in %s, for inspection.}\n", dir)
+	return nil
+}
+
 func (p XtraBackupPlugin) Store(endpoint ShieldEndpoint) (string, error) {
 	return "", UNIMPLEMENTED
 }
@@ -420,6 +1605,82 @@ func (p XtraBackupPlugin) Purge(endpoint ShieldEndpoint, file string) error {
 	return UNIMPLEMENTED
 }
 
+// lockOptions returns the xtrabackup flags that bound the impact of the
+// locks taken during the backup, each with a leading space.
+// tar runs a tar command like Exec() does, streaming the archive on the
+// standard output or input, but as `mysql_run_as`, if set.  Archives read
+// from the standard input are decompressed on the way, if need be, and
+// checked; those written to the standard output are followed by their
+// checksum when `mysql_checksum` is set.
+func (xtrabackup XtraBackupEndpoint) tar(cmdString string, flags int) error {
+	opts := ExecOptions{
+		Cmd:        cmdString,
+		Stderr:     os.Stderr,
+		BufferSize: ExecBufferSize,
+		RunAs:      xtrabackup.RunAs,
+	}
+	if flags&STDOUT == STDOUT {
+		opts.Stdout = os.Stdout
+	}
+	if flags&STDIN == STDIN {
+		return untar(opts, os.Stdin)
+	}
+	if opts.Stdout == nil || !xtrabackup.Checksum {
+		return ExecWithOptions(opts)
+	}
+
+	out, err := NewChecksumWriter(os.Stdout)
+	if err != nil {
+		return err
+	}
+	opts.Stdout = out
+	if err = ExecWithOptions(opts); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func (xtrabackup XtraBackupEndpoint) lockOptions() string {
+	opts := ""
+	if xtrabackup.LockDDL {
+		opts += " --lock-ddl"
+	}
+	if xtrabackup.FTWRLWaitTimeout > 0 {
+		opts += fmt.Sprintf(" --ftwrl-wait-timeout=%d", xtrabackup.FTWRLWaitTimeout)
+	}
+	if xtrabackup.KillLongQueriesTimeout > 0 {
+		opts += fmt.Sprintf(" --kill-long-queries-timeout=%d", xtrabackup.KillLongQueriesTimeout)
+	}
+	return opts
+}
+
+// timeoutValue retrieves a timeout, in whole seconds, from the endpoint.
+func timeoutValue(endpoint ShieldEndpoint, key string, def int) (int, error) {
+	f, err := endpoint.FloatValueDefault(key, float64(def))
+	if err != nil {
+		return 0, err
+	}
+	if f < 0 || f != float64(int(f)) {
+		return 0, ConfigError{Key: key, Err: fmt.Errorf("%s must be a whole, non-negative number of seconds", key)}
+	}
+	return int(f), nil
+}
+
+// regexValue retrieves an optional regular expression from the endpoint,
+// making sure that it compiles.
+func regexValue(endpoint ShieldEndpoint, key string) (string, error) {
+	s, err := endpoint.StringValueDefault(key, "")
+	if err != nil {
+		return "", err
+	}
+	if s != "" {
+		if _, err := regexp.Compile(s); err != nil {
+			return "", ConfigError{Key: key, Err: fmt.Errorf("%s is not a valid regular expression: %s", key, err)}
+		}
+	}
+	return s, nil
+}
+
 func getXtraBackupEndpoint(endpoint ShieldEndpoint) (XtraBackupEndpoint, error) {
 	user, err := endpoint.StringValue("mysql_user")
 	if err != nil {
@@ -432,6 +1693,7 @@ func getXtraBackupEndpoint(endpoint ShieldEndpoint) (XtraBackupEndpoint, error)
 		return XtraBackupEndpoint{}, err
 	}
 	DEBUG("MYSQL_PWD: '%s'", password)
+	RegisterSecret(password)
 
 	databases, err := endpoint.StringValueDefault("mysql_databases", "")
 	if err != nil {
@@ -439,10 +1701,46 @@ func getXtraBackupEndpoint(endpoint ShieldEndpoint) (XtraBackupEndpoint, error)
 	}
 	DEBUG("MYSQL_DATABASES: '%s'", databases)
 
-	dataDir, err := endpoint.StringValueDefault("mysql_datadir", DefaultDataDir)
+	databasesExclude, err := endpoint.StringValueDefault("mysql_databases_exclude", "")
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	if databases != "" && databasesExclude != "" {
+		return XtraBackupEndpoint{}, ConfigError{Key: "mysql_databases_exclude", Err: fmt.Errorf("mysql_databases_exclude can't be combined with mysql_databases")}
+	}
+	DEBUG("MYSQL_DATABASES_EXCLUDE: '%s'", databasesExclude)
+
+	tables, err := regexValue(endpoint, "mysql_tables")
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	DEBUG("MYSQL_TABLES: '%s'", tables)
+
+	tablesExclude, err := regexValue(endpoint, "mysql_tables_exclude")
 	if err != nil {
 		return XtraBackupEndpoint{}, err
 	}
+	DEBUG("MYSQL_TABLES_EXCLUDE: '%s'", tablesExclude)
+
+	defaultsFile, err := endpoint.StringValueDefault("mysql_defaults_file", "")
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	DEBUG("MYSQL_DEFAULTS_FILE: '%s'", defaultsFile)
+
+	dataDir := DefaultDataDir
+	if defaultsFile != "" {
+		dataDir = ""
+	}
+	dataDir, err = endpoint.StringValueDefault("mysql_datadir", dataDir)
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	if dataDir == "" && defaultsFile != "" {
+		if dataDir, err = datadirFromDefaults(defaultsFile); err != nil {
+			return XtraBackupEndpoint{}, err
+		}
+	}
 	DEBUG("MYSQL_DATADIR: '%s'", dataDir)
 
 	targetDir, err := endpoint.StringValueDefault("mysql_temp_targetdir", DefaultTempTargetDir)
@@ -463,13 +1761,209 @@ func getXtraBackupEndpoint(endpoint ShieldEndpoint) (XtraBackupEndpoint, error)
 	}
 	DEBUG("MYSQL_TAR: '%s'", tar)
 
+	lockDDL, err := endpoint.BooleanValueDefault("mysql_lock_ddl", DefaultLockDDL)
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	DEBUG("MYSQL_LOCK_DDL: %t", lockDDL)
+
+	ftwrlWait, err := timeoutValue(endpoint, "mysql_ftwrl_wait_timeout", DefaultFTWRLWaitTimeout)
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	DEBUG("MYSQL_FTWRL_WAIT_TIMEOUT: %d", ftwrlWait)
+
+	killLong, err := timeoutValue(endpoint, "mysql_kill_long_queries_timeout", DefaultKillLongQueriesTimeout)
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	DEBUG("MYSQL_KILL_LONG_QUERIES_TIMEOUT: %d", killLong)
+
+	compress, err := endpoint.StringValueDefault("mysql_compress", DefaultCompress)
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	if !validCompression(compress) {
+		return XtraBackupEndpoint{}, ConfigError{Key: "mysql_compress", Err: fmt.Errorf("mysql_compress must be one of quicklz, lz4 or zstd, not '%s'", compress)}
+	}
+	DEBUG("MYSQL_COMPRESS: '%s'", compress)
+
+	useMemory, err := endpoint.StringValueDefault("mysql_use_memory", DefaultUseMemory)
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	if useMemory != "" {
+		if _, err = parseUseMemory(useMemory); err != nil {
+			return XtraBackupEndpoint{}, ConfigError{Key: "mysql_use_memory", Err: err}
+		}
+	}
+	DEBUG("MYSQL_USE_MEMORY: '%s'", useMemory)
+
+	extract, err := endpoint.BooleanValueDefault("mysql_extract_only", DefaultExtractOnly)
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	DEBUG("MYSQL_EXTRACT_ONLY: %t", extract)
+
+	extractDir, err := endpoint.StringValueDefault("mysql_extract_dir", "")
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	DEBUG("MYSQL_EXTRACT_DIR: '%s'", extractDir)
+
+	verify, err := endpoint.BooleanValueDefault("mysql_verify_after_restore", DefaultVerifyAfterRestore)
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	DEBUG("MYSQL_VERIFY_AFTER_RESTORE: %t", verify)
+
+	innochecksum, err := endpoint.StringValueDefault("mysql_innochecksum", DefaultInnochecksum)
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	DEBUG("MYSQL_INNOCHECKSUM: '%s'", innochecksum)
+
+	myisamchk, err := endpoint.StringValueDefault("mysql_myisamchk", DefaultMyisamchk)
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	DEBUG("MYSQL_MYISAMCHK: '%s'", myisamchk)
+
+	innodbConfigFile, err := endpoint.StringValueDefault("mysql_innodb_config_file", "")
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	DEBUG("MYSQL_INNODB_CONFIG_FILE: '%s'", innodbConfigFile)
+
+	runAsName, err := endpoint.StringValueDefault("mysql_run_as", "")
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	DEBUG("MYSQL_RUN_AS: '%s'", runAsName)
+	var runAs *RunAs
+	if runAsName != "" {
+		if runAs, err = LookupRunAs(runAsName); err != nil {
+			return XtraBackupEndpoint{}, ConfigError{Key: "mysql_run_as", Err: err}
+		}
+	}
+
+	safetyBackupDir, err := endpoint.StringValueDefault("mysql_safety_backup_dir", "")
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	DEBUG("MYSQL_SAFETY_BACKUP_DIR: '%s'", safetyBackupDir)
+
+	forcePartial, err := endpoint.BooleanValueDefault("mysql_force_partial_restore", DefaultForcePartialRestore)
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	DEBUG("MYSQL_FORCE_PARTIAL_RESTORE: %t", forcePartial)
+
+	backupGrants, err := endpoint.BooleanValueDefault("mysql_backup_grants", DefaultBackupGrants)
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	DEBUG("MYSQL_BACKUP_GRANTS: %t", backupGrants)
+
+	grantsOnly, err := endpoint.BooleanValueDefault("mysql_restore_grants_only", DefaultRestoreGrantsOnly)
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	if grantsOnly && extract {
+		return XtraBackupEndpoint{}, ConfigError{Key: "mysql_restore_grants_only", Err: fmt.Errorf("mysql_restore_grants_only can't be combined with mysql_extract_only")}
+	}
+	DEBUG("MYSQL_RESTORE_GRANTS_ONLY: %t", grantsOnly)
+
+	client, err := endpoint.StringValueDefault("mysql_client", DefaultClient)
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	DEBUG("MYSQL_CLIENT: '%s'", client)
+
+	socket, err := endpoint.StringValueDefault("mysql_socket", "")
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	if socket != "" && !filepath.IsAbs(socket) {
+		return XtraBackupEndpoint{}, ConfigError{Key: "mysql_socket", Err: fmt.Errorf("mysql_socket must be an absolute path")}
+	}
+	DEBUG("MYSQL_SOCKET: '%s'", socket)
+
+	preview, err := endpoint.BooleanValueDefault("mysql_restore_preview", DefaultRestorePreview)
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	if preview && (extract || grantsOnly) {
+		return XtraBackupEndpoint{}, ConfigError{Key: "mysql_restore_preview", Err: fmt.Errorf("mysql_restore_preview can't be combined with mysql_extract_only or mysql_restore_grants_only")}
+	}
+	DEBUG("MYSQL_RESTORE_PREVIEW: %t", preview)
+
+	slaveInfo, err := endpoint.BooleanValueDefault("mysql_slave_info", DefaultSlaveInfo)
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	DEBUG("MYSQL_SLAVE_INFO: %t", slaveInfo)
+
+	logFile, err := endpoint.StringValueDefault("mysql_log_file", "")
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	if logFile != "" && !filepath.IsAbs(logFile) {
+		return XtraBackupEndpoint{}, ConfigError{Key: "mysql_log_file", Err: fmt.Errorf("mysql_log_file must be an absolute path")}
+	}
+	DEBUG("MYSQL_LOG_FILE: '%s'", logFile)
+
+	checksum, err := endpoint.BooleanValueDefault("mysql_checksum", DefaultChecksum)
+	if err != nil {
+		return XtraBackupEndpoint{}, err
+	}
+	DEBUG("MYSQL_CHECKSUM: %t", checksum)
+
 	return XtraBackupEndpoint{
-		User:      user,
-		Password:  password,
-		Databases: databases,
-		DataDir:   dataDir,
-		TargetDir: targetDir,
-		Bin:       xtrabackupBin,
-		Tar:       tar,
+		User:             user,
+		Password:         password,
+		Databases:        databases,
+		DatabasesExclude: strings.Fields(databasesExclude),
+		Tables:           tables,
+		TablesExclude:    tablesExclude,
+		DataDir:          dataDir,
+		DefaultsFile:     defaultsFile,
+		TargetDir:        targetDir,
+		Bin:              xtrabackupBin,
+		Tar:              tar,
+
+		LockDDL:                lockDDL,
+		FTWRLWaitTimeout:       ftwrlWait,
+		KillLongQueriesTimeout: killLong,
+		Compress:               compress,
+		UseMemory:              useMemory,
+
+		ExtractOnly: extract,
+		ExtractDir:  extractDir,
+
+		VerifyAfterRestore: verify,
+		Innochecksum:       innochecksum,
+		Myisamchk:          myisamchk,
+
+		InnoDBConfigFile: innodbConfigFile,
+
+		RunAs: runAs,
+
+		SafetyBackupDir:     safetyBackupDir,
+		ForcePartialRestore: forcePartial,
+
+		BackupGrants:      backupGrants,
+		RestoreGrantsOnly: grantsOnly,
+		Client:            client,
+
+		Socket: socket,
+
+		RestorePreview: preview,
+
+		SlaveInfo: slaveInfo,
+
+		LogFile: logFile,
+
+		Checksum: checksum,
 	}, nil
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Preparing a backup (`xtrabackup --prepare`) replays the redo log through an
+// InnoDB buffer pool, that `--use-memory` sizes (100M by default).  When
+// `mysql_use_memory` is set, it is passed on, to speed large prepares up on
+// hosts with memory to spare, or to keep them within the limits of small
+// containers.
+
+// useMemoryRegexp matches the sizes `--use-memory` accepts: a number of
+// bytes, or of kilobytes, megabytes or gigabytes.
+var useMemoryRegexp = regexp.MustCompile(`^([0-9]+)([KMG]?)$`)
+
+var useMemoryUnits = map[string]uint{"": 0, "K": 10, "M": 20, "G": 30}
+
+// parseUseMemory returns the number of bytes a `mysql_use_memory` size
+// stands for.
+func parseUseMemory(size string) (int64, error) {
+	m := useMemoryRegexp.FindStringSubmatch(strings.ToUpper(size))
+	if m == nil {
+		return 0, fmt.Errorf("'%s' is not a size (i.e. 512M or 2G)", size)
+	}
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not a size (i.e. 512M or 2G)", size)
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("'%s' leaves no memory to prepare the backup with", size)
+	}
+	return n << useMemoryUnits[m[2]], nil
+}
+
+// prepareCmd returns the command line that prepares the backup in `dir`.
+func (xtrabackup XtraBackupEndpoint) prepareCmd(dir string) string {
+	if xtrabackup.UseMemory == "" {
+		return fmt.Sprintf("%s --prepare --target-dir=%s", xtrabackup.Bin, dir)
+	}
+	return fmt.Sprintf("%s --prepare --use-memory=%s --target-dir=%s", xtrabackup.Bin, xtrabackup.UseMemory, dir)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Prepare Memory", func() {
+	It("parses sizes the way xtrabackup does", func() {
+		for size, bytes := range map[string]int64{
+			"104857600": 104857600,
+			"512K":      512 * 1024,
+			"512M":      512 * 1024 * 1024,
+			"2G":        2 * 1024 * 1024 * 1024,
+			"1g":        1024 * 1024 * 1024,
+		} {
+			Ω(parseUseMemory(size)).Should(Equal(bytes), size)
+		}
+	})
+
+	It("rejects what is not a size", func() {
+		for _, size := range []string{"", "0", "0G", "1.5G", "1T", "G", "-1G", "1 G", "lots"} {
+			_, err := parseUseMemory(size)
+			Ω(err).Should(HaveOccurred(), size)
+		}
+	})
+
+	It("passes the memory on to the prepare command", func() {
+		xtrabackup := XtraBackupEndpoint{Bin: "/bin/xtrabackup"}
+		Ω(xtrabackup.prepareCmd("/tmp/dir")).Should(Equal("/bin/xtrabackup --prepare --target-dir=/tmp/dir"))
+
+		xtrabackup.UseMemory = "2G"
+		Ω(xtrabackup.prepareCmd("/tmp/dir")).Should(Equal("/bin/xtrabackup --prepare --use-memory=2G --target-dir=/tmp/dir"))
+	})
+})
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+// Restore preview
+//
+// With `mysql_restore_preview`, restoring only reads the archive, and
+// reports what it holds: the databases and tables, the version of the
+// backed up server and its binary log position (from the `xtrabackup_info`
+// and `xtrabackup_binlog_info` files xtrabackup saves with each backup, and
+// the position of its master, from `xtrabackup_slave_info`), and how that compares with the data directory and the server in place.
+// The archive is read as it streams in, nothing is written to disk, and
+// neither the data directory nor the server are touched.
+
+var (
+	DefaultRestorePreview      = false
+	DefaultForcePartialRestore = false
+)
+
+const (
+	// InfoFile is the file, at the root of the archive, where xtrabackup
+	// records how the backup was taken.
+	InfoFile = "xtrabackup_info"
+	// BinlogInfoFile is the file, at the root of the archive, where
+	// xtrabackup records the binary log position of the backup.
+	BinlogInfoFile = "xtrabackup_binlog_info"
+)
+
+// previewFiles are the files of the archive that the preview reads.
+var previewFiles = map[string]bool{
+	InfoFile:         true,
+	BinlogInfoFile:   true,
+	SlaveInfoFile:    true,
+	BackupConfigFile: true,
+}
+
+// tableExtensions are the extensions of the files that hold tables, one of
+// which, at least, each table has in its database directory.
+var tableExtensions = map[string]bool{
+	".ibd": true,
+	".frm": true,
+	".MYD": true,
+	".MYI": true,
+	".MRG": true,
+	".CSV": true,
+	".ARZ": true,
+}
+
+// partitionRegexp matches the suffix that partitions (and subpartitions)
+// add to the name of the files of their table.
+var partitionRegexp = regexp.MustCompile(`(?i)#p#.*$`)
+
+// PreviewBackup is what the archive holds.
+type PreviewBackup struct {
+	ServerVersion  string              `json:"server_version"`
+	ToolVersion    string              `json:"tool_version"`
+	StartTime      string              `json:"start_time"`
+	EndTime        string              `json:"end_time"`
+	Partial        bool                `json:"partial"`
+	Compressed     string              `json:"compressed"`
+	BinlogFile     string              `json:"binlog_file"`
+	BinlogPosition string              `json:"binlog_position"`
+	GTID           string              `json:"gtid,omitempty"`
+	Replica        *ReplicaInfo        `json:"replica,omitempty"`
+	Databases      map[string][]string `json:"databases"`
+}
+
+// PreviewServer is what the restore would replace.
+type PreviewServer struct {
+	ServerVersion string              `json:"server_version"`
+	DataDir       string              `json:"datadir"`
+	Databases     map[string][]string `json:"databases"`
+}
+
+// RestorePreview is the report of a restore preview.  Tables are listed as
+// `database.table`, and only for the databases that are both in the backup
+// and in the data directory; the tables of the other databases come and go
+// with them.
+type RestorePreview struct {
+	Backup PreviewBackup `json:"backup"`
+	Server PreviewServer `json:"server"`
+
+	DatabasesAdded   []string `json:"databases_added"`
+	DatabasesRemoved []string `json:"databases_removed"`
+	TablesAdded      []string `json:"tables_added"`
+	TablesRemoved    []string `json:"tables_removed"`
+
+	Warnings []string `json:"warnings"`
+}
+
+// tableOf tells which table a file of the data directory (or of the
+// archive) belongs to, given its path relative to the data directory.
+func tableOf(name string) (db, table string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(path.Clean("/"+name), "/"), "/")
+	if len(parts) != 2 || !isDatabase(parts[0]) {
+		return "", "", false
+	}
+	file := parts[1]
+	if _, compressed := compressedExtensions[path.Ext(file)]; compressed {
+		file = strings.TrimSuffix(file, path.Ext(file))
+	}
+	ext := path.Ext(file)
+	if !tableExtensions[ext] {
+		return "", "", false
+	}
+	return parts[0], partitionRegexp.ReplaceAllString(strings.TrimSuffix(file, ext), ""), true
+}
+
+// isDatabase tells whether a directory, at the root of the data directory,
+// is a database; see listDatabases().
+func isDatabase(name string) bool {
+	return name != "" && name != "." && !strings.HasPrefix(name, "#") && name != "lost+found"
+}
+
+// addTable adds a table to a list of databases, once.
+func addTable(dbs map[string][]string, db, table string) {
+	for _, t := range dbs[db] {
+		if t == table {
+			return
+		}
+	}
+	dbs[db] = append(dbs[db], table)
+}
+
+// parseInfo reads the `key = value` lines of the xtrabackup_info file.
+func parseInfo(b []byte) map[string]string {
+	info := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) == 2 {
+			info[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	return info
+}
+
+// warnPartialBackup warns that the backup unpacked in dir is partial, if
+// its xtrabackup_info file says so, and tells whether it did.  Restores
+// only find out once the archive is unpacked, after the data directory was
+// emptied: they refuse when a safety backup can be rolled back to, and
+// only warn otherwise.  See BACKUP DETAILS.
+func warnPartialBackup(dir string) bool {
+	b, err := ioutil.ReadFile(filepath.Join(dir, InfoFile))
+	if err != nil {
+		DEBUG("unable to read %s (%s); unable to tell whether the backup is partial", InfoFile, err)
+		return false
+	}
+	if parseInfo(b)["partial"] != "Y" {
+		return false
+	}
+	Fprintf(os.Stderr, "@Y{WARNING: the backup is partial; once it is moved back, MySQL still references the InnoDB tables it lacks (see BACKUP DETAILS)}\n")
+	return true
+}
+
+// binlogPosRegexp matches the `binlog_pos` of the xtrabackup_info file, i.e.
+//
+//	filename 'mysql-bin.000003', position '157', GTID of the last change '3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5'
+var binlogPosRegexp = regexp.MustCompile(`filename '([^']*)', position '([^']*)'(?:, GTID of the last change '([^']*)')?`)
+
+// readArchive reads an archive as it streams in, listing its databases and
+// tables, and reading the few files that describe the backup.
+func readArchive(r io.Reader) (PreviewBackup, map[string]string, error) {
+	backup := PreviewBackup{Databases: map[string][]string{}}
+	config := map[string]string{}
+	files := map[string][]byte{}
+
+	archive := tar.NewReader(r)
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return backup, nil, fmt.Errorf("unable to read the archive: %s", err)
+		}
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if algo, ok := compressedExtensions[path.Ext(name)]; ok {
+			backup.Compressed = algo
+		}
+
+		parts := strings.Split(name, "/")
+		if len(parts) == 1 && hdr.Typeflag == tar.TypeDir && isDatabase(name) {
+			if _, ok := backup.Databases[name]; !ok {
+				backup.Databases[name] = []string{}
+			}
+			continue
+		}
+		if db, table, ok := tableOf(name); ok {
+			addTable(backup.Databases, db, table)
+			continue
+		}
+		if previewFiles[name] {
+			if files[name], err = ioutil.ReadAll(archive); err != nil {
+				return backup, nil, fmt.Errorf("unable to read %s from the archive: %s", name, err)
+			}
+		}
+	}
+	for db := range backup.Databases {
+		sort.Strings(backup.Databases[db])
+	}
+
+	info := parseInfo(files[InfoFile])
+	backup.ServerVersion = info["server_version"]
+	backup.ToolVersion = info["tool_version"]
+	backup.StartTime = info["start_time"]
+	backup.EndTime = info["end_time"]
+	backup.Partial = info["partial"] == "Y"
+	if m := binlogPosRegexp.FindStringSubmatch(info["binlog_pos"]); m != nil {
+		backup.BinlogFile, backup.BinlogPosition, backup.GTID = m[1], m[2], m[3]
+	}
+	if b, ok := files[BinlogInfoFile]; ok {
+		/* file, position and GTID set, separated by tabs */
+		cols := strings.Split(strings.TrimSpace(string(b)), "\t")
+		if len(cols) >= 2 {
+			backup.BinlogFile, backup.BinlogPosition = cols[0], cols[1]
+		}
+		if len(cols) >= 3 {
+			backup.GTID = cols[2]
+		}
+	}
+	if b, ok := files[SlaveInfoFile]; ok {
+		replica, err := parseSlaveInfo(b)
+		if err != nil {
+			DEBUG("unable to read the master position of the backup: %s", err)
+		}
+		backup.Replica = replica
+	}
+	if b, ok := files[BackupConfigFile]; ok {
+		groups, err := readOptions(bytes.NewReader(b), BackupConfigFile)
+		if err != nil {
+			return backup, nil, err
+		}
+		config = innodbConfigOf(groups)
+	}
+	return backup, config, nil
+}
+
+// listTables returns the databases of a MySQL data directory, with their
+// tables.
+func listTables(dataDir string) (map[string][]string, error) {
+	names, err := listDatabases(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	dbs := map[string][]string{}
+	for _, db := range names {
+		dbs[db] = []string{}
+		entries, err := ioutil.ReadDir(filepath.Join(dataDir, db))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if _, table, ok := tableOf(db + "/" + entry.Name()); ok && !entry.IsDir() {
+				addTable(dbs, db, table)
+			}
+		}
+		sort.Strings(dbs[db])
+	}
+	return dbs, nil
+}
+
+// missingFrom returns the names of a that b lacks, sorted, each with the
+// given prefix.
+func missingFrom(a, b []string, prefix string) []string {
+	in := map[string]bool{}
+	for _, s := range b {
+		in[s] = true
+	}
+	missing := []string{}
+	for _, s := range a {
+		if !in[s] {
+			missing = append(missing, prefix+s)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// sortedKeys returns the databases of a list of databases, sorted.
+func sortedKeys(m map[string][]string) []string {
+	l := []string{}
+	for k := range m {
+		l = append(l, k)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// series returns the release series of a MySQL version, i.e. 8.0 for
+// 8.0.35-27.
+func series(version string) string {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return version
+	}
+	return parts[0] + "." + parts[1]
+}
+
+// compare fills in the differences between the backup and the server.
+func (p *RestorePreview) compare() {
+	p.DatabasesAdded = missingFrom(sortedKeys(p.Backup.Databases), sortedKeys(p.Server.Databases), "")
+	p.DatabasesRemoved = missingFrom(sortedKeys(p.Server.Databases), sortedKeys(p.Backup.Databases), "")
+	p.TablesAdded = []string{}
+	p.TablesRemoved = []string{}
+	for _, db := range sortedKeys(p.Backup.Databases) {
+		if live, ok := p.Server.Databases[db]; ok {
+			p.TablesAdded = append(p.TablesAdded, missingFrom(p.Backup.Databases[db], live, db+".")...)
+			p.TablesRemoved = append(p.TablesRemoved, missingFrom(live, p.Backup.Databases[db], db+".")...)
+		}
+	}
+
+	if p.Backup.ServerVersion != "" && p.Server.ServerVersion != "" &&
+		series(p.Backup.ServerVersion) != series(p.Server.ServerVersion) {
+		p.Warnings = append(p.Warnings, fmt.Sprintf("the backup was taken from MySQL %s, but the server runs MySQL %s",
+			p.Backup.ServerVersion, p.Server.ServerVersion))
+	}
+	if p.Backup.Partial {
+		p.Warnings = append(p.Warnings, "the backup is partial; see BACKUP DETAILS about restoring it")
+	}
+}
+
+// previewRestore reads the archive from standard input, and reports what
+// restoring it would change, as text on standard error and as JSON on
+// standard output, without restoring anything.
+func previewRestore(xtrabackup XtraBackupEndpoint) error {
+	var (
+		backup PreviewBackup
+		config map[string]string
+	)
+	archive, err := openArchive(os.Stdin)
+	if err == nil {
+		backup, config, err = readArchive(archive)
+		err = archive.close(err)
+	}
+	if err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Reading the archive failed}\n")
+		return err
+	}
+	tables := 0
+	for _, t := range backup.Databases {
+		tables += len(t)
+	}
+	Fprintf(os.Stderr, "@G{\u2713 Read the archive} %d databases, %d tables\n", len(backup.Databases), tables)
+
+	p := RestorePreview{
+		Backup:   backup,
+		Server:   PreviewServer{DataDir: xtrabackup.DataDir, Databases: map[string][]string{}},
+		Warnings: []string{},
+	}
+	if backup.ServerVersion == "" && backup.Compressed != "" {
+		p.Warnings = append(p.Warnings, fmt.Sprintf("the files of the backup are compressed (%s); its server version and binary log position are unknown", backup.Compressed))
+	} else if backup.ServerVersion == "" {
+		p.Warnings = append(p.Warnings, fmt.Sprintf("no %s in the backup; its server version and binary log position are unknown", InfoFile))
+	}
+
+	if v, err := mysqlQuery(xtrabackup, "SELECT VERSION()"); err != nil {
+		DEBUG("unable to query the server version: %s", err)
+		p.Warnings = append(p.Warnings, "the server is not running, or can't be reached; its version is unknown")
+	} else {
+		p.Server.ServerVersion = strings.TrimSpace(v)
+	}
+	if xtrabackup.DataDir == "" {
+		p.Warnings = append(p.Warnings, "mysql_datadir is not set; unable to compare the backup with the data directory")
+	} else if dbs, err := listTables(xtrabackup.DataDir); err != nil {
+		p.Warnings = append(p.Warnings, fmt.Sprintf("unable to read the data directory: %s", err))
+	} else {
+		p.Server.Databases = dbs
+	}
+	if xtrabackup.DefaultsFile != "" && len(config) > 0 {
+		if target, err := innodbConfig(xtrabackup.DefaultsFile); err != nil {
+			p.Warnings = append(p.Warnings, fmt.Sprintf("unable to read the InnoDB settings of %s: %s", xtrabackup.DefaultsFile, err))
+		} else {
+			for _, diff := range diffInnoDBConfig(config, target) {
+				p.Warnings = append(p.Warnings, fmt.Sprintf("%s (%s); MySQL may fail to start on the restored files", diff, xtrabackup.DefaultsFile))
+			}
+		}
+	}
+	p.compare()
+
+	p.report()
+	output, err := json.MarshalIndent(p, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", string(output))
+	return nil
+}
+
+// report prints the preview for humans.
+func (p RestorePreview) report() {
+	unknown := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+	Fprintf(os.Stderr, "Backup:  MySQL @C{%s}, taken with xtrabackup @C{%s}, from %s to %s\n",
+		unknown(p.Backup.ServerVersion), unknown(p.Backup.ToolVersion), unknown(p.Backup.StartTime), unknown(p.Backup.EndTime))
+	if p.Backup.BinlogFile != "" {
+		Fprintf(os.Stderr, "Binlog:  @C{%s} at position @C{%s}\n", p.Backup.BinlogFile, p.Backup.BinlogPosition)
+	}
+	if p.Backup.GTID != "" {
+		Fprintf(os.Stderr, "GTIDs:   @C{%s}\n", p.Backup.GTID)
+	}
+	if p.Backup.Replica != nil {
+		for _, source := range p.Backup.Replica.Sources {
+			Fprintf(os.Stderr, "Master:  @C{%s}\n", source)
+		}
+		if p.Backup.Replica.GTIDPurged != "" {
+			Fprintf(os.Stderr, "Purged:  @C{%s}\n", p.Backup.Replica.GTIDPurged)
+		}
+	}
+	Fprintf(os.Stderr, "Server:  MySQL @C{%s}, data directory %s\n", unknown(p.Server.ServerVersion), unknown(p.Server.DataDir))
+
+	for _, db := range p.DatabasesAdded {
+		Fprintf(os.Stderr, "@G{+ database %s} (%d tables)\n", db, len(p.Backup.Databases[db]))
+	}
+	for _, db := range p.DatabasesRemoved {
+		Fprintf(os.Stderr, "@R{- database %s} (%d tables)\n", db, len(p.Server.Databases[db]))
+	}
+	for _, t := range p.TablesAdded {
+		Fprintf(os.Stderr, "@G{+ table %s}\n", t)
+	}
+	for _, t := range p.TablesRemoved {
+		Fprintf(os.Stderr, "@R{- table %s}\n", t)
+	}
+	for _, w := range p.Warnings {
+		Fprintf(os.Stderr, "@Y{WARNING: %s}\n", w)
+	}
+	Fprintf(os.Stderr, "@Y{Restore preview: nothing was restored; the MySQL data directory was not touched.}\n")
+}
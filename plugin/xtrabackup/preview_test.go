@@ -0,0 +1,282 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("Restore Preview", func() {
+	/* an archive the way the plugin makes them: `tar -cf - -C dir .` */
+	archive := func(files map[string]string) *bytes.Buffer {
+		var b bytes.Buffer
+		w := tar.NewWriter(&b)
+		for name, content := range files {
+			hdr := &tar.Header{Name: name, Mode: 0640, Size: int64(len(content)), Typeflag: tar.TypeReg}
+			if content == "/" {
+				hdr = &tar.Header{Name: name, Mode: 0750, Typeflag: tar.TypeDir}
+			}
+			Ω(w.WriteHeader(hdr)).Should(Succeed())
+			if hdr.Typeflag == tar.TypeReg {
+				_, err := w.Write([]byte(content))
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+		}
+		Ω(w.Close()).Should(Succeed())
+		return &b
+	}
+
+	It("tells which table each file belongs to", func() {
+		for name, table := range map[string]string{
+			"./app/users.ibd":                "app.users",
+			"app/users.frm":                  "app.users",
+			"./app/logs#P#p2017.ibd":         "app.logs",
+			"./app/logs#p#p0#sp#s0.ibd":      "app.logs",
+			"./app/sessions.MYD":             "app.sessions",
+			"./app/orders.ibd.zst":           "app.orders",
+			"./app/db.opt":                   "",
+			"./ibdata1":                      "",
+			"./#innodb_temp/temp_1.ibd":      "",
+			"./app/sub/dir.ibd":              "",
+			"./mysql/innodb_table_stats.ibd": "mysql.innodb_table_stats",
+		} {
+			db, t, ok := tableOf(name)
+			if table == "" {
+				Ω(ok).Should(BeFalse(), name)
+			} else {
+				Ω(ok).Should(BeTrue(), name)
+				Ω(db+"."+t).Should(Equal(table), name)
+			}
+		}
+	})
+
+	It("reads the databases, tables and metadata of the archive", func() {
+		backup, config, err := readArchive(archive(map[string]string{
+			"./":                 "/",
+			"./app/":             "/",
+			"./empty/":           "/",
+			"./app/users.ibd":    "data",
+			"./app/logs#P#a.ibd": "data",
+			"./app/logs#P#b.ibd": "data",
+			"./ibdata1":          "data",
+			"./backup-my.cnf":    "[mysqld]\ninnodb_page_size=16384\n",
+			"./xtrabackup_info": "uuid = 1\ntool_version = 8.0.35-30\nserver_version = 8.0.35\n" +
+				"start_time = 2017-01-01 00:00:00\nend_time = 2017-01-01 00:01:00\npartial = N\n" +
+				"binlog_pos = filename 'mysql-bin.000003', position '157', GTID of the last change 'abc:1-5'\n",
+		}))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(backup.Databases).Should(Equal(map[string][]string{
+			"app":   {"logs", "users"},
+			"empty": {},
+		}))
+		Ω(backup.ServerVersion).Should(Equal("8.0.35"))
+		Ω(backup.ToolVersion).Should(Equal("8.0.35-30"))
+		Ω(backup.StartTime).Should(Equal("2017-01-01 00:00:00"))
+		Ω(backup.Partial).Should(BeFalse())
+		Ω(backup.BinlogFile).Should(Equal("mysql-bin.000003"))
+		Ω(backup.BinlogPosition).Should(Equal("157"))
+		Ω(backup.GTID).Should(Equal("abc:1-5"))
+		Ω(config).Should(Equal(map[string]string{"innodb_page_size": "16384"}))
+	})
+
+	It("prefers the binary log position of xtrabackup_binlog_info", func() {
+		backup, _, err := readArchive(archive(map[string]string{
+			"./xtrabackup_info":        "server_version = 5.7.35-log\nbinlog_pos = filename 'old.000001', position '4'\n",
+			"./xtrabackup_binlog_info": "mysql-bin.000007\t1234\n",
+		}))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(backup.BinlogFile).Should(Equal("mysql-bin.000007"))
+		Ω(backup.BinlogPosition).Should(Equal("1234"))
+		Ω(backup.GTID).Should(Equal(""))
+	})
+
+	It("reads the master position of replica backups", func() {
+		backup, _, err := readArchive(archive(map[string]string{
+			"./xtrabackup_info":       "server_version = 8.0.35\n",
+			"./xtrabackup_slave_info": "CHANGE MASTER TO MASTER_LOG_FILE='mysql-bin.000002', MASTER_LOG_POS=1234\n",
+		}))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(backup.Replica).ShouldNot(BeNil())
+		Ω(backup.Replica.Sources).Should(Equal([]ReplicationSource{{LogFile: "mysql-bin.000002", LogPosition: "1234"}}))
+	})
+
+	It("notices compressed backups", func() {
+		backup, _, err := readArchive(archive(map[string]string{
+			"./app/users.ibd.zst":   "data",
+			"./xtrabackup_info.zst": "data",
+		}))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(backup.Compressed).Should(Equal("zstd"))
+		Ω(backup.Databases).Should(Equal(map[string][]string{"app": {"users"}}))
+		Ω(backup.ServerVersion).Should(Equal(""))
+	})
+
+	It("fails on what is not an archive", func() {
+		_, _, err := readArchive(bytes.NewBufferString("not a tar archive, but long enough to hold a tar header... " + string(make([]byte, 1024))))
+		Ω(err).Should(HaveOccurred())
+	})
+
+	Context("against a data directory", func() {
+		var dataDir string
+
+		BeforeEach(func() {
+			var err error
+			dataDir, err = ioutil.TempDir("", "shield-xtrabackup-preview-")
+			Ω(err).ShouldNot(HaveOccurred())
+			for _, file := range []string{"app/users.ibd", "app/carts.ibd", "app/db.opt", "legacy/t.MYD", "legacy/t.MYI", "#innodb_temp/temp_1.ibd"} {
+				Ω(os.MkdirAll(filepath.Dir(filepath.Join(dataDir, file)), 0755)).Should(Succeed())
+				Ω(ioutil.WriteFile(filepath.Join(dataDir, file), []byte("data"), 0644)).Should(Succeed())
+			}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dataDir)
+		})
+
+		It("lists the tables of the data directory", func() {
+			Ω(listTables(dataDir)).Should(Equal(map[string][]string{
+				"app":    {"carts", "users"},
+				"legacy": {"t"},
+			}))
+		})
+
+		It("reports the databases and tables that a restore would add or delete", func() {
+			live, err := listTables(dataDir)
+			Ω(err).ShouldNot(HaveOccurred())
+			p := RestorePreview{
+				Backup: PreviewBackup{
+					ServerVersion: "5.7.35-log",
+					Databases:     map[string][]string{"app": {"orders", "users"}, "mysql": {"user"}},
+				},
+				Server:   PreviewServer{ServerVersion: "8.0.35", Databases: live},
+				Warnings: []string{},
+			}
+			p.compare()
+			Ω(p.DatabasesAdded).Should(Equal([]string{"mysql"}))
+			Ω(p.DatabasesRemoved).Should(Equal([]string{"legacy"}))
+			Ω(p.TablesAdded).Should(Equal([]string{"app.orders"}))
+			Ω(p.TablesRemoved).Should(Equal([]string{"app.carts"}))
+			Ω(p.Warnings).Should(HaveLen(1))
+			Ω(p.Warnings[0]).Should(ContainSubstring("MySQL 5.7.35-log"))
+		})
+	})
+
+	It("does not warn about versions of the same release series", func() {
+		p := RestorePreview{
+			Backup:   PreviewBackup{ServerVersion: "8.0.35-27", Databases: map[string][]string{}},
+			Server:   PreviewServer{ServerVersion: "8.0.36", Databases: map[string][]string{}},
+			Warnings: []string{},
+		}
+		p.compare()
+		Ω(p.Warnings).Should(BeEmpty())
+		Ω(p.TablesAdded).ShouldNot(BeNil())
+	})
+
+	It("warns about partial backups", func() {
+		p := RestorePreview{
+			Backup:   PreviewBackup{ServerVersion: "8.0.35", Partial: true, Databases: map[string][]string{}},
+			Server:   PreviewServer{ServerVersion: "8.0.35", Databases: map[string][]string{}},
+			Warnings: []string{},
+		}
+		p.compare()
+		Ω(p.Warnings).Should(ConsistOf(ContainSubstring("the backup is partial")))
+	})
+
+	Context("when restoring a partial backup", func() {
+		var (
+			tmp  string
+			fake *FakeExec
+		)
+
+		BeforeEach(func() {
+			var err error
+			tmp, err = ioutil.TempDir("", "shield-xtrabackup-partial-")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(os.MkdirAll(filepath.Join(tmp, "data"), 0755)).Should(Succeed())
+			fake = NewFakeExec()
+		})
+
+		AfterEach(func() {
+			fake.Restore()
+			os.RemoveAll(tmp)
+		})
+
+		It("tells partial backups from the others", func() {
+			Ω(warnPartialBackup(tmp)).Should(BeFalse())
+			Ω(ioutil.WriteFile(filepath.Join(tmp, InfoFile), []byte("tool_version = 8.0.35-30\npartial = N\n"), 0644)).Should(Succeed())
+			Ω(warnPartialBackup(tmp)).Should(BeFalse())
+			Ω(ioutil.WriteFile(filepath.Join(tmp, InfoFile), []byte("tool_version = 8.0.35-30\npartial = Y\n"), 0644)).Should(Succeed())
+			Ω(warnPartialBackup(tmp)).Should(BeTrue())
+		})
+
+		/* restore restores a partial backup over a data directory holding
+		   a single `previous` file, with the given extra settings */
+		restore := func(extra ShieldEndpoint) error {
+			Ω(ioutil.WriteFile(filepath.Join(tmp, "data", "previous"), []byte("previous"), 0644)).Should(Succeed())
+
+			/* MySQL is not running, and the archive is unpacked where asked */
+			fake.On(`^bash -c " ps `, FakeFailure(1, ""))
+			fake.On(`^mkdir -p `, func(opts ExecOptions) error {
+				return os.MkdirAll(strings.TrimPrefix(opts.Cmd, "mkdir -p "), 0755)
+			})
+			fake.On(`^tar -xf - -C `, func(opts ExecOptions) error {
+				_, err := ioutil.ReadAll(opts.Stdin)
+				Ω(err).ShouldNot(HaveOccurred())
+				return ioutil.WriteFile(filepath.Join(strings.TrimPrefix(opts.Cmd, "tar -xf - -C "), InfoFile), []byte("partial = Y\n"), 0644)
+			})
+
+			stdin := os.Stdin
+			defer func() { os.Stdin = stdin }()
+			var err error
+			os.Stdin, err = os.Open(os.DevNull)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer os.Stdin.Close()
+
+			endpoint := ShieldEndpoint{
+				"mysql_user":           "root",
+				"mysql_password":       "s3cr3t",
+				"mysql_xtrabackup":     "/bin/xtrabackup",
+				"mysql_datadir":        filepath.Join(tmp, "data"),
+				"mysql_temp_targetdir": filepath.Join(tmp, "backups"),
+			}
+			for k, v := range extra {
+				endpoint[k] = v
+			}
+			return XtraBackupPlugin{}.Restore(endpoint)
+		}
+
+		It("warns, but still moves it back, without a safety backup", func() {
+			Ω(restore(nil)).Should(Succeed())
+			Ω(fake.Commands()).Should(ContainElement(HavePrefix("/bin/xtrabackup --move-back ")))
+			Ω(filepath.Join(tmp, "data", "previous")).ShouldNot(BeAnExistingFile())
+		})
+
+		It("refuses it, and rolls the data directory back, with a safety backup", func() {
+			err := restore(ShieldEndpoint{"mysql_safety_backup_dir": filepath.Join(tmp, "safety")})
+			Ω(err).Should(MatchError(ContainSubstring("refusing to restore a partial backup")))
+			Ω(fake.Commands()).ShouldNot(ContainElement(ContainSubstring("--prepare")))
+			Ω(fake.Commands()).ShouldNot(ContainElement(ContainSubstring("--move-back")))
+
+			b, err := ioutil.ReadFile(filepath.Join(tmp, "data", "previous"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(b)).Should(Equal("previous"))
+			Ω(filepath.Join(tmp, "data", InfoFile)).ShouldNot(BeAnExistingFile())
+		})
+
+		It("moves it back all the same when forced to", func() {
+			Ω(restore(ShieldEndpoint{
+				"mysql_safety_backup_dir":     filepath.Join(tmp, "safety"),
+				"mysql_force_partial_restore": true,
+			})).Should(Succeed())
+			Ω(fake.Commands()).Should(ContainElement(HavePrefix("/bin/xtrabackup --move-back ")))
+		})
+	})
+})
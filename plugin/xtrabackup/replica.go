@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+// Replica backups
+//
+// When `mysql_slave_info` is true, the backup is taken with `xtrabackup
+// --slave-info`, which records where the backed up replica was in the binary
+// log of its master, in the `xtrabackup_slave_info` file, as the CHANGE
+// MASTER TO statement (and, with GTIDs, the SET GLOBAL gtid_purged one) to
+// run on a server restored from the backup, to make it another replica of
+// the same master.  The plugin prints that position once the backup is done,
+// and the restore preview reports it.
+
+var DefaultSlaveInfo = false
+
+// SlaveInfoFile is the file, at the root of the archive, where xtrabackup
+// records the position of the master of a replica.
+const SlaveInfoFile = "xtrabackup_slave_info"
+
+// ReplicationSource is the position of a replica in the binary log of one
+// of its masters (one per replication channel).
+type ReplicationSource struct {
+	Channel      string `json:"channel,omitempty"`
+	LogFile      string `json:"log_file,omitempty"`
+	LogPosition  string `json:"log_position,omitempty"`
+	AutoPosition bool   `json:"auto_position,omitempty"`
+}
+
+func (s ReplicationSource) String() string {
+	pos := fmt.Sprintf("%s at position %s", s.LogFile, s.LogPosition)
+	if s.AutoPosition {
+		pos = "auto-positioned, with GTIDs"
+	}
+	if s.Channel != "" {
+		pos += fmt.Sprintf(" (channel '%s')", s.Channel)
+	}
+	return pos
+}
+
+// ReplicaInfo is what the xtrabackup_slave_info file of a backup records.
+type ReplicaInfo struct {
+	GTIDPurged string              `json:"gtid_purged,omitempty"`
+	Sources    []ReplicationSource `json:"sources"`
+	Statements string              `json:"statements"`
+}
+
+var (
+	// changeMasterRegexp matches the statements of the xtrabackup_slave_info
+	// file, of the older (CHANGE MASTER TO) or newer (CHANGE REPLICATION
+	// SOURCE TO) syntax, i.e.
+	//
+	//	CHANGE MASTER TO MASTER_LOG_FILE='mysql-bin.000002', MASTER_LOG_POS=1234 FOR CHANNEL 'east';
+	changeMasterRegexp = regexp.MustCompile(`(?i)^CHANGE\s+(?:MASTER|REPLICATION\s+SOURCE)\s+TO\s+(.*?)(?:\s+FOR\s+CHANNEL\s+'([^']*)')?\s*;?$`)
+	logFileRegexp      = regexp.MustCompile(`(?i)\b(?:MASTER|SOURCE)_LOG_FILE\s*=\s*'([^']*)'`)
+	logPosRegexp       = regexp.MustCompile(`(?i)\b(?:MASTER|SOURCE)_LOG_POS\s*=\s*(\d+)`)
+	autoPositionRegexp = regexp.MustCompile(`(?i)\b(?:MASTER|SOURCE)_AUTO_POSITION\s*=\s*1\b`)
+	gtidPurgedRegexp   = regexp.MustCompile(`(?i)^SET\s+GLOBAL\s+gtid_purged\s*=\s*'([^']*)'\s*;?$`)
+)
+
+// parseSlaveInfo reads the xtrabackup_slave_info file, and returns nil when
+// it records nothing, as when the backed up server is not a replica.
+func parseSlaveInfo(b []byte) (*ReplicaInfo, error) {
+	statements := strings.TrimSpace(string(b))
+	if statements == "" {
+		return nil, nil
+	}
+
+	info := &ReplicaInfo{Sources: []ReplicationSource{}, Statements: statements}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if m := gtidPurgedRegexp.FindStringSubmatch(line); m != nil {
+			info.GTIDPurged = m[1]
+			continue
+		}
+		m := changeMasterRegexp.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		source := ReplicationSource{Channel: m[2], AutoPosition: autoPositionRegexp.MatchString(m[1])}
+		if f := logFileRegexp.FindStringSubmatch(m[1]); f != nil {
+			source.LogFile = f[1]
+		}
+		if p := logPosRegexp.FindStringSubmatch(m[1]); p != nil {
+			source.LogPosition = p[1]
+		}
+		if !source.AutoPosition && (source.LogFile == "" || source.LogPosition == "") {
+			return nil, fmt.Errorf("no binary log position in `%s`", line)
+		}
+		info.Sources = append(info.Sources, source)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(info.Sources) == 0 {
+		return nil, fmt.Errorf("no CHANGE MASTER TO statement in %s", SlaveInfoFile)
+	}
+	return info, nil
+}
+
+// slaveInfoOption returns the --slave-info flag, with a leading space, when
+// the endpoint asks for it.
+func (xtrabackup XtraBackupEndpoint) slaveInfoOption() string {
+	if !xtrabackup.SlaveInfo {
+		return ""
+	}
+	return " --slave-info"
+}
+
+// reportSlaveInfo prints the master position that a fresh backup recorded
+// in its xtrabackup_slave_info, along with the statements to run to make a
+// server restored from it a replica of the same master.
+func reportSlaveInfo(dir string) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, SlaveInfoFile))
+	if os.IsNotExist(err) {
+		if compressed, _ := filepath.Glob(filepath.Join(dir, SlaveInfoFile+".*")); len(compressed) > 0 {
+			Fprintf(os.Stderr, "@G{\u2713 Recorded the master position} in %s\n", filepath.Base(compressed[0]))
+			return
+		}
+		Fprintf(os.Stderr, "@Y{WARNING: no %s in the backup; the server may not be a replica, and no master position was recorded}\n", SlaveInfoFile)
+		return
+	}
+	if err != nil {
+		Fprintf(os.Stderr, "@Y{Unable to read the master position of the backup: %s}\n", err)
+		return
+	}
+
+	info, err := parseSlaveInfo(b)
+	if err != nil {
+		Fprintf(os.Stderr, "@Y{Unable to read the master position of the backup: %s}\n", err)
+		return
+	}
+	if info == nil {
+		Fprintf(os.Stderr, "@Y{WARNING: %s is empty; the server may not be a replica, and no master position was recorded}\n", SlaveInfoFile)
+		return
+	}
+	for _, source := range info.Sources {
+		Fprintf(os.Stderr, "@G{\u2713 Recorded the master position} %s\n", source)
+	}
+	Fprintf(os.Stderr, "To make a new replica of the same master from this backup, run:\n%s\n", info.Statements)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Replica Backups", func() {
+	sample := func(name string) *ReplicaInfo {
+		b, err := ioutil.ReadFile(filepath.Join("test", "slave_info", name))
+		Ω(err).ShouldNot(HaveOccurred())
+		info, err := parseSlaveInfo(b)
+		Ω(err).ShouldNot(HaveOccurred())
+		return info
+	}
+
+	It("reads the binary log position of the master", func() {
+		info := sample("position")
+		Ω(info.Sources).Should(Equal([]ReplicationSource{
+			{LogFile: "mysql-bin.000002", LogPosition: "1234"},
+		}))
+		Ω(info.GTIDPurged).Should(Equal(""))
+		Ω(info.Statements).Should(Equal("CHANGE MASTER TO MASTER_LOG_FILE='mysql-bin.000002', MASTER_LOG_POS=1234"))
+		Ω(info.Sources[0].String()).Should(Equal("mysql-bin.000002 at position 1234"))
+	})
+
+	It("reads the purged GTIDs of auto-positioned replicas", func() {
+		info := sample("gtid")
+		Ω(info.Sources).Should(Equal([]ReplicationSource{{AutoPosition: true}}))
+		Ω(info.GTIDPurged).Should(Equal("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5"))
+	})
+
+	It("reads the position of each replication channel", func() {
+		info := sample("channels")
+		Ω(info.Sources).Should(Equal([]ReplicationSource{
+			{Channel: "east", LogFile: "east-bin.000007", LogPosition: "4"},
+			{Channel: "west", LogFile: "west-bin.000012", LogPosition: "98765"},
+		}))
+		Ω(info.Sources[1].String()).Should(Equal("west-bin.000012 at position 98765 (channel 'west')"))
+	})
+
+	It("reads the CHANGE REPLICATION SOURCE TO syntax", func() {
+		info := sample("source")
+		Ω(info.Sources).Should(Equal([]ReplicationSource{
+			{LogFile: "binlog.000042", LogPosition: "157"},
+		}))
+	})
+
+	It("records nothing for servers that are not replicas", func() {
+		Ω(sample("empty")).Should(BeNil())
+	})
+
+	It("fails on statements it can't make sense of", func() {
+		_, err := parseSlaveInfo([]byte("SHOW SLAVE STATUS\n"))
+		Ω(err).Should(HaveOccurred())
+		_, err = parseSlaveInfo([]byte("CHANGE MASTER TO MASTER_LOG_FILE='mysql-bin.000002'\n"))
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("only passes --slave-info when asked to", func() {
+		Ω(XtraBackupEndpoint{}.slaveInfoOption()).Should(Equal(""))
+		Ω(XtraBackupEndpoint{SlaveInfo: true}.slaveInfoOption()).Should(Equal(" --slave-info"))
+	})
+})
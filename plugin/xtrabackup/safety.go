@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+// Safety backups
+//
+// Restoring wipes the MySQL data directory before moving the backup back in
+// place.  When `mysql_safety_backup_dir` is set, the contents of the data
+// directory are moved (renamed, not copied) to a fresh directory below it
+// instead, and moved back if the restore fails, so that a failed restore
+// leaves the server as it was.  The safety backup is only removed once the
+// restore succeeded.  Since files are renamed, the safety backup directory
+// has to be on the same filesystem as the data directory, which also means
+// that it needs no extra disk space.
+
+// safetyBackup is the previous contents of a data directory, moved aside.
+type safetyBackup struct {
+	dataDir string
+	dir     string
+}
+
+// checkSafetyBackupDir makes sure that the contents of the data directory
+// can be moved to dir: it must be an absolute path, and it must not overlap
+// with the data directory.
+func checkSafetyBackupDir(dir, dataDir string) error {
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("%s is not an absolute path", dir)
+	}
+	if within(dir, dataDir) || within(dataDir, dir) {
+		return fmt.Errorf("refusing to use %s as a safety backup directory: it overlaps with the MySQL data directory (%s)", dir, dataDir)
+	}
+	return nil
+}
+
+// moveAside moves the contents of dataDir to a new directory below
+// safetyDir.  When that fails halfway, what was moved is moved back.
+func moveAside(dataDir, safetyDir string) (*safetyBackup, error) {
+	if err := checkSafetyBackupDir(safetyDir, dataDir); err != nil {
+		return nil, ConfigError{Key: "mysql_safety_backup_dir", Err: err}
+	}
+	s := &safetyBackup{
+		dataDir: dataDir,
+		dir:     filepath.Join(safetyDir, "datadir-"+time.Now().Format("20060102-150405")),
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	err := moveEntries(dataDir, s.dir)
+	if le, ok := err.(*os.LinkError); ok && le.Err == syscall.EXDEV {
+		err = fmt.Errorf("%s is not on the same filesystem as the MySQL data directory (%s)", safetyDir, dataDir)
+	}
+	if err != nil {
+		if e := s.moveBack(); e != nil {
+			return nil, fmt.Errorf("%s; moving the files back failed too: %s (they are in %s)", err, e, s.dir)
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// moveEntries renames all the entries of one directory into another.
+func moveEntries(from, to string) error {
+	entries, err := ioutil.ReadDir(from)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err = os.Rename(filepath.Join(from, entry.Name()), filepath.Join(to, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveBack moves the safety backup back to the data directory, and removes
+// the (then empty) safety backup directory.
+func (s *safetyBackup) moveBack() error {
+	if err := moveEntries(s.dir, s.dataDir); err != nil {
+		return err
+	}
+	return os.Remove(s.dir)
+}
+
+// rollback replaces whatever a failed restore left in the data directory
+// with the safety backup.
+func (s *safetyBackup) rollback() error {
+	entries, err := ioutil.ReadDir(s.dataDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err = os.RemoveAll(filepath.Join(s.dataDir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return s.moveBack()
+}
+
+// discard removes the safety backup, once the restore succeeded.
+func (s *safetyBackup) discard() error {
+	return os.RemoveAll(s.dir)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Safety Backups", func() {
+	var tmp, dataDir, safetyDir string
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-xtrabackup-safety-")
+		Ω(err).ShouldNot(HaveOccurred())
+		dataDir = filepath.Join(tmp, "mysql")
+		safetyDir = filepath.Join(tmp, "safety")
+		Ω(os.MkdirAll(filepath.Join(dataDir, "db1"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(dataDir, "ibdata1"), []byte("old"), 0644)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(dataDir, "db1", "t.ibd"), []byte("old"), 0644)).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	contents := func(dir string) []string {
+		names := []string{}
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && path != dir {
+				rel, _ := filepath.Rel(dir, path)
+				names = append(names, rel)
+			}
+			return nil
+		})
+		return names
+	}
+
+	It("moves the datadir contents aside, and back on rollback", func() {
+		s, err := moveAside(dataDir, safetyDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(contents(dataDir)).Should(BeEmpty())
+		Ω(contents(s.dir)).Should(ConsistOf("ibdata1", "db1", "db1/t.ibd"))
+
+		Ω(ioutil.WriteFile(filepath.Join(dataDir, "ibdata1"), []byte("half-restored"), 0644)).Should(Succeed())
+		Ω(os.Mkdir(filepath.Join(dataDir, "db2"), 0755)).Should(Succeed())
+
+		Ω(s.rollback()).Should(Succeed())
+		Ω(contents(dataDir)).Should(ConsistOf("ibdata1", "db1", "db1/t.ibd"))
+		Ω(ioutil.ReadFile(filepath.Join(dataDir, "ibdata1"))).Should(Equal([]byte("old")))
+		Ω(contents(safetyDir)).Should(BeEmpty())
+	})
+
+	It("removes the safety backup once the restore succeeded", func() {
+		s, err := moveAside(dataDir, safetyDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(s.discard()).Should(Succeed())
+		Ω(contents(safetyDir)).Should(BeEmpty())
+	})
+
+	It("refuses safety backup directories that overlap with the datadir", func() {
+		_, err := moveAside(dataDir, filepath.Join(dataDir, "safety"))
+		Ω(err).Should(HaveOccurred())
+		_, err = moveAside(dataDir, tmp)
+		Ω(err).Should(HaveOccurred())
+		_, err = moveAside(dataDir, "safety")
+		Ω(err).Should(HaveOccurred())
+		Ω(contents(dataDir)).Should(ConsistOf("ibdata1", "db1", "db1/t.ibd"))
+	})
+})
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+// The socket of the server
+//
+// xtrabackup takes its locks (and the mysql client runs its queries) through
+// the unix socket of the local server.  Their compiled-in default seldom is
+// where the server actually put it, in containers or BOSH deployments.  So,
+// unless `mysql_socket` says where it is, the socket is looked for, before
+// backups and grants-only restores, in this order:
+//
+//    1. the `socket` setting of `mysql_defaults_file`, in its [xtrabackup],
+//       [client] or [mysqld] group;
+//    2. the `socket` variable of the server, asked over TCP (on the host and
+//       port of the defaults file, or 127.0.0.1:3306) with `mysql_client`;
+//    3. the usual places, in DefaultSockets.
+//
+// The first of those paths that is a socket is passed on, with --socket.
+// When none is, the run fails, with the list of the paths that were tried.
+
+// DefaultSockets are the usual places of the socket of MySQL servers.
+var DefaultSockets = []string{
+	"/var/vcap/sys/run/mysql/mysqld.sock",
+	"/var/vcap/sys/run/pxc-mysql/mysqld.sock",
+	"/var/run/mysqld/mysqld.sock",
+	"/run/mysqld/mysqld.sock",
+	"/var/lib/mysql/mysql.sock",
+	"/tmp/mysql.sock",
+}
+
+// isSocket tells whether there is a socket at path.
+func isSocket(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode()&os.ModeSocket != 0
+}
+
+// socketFromDefaults returns the socket that a MySQL option file sets for
+// xtrabackup and the client, or "" if it sets none.
+func socketFromDefaults(path string) (string, error) {
+	groups, err := readOptionFile(path)
+	if err != nil {
+		return "", err
+	}
+	for _, group := range []string{"xtrabackup", "client", "mysqld"} {
+		if socket, ok := groups[group]["socket"]; ok && socket != "" {
+			return socket, nil
+		}
+	}
+	return "", nil
+}
+
+// socketFromServer asks the server, over TCP, where its socket is.
+func socketFromServer(xtrabackup XtraBackupEndpoint) (string, error) {
+	if xtrabackup.Client == "" {
+		return "", fmt.Errorf("mysql_client is not set")
+	}
+	xtrabackup.tcp = true
+	out, err := mysqlQuery(xtrabackup, "SHOW VARIABLES LIKE 'socket'")
+	if err != nil {
+		return "", err
+	}
+	for _, row := range rows(out) {
+		if cols := strings.SplitN(row, "\t", 2); len(cols) == 2 && cols[0] == "socket" {
+			return cols[1], nil
+		}
+	}
+	return "", nil
+}
+
+// findSocket returns the path of the socket of the server: `mysql_socket`,
+// or the first socket found where it is looked for.
+func findSocket(xtrabackup XtraBackupEndpoint) (string, error) {
+	if xtrabackup.Socket != "" {
+		if !isSocket(xtrabackup.Socket) {
+			return "", ConfigError{Key: "mysql_socket", Err: fmt.Errorf("there is no socket at %s; is the MySQL server running?", xtrabackup.Socket)}
+		}
+		return xtrabackup.Socket, nil
+	}
+
+	tried := []string{}
+	try := func(path, from string) bool {
+		if path == "" {
+			return false
+		}
+		tried = append(tried, path)
+		if !isSocket(path) {
+			DEBUG("no socket at %s (%s)", path, from)
+			return false
+		}
+		DEBUG("found the socket of the server at %s (%s)", path, from)
+		return true
+	}
+
+	if xtrabackup.DefaultsFile != "" {
+		socket, err := socketFromDefaults(xtrabackup.DefaultsFile)
+		if err != nil {
+			DEBUG("unable to read the socket from %s: %s", xtrabackup.DefaultsFile, err)
+		} else if try(socket, "from "+xtrabackup.DefaultsFile) {
+			return socket, nil
+		}
+	}
+
+	if socket, err := socketFromServer(xtrabackup); err != nil {
+		DEBUG("unable to ask the server where its socket is: %s", err)
+	} else if try(socket, "from the server") {
+		return socket, nil
+	}
+
+	for _, socket := range DefaultSockets {
+		if try(socket, "a usual place") {
+			return socket, nil
+		}
+	}
+	return "", fmt.Errorf("unable to find the socket of the MySQL server (tried %s); set mysql_socket to its path", strings.Join(tried, ", "))
+}
+
+// socketOption returns the --socket flag, with a leading space, if the
+// socket is known.
+func (xtrabackup XtraBackupEndpoint) socketOption() string {
+	if xtrabackup.Socket == "" {
+		return ""
+	}
+	return fmt.Sprintf(" --socket=%s", xtrabackup.Socket)
+}
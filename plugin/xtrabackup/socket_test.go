@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("MySQL Socket", func() {
+	var (
+		tmp       string
+		query     func(XtraBackupEndpoint, string) (string, error)
+		defaults  []string
+		listeners []net.Listener
+		asked     bool
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-xtrabackup-")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		query, defaults, listeners, asked = mysqlQuery, DefaultSockets, nil, false
+		DefaultSockets = []string{filepath.Join(tmp, "usual.sock")}
+		mysqlQuery = func(xtrabackup XtraBackupEndpoint, sql string) (string, error) {
+			return "", fmt.Errorf("ERROR 2003 (HY000): Can't connect to MySQL server on '127.0.0.1'")
+		}
+	})
+
+	AfterEach(func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+		mysqlQuery, DefaultSockets = query, defaults
+		os.RemoveAll(tmp)
+	})
+
+	listen := func(name string) string {
+		path := filepath.Join(tmp, name)
+		l, err := net.Listen("unix", path)
+		Ω(err).ShouldNot(HaveOccurred())
+		listeners = append(listeners, l)
+		return path
+	}
+
+	server := func(socket string) {
+		mysqlQuery = func(xtrabackup XtraBackupEndpoint, sql string) (string, error) {
+			Ω(xtrabackup.tcp).Should(BeTrue())
+			Ω(sql).Should(Equal("SHOW VARIABLES LIKE 'socket'"))
+			asked = true
+			return "socket\t" + socket + "\n", nil
+		}
+	}
+
+	defaultsFile := func(content string) string {
+		path := filepath.Join(tmp, "my.cnf")
+		Ω(ioutil.WriteFile(path, []byte(content), 0644)).Should(Succeed())
+		return path
+	}
+
+	It("uses mysql_socket, without looking further", func() {
+		socket := listen("configured.sock")
+		server(listen("server.sock"))
+		Ω(findSocket(XtraBackupEndpoint{Socket: socket, Client: "mysql"})).Should(Equal(socket))
+		Ω(asked).Should(BeFalse())
+	})
+
+	It("fails when mysql_socket is not a socket", func() {
+		listen("usual.sock")
+		_, err := findSocket(XtraBackupEndpoint{Socket: filepath.Join(tmp, "missing.sock")})
+		Ω(err).Should(BeAssignableToTypeOf(ConfigError{}))
+		Ω(err.(ConfigError).Key).Should(Equal("mysql_socket"))
+		Ω(err.Error()).Should(ContainSubstring("missing.sock"))
+	})
+
+	It("reads the socket from the defaults file first", func() {
+		socket := listen("defaults.sock")
+		server(listen("server.sock"))
+		path := defaultsFile("[mysqld]\nsocket = /nowhere.sock\n[client]\nsocket = " + socket + "\n")
+		Ω(findSocket(XtraBackupEndpoint{DefaultsFile: path, Client: "mysql"})).Should(Equal(socket))
+		Ω(asked).Should(BeFalse())
+	})
+
+	It("asks the server, over TCP, when the defaults file sets no socket", func() {
+		socket := listen("server.sock")
+		listen("usual.sock")
+		server(socket)
+		path := defaultsFile("[client]\nport = 3307\n")
+		Ω(findSocket(XtraBackupEndpoint{DefaultsFile: path, Client: "mysql"})).Should(Equal(socket))
+		Ω(asked).Should(BeTrue())
+	})
+
+	It("asks the server when the socket of the defaults file is not there", func() {
+		socket := listen("server.sock")
+		server(socket)
+		path := defaultsFile("[client]\nsocket = " + filepath.Join(tmp, "stale.sock") + "\n")
+		Ω(findSocket(XtraBackupEndpoint{DefaultsFile: path, Client: "mysql"})).Should(Equal(socket))
+	})
+
+	It("falls back to the usual places when the server can't be asked", func() {
+		socket := listen("usual.sock")
+		Ω(findSocket(XtraBackupEndpoint{Client: "mysql"})).Should(Equal(socket))
+		Ω(findSocket(XtraBackupEndpoint{})).Should(Equal(socket))
+	})
+
+	It("lists the paths it tried when there is no socket", func() {
+		server(filepath.Join(tmp, "server.sock"))
+		path := defaultsFile("[client]\nsocket = " + filepath.Join(tmp, "stale.sock") + "\n")
+		_, err := findSocket(XtraBackupEndpoint{DefaultsFile: path, Client: "mysql"})
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring(fmt.Sprintf("tried %s, %s, %s)",
+			filepath.Join(tmp, "stale.sock"), filepath.Join(tmp, "server.sock"), filepath.Join(tmp, "usual.sock"))))
+		Ω(err.Error()).Should(ContainSubstring("set mysql_socket"))
+	})
+
+	It("passes the socket on to xtrabackup and the mysql client", func() {
+		xtrabackup := XtraBackupEndpoint{Client: "mysql", User: "root", Socket: "/run/mysqld/mysqld.sock"}
+		Ω(xtrabackup.socketOption()).Should(Equal(" --socket=/run/mysqld/mysqld.sock"))
+		Ω(xtrabackup.mysqlArgs()).Should(ContainElement("--socket=/run/mysqld/mysqld.sock"))
+
+		xtrabackup.tcp = true
+		Ω(xtrabackup.mysqlArgs()).Should(ContainElement("--protocol=TCP"))
+		Ω(xtrabackup.mysqlArgs()).ShouldNot(ContainElement("--socket=/run/mysqld/mysqld.sock"))
+
+		Ω(XtraBackupEndpoint{}.socketOption()).Should(Equal(""))
+	})
+})
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+// Compressed archives
+//
+// The archives that backups write are plain tar streams, but they may be
+// compressed as a whole on their way to storage, by a step of their own.
+// On restore, the first bytes of the archive are compared with the magic
+// numbers of gzip, bzip2, xz and zstd streams, and a compressed archive is
+// piped through `gzip -dc`, `bzip2 -dc`, `xz -dc` or `zstd -dc` before it is
+// unpacked (or read, for restore previews).  Other archives are unpacked as
+// they come.  This has nothing to do with `mysql_compress`, which compresses
+// the files inside the archive, and which restores undo once unpacked.
+//
+// Once decompressed, archives written with `mysql_checksum` are checked
+// against the checksum that follows them (see plugin/checksum.go), when they
+// have been read to the end, before the restore goes on with what was
+// unpacked.
+
+var DefaultChecksum = false
+
+// streamCompression is a compression that whole archives may come in.
+type streamCompression struct {
+	name  string
+	magic []byte
+	cmd   string
+}
+
+var streamCompressions = []streamCompression{
+	{name: "gzip", magic: []byte{0x1f, 0x8b}, cmd: "gzip -dc"},
+	{name: "bzip2", magic: []byte("BZh"), cmd: "bzip2 -dc"},
+	{name: "xz", magic: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, cmd: "xz -dc"},
+	{name: "zstd", magic: []byte{0x28, 0xb5, 0x2f, 0xfd}, cmd: "zstd -dc"},
+}
+
+// detectCompression tells which compression a stream comes in, given its
+// first bytes, or nil when it is not compressed.  Tar archives start with
+// the name of their first entry, which none of the magic numbers is.
+func detectCompression(header []byte) *streamCompression {
+	for i := range streamCompressions {
+		if bytes.HasPrefix(header, streamCompressions[i].magic) {
+			return &streamCompressions[i]
+		}
+	}
+	return nil
+}
+
+// archiveStream is an archive, decompressed on the way if it came in
+// compressed, and checked if it came with a checksum.
+type archiveStream struct {
+	io.Reader
+	checksum    *ChecksumReader
+	compression *streamCompression
+	pipe        *os.File
+	done        chan error
+}
+
+// openArchive returns the archive read from in, decompressed if need be.
+func openArchive(in io.Reader) (*archiveStream, error) {
+	r := bufio.NewReaderSize(in, 64*1024)
+	header, _ := r.Peek(8)
+	a := &archiveStream{compression: detectCompression(header)}
+	if a.compression == nil {
+		a.checksum = NewChecksumReader(r)
+		a.Reader = a.checksum
+		return a, nil
+	}
+
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	a.pipe, a.done = rd, make(chan error, 1)
+	DEBUG("Executing: `%s`", a.compression.cmd)
+	go func() {
+		err := ExecWithOptions(ExecOptions{
+			Cmd:      a.compression.cmd,
+			Stdin:    r,
+			Stdout:   wr,
+			Stderr:   os.Stderr,
+			ExpectRC: []int{0},
+		})
+		wr.Close()
+		a.done <- err
+	}()
+	a.checksum = NewChecksumReader(rd)
+	a.Reader = a.checksum
+	Fprintf(os.Stderr, "@G{\u2713 The archive is %s-compressed}, decompressing it on the way\n", a.compression.name)
+	return a, nil
+}
+
+// close waits for the decompression, once the archive has been read, with
+// the outcome err.  What was left of the stream (i.e. past the end of the
+// archive) is read first, and checked against the checksum of the archive,
+// if any, unless reading the archive failed.
+func (a *archiveStream) close(err error) error {
+	var checksum ChecksumError
+	if err == nil {
+		err = a.checksum.Verify()
+	} else if errors.As(err, &checksum) {
+		/* tar read up to the end of the stream, where the checksum failed */
+		err = checksum
+	}
+	if a.compression == nil {
+		return err
+	}
+	a.pipe.Close()
+	derr := <-a.done
+	if err != nil {
+		if derr != nil {
+			DEBUG("`%s` failed too: %s", a.compression.cmd, derr)
+		}
+		return err
+	}
+	if derr != nil {
+		return fmt.Errorf("unable to decompress the %s archive: %s", a.compression.name, derr)
+	}
+	return nil
+}
+
+// untar runs a tar command that unpacks the archive read from in, which is
+// decompressed on the way if need be.
+func untar(opts ExecOptions, in io.Reader) error {
+	a, err := openArchive(in)
+	if err != nil {
+		return err
+	}
+	opts.Stdin = a
+	return a.close(ExecWithOptions(opts))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("Compressed Archives", func() {
+	var tmp string
+
+	archive := func() []byte {
+		var b bytes.Buffer
+		w := tar.NewWriter(&b)
+		content := bytes.Repeat([]byte("ibdata"), 10000)
+		Ω(w.WriteHeader(&tar.Header{Name: "./ibdata1", Mode: 0640, Size: int64(len(content)), Typeflag: tar.TypeReg})).Should(Succeed())
+		_, err := w.Write(content)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(w.Close()).Should(Succeed())
+		return b.Bytes()
+	}
+
+	compress := func(tool string, b []byte) []byte {
+		if _, err := exec.LookPath(tool); err != nil {
+			Skip(tool + " is not installed")
+		}
+		cmd := exec.Command(tool, "-c")
+		cmd.Stdin = bytes.NewReader(b)
+		out, err := cmd.Output()
+		Ω(err).ShouldNot(HaveOccurred())
+		return out
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-xtrabackup-")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	It("tells compressed streams from tar archives by their first bytes", func() {
+		Ω(detectCompression(archive())).Should(BeNil())
+		Ω(detectCompression([]byte{})).Should(BeNil())
+		Ω(detectCompression([]byte{0x1f, 0x8b, 0x08}).name).Should(Equal("gzip"))
+		Ω(detectCompression([]byte("BZh91AY")).name).Should(Equal("bzip2"))
+		Ω(detectCompression([]byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00}).name).Should(Equal("xz"))
+		Ω(detectCompression([]byte{0x28, 0xb5, 0x2f, 0xfd, 0x24}).name).Should(Equal("zstd"))
+	})
+
+	for _, tool := range []string{"", "gzip", "bzip2", "xz", "zstd"} {
+		tool := tool
+		name := tool
+		if name == "" {
+			name = "uncompressed"
+		}
+		It("unpacks "+name+" archives", func() {
+			in := archive()
+			if tool != "" {
+				in = compress(tool, in)
+			}
+			opts := ExecOptions{Cmd: "tar -xf - -C " + tmp, Stderr: os.Stderr}
+			Ω(untar(opts, bytes.NewReader(in))).Should(Succeed())
+
+			b, err := ioutil.ReadFile(filepath.Join(tmp, "ibdata1"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(b).Should(Equal(bytes.Repeat([]byte("ibdata"), 10000)))
+		})
+	}
+
+	It("reads compressed archives for restore previews", func() {
+		a, err := openArchive(bytes.NewReader(compress("gzip", archive())))
+		Ω(err).ShouldNot(HaveOccurred())
+		backup, _, err := readArchive(a)
+		Ω(a.close(err)).Should(Succeed())
+		Ω(backup.Compressed).Should(Equal(""))
+	})
+
+	It("fails on corrupted compressed archives", func() {
+		in := compress("gzip", archive())
+		in = append(in[:len(in)/2], bytes.Repeat([]byte{0x42}, 100)...)
+		opts := ExecOptions{Cmd: "tar -xf - -C " + tmp, Stderr: os.Stderr}
+		Ω(untar(opts, bytes.NewReader(in))).ShouldNot(Succeed())
+	})
+
+	checksummed := func(b []byte) []byte {
+		var out bytes.Buffer
+		w, err := NewChecksumWriter(&out)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = w.Write(b)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(w.Close()).Should(Succeed())
+		return out.Bytes()
+	}
+
+	It("unpacks checksummed archives, compressed or not", func() {
+		for _, in := range [][]byte{checksummed(archive()), compress("gzip", checksummed(archive()))} {
+			opts := ExecOptions{Cmd: "tar -xf - -C " + tmp, Stderr: os.Stderr}
+			Ω(untar(opts, bytes.NewReader(in))).Should(Succeed())
+			Ω(ioutil.ReadFile(filepath.Join(tmp, "ibdata1"))).Should(Equal(bytes.Repeat([]byte("ibdata"), 10000)))
+		}
+	})
+
+	It("fails on checksummed archives corrupted in ways tar does not notice", func() {
+		/* a flipped bit in the content of a file, and a stream cut after the archive */
+		flipped := checksummed(archive())
+		flipped[len(flipped)/2] ^= 0x01
+		cut := checksummed(archive())
+		cut = cut[:len(cut)-ChecksumTrailerSize]
+
+		for _, in := range [][]byte{flipped, cut} {
+			opts := ExecOptions{Cmd: "tar -xf - -C " + tmp, Stderr: os.Stderr}
+			err := untar(opts, bytes.NewReader(in))
+			Ω(err).Should(BeAssignableToTypeOf(ChecksumError{}))
+		}
+	})
+})
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+// protectedDirs are never used as the temporary target directory, which
+// gets wiped before and after each backup or restore: a typo in
+// `mysql_temp_targetdir` must not take the system down with it.
+var protectedDirs = map[string]bool{
+	"/":                  true,
+	"/bin":               true,
+	"/boot":              true,
+	"/dev":               true,
+	"/etc":               true,
+	"/home":              true,
+	"/lib":               true,
+	"/lib64":             true,
+	"/opt":               true,
+	"/proc":              true,
+	"/root":              true,
+	"/run":               true,
+	"/sbin":              true,
+	"/srv":               true,
+	"/sys":               true,
+	"/tmp":               true,
+	"/usr":               true,
+	"/var":               true,
+	"/var/lib":           true,
+	"/var/log":           true,
+	"/var/tmp":           true,
+	"/var/vcap":          true,
+	"/var/vcap/data":     true,
+	"/var/vcap/jobs":     true,
+	"/var/vcap/packages": true,
+	"/var/vcap/store":    true,
+	"/var/vcap/sys":      true,
+}
+
+// within tells whether path is dir, or somewhere below it.
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// checkTempTargetDir makes sure that dir can safely be wiped: it must be an
+// absolute path, not a system directory, and it must not overlap with the
+// MySQL data directory.
+func checkTempTargetDir(dir, dataDir string) error {
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("%s is not an absolute path", dir)
+	}
+	dir = filepath.Clean(dir)
+	if protectedDirs[dir] {
+		return fmt.Errorf("refusing to use %s as a temporary directory: it is a system directory", dir)
+	}
+	if dataDir != "" && (within(dir, dataDir) || within(dataDir, dir)) {
+		return fmt.Errorf("refusing to use %s as a temporary directory: it overlaps with the MySQL data directory (%s)", dir, dataDir)
+	}
+	return nil
+}
+
+// clearTempTargetDir removes the temporary target directory, if it exists,
+// and tells whether it did.  The directory is supposed to be removed at the
+// end of each backup or restore; when it is there beforehand, it has been
+// left behind by an interrupted (i.e. killed) run.
+func (xtrabackup XtraBackupEndpoint) clearTempTargetDir() (bool, error) {
+	if err := checkTempTargetDir(xtrabackup.TargetDir, xtrabackup.DataDir); err != nil {
+		return false, ConfigError{Key: "mysql_temp_targetdir", Err: err}
+	}
+
+	fi, err := os.Lstat(xtrabackup.TargetDir)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if fi.IsDir() {
+		err = os.RemoveAll(xtrabackup.TargetDir)
+	} else {
+		err = os.Remove(xtrabackup.TargetDir)
+	}
+	return err == nil, err
+}
+
+// dirSize returns the number of bytes used by the files under dir.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// Cleanup removes the temporary target directory left behind by a backup
+// or a restore that was killed before it could clean up after itself.  It
+// must not be run while a backup or a restore is in progress.
+func (p XtraBackupPlugin) Cleanup(endpoint ShieldEndpoint, dryRun bool) error {
+	xtrabackup, err := getXtraBackupEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+	if err = checkTempTargetDir(xtrabackup.TargetDir, xtrabackup.DataDir); err != nil {
+		Printf("@R{\u2717 %s  %s}\n", xtrabackup.TargetDir, err)
+		return ConfigError{Key: "mysql_temp_targetdir", Err: err}
+	}
+
+	if _, err = os.Lstat(xtrabackup.TargetDir); os.IsNotExist(err) {
+		Printf("@G{\u2713 %s}  does not exist; nothing to clean up\n", xtrabackup.TargetDir)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	size := dirSize(xtrabackup.TargetDir)
+	if dryRun {
+		Printf("@Y{- %s}  left behind by an interrupted run (%d MiB)\n", xtrabackup.TargetDir, size/1024/1024)
+		return nil
+	}
+	if _, err = xtrabackup.clearTempTargetDir(); err != nil {
+		Printf("@R{\u2717 %s  %s}\n", xtrabackup.TargetDir, err)
+		return err
+	}
+	Printf("@G{\u2713 %s}  removed (%d MiB freed)\n", xtrabackup.TargetDir, size/1024/1024)
+	return nil
+}
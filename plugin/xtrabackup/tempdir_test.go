@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+var _ = Describe("Temporary Target Directory", func() {
+	var tmp string
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-xtrabackup-tempdir-")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(os.MkdirAll(filepath.Join(tmp, "data", "app"), 0755)).Should(Succeed())
+		Ω(os.MkdirAll(filepath.Join(tmp, "backups", "app"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "backups", "app", "t.ibd"), []byte("left over"), 0644)).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	It("refuses the directories it must not wipe", func() {
+		for _, t := range []struct {
+			dir     string
+			datadir string
+			refused string
+		}{
+			{"tmp/xtrabackup", "", "not an absolute path"},
+			{"./xtrabackup", "", "not an absolute path"},
+			{"", "", "not an absolute path"},
+
+			{"/", "", "system directory"},
+			{"//", "", "system directory"},
+			{"/tmp", "", "system directory"},
+			{"/tmp/", "", "system directory"},
+			{"/var/vcap/store", "", "system directory"},
+			{"/var/vcap/store/", "", "system directory"},
+			{"/var/vcap/store//", "", "system directory"},
+			{"/var/vcap/./store", "", "system directory"},
+			{"/var/vcap/../vcap/store/", "", "system directory"},
+			{"/var/vcap/store/mysql/..", "", "system directory"},
+			{"/var/vcap/data/../../vcap", "", "system directory"},
+			{"/usr/local/..", "", "system directory"},
+
+			/* the temporary directory inside the data directory, or the other way around */
+			{"/var/vcap/store/mysql", "/var/vcap/store/mysql", "overlaps"},
+			{"/var/vcap/store/mysql/", "/var/vcap/store/mysql", "overlaps"},
+			{"/var/vcap/store/mysql/tmp", "/var/vcap/store/mysql", "overlaps"},
+			{"/var/vcap/store/mysql/tmp", "/var/vcap/store/mysql/", "overlaps"},
+			{"/var/vcap/store/mysql/../mysql/tmp", "/var/vcap/store/mysql", "overlaps"},
+			{"/var/vcap/store/shield", "/var/vcap/store/shield/mysql", "overlaps"},
+			{"/var/vcap/store/shield/", "/var/vcap/store/shield/mysql/data", "overlaps"},
+
+			{"/var/vcap/store/xtrabackup", "/var/vcap/store/mysql", ""},
+			{"/var/vcap/store/mysql-tmp", "/var/vcap/store/mysql", ""},
+			{"/var/vcap/store/mysql", "/var/vcap/store/mysql-data", ""},
+			{"/var/vcap/data/mysql/tmp", "", ""},
+			{"/tmp/xtrabackup", "/var/lib/mysql", ""},
+			{"/var/tmp/..xtrabackup", "/var/lib/mysql", ""},
+		} {
+			err := checkTempTargetDir(t.dir, t.datadir)
+			if t.refused == "" {
+				Ω(err).ShouldNot(HaveOccurred(), "'%s' with mysql_datadir '%s'", t.dir, t.datadir)
+			} else {
+				Ω(err).Should(MatchError(ContainSubstring(t.refused)), "'%s' with mysql_datadir '%s'", t.dir, t.datadir)
+			}
+		}
+	})
+
+	It("clears what is left behind, whatever it is", func() {
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "file"), []byte("not a directory"), 0644)).Should(Succeed())
+		Ω(os.Symlink(filepath.Join(tmp, "data"), filepath.Join(tmp, "link"))).Should(Succeed())
+
+		for _, t := range []struct {
+			dir     string
+			cleared bool
+		}{
+			{"backups", true},
+			{"file", true},
+			{"link", true},
+			{"nothing", false},
+		} {
+			cleared, err := XtraBackupEndpoint{
+				TargetDir: filepath.Join(tmp, t.dir),
+				DataDir:   filepath.Join(tmp, "data"),
+			}.clearTempTargetDir()
+			Ω(err).ShouldNot(HaveOccurred(), "'%s'", t.dir)
+			Ω(cleared).Should(Equal(t.cleared), "'%s'", t.dir)
+			_, err = os.Lstat(filepath.Join(tmp, t.dir))
+			Ω(os.IsNotExist(err)).Should(BeTrue(), "'%s'", t.dir)
+		}
+
+		/* only the link went away, not what it pointed to */
+		Ω(filepath.Join(tmp, "data", "app")).Should(BeADirectory())
+	})
+
+	It("clears nothing it must not wipe", func() {
+		for _, t := range []struct {
+			dir     string
+			datadir string
+		}{
+			{"backups", ""},
+			{tmp + "/backups", tmp + "/backups/app"},
+			{tmp + "/backups/app", tmp + "/backups"},
+			{tmp + "/backups/../backups/", tmp + "/backups"},
+			{"/var/vcap/../vcap/store/", ""},
+		} {
+			cleared, err := XtraBackupEndpoint{TargetDir: t.dir, DataDir: t.datadir}.clearTempTargetDir()
+			Ω(err).Should(BeAssignableToTypeOf(ConfigError{}), "'%s' with mysql_datadir '%s'", t.dir, t.datadir)
+			Ω(cleared).Should(BeFalse())
+		}
+		Ω(ioutil.ReadFile(filepath.Join(tmp, "backups", "app", "t.ibd"))).Should(Equal([]byte("left over")))
+	})
+
+	Context("when cleaning up", func() {
+		var endpoint ShieldEndpoint
+
+		BeforeEach(func() {
+			endpoint = ShieldEndpoint{
+				"mysql_user":           "root",
+				"mysql_password":       "s3cr3t",
+				"mysql_datadir":        filepath.Join(tmp, "data"),
+				"mysql_temp_targetdir": filepath.Join(tmp, "backups"),
+			}
+		})
+
+		It("removes nothing on a dry run", func() {
+			Ω(XtraBackupPlugin{}.Cleanup(endpoint, true)).Should(Succeed())
+			Ω(ioutil.ReadFile(filepath.Join(tmp, "backups", "app", "t.ibd"))).Should(Equal([]byte("left over")))
+			Ω(filepath.Join(tmp, "data", "app")).Should(BeADirectory())
+		})
+
+		It("removes the temporary target directory otherwise", func() {
+			Ω(XtraBackupPlugin{}.Cleanup(endpoint, false)).Should(Succeed())
+			Ω(filepath.Join(tmp, "backups")).ShouldNot(BeAnExistingFile())
+			Ω(filepath.Join(tmp, "data", "app")).Should(BeADirectory())
+
+			/* and then there is nothing left to clean up */
+			Ω(XtraBackupPlugin{}.Cleanup(endpoint, false)).Should(Succeed())
+		})
+
+		It("refuses the directories it must not wipe", func() {
+			endpoint["mysql_temp_targetdir"] = filepath.Join(tmp, "data", "..", "data", "app") + "/"
+			Ω(XtraBackupPlugin{}.Cleanup(endpoint, false)).Should(BeAssignableToTypeOf(ConfigError{}))
+			Ω(filepath.Join(tmp, "data", "app")).Should(BeADirectory())
+		})
+	})
+})
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+var (
+	DefaultVerifyAfterRestore = false
+	DefaultInnochecksum       = "/var/vcap/packages/shield-mysql/bin/innochecksum"
+	DefaultMyisamchk          = "/var/vcap/packages/shield-mysql/bin/myisamchk"
+)
+
+// tablespaceFiles lists the files of a MySQL data directory that can be
+// checked offline: InnoDB tablespaces (for `innochecksum`) and MyISAM
+// indexes (for `myisamchk`).
+func tablespaceFiles(dir string) (innodb []string, myisam []string, err error) {
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		name := info.Name()
+		switch {
+		case strings.HasSuffix(name, ".ibd"), strings.HasPrefix(name, "ibdata"):
+			innodb = append(innodb, path)
+		case strings.HasSuffix(name, ".MYI"):
+			myisam = append(myisam, path)
+		}
+		return nil
+	})
+	return innodb, myisam, err
+}
+
+// verifyDataDir checks the consistency of the restored files, with
+// `innochecksum` for InnoDB tablespaces and `myisamchk` for MyISAM
+// tables.  MySQL must not be running.  All the files are checked, and
+// all the corrupted ones are reported.
+func verifyDataDir(xtrabackup XtraBackupEndpoint, dir string) error {
+	innodb, myisam, err := tablespaceFiles(dir)
+	if err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Verify restored files} unable to list %s\n", dir)
+		return err
+	}
+
+	type check struct {
+		file string
+		cmd  string
+	}
+	checks := []check{}
+	for _, f := range innodb {
+		checks = append(checks, check{f, fmt.Sprintf(`%s "%s"`, xtrabackup.Innochecksum, f)})
+	}
+	for _, f := range myisam {
+		checks = append(checks, check{f, fmt.Sprintf(`%s --check --read-only --silent "%s"`, xtrabackup.Myisamchk, f)})
+	}
+
+	failed := []string{}
+	for _, c := range checks {
+		DEBUG("Executing: `%s`", c.cmd)
+		err = ExecWithOptions(ExecOptions{
+			Cmd:      c.cmd,
+			Stdout:   os.Stderr,
+			ExpectRC: []int{0},
+		})
+		if err != nil {
+			Fprintf(os.Stderr, "@R{\u2717 %s}  %s\n", c.file, err)
+			failed = append(failed, c.file)
+		}
+	}
+
+	if len(failed) > 0 {
+		Fprintf(os.Stderr, "@R{\u2717 Verify restored files} %d of %d file(s) failed verification\n", len(failed), len(checks))
+		return fmt.Errorf("%d restored file(s) failed verification:\n  %s", len(failed), strings.Join(failed, "\n  "))
+	}
+	Fprintf(os.Stderr, "@G{\u2713 Verify restored files} %d InnoDB tablespace(s), %d MyISAM table(s) checked\n", len(innodb), len(myisam))
+	return nil
+}
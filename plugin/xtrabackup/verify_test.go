@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+// checker is an innochecksum (or myisamchk) that fails on the files that
+// contain "corrupted", and logs the files it is asked to check.
+const checker = `#!/bin/sh
+for f; do :; done
+echo "$f" >> $(dirname $0)/checked
+! grep -q corrupted "$f"
+`
+
+var _ = Describe("Restore Verification", func() {
+	var (
+		tmp, dir   string
+		xtrabackup XtraBackupEndpoint
+	)
+
+	file := func(path, content string) {
+		Ω(os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(dir, path), []byte(content), 0644)).Should(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "shield-xtrabackup-verify-")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "innochecksum"), []byte(checker), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "myisamchk"), []byte(checker), 0755)).Should(Succeed())
+
+		dir = filepath.Join(tmp, "data")
+		file("ibdata1", "system tablespace")
+		file("ibdata2", "system tablespace")
+		file("app/users.ibd", "users")
+		file("app/users.frm", "definition")
+		file("app/sessions.MYI", "index")
+		file("app/sessions.MYD", "data")
+		file("mysql/user.MYI", "index")
+		file("ib_logfile0", "redo log")
+		file("xtrabackup_checkpoints", "backup_type = full-prepared")
+
+		xtrabackup = XtraBackupEndpoint{
+			Innochecksum: filepath.Join(tmp, "innochecksum"),
+			Myisamchk:    filepath.Join(tmp, "myisamchk"),
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	checked := func() string {
+		b, err := ioutil.ReadFile(filepath.Join(tmp, "checked"))
+		Ω(err).ShouldNot(HaveOccurred())
+		return string(b)
+	}
+
+	It("selects the InnoDB tablespaces and the MyISAM indexes", func() {
+		innodb, myisam, err := tablespaceFiles(dir)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(innodb).Should(ConsistOf(
+			filepath.Join(dir, "ibdata1"),
+			filepath.Join(dir, "ibdata2"),
+			filepath.Join(dir, "app", "users.ibd")))
+		Ω(myisam).Should(ConsistOf(
+			filepath.Join(dir, "app", "sessions.MYI"),
+			filepath.Join(dir, "mysql", "user.MYI")))
+
+		_, _, err = tablespaceFiles(filepath.Join(tmp, "nope"))
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("checks each of them", func() {
+		Ω(verifyDataDir(xtrabackup, dir)).Should(Succeed())
+		for _, f := range []string{"ibdata1", "ibdata2", "app/users.ibd", "app/sessions.MYI", "mysql/user.MYI"} {
+			Ω(checked()).Should(ContainSubstring(filepath.Join(dir, f) + "\n"))
+		}
+		Ω(checked()).ShouldNot(ContainSubstring("MYD"))
+	})
+
+	It("reports every file that fails, once they are all checked", func() {
+		file("ibdata2", "corrupted")
+		file("app/sessions.MYI", "corrupted")
+
+		err := verifyDataDir(xtrabackup, dir)
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(HavePrefix("2 restored file(s) failed verification"))
+		Ω(err.Error()).Should(ContainSubstring(filepath.Join(dir, "ibdata2")))
+		Ω(err.Error()).Should(ContainSubstring(filepath.Join(dir, "app", "sessions.MYI")))
+		Ω(err.Error()).ShouldNot(ContainSubstring("users.ibd"))
+		Ω(checked()).Should(ContainSubstring(filepath.Join(dir, "mysql", "user.MYI")))
+	})
+
+	It("fails the restore when a restored file fails", func() {
+		file("app/users.ibd", "corrupted")
+		Ω(exec.Command("tar", "-cf", filepath.Join(tmp, "archive"), "-C", dir, ".").Run()).Should(Succeed())
+
+		stdin := os.Stdin
+		defer func() { os.Stdin = stdin }()
+		var err error
+		os.Stdin, err = os.Open(filepath.Join(tmp, "archive"))
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.Stdin.Close()
+
+		err = XtraBackupPlugin{}.Restore(ShieldEndpoint{
+			"mysql_user":                 "root",
+			"mysql_password":             "s3cr3t",
+			"mysql_xtrabackup":           "/bin/true",
+			"mysql_datadir":              filepath.Join(tmp, "live"),
+			"mysql_extract_only":         true,
+			"mysql_extract_dir":          filepath.Join(tmp, "extract"),
+			"mysql_verify_after_restore": true,
+			"mysql_innochecksum":         xtrabackup.Innochecksum,
+			"mysql_myisamchk":            xtrabackup.Myisamchk,
+		})
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring(filepath.Join(tmp, "extract", "app", "users.ibd")))
+	})
+})
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	. "github.com/starkandwayne/shield/plugin"
+)
+
+// XtraBackupVersion is the version of the xtrabackup binary, as reported by
+// `xtrabackup --version`.
+type XtraBackupVersion struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+func (v XtraBackupVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+func (v XtraBackupVersion) less(o XtraBackupVersion) bool {
+	if v.Major != o.Major {
+		return v.Major < o.Major
+	}
+	if v.Minor != o.Minor {
+		return v.Minor < o.Minor
+	}
+	return v.Patch < o.Patch
+}
+
+// since tells whether the version has a feature that appeared in the given
+// releases, one per release series (i.e. 2.4.21 and 8.0.20).  Series that
+// are newer than all of them have it too.
+func (v XtraBackupVersion) since(releases ...XtraBackupVersion) bool {
+	for _, r := range releases {
+		if v.Major == r.Major && v.Minor == r.Minor {
+			return !v.less(r)
+		}
+	}
+	return releases[len(releases)-1].less(v)
+}
+
+var versionRegexp = regexp.MustCompile(`xtrabackup version (\d+)\.(\d+)\.(\d+)`)
+
+// parseXtraBackupVersion extracts the version from what `xtrabackup
+// --version` prints, i.e.
+//
+//	xtrabackup version 2.4.24 based on MySQL server 5.7.35 Linux (x86_64) (revision id: b4ee263)
+//	xtrabackup version 8.0.35-30 based on MySQL server 8.0.35 Linux (x86_64) (revision id: 6beb4b49)
+func parseXtraBackupVersion(out string) (XtraBackupVersion, error) {
+	m := versionRegexp.FindStringSubmatch(out)
+	if m == nil {
+		return XtraBackupVersion{}, fmt.Errorf("unable to find the xtrabackup version in `%s`", strings.TrimSpace(out))
+	}
+	n := make([]int, 3)
+	for i := range n {
+		n[i], _ = strconv.Atoi(m[i+1])
+	}
+	return XtraBackupVersion{Major: n[0], Minor: n[1], Patch: n[2]}, nil
+}
+
+// xtrabackupVersion runs `xtrabackup --version`, which prints its version
+// on standard error.
+var xtrabackupVersion = func(bin string) ([]byte, error) {
+	DEBUG("Executing: `%s --version`", bin)
+	return exec.Command(bin, "--version").CombinedOutput()
+}
+
+// version returns the version of the xtrabackup binary, which is only run
+// once; the result is cached in the endpoint.
+func (xtrabackup *XtraBackupEndpoint) version() (XtraBackupVersion, error) {
+	if xtrabackup.Version != nil {
+		return *xtrabackup.Version, nil
+	}
+	out, err := xtrabackupVersion(xtrabackup.Bin)
+	if err != nil {
+		return XtraBackupVersion{}, fmt.Errorf("unable to run `%s --version`: %s", xtrabackup.Bin, err)
+	}
+	v, err := parseXtraBackupVersion(string(out))
+	if err != nil {
+		return XtraBackupVersion{}, err
+	}
+	DEBUG("XTRABACKUP_VERSION: %s", v)
+	xtrabackup.Version = &v
+	return v, nil
+}
+
+// compressionReleases lists, for each value of `mysql_compress`, the
+// releases that introduced it.
+var compressionReleases = map[string][]XtraBackupVersion{
+	"quicklz": {{2, 4, 0}},
+	"lz4":     {{2, 4, 21}, {8, 0, 20}},
+	"zstd":    {{8, 0, 30}},
+}
+
+// compressedExtensions maps the extension xtrabackup gives to compressed
+// files to the algorithm that compressed them.
+var compressedExtensions = map[string]string{
+	".qp":  "quicklz",
+	".lz4": "lz4",
+	".zst": "zstd",
+}
+
+func validCompression(algo string) bool {
+	_, ok := compressionReleases[algo]
+	return algo == "" || ok
+}
+
+// checkCompression makes sure the xtrabackup binary can (de)compress
+// backups with the given algorithm.
+func (xtrabackup *XtraBackupEndpoint) checkCompression(algo string) error {
+	if algo == "" {
+		return nil
+	}
+	v, err := xtrabackup.version()
+	if err != nil {
+		return err
+	}
+	if !v.since(compressionReleases[algo]...) {
+		releases := []string{}
+		for _, r := range compressionReleases[algo] {
+			releases = append(releases, r.String())
+		}
+		return fmt.Errorf("xtrabackup %s does not support %s compression (it requires xtrabackup %s or later)",
+			v, algo, strings.Join(releases, " / "))
+	}
+	return nil
+}
+
+// checkFeatures makes sure the xtrabackup binary supports what the endpoint
+// asks the backup for, so that it fails with a clear message, instead of an
+// `unknown option` buried in the xtrabackup output.
+func (xtrabackup *XtraBackupEndpoint) checkFeatures() error {
+	if xtrabackup.LockDDL {
+		v, err := xtrabackup.version()
+		if err != nil {
+			return err
+		}
+		if !v.since(XtraBackupVersion{2, 4, 8}, XtraBackupVersion{8, 0, 0}) {
+			return ConfigError{Key: "mysql_lock_ddl", Err: fmt.Errorf("xtrabackup %s does not support --lock-ddl (it requires xtrabackup 2.4.8 or later)", v)}
+		}
+	}
+	if err := xtrabackup.checkCompression(xtrabackup.Compress); err != nil {
+		return ConfigError{Key: "mysql_compress", Err: err}
+	}
+	return nil
+}
+
+// compressOption returns the --compress flag, with a leading space, unless
+// the backup is not compressed.
+func (xtrabackup XtraBackupEndpoint) compressOption() string {
+	if xtrabackup.Compress == "" {
+		return ""
+	}
+	return fmt.Sprintf(" --compress=%s", xtrabackup.Compress)
+}
+
+var errCompressed = fmt.Errorf("compressed file found")
+
+// compressedWith tells which algorithm compressed the files of an unpacked
+// backup, if any.
+func compressedWith(dir string) (string, error) {
+	algo := ""
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if a, ok := compressedExtensions[filepath.Ext(path)]; ok && !info.IsDir() {
+			algo = a
+			return errCompressed
+		}
+		return nil
+	})
+	if err == errCompressed {
+		err = nil
+	}
+	return algo, err
+}
+
+// decompress decompresses an unpacked backup in place, if it was compressed,
+// since it has to be before it can be prepared.
+func (xtrabackup *XtraBackupEndpoint) decompress(dir string) error {
+	algo, err := compressedWith(dir)
+	if err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Checking backup compression failed}\n")
+		return err
+	}
+	if algo == "" {
+		return nil
+	}
+	if err = xtrabackup.checkCompression(algo); err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Backup is compressed with %s}\n", algo)
+		return err
+	}
+
+	cmdString := fmt.Sprintf("%s --decompress --remove-original --target-dir=%s", xtrabackup.Bin, dir)
+	opts := ExecOptions{
+		Cmd:      cmdString,
+		Stdout:   os.Stdout,
+		ExpectRC: []int{0},
+		RunAs:    xtrabackup.RunAs,
+	}
+	DEBUG("Executing: `%s`", cmdString)
+	if err = ExecWithOptions(opts); err != nil {
+		Fprintf(os.Stderr, "@R{\u2717 Decompressing backup files failed}\n")
+		return err
+	}
+	Fprintf(os.Stderr, "@G{\u2713 Decompressed backup files} (%s)\n", algo)
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	version24 = `xtrabackup: recognized server arguments: --datadir=/var/lib/mysql
+xtrabackup version 2.4.24 based on MySQL server 5.7.35 Linux (x86_64) (revision id: b4ee263)
+`
+	version80 = `xtrabackup: recognized server arguments: --datadir=/var/lib/mysql
+xtrabackup version 8.0.35-30 based on MySQL server 8.0.35 Linux (x86_64) (revision id: 6beb4b49)
+`
+)
+
+var _ = Describe("XtraBackup Versions", func() {
+	var (
+		runs        int
+		output      string
+		realVersion func(string) ([]byte, error)
+	)
+
+	BeforeEach(func() {
+		runs = 0
+		realVersion = xtrabackupVersion
+		xtrabackupVersion = func(bin string) ([]byte, error) {
+			runs++
+			return []byte(output), nil
+		}
+	})
+
+	AfterEach(func() {
+		xtrabackupVersion = realVersion
+	})
+
+	It("parses the version of the 2.4 and 8.0 series", func() {
+		v, err := parseXtraBackupVersion(version24)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(v).Should(Equal(XtraBackupVersion{Major: 2, Minor: 4, Patch: 24}))
+
+		v, err = parseXtraBackupVersion(version80)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(v).Should(Equal(XtraBackupVersion{Major: 8, Minor: 0, Patch: 35}))
+		Ω(v.String()).Should(Equal("8.0.35"))
+
+		_, err = parseXtraBackupVersion("command not found")
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("compares versions within, and across, release series", func() {
+		lz4 := compressionReleases["lz4"]
+		Ω(XtraBackupVersion{2, 4, 20}.since(lz4...)).Should(BeFalse())
+		Ω(XtraBackupVersion{2, 4, 21}.since(lz4...)).Should(BeTrue())
+		Ω(XtraBackupVersion{8, 0, 19}.since(lz4...)).Should(BeFalse())
+		Ω(XtraBackupVersion{8, 0, 20}.since(lz4...)).Should(BeTrue())
+		Ω(XtraBackupVersion{8, 4, 0}.since(lz4...)).Should(BeTrue())
+		Ω(XtraBackupVersion{2, 3, 10}.since(lz4...)).Should(BeFalse())
+	})
+
+	It("only runs xtrabackup --version once", func() {
+		output = version80
+		xtrabackup := XtraBackupEndpoint{Bin: "xtrabackup", Compress: "zstd", LockDDL: true}
+		Ω(xtrabackup.checkFeatures()).Should(Succeed())
+		Ω(xtrabackup.checkFeatures()).Should(Succeed())
+		Ω(xtrabackup.Version).ShouldNot(BeNil())
+		Ω(runs).Should(Equal(1))
+	})
+
+	It("builds the command line for the requested compression", func() {
+		Ω(XtraBackupEndpoint{}.compressOption()).Should(Equal(""))
+		Ω(XtraBackupEndpoint{Compress: "lz4"}.compressOption()).Should(Equal(" --compress=lz4"))
+	})
+
+	It("refuses zstd compression with xtrabackup 2.4", func() {
+		output = version24
+		xtrabackup := XtraBackupEndpoint{Bin: "xtrabackup", Compress: "zstd"}
+		err := xtrabackup.checkFeatures()
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("xtrabackup 2.4.24 does not support zstd compression (it requires xtrabackup 8.0.30 or later)"))
+
+		xtrabackup = XtraBackupEndpoint{Bin: "xtrabackup", Compress: "quicklz", LockDDL: true}
+		Ω(xtrabackup.checkFeatures()).Should(Succeed())
+	})
+
+	It("does not run xtrabackup --version when no feature needs it", func() {
+		xtrabackup := XtraBackupEndpoint{Bin: "xtrabackup"}
+		Ω(xtrabackup.checkFeatures()).Should(Succeed())
+		Ω(runs).Should(Equal(0))
+	})
+
+	It("tells which algorithm compressed an unpacked backup", func() {
+		tmp, err := ioutil.TempDir("", "shield-xtrabackup-")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(tmp)
+
+		Ω(os.Mkdir(filepath.Join(tmp, "db1"), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "xtrabackup_checkpoints"), nil, 0644)).Should(Succeed())
+		algo, err := compressedWith(tmp)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(algo).Should(Equal(""))
+
+		Ω(ioutil.WriteFile(filepath.Join(tmp, "db1", "t1.ibd.zst"), nil, 0644)).Should(Succeed())
+		algo, err = compressedWith(tmp)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(algo).Should(Equal("zstd"))
+	})
+})
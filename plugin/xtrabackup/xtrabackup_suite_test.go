@@ -0,0 +1,12 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"testing"
+)
+
+func TestXtraBackupPlugin(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "XtraBackup Plugin Test Suite")
+}